@@ -33,9 +33,7 @@ import (
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
-	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tun"
-	"os"
 )
 
 type PsiphonProvider interface {
@@ -229,38 +227,16 @@ func storeServerEntries(
 	config *psiphon.Config,
 	embeddedServerEntryListFilename, embeddedServerEntryList string) error {
 
+	var source psiphon.ServerEntrySource
 	if embeddedServerEntryListFilename != "" {
-
-		file, err := os.Open(embeddedServerEntryListFilename)
-		if err != nil {
-			return fmt.Errorf("error reading embedded server list file: %s", common.ContextError(err))
-		}
-		defer file.Close()
-
-		err = psiphon.StreamingStoreServerEntries(
-			config,
-			protocol.NewStreamingServerEntryDecoder(
-				file,
-				common.GetCurrentTimestamp(),
-				protocol.SERVER_ENTRY_SOURCE_EMBEDDED),
-			false)
-		if err != nil {
-			return fmt.Errorf("error storing embedded server list: %s", common.ContextError(err))
-		}
-
+		source = psiphon.NewEmbeddedServerEntryFileSource(embeddedServerEntryListFilename)
 	} else {
+		source = psiphon.NewEmbeddedServerEntrySource(embeddedServerEntryList)
+	}
 
-		serverEntries, err := protocol.DecodeServerEntryList(
-			embeddedServerEntryList,
-			common.GetCurrentTimestamp(),
-			protocol.SERVER_ENTRY_SOURCE_EMBEDDED)
-		if err != nil {
-			return fmt.Errorf("error decoding embedded server list: %s", err)
-		}
-		err = psiphon.StoreServerEntries(config, serverEntries, false)
-		if err != nil {
-			return fmt.Errorf("error storing embedded server list: %s", err)
-		}
+	err := psiphon.StoreServerEntrySource(context.Background(), config, source, false)
+	if err != nil {
+		return fmt.Errorf("error storing embedded server list: %s", common.ContextError(err))
 	}
 
 	return nil
@@ -29,6 +29,7 @@ import (
 	"os"
 	"syscall"
 
+	"github.com/Psiphon-Inc/dns"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 )
 
@@ -44,6 +45,14 @@ func LookupIP(ctx context.Context, host string, config *DialConfig) ([]net.IP, e
 		return []net.IP{ip}, nil
 	}
 
+	if config.BootstrapDohUrl != "" {
+		ips, err := bootstrapDohLookupIP(ctx, host, config)
+		if err == nil {
+			return ips, nil
+		}
+		NoticeAlert("bootstrap DoH resolve host %s failed: %s", host, err)
+	}
+
 	if config.DeviceBinder != nil {
 
 		dnsServer := config.DnsServerGetter.GetPrimaryDnsServer()
@@ -162,8 +171,15 @@ func bindLookupIP(
 
 	resultChannel := make(chan resolveIPResult)
 
+	// Only query for IPv6 addresses when an address family preference is
+	// configured; otherwise the dialer continues to use IPv4 only.
+	queryTypes := []uint16{dns.TypeA}
+	if config.IPAddressFamilyPreference != "" {
+		queryTypes = append(queryTypes, dns.TypeAAAA)
+	}
+
 	go func() {
-		ips, _, err := ResolveIP(host, netConn)
+		ips, _, err := resolveIP(host, netConn, queryTypes...)
 		netConn.Close()
 		resultChannel <- resolveIPResult{ips: ips, err: err}
 	}()
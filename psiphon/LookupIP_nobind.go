@@ -37,6 +37,14 @@ func LookupIP(ctx context.Context, host string, config *DialConfig) ([]net.IP, e
 		return nil, common.ContextError(errors.New("LookupIP with DeviceBinder not supported on this platform"))
 	}
 
+	if config.BootstrapDohUrl != "" && net.ParseIP(host) == nil {
+		ips, err := bootstrapDohLookupIP(ctx, host, config)
+		if err == nil {
+			return ips, nil
+		}
+		NoticeAlert("bootstrap DoH resolve host %s failed: %s", host, err)
+	}
+
 	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
 	if err != nil {
 		return nil, common.ContextError(err)
@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/quic"
+)
+
+// DialQUIC establishes a QUIC connection to addr and returns a net.Conn,
+// over a single QUIC stream, which supports the Closer interface.
+//
+// As QUIC runs over UDP, UpstreamProxyURL is not supported; QUIC tunnel
+// protocols are not selected when an upstream proxy is configured.
+// DeviceBinder and SocketFwmark are applied to the UDP socket.
+func DialQUIC(
+	ctx context.Context, addr string, config *DialConfig) (net.Conn, error) {
+
+	if config.UpstreamProxyURL != "" {
+		return nil, common.ContextError(errors.New("QUIC with UpstreamProxyURL not supported"))
+	}
+
+	host, strPort, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	port, err := strconv.Atoi(strPort)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	ipAddrs, err := LookupIP(ctx, host, config)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	conn, err := dialIPAddresses(
+		ctx,
+		ipAddrs,
+		config.IPAddressFamilyPreference,
+		func(ctx context.Context, ipAddr net.IP) (net.Conn, error) {
+
+			packetConn, err := udpListen(ipAddr, config)
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+
+			// quic.Dial closes packetConn on failure.
+			conn, err := quic.Dial(
+				ctx, packetConn, &net.UDPAddr{IP: ipAddr, Port: port})
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+
+			return conn, nil
+		})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if config.ResolvedIPCallback != nil {
+		ipAddress := common.IPAddressFromAddr(conn.RemoteAddr())
+		if ipAddress != "" {
+			config.ResolvedIPCallback(ipAddress)
+		}
+	}
+
+	return conn, nil
+}
@@ -23,13 +23,31 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"sync/atomic"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/upstreamproxy"
 )
 
+const (
+	IP_ADDRESS_FAMILY_PREFER_IPV4    = "prefer-ipv4"
+	IP_ADDRESS_FAMILY_PREFER_IPV6    = "prefer-ipv6"
+	IP_ADDRESS_FAMILY_HAPPY_EYEBALLS = "happy-eyeballs"
+
+	// happyEyeballsAttemptDelay is the delay before starting the next
+	// connection attempt while previous attempts are still in progress,
+	// as recommended in RFC 8305.
+	happyEyeballsAttemptDelay = 250 * time.Millisecond
+
+	// MIN_SOCKET_BUFFER_SIZE and MAX_SOCKET_BUFFER_SIZE bound the
+	// TunnelSocketReadBuffer and TunnelSocketWriteBuffer sizes.
+	MIN_SOCKET_BUFFER_SIZE = 4096
+	MAX_SOCKET_BUFFER_SIZE = 16 * 1024 * 1024
+)
+
 // TCPConn is a customized TCP connection that supports the Closer interface
 // and which may be created using options in DialConfig, including
 // UpstreamProxyURL, DeviceBinder, IPv6Synthesizer, and ResolvedIPCallback.
@@ -182,3 +200,173 @@ func (conn *TCPConn) CloseWrite() (err error) {
 
 	return tcpConn.CloseWrite()
 }
+
+// dialIPAddresses attempts to connect to one of ipAddrs, using dial, in the
+// order determined by preference; see IPAddressFamilyPreference. With
+// IP_ADDRESS_FAMILY_HAPPY_EYEBALLS, attempts are raced, with staggered
+// starts; otherwise, attempts are made serially until one succeeds or the
+// dial context is done.
+//
+// Unlike net.Dial, we do not fractionalize the context deadline, as the dial
+// is generally intended to apply to a single attempt. So serial retries are
+// most useful in cases of immediate failure, such as "no route to host"
+// errors when a host resolves to both IPv4 and IPv6 but IPv6 addresses are
+// unreachable.
+func dialIPAddresses(
+	ctx context.Context,
+	ipAddrs []net.IP,
+	preference string,
+	dial func(context.Context, net.IP) (net.Conn, error)) (net.Conn, error) {
+
+	if len(ipAddrs) < 1 {
+		return nil, common.ContextError(errors.New("no IP address"))
+	}
+
+	ipAddrs = orderIPAddresses(ipAddrs, preference)
+
+	if preference == IP_ADDRESS_FAMILY_HAPPY_EYEBALLS {
+		return happyEyeballsDial(ctx, ipAddrs, dial)
+	}
+
+	var lastErr error
+
+	for _, ipAddr := range ipAddrs {
+
+		conn, err := dial(ctx, ipAddr)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+
+		if ctx.Err() != nil {
+			// Skip retry as dial context has timed out of been canceled.
+			break
+		}
+	}
+
+	return nil, common.ContextError(lastErr)
+}
+
+// orderIPAddresses returns a pseudorandom permutation of ipAddrs, arranged
+// according to preference. For IP_ADDRESS_FAMILY_HAPPY_EYEBALLS, the address
+// families are interleaved, starting with IPv6.
+func orderIPAddresses(ipAddrs []net.IP, preference string) []net.IP {
+
+	var ipv4Addrs, ipv6Addrs []net.IP
+	permuted := make([]net.IP, len(ipAddrs))
+
+	for i, index := range rand.Perm(len(ipAddrs)) {
+		ipAddr := ipAddrs[index]
+		permuted[i] = ipAddr
+		if ipAddr.To4() != nil {
+			ipv4Addrs = append(ipv4Addrs, ipAddr)
+		} else {
+			ipv6Addrs = append(ipv6Addrs, ipAddr)
+		}
+	}
+
+	switch preference {
+
+	case IP_ADDRESS_FAMILY_PREFER_IPV4:
+		return append(ipv4Addrs, ipv6Addrs...)
+
+	case IP_ADDRESS_FAMILY_PREFER_IPV6:
+		return append(ipv6Addrs, ipv4Addrs...)
+
+	case IP_ADDRESS_FAMILY_HAPPY_EYEBALLS:
+		ordered := make([]net.IP, 0, len(ipAddrs))
+		for i := 0; i < len(ipv4Addrs) || i < len(ipv6Addrs); i++ {
+			if i < len(ipv6Addrs) {
+				ordered = append(ordered, ipv6Addrs[i])
+			}
+			if i < len(ipv4Addrs) {
+				ordered = append(ordered, ipv4Addrs[i])
+			}
+		}
+		return ordered
+	}
+
+	return permuted
+}
+
+// happyEyeballsDial races connection attempts to ipAddrs, in order. Each
+// attempt starts when the previous attempt fails or after
+// happyEyeballsAttemptDelay, whichever comes first. The first successful
+// connection is returned, and all other attempts are canceled.
+func happyEyeballsDial(
+	ctx context.Context,
+	ipAddrs []net.IP,
+	dial func(context.Context, net.IP) (net.Conn, error)) (net.Conn, error) {
+
+	dialCtx, cancelFunc := context.WithCancel(ctx)
+	defer cancelFunc()
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+
+	// Buffered so that attempts completing after a winner don't block.
+	results := make(chan dialResult, len(ipAddrs))
+
+	nextIndex := 0
+	pendingCount := 0
+	var nextAttempt <-chan time.Time
+
+	startAttempt := func() {
+		ipAddr := ipAddrs[nextIndex]
+		nextIndex++
+		pendingCount++
+		go func() {
+			conn, err := dial(dialCtx, ipAddr)
+			results <- dialResult{conn: conn, err: err}
+		}()
+		nextAttempt = nil
+		if nextIndex < len(ipAddrs) {
+			nextAttempt = time.After(happyEyeballsAttemptDelay)
+		}
+	}
+
+	startAttempt()
+
+	var lastErr error
+
+	for pendingCount > 0 {
+
+		select {
+
+		case result := <-results:
+			pendingCount--
+
+			if result.err == nil {
+
+				// Cancel the remaining attempts and close any connections
+				// they establish before observing the cancel.
+				cancelFunc()
+				go func(count int) {
+					for i := 0; i < count; i++ {
+						result := <-results
+						if result.conn != nil {
+							result.conn.Close()
+						}
+					}
+				}(pendingCount)
+
+				return result.conn, nil
+			}
+
+			lastErr = result.err
+
+			if nextIndex < len(ipAddrs) && ctx.Err() == nil {
+				startAttempt()
+			}
+
+		case <-nextAttempt:
+			if ctx.Err() == nil {
+				startAttempt()
+			}
+		}
+	}
+
+	return nil, common.ContextError(lastErr)
+}
@@ -25,7 +25,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"math/rand"
 	"net"
 	"os"
 	"strconv"
@@ -56,10 +55,6 @@ func tcpDial(ctx context.Context, addr string, config *DialConfig) (net.Conn, er
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
-	if len(ipAddrs) < 1 {
-		return nil, common.ContextError(errors.New("no IP address"))
-	}
-
 	// When configured, attempt to synthesize IPv6 addresses from
 	// an IPv4 addresses for compatibility on DNS64/NAT64 networks.
 	// If synthesize fails, try the original addresses.
@@ -77,190 +72,194 @@ func tcpDial(ctx context.Context, addr string, config *DialConfig) (net.Conn, er
 		}
 	}
 
-	// Iterate over a pseudorandom permutation of the destination
-	// IPs and attempt connections.
-	//
-	// Only continue retrying as long as the dial context is not
-	// done. Unlike net.Dial, we do not fractionalize the context
-	// deadline, as the dial is generally intended to apply to a
-	// single attempt. So these serial retries are most useful in
-	// cases of immediate failure, such as "no route to host"
-	// errors when a host resolves to both IPv4 and IPv6 but IPv6
-	// addresses are unreachable.
-	//
-	// Retries at higher levels cover other cases: e.g.,
-	// Controller.remoteServerListFetcher will retry its entire
-	// operation and tcpDial will try a new permutation; or similarly,
-	// Controller.establishCandidateGenerator will retry a candidate
-	// tunnel server dials.
-
-	permutedIndexes := rand.Perm(len(ipAddrs))
-
-	lastErr := errors.New("unknown error")
-
-	for _, index := range permutedIndexes {
-
-		// Get address type (IPv4 or IPv6)
-
-		var ipv4 [4]byte
-		var ipv6 [16]byte
-		var domain int
-		var sockAddr syscall.Sockaddr
-
-		ipAddr := ipAddrs[index]
-		if ipAddr != nil && ipAddr.To4() != nil {
-			copy(ipv4[:], ipAddr.To4())
-			domain = syscall.AF_INET
-		} else if ipAddr != nil && ipAddr.To16() != nil {
-			copy(ipv6[:], ipAddr.To16())
-			domain = syscall.AF_INET6
-		} else {
-			lastErr = common.ContextError(fmt.Errorf("invalid IP address: %s", ipAddr.String()))
-			continue
-		}
-		if domain == syscall.AF_INET {
-			sockAddr = &syscall.SockaddrInet4{Addr: ipv4, Port: port}
-		} else if domain == syscall.AF_INET6 {
-			sockAddr = &syscall.SockaddrInet6{Addr: ipv6, Port: port}
-		}
-
-		// Create a socket and bind to device, when configured to do so
+	return dialIPAddresses(
+		ctx,
+		ipAddrs,
+		config.IPAddressFamilyPreference,
+		func(ctx context.Context, ipAddr net.IP) (net.Conn, error) {
+			return tcpDialIPAddress(ctx, ipAddr, port, config)
+		})
+}
 
-		socketFD, err := syscall.Socket(domain, syscall.SOCK_STREAM, 0)
-		if err != nil {
-			lastErr = common.ContextError(err)
-			continue
-		}
+// tcpDialIPAddress makes a single TCP connection attempt to the specified
+// IP address and port.
+func tcpDialIPAddress(
+	ctx context.Context, ipAddr net.IP, port int, config *DialConfig) (net.Conn, error) {
+
+	// Get address type (IPv4 or IPv6)
+
+	var ipv4 [4]byte
+	var ipv6 [16]byte
+	var domain int
+	var sockAddr syscall.Sockaddr
+
+	if ipAddr != nil && ipAddr.To4() != nil {
+		copy(ipv4[:], ipAddr.To4())
+		domain = syscall.AF_INET
+	} else if ipAddr != nil && ipAddr.To16() != nil {
+		copy(ipv6[:], ipAddr.To16())
+		domain = syscall.AF_INET6
+	} else {
+		return nil, common.ContextError(fmt.Errorf("invalid IP address: %s", ipAddr.String()))
+	}
+	if domain == syscall.AF_INET {
+		sockAddr = &syscall.SockaddrInet4{Addr: ipv4, Port: port}
+	} else if domain == syscall.AF_INET6 {
+		sockAddr = &syscall.SockaddrInet6{Addr: ipv6, Port: port}
+	}
 
-		syscall.CloseOnExec(socketFD)
+	// Create a socket and bind to device, when configured to do so
 
-		tcpDialSetAdditionalSocketOptions(socketFD)
+	socketFD, err := syscall.Socket(domain, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
 
-		if config.DeviceBinder != nil {
-			err = config.DeviceBinder.BindToDevice(socketFD)
-			if err != nil {
-				syscall.Close(socketFD)
-				lastErr = common.ContextError(fmt.Errorf("BindToDevice failed: %s", err))
-				continue
-			}
-		}
+	syscall.CloseOnExec(socketFD)
 
-		// Connect socket to the server's IP address
+	tcpDialSetAdditionalSocketOptions(socketFD)
 
-		err = syscall.SetNonblock(socketFD, true)
+	if config.SocketFwmark != 0 {
+		err = tcpDialSetSocketFwmark(socketFD, config.SocketFwmark)
 		if err != nil {
 			syscall.Close(socketFD)
-			lastErr = common.ContextError(err)
-			continue
+			return nil, common.ContextError(fmt.Errorf("set fwmark failed: %s", err))
 		}
+	}
+
+	// Socket buffer sizes must be set before connecting, as the TCP window
+	// scale is negotiated in the handshake.
+	err = tcpDialSetSocketBuffers(socketFD, config)
+	if err != nil {
+		syscall.Close(socketFD)
+		return nil, common.ContextError(fmt.Errorf("set socket buffers failed: %s", err))
+	}
 
-		err = syscall.Connect(socketFD, sockAddr)
+	if config.DeviceBinder != nil {
+		err = config.DeviceBinder.BindToDevice(socketFD)
 		if err != nil {
-			if errno, ok := err.(syscall.Errno); !ok || errno != syscall.EINPROGRESS {
-				syscall.Close(socketFD)
-				lastErr = common.ContextError(err)
-				continue
-			}
+			syscall.Close(socketFD)
+			return nil, common.ContextError(fmt.Errorf("BindToDevice failed: %s", err))
 		}
+	}
 
-		// Use a control pipe to interrupt if the dial context is done (timeout or
-		// interrupted) before the TCP connection is established.
+	// Connect socket to the server's IP address
 
-		var controlFDs [2]int
-		err = syscall.Pipe(controlFDs[:])
-		if err != nil {
-			syscall.Close(socketFD)
-			lastErr = common.ContextError(err)
-			continue
+	err = syscall.SetNonblock(socketFD, true)
+	if err != nil {
+		syscall.Close(socketFD)
+		return nil, common.ContextError(err)
+	}
 
+	err = syscall.Connect(socketFD, sockAddr)
+	if err != nil {
+		if errno, ok := err.(syscall.Errno); !ok || errno != syscall.EINPROGRESS {
+			syscall.Close(socketFD)
+			return nil, common.ContextError(err)
 		}
+	}
 
-		for _, controlFD := range controlFDs {
-			syscall.CloseOnExec(controlFD)
-			err = syscall.SetNonblock(controlFD, true)
-			if err != nil {
-				break
-			}
-		}
+	// Use a control pipe to interrupt if the dial context is done (timeout or
+	// interrupted) before the TCP connection is established.
+
+	var controlFDs [2]int
+	err = syscall.Pipe(controlFDs[:])
+	if err != nil {
+		syscall.Close(socketFD)
+		return nil, common.ContextError(err)
+	}
 
+	for _, controlFD := range controlFDs {
+		syscall.CloseOnExec(controlFD)
+		err = syscall.SetNonblock(controlFD, true)
 		if err != nil {
-			syscall.Close(socketFD)
-			lastErr = common.ContextError(err)
-			continue
+			break
 		}
+	}
 
-		resultChannel := make(chan error)
+	if err != nil {
+		syscall.Close(socketFD)
+		return nil, common.ContextError(err)
+	}
 
-		go func() {
+	resultChannel := make(chan error)
 
-			readSet := goselect.FDSet{}
-			readSet.Set(uintptr(controlFDs[0]))
-			writeSet := goselect.FDSet{}
-			writeSet.Set(uintptr(socketFD))
+	go func() {
 
-			max := socketFD
-			if controlFDs[0] > max {
-				max = controlFDs[0]
-			}
+		readSet := goselect.FDSet{}
+		readSet.Set(uintptr(controlFDs[0]))
+		writeSet := goselect.FDSet{}
+		writeSet.Set(uintptr(socketFD))
 
-			err := goselect.Select(max+1, &readSet, &writeSet, nil, -1)
+		max := socketFD
+		if controlFDs[0] > max {
+			max = controlFDs[0]
+		}
 
-			if err == nil && !writeSet.IsSet(uintptr(socketFD)) {
-				err = errors.New("interrupted")
-			}
+		err := goselect.Select(max+1, &readSet, &writeSet, nil, -1)
 
-			resultChannel <- err
-		}()
-
-		done := false
-		select {
-		case err = <-resultChannel:
-		case <-ctx.Done():
-			err = ctx.Err()
-			// Interrupt the goroutine
-			// TODO: if this Write fails, abandon the goroutine instead of hanging?
-			var b [1]byte
-			syscall.Write(controlFDs[1], b[:])
-			<-resultChannel
-			done = true
+		if err == nil && !writeSet.IsSet(uintptr(socketFD)) {
+			err = errors.New("interrupted")
 		}
 
-		syscall.Close(controlFDs[0])
-		syscall.Close(controlFDs[1])
+		resultChannel <- err
+	}()
+
+	select {
+	case err = <-resultChannel:
+	case <-ctx.Done():
+		err = ctx.Err()
+		// Interrupt the goroutine
+		// TODO: if this Write fails, abandon the goroutine instead of hanging?
+		var b [1]byte
+		syscall.Write(controlFDs[1], b[:])
+		<-resultChannel
+	}
 
-		if err != nil {
-			syscall.Close(socketFD)
+	syscall.Close(controlFDs[0])
+	syscall.Close(controlFDs[1])
 
-			if done {
-				// Skip retry as dial context has timed out of been canceled.
-				return nil, common.ContextError(err)
-			}
+	if err != nil {
+		syscall.Close(socketFD)
+		return nil, common.ContextError(err)
+	}
 
-			lastErr = common.ContextError(err)
-			continue
-		}
+	err = syscall.SetNonblock(socketFD, false)
+	if err != nil {
+		syscall.Close(socketFD)
+		return nil, common.ContextError(err)
+	}
 
-		err = syscall.SetNonblock(socketFD, false)
-		if err != nil {
-			syscall.Close(socketFD)
-			lastErr = common.ContextError(err)
-			continue
-		}
+	// Convert the socket fd to a net.Conn
+	// This code block is from:
+	// https://github.com/golang/go/issues/6966
 
-		// Convert the socket fd to a net.Conn
-		// This code block is from:
-		// https://github.com/golang/go/issues/6966
+	file := os.NewFile(uintptr(socketFD), "")
+	conn, err := net.FileConn(file) // net.FileConn() dups socketFD
+	file.Close()                    // file.Close() closes socketFD
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return &TCPConn{Conn: conn}, nil
+}
 
-		file := os.NewFile(uintptr(socketFD), "")
-		conn, err := net.FileConn(file) // net.FileConn() dups socketFD
-		file.Close()                    // file.Close() closes socketFD
+// tcpDialSetSocketBuffers sets the SO_RCVBUF and SO_SNDBUF sizes specified
+// in config, when non-zero.
+func tcpDialSetSocketBuffers(socketFD int, config *DialConfig) error {
+	if config.SocketReadBuffer != 0 {
+		err := syscall.SetsockoptInt(
+			socketFD, syscall.SOL_SOCKET, syscall.SO_RCVBUF, config.SocketReadBuffer)
 		if err != nil {
-			lastErr = common.ContextError(err)
-			continue
+			return common.ContextError(err)
 		}
-
-		return &TCPConn{Conn: conn}, nil
 	}
-
-	return nil, lastErr
+	if config.SocketWriteBuffer != 0 {
+		err := syscall.SetsockoptInt(
+			socketFD, syscall.SOL_SOCKET, syscall.SO_SNDBUF, config.SocketWriteBuffer)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,202 @@
+// +build linux
+
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestTCPDialSocketFwmark(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	mark := uint32(0x1234)
+
+	conn, err := DialTCP(
+		context.Background(),
+		listener.Addr().String(),
+		&DialConfig{SocketFwmark: mark})
+	if err != nil {
+		// Setting SO_MARK requires CAP_NET_ADMIN.
+		if syscall.Geteuid() != 0 {
+			t.Skipf("DialTCP failed without CAP_NET_ADMIN: %s", err)
+		}
+		t.Fatalf("DialTCP failed: %s", err)
+	}
+	defer conn.Close()
+
+	rawConn, err := conn.(*TCPConn).Conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn failed: %s", err)
+	}
+
+	var socketMark int
+	var getErr error
+	err = rawConn.Control(func(fd uintptr) {
+		socketMark, getErr = syscall.GetsockoptInt(
+			int(fd), syscall.SOL_SOCKET, syscall.SO_MARK)
+	})
+	if err == nil {
+		err = getErr
+	}
+	if err != nil {
+		t.Fatalf("get fwmark failed: %s", err)
+	}
+
+	if uint32(socketMark) != mark {
+		t.Fatalf("unexpected fwmark: %x", socketMark)
+	}
+}
+
+func TestTCPDialSocketBuffers(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	bufferSize := 32768
+
+	conn, err := DialTCP(
+		context.Background(),
+		listener.Addr().String(),
+		&DialConfig{
+			SocketReadBuffer:  bufferSize,
+			SocketWriteBuffer: bufferSize,
+		})
+	if err != nil {
+		t.Fatalf("DialTCP failed: %s", err)
+	}
+	defer conn.Close()
+
+	rawConn, err := conn.(*TCPConn).Conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn failed: %s", err)
+	}
+
+	for _, option := range []int{syscall.SO_RCVBUF, syscall.SO_SNDBUF} {
+
+		var size int
+		var getErr error
+		err = rawConn.Control(func(fd uintptr) {
+			size, getErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, option)
+		})
+		if err == nil {
+			err = getErr
+		}
+		if err != nil {
+			t.Fatalf("get socket buffer failed: %s", err)
+		}
+
+		// Linux doubles the requested size to allow for bookkeeping overhead.
+
+		if size != 2*bufferSize {
+			t.Fatalf("unexpected socket buffer size for %d: %d", option, size)
+		}
+	}
+}
+
+// BenchmarkTCPDialSocketBuffers compares the throughput of a large download
+// with the default and tuned socket buffers. Loopback has negligible delay,
+// so the tuned buffers show little effect here. To observe the effect on a
+// high bandwidth-delay product path, add delay to loopback, e.g.,
+// "tc qdisc add dev lo root netem delay 50ms", and run with
+// -bench TCPDialSocketBuffers: with 100ms RTT, throughput is limited to
+// roughly the buffer size per RTT.
+func BenchmarkTCPDialSocketBuffers(b *testing.B) {
+
+	downloadSize := 16 * 1024 * 1024
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		payload := make([]byte, downloadSize)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.Write(payload)
+				conn.Close()
+			}()
+		}
+	}()
+
+	for _, bufferSize := range []int{0, 4 * 1024 * 1024} {
+		b.Run(fmt.Sprintf("buffer-%d", bufferSize), func(b *testing.B) {
+			b.SetBytes(int64(downloadSize))
+			for i := 0; i < b.N; i++ {
+				conn, err := DialTCP(
+					context.Background(),
+					listener.Addr().String(),
+					&DialConfig{
+						SocketReadBuffer:  bufferSize,
+						SocketWriteBuffer: bufferSize,
+					})
+				if err != nil {
+					b.Fatalf("DialTCP failed: %s", err)
+				}
+				n, err := io.Copy(ioutil.Discard, conn)
+				conn.Close()
+				if err != nil || n != int64(downloadSize) {
+					b.Fatalf("download failed: %d, %v", n, err)
+				}
+			}
+		})
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"context"
 	"errors"
 	"net"
+	"syscall"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 )
@@ -38,11 +39,71 @@ func tcpDial(ctx context.Context, addr string, config *DialConfig) (net.Conn, er
 
 	dialer := net.Dialer{}
 
-	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if config.SocketReadBuffer != 0 || config.SocketWriteBuffer != 0 {
+		dialer.Control = func(_, _ string, rawConn syscall.RawConn) error {
+			return tcpDialSetSocketBuffers(rawConn, config)
+		}
+	}
+
+	if config.IPAddressFamilyPreference == "" && config.BootstrapDohUrl == "" {
+
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		return &TCPConn{Conn: conn}, nil
+	}
+
+	// With an address family preference or a bootstrap DoH resolver,
+	// resolve and order the candidate addresses here rather than using the
+	// net.Dialer default policy.
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
 
+	IPs, err := LookupIP(ctx, host, config)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
 
-	return &TCPConn{Conn: conn}, nil
+	return dialIPAddresses(
+		ctx,
+		IPs,
+		config.IPAddressFamilyPreference,
+		func(ctx context.Context, ipAddr net.IP) (net.Conn, error) {
+			conn, err := dialer.DialContext(
+				ctx, "tcp", net.JoinHostPort(ipAddr.String(), port))
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+			return &TCPConn{Conn: conn}, nil
+		})
+}
+
+// tcpDialSetSocketBuffers sets the SO_RCVBUF and SO_SNDBUF sizes specified
+// in config, when non-zero. net.Dialer invokes this Control function before
+// connecting.
+func tcpDialSetSocketBuffers(rawConn syscall.RawConn, config *DialConfig) error {
+	var err error
+	controlErr := rawConn.Control(func(fd uintptr) {
+		if config.SocketReadBuffer != 0 {
+			err = syscall.SetsockoptInt(
+				syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, config.SocketReadBuffer)
+		}
+		if err == nil && config.SocketWriteBuffer != 0 {
+			err = syscall.SetsockoptInt(
+				syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, config.SocketWriteBuffer)
+		}
+	})
+	if err == nil {
+		err = controlErr
+	}
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
 }
@@ -0,0 +1,227 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOrderIPAddresses(t *testing.T) {
+
+	ipAddrs := []net.IP{
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("192.0.2.2"),
+		net.ParseIP("2001:db8::2"),
+		net.ParseIP("192.0.2.3"),
+	}
+
+	isIPv6 := func(ipAddr net.IP) bool { return ipAddr.To4() == nil }
+
+	for _, preference := range []string{
+		"",
+		IP_ADDRESS_FAMILY_PREFER_IPV4,
+		IP_ADDRESS_FAMILY_PREFER_IPV6,
+		IP_ADDRESS_FAMILY_HAPPY_EYEBALLS,
+	} {
+
+		ordered := orderIPAddresses(ipAddrs, preference)
+
+		if len(ordered) != len(ipAddrs) {
+			t.Fatalf("unexpected address count for %q: %d", preference, len(ordered))
+		}
+
+		families := make([]bool, len(ordered))
+		for i, ipAddr := range ordered {
+			families[i] = isIPv6(ipAddr)
+		}
+
+		var expected []bool
+		switch preference {
+		case IP_ADDRESS_FAMILY_PREFER_IPV4:
+			expected = []bool{false, false, false, true, true}
+		case IP_ADDRESS_FAMILY_PREFER_IPV6:
+			expected = []bool{true, true, false, false, false}
+		case IP_ADDRESS_FAMILY_HAPPY_EYEBALLS:
+			expected = []bool{true, false, true, false, false}
+		}
+
+		for i := range expected {
+			if families[i] != expected[i] {
+				t.Fatalf("unexpected order for %q: %v", preference, ordered)
+			}
+		}
+	}
+}
+
+func TestHappyEyeballsDial(t *testing.T) {
+
+	ipAddrs := []net.IP{
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("192.0.2.1"),
+	}
+
+	// The IPv6 attempt hangs until canceled, so the IPv4 attempt must start
+	// after happyEyeballsAttemptDelay and win the race.
+
+	var canceled int32
+
+	dial := func(ctx context.Context, ipAddr net.IP) (net.Conn, error) {
+		if ipAddr.To4() == nil {
+			<-ctx.Done()
+			atomic.StoreInt32(&canceled, 1)
+			return nil, ctx.Err()
+		}
+		conn, _ := net.Pipe()
+		return conn, nil
+	}
+
+	startTime := time.Now()
+
+	conn, err := dialIPAddresses(
+		context.Background(), ipAddrs, IP_ADDRESS_FAMILY_HAPPY_EYEBALLS, dial)
+	if err != nil {
+		t.Fatalf("dialIPAddresses failed: %s", err)
+	}
+	conn.Close()
+
+	if time.Since(startTime) < happyEyeballsAttemptDelay {
+		t.Fatalf("fallback attempt started too early")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadInt32(&canceled) != 1 {
+		t.Fatalf("losing attempt not canceled")
+	}
+
+	// When the first attempt fails immediately, the next attempt starts
+	// without waiting for happyEyeballsAttemptDelay.
+
+	dial = func(ctx context.Context, ipAddr net.IP) (net.Conn, error) {
+		if ipAddr.To4() == nil {
+			return nil, errors.New("unreachable")
+		}
+		conn, _ := net.Pipe()
+		return conn, nil
+	}
+
+	startTime = time.Now()
+
+	conn, err = dialIPAddresses(
+		context.Background(), ipAddrs, IP_ADDRESS_FAMILY_HAPPY_EYEBALLS, dial)
+	if err != nil {
+		t.Fatalf("dialIPAddresses failed: %s", err)
+	}
+	conn.Close()
+
+	if time.Since(startTime) >= happyEyeballsAttemptDelay {
+		t.Fatalf("fallback attempt delayed after failure")
+	}
+
+	// When all attempts fail, the last error is returned.
+
+	dial = func(ctx context.Context, ipAddr net.IP) (net.Conn, error) {
+		return nil, errors.New("unreachable")
+	}
+
+	_, err = dialIPAddresses(
+		context.Background(), ipAddrs, IP_ADDRESS_FAMILY_HAPPY_EYEBALLS, dial)
+	if err == nil {
+		t.Fatalf("dialIPAddresses unexpectedly succeeded")
+	}
+}
+
+type testDeviceBinder struct {
+	mutex           sync.Mutex
+	fileDescriptors []int
+}
+
+func (binder *testDeviceBinder) BindToDevice(fileDescriptor int) error {
+	binder.mutex.Lock()
+	defer binder.mutex.Unlock()
+	binder.fileDescriptors = append(binder.fileDescriptors, fileDescriptor)
+	return nil
+}
+
+func TestTCPDialDeviceBinder(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("DeviceBinder not supported")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	binder := &testDeviceBinder{}
+
+	dialConfig := &DialConfig{DeviceBinder: binder}
+
+	dialCount := 3
+
+	for i := 0; i < dialCount; i++ {
+		conn, err := DialTCP(
+			context.Background(), listener.Addr().String(), dialConfig)
+		if err != nil {
+			t.Fatalf("DialTCP failed: %s", err)
+		}
+		conn.Close()
+	}
+
+	if len(binder.fileDescriptors) != dialCount {
+		t.Fatalf("unexpected BindToDevice calls: %d", len(binder.fileDescriptors))
+	}
+
+	// A failed bind must fail the dial rather than leave the connection
+	// unprotected.
+
+	_, err = DialTCP(
+		context.Background(),
+		listener.Addr().String(),
+		&DialConfig{DeviceBinder: failingDeviceBinder{}})
+	if err == nil {
+		t.Fatalf("DialTCP unexpectedly succeeded")
+	}
+}
+
+type failingDeviceBinder struct{}
+
+func (failingDeviceBinder) BindToDevice(_ int) error {
+	return errors.New("bind failed")
+}
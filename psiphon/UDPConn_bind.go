@@ -0,0 +1,89 @@
+// +build !windows
+
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// udpListen creates an unconnected UDP socket, for sending to ipAddr, with
+// an ephemeral local port.
+//
+// As in tcpDialIPAddress, the lower-level syscall APIs are used to apply
+// DeviceBinder and SocketFwmark.
+func udpListen(ipAddr net.IP, config *DialConfig) (net.PacketConn, error) {
+
+	network := "udp6"
+	domain := syscall.AF_INET6
+	if ipAddr.To4() != nil {
+		network = "udp4"
+		domain = syscall.AF_INET
+	}
+
+	if config.DeviceBinder == nil && config.SocketFwmark == 0 {
+		conn, err := net.ListenUDP(network, nil)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		return conn, nil
+	}
+
+	socketFD, err := syscall.Socket(domain, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	syscall.CloseOnExec(socketFD)
+
+	if config.SocketFwmark != 0 {
+		err = tcpDialSetSocketFwmark(socketFD, config.SocketFwmark)
+		if err != nil {
+			syscall.Close(socketFD)
+			return nil, common.ContextError(fmt.Errorf("set fwmark failed: %s", err))
+		}
+	}
+
+	if config.DeviceBinder != nil {
+		err = config.DeviceBinder.BindToDevice(socketFD)
+		if err != nil {
+			syscall.Close(socketFD)
+			return nil, common.ContextError(fmt.Errorf("BindToDevice failed: %s", err))
+		}
+	}
+
+	// Convert the syscall socket to a net.PacketConn; as in bindLookupIP,
+	// net.FilePacketConn dups socketFD and file.Close closes socketFD.
+
+	file := os.NewFile(uintptr(socketFD), "")
+	conn, err := net.FilePacketConn(file)
+	file.Close()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return conn, nil
+}
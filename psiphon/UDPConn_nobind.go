@@ -0,0 +1,50 @@
+// +build windows
+
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"net"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// udpListen creates an unconnected UDP socket, for sending to ipAddr, with
+// an ephemeral local port.
+func udpListen(ipAddr net.IP, config *DialConfig) (net.PacketConn, error) {
+
+	if config.DeviceBinder != nil {
+		return nil, common.ContextError(errors.New("psiphon.udpListen with DeviceBinder not supported"))
+	}
+
+	network := "udp6"
+	if ipAddr.To4() != nil {
+		network = "udp4"
+	}
+
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return conn, nil
+}
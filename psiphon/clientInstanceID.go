@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const CLIENT_INSTANCE_ID_BYTE_LENGTH = 16
+
+// GetClientInstanceID returns an identifier for this client instance, which
+// support may use to correlate a user's bug report with server logs. The ID
+// is sent in the handshake request and reported in a ClientInfo notice.
+//
+// Privacy properties:
+//
+//   - The ID is derived from the propagation channel ID and a random seed that
+//     is generated locally, on first use, and persisted in the datastore. No
+//     device identifiers, such as hardware IDs or network addresses, are used.
+//
+//   - The ID is a truncated SHA-256 digest. It doesn't reveal the seed, which
+//     is never sent, and it can't be reversed to any device information.
+//
+//   - The ID is stable across restarts, but it is unlinkable to any previous
+//     ID once the datastore is deleted, as when the app is reinstalled.
+//
+// Returns "" when the seed can't be stored, rather than an ID that would
+// change on the next run.
+func GetClientInstanceID(config *Config) string {
+
+	seed, err := getClientInstanceSeed()
+	if err != nil {
+		NoticeAlert("failed to get client instance seed: %s", common.ContextError(err))
+		return ""
+	}
+
+	return makeClientInstanceID(config.PropagationChannelId, seed)
+}
+
+func makeClientInstanceID(propagationChannelID, seed string) string {
+	digest := sha256.New()
+	digest.Write([]byte(propagationChannelID))
+	digest.Write([]byte(seed))
+	return hex.EncodeToString(digest.Sum(nil)[:CLIENT_INSTANCE_ID_BYTE_LENGTH])
+}
+
+func getClientInstanceSeed() (string, error) {
+
+	seed, err := GetKeyValue(DATA_STORE_CLIENT_INSTANCE_SEED_KEY)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+	if seed != "" {
+		return seed, nil
+	}
+
+	seed, err = common.MakeRandomStringHex(32)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	err = SetKeyValue(DATA_STORE_CLIENT_INSTANCE_SEED_KEY, seed)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	return seed, nil
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"testing"
+)
+
+func TestClientInstanceID(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-client-instance-id-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	initDataStore := func() {
+		singleton = dataStore{}
+		err := InitDataStore(&Config{DataStoreDirectory: testDataDirName})
+		if err != nil {
+			t.Fatalf("InitDataStore failed: %s", err)
+		}
+	}
+
+	initDataStore()
+
+	config := &Config{PropagationChannelId: "0000000000000000"}
+
+	clientInstanceID := GetClientInstanceID(config)
+
+	if !regexp.MustCompile("^[0-9a-f]{32}$").MatchString(clientInstanceID) {
+		t.Fatalf("unexpected client instance ID: %s", clientInstanceID)
+	}
+
+	if GetClientInstanceID(config) != clientInstanceID {
+		t.Fatalf("client instance ID changed")
+	}
+
+	// Simulate a restart: the ID must be stable.
+
+	singleton.db.Close()
+	initDataStore()
+
+	if GetClientInstanceID(config) != clientInstanceID {
+		t.Fatalf("client instance ID changed after restart")
+	}
+
+	// The ID must differ by propagation channel, so IDs can't be linked
+	// across channels.
+
+	otherConfig := &Config{PropagationChannelId: "1111111111111111"}
+
+	if GetClientInstanceID(otherConfig) == clientInstanceID {
+		t.Fatalf("client instance ID unchanged for other propagation channel")
+	}
+
+	// The ID must not contain the seed.
+
+	seed, err := getClientInstanceSeed()
+	if err != nil {
+		t.Fatalf("getClientInstanceSeed failed: %s", err)
+	}
+
+	if regexp.MustCompile(regexp.QuoteMeta(clientInstanceID)).MatchString(seed) ||
+		regexp.MustCompile(regexp.QuoteMeta(seed)).MatchString(clientInstanceID) {
+		t.Fatalf("client instance ID reveals seed")
+	}
+}
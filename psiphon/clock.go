@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"time"
+)
+
+// clock is the source of time for timeouts and retry backoff. Production
+// code uses realClock; tests may substitute a fake clock, via Config.clock,
+// to deterministically exercise timeout and backoff logic without real
+// sleeps.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) clockTimer
+}
+
+// clockTimer is the subset of time.Timer functionality provided by a clock.
+type clockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// realClock is a clock which uses the time package.
+type realClock struct {
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) clockTimer {
+	return &realClockTimer{timer: time.NewTimer(d)}
+}
+
+type realClockTimer struct {
+	timer *time.Timer
+}
+
+func (t *realClockTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t *realClockTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+// getClock returns the config clock, or realClock when no clock is set.
+func (config *Config) getClock() clock {
+	if config.clock == nil {
+		return realClock{}
+	}
+	return config.clock
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock for tests. Time advances only when Advance is called
+// or, when autoAdvance is set, when a timer is created, in which case the
+// timer fires immediately. fakeClock records the duration of every timer
+// created.
+type fakeClock struct {
+	mutex       sync.Mutex
+	autoAdvance bool
+	now         time.Time
+	timers      map[*fakeClockTimer]bool
+	durations   []time.Duration
+	timerAdded  chan struct{}
+}
+
+func newFakeClock(autoAdvance bool) *fakeClock {
+	return &fakeClock{
+		autoAdvance: autoAdvance,
+		now:         time.Unix(0, 0),
+		timers:      make(map[*fakeClockTimer]bool),
+		timerAdded:  make(chan struct{}, 1),
+	}
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) After(d time.Duration) <-chan time.Time {
+	return clock.NewTimer(d).C()
+}
+
+func (clock *fakeClock) NewTimer(d time.Duration) clockTimer {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	clock.durations = append(clock.durations, d)
+
+	timer := &fakeClockTimer{
+		clock:    clock,
+		deadline: clock.now.Add(d),
+		c:        make(chan time.Time, 1),
+	}
+
+	if clock.autoAdvance {
+		clock.now = timer.deadline
+		timer.c <- clock.now
+		return timer
+	}
+
+	clock.timers[timer] = true
+
+	select {
+	case clock.timerAdded <- *new(struct{}):
+	default:
+	}
+
+	return timer
+}
+
+// Advance moves the clock forward by d and fires all expired timers.
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	clock.now = clock.now.Add(d)
+
+	for timer := range clock.timers {
+		if !timer.deadline.After(clock.now) {
+			delete(clock.timers, timer)
+			timer.c <- clock.now
+		}
+	}
+}
+
+// WaitForTimers blocks until at least count timers are pending.
+func (clock *fakeClock) WaitForTimers(count int) {
+	for {
+		clock.mutex.Lock()
+		pendingCount := len(clock.timers)
+		clock.mutex.Unlock()
+		if pendingCount >= count {
+			return
+		}
+		<-clock.timerAdded
+	}
+}
+
+// Durations returns the durations of all timers created.
+func (clock *fakeClock) Durations() []time.Duration {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return append([]time.Duration(nil), clock.durations...)
+}
+
+type fakeClockTimer struct {
+	clock    *fakeClock
+	deadline time.Time
+	c        chan time.Time
+}
+
+func (timer *fakeClockTimer) C() <-chan time.Time {
+	return timer.c
+}
+
+func (timer *fakeClockTimer) Stop() bool {
+	timer.clock.mutex.Lock()
+	defer timer.clock.mutex.Unlock()
+	pending := timer.clock.timers[timer]
+	delete(timer.clock.timers, timer)
+	return pending
+}
+
+func TestFakeClock(t *testing.T) {
+
+	clock := newFakeClock(false)
+
+	timer1 := clock.NewTimer(time.Hour)
+	timer2 := clock.NewTimer(2 * time.Hour)
+	timer3 := clock.NewTimer(3 * time.Hour)
+
+	if !timer3.Stop() {
+		t.Fatalf("unexpected Stop result")
+	}
+
+	clock.Advance(time.Hour)
+
+	select {
+	case <-timer1.C():
+	default:
+		t.Fatalf("timer did not fire")
+	}
+
+	select {
+	case <-timer2.C():
+		t.Fatalf("timer fired early")
+	default:
+	}
+
+	clock.Advance(time.Hour)
+
+	select {
+	case <-timer2.C():
+	default:
+		t.Fatalf("timer did not fire")
+	}
+
+	clock.Advance(time.Hour)
+
+	select {
+	case <-timer3.C():
+		t.Fatalf("stopped timer fired")
+	default:
+	}
+
+	if !clock.Now().Equal(time.Unix(0, 0).Add(3 * time.Hour)) {
+		t.Fatalf("unexpected time: %s", clock.Now())
+	}
+}
@@ -106,7 +106,8 @@ const (
 func NewObfuscatedSshConn(
 	mode ObfuscatedSshConnMode,
 	conn net.Conn,
-	obfuscationKeyword string) (*ObfuscatedSshConn, error) {
+	obfuscationKeyword string,
+	obfuscationPassphrase string) (*ObfuscatedSshConn, error) {
 
 	var err error
 	var obfuscator *Obfuscator
@@ -114,7 +115,11 @@ func NewObfuscatedSshConn(
 	var writeState ObfuscatedSshWriteState
 
 	if mode == OBFUSCATION_CONN_MODE_CLIENT {
-		obfuscator, err = NewClientObfuscator(&ObfuscatorConfig{Keyword: obfuscationKeyword})
+		obfuscator, err = NewClientObfuscator(
+			&ObfuscatorConfig{
+				Keyword:    obfuscationKeyword,
+				Passphrase: obfuscationPassphrase,
+			})
 		if err != nil {
 			return nil, ContextError(err)
 		}
@@ -124,7 +129,11 @@ func NewObfuscatedSshConn(
 	} else {
 		// NewServerObfuscator reads a seed message from conn
 		obfuscator, err = NewServerObfuscator(
-			conn, &ObfuscatorConfig{Keyword: obfuscationKeyword})
+			conn,
+			&ObfuscatorConfig{
+				Keyword:    obfuscationKeyword,
+				Passphrase: obfuscationPassphrase,
+			})
 		if err != nil {
 			// TODO: readForver() equivalent
 			return nil, ContextError(err)
@@ -23,19 +23,28 @@ import (
 	"bytes"
 	"crypto/rc4"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"io"
+	"sync"
 )
 
 const (
 	OBFUSCATE_SEED_LENGTH         = 16
+	OBFUSCATE_MIN_KEYWORD_LENGTH  = 16
+	OBFUSCATE_SEED_HISTORY_SIZE   = 1024
+	OBFUSCATE_MAX_SEED_ATTEMPTS   = 10
 	OBFUSCATE_KEY_LENGTH          = 16
 	OBFUSCATE_HASH_ITERATIONS     = 6000
 	OBFUSCATE_MAX_PADDING         = 8192
 	OBFUSCATE_MAGIC_VALUE         = 0x0BF5CA7E
 	OBFUSCATE_CLIENT_TO_SERVER_IV = "client_to_server"
 	OBFUSCATE_SERVER_TO_CLIENT_IV = "server_to_client"
+	OBFUSCATE_PASSPHRASE_KEY_INFO = "obfuscation_passphrase_key"
+	OBFUSCATE_PASSPHRASE_TAG_INFO = "obfuscation_passphrase_tag"
+	OBFUSCATE_PASSPHRASE_TAG_SIZE = 8
 )
 
 // Obfuscator implements the seed message, key derivation, and
@@ -47,8 +56,14 @@ type Obfuscator struct {
 	serverToClientCipher *rc4.Cipher
 }
 
+// ObfuscatorConfig specifies the obfuscation keyword, which is shared key
+// material distributed in server entries, and an optional passphrase. When
+// a passphrase is set, it's mixed into the obfuscation key derivation, so
+// that a client and server interoperate only when both have the same
+// passphrase.
 type ObfuscatorConfig struct {
 	Keyword    string
+	Passphrase string
 	MaxPadding int
 }
 
@@ -58,7 +73,12 @@ type ObfuscatorConfig struct {
 func NewClientObfuscator(
 	config *ObfuscatorConfig) (obfuscator *Obfuscator, err error) {
 
-	seed, err := MakeSecureRandomBytes(OBFUSCATE_SEED_LENGTH)
+	err = ValidateObfuscatorKeyword(config.Keyword)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	seed, err := makeClientSeed()
 	if err != nil {
 		return nil, ContextError(err)
 	}
@@ -118,15 +138,76 @@ func (obfuscator *Obfuscator) ObfuscateServerToClient(buffer []byte) {
 	obfuscator.serverToClientCipher.XORKeyStream(buffer, buffer)
 }
 
+// ValidateObfuscatorKeyword checks that keyword, the shared obfuscation key
+// material, is long enough to provide meaningful obfuscation.
+func ValidateObfuscatorKeyword(keyword string) error {
+	if len(keyword) < OBFUSCATE_MIN_KEYWORD_LENGTH {
+		return ContextError(errors.New("insufficient obfuscation keyword length"))
+	}
+	return nil
+}
+
+// seedHistory records recently issued client seeds. A fixed size ring of
+// seeds is retained, so that memory use is bounded while still covering
+// all concurrently active tunnels.
+type seedHistory struct {
+	mutex sync.Mutex
+	seeds map[string]bool
+	ring  []string
+	next  int
+}
+
+// add records seed, returning false when seed is already in the history.
+func (history *seedHistory) add(seed []byte) bool {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	key := string(seed)
+	if history.seeds[key] {
+		return false
+	}
+	if history.seeds == nil {
+		history.seeds = make(map[string]bool)
+		history.ring = make([]string, OBFUSCATE_SEED_HISTORY_SIZE)
+	}
+	if evicted := history.ring[history.next]; evicted != "" {
+		delete(history.seeds, evicted)
+	}
+	history.ring[history.next] = key
+	history.next = (history.next + 1) % len(history.ring)
+	history.seeds[key] = true
+	return true
+}
+
+var clientSeedHistory seedHistory
+
+// makeClientSeed generates a fresh random seed for each client connection.
+// Seeds are checked against the recent seed history to ensure that no two
+// concurrent tunnels use the same seed.
+func makeClientSeed() ([]byte, error) {
+	for i := 0; i < OBFUSCATE_MAX_SEED_ATTEMPTS; i++ {
+		seed, err := MakeSecureRandomBytes(OBFUSCATE_SEED_LENGTH)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		if clientSeedHistory.add(seed) {
+			return seed, nil
+		}
+	}
+	return nil, ContextError(errors.New("failed to make unique obfuscation seed"))
+}
+
 func initObfuscatorCiphers(
 	seed []byte, config *ObfuscatorConfig) (*rc4.Cipher, *rc4.Cipher, error) {
 
-	clientToServerKey, err := deriveKey(seed, []byte(config.Keyword), []byte(OBFUSCATE_CLIENT_TO_SERVER_IV))
+	keyMaterial := getObfuscatorKeyMaterial(config)
+
+	clientToServerKey, err := deriveKey(seed, keyMaterial, []byte(OBFUSCATE_CLIENT_TO_SERVER_IV))
 	if err != nil {
 		return nil, nil, ContextError(err)
 	}
 
-	serverToClientKey, err := deriveKey(seed, []byte(config.Keyword), []byte(OBFUSCATE_SERVER_TO_CLIENT_IV))
+	serverToClientKey, err := deriveKey(seed, keyMaterial, []byte(OBFUSCATE_SERVER_TO_CLIENT_IV))
 	if err != nil {
 		return nil, nil, ContextError(err)
 	}
@@ -144,6 +225,34 @@ func initObfuscatorCiphers(
 	return clientToServerCipher, serverToClientCipher, nil
 }
 
+// getObfuscatorKeyMaterial returns the keyword, followed by a digest of the
+// passphrase when one is set. Without a passphrase, the key material is
+// the keyword alone, as in the original obfuscated SSH protocol.
+func getObfuscatorKeyMaterial(config *ObfuscatorConfig) []byte {
+	keyMaterial := []byte(config.Keyword)
+	if config.Passphrase != "" {
+		h := sha256.New()
+		h.Write([]byte(OBFUSCATE_PASSPHRASE_KEY_INFO))
+		h.Write([]byte(config.Passphrase))
+		keyMaterial = h.Sum(keyMaterial)
+	}
+	return keyMaterial
+}
+
+// GetObfuscationPassphraseTag returns a tag which identifies, without
+// revealing, an obfuscation passphrase. Server entries for servers which
+// require a passphrase carry the tag, so that clients may skip servers with
+// which they cannot interoperate. There is no tag, "", for no passphrase.
+func GetObfuscationPassphraseTag(passphrase string) string {
+	if passphrase == "" {
+		return ""
+	}
+	h := sha256.New()
+	h.Write([]byte(OBFUSCATE_PASSPHRASE_TAG_INFO))
+	h.Write([]byte(passphrase))
+	return hex.EncodeToString(h.Sum(nil)[:OBFUSCATE_PASSPHRASE_TAG_SIZE])
+}
+
 func deriveKey(seed, keyword, iv []byte) ([]byte, error) {
 	h := sha1.New()
 	h.Write(seed)
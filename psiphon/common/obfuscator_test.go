@@ -24,7 +24,9 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"errors"
+	"fmt"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -73,6 +75,163 @@ func TestObfuscator(t *testing.T) {
 	}
 }
 
+func TestObfuscatorKeyword(t *testing.T) {
+
+	_, err := NewClientObfuscator(&ObfuscatorConfig{Keyword: "short"})
+	if err == nil {
+		t.Fatalf("unexpected NewClientObfuscator success with short keyword")
+	}
+
+	_, err = NewClientObfuscator(&ObfuscatorConfig{})
+	if err == nil {
+		t.Fatalf("unexpected NewClientObfuscator success with empty keyword")
+	}
+}
+
+func TestObfuscatorPassphrase(t *testing.T) {
+
+	keyword, _ := MakeRandomStringHex(32)
+
+	// Key derivation is deterministic for a given seed, keyword, and
+	// passphrase, and no passphrase derives the original keys.
+
+	seed := []byte("0123456789abcdef")
+
+	deriveTestKey := func(passphrase string) []byte {
+		key, err := deriveKey(
+			seed,
+			getObfuscatorKeyMaterial(&ObfuscatorConfig{Keyword: keyword, Passphrase: passphrase}),
+			[]byte(OBFUSCATE_CLIENT_TO_SERVER_IV))
+		if err != nil {
+			t.Fatalf("deriveKey failed: %s", err)
+		}
+		return key
+	}
+
+	originalKey, err := deriveKey(seed, []byte(keyword), []byte(OBFUSCATE_CLIENT_TO_SERVER_IV))
+	if err != nil {
+		t.Fatalf("deriveKey failed: %s", err)
+	}
+
+	if !bytes.Equal(deriveTestKey(""), originalKey) ||
+		!bytes.Equal(deriveTestKey("passphrase-1"), deriveTestKey("passphrase-1")) ||
+		bytes.Equal(deriveTestKey("passphrase-1"), originalKey) ||
+		bytes.Equal(deriveTestKey("passphrase-1"), deriveTestKey("passphrase-2")) {
+		t.Fatalf("unexpected derived keys")
+	}
+
+	if GetObfuscationPassphraseTag("") != "" ||
+		GetObfuscationPassphraseTag("passphrase-1") != GetObfuscationPassphraseTag("passphrase-1") ||
+		GetObfuscationPassphraseTag("passphrase-1") == GetObfuscationPassphraseTag("passphrase-2") ||
+		len(GetObfuscationPassphraseTag("passphrase-1")) != 2*OBFUSCATE_PASSPHRASE_TAG_SIZE {
+		t.Fatalf("unexpected passphrase tags")
+	}
+
+	// Only a client and server with matching passphrases interoperate.
+
+	for _, testCase := range []struct {
+		clientPassphrase string
+		serverPassphrase string
+		expectSuccess    bool
+	}{
+		{"", "", true},
+		{"passphrase-1", "passphrase-1", true},
+		{"passphrase-1", "passphrase-2", false},
+		{"passphrase-1", "", false},
+		{"", "passphrase-1", false},
+	} {
+		client, err := NewClientObfuscator(
+			&ObfuscatorConfig{Keyword: keyword, Passphrase: testCase.clientPassphrase})
+		if err != nil {
+			t.Fatalf("NewClientObfuscator failed: %s", err)
+		}
+
+		server, err := NewServerObfuscator(
+			bytes.NewReader(client.SendSeedMessage()),
+			&ObfuscatorConfig{Keyword: keyword, Passphrase: testCase.serverPassphrase})
+
+		if testCase.expectSuccess {
+			if err != nil {
+				t.Fatalf("NewServerObfuscator failed: %s", err)
+			}
+			clientMessage := []byte("client hello")
+			b := append([]byte(nil), clientMessage...)
+			client.ObfuscateClientToServer(b)
+			server.ObfuscateClientToServer(b)
+			if !bytes.Equal(clientMessage, b) {
+				t.Fatalf("unexpected client message")
+			}
+		} else if err == nil {
+			t.Fatalf("unexpected NewServerObfuscator success: %+v", testCase)
+		}
+	}
+}
+
+func TestObfuscatorSeedUniqueness(t *testing.T) {
+
+	keyword, _ := MakeRandomStringHex(32)
+
+	config := &ObfuscatorConfig{
+		Keyword:    keyword,
+		MaxPadding: 256,
+	}
+
+	concurrency := 100
+
+	var mutex sync.Mutex
+	seeds := make(map[string]bool)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrency)
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, err := NewClientObfuscator(config)
+			if err != nil {
+				errs <- err
+				return
+			}
+			seed := string(client.SendSeedMessage()[:OBFUSCATE_SEED_LENGTH])
+			mutex.Lock()
+			defer mutex.Unlock()
+			if seeds[seed] {
+				errs <- fmt.Errorf("duplicate seed: %x", seed)
+			}
+			seeds[seed] = true
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(seeds) != concurrency {
+		t.Fatalf("unexpected seed count: %d", len(seeds))
+	}
+
+	// A seed still in the history is rejected
+
+	var history seedHistory
+	seed := []byte("0123456789abcdef")
+	if !history.add(seed) || history.add(seed) {
+		t.Fatalf("unexpected seed history result")
+	}
+
+	// Once enough seeds are issued, the oldest seed is evicted
+
+	for i := 0; i < OBFUSCATE_SEED_HISTORY_SIZE; i++ {
+		history.add([]byte(fmt.Sprintf("%016d", i)))
+	}
+	if !history.add(seed) {
+		t.Fatalf("unexpected seed history result after eviction")
+	}
+}
+
 func TestObfuscatedSSHConn(t *testing.T) {
 
 	keyword, _ := MakeRandomStringHex(32)
@@ -111,7 +270,7 @@ func TestObfuscatedSSHConn(t *testing.T) {
 
 		if err == nil {
 			conn, err = NewObfuscatedSshConn(
-				OBFUSCATION_CONN_MODE_SERVER, conn, keyword)
+				OBFUSCATION_CONN_MODE_SERVER, conn, keyword, "")
 		}
 
 		if err == nil {
@@ -137,7 +296,7 @@ func TestObfuscatedSSHConn(t *testing.T) {
 
 		if err == nil {
 			conn, err = NewObfuscatedSshConn(
-				OBFUSCATION_CONN_MODE_CLIENT, conn, keyword)
+				OBFUSCATION_CONN_MODE_CLIENT, conn, keyword, "")
 		}
 
 		if err == nil {
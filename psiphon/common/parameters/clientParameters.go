@@ -76,15 +76,24 @@ const (
 	EstablishTunnelWorkTime                        = "EstablishTunnelWorkTime"
 	EstablishTunnelPausePeriod                     = "EstablishTunnelPausePeriod"
 	EstablishTunnelPausePeriodJitter               = "EstablishTunnelPausePeriodJitter"
+	EstablishTunnelPausePeriodMax                  = "EstablishTunnelPausePeriodMax"
+	EstablishTunnelPauseBackoffResetPeriod         = "EstablishTunnelPauseBackoffResetPeriod"
 	EstablishTunnelServerAffinityGracePeriod       = "EstablishTunnelServerAffinityGracePeriod"
 	StaggerConnectionWorkersPeriod                 = "StaggerConnectionWorkersPeriod"
 	StaggerConnectionWorkersJitter                 = "StaggerConnectionWorkersJitter"
 	LimitMeekConnectionWorkers                     = "LimitMeekConnectionWorkers"
+	ServerEntryPerformanceDecayWindow              = "ServerEntryPerformanceDecayWindow"
+	ServerEntryPerformanceExplorationRatio         = "ServerEntryPerformanceExplorationRatio"
 	IgnoreHandshakeStatsRegexps                    = "IgnoreHandshakeStatsRegexps"
 	PrioritizeTunnelProtocols                      = "PrioritizeTunnelProtocols"
 	PrioritizeTunnelProtocolsCandidateCount        = "PrioritizeTunnelProtocolsCandidateCount"
 	LimitTunnelProtocols                           = "LimitTunnelProtocols"
+	DisableTunnelProtocols                         = "DisableTunnelProtocols"
 	TunnelOperateShutdownTimeout                   = "TunnelOperateShutdownTimeout"
+	SwitchServerDrainTimeout                       = "SwitchServerDrainTimeout"
+	TunnelReadStallTimeout                         = "TunnelReadStallTimeout"
+	IdleTunnelTimeout                              = "IdleTunnelTimeout"
+	IdleTunnelReestablishTimeout                   = "IdleTunnelReestablishTimeout"
 	TunnelPortForwardDialTimeout                   = "TunnelPortForwardDialTimeout"
 	TunnelRateLimits                               = "TunnelRateLimits"
 	AdditionalCustomHeaders                        = "AdditionalCustomHeaders"
@@ -100,11 +109,16 @@ const (
 	SSHKeepAlivePeriodicInactivePeriod             = "SSHKeepAlivePeriodicInactivePeriod"
 	SSHKeepAliveProbeTimeout                       = "SSHKeepAliveProbeTimeout"
 	SSHKeepAliveProbeInactivePeriod                = "SSHKeepAliveProbeInactivePeriod"
+	SSHKeepAliveMaxMissedReplies                   = "SSHKeepAliveMaxMissedReplies"
 	HTTPProxyOriginServerTimeout                   = "HTTPProxyOriginServerTimeout"
 	HTTPProxyMaxIdleConnectionsPerHost             = "HTTPProxyMaxIdleConnectionsPerHost"
+	PortForwardIdleTimeout                         = "PortForwardIdleTimeout"
 	FetchRemoteServerListTimeout                   = "FetchRemoteServerListTimeout"
 	FetchRemoteServerListRetryPeriod               = "FetchRemoteServerListRetryPeriod"
 	FetchRemoteServerListStalePeriod               = "FetchRemoteServerListStalePeriod"
+	PrefetchServerEntriesPeriod                    = "PrefetchServerEntriesPeriod"
+	PrefetchServerEntriesIdlePeriod                = "PrefetchServerEntriesIdlePeriod"
+	PrefetchServerEntriesBytesPerSecond            = "PrefetchServerEntriesBytesPerSecond"
 	RemoteServerListSignaturePublicKey             = "RemoteServerListSignaturePublicKey"
 	RemoteServerListURLs                           = "RemoteServerListURLs"
 	ObfuscatedServerListRootURLs                   = "ObfuscatedServerListRootURLs"
@@ -115,6 +129,8 @@ const (
 	PsiphonAPIStatusRequestShortPeriodMax          = "PsiphonAPIStatusRequestShortPeriodMax"
 	PsiphonAPIStatusRequestPaddingMinBytes         = "PsiphonAPIStatusRequestPaddingMinBytes"
 	PsiphonAPIStatusRequestPaddingMaxBytes         = "PsiphonAPIStatusRequestPaddingMaxBytes"
+	PsiphonAPIHandshakeRequestPaddingMinBytes      = "PsiphonAPIHandshakeRequestPaddingMinBytes"
+	PsiphonAPIHandshakeRequestPaddingMaxBytes      = "PsiphonAPIHandshakeRequestPaddingMaxBytes"
 	PsiphonAPIPersistentStatsMaxCount              = "PsiphonAPIPersistentStatsMaxCount"
 	PsiphonAPIConnectedRequestPeriod               = "PsiphonAPIConnectedRequestPeriod"
 	PsiphonAPIConnectedRequestRetryPeriod          = "PsiphonAPIConnectedRequestRetryPeriod"
@@ -129,14 +145,29 @@ const (
 	FetchUpgradeStalePeriod                        = "FetchUpgradeStalePeriod"
 	UpgradeDownloadURLs                            = "UpgradeDownloadURLs"
 	UpgradeDownloadClientVersionHeader             = "UpgradeDownloadClientVersionHeader"
+	UpgradeDownloadProgressNoticePeriod            = "UpgradeDownloadProgressNoticePeriod"
+	UpgradeDownloadProgressNoticeBytes             = "UpgradeDownloadProgressNoticeBytes"
+	UpgradeDownloadChunkSize                       = "UpgradeDownloadChunkSize"
+	UpgradeDownloadRetries                         = "UpgradeDownloadRetries"
+	UpgradeDownloadRetryBase                       = "UpgradeDownloadRetryBase"
+	UpgradeDownloadRetryMaximum                    = "UpgradeDownloadRetryMaximum"
+	UpgradeDownloadRetryAfterMaximum               = "UpgradeDownloadRetryAfterMaximum"
+	UpgradeDownloadDiskSpaceMargin                 = "UpgradeDownloadDiskSpaceMargin"
+	UpgradeDownloadResumeVerifyBytes               = "UpgradeDownloadResumeVerifyBytes"
+	DownloadSyncBytes                              = "DownloadSyncBytes"
+	DownloadSyncPeriod                             = "DownloadSyncPeriod"
+	UpgradeCheckPeriod                             = "UpgradeCheckPeriod"
+	UpgradeCheckPeriodJitter                       = "UpgradeCheckPeriodJitter"
 	ImpairedProtocolClassificationDuration         = "ImpairedProtocolClassificationDuration"
 	ImpairedProtocolClassificationThreshold        = "ImpairedProtocolClassificationThreshold"
 	TotalBytesTransferredNoticePeriod              = "TotalBytesTransferredNoticePeriod"
+	BytesTransferredNoticePeriod                   = "BytesTransferredNoticePeriod"
 	MeekDialDomainsOnly                            = "MeekDialDomainsOnly"
 	MeekLimitBufferSizes                           = "MeekLimitBufferSizes"
 	MeekCookieMaxPadding                           = "MeekCookieMaxPadding"
 	MeekFullReceiveBufferLength                    = "MeekFullReceiveBufferLength"
 	MeekReadPayloadChunkLength                     = "MeekReadPayloadChunkLength"
+	MeekMaxRequestPayloadLength                    = "MeekMaxRequestPayloadLength"
 	MeekLimitedFullReceiveBufferLength             = "MeekLimitedFullReceiveBufferLength"
 	MeekLimitedReadPayloadChunkLength              = "MeekLimitedReadPayloadChunkLength"
 	MeekMinPollInterval                            = "MeekMinPollInterval"
@@ -194,11 +225,51 @@ var defaultClientParameters = map[string]struct {
 	StaggerConnectionWorkersPeriod:           {value: time.Duration(0), minimum: time.Duration(0)},
 	StaggerConnectionWorkersJitter:           {value: 0.1, minimum: 0.0},
 	LimitMeekConnectionWorkers:               {value: 0, minimum: 0},
+
+	// The pause between establishment rounds starts at
+	// EstablishTunnelPausePeriod and doubles after each consecutive round
+	// that fails to establish a tunnel, up to EstablishTunnelPausePeriodMax.
+	// The backoff is reset once a tunnel has remained connected for
+	// EstablishTunnelPauseBackoffResetPeriod.
+
+	EstablishTunnelPausePeriodMax:          {value: 1 * time.Minute, minimum: 1 * time.Millisecond},
+	EstablishTunnelPauseBackoffResetPeriod: {value: 5 * time.Minute, minimum: time.Duration(0)},
+
+	// Recorded server entry connection performance decays over
+	// ServerEntryPerformanceDecayWindow. When ordering server candidates, a
+	// ServerEntryPerformanceExplorationRatio fraction of candidates is
+	// selected at random, ignoring performance, so that servers without
+	// recent history are still tried.
+
+	ServerEntryPerformanceDecayWindow:      {value: 7 * 24 * time.Hour, minimum: 1 * time.Minute},
+	ServerEntryPerformanceExplorationRatio: {value: 0.2, minimum: 0.0},
 	IgnoreHandshakeStatsRegexps:              {value: false},
 	TunnelOperateShutdownTimeout:             {value: 1 * time.Second, minimum: 1 * time.Millisecond, flags: useNetworkLatencyMultiplier},
 	TunnelPortForwardDialTimeout:             {value: 10 * time.Second, minimum: 1 * time.Millisecond, flags: useNetworkLatencyMultiplier},
 	TunnelRateLimits:                         {value: common.RateLimits{}},
 
+	// SwitchServerDrainTimeout is the maximum time that a tunnel replaced by
+	// Controller.SwitchServer remains open to allow its in-flight port
+	// forwards to complete.
+
+	SwitchServerDrainTimeout: {value: 30 * time.Second, minimum: 0 * time.Second},
+
+	// TunnelReadStallTimeout is the maximum time that a read on a connection
+	// made by a tunneled HTTP client, such as an upgrade download, may wait
+	// without receiving any bytes before the connection is closed. 0
+	// disables the watchdog.
+
+	TunnelReadStallTimeout: {value: 60 * time.Second, minimum: 0 * time.Second, flags: useNetworkLatencyMultiplier},
+
+	// IdleTunnelTimeout is how long the active tunnels may go without port
+	// forward traffic before they are disconnected, to save battery. 0
+	// disables idle disconnection. IdleTunnelReestablishTimeout is the
+	// maximum time that a port forward dial, made after an idle disconnect,
+	// waits for a tunnel to be reestablished.
+
+	IdleTunnelTimeout:            {value: time.Duration(0), minimum: time.Duration(0)},
+	IdleTunnelReestablishTimeout: {value: 30 * time.Second, minimum: 1 * time.Millisecond, flags: useNetworkLatencyMultiplier},
+
 	// PrioritizeTunnelProtocolsCandidateCount should be set to at least
 	// ConnectionWorkerPoolSize in order to use only priotitized protocols in
 	// the first establishment round. Even then, this will only happen if the
@@ -208,6 +279,12 @@ var defaultClientParameters = map[string]struct {
 	PrioritizeTunnelProtocolsCandidateCount: {value: 10, minimum: 0},
 	LimitTunnelProtocols:                    {value: protocol.TunnelProtocols{}},
 
+	// DisableTunnelProtocols are removed from LimitTunnelProtocols, or from
+	// all supported protocols when LimitTunnelProtocols is empty. See
+	// ClientParametersSnapshot.LimitTunnelProtocols.
+
+	DisableTunnelProtocols: {value: protocol.TunnelProtocols{}},
+
 	AdditionalCustomHeaders: {value: make(http.Header)},
 
 	// Speed test and SSH keep alive padding is intended to frustrate
@@ -234,9 +311,22 @@ var defaultClientParameters = map[string]struct {
 	SSHKeepAliveProbeTimeout:               {value: 30 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
 	SSHKeepAliveProbeInactivePeriod:        {value: 10 * time.Second, minimum: 1 * time.Second},
 
+	// SSHKeepAliveMaxMissedReplies is the number of consecutive periodic SSH
+	// keepalives that may time out before the tunnel is considered to have
+	// failed. Probe keepalives, sent after a port forward failure, are not
+	// retried.
+
+	SSHKeepAliveMaxMissedReplies: {value: 1, minimum: 1},
+
 	HTTPProxyOriginServerTimeout:       {value: 15 * time.Second, minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
 	HTTPProxyMaxIdleConnectionsPerHost: {value: 50, minimum: 0},
 
+	// PortForwardIdleTimeout is how long a local proxy port forward may go
+	// without relaying any bytes, in either direction, before it's closed.
+	// 0 disables the timeout.
+
+	PortForwardIdleTimeout: {value: time.Duration(0), minimum: time.Duration(0)},
+
 	FetchRemoteServerListTimeout:       {value: 30 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
 	FetchRemoteServerListRetryPeriod:   {value: 30 * time.Second, minimum: 1 * time.Millisecond},
 	FetchRemoteServerListStalePeriod:   {value: 6 * time.Hour, minimum: 1 * time.Hour},
@@ -244,6 +334,16 @@ var defaultClientParameters = map[string]struct {
 	RemoteServerListURLs:               {value: DownloadURLs{}},
 	ObfuscatedServerListRootURLs:       {value: DownloadURLs{}},
 
+	// PrefetchServerEntriesPeriod is the minimum time between server entry
+	// prefetches, which are made only after the active tunnels have had no
+	// port forward traffic for PrefetchServerEntriesIdlePeriod. The prefetch
+	// download is rate limited to PrefetchServerEntriesBytesPerSecond so
+	// that it doesn't compete with user traffic.
+
+	PrefetchServerEntriesPeriod:         {value: 6 * time.Hour, minimum: 1 * time.Minute},
+	PrefetchServerEntriesIdlePeriod:     {value: 60 * time.Second, minimum: 1 * time.Second},
+	PrefetchServerEntriesBytesPerSecond: {value: 32 * 1024, minimum: 1024},
+
 	PsiphonAPIRequestTimeout: {value: 20 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
 
 	PsiphonAPIStatusRequestPeriodMin:       {value: 5 * time.Minute, minimum: 1 * time.Second},
@@ -254,6 +354,13 @@ var defaultClientParameters = map[string]struct {
 	PsiphonAPIStatusRequestPaddingMaxBytes: {value: 256, minimum: 0},
 	PsiphonAPIPersistentStatsMaxCount:      {value: 100, minimum: 1},
 
+	// PsiphonAPIHandshakeRequestPaddingMinBytes/MaxBytes specify the range,
+	// inclusive, of random padding added to SSH API handshake requests. The
+	// default, 0, adds no padding.
+
+	PsiphonAPIHandshakeRequestPaddingMinBytes: {value: 0, minimum: 0},
+	PsiphonAPIHandshakeRequestPaddingMaxBytes: {value: 0, minimum: 0},
+
 	PsiphonAPIConnectedRequestRetryPeriod: {value: 5 * time.Second, minimum: 1 * time.Millisecond},
 
 	PsiphonAPIClientVerificationRequestRetryPeriod: {value: 5 * time.Second, minimum: 1 * time.Millisecond},
@@ -270,21 +377,89 @@ var defaultClientParameters = map[string]struct {
 	UpgradeDownloadURLs:                {value: DownloadURLs{}},
 	UpgradeDownloadClientVersionHeader: {value: ""},
 
+	// Upgrade download progress notices are emitted at most once per
+	// UpgradeDownloadProgressNoticePeriod or once per
+	// UpgradeDownloadProgressNoticeBytes, whichever comes first.
+
+	UpgradeDownloadProgressNoticePeriod: {value: 500 * time.Millisecond, minimum: 1 * time.Millisecond},
+	UpgradeDownloadProgressNoticeBytes:  {value: 1048576, minimum: 1},
+
+	// UpgradeDownloadChunkSize is the size of each Range request when
+	// downloading an upgrade with concurrent requests.
+
+	UpgradeDownloadChunkSize: {value: 4194304, minimum: 1},
+
+	// UpgradeDownloadRetries is the number of times a failed upgrade download
+	// is resumed, within one FetchUpgradeTimeout, before failing. The delay
+	// before the first retry is UpgradeDownloadRetryBase, doubling for each
+	// subsequent retry, up to UpgradeDownloadRetryMaximum.
+
+	UpgradeDownloadRetries:      {value: 3, minimum: 0},
+	UpgradeDownloadRetryBase:    {value: 1 * time.Second, minimum: 1 * time.Millisecond},
+	UpgradeDownloadRetryMaximum: {value: 1 * time.Minute, minimum: 1 * time.Millisecond},
+
+	// UpgradeDownloadRetryAfterMaximum caps the delay requested by a
+	// Retry-After header in a 503 response to an upgrade download. A zero
+	// value ignores Retry-After.
+
+	UpgradeDownloadRetryAfterMaximum: {value: 1 * time.Minute, minimum: time.Duration(0)},
+
+	// UpgradeDownloadDiskSpaceMargin is the number of bytes of free disk
+	// space, in addition to the remaining upgrade download size, required
+	// before an upgrade download is started.
+
+	UpgradeDownloadDiskSpaceMargin: {value: 1048576, minimum: 0},
+
+	// UpgradeDownloadResumeVerifyBytes is the number of bytes at the end of a
+	// partial upgrade download which are requested again, and compared with
+	// the bytes on disk, when the download is resumed. This detects a tail
+	// corrupted by a crash mid-write. 0 disables the verification.
+
+	UpgradeDownloadResumeVerifyBytes: {value: 4096, minimum: 0},
+
+	// Partial upgrade and remote server list downloads are synced to disk at
+	// most once per DownloadSyncBytes written and once per
+	// DownloadSyncPeriod. Less frequent syncing increases download
+	// throughput on slow storage; unsynced data is downloaded again when a
+	// partial download is resumed. Completed downloads are always synced.
+
+	DownloadSyncBytes:  {value: 1048576, minimum: 1},
+	DownloadSyncPeriod: {value: 1 * time.Second, minimum: time.Duration(0)},
+
+	// Periodic upgrade checks, scheduled with GetUpgradeCheckDelay, are
+	// spread over UpgradeCheckPeriod +/- UpgradeCheckPeriodJitter to avoid
+	// many clients checking at the same time.
+
+	UpgradeCheckPeriod:       {value: 6 * time.Hour, minimum: 1 * time.Minute},
+	UpgradeCheckPeriodJitter: {value: 0.1, minimum: 0.0},
+
 	ImpairedProtocolClassificationDuration:  {value: 2 * time.Minute, minimum: 1 * time.Millisecond, flags: useNetworkLatencyMultiplier},
 	ImpairedProtocolClassificationThreshold: {value: 3, minimum: 1},
 
 	TotalBytesTransferredNoticePeriod: {value: 5 * time.Minute, minimum: 1 * time.Second},
 
+	// BytesTransferredNoticePeriod is the period for emitting BytesTransferred
+	// notices, when enabled by EmitBytesTransferred. Bytes transferred are
+	// sampled once per second, so the period is rounded down to whole seconds.
+
+	BytesTransferredNoticePeriod: {value: 1 * time.Second, minimum: 1 * time.Second},
+
 	// The meek server times out inactive sessions after 45 seconds, so this
 	// is a soft max for MeekMaxPollInterval,  MeekRoundTripTimeout, and
 	// MeekRoundTripRetryDeadline. MeekCookieMaxPadding cannot exceed
 	// common.OBFUSCATE_SEED_LENGTH.
+	//
+	// MeekMaxRequestPayloadLength limits the payload sent in each meek
+	// request, for CDNs which impose small request body sizes. The meek
+	// server accepts at most 65536 bytes per request, so larger values are
+	// capped at that size.
 
 	MeekDialDomainsOnly:                        {value: false},
 	MeekLimitBufferSizes:                       {value: false},
 	MeekCookieMaxPadding:                       {value: 256, minimum: 0},
 	MeekFullReceiveBufferLength:                {value: 4194304, minimum: 1024},
 	MeekReadPayloadChunkLength:                 {value: 65536, minimum: 1024},
+	MeekMaxRequestPayloadLength:                {value: 65536, minimum: 1024},
 	MeekLimitedFullReceiveBufferLength:         {value: 131072, minimum: 1024},
 	MeekLimitedReadPayloadChunkLength:          {value: 4096, minimum: 1024},
 	MeekMinPollInterval:                        {value: 100 * time.Millisecond, minimum: 1 * time.Millisecond},
@@ -645,6 +820,39 @@ func (p *ClientParametersSnapshot) TunnelProtocols(name string) protocol.TunnelP
 	return value
 }
 
+// LimitTunnelProtocols returns the effective set of tunnel protocols to use,
+// which is the LimitTunnelProtocols parameter value with any
+// DisableTunnelProtocols removed. As with LimitTunnelProtocols, an empty
+// return value indicates that all protocols may be used.
+//
+// When every candidate protocol is disabled, allDisabled is true and no
+// protocol may be used. Disabled protocols are never re-enabled, even when
+// the combination of LimitTunnelProtocols and DisableTunnelProtocols, as
+// from tactics, is a misconfiguration.
+func (p *ClientParametersSnapshot) LimitTunnelProtocols() (
+	tunnelProtocols protocol.TunnelProtocols, allDisabled bool) {
+
+	limitTunnelProtocols := p.TunnelProtocols(LimitTunnelProtocols)
+	disableTunnelProtocols := p.TunnelProtocols(DisableTunnelProtocols)
+	if len(disableTunnelProtocols) == 0 {
+		return limitTunnelProtocols, false
+	}
+
+	candidateProtocols := limitTunnelProtocols
+	if len(candidateProtocols) == 0 {
+		candidateProtocols = protocol.SupportedTunnelProtocols
+	}
+
+	tunnelProtocols = make(protocol.TunnelProtocols, 0)
+	for _, tunnelProtocol := range candidateProtocols {
+		if !common.Contains(disableTunnelProtocols, tunnelProtocol) {
+			tunnelProtocols = append(tunnelProtocols, tunnelProtocol)
+		}
+	}
+
+	return tunnelProtocols, len(tunnelProtocols) == 0
+}
+
 // DownloadURLs returns a DownloadURLs parameter value.
 func (p *ClientParametersSnapshot) DownloadURLs(name string) DownloadURLs {
 	value := DownloadURLs{}
@@ -195,3 +195,79 @@ func TestNetworkLatencyMultiplier(t *testing.T) {
 
 	}
 }
+
+func TestLimitTunnelProtocols(t *testing.T) {
+	p, err := NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	testCases := []struct {
+		limit               protocol.TunnelProtocols
+		disable             protocol.TunnelProtocols
+		expected            protocol.TunnelProtocols
+		expectedAllDisabled bool
+	}{
+		{
+			protocol.TunnelProtocols{},
+			protocol.TunnelProtocols{},
+			protocol.TunnelProtocols{},
+			false,
+		},
+		{
+			protocol.TunnelProtocols{protocol.TUNNEL_PROTOCOL_SSH, protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH},
+			protocol.TunnelProtocols{protocol.TUNNEL_PROTOCOL_SSH},
+			protocol.TunnelProtocols{protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH},
+			false,
+		},
+		{
+			protocol.TunnelProtocols{},
+			protocol.TunnelProtocols{
+				protocol.TUNNEL_PROTOCOL_FRONTED_MEEK,
+				protocol.TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP,
+				protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+				protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS,
+				protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET,
+			},
+			protocol.TunnelProtocols{
+				protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+				protocol.TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH,
+				protocol.TUNNEL_PROTOCOL_SSH,
+			},
+			false,
+		},
+		{
+			protocol.TunnelProtocols{protocol.TUNNEL_PROTOCOL_SSH},
+			protocol.TunnelProtocols{protocol.TUNNEL_PROTOCOL_SSH},
+			protocol.TunnelProtocols{},
+			true,
+		},
+		{
+			protocol.TunnelProtocols{},
+			protocol.SupportedTunnelProtocols,
+			protocol.TunnelProtocols{},
+			true,
+		},
+	}
+
+	for _, testCase := range testCases {
+
+		applyParameters := map[string]interface{}{
+			LimitTunnelProtocols:   testCase.limit,
+			DisableTunnelProtocols: testCase.disable,
+		}
+
+		_, err = p.Set("", false, applyParameters)
+		if err != nil {
+			t.Fatalf("Set failed: %s", err)
+		}
+
+		limitTunnelProtocols, allDisabled := p.Get().LimitTunnelProtocols()
+		if !reflect.DeepEqual(limitTunnelProtocols, testCase.expected) ||
+			allDisabled != testCase.expectedAllDisabled {
+			t.Fatalf("Unexpected LimitTunnelProtocols: %+v, %v != %+v, %v",
+				limitTunnelProtocols, allDisabled,
+				testCase.expected, testCase.expectedAllDisabled)
+		}
+	}
+}
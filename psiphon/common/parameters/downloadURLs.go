@@ -120,3 +120,27 @@ func (d DownloadURLs) Select(attempt int) (string, string, bool) {
 
 	return downloadURL.URL, canonicalURL, downloadURL.SkipVerify
 }
+
+// Candidates returns the DownloadURLs which are candidates in the specified
+// attempt, in random order. Downloaders which fail over between mirrors try
+// the candidates in this order, so that, as with Select, load is spread
+// across the candidates and a single unavailable mirror isn't always tried
+// first.
+func (d DownloadURLs) Candidates(attempt int) DownloadURLs {
+	candidates := make(DownloadURLs, 0)
+	for _, downloadURL := range d {
+		if attempt >= downloadURL.OnlyAfterAttempts {
+			candidates = append(candidates, downloadURL)
+		}
+	}
+
+	for i := len(candidates) - 1; i > 0; i-- {
+		j, err := common.MakeSecureRandomInt(i + 1)
+		if err != nil {
+			break
+		}
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	}
+
+	return candidates
+}
@@ -186,3 +186,74 @@ func TestDownloadURLs(t *testing.T) {
 	}
 
 }
+
+func TestDownloadURLCandidates(t *testing.T) {
+
+	downloadURLs := DownloadURLs{
+		{
+			URL:               base64.StdEncoding.EncodeToString([]byte("a.example.com")),
+			OnlyAfterAttempts: 0,
+		},
+		{
+			URL:               base64.StdEncoding.EncodeToString([]byte("b.example.com")),
+			OnlyAfterAttempts: 0,
+		},
+		{
+			URL:               base64.StdEncoding.EncodeToString([]byte("c.example.com")),
+			OnlyAfterAttempts: 0,
+		},
+		{
+			URL:               base64.StdEncoding.EncodeToString([]byte("d.example.com")),
+			OnlyAfterAttempts: 1,
+		},
+	}
+
+	err := downloadURLs.DecodeAndValidate()
+	if err != nil {
+		t.Fatalf("unexpected validation error: %s", err)
+	}
+
+	testCases := []struct {
+		attempt            int
+		expectedCandidates []string
+	}{
+		{0, []string{"a.example.com", "b.example.com", "c.example.com"}},
+		{1, []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com"}},
+	}
+
+	for _, testCase := range testCases {
+
+		// Each eligible candidate, and only eligible candidates, should
+		// be tried first in some runs.
+
+		firstCandidates := make(map[string]int)
+
+		runs := 1000
+
+		for i := 0; i < runs; i++ {
+
+			candidates := downloadURLs.Candidates(testCase.attempt)
+
+			if len(candidates) != len(testCase.expectedCandidates) {
+				t.Fatalf("unexpected candidate count: %d", len(candidates))
+			}
+
+			distinctCandidates := make(map[string]bool)
+			for _, candidate := range candidates {
+				distinctCandidates[candidate.URL] = true
+			}
+			for _, expectedCandidate := range testCase.expectedCandidates {
+				if !distinctCandidates[expectedCandidate] {
+					t.Fatalf("missing candidate: %s", expectedCandidate)
+				}
+			}
+
+			firstCandidates[candidates[0].URL] += 1
+		}
+
+		if len(firstCandidates) != len(testCase.expectedCandidates) {
+			t.Fatalf("got %d distinct first candidates, expected %d",
+				len(firstCandidates), len(testCase.expectedCandidates))
+		}
+	}
+}
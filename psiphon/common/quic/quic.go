@@ -0,0 +1,380 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+/*
+Package quic wraps a QUIC connection and its single bidirectional stream in
+a net.Conn, so that QUIC may be used as the base transport for obfuscated
+SSH.
+
+QUIC's TLS layer is used only as QUIC requires it: the server presents an
+ephemeral, self-signed certificate and the client does not verify it. As
+with the other tunnel protocols, the server is authenticated by the
+obfuscated SSH and SSH layers above this transport.
+*/
+package quic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"golang.org/x/net/quic"
+)
+
+const (
+	ALPN                         = "psiphon-ossh"
+	SERVER_HANDSHAKE_TIMEOUT     = 30 * time.Second
+	SERVER_ACCEPT_STREAM_TIMEOUT = 30 * time.Second
+	CLIENT_IDLE_TIMEOUT          = 30 * time.Second
+	CLIENT_KEEP_ALIVE_PERIOD     = 10 * time.Second
+	CLOSE_ENDPOINT_TIMEOUT       = 1 * time.Second
+)
+
+// Listener is a net.Listener which accepts QUIC connections. Each accepted
+// net.Conn is the first bidirectional stream opened by the client.
+type Listener struct {
+	endpoint       *quic.Endpoint
+	runContext     context.Context
+	stopRunning    context.CancelFunc
+	acceptedConns  chan *Conn
+	acceptErr      atomic.Value
+	acceptFinished chan struct{}
+}
+
+// Listen creates a new Listener on the specified UDP address.
+func Listen(address string) (*Listener, error) {
+
+	certificate, err := generateCertificate()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	config := &quic.Config{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{*certificate},
+			NextProtos:   []string{ALPN},
+			MinVersion:   tls.VersionTLS13,
+		},
+		HandshakeTimeout: SERVER_HANDSHAKE_TIMEOUT,
+	}
+
+	endpoint, err := quic.Listen("udp", address, config)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	runContext, stopRunning := context.WithCancel(context.Background())
+
+	listener := &Listener{
+		endpoint:       endpoint,
+		runContext:     runContext,
+		stopRunning:    stopRunning,
+		acceptedConns:  make(chan *Conn),
+		acceptFinished: make(chan struct{}),
+	}
+
+	go listener.acceptConns()
+
+	return listener, nil
+}
+
+// acceptConns accepts QUIC connections and, for each, awaits the client's
+// stream in a separate goroutine, so that a slow or idle client doesn't
+// block other clients.
+func (listener *Listener) acceptConns() {
+	defer close(listener.acceptFinished)
+
+	for {
+		quicConn, err := listener.endpoint.Accept(listener.runContext)
+		if err != nil {
+			listener.acceptErr.Store(err)
+			return
+		}
+
+		go func() {
+
+			ctx, cancelFunc := context.WithTimeout(
+				listener.runContext, SERVER_ACCEPT_STREAM_TIMEOUT)
+			stream, err := quicConn.AcceptStream(ctx)
+			cancelFunc()
+
+			if err != nil {
+				quicConn.Abort(nil)
+				return
+			}
+
+			conn := newConn(quicConn, stream, nil)
+
+			select {
+			case listener.acceptedConns <- conn:
+			case <-listener.runContext.Done():
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// Accept implements the net.Listener interface.
+func (listener *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.acceptedConns:
+		return conn, nil
+	case <-listener.acceptFinished:
+		err, _ := listener.acceptErr.Load().(error)
+		if err == nil {
+			err = errors.New("listener closed")
+		}
+		return nil, common.ContextError(err)
+	}
+}
+
+// Close implements the net.Listener interface. Unlike a TCP listener, all
+// accepted conns share the listener's UDP socket, so closing the listener
+// also closes any accepted conns.
+func (listener *Listener) Close() error {
+	listener.stopRunning()
+	<-listener.acceptFinished
+
+	ctx, cancelFunc := context.WithTimeout(
+		context.Background(), CLOSE_ENDPOINT_TIMEOUT)
+	defer cancelFunc()
+
+	// A timeout waiting for peers to acknowledge the close is not an error:
+	// the endpoint is closed regardless.
+	listener.endpoint.Close(ctx)
+
+	return nil
+}
+
+// Addr implements the net.Listener interface.
+func (listener *Listener) Addr() net.Addr {
+	return net.UDPAddrFromAddrPort(listener.endpoint.LocalAddr())
+}
+
+// Dial establishes a new QUIC connection, over the specified packetConn,
+// with the server at remoteAddr and opens a stream. The packetConn is owned,
+// and closed, by the returned Conn.
+func Dial(
+	ctx context.Context,
+	packetConn net.PacketConn,
+	remoteAddr *net.UDPAddr) (net.Conn, error) {
+
+	config := &quic.Config{
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{ALPN},
+			MinVersion:         tls.VersionTLS13,
+		},
+		MaxIdleTimeout:  CLIENT_IDLE_TIMEOUT,
+		KeepAlivePeriod: CLIENT_KEEP_ALIVE_PERIOD,
+	}
+
+	endpoint, err := quic.NewEndpoint(packetConn, config)
+	if err != nil {
+		packetConn.Close()
+		return nil, common.ContextError(err)
+	}
+
+	closeEndpoint := func() {
+		ctx, cancelFunc := context.WithTimeout(
+			context.Background(), CLOSE_ENDPOINT_TIMEOUT)
+		defer cancelFunc()
+		endpoint.Close(ctx)
+		packetConn.Close()
+	}
+
+	quicConn, err := endpoint.Dial(ctx, "udp", remoteAddr.String(), config)
+	if err != nil {
+		closeEndpoint()
+		return nil, common.ContextError(err)
+	}
+
+	// The server doesn't see the stream until data is sent; the first write
+	// will be the obfuscated SSH seed message.
+
+	stream, err := quicConn.NewStream(ctx)
+	if err != nil {
+		quicConn.Abort(nil)
+		closeEndpoint()
+		return nil, common.ContextError(err)
+	}
+
+	return newConn(quicConn, stream, closeEndpoint), nil
+}
+
+// Conn is a net.Conn over a single QUIC stream. Conn supports the
+// common.Closer interface.
+type Conn struct {
+	quicConn      *quic.Conn
+	stream        *quic.Stream
+	closeEndpoint func()
+	writeMutex    sync.Mutex
+	deadlineMutex sync.Mutex
+	deadlineTimer *time.Timer
+	isClosed      int32
+}
+
+func newConn(quicConn *quic.Conn, stream *quic.Stream, closeEndpoint func()) *Conn {
+	return &Conn{
+		quicConn:      quicConn,
+		stream:        stream,
+		closeEndpoint: closeEndpoint,
+	}
+}
+
+// Read implements the net.Conn interface.
+func (conn *Conn) Read(buffer []byte) (int, error) {
+	return conn.stream.Read(buffer)
+}
+
+// Write implements the net.Conn interface. Each write is flushed, as
+// stream writes are otherwise buffered.
+func (conn *Conn) Write(buffer []byte) (int, error) {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+
+	n, err := conn.stream.Write(buffer)
+	if err != nil {
+		return n, err
+	}
+	return n, conn.stream.Flush()
+}
+
+// Close implements the net.Conn interface.
+func (conn *Conn) Close() error {
+
+	if !atomic.CompareAndSwapInt32(&conn.isClosed, 0, 1) {
+		return nil
+	}
+
+	conn.deadlineMutex.Lock()
+	if conn.deadlineTimer != nil {
+		conn.deadlineTimer.Stop()
+	}
+	conn.deadlineMutex.Unlock()
+
+	// The stream is closed without waiting for the peer to acknowledge
+	// outstanding data. Conn.Close waits, for the QUIC draining period, for
+	// the peer to acknowledge the connection close; its result, the reason
+	// the connection closed, is not an error here.
+
+	conn.stream.CloseRead()
+	conn.stream.CloseWrite()
+	conn.quicConn.Close()
+
+	if conn.closeEndpoint != nil {
+		conn.closeEndpoint()
+	}
+
+	return nil
+}
+
+// IsClosed implements the common.Closer interface.
+func (conn *Conn) IsClosed() bool {
+	return atomic.LoadInt32(&conn.isClosed) == 1
+}
+
+// LocalAddr implements the net.Conn interface.
+func (conn *Conn) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(conn.quicConn.LocalAddr())
+}
+
+// RemoteAddr implements the net.Conn interface.
+func (conn *Conn) RemoteAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(conn.quicConn.RemoteAddr())
+}
+
+// SetDeadline is not a full implementation of net.Conn.SetDeadline: when
+// the deadline is reached, the conn is closed, interrupting any blocked Read
+// or Write. This supports the inactivity timeout use case, where the
+// deadline is repeatedly extended while the conn is active.
+func (conn *Conn) SetDeadline(t time.Time) error {
+
+	conn.deadlineMutex.Lock()
+	defer conn.deadlineMutex.Unlock()
+
+	if conn.deadlineTimer != nil {
+		conn.deadlineTimer.Stop()
+		conn.deadlineTimer = nil
+	}
+
+	if !t.IsZero() {
+		conn.deadlineTimer = time.AfterFunc(time.Until(t), func() { conn.Close() })
+	}
+
+	return nil
+}
+
+// Stub implementation of net.Conn.SetReadDeadline
+func (conn *Conn) SetReadDeadline(t time.Time) error {
+	return common.ContextError(errors.New("not supported"))
+}
+
+// Stub implementation of net.Conn.SetWriteDeadline
+func (conn *Conn) SetWriteDeadline(t time.Time) error {
+	return common.ContextError(errors.New("not supported"))
+}
+
+// generateCertificate creates an ephemeral, self-signed certificate for the
+// QUIC TLS handshake.
+func generateCertificate() (*tls.Certificate, error) {
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	notBefore := time.Now().Add(-24 * time.Hour)
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	derCertificate, err := x509.CreateCertificate(
+		rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{derCertificate},
+		PrivateKey:  privateKey,
+	}, nil
+}
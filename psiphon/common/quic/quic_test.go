@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package quic
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+func TestQUIC(t *testing.T) {
+
+	listener, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	// Each server conn echoes its input.
+	serverConns := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			serverConns <- conn
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFunc()
+
+	dial := func() net.Conn {
+		packetConn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			t.Fatalf("ListenUDP failed: %s", err)
+		}
+		conn, err := Dial(ctx, packetConn, listener.Addr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatalf("Dial failed: %s", err)
+		}
+		return conn
+	}
+
+	t.Run("echo", func(t *testing.T) {
+
+		conn := dial()
+
+		message := make([]byte, 1<<20)
+		rand.Read(message)
+
+		go func() {
+			for i := 0; i < len(message); i += 16384 {
+				conn.Write(message[i : i+16384])
+			}
+		}()
+
+		echo := make([]byte, len(message))
+		_, err := io.ReadFull(conn, echo)
+		if err != nil {
+			t.Fatalf("ReadFull failed: %s", err)
+		}
+		if !bytes.Equal(message, echo) {
+			t.Fatalf("unexpected echo")
+		}
+
+		if common.IPAddressFromAddr(conn.RemoteAddr()) != "127.0.0.1" {
+			t.Fatalf("unexpected remote address: %s", conn.RemoteAddr())
+		}
+
+		<-serverConns
+
+		closer, ok := conn.(common.Closer)
+		if !ok {
+			t.Fatalf("conn is not a Closer")
+		}
+		conn.Close()
+		if !closer.IsClosed() {
+			t.Fatalf("conn is not closed")
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+
+		conn := dial()
+		defer conn.Close()
+
+		_, err := conn.Write([]byte("x"))
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+
+		var serverConn net.Conn
+		select {
+		case serverConn = <-serverConns:
+		case <-ctx.Done():
+			t.Fatalf("Accept timeout")
+		}
+
+		// The server conn is closed when its deadline is reached, which the
+		// client observes as the end of the stream.
+
+		err = serverConn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+		if err != nil {
+			t.Fatalf("SetDeadline failed: %s", err)
+		}
+
+		buffer := make([]byte, 1)
+		_, err = io.ReadFull(conn, buffer)
+		if err != nil {
+			t.Fatalf("ReadFull failed: %s", err)
+		}
+
+		_, err = conn.Read(buffer)
+		if err == nil {
+			t.Fatalf("unexpected Read success")
+		}
+
+		if !serverConn.(common.Closer).IsClosed() {
+			t.Fatalf("server conn is not closed")
+		}
+	})
+}
@@ -0,0 +1,372 @@
+/*
+ * Copyright (c) 2017, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tls
+
+import (
+	stdtls "crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// [Psiphon]
+// TestClientHelloProfiles checks the cipher suite and extension ordering
+// emitted for each ClientHello profile.
+func TestClientHelloProfiles(t *testing.T) {
+
+	t.Run("Chrome", func(t *testing.T) {
+
+		hello, err := captureClientHello(&Config{EmulateChrome: true})
+		if err != nil {
+			t.Fatalf("captureClientHello failed: %s", err)
+		}
+
+		if len(hello.cipherSuites) == 0 || !isGREASE(hello.cipherSuites[0]) {
+			t.Fatalf("missing leading GREASE cipher suite: %x", hello.cipherSuites)
+		}
+		expectedCipherSuites := []uint16{
+			0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013,
+			0xc014, 0x009c, 0x009d, 0x002f, 0x0035, 0x000a,
+		}
+		if !reflect.DeepEqual(hello.cipherSuites[1:], expectedCipherSuites) {
+			t.Fatalf("unexpected cipher suites: %x", hello.cipherSuites)
+		}
+
+		extensions := hello.extensions
+		if len(extensions) < 2 ||
+			!isGREASE(extensions[0]) ||
+			!isGREASE(extensions[len(extensions)-1]) {
+			t.Fatalf("missing GREASE extensions: %x", extensions)
+		}
+		expectedExtensions := []uint16{
+			extensionRenegotiationInfo,
+			extensionServerName,
+			extensionExtendedMasterSecret,
+			extensionSessionTicket,
+			extensionSignatureAlgorithms,
+			extensionStatusRequest,
+			extensionSCT,
+			extensionALPN,
+			extensionChannelID,
+			extensionSupportedPoints,
+			extensionSupportedCurves,
+		}
+		if !reflect.DeepEqual(extensions[1:len(extensions)-1], expectedExtensions) {
+			t.Fatalf("unexpected extensions: %x", extensions)
+		}
+
+		if !reflect.DeepEqual(hello.alpnProtocols, []string{"h2", "http/1.1"}) {
+			t.Fatalf("unexpected ALPN protocols: %v", hello.alpnProtocols)
+		}
+	})
+
+	t.Run("Firefox", func(t *testing.T) {
+
+		hello, err := captureClientHello(&Config{EmulateFirefox: true})
+		if err != nil {
+			t.Fatalf("captureClientHello failed: %s", err)
+		}
+
+		expectedCipherSuites := []uint16{
+			0xc02b, 0xc02f, 0xcca9, 0xcca8, 0xc02c, 0xc030, 0xc00a, 0xc009,
+			0xc013, 0xc014, 0x0033, 0x0039, 0x002f, 0x0035, 0x000a,
+		}
+		if !reflect.DeepEqual(hello.cipherSuites, expectedCipherSuites) {
+			t.Fatalf("unexpected cipher suites: %x", hello.cipherSuites)
+		}
+
+		extensions := hello.extensions
+		if len(extensions) > 0 && extensions[len(extensions)-1] == extensionPadding {
+			extensions = extensions[:len(extensions)-1]
+		}
+		expectedExtensions := []uint16{
+			extensionServerName,
+			extensionExtendedMasterSecret,
+			extensionRenegotiationInfo,
+			extensionSupportedCurves,
+			extensionSupportedPoints,
+			extensionSessionTicket,
+			extensionALPN,
+			extensionStatusRequest,
+			extensionSignatureAlgorithms,
+		}
+		if !reflect.DeepEqual(extensions, expectedExtensions) {
+			t.Fatalf("unexpected extensions: %x", hello.extensions)
+		}
+
+		expectedCurves := []uint16{
+			uint16(X25519), uint16(CurveP256), uint16(CurveP384), uint16(CurveP521),
+		}
+		if !reflect.DeepEqual(hello.supportedCurves, expectedCurves) {
+			t.Fatalf("unexpected curves: %x", hello.supportedCurves)
+		}
+	})
+
+	t.Run("Randomized", func(t *testing.T) {
+
+		distinctCipherSuites := make(map[string]bool)
+		distinctExtensions := make(map[string]bool)
+
+		for i := 0; i < 10; i++ {
+
+			hello, err := captureClientHello(&Config{RandomizeClientHello: true})
+			if err != nil {
+				t.Fatalf("captureClientHello failed: %s", err)
+			}
+
+			for _, required := range []uint16{
+				TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+				TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256} {
+
+				found := false
+				for _, suite := range hello.cipherSuites {
+					if suite == required {
+						found = true
+					}
+				}
+				if !found {
+					t.Fatalf("missing required cipher suite %x: %x", required, hello.cipherSuites)
+				}
+			}
+
+			distinctCipherSuites[fmt.Sprintf("%x", hello.cipherSuites)] = true
+			distinctExtensions[fmt.Sprintf("%x", hello.extensions)] = true
+		}
+
+		if len(distinctCipherSuites) < 2 || len(distinctExtensions) < 2 {
+			t.Fatalf("ClientHello not randomized")
+		}
+	})
+
+	t.Run("Multiple profiles", func(t *testing.T) {
+
+		_, err := captureClientHello(&Config{EmulateChrome: true, EmulateFirefox: true})
+		if err == nil {
+			t.Fatalf("unexpected success")
+		}
+	})
+}
+
+// [Psiphon]
+// TestClientHelloProfileHandshakes checks that each ClientHello profile
+// completes a handshake with a stock crypto/tls server.
+func TestClientHelloProfileHandshakes(t *testing.T) {
+
+	certificate, err := generateCertificate()
+	if err != nil {
+		t.Fatalf("generateCertificate failed: %s", err)
+	}
+
+	serverCertificate := stdtls.Certificate{
+		Certificate: certificate.Certificate,
+		PrivateKey:  certificate.PrivateKey,
+	}
+
+	for _, profile := range []string{"Chrome", "Firefox", "Randomized"} {
+		t.Run(profile, func(t *testing.T) {
+
+			// Multiple handshakes cover randomized variations and
+			// session resumption.
+			clientSessionCache := NewLRUClientSessionCache(0)
+
+			for i := 0; i < 10; i++ {
+
+				clientConn, serverConn := net.Pipe()
+
+				serverResult := make(chan error, 1)
+				go func() {
+					conn := stdtls.Server(serverConn, &stdtls.Config{
+						Certificates: []stdtls.Certificate{serverCertificate},
+						NextProtos:   []string{"http/1.1"},
+					})
+					// Close the pipe, not the TLS conn: a close_notify
+					// write blocks until the peer reads it.
+					err := conn.Handshake()
+					serverConn.Close()
+					serverResult <- err
+				}()
+
+				conn := Client(clientConn, &Config{
+					ServerName:           "www.example.com",
+					InsecureSkipVerify:   true,
+					ClientSessionCache:   clientSessionCache,
+					EmulateChrome:        profile == "Chrome",
+					EmulateFirefox:       profile == "Firefox",
+					RandomizeClientHello: profile == "Randomized",
+				})
+				err := conn.Handshake()
+				clientConn.Close()
+
+				if err != nil {
+					t.Fatalf("client handshake failed: %s", err)
+				}
+				if err := <-serverResult; err != nil {
+					t.Fatalf("server handshake failed: %s", err)
+				}
+			}
+		})
+	}
+}
+
+type capturedClientHello struct {
+	cipherSuites    []uint16
+	extensions      []uint16
+	supportedCurves []uint16
+	alpnProtocols   []string
+}
+
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+// captureClientHello runs a client handshake with the specified config
+// and parses the ClientHello it emits.
+func captureClientHello(config *Config) (*capturedClientHello, error) {
+
+	config.ServerName = "www.example.com"
+	config.ClientSessionCache = NewLRUClientSessionCache(0)
+
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	clientResult := make(chan error, 1)
+	go func() {
+		clientResult <- Client(clientConn, config).Handshake()
+		clientConn.Close()
+	}()
+
+	header := make([]byte, 5)
+	_, err := io.ReadFull(serverConn, header)
+	if err == nil {
+		record := make([]byte, int(header[3])<<8|int(header[4]))
+		_, err = io.ReadFull(serverConn, record)
+		if err == nil {
+			serverConn.Close()
+			return parseClientHello(record)
+		}
+	}
+
+	serverConn.Close()
+	clientErr := <-clientResult
+	if clientErr != nil {
+		return nil, clientErr
+	}
+	return nil, err
+}
+
+func parseClientHello(record []byte) (*capturedClientHello, error) {
+
+	data := record
+	next := func(n int) ([]byte, error) {
+		if len(data) < n {
+			return nil, errors.New("truncated ClientHello")
+		}
+		value := data[:n]
+		data = data[n:]
+		return value, nil
+	}
+	nextLength := func(n int) ([]byte, error) {
+		lengthBytes, err := next(n)
+		if err != nil {
+			return nil, err
+		}
+		length := 0
+		for _, b := range lengthBytes {
+			length = length<<8 | int(b)
+		}
+		return next(length)
+	}
+
+	// Message type, length, version, and random
+	if _, err := next(4 + 2 + 32); err != nil {
+		return nil, err
+	}
+	if record[0] != typeClientHello {
+		return nil, errors.New("unexpected message type")
+	}
+
+	// Session ID
+	if _, err := nextLength(1); err != nil {
+		return nil, err
+	}
+
+	hello := &capturedClientHello{}
+
+	cipherSuites, err := nextLength(2)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i+1 < len(cipherSuites); i += 2 {
+		hello.cipherSuites = append(
+			hello.cipherSuites, uint16(cipherSuites[i])<<8|uint16(cipherSuites[i+1]))
+	}
+
+	// Compression methods
+	if _, err := nextLength(1); err != nil {
+		return nil, err
+	}
+
+	extensions, err := nextLength(2)
+	if err != nil {
+		return nil, err
+	}
+	data = extensions
+	for len(data) > 0 {
+		extensionType, err := next(2)
+		if err != nil {
+			return nil, err
+		}
+		extension := uint16(extensionType[0])<<8 | uint16(extensionType[1])
+		body, err := nextLength(2)
+		if err != nil {
+			return nil, err
+		}
+		hello.extensions = append(hello.extensions, extension)
+
+		switch extension {
+		case extensionSupportedCurves:
+			if len(body) < 2 {
+				return nil, errors.New("invalid supported curves")
+			}
+			for i := 2; i+1 < len(body); i += 2 {
+				hello.supportedCurves = append(
+					hello.supportedCurves, uint16(body[i])<<8|uint16(body[i+1]))
+			}
+		case extensionALPN:
+			if len(body) < 2 {
+				return nil, errors.New("invalid ALPN")
+			}
+			for protocols := body[2:]; len(protocols) > 0; {
+				length := int(protocols[0])
+				if len(protocols) < 1+length {
+					return nil, errors.New("invalid ALPN")
+				}
+				hello.alpnProtocols = append(
+					hello.alpnProtocols, string(protocols[1:1+length]))
+				protocols = protocols[1+length:]
+			}
+		}
+	}
+
+	return hello, nil
+}
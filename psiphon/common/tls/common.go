@@ -85,7 +85,7 @@ const (
 	extensionRenegotiationInfo   uint16 = 0xff01
 
 	// [Psiphon]
-	// Additional extensions required for EmulateChrome.
+	// Additional extensions required for EmulateChrome and EmulateFirefox.
 	extensionPadding              uint16 = 21
 	extensionExtendedMasterSecret uint16 = 23
 	extensionChannelID            uint16 = 30032 // not IANA assigned
@@ -142,6 +142,14 @@ const (
 	// [Psiphon]
 	// hashSHA512 is required for EmulateChrome.
 	hashSHA512 uint8 = 6
+
+	// [Psiphon]
+	// hashRSAPSS identifies the RSA-PSS signature schemes offered by
+	// EmulateChrome and EmulateFirefox (See RFC 8446, section 4.2.3). These
+	// are encoded with hash 0x08 and a signature value that is the hash
+	// identifier of the PSS digest: 0x0804, 0x0805, and 0x0806 are RSA-PSS
+	// with SHA-256, SHA-384, and SHA-512, respectively.
+	hashRSAPSS uint8 = 8
 )
 
 // Signature algorithms for TLS 1.2 (See RFC 5246, section A.4.1)
@@ -529,6 +537,27 @@ type Config struct {
 	// CipherSuites is ignored when EmulateChrome is on.
 	EmulateChrome bool
 
+	// [Psiphon]
+	// EmulateFirefox is EmulateChrome for the traffic signature of modern
+	// Firefox browsers using NSS. The emulated ciphersuites include DHE
+	// ciphersuites which aren't implemented; the handshake fails if a
+	// server selects one.
+	EmulateFirefox bool
+
+	// [Psiphon]
+	// RandomizeClientHello enables a network traffic obfuscation facility
+	// that varies the client hello of each connection, so that there's no
+	// single fingerprint to block. The selection and preference order of
+	// ciphersuites, curves, and signature algorithms; the selection of
+	// optional extensions, GREASE, and padding; and the order of extensions
+	// are all randomized. The randomized ciphersuites are drawn from
+	// CipherSuites.
+	//
+	// At most one of EmulateChrome, EmulateFirefox, and RandomizeClientHello
+	// may be set. With any of these, NextProtos, when set, replaces the
+	// emulated ALPN protocols.
+	RandomizeClientHello bool
+
 	serverInitOnce sync.Once // guards calling (*Config).serverInit
 
 	// mutex protects sessionTicketKeys and originalConfig.
@@ -605,7 +634,11 @@ func (c *Config) Clone() *Config {
 		DynamicRecordSizingDisabled: c.DynamicRecordSizingDisabled,
 		Renegotiation:               c.Renegotiation,
 		KeyLogWriter:                c.KeyLogWriter,
-		sessionTicketKeys:           sessionTicketKeys,
+		// [Psiphon]
+		EmulateChrome:        c.EmulateChrome,
+		EmulateFirefox:       c.EmulateFirefox,
+		RandomizeClientHello: c.RandomizeClientHello,
+		sessionTicketKeys:    sessionTicketKeys,
 		// originalConfig is deliberately not duplicated.
 	}
 }
@@ -12,9 +12,11 @@ import (
 	"crypto/sha256"
 	"crypto/subtle"
 	"crypto/x509"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	mathrand "math/rand"
 	"net"
 	"strconv"
 	"strings"
@@ -160,13 +162,26 @@ NextCipherSuite:
 	}
 
 	// [Psiphon]
-	// Re-configure extensions as required for EmulateChrome.
-	if c.config.EmulateChrome {
-
-		hello.emulateChrome = true
+	// At most one ClientHello profile may be configured.
+	profileCount := 0
+	for _, profile := range []bool{
+		c.config.EmulateChrome,
+		c.config.EmulateFirefox,
+		c.config.RandomizeClientHello} {
+
+		if profile {
+			profileCount++
+		}
+	}
+	if profileCount > 1 {
+		return errors.New("tls: multiple ClientHello profiles configured")
+	}
 
-		// Sanity check that expected and required configuration is present
-		if hello.vers != VersionTLS12 ||
+	// [Psiphon]
+	// Sanity check that expected and required configuration is present
+	// for any ClientHello profile.
+	if profileCount > 0 &&
+		(hello.vers != VersionTLS12 ||
 			len(hello.compressionMethods) != 1 ||
 			hello.compressionMethods[0] != compressionNone ||
 			!hello.ticketSupported ||
@@ -174,10 +189,18 @@ NextCipherSuite:
 			!hello.scts ||
 			len(hello.supportedPoints) != 1 ||
 			hello.supportedPoints[0] != pointFormatUncompressed ||
-			!hello.secureRenegotiationSupported {
+			!hello.secureRenegotiationSupported) {
 
-			return errors.New("tls: unexpected configuration for EmulateChrome")
-		}
+		return errors.New("tls: unexpected configuration for ClientHello profile")
+	}
+
+	// [Psiphon]
+	// Re-configure extensions as required for EmulateChrome.
+	if c.config.EmulateChrome {
+
+		hello.extensionOrder = chromeExtensionOrder
+		hello.greaseExtensions = true
+		hello.boringPadding = true
 
 		hello.supportedCurves = []CurveID{
 			CurveID(getGREASEValue(hello.random, greaseGroup)),
@@ -204,22 +227,23 @@ NextCipherSuite:
 		}
 
 		// From: https://github.com/google/boringssl/blob/46db7af2c998cf8514d606408546d9be9699f03c/ssl/t1_lib.c#L442
-		// TODO: handle RSA-PSS (0x08)
 		hello.signatureAndHashes = []signatureAndHash{
 			{hashSHA256, signatureECDSA},
-			{0x08, 0x04},
+			{hashRSAPSS, hashSHA256},
 			{hashSHA256, signatureRSA},
 			{hashSHA384, signatureECDSA},
-			{0x08, 0x05},
+			{hashRSAPSS, hashSHA384},
 			{hashSHA384, signatureRSA},
-			{0x08, 0x06},
+			{hashRSAPSS, hashSHA512},
 			{hashSHA512, signatureRSA},
 			{hashSHA1, signatureRSA},
 		}
 
 		hello.nextProtoNeg = false
 
-		hello.alpnProtocols = []string{"h2", "http/1.1"}
+		if len(c.config.NextProtos) == 0 {
+			hello.alpnProtocols = []string{"h2", "http/1.1"}
+		}
 
 		// The extended master secret and channel ID extensions
 		// code is from:
@@ -243,6 +267,149 @@ NextCipherSuite:
 		}
 	}
 
+	// [Psiphon]
+	// Re-configure extensions as required for EmulateFirefox. The
+	// configuration follows the NSS ClientHello sent by Firefox 56.
+	if c.config.EmulateFirefox {
+
+		hello.extensionOrder = firefoxExtensionOrder
+		hello.boringPadding = true
+
+		hello.supportedCurves = []CurveID{
+			X25519,
+			CurveP256,
+			CurveP384,
+			CurveP521,
+		}
+
+		// The DHE cipher suites aren't implemented; they're offered
+		// only for the traffic signature and are never selected by
+		// servers that support the preceding ECDHE cipher suites.
+		hello.cipherSuites = []uint16{
+			TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			0x0033, // TLS_DHE_RSA_WITH_AES_128_CBC_SHA
+			0x0039, // TLS_DHE_RSA_WITH_AES_256_CBC_SHA
+			TLS_RSA_WITH_AES_128_CBC_SHA,
+			TLS_RSA_WITH_AES_256_CBC_SHA,
+			TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+		}
+
+		hello.signatureAndHashes = []signatureAndHash{
+			{hashSHA256, signatureECDSA},
+			{hashSHA384, signatureECDSA},
+			{hashSHA512, signatureECDSA},
+			{hashRSAPSS, hashSHA256},
+			{hashRSAPSS, hashSHA384},
+			{hashRSAPSS, hashSHA512},
+			{hashSHA256, signatureRSA},
+			{hashSHA384, signatureRSA},
+			{hashSHA512, signatureRSA},
+			{hashSHA1, signatureECDSA},
+			{hashSHA1, signatureRSA},
+		}
+
+		hello.scts = false
+
+		hello.nextProtoNeg = false
+
+		if len(c.config.NextProtos) == 0 {
+			hello.alpnProtocols = []string{"h2", "http/1.1"}
+		}
+
+		hello.extendedMasterSecretSupported = true
+	}
+
+	// [Psiphon]
+	// Re-configure extensions as required for RandomizeClientHello. Each
+	// handshake draws a new configuration, seeded from Config.Rand: the
+	// cipher suites, curves, signature algorithms, and extensions are
+	// shuffled, and optional cipher suites, curves, and extensions are
+	// included at random. The AES-128-GCM ECDHE cipher suites are always
+	// offered, so the randomized ClientHello remains compatible with
+	// typical servers.
+	if c.config.RandomizeClientHello {
+
+		var seed [8]byte
+		if _, err := io.ReadFull(c.config.rand(), seed[:]); err != nil {
+			c.sendAlert(alertInternalError)
+			return errors.New("tls: short read from Rand: " + err.Error())
+		}
+		prng := mathrand.New(mathrand.NewSource(
+			int64(binary.BigEndian.Uint64(seed[:]))))
+		flip := func() bool { return prng.Intn(2) == 0 }
+
+		hello.extensionOrder = make([]uint16, len(chromeExtensionOrder))
+		copy(hello.extensionOrder, chromeExtensionOrder)
+		prng.Shuffle(len(hello.extensionOrder), func(i, j int) {
+			hello.extensionOrder[i], hello.extensionOrder[j] =
+				hello.extensionOrder[j], hello.extensionOrder[i]
+		})
+
+		hello.greaseExtensions = flip()
+		hello.boringPadding = flip()
+
+		cipherSuites := make([]uint16, 0, len(hello.cipherSuites))
+		for _, suite := range hello.cipherSuites {
+			if suite == TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 ||
+				suite == TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 ||
+				flip() {
+
+				cipherSuites = append(cipherSuites, suite)
+			}
+		}
+		prng.Shuffle(len(cipherSuites), func(i, j int) {
+			cipherSuites[i], cipherSuites[j] = cipherSuites[j], cipherSuites[i]
+		})
+		if hello.greaseExtensions {
+			cipherSuites = append(
+				[]uint16{getGREASEValue(hello.random, greaseCipher)}, cipherSuites...)
+		}
+		hello.cipherSuites = cipherSuites
+
+		curves := []CurveID{X25519, CurveP256, CurveP384}
+		if flip() {
+			curves = append(curves, CurveP521)
+		}
+		prng.Shuffle(len(curves), func(i, j int) {
+			curves[i], curves[j] = curves[j], curves[i]
+		})
+		if hello.greaseExtensions {
+			curves = append(
+				[]CurveID{CurveID(getGREASEValue(hello.random, greaseGroup))}, curves...)
+		}
+		hello.supportedCurves = curves
+
+		signatureAndHashes := make([]signatureAndHash, len(supportedSignatureAlgorithms))
+		copy(signatureAndHashes, supportedSignatureAlgorithms)
+		prng.Shuffle(len(signatureAndHashes), func(i, j int) {
+			signatureAndHashes[i], signatureAndHashes[j] =
+				signatureAndHashes[j], signatureAndHashes[i]
+		})
+		hello.signatureAndHashes = signatureAndHashes
+
+		hello.ocspStapling = flip()
+		hello.scts = flip()
+		hello.nextProtoNeg = false
+		hello.extendedMasterSecretSupported = flip()
+
+		if len(c.config.NextProtos) == 0 {
+			if flip() {
+				hello.alpnProtocols = []string{"h2", "http/1.1"}
+			} else {
+				hello.alpnProtocols = []string{"http/1.1"}
+			}
+		}
+	}
+
 	if _, err := c.writeRecord(recordTypeHandshake, hello.marshal()); err != nil {
 		return err
 	}
@@ -347,6 +514,43 @@ NextCipherSuite:
 	return nil
 }
 
+// [Psiphon]
+// chromeExtensionOrder is the BoringSSL ClientHello extension order used
+// for EmulateChrome. It lists every extension that may be marshaled and so
+// is also the set of extensions shuffled for RandomizeClientHello.
+var chromeExtensionOrder = []uint16{
+	extensionRenegotiationInfo,
+	extensionServerName,
+	extensionExtendedMasterSecret,
+	extensionSessionTicket,
+	extensionSignatureAlgorithms,
+	extensionStatusRequest,
+	extensionSCT,
+	extensionNextProtoNeg,
+	extensionALPN,
+	extensionChannelID,
+	extensionSupportedPoints,
+	extensionSupportedCurves,
+}
+
+// [Psiphon]
+// firefoxExtensionOrder is the NSS ClientHello extension order used for
+// EmulateFirefox.
+var firefoxExtensionOrder = []uint16{
+	extensionServerName,
+	extensionExtendedMasterSecret,
+	extensionRenegotiationInfo,
+	extensionSupportedCurves,
+	extensionSupportedPoints,
+	extensionSessionTicket,
+	extensionALPN,
+	extensionStatusRequest,
+	extensionSignatureAlgorithms,
+	extensionSCT,
+	extensionNextProtoNeg,
+	extensionChannelID,
+}
+
 // From: https://github.com/google/boringssl/blob/46db7af2c998cf8514d606408546d9be9699f03c/ssl/internal.h#L1225-L1231
 const (
 	greaseCipher     = 0
@@ -574,7 +778,7 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 
 	// [Psiphon]
 	// extended master secret implementation from https://github.com/google/boringssl/commit/7571292eaca1745f3ecda2374ba1e8163b58c3b5
-	if hs.serverHello.extendedMasterSecret && c.config.EmulateChrome {
+	if hs.serverHello.extendedMasterSecret && hs.hello.extendedMasterSecretSupported {
 		hs.masterSecret = extendedMasterFromPreMasterSecret(c.vers, hs.suite, preMasterSecret, hs.finishedHash)
 		c.extendedMasterSecret = true
 	} else {
@@ -8,11 +8,17 @@ import "bytes"
 
 type clientHelloMsg struct {
 	// [Psiphon]
-	// emulateChrome indicates whether to use Chrome/BoringSSL-like
-	// extension order. This order is used only when emulateChrome
-	// is set to ensure the automated tests run against pre-recorded
-	// "testdata".
-	emulateChrome bool
+	// extensionOrder, when set, specifies the order in which extensions
+	// are marshaled, as required for EmulateChrome, EmulateFirefox, and
+	// RandomizeClientHello. The order lists every extension that may be
+	// marshaled; extensions that aren't configured are skipped. The
+	// default order is used when extensionOrder isn't set, to ensure the
+	// automated tests run against pre-recorded "testdata".
+	// greaseExtensions adds Chrome/BoringSSL-like GREASE extensions, and
+	// boringPadding adds the Chrome/BoringSSL-like padding extension.
+	extensionOrder   []uint16
+	greaseExtensions bool
+	boringPadding    bool
 
 	raw                          []byte
 	vers                         uint16
@@ -128,20 +134,20 @@ func (m *clientHelloMsg) marshal() []byte {
 	if m.channelIDSupported {
 		numExtensions++
 	}
-	if m.emulateChrome {
+	if m.greaseExtensions {
 		// GREASE extensions
 		numExtensions += 2
 		extensionsLength++
 	}
 
 	// [Psiphon]
-	// Padding extension required for EmulateChrome.
+	// Padding extension required for EmulateChrome and EmulateFirefox.
 	// Logic from:
 	//
 	// https://github.com/google/boringssl/blob/46db7af2c998cf8514d606408546d9be9699f03c/ssl/t1_lib.c#L2803
 	// https://github.com/google/boringssl/blob/master/LICENSE
 	paddingLength := uint16(0)
-	if m.emulateChrome {
+	if m.boringPadding {
 		unpaddedLength := length + 2 + 4*numExtensions + extensionsLength
 		if unpaddedLength > 0xff && unpaddedLength < 0x200 {
 			paddingLength = 0x200 - uint16(unpaddedLength)
@@ -182,7 +188,8 @@ func (m *clientHelloMsg) marshal() []byte {
 	copy(z[1:], m.compressionMethods)
 
 	// [Psiphon]
-	// The extension marshal order changes as required for EmulateChrome.
+	// The extension marshal order changes as required for EmulateChrome,
+	// EmulateFirefox, and RandomizeClientHello.
 
 	marshalNextProtoNeg := func() {
 		z[0] = byte(extensionNextProtoNeg >> 8)
@@ -387,61 +394,81 @@ func (m *clientHelloMsg) marshal() []byte {
 		z = z[2:]
 	}
 
-	if m.emulateChrome {
+	if m.extensionOrder != nil {
 
 		// [Psiphon]
 		// This code handles extension ordering only; configuration
-		// of extensions as required for EmulateChrome is handled
-		// in Conn.clientHandshae().
+		// of extensions as required for EmulateChrome, EmulateFirefox,
+		// and RandomizeClientHello is handled in Conn.clientHandshake().
 
 		greaseValue := getGREASEValue(m.random, greaseExtension1)
-		marshalGREASE(greaseValue, true)
-
-		if m.secureRenegotiationSupported {
-			marshalRenegotiationInfo()
-		}
-		if len(m.serverName) > 0 {
-			marshalServerName()
-		}
-		if m.extendedMasterSecretSupported {
-			marshalExtendedMasterSecret()
-		}
-		if m.ticketSupported {
-			marshalSessionTicket()
-		}
-		if len(m.signatureAndHashes) > 0 {
-			marshalSignatureAlgorithms()
-		}
-		if m.ocspStapling {
-			marshalStatusRequest()
-		}
-		if m.scts {
-			marshalSCT()
-		}
-		if m.nextProtoNeg {
-			marshalNextProtoNeg()
-		}
-		if len(m.alpnProtocols) > 0 {
-			marshalALPN()
-		}
-		if m.channelIDSupported {
-			marshalChannelID()
-		}
-		if len(m.supportedPoints) > 0 {
-			marshalSupportedPoints()
-		}
-		if len(m.supportedCurves) > 0 {
-			marshalSupportedCurves()
+		if m.greaseExtensions {
+			marshalGREASE(greaseValue, true)
 		}
 
-		previousValue := greaseValue
-		greaseValue = getGREASEValue(m.random, greaseExtension2)
-		if greaseValue == previousValue {
-			// See: https://github.com/google/boringssl/blob/46db7af2c998cf8514d606408546d9be9699f03c/ssl/t1_lib.c#L2787-L2792
-			greaseValue ^= 0x1010
+		for _, extension := range m.extensionOrder {
+			switch extension {
+			case extensionRenegotiationInfo:
+				if m.secureRenegotiationSupported {
+					marshalRenegotiationInfo()
+				}
+			case extensionServerName:
+				if len(m.serverName) > 0 {
+					marshalServerName()
+				}
+			case extensionExtendedMasterSecret:
+				if m.extendedMasterSecretSupported {
+					marshalExtendedMasterSecret()
+				}
+			case extensionSessionTicket:
+				if m.ticketSupported {
+					marshalSessionTicket()
+				}
+			case extensionSignatureAlgorithms:
+				if len(m.signatureAndHashes) > 0 {
+					marshalSignatureAlgorithms()
+				}
+			case extensionStatusRequest:
+				if m.ocspStapling {
+					marshalStatusRequest()
+				}
+			case extensionSCT:
+				if m.scts {
+					marshalSCT()
+				}
+			case extensionNextProtoNeg:
+				if m.nextProtoNeg {
+					marshalNextProtoNeg()
+				}
+			case extensionALPN:
+				if len(m.alpnProtocols) > 0 {
+					marshalALPN()
+				}
+			case extensionChannelID:
+				if m.channelIDSupported {
+					marshalChannelID()
+				}
+			case extensionSupportedPoints:
+				if len(m.supportedPoints) > 0 {
+					marshalSupportedPoints()
+				}
+			case extensionSupportedCurves:
+				if len(m.supportedCurves) > 0 {
+					marshalSupportedCurves()
+				}
+			}
 		}
 
-		marshalGREASE(greaseValue, false)
+		if m.greaseExtensions {
+			previousValue := greaseValue
+			greaseValue = getGREASEValue(m.random, greaseExtension2)
+			if greaseValue == previousValue {
+				// See: https://github.com/google/boringssl/blob/46db7af2c998cf8514d606408546d9be9699f03c/ssl/t1_lib.c#L2787-L2792
+				greaseValue ^= 0x1010
+			}
+
+			marshalGREASE(greaseValue, false)
+		}
 
 		if paddingLength > 0 {
 			marshalPadding(paddingLength)
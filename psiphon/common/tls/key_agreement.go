@@ -376,10 +376,22 @@ func (ka *ecdheKeyAgreement) processServerKeyExchange(config *Config, clientHell
 	}
 
 	sigAndHash := signatureAndHash{signature: ka.sigType}
+	isRSAPSS := false
 	if ka.version >= VersionTLS12 {
 		// handle SignatureAndHashAlgorithm
 		sigAndHash = signatureAndHash{hash: sig[0], signature: sig[1]}
-		if sigAndHash.signature != ka.sigType {
+
+		// [Psiphon]
+		// Accept an RSA-PSS signature when the ClientHello offered the
+		// scheme. The digest is then computed with the hash identified
+		// by the signature field of the scheme.
+		if sigAndHash.hash == hashRSAPSS && ka.sigType == signatureRSA {
+			if !isSupportedSignatureAndHash(sigAndHash, clientHello.signatureAndHashes) {
+				return errServerKeyExchange
+			}
+			isRSAPSS = true
+			sigAndHash = signatureAndHash{hash: sigAndHash.signature, signature: signatureRSA}
+		} else if sigAndHash.signature != ka.sigType {
 			return errServerKeyExchange
 		}
 		sig = sig[2:]
@@ -418,6 +430,14 @@ func (ka *ecdheKeyAgreement) processServerKeyExchange(config *Config, clientHell
 		if !ok {
 			return errors.New("tls: ECDHE RSA requires a RSA server public key")
 		}
+		// [Psiphon]
+		if isRSAPSS {
+			opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+			if err := rsa.VerifyPSS(pubKey, hashFunc, digest, sig, opts); err != nil {
+				return err
+			}
+			break
+		}
 		if err := rsa.VerifyPKCS1v15(pubKey, hashFunc, digest, sig); err != nil {
 			return err
 		}
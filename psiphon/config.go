@@ -20,12 +20,19 @@
 package psiphon
 
 import (
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"unicode"
@@ -92,9 +99,20 @@ type Config struct {
 
 	// EgressRegion is a ISO 3166-1 alpha-2 country code which indicates which
 	// country to egress from. For the default, "", the best performing server
-	// in any country is selected.
+	// in any country is selected. When there are no known servers in the
+	// region, an EgressRegionUnavailable notice is emitted. See
+	// GetAvailableEgressRegions for the list of regions that may be selected.
 	EgressRegion string
 
+	// ObfuscationPassphrase is an optional pre-shared passphrase which is
+	// mixed into the Obfuscated SSH key derivation. Only servers configured
+	// with the same passphrase interoperate with the client. Server entries
+	// which don't carry the ObfuscationPassphraseTag corresponding to the
+	// passphrase are not attempted, and a ServerEntryRejected notice is
+	// emitted. When ObfuscationPassphrase is not set, server entries which
+	// carry any tag are likewise not attempted.
+	ObfuscationPassphrase string
+
 	// ListenInterface specifies which interface to listen on.  If no
 	// interface is provided then listen on 127.0.0.1. If 'any' is provided
 	// then use 0.0.0.0. If there are multiple IP addresses on an interface
@@ -109,14 +127,79 @@ type Config struct {
 	// free port (a notice reporting the selected port is emitted).
 	LocalSocksProxyPort int
 
+	// LocalSocksProxyUsername and LocalSocksProxyPassword, when set, require
+	// SOCKS5 clients of the local SOCKS proxy to authenticate with RFC 1929
+	// username/password authentication. When set, clients offering only the
+	// "no authentication" method, and SOCKS4a clients, are rejected. When
+	// not set, the local SOCKS proxy does not require authentication.
+	LocalSocksProxyUsername string
+	LocalSocksProxyPassword string
+
 	// LocalHttpProxyPort specifies a port number for the local HTTP proxy
 	// running at 127.0.0.1. For the default value, 0, the system selects a
 	// free port (a notice reporting the selected port is emitted).
 	LocalHttpProxyPort int
 
+	// LocalSocksProxyAddress and LocalHttpProxyAddress specify host:port
+	// addresses for the local SOCKS and HTTP proxies to listen on, where
+	// host is an IP address. When set, these override ListenInterface and
+	// LocalSocksProxyPort/LocalHttpProxyPort. A port of 0 selects a free
+	// port, and the actual listening address is reported in a notice.
+	//
+	// Listening on a non-loopback address exposes the local proxies to other
+	// hosts and requires AllowNonLoopbackLocalProxyAddress to be set.
+	LocalSocksProxyAddress string
+	LocalHttpProxyAddress  string
+
+	// AllowNonLoopbackLocalProxyAddress permits LocalSocksProxyAddress and
+	// LocalHttpProxyAddress to specify non-loopback addresses. This is an
+	// explicit opt-in as, unless LocalSocksProxyUsername is also set, the
+	// local proxies are open to any host that can reach them.
+	AllowNonLoopbackLocalProxyAddress bool
+
 	// DisableLocalHTTPProxy disables running the local HTTP proxy.
 	DisableLocalHTTPProxy bool
 
+	// MaxOpenPortForwards and MaxOpenPortForwardsPerHost limit the number of
+	// concurrently open port forwards through each local proxy, in total and
+	// to any one destination host. Connections exceeding a limit are
+	// rejected, with a SOCKS "connection not allowed" reply or an HTTP 429
+	// response, and a LocalProxyThrottled notice is emitted. The default, 0,
+	// is no limit.
+	MaxOpenPortForwards        int
+	MaxOpenPortForwardsPerHost int
+
+	// PortForwardIdleSeconds specifies how long a local proxy port forward
+	// may go without relaying any bytes, in either direction, before both
+	// the port forward and the local connection are closed. This reaps
+	// stalled port forwards, including those left open by apps which don't
+	// close their sockets, and ensures the app sees a timely close. 0, the
+	// default, disables the timeout.
+	PortForwardIdleSeconds *int
+
+	// HealthCheckAddress, when set, specifies a host:port address for a
+	// local HTTP health check endpoint. The endpoint responds with 200 when
+	// at least one tunnel is established and 503 otherwise, with a JSON body
+	// summarizing the tunnels; see HealthCheckStatus. This may be used, for
+	// example, as a Kubernetes readiness probe. The endpoint is served
+	// directly and is never tunneled.
+	HealthCheckAddress string
+
+	// PACServerAddress, when set, specifies a host:port address for a local
+	// HTTP endpoint which serves a proxy auto-config (PAC) file. The PAC file
+	// routes through the local HTTP and SOCKS proxies, at their actual
+	// listening addresses, and excludes local networks and
+	// SplitTunnelDirectCIDRs; see PACServer. A ListeningPACServer notice
+	// reports the PAC URL.
+	PACServerAddress string
+
+	// UseControllerDial indicates that the host application makes tunneled
+	// connections directly, with Controller.Dial, rather than through the
+	// local proxies. When both local proxies are disabled and neither a
+	// packet tunnel nor UseControllerDial is configured, no traffic may flow
+	// through the tunnel and LoadConfig emits an alert.
+	UseControllerDial bool
+
 	// NetworkLatencyMultiplier is a multiplier that is to be applied to
 	// default network event timeouts. Set this to tune performance for
 	// slow networks.
@@ -126,18 +209,42 @@ type Config struct {
 	// TunnelProtocol indicates which protocol to use. For the default, "",
 	// all protocols are used.
 	//
-	// Deprecated: Use TunnelProtocols. When TunnelProtocols is not nil, this
-	// parameter is ignored.
+	// Deprecated: Use LimitTunnelProtocols. When LimitTunnelProtocols or
+	// TunnelProtocols is not nil, this parameter is ignored.
 	TunnelProtocol string
 
-	// TunnelProtocols indicates which protocols to use. Valid values include:
-	// "SSH", "OSSH", "UNFRONTED-MEEK-OSSH", "UNFRONTED-MEEK-HTTPS-OSSH",
-	// "UNFRONTED-MEEK-SESSION-TICKET-OSSH", "FRONTED-MEEK-OSSH", "FRONTED-
-	// MEEK-HTTP-OSSH".
+	// TunnelProtocols indicates which protocols to use.
 	//
-	// For the default, an empty list, all protocols are used.
+	// Deprecated: Use LimitTunnelProtocols. When LimitTunnelProtocols is not
+	// nil, this parameter is ignored.
 	TunnelProtocols []string
 
+	// LimitTunnelProtocols indicates which protocols to use. Only the listed
+	// protocols are attempted during tunnel establishment. Valid values
+	// include: "SSH", "OSSH", "UNFRONTED-MEEK-OSSH",
+	// "UNFRONTED-MEEK-HTTPS-OSSH", "UNFRONTED-MEEK-SESSION-TICKET-OSSH",
+	// "FRONTED-MEEK-OSSH", "FRONTED-MEEK-HTTP-OSSH", "QUIC-OSSH".
+	//
+	// "QUIC-OSSH" runs over UDP and is not used when UpstreamProxyURL is
+	// set.
+	//
+	// For the default, an empty list, all protocols are used.
+	LimitTunnelProtocols []string
+
+	// DisableTunnelProtocols indicates protocols which are never to be used.
+	// Disabled protocols are removed from LimitTunnelProtocols or, when
+	// LimitTunnelProtocols is empty, from all protocols. Valid values are
+	// the same as for LimitTunnelProtocols. At least one protocol must remain
+	// enabled.
+	DisableTunnelProtocols []string
+
+	// DisableStickyTunnelProtocol disables preferring, in the first round of
+	// tunnel establishment, the tunnel protocol that last succeeded for each
+	// server region. By default, the last successful protocol is tried first
+	// so that reconnecting doesn't re-probe protocols that may be blocked.
+	// This flag is intended for testing.
+	DisableStickyTunnelProtocol bool
+
 	// EstablishTunnelTimeoutSeconds specifies a time limit after which to
 	// halt the core tunnel controller if no tunnel has been established. The
 	// default is parameters.EstablishTunnelTimeoutSeconds.
@@ -150,16 +257,42 @@ type Config struct {
 	// typical overridden for testing.
 	EstablishTunnelPausePeriodSeconds *int
 
+	// EstablishTunnelPausePeriodMaxSeconds specifies the maximum delay
+	// between attempts to establish tunnels. The delay starts at
+	// EstablishTunnelPausePeriodSeconds and doubles after each attempt that
+	// fails to establish a tunnel, so that attempts are spaced out while the
+	// network is down. The delay is reset once a tunnel remains connected
+	// for a sustained period. If omitted, a default value is used.
+	EstablishTunnelPausePeriodMaxSeconds *int
+
+	// EstablishTunnelPausePeriodJitter specifies the maximum deviation, as a
+	// fraction of the delay, applied at random to the delay between attempts
+	// to establish tunnels. If omitted, a default value is used.
+	EstablishTunnelPausePeriodJitter *float64
+
 	// ConnectionWorkerPoolSize specifies how many connection attempts to
 	// attempt in parallel. If omitted of when 0, a default is used; this is
 	// recommended.
 	ConnectionWorkerPoolSize int
 
+	// TunnelConnectTimeoutSeconds specifies a time limit for each individual
+	// candidate server connection attempt, covering the dial and the SSH
+	// handshake. Slow or blackholed candidates are abandoned after this
+	// period, freeing the connection worker for the next candidate. If
+	// omitted, the default is parameters.TunnelConnectTimeout.
+	TunnelConnectTimeoutSeconds *int
+
 	// TunnelPoolSize specifies how many tunnels to run in parallel. Port
 	// forwards are multiplexed over multiple tunnels. If omitted or when 0,
 	// the default is TUNNEL_POOL_SIZE, which is recommended.
 	TunnelPoolSize int
 
+	// TunnelPoolSelection specifies how port forwards are distributed among
+	// the tunnels in the pool. Valid values are "round-robin" and
+	// "least-loaded", which selects the tunnel with the fewest open port
+	// forwards. The default, "", is "round-robin".
+	TunnelPoolSelection string
+
 	// StaggerConnectionWorkersMilliseconds adds a specified delay before
 	// making each server candidate available to connection workers. This
 	// option is enabled when StaggerConnectionWorkersMilliseconds > 0.
@@ -170,9 +303,30 @@ type Config struct {
 	// enabled when LimitMeekConnectionWorkers > 0.
 	LimitMeekConnectionWorkers int
 
+	// ServerEntryPerformanceDecayWindowSeconds specifies the period over
+	// which recorded server connection success rates and latencies decay.
+	// Server candidates are ordered to favor servers with recent successful,
+	// low latency connections. If omitted, a default value is used.
+	ServerEntryPerformanceDecayWindowSeconds *int
+
+	// ServerEntryPerformanceExplorationRatio specifies the fraction, from 0.0
+	// to 1.0, of server candidates selected at random rather than by recorded
+	// performance. If omitted, a default value is used.
+	ServerEntryPerformanceExplorationRatio *float64
+
 	// LimitMeekBufferSizes selects smaller buffers for meek protocols.
 	LimitMeekBufferSizes bool
 
+	// MeekMinPollIntervalMilliseconds and MeekMaxPollIntervalMilliseconds
+	// specify the range of the meek polling interval, which backs off from
+	// the minimum to the maximum while no data is exchanged.
+	// MeekMaxRequestPayloadBytes limits the payload sent in each meek
+	// request, for CDNs which impose small request sizes; it cannot exceed
+	// 65536. If omitted, default values are used.
+	MeekMinPollIntervalMilliseconds *int
+	MeekMaxPollIntervalMilliseconds *int
+	MeekMaxRequestPayloadBytes      *int
+
 	// IgnoreHandshakeStatsRegexps skips compiling and using stats regexes.
 	IgnoreHandshakeStatsRegexps bool
 
@@ -212,6 +366,49 @@ type Config struct {
 	// This parameter is only applicable to library deployments.
 	IPv6Synthesizer IPv6Synthesizer
 
+	// IPAddressFamilyPreference specifies how TCP dials choose between the
+	// IPv4 and IPv6 addresses of a destination. Valid values are
+	// IP_ADDRESS_FAMILY_PREFER_IPV4, "prefer-ipv4", which tries IPv4
+	// addresses first; IP_ADDRESS_FAMILY_PREFER_IPV6, "prefer-ipv6", which
+	// tries IPv6 addresses first; and IP_ADDRESS_FAMILY_HAPPY_EYEBALLS,
+	// "happy-eyeballs", which races IPv6 and IPv4 connections, as in RFC 8305.
+	// The default, "", tries addresses in random order.
+	IPAddressFamilyPreference string
+
+	// TunnelSocketFwmark, when non-zero, specifies a firewall mark (SO_MARK)
+	// to set on sockets used to dial tunnels and other untunneled
+	// connections. Host routing rules may match the mark to route the
+	// tunnel's own traffic outside of a VPN, avoiding a routing loop. Setting
+	// the mark typically requires CAP_NET_ADMIN.
+	//
+	// TunnelSocketFwmark is only supported on Linux and is ignored, with a
+	// notice, on other platforms.
+	TunnelSocketFwmark uint32
+
+	// TunnelSocketReadBuffer and TunnelSocketWriteBuffer, when non-zero,
+	// specify the size, in bytes, of the socket receive (SO_RCVBUF) and send
+	// (SO_SNDBUF) buffers for sockets used to dial tunnels and untunneled
+	// downloads. On high bandwidth-delay product paths, such as long, fast
+	// links, the default buffers limit the TCP window and cap throughput of,
+	// e.g., DownloadUpgrade. The buffers are set before connecting, so that
+	// the TCP window scale reflects the larger buffer. The operating system
+	// may adjust or cap the sizes; on Linux, the effective size is limited by
+	// net.core.rmem_max and net.core.wmem_max. Valid sizes range from
+	// MIN_SOCKET_BUFFER_SIZE to MAX_SOCKET_BUFFER_SIZE. The default, 0, uses
+	// the operating system default and auto-tuning.
+	TunnelSocketReadBuffer  int
+	TunnelSocketWriteBuffer int
+
+	// BootstrapDohUrl specifies a DNS-over-HTTPS (RFC 8484) resolver URL,
+	// such as "https://1.1.1.1/dns-query", to use when resolving domains for
+	// untunneled connections, including meek fronts and remote server list
+	// and upgrade download hosts. This bypasses system DNS resolution, which
+	// may be subject to tampering. When a DoH lookup fails, resolution falls
+	// back to the system resolver. The URL must use the https scheme; the DoH
+	// server host should be an IP address, as that host itself is resolved
+	// with the system resolver.
+	BootstrapDohUrl string
+
 	// DnsServerGetter is an interface that enables tunnel-core to call into
 	// the host application to discover the native network DNS server
 	// settings. See: DnsServerGetter doc.
@@ -226,6 +423,55 @@ type Config struct {
 	// This parameter is only applicable to library deployments.
 	NetworkIDGetter NetworkIDGetter
 
+	// ServerEntrySource is an interface that enables the host application to
+	// supply server entries, in addition to the built-in embedded and remote
+	// server lists. When set, the server entries are imported when the
+	// controller starts, before tunnel establishment begins. See:
+	// ServerEntrySource doc.
+	//
+	// This parameter is only applicable to library deployments.
+	ServerEntrySource ServerEntrySource
+
+	// KeyValueStore is an interface that enables the host application to
+	// supply the storage backend for persistent client state, such as an
+	// app-specific encrypted store. When not set, state is stored in files
+	// in DataStoreDirectory. See: KeyValueStore doc.
+	//
+	// This parameter is only applicable to library deployments.
+	KeyValueStore KeyValueStore
+
+	// NoticeWriter and NoticeCallback, when either is set, give the
+	// controller created with this config its own notice sink. Notices
+	// emitted by the controller, its establishment workers, and its tunnels,
+	// including Tunnels notices, are written to NoticeWriter and delivered to
+	// NoticeCallback instead of to the process-wide writer and callback set
+	// with SetNoticeWriter and SetNoticeCallback. This allows an application
+	// to run multiple controllers, each with its own config, in one process
+	// and tell their notices apart. NoticeCallback is invoked as described in
+	// SetNoticeCallback. Either may be nil. The diagnostic, severity, and
+	// timestamp notice settings in effect when NewController is called apply.
+	//
+	// The controller's local proxies, remote server list fetches, upgrade
+	// downloads, and datastore reads and writes made with this config also
+	// emit to its notice sink. Notices from components that are not specific
+	// to one controller, including InitDataStore, datastore functions that
+	// take no config, such as StoreServerEntry, and persistent stats, are
+	// emitted to the process-wide notice sink.
+	//
+	// This parameter is only applicable to library deployments.
+	NoticeWriter   io.Writer
+	NoticeCallback func(noticeType string, data map[string]interface{})
+
+	// MeekFrontingAddressSelection specifies how a fronting address is
+	// selected, for each fronted meek connection attempt, from the server
+	// entry's list of candidate fronting addresses. Valid values are
+	// "random", "ordered", which prefers fronting addresses in list order,
+	// and "sticky-on-success", which prefers the fronting address that last
+	// connected successfully. With all policies, fronting addresses that
+	// have failed are skipped until all fronting addresses have failed. The
+	// default, "", is "random".
+	MeekFrontingAddressSelection string
+
 	// TransformHostNames specifies whether to use hostname transformation
 	// circumvention strategies. Set to "always" to always transform, "never"
 	// to never transform, and "", the default, for the default transformation
@@ -249,6 +495,14 @@ type Config struct {
 	// testing and debugging only.
 	TargetApiProtocol string
 
+	// HandshakePaddingMinBytes and HandshakePaddingMaxBytes specify the
+	// range, inclusive, of the length of random padding added to each
+	// handshake request, so that handshake requests don't have a fixed size.
+	// The padding is ignored by the server. If omitted, default values are
+	// used.
+	HandshakePaddingMinBytes *int
+	HandshakePaddingMaxBytes *int
+
 	// RemoteServerListUrl is a URL which specifies a location to fetch out-
 	// of-band server entries. This facility is used when a tunnel cannot be
 	// established to known servers. This value is supplied by and depends on
@@ -282,6 +536,38 @@ type Config struct {
 	// This is used for special case temporary tunnels.
 	DisableRemoteServerListFetcher bool
 
+	// ConnectionTraceFile specifies a file to which a JSON line is appended
+	// for each tunnel connection lifecycle event: dial, SSH handshake,
+	// establishment, and teardown, along with failures. Events include
+	// timestamps and tunnel byte counts, and are intended for debugging
+	// connection blocking without packet captures. Events never include
+	// payload data or port forward destinations.
+	ConnectionTraceFile string
+
+	// ConnectionTraceIncludeServerAddresses opts into including the server
+	// IP address in ConnectionTraceFile events. By default, only the server
+	// region is included.
+	ConnectionTraceIncludeServerAddresses bool
+
+	// PrefetchServerEntries enables prefetching the common remote server
+	// list, and refreshing the recorded server entry performance, while a
+	// tunnel is established and idle. Prefetched server entries are then
+	// available for the next tunnel establishment without waiting on a
+	// fetch. The prefetch download is rate limited so that it doesn't
+	// compete with user traffic. Requires RemoteServerListURLs.
+	PrefetchServerEntries bool
+
+	// PrefetchServerEntriesBytesPerSecond specifies the download rate limit
+	// for server entry prefetches.
+	// For testing purposes.
+	PrefetchServerEntriesBytesPerSecond *int
+
+	// PrefetchServerEntriesIdleSeconds specifies how long the active tunnels
+	// must have had no port forward traffic before a server entry prefetch
+	// is made.
+	// For testing purposes.
+	PrefetchServerEntriesIdleSeconds *int
+
 	// FetchRemoteServerListRetryPeriodMilliseconds specifies the delay before
 	// resuming a remote server list download after a failure. If omitted, a
 	// default value is used. This value is typical overridden for testing.
@@ -331,6 +617,23 @@ type Config struct {
 	// server must support TCP requests.
 	SplitTunnelDNSServer string
 
+	// SplitTunnelDirectCIDRs specifies a list of networks, in CIDR notation,
+	// such as "192.0.2.0/24" or "2001:db8::/32", which are always accessed
+	// directly, untunneled, by the local SOCKS and HTTP proxies. This applies
+	// independent of the routes data for the client region. Hostname
+	// destinations are resolved, for classification, using
+	// SplitTunnelDNSServer; when SplitTunnelDNSServer is not set, only IP
+	// address destinations are matched. An Untunneled notice is emitted
+	// the first time each destination is accessed untunneled.
+	SplitTunnelDirectCIDRs []string
+
+	// SplitTunnelDirectRegions specifies a list of country codes, in addition
+	// to the client region, for which routes data is fetched using
+	// SplitTunnelRoutesURLFormat. Destinations in these regions are accessed
+	// directly, untunneled. SplitTunnelDirectRegions requires all the
+	// SplitTunnel routes parameters to be supplied.
+	SplitTunnelDirectRegions []string
+
 	// UpgradeDownloadUrl specifies a URL from which to download a host client
 	// upgrade file, when one is available. The core tunnel controller
 	// provides a resumable download facility which downloads this resource
@@ -365,19 +668,202 @@ type Config struct {
 	// (UpgradeDownloadFilename.part*) to allow for resumable downloading.
 	UpgradeDownloadFilename string
 
+	// UpgradeDownloadTempDir specifies a directory in which to store the
+	// intermediate, partial download files, in place of the directory of
+	// UpgradeDownloadFilename, which may be on a read-mostly or small
+	// partition. The directory is created if it doesn't exist. When the
+	// directory is on a different filesystem, the completed download is
+	// copied to UpgradeDownloadFilename, which is still never observed with
+	// partial contents; and the disk space check, before downloading, also
+	// requires space for the entire download in the UpgradeDownloadFilename
+	// directory. The default, "", is the UpgradeDownloadFilename
+	// directory.
+	UpgradeDownloadTempDir string
+
+	// UpgradeDownloadSHA256 is an optional, hex-encoded SHA-256 digest of the
+	// upgrade file. When specified, the digest of a completed upgrade download
+	// is verified before the file is moved to UpgradeDownloadFilename; a
+	// download which fails verification is discarded. When blank, no digest
+	// verification is performed and the outer client is expected to
+	// authenticate the upgrade package.
+	UpgradeDownloadSHA256 string
+
+	// UpgradeDownloadBytesPerSecond specifies a rate limit, in bytes per
+	// second, for upgrade downloads. This allows for a background upgrade
+	// download that doesn't saturate the tunnel on metered connections. The
+	// default, 0, is no limit.
+	UpgradeDownloadBytesPerSecond int64
+
+	// UpgradeDownloadMaxBytes specifies the maximum size of an upgrade
+	// download. A download which exceeds this size, as advertised or as
+	// actually received, fails, is not retried, and any partial download is
+	// deleted. This protects constrained devices from disk exhaustion by a
+	// hostile endpoint. The default, 0, is no limit.
+	UpgradeDownloadMaxBytes int64
+
+	// UpgradeDownloadHeaders is a set of additional HTTP headers, such as
+	// an authorization header or a CDN bypass token, that are added to
+	// upgrade download requests. Headers set by the download itself, such as
+	// User-Agent and Range, are never replaced. Headers which control the
+	// request framing or the requested range, such as Host and Range, may
+	// not be specified.
+	UpgradeDownloadHeaders http.Header
+
+	// UpgradeDownloadMaxConcurrency specifies the maximum number of parallel
+	// Range requests used to download an upgrade. Concurrent chunk downloads
+	// may better utilize bandwidth on high-latency tunnels. The default, 0,
+	// and 1 both specify a single, sequential download.
+	UpgradeDownloadMaxConcurrency int
+
+	// UpgradeDownloadUntunneledDiagnostic specifies that upgrade downloads
+	// are to be made untunneled, dialing directly, even when a tunnel is
+	// available. This is a diagnostic for distinguishing server-side problems
+	// from tunnel problems, and may be used only in diagnostics builds, built
+	// with the DIAGNOSTICS tag; otherwise, the config is rejected.
+	UpgradeDownloadUntunneledDiagnostic bool
+
+	// UpgradeDownloadConditionalRequest specifies that the ETag and
+	// Last-Modified validators of each completed upgrade download are stored,
+	// in the KeyValueStore and keyed by UpgradeDownloadFilename, and that
+	// subsequent upgrade downloads first make a conditional HEAD request
+	// using the stored validators. When the server responds with 304 Not
+	// Modified, the previously completed upgrade is unchanged and the
+	// download is skipped. The outer client should call
+	// ClearUpgradeDownloadValidator to force a re-download of an unchanged
+	// upgrade. Any UpgradeDownloadFilename.validator file, stored by previous
+	// versions, is deleted and ignored.
+	UpgradeDownloadConditionalRequest bool
+
+	// UpgradeDownloadRetries specifies the number of times a failed upgrade
+	// download is immediately resumed, with exponential backoff, before
+	// DownloadUpgrade fails. If omitted, a default value is used.
+	UpgradeDownloadRetries *int
+
+	// UpgradeDownloadRetryBaseMilliseconds specifies the delay before the
+	// first upgrade download retry; the delay doubles for each subsequent
+	// retry, up to UpgradeDownloadRetryMaxMilliseconds. If omitted, a default
+	// value is used.
+	UpgradeDownloadRetryBaseMilliseconds *int
+
+	// UpgradeDownloadRetryMaxMilliseconds specifies the maximum delay before
+	// an upgrade download retry. If omitted, a default value is used.
+	UpgradeDownloadRetryMaxMilliseconds *int
+
+	// UpgradeDownloadRetryAfterMaxMilliseconds specifies the maximum delay
+	// honored when the upgrade download server responds with 503 and a
+	// Retry-After header. 0 ignores Retry-After. If omitted, a default value
+	// is used.
+	UpgradeDownloadRetryAfterMaxMilliseconds *int
+
+	// UpgradeDownloadResumeVerifyBytes specifies how many bytes at the end of
+	// a partial upgrade download are verified against the server's bytes when
+	// the download is resumed. 0 disables verification. If omitted, a
+	// default value is used.
+	UpgradeDownloadResumeVerifyBytes *int
+
+	// UpgradeDownloadDiskSpaceMarginBytes specifies the free disk space, in
+	// addition to the remaining upgrade download size, that must be available
+	// before an upgrade download is started. If omitted, a default value is
+	// used.
+	UpgradeDownloadDiskSpaceMarginBytes *int
+
+	// UpgradeCheckPeriodSeconds specifies the nominal period between
+	// periodic upgrade checks scheduled with GetUpgradeCheckDelay. If
+	// omitted, a default value is used.
+	UpgradeCheckPeriodSeconds *int
+
+	// UpgradeCheckPeriodJitter specifies the maximum deviation, as a fraction
+	// of UpgradeCheckPeriodSeconds, of the delay returned by
+	// GetUpgradeCheckDelay. If omitted, a default value is used.
+	UpgradeCheckPeriodJitter *float64
+
 	// FetchUpgradeRetryPeriodMilliseconds specifies the delay before resuming
 	// a client upgrade download after a failure. If omitted, a default value
 	// is used. This value is typical overridden for testing.
 	FetchUpgradeRetryPeriodMilliseconds *int
 
+	// SwitchServerDrainTimeoutSeconds specifies how long a tunnel replaced by
+	// Controller.SwitchServer remains open to allow in-flight port forwards
+	// to complete. If omitted, a default value is used.
+	SwitchServerDrainTimeoutSeconds *int
+
+	// TunnelReadStallSeconds specifies how long a read on a connection made
+	// by a tunneled HTTP client, such as for an upgrade download, may wait
+	// without receiving any bytes. When exceeded, the connection is closed
+	// and the read fails, so that a tunnel which has silently stopped
+	// delivering data doesn't cause the request to hang. 0 disables the
+	// check. If omitted, a default value is used.
+	TunnelReadStallSeconds *int
+
+	// IdleTunnelTimeoutSeconds specifies how long the tunnels may go without
+	// any port forward traffic before they are disconnected. After an idle
+	// disconnect, the next port forward, such as a new local proxy
+	// connection, triggers tunnel reestablishment. An upgrade download in
+	// progress counts as activity. 0, the default, disables idle
+	// disconnection. Not supported with PacketTunnelTunFileDescriptor.
+	IdleTunnelTimeoutSeconds *int
+
+	// SessionByteBudget specifies the maximum number of port forward bytes,
+	// sent and received, across all tunnels established by the controller.
+	// When the budget is exceeded, all tunnels are disconnected and no new
+	// tunnels are established until Controller.ResetSessionByteBudget is
+	// called. 0, the default, is no budget.
+	SessionByteBudget int64
+
+	// DirectConnectionFallbackTimeoutSeconds opts in to a direct connection
+	// fallback. When set, and tunnel establishment has run for this long
+	// without any active tunnel, local proxy connections are dialed directly
+	// instead of failing, and a DirectConnectionFallback notice is emitted to
+	// inform the user that traffic is no longer tunneled. Tunneled dialing
+	// resumes, with another DirectConnectionFallback notice, once a tunnel is
+	// established. Only for apps where degraded connectivity is preferable to
+	// no connectivity, as direct connections offer none of the tunnel's
+	// protections. This is deliberately not a tactics parameter. 0, the
+	// default, disables the fallback. Not supported with
+	// PacketTunnelTunFileDescriptor.
+	DirectConnectionFallbackTimeoutSeconds int
+
+	// FeedbackUploadUrl specifies the URL to which SendTunneledFeedback
+	// uploads encrypted feedback. A random upload ID is appended to the URL,
+	// so the URL is typically a path prefix ending with "/". Feedback is
+	// uploaded with a PUT request through the tunnel.
+	FeedbackUploadUrl string
+
+	// FeedbackEncryptionPublicKey is the base64-encoded, PKIX DER-encoded
+	// RSA public key to which feedback is encrypted by SendTunneledFeedback.
+	FeedbackEncryptionPublicKey string
+
+	// FeedbackUploadHeaders is a set of additional HTTP headers that are
+	// added to feedback upload requests, with the same restrictions as
+	// UpgradeDownloadHeaders.
+	FeedbackUploadHeaders http.Header
+
 	// EmitBytesTransferred indicates whether to emit periodic notices showing
 	// bytes sent and received.
 	EmitBytesTransferred bool
 
+	// BytesTransferredNoticePeriodSeconds specifies the period for emitting
+	// notices showing bytes sent and received, when EmitBytesTransferred is
+	// set. If omitted, a default value is used.
+	BytesTransferredNoticePeriodSeconds *int
+
 	// UseIndistinguishableTLS enables use of alternative TLS profiles with a
 	// less distinct fingerprint (ClientHello content) than the stock Go TLS.
 	UseIndistinguishableTLS bool
 
+	// TLSProfile pins the ClientHello profile used by the TLS for meek and
+	// for tunneled HTTPS requests, such as upgrade downloads and remote
+	// server list fetches. Valid values are "Chrome", "Firefox", and
+	// "Randomized", matched case-insensitively; "Randomized" varies the
+	// ClientHello, including the cipher suite and extension order, for each
+	// connection. When omitted, meek selects a profile at random when
+	// UseIndistinguishableTLS is set and tunneled HTTPS requests use stock
+	// Go TLS.
+	//
+	// Tunneled HTTPS requests made with a TLSProfile use HTTP/1.1, as the
+	// HTTP/2 transport requires stock Go TLS connections.
+	TLSProfile string
+
 	// UseTrustedCACertificatesForStockTLS toggles use of the trusted CA
 	// certs, specified in TrustedCACertificatesFilename, for tunneled TLS
 	// connections that expect server certificates signed with public
@@ -387,6 +873,41 @@ type Config struct {
 	// TrustedCACertificatesFilename to be set.
 	UseTrustedCACertificatesForStockTLS bool
 
+	// TrustedCACertificatesPEM specifies PEM-encoded CA certificates to
+	// trust for tunneled TLS connections that expect server certificates
+	// signed with public certificate authorities, such as upgrade downloads
+	// and feedback uploads. When set, only these CAs, plus any loaded via
+	// UseTrustedCACertificatesForStockTLS, are trusted; the system root CAs
+	// are not.
+	TrustedCACertificatesPEM string
+
+	// PinnedSPKIHashes is a list of base64-encoded SHA-256 hashes of
+	// certificate SubjectPublicKeyInfo, as used in HTTP Public Key Pinning.
+	// When set, tunneled TLS connections which verify server certificates
+	// also require the verified certificate chain to include a certificate
+	// with one of these public keys, otherwise the connection fails with
+	// ErrCertificatePinMismatch.
+	PinnedSPKIHashes []string
+
+	// DisableTunneledHTTP2 forces HTTP/1.1 for HTTPS requests, such as
+	// upgrade downloads, made through tunneled HTTP clients. By default,
+	// HTTP/2 is negotiated via ALPN when the server supports it. This is a
+	// workaround for servers which mishandle HTTP/2 Range requests.
+	DisableTunneledHTTP2 bool
+
+	// HTTPUserAgent is the User-Agent sent with HTTP requests, such as
+	// upgrade downloads and remote server list fetches, made through
+	// tunneled HTTP clients. HTTPUserAgent replaces the default User-Agent,
+	// which identifies the client as tunnel-core. A User-Agent for a single
+	// request may be specified with WithHTTPUserAgent.
+	HTTPUserAgent string
+
+	// RandomizeHTTPUserAgent enables picking, for each tunneled HTTP
+	// request, a User-Agent from the User-Agent picker registered with
+	// RegisterUserAgentPicker. When no picker is registered, HTTPUserAgent,
+	// if set, is used.
+	RandomizeHTTPUserAgent bool
+
 	// TrustedCACertificatesFilename specifies a file containing trusted CA
 	// certs. The file contents should be compatible with OpenSSL's
 	// SSL_CTX_load_verify_locations. When specified, this enables use of
@@ -399,6 +920,18 @@ type Config struct {
 	// out, the tunnel is considered to have failed.
 	DisablePeriodicSshKeepAlive bool
 
+	// SSHKeepAlivePeriodSeconds specifies the interval between periodic SSH
+	// keepalives, which are sent when the tunnel is idle. If omitted, the
+	// default is a random period between parameters.SSHKeepAlivePeriodMin
+	// and parameters.SSHKeepAlivePeriodMax.
+	SSHKeepAlivePeriodSeconds *int
+
+	// SSHKeepAliveMaxMissedReplies specifies how many consecutive periodic
+	// SSH keepalives may time out before the tunnel is considered to have
+	// failed and is reestablished. If omitted, the default is
+	// parameters.SSHKeepAliveMaxMissedReplies.
+	SSHKeepAliveMaxMissedReplies *int
+
 	// DeviceRegion is the optional, reported region the host device is
 	// running in. This input value should be a ISO 3166-1 alpha-2 country
 	// code. The device region is reported to the server in the connected
@@ -415,6 +948,19 @@ type Config struct {
 	// distributed or displayed to users. Default is off.
 	EmitDiagnosticNotices bool
 
+	// NoticeTimestampFormat specifies the format of notice timestamps. Valid
+	// values are "", the default, for UTC RFC3339 with millisecond
+	// precision; "rfc3339nano", for UTC RFC3339 with nanosecond precision;
+	// and "none", which omits notice timestamps. See
+	// SetNoticeTimestampFormat.
+	NoticeTimestampFormat string
+
+	// MinNoticeSeverity specifies the minimum severity of notices which are
+	// emitted. Valid values are "", the default, and "info", which emit all
+	// notices; "warning", which emits only warning and alert notices; and
+	// "alert", which emits only alert notices. See SetMinNoticeSeverity.
+	MinNoticeSeverity string
+
 	// RateLimits specify throttling configuration for the tunnel.
 	RateLimits common.RateLimits
 
@@ -452,6 +998,15 @@ type Config struct {
 	// New tactics must be applied by calling Config.SetClientParameters;
 	// calling clientParameters.Set directly will fail to add config values.
 	clientParameters *parameters.ClientParameters
+
+	// clock, when set, replaces the real clock for timeouts and backoff.
+	// clock is for testing only. See getClock.
+	clock clock
+
+	// notices is the notice sink created by NewController when NoticeWriter
+	// or NoticeCallback is set. When nil, notices are emitted to the
+	// process-wide notice sink.
+	notices *noticeLogger
 }
 
 // LoadConfig parses and validates a JSON format Psiphon config JSON
@@ -470,6 +1025,20 @@ func LoadConfig(configJson []byte) (*Config, error) {
 		SetEmitDiagnosticNotices(true)
 	}
 
+	if config.NoticeTimestampFormat != "" {
+		err := SetNoticeTimestampFormat(config.NoticeTimestampFormat)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	if config.MinNoticeSeverity != "" {
+		err := SetMinNoticeSeverity(config.MinNoticeSeverity)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
 	// Promote legacy fields.
 
 	if config.CustomHeaders == nil {
@@ -489,6 +1058,14 @@ func LoadConfig(configJson []byte) (*Config, error) {
 		config.UpgradeDownloadURLs = promoteLegacyDownloadURL(config.UpgradeDownloadUrl)
 	}
 
+	if config.LimitTunnelProtocols == nil {
+		if len(config.TunnelProtocols) > 0 {
+			config.LimitTunnelProtocols = config.TunnelProtocols
+		} else if config.TunnelProtocol != "" {
+			config.LimitTunnelProtocols = []string{config.TunnelProtocol}
+		}
+	}
+
 	// Supply default values.
 
 	if config.DataStoreDirectory == "" {
@@ -506,125 +1083,545 @@ func LoadConfig(configJson []byte) (*Config, error) {
 		config.TunnelPoolSize = TUNNEL_POOL_SIZE
 	}
 
+	if tlsProfile, ok := normalizeConfigTLSProfile(config.TLSProfile); ok {
+		config.TLSProfile = tlsProfile
+	}
+
 	// Validate config fields.
 
+	err = config.Validate()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// With both local proxies disabled, traffic can flow through the tunnel
+	// only via a packet tunnel or Controller.Dial. This isn't an error, as
+	// existing host applications may use Controller.Dial without setting
+	// UseControllerDial.
+	if config.DisableLocalSocksProxy && config.DisableLocalHTTPProxy &&
+		config.PacketTunnelTunFileDescriptor <= 0 && !config.UseControllerDial {
+		NoticeAlert(
+			"DisableLocalSocksProxy and DisableLocalHTTPProxy are set without PacketTunnelTunFileDescriptor or UseControllerDial")
+	}
+
+	if config.SessionID == "" {
+		sessionID, err := MakeSessionId()
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		config.SessionID = sessionID
+	}
+
+	config.clientParameters, err = parameters.NewClientParameters(
+		func(err error) {
+			NoticeAlert("ClientParameters getValue failed: %s", err)
+		})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// clientParameters.Set will validate the config fields applied to parameters.
+
+	err = config.SetClientParameters("", false, nil)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return &config, nil
+}
+
+// Validate checks the config fields and returns an error which lists every
+// problem found, rather than only the first problem. Validate may be called
+// on a config unmarshaled from JSON, before LoadConfig promotes legacy fields
+// and supplies default values; LoadConfig calls Validate.
+func (config *Config) Validate() error {
+
+	var problems []string
+
 	if config.PropagationChannelId == "" {
-		return nil, common.ContextError(
-			errors.New("propagation channel ID is missing from the configuration file"))
+		problems = append(problems, "propagation channel ID is missing from the configuration file")
 	}
 	if config.SponsorId == "" {
-		return nil, common.ContextError(
-			errors.New("sponsor ID is missing from the configuration file"))
+		problems = append(problems, "sponsor ID is missing from the configuration file")
 	}
 
-	_, err = strconv.Atoi(config.ClientVersion)
-	if err != nil {
-		return nil, common.ContextError(
-			fmt.Errorf("invalid client version: %s", err))
+	if config.ClientVersion != "" {
+		_, err := strconv.Atoi(config.ClientVersion)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("invalid client version: %s", err))
+		}
 	}
 
 	if config.NetworkConnectivityChecker != nil {
-		return nil, common.ContextError(
-			errors.New("NetworkConnectivityChecker interface must be set at runtime"))
+		problems = append(problems, "NetworkConnectivityChecker interface must be set at runtime")
 	}
 
 	if config.DeviceBinder != nil {
-		return nil, common.ContextError(
-			errors.New("DeviceBinder interface must be set at runtime"))
+		problems = append(problems, "DeviceBinder interface must be set at runtime")
 	}
 
 	if config.DnsServerGetter != nil {
-		return nil, common.ContextError(
-			errors.New("DnsServerGetter interface must be set at runtime"))
+		problems = append(problems, "DnsServerGetter interface must be set at runtime")
 	}
 
 	if !common.Contains(
 		[]string{"", protocol.PSIPHON_SSH_API_PROTOCOL, protocol.PSIPHON_WEB_API_PROTOCOL},
 		config.TargetApiProtocol) {
 
-		return nil, common.ContextError(
-			errors.New("invalid TargetApiProtocol"))
+		problems = append(problems, "invalid TargetApiProtocol")
 	}
 
-	if !config.DisableRemoteServerListFetcher {
+	if config.EgressRegion != "" &&
+		(len(config.EgressRegion) != 2 ||
+			-1 != strings.IndexFunc(config.EgressRegion, func(c rune) bool {
+				return c < 'A' || c > 'Z'
+			})) {
+		problems = append(problems, "invalid EgressRegion")
+	}
 
-		if config.RemoteServerListURLs != nil {
-			if config.RemoteServerListSignaturePublicKey == "" {
-				return nil, common.ContextError(errors.New("missing RemoteServerListSignaturePublicKey"))
-			}
-			if config.RemoteServerListDownloadFilename == "" {
-				return nil, common.ContextError(errors.New("missing RemoteServerListDownloadFilename"))
-			}
+	if config.LocalSocksProxyPort < 0 || config.LocalSocksProxyPort > 65535 {
+		problems = append(problems, "invalid LocalSocksProxyPort")
+	}
+
+	if config.LocalHttpProxyPort < 0 || config.LocalHttpProxyPort > 65535 {
+		problems = append(problems, "invalid LocalHttpProxyPort")
+	}
+
+	switch config.IPAddressFamilyPreference {
+	case "",
+		IP_ADDRESS_FAMILY_PREFER_IPV4,
+		IP_ADDRESS_FAMILY_PREFER_IPV6,
+		IP_ADDRESS_FAMILY_HAPPY_EYEBALLS:
+	default:
+		problems = append(problems, "invalid IPAddressFamilyPreference")
+	}
+
+	if _, ok := normalizeConfigTLSProfile(config.TLSProfile); config.TLSProfile != "" && !ok {
+		problems = append(problems, fmt.Sprintf("invalid TLSProfile: %s", config.TLSProfile))
+	}
+
+	for _, bufferSize := range []int{
+		config.TunnelSocketReadBuffer, config.TunnelSocketWriteBuffer} {
+
+		if bufferSize != 0 &&
+			(bufferSize < MIN_SOCKET_BUFFER_SIZE || bufferSize > MAX_SOCKET_BUFFER_SIZE) {
+			problems = append(problems, "invalid TunnelSocketReadBuffer or TunnelSocketWriteBuffer")
+			break
 		}
+	}
 
-		if config.ObfuscatedServerListRootURLs != nil {
-			if config.RemoteServerListSignaturePublicKey == "" {
-				return nil, common.ContextError(errors.New("missing RemoteServerListSignaturePublicKey"))
-			}
-			if config.ObfuscatedServerListDownloadDirectory == "" {
-				return nil, common.ContextError(errors.New("missing ObfuscatedServerListDownloadDirectory"))
+	for _, tunnelProtocol := range config.LimitTunnelProtocols {
+		if !common.Contains(protocol.SupportedTunnelProtocols, tunnelProtocol) {
+			problems = append(problems, fmt.Sprintf("invalid LimitTunnelProtocols: %s", tunnelProtocol))
+		}
+	}
+
+	for _, tunnelProtocol := range config.DisableTunnelProtocols {
+		if !common.Contains(protocol.SupportedTunnelProtocols, tunnelProtocol) {
+			problems = append(problems, fmt.Sprintf("invalid DisableTunnelProtocols: %s", tunnelProtocol))
+		}
+	}
+
+	if len(config.DisableTunnelProtocols) > 0 {
+		limitTunnelProtocols := config.LimitTunnelProtocols
+		if len(limitTunnelProtocols) == 0 {
+			limitTunnelProtocols = protocol.SupportedTunnelProtocols
+		}
+		enabled := false
+		for _, tunnelProtocol := range limitTunnelProtocols {
+			if !common.Contains(config.DisableTunnelProtocols, tunnelProtocol) {
+				enabled = true
+				break
 			}
 		}
+		if !enabled {
+			problems = append(problems, "DisableTunnelProtocols disables all LimitTunnelProtocols")
+		}
+	}
+
+	if config.FeedbackUploadUrl != "" {
+		feedbackURL, err := url.Parse(config.FeedbackUploadUrl)
+		if err != nil || feedbackURL.Scheme != "https" || feedbackURL.Host == "" {
+			problems = append(problems, "invalid FeedbackUploadUrl")
+		}
+	}
+
+	if config.BootstrapDohUrl != "" {
+		dohURL, err := url.Parse(config.BootstrapDohUrl)
+		if err != nil || dohURL.Scheme != "https" || dohURL.Host == "" {
+			problems = append(problems, "invalid BootstrapDohUrl")
+		}
+	}
+
+	if config.TrustedCACertificatesPEM != "" &&
+		!x509.NewCertPool().AppendCertsFromPEM([]byte(config.TrustedCACertificatesPEM)) {
+		problems = append(problems, "invalid TrustedCACertificatesPEM")
+	}
+
+	for _, pin := range config.PinnedSPKIHashes {
+		hash, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(hash) != sha256.Size {
+			problems = append(problems, fmt.Sprintf("invalid PinnedSPKIHashes: %s", pin))
+		}
+	}
+
+	if config.IdleTunnelTimeoutSeconds != nil && *config.IdleTunnelTimeoutSeconds > 0 &&
+		config.PacketTunnelTunFileDescriptor > 0 {
+		problems = append(problems, "IdleTunnelTimeoutSeconds is not supported with PacketTunnelTunFileDescriptor")
+	}
+
+	if config.DirectConnectionFallbackTimeoutSeconds < 0 {
+		problems = append(problems, "invalid DirectConnectionFallbackTimeoutSeconds")
+	}
+
+	if config.DirectConnectionFallbackTimeoutSeconds > 0 &&
+		config.PacketTunnelTunFileDescriptor > 0 {
+		problems = append(problems, "DirectConnectionFallbackTimeoutSeconds is not supported with PacketTunnelTunFileDescriptor")
+	}
+
+	if problem := validateLocalProxyAddress(
+		"LocalSocksProxyAddress",
+		config.LocalSocksProxyAddress,
+		config.AllowNonLoopbackLocalProxyAddress); problem != "" {
+
+		problems = append(problems, problem)
+	}
+
+	if problem := validateLocalProxyAddress(
+		"LocalHttpProxyAddress",
+		config.LocalHttpProxyAddress,
+		config.AllowNonLoopbackLocalProxyAddress); problem != "" {
+
+		problems = append(problems, problem)
+	}
+
+	if config.HandshakePaddingMinBytes != nil && config.HandshakePaddingMaxBytes != nil &&
+		*config.HandshakePaddingMinBytes > *config.HandshakePaddingMaxBytes {
+		problems = append(problems, "HandshakePaddingMinBytes exceeds HandshakePaddingMaxBytes")
+	}
+
+	if config.MeekMinPollIntervalMilliseconds != nil && config.MeekMaxPollIntervalMilliseconds != nil &&
+		*config.MeekMinPollIntervalMilliseconds > *config.MeekMaxPollIntervalMilliseconds {
+		problems = append(problems, "MeekMinPollIntervalMilliseconds exceeds MeekMaxPollIntervalMilliseconds")
+	}
+
+	if config.MeekMaxRequestPayloadBytes != nil &&
+		*config.MeekMaxRequestPayloadBytes > MEEK_MAX_REQUEST_PAYLOAD_LENGTH {
+		problems = append(problems, "MeekMaxRequestPayloadBytes exceeds maximum")
+	}
+
+	if config.HealthCheckAddress != "" {
+		if _, _, err := net.SplitHostPort(config.HealthCheckAddress); err != nil {
+			problems = append(problems, "invalid HealthCheckAddress")
+		}
+	}
+
+	if config.PACServerAddress != "" {
+		if _, _, err := net.SplitHostPort(config.PACServerAddress); err != nil {
+			problems = append(problems, "invalid PACServerAddress")
+		}
+		if config.DisableLocalSocksProxy && config.DisableLocalHTTPProxy {
+			problems = append(problems, "PACServerAddress requires a local proxy")
+		}
+	}
 
+	if config.MaxOpenPortForwards < 0 || config.MaxOpenPortForwardsPerHost < 0 {
+		problems = append(problems, "invalid MaxOpenPortForwards or MaxOpenPortForwardsPerHost")
+	}
+
+	// RFC 1929 limits the username and password to 255 bytes each, and
+	// doesn't permit an empty password.
+	if config.LocalSocksProxyUsername != "" || config.LocalSocksProxyPassword != "" {
+		if config.LocalSocksProxyUsername == "" || config.LocalSocksProxyPassword == "" {
+			problems = append(problems, "LocalSocksProxyUsername and LocalSocksProxyPassword must both be set")
+		} else if len(config.LocalSocksProxyUsername) > 255 || len(config.LocalSocksProxyPassword) > 255 {
+			problems = append(problems, "invalid LocalSocksProxyUsername or LocalSocksProxyPassword length")
+		}
+	}
+
+	if !config.DisableRemoteServerListFetcher {
+
+		hasRemoteServerListURLs :=
+			config.RemoteServerListURLs != nil || config.RemoteServerListUrl != ""
+
+		hasObfuscatedServerListRootURLs :=
+			config.ObfuscatedServerListRootURLs != nil || config.ObfuscatedServerListRootURL != ""
+
+		if (hasRemoteServerListURLs || hasObfuscatedServerListRootURLs) &&
+			config.RemoteServerListSignaturePublicKey == "" {
+			problems = append(problems, "missing RemoteServerListSignaturePublicKey")
+		}
+
+		if hasRemoteServerListURLs && config.RemoteServerListDownloadFilename == "" {
+			problems = append(problems, "missing RemoteServerListDownloadFilename")
+		}
+
+		if hasObfuscatedServerListRootURLs && config.ObfuscatedServerListDownloadDirectory == "" {
+			problems = append(problems, "missing ObfuscatedServerListDownloadDirectory")
+		}
+	}
+
+	if config.PrefetchServerEntries &&
+		(config.DisableRemoteServerListFetcher ||
+			(config.RemoteServerListURLs == nil && config.RemoteServerListUrl == "")) {
+		problems = append(problems, "PrefetchServerEntries requires RemoteServerListURLs")
+	}
+
+	if config.PrefetchServerEntriesBytesPerSecond != nil && *config.PrefetchServerEntriesBytesPerSecond <= 0 {
+		problems = append(problems, "invalid PrefetchServerEntriesBytesPerSecond")
 	}
 
 	if config.SplitTunnelRoutesURLFormat != "" {
 		if config.SplitTunnelRoutesSignaturePublicKey == "" {
-			return nil, common.ContextError(errors.New("missing SplitTunnelRoutesSignaturePublicKey"))
+			problems = append(problems, "missing SplitTunnelRoutesSignaturePublicKey")
 		}
 		if config.SplitTunnelDNSServer == "" {
-			return nil, common.ContextError(errors.New("missing SplitTunnelDNSServer"))
+			problems = append(problems, "missing SplitTunnelDNSServer")
 		}
 	}
 
-	if config.UpgradeDownloadURLs != nil {
+	for _, CIDR := range config.SplitTunnelDirectCIDRs {
+		if _, _, err := net.ParseCIDR(CIDR); err != nil {
+			problems = append(problems, "invalid SplitTunnelDirectCIDRs")
+			break
+		}
+	}
+
+	if len(config.SplitTunnelDirectRegions) > 0 && config.SplitTunnelRoutesURLFormat == "" {
+		problems = append(problems, "missing SplitTunnelRoutesURLFormat")
+	}
+
+	if config.UpgradeDownloadURLs != nil || config.UpgradeDownloadUrl != "" {
 		if config.UpgradeDownloadClientVersionHeader == "" {
-			return nil, common.ContextError(errors.New("missing UpgradeDownloadClientVersionHeader"))
+			problems = append(problems, "missing UpgradeDownloadClientVersionHeader")
 		}
 		if config.UpgradeDownloadFilename == "" {
-			return nil, common.ContextError(errors.New("missing UpgradeDownloadFilename"))
+			problems = append(problems, "missing UpgradeDownloadFilename")
+		}
+	} else if config.UpgradeDownloadFilename != "" {
+		problems = append(problems, "missing UpgradeDownloadURLs")
+	}
+
+	if err := validateCustomRequestHeaders(config.UpgradeDownloadHeaders); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid UpgradeDownloadHeaders: %s", err))
+	}
+
+	if err := validateCustomRequestHeaders(config.FeedbackUploadHeaders); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid FeedbackUploadHeaders: %s", err))
+	}
+
+	if config.UpgradeDownloadSHA256 != "" {
+		digest, err := hex.DecodeString(config.UpgradeDownloadSHA256)
+		if err != nil || len(digest) != sha256.Size {
+			problems = append(problems, "invalid UpgradeDownloadSHA256")
 		}
 	}
 
+	if config.UpgradeDownloadUntunneledDiagnostic && !diagnosticsBuild {
+		problems = append(problems, "UpgradeDownloadUntunneledDiagnostic requires a diagnostics build")
+	}
+
+	if config.SessionByteBudget < 0 {
+		problems = append(problems, "invalid SessionByteBudget")
+	}
+
+	if config.UpgradeDownloadMaxBytes < 0 {
+		problems = append(problems, "invalid UpgradeDownloadMaxBytes")
+	}
+
+	if config.UpgradeDownloadBytesPerSecond < 0 {
+		problems = append(problems, "invalid UpgradeDownloadBytesPerSecond")
+	}
+
+	if config.UpgradeDownloadMaxConcurrency < 0 {
+		problems = append(problems, "invalid UpgradeDownloadMaxConcurrency")
+	}
+
+	if config.MeekFrontingAddressSelection != "" &&
+		config.MeekFrontingAddressSelection != MEEK_FRONTING_ADDRESS_SELECTION_RANDOM &&
+		config.MeekFrontingAddressSelection != MEEK_FRONTING_ADDRESS_SELECTION_ORDERED &&
+		config.MeekFrontingAddressSelection != MEEK_FRONTING_ADDRESS_SELECTION_STICKY {
+		problems = append(problems, "invalid MeekFrontingAddressSelection")
+	}
+
+	if config.TunnelPoolSelection != "" &&
+		config.TunnelPoolSelection != TUNNEL_POOL_SELECTION_ROUND_ROBIN &&
+		config.TunnelPoolSelection != TUNNEL_POOL_SELECTION_LEAST_LOADED {
+		problems = append(problems, "invalid TunnelPoolSelection")
+	}
+
 	// This constraint is expected by logic in Controller.runTunnels().
 
-	if config.PacketTunnelTunFileDescriptor > 0 && config.TunnelPoolSize != 1 {
-		return nil, common.ContextError(errors.New("packet tunnel mode requires TunnelPoolSize to be 1"))
+	if config.PacketTunnelTunFileDescriptor > 0 && config.TunnelPoolSize > 1 {
+		problems = append(problems, "packet tunnel mode requires TunnelPoolSize to be 1")
 	}
 
 	// SessionID must be PSIPHON_API_CLIENT_SESSION_ID_LENGTH lowercase hex-encoded bytes.
 
-	if config.SessionID == "" {
-		sessionID, err := MakeSessionId()
-		if err != nil {
-			return nil, common.ContextError(err)
+	if config.SessionID != "" &&
+		(len(config.SessionID) != 2*protocol.PSIPHON_API_CLIENT_SESSION_ID_LENGTH ||
+			-1 != strings.IndexFunc(config.SessionID, func(c rune) bool {
+				return !unicode.Is(unicode.ASCII_Hex_Digit, c) || unicode.IsUpper(c)
+			})) {
+		problems = append(problems, "invalid SessionID")
+	}
+
+	if len(problems) > 0 {
+		return common.ContextError(
+			fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; ")))
+	}
+
+	return nil
+}
+
+// validateLocalProxyAddress checks that address, when set, is a valid
+// IP:port local proxy listening address and that non-loopback addresses are
+// only used when allowNonLoopback is set. Returns a description of the
+// problem, or "" when the address is valid.
+func validateLocalProxyAddress(name, address string, allowNonLoopback bool) string {
+
+	if address == "" {
+		return ""
+	}
+
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Sprintf("invalid %s", name)
+	}
+
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 0 || port > 65535 {
+		return fmt.Sprintf("invalid %s port", name)
+	}
+
+	// An empty host, as in ":1080", listens on all interfaces.
+	var IP net.IP
+	if host != "" {
+		IP = net.ParseIP(host)
+		if IP == nil {
+			return fmt.Sprintf("invalid %s IP address", name)
 		}
-		config.SessionID = sessionID
 	}
 
-	if len(config.SessionID) != 2*protocol.PSIPHON_API_CLIENT_SESSION_ID_LENGTH ||
-		-1 != strings.IndexFunc(config.SessionID, func(c rune) bool {
-			return !unicode.Is(unicode.ASCII_Hex_Digit, c) || unicode.IsUpper(c)
-		}) {
-		return nil, common.ContextError(errors.New("invalid SessionID"))
+	if (IP == nil || !IP.IsLoopback()) && !allowNonLoopback {
+		return fmt.Sprintf(
+			"non-loopback %s requires AllowNonLoopbackLocalProxyAddress", name)
 	}
 
-	config.clientParameters, err = parameters.NewClientParameters(
-		func(err error) {
-			NoticeAlert("ClientParameters getValue failed: %s", err)
-		})
+	return ""
+}
+
+// CONFIG_ENVIRONMENT_VARIABLE_PREFIX is the prefix for environment variables
+// which override config fields. See LoadConfigFromEnv.
+const CONFIG_ENVIRONMENT_VARIABLE_PREFIX = "PSIPHON_"
+
+// LoadConfigFromEnv is LoadConfig with config field values overridden by
+// environment variables. This supports containerized deployments which
+// share a base config file across environments.
+//
+// Each string, integer, float, and boolean config field may be overridden by
+// an environment variable named with CONFIG_ENVIRONMENT_VARIABLE_PREFIX
+// followed by the field name in upper case, with words separated by
+// underscores. For example, PSIPHON_SPONSOR_ID overrides SponsorId and
+// PSIPHON_UPGRADE_DOWNLOAD_URL overrides UpgradeDownloadUrl. Environment
+// variables take precedence over configJson values, which take precedence
+// over default values. An error is returned when an environment variable
+// value cannot be parsed as the type of its field.
+func LoadConfigFromEnv(configJson []byte) (*Config, error) {
+
+	configJson, err := OverlayConfigEnv(configJson, os.LookupEnv)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
 
-	// clientParameters.Set will validate the config fields applied to parameters.
+	return LoadConfig(configJson)
+}
 
-	err = config.SetClientParameters("", false, nil)
+// OverlayConfigEnv applies environment variable overrides, as described in
+// LoadConfigFromEnv, to configJson and returns the resulting config JSON.
+// lookupEnv is typically os.LookupEnv.
+func OverlayConfigEnv(
+	configJson []byte,
+	lookupEnv func(key string) (string, bool)) ([]byte, error) {
+
+	var configFields map[string]interface{}
+	err := json.Unmarshal(configJson, &configFields)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
+	if configFields == nil {
+		configFields = make(map[string]interface{})
+	}
 
-	return &config, nil
+	configType := reflect.TypeOf(Config{})
+
+	for i := 0; i < configType.NumField(); i++ {
+
+		field := configType.Field(i)
+		if field.PkgPath != "" {
+			// Skip unexported fields.
+			continue
+		}
+
+		key := CONFIG_ENVIRONMENT_VARIABLE_PREFIX + configEnvName(field.Name)
+
+		value, ok := lookupEnv(key)
+		if !ok {
+			continue
+		}
+
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+
+		var fieldValue interface{}
+
+		switch fieldType.Kind() {
+		case reflect.String:
+			fieldValue = value
+		case reflect.Int, reflect.Int64:
+			fieldValue, err = strconv.ParseInt(value, 10, 64)
+		case reflect.Float64:
+			fieldValue, err = strconv.ParseFloat(value, 64)
+		case reflect.Bool:
+			fieldValue, err = strconv.ParseBool(value)
+		default:
+			return nil, common.ContextError(
+				fmt.Errorf("unsupported environment variable: %s", key))
+		}
+		if err != nil {
+			return nil, common.ContextError(
+				fmt.Errorf("invalid environment variable %s: %s", key, err))
+		}
+
+		configFields[field.Name] = fieldValue
+	}
+
+	configJson, err = json.Marshal(configFields)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return configJson, nil
+}
+
+// configEnvName converts a config field name to the corresponding
+// environment variable name, without prefix; for example,
+// UpgradeDownloadUrl becomes UPGRADE_DOWNLOAD_URL and SessionID becomes
+// SESSION_ID.
+func configEnvName(fieldName string) string {
+	runes := []rune(fieldName)
+	var name []rune
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) &&
+			(unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			name = append(name, '_')
+		}
+		name = append(name, unicode.ToUpper(r))
+	}
+	return string(name)
 }
 
 // GetClientParameters returns a snapshot of the current client parameters.
@@ -632,6 +1629,16 @@ func (config *Config) GetClientParameters() *parameters.ClientParametersSnapshot
 	return config.clientParameters.Get()
 }
 
+// getKeyValueStore returns Config.KeyValueStore or, when not set, the
+// default FileKeyValueStore.
+func (config *Config) getKeyValueStore() KeyValueStore {
+	if config.KeyValueStore != nil {
+		return config.KeyValueStore
+	}
+	return NewFileKeyValueStore(
+		filepath.Join(config.DataStoreDirectory, KEY_VALUE_STORE_DIRECTORY))
+}
+
 // SetClientParameters resets Config.clientParameters to the default values,
 // applies any config file values, and then applies the input parameters (from
 // tactics, etc.)
@@ -677,12 +1684,18 @@ func (config *Config) makeConfigParameters() map[string]interface{} {
 		applyParameters[parameters.NetworkLatencyMultiplier] = config.NetworkLatencyMultiplier
 	}
 
-	if len(config.TunnelProtocols) > 0 {
+	if len(config.LimitTunnelProtocols) > 0 {
+		applyParameters[parameters.LimitTunnelProtocols] = protocol.TunnelProtocols(config.LimitTunnelProtocols)
+	} else if len(config.TunnelProtocols) > 0 {
 		applyParameters[parameters.LimitTunnelProtocols] = protocol.TunnelProtocols(config.TunnelProtocols)
 	} else if config.TunnelProtocol != "" {
 		applyParameters[parameters.LimitTunnelProtocols] = protocol.TunnelProtocols{config.TunnelProtocol}
 	}
 
+	if len(config.DisableTunnelProtocols) > 0 {
+		applyParameters[parameters.DisableTunnelProtocols] = protocol.TunnelProtocols(config.DisableTunnelProtocols)
+	}
+
 	if config.EstablishTunnelTimeoutSeconds != nil {
 		applyParameters[parameters.EstablishTunnelTimeout] = fmt.Sprintf("%ds", *config.EstablishTunnelTimeoutSeconds)
 	}
@@ -691,10 +1704,55 @@ func (config *Config) makeConfigParameters() map[string]interface{} {
 		applyParameters[parameters.EstablishTunnelPausePeriod] = fmt.Sprintf("%ds", *config.EstablishTunnelPausePeriodSeconds)
 	}
 
+	if config.EstablishTunnelPausePeriodMaxSeconds != nil {
+		applyParameters[parameters.EstablishTunnelPausePeriodMax] = fmt.Sprintf("%ds", *config.EstablishTunnelPausePeriodMaxSeconds)
+	}
+
+	if config.EstablishTunnelPausePeriodJitter != nil {
+		applyParameters[parameters.EstablishTunnelPausePeriodJitter] = *config.EstablishTunnelPausePeriodJitter
+	}
+
 	if config.ConnectionWorkerPoolSize != 0 {
 		applyParameters[parameters.ConnectionWorkerPoolSize] = config.ConnectionWorkerPoolSize
 	}
 
+	if config.TunnelConnectTimeoutSeconds != nil {
+		applyParameters[parameters.TunnelConnectTimeout] = fmt.Sprintf("%ds", *config.TunnelConnectTimeoutSeconds)
+	}
+
+	if config.SwitchServerDrainTimeoutSeconds != nil {
+		applyParameters[parameters.SwitchServerDrainTimeout] = fmt.Sprintf("%ds", *config.SwitchServerDrainTimeoutSeconds)
+	}
+
+	if config.TunnelReadStallSeconds != nil {
+		applyParameters[parameters.TunnelReadStallTimeout] = fmt.Sprintf("%ds", *config.TunnelReadStallSeconds)
+	}
+
+	if config.PortForwardIdleSeconds != nil {
+		applyParameters[parameters.PortForwardIdleTimeout] = fmt.Sprintf("%ds", *config.PortForwardIdleSeconds)
+	}
+
+	if config.PrefetchServerEntriesBytesPerSecond != nil {
+		applyParameters[parameters.PrefetchServerEntriesBytesPerSecond] = *config.PrefetchServerEntriesBytesPerSecond
+	}
+
+	if config.PrefetchServerEntriesIdleSeconds != nil {
+		applyParameters[parameters.PrefetchServerEntriesIdlePeriod] = fmt.Sprintf("%ds", *config.PrefetchServerEntriesIdleSeconds)
+	}
+
+	if config.IdleTunnelTimeoutSeconds != nil {
+		applyParameters[parameters.IdleTunnelTimeout] = fmt.Sprintf("%ds", *config.IdleTunnelTimeoutSeconds)
+	}
+
+	if config.SSHKeepAlivePeriodSeconds != nil {
+		applyParameters[parameters.SSHKeepAlivePeriodMin] = fmt.Sprintf("%ds", *config.SSHKeepAlivePeriodSeconds)
+		applyParameters[parameters.SSHKeepAlivePeriodMax] = fmt.Sprintf("%ds", *config.SSHKeepAlivePeriodSeconds)
+	}
+
+	if config.SSHKeepAliveMaxMissedReplies != nil {
+		applyParameters[parameters.SSHKeepAliveMaxMissedReplies] = *config.SSHKeepAliveMaxMissedReplies
+	}
+
 	if config.StaggerConnectionWorkersMilliseconds > 0 {
 		applyParameters[parameters.StaggerConnectionWorkersPeriod] = fmt.Sprintf("%dms", config.StaggerConnectionWorkersMilliseconds)
 	}
@@ -703,8 +1761,28 @@ func (config *Config) makeConfigParameters() map[string]interface{} {
 		applyParameters[parameters.LimitMeekConnectionWorkers] = config.LimitMeekConnectionWorkers
 	}
 
+	if config.ServerEntryPerformanceDecayWindowSeconds != nil {
+		applyParameters[parameters.ServerEntryPerformanceDecayWindow] = fmt.Sprintf("%ds", *config.ServerEntryPerformanceDecayWindowSeconds)
+	}
+
+	if config.ServerEntryPerformanceExplorationRatio != nil {
+		applyParameters[parameters.ServerEntryPerformanceExplorationRatio] = *config.ServerEntryPerformanceExplorationRatio
+	}
+
 	applyParameters[parameters.MeekLimitBufferSizes] = config.LimitMeekBufferSizes
 
+	if config.MeekMinPollIntervalMilliseconds != nil {
+		applyParameters[parameters.MeekMinPollInterval] = fmt.Sprintf("%dms", *config.MeekMinPollIntervalMilliseconds)
+	}
+
+	if config.MeekMaxPollIntervalMilliseconds != nil {
+		applyParameters[parameters.MeekMaxPollInterval] = fmt.Sprintf("%dms", *config.MeekMaxPollIntervalMilliseconds)
+	}
+
+	if config.MeekMaxRequestPayloadBytes != nil {
+		applyParameters[parameters.MeekMaxRequestPayloadLength] = *config.MeekMaxRequestPayloadBytes
+	}
+
 	applyParameters[parameters.IgnoreHandshakeStatsRegexps] = config.IgnoreHandshakeStatsRegexps
 
 	if config.EstablishTunnelTimeoutSeconds != nil {
@@ -715,10 +1793,54 @@ func (config *Config) makeConfigParameters() map[string]interface{} {
 		applyParameters[parameters.FetchRemoteServerListRetryPeriod] = fmt.Sprintf("%dms", *config.FetchRemoteServerListRetryPeriodMilliseconds)
 	}
 
+	if config.BytesTransferredNoticePeriodSeconds != nil {
+		applyParameters[parameters.BytesTransferredNoticePeriod] = fmt.Sprintf("%ds", *config.BytesTransferredNoticePeriodSeconds)
+	}
+
 	if config.FetchUpgradeRetryPeriodMilliseconds != nil {
 		applyParameters[parameters.FetchUpgradeRetryPeriod] = fmt.Sprintf("%dms", *config.FetchUpgradeRetryPeriodMilliseconds)
 	}
 
+	if config.UpgradeDownloadRetries != nil {
+		applyParameters[parameters.UpgradeDownloadRetries] = *config.UpgradeDownloadRetries
+	}
+
+	if config.UpgradeDownloadRetryBaseMilliseconds != nil {
+		applyParameters[parameters.UpgradeDownloadRetryBase] = fmt.Sprintf("%dms", *config.UpgradeDownloadRetryBaseMilliseconds)
+	}
+
+	if config.UpgradeDownloadRetryMaxMilliseconds != nil {
+		applyParameters[parameters.UpgradeDownloadRetryMaximum] = fmt.Sprintf("%dms", *config.UpgradeDownloadRetryMaxMilliseconds)
+	}
+
+	if config.UpgradeDownloadRetryAfterMaxMilliseconds != nil {
+		applyParameters[parameters.UpgradeDownloadRetryAfterMaximum] = fmt.Sprintf("%dms", *config.UpgradeDownloadRetryAfterMaxMilliseconds)
+	}
+
+	if config.HandshakePaddingMinBytes != nil {
+		applyParameters[parameters.PsiphonAPIHandshakeRequestPaddingMinBytes] = *config.HandshakePaddingMinBytes
+	}
+
+	if config.HandshakePaddingMaxBytes != nil {
+		applyParameters[parameters.PsiphonAPIHandshakeRequestPaddingMaxBytes] = *config.HandshakePaddingMaxBytes
+	}
+
+	if config.UpgradeDownloadResumeVerifyBytes != nil {
+		applyParameters[parameters.UpgradeDownloadResumeVerifyBytes] = *config.UpgradeDownloadResumeVerifyBytes
+	}
+
+	if config.UpgradeDownloadDiskSpaceMarginBytes != nil {
+		applyParameters[parameters.UpgradeDownloadDiskSpaceMargin] = *config.UpgradeDownloadDiskSpaceMarginBytes
+	}
+
+	if config.UpgradeCheckPeriodSeconds != nil {
+		applyParameters[parameters.UpgradeCheckPeriod] = fmt.Sprintf("%ds", *config.UpgradeCheckPeriodSeconds)
+	}
+
+	if config.UpgradeCheckPeriodJitter != nil {
+		applyParameters[parameters.UpgradeCheckPeriodJitter] = *config.UpgradeCheckPeriodJitter
+	}
+
 	if !config.DisableRemoteServerListFetcher {
 
 		if config.RemoteServerListURLs != nil {
@@ -21,9 +21,12 @@ package psiphon
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
 )
@@ -157,3 +160,297 @@ func (suite *ConfigTestSuite) Test_LoadConfig_GoodJson() {
 	_, err = LoadConfig(testObjJSON)
 	suite.Nil(err, "JSON with null for optional values should succeed")
 }
+
+// Tests that Validate reports every problem at once
+func (suite *ConfigTestSuite) Test_Config_Validate() {
+
+	testCases := []struct {
+		description string
+		configJSON  string
+		problems    []string
+	}{
+		{
+			"valid",
+			`{"PropagationChannelId": "0", "SponsorId": "0"}`,
+			nil,
+		},
+		{
+			"missing required fields",
+			`{}`,
+			[]string{
+				"propagation channel ID is missing from the configuration file",
+				"sponsor ID is missing from the configuration file",
+			},
+		},
+		{
+			"invalid ports",
+			`{"PropagationChannelId": "0", "SponsorId": "0",
+			  "LocalSocksProxyPort": 65536, "LocalHttpProxyPort": -1}`,
+			[]string{
+				"invalid LocalSocksProxyPort",
+				"invalid LocalHttpProxyPort",
+			},
+		},
+		{
+			"loopback local proxy addresses",
+			`{"PropagationChannelId": "0", "SponsorId": "0",
+			  "LocalSocksProxyAddress": "127.0.0.1:0", "LocalHttpProxyAddress": "[::1]:8080"}`,
+			nil,
+		},
+		{
+			"non-loopback local proxy addresses",
+			`{"PropagationChannelId": "0", "SponsorId": "0",
+			  "LocalSocksProxyAddress": "192.168.0.1:1080", "LocalHttpProxyAddress": ":8080"}`,
+			[]string{
+				"non-loopback LocalSocksProxyAddress requires AllowNonLoopbackLocalProxyAddress",
+				"non-loopback LocalHttpProxyAddress requires AllowNonLoopbackLocalProxyAddress",
+			},
+		},
+		{
+			"allowed non-loopback local proxy addresses",
+			`{"PropagationChannelId": "0", "SponsorId": "0",
+			  "LocalSocksProxyAddress": "192.168.0.1:1080", "LocalHttpProxyAddress": ":8080",
+			  "AllowNonLoopbackLocalProxyAddress": true}`,
+			nil,
+		},
+		{
+			"invalid local proxy addresses",
+			`{"PropagationChannelId": "0", "SponsorId": "0",
+			  "LocalSocksProxyAddress": "localhost:1080", "LocalHttpProxyAddress": "127.0.0.1:65536"}`,
+			[]string{
+				"invalid LocalSocksProxyAddress IP address",
+				"invalid LocalHttpProxyAddress port",
+			},
+		},
+		{
+			"SOCKS proxy username without password",
+			`{"PropagationChannelId": "0", "SponsorId": "0",
+			  "LocalSocksProxyUsername": "user"}`,
+			[]string{
+				"LocalSocksProxyUsername and LocalSocksProxyPassword must both be set",
+			},
+		},
+		{
+			"upgrade URL without filename",
+			`{"PropagationChannelId": "0", "SponsorId": "0",
+			  "UpgradeDownloadUrl": "https://example.com/upgrade"}`,
+			[]string{
+				"missing UpgradeDownloadClientVersionHeader",
+				"missing UpgradeDownloadFilename",
+			},
+		},
+		{
+			"upgrade filename without URL",
+			`{"SponsorId": "0",
+			  "UpgradeDownloadFilename": "upgrade",
+			  "UpgradeDownloadSHA256": "00"}`,
+			[]string{
+				"propagation channel ID is missing from the configuration file",
+				"missing UpgradeDownloadURLs",
+				"invalid UpgradeDownloadSHA256",
+			},
+		},
+		{
+			"limited and disabled tunnel protocols",
+			`{"PropagationChannelId": "0", "SponsorId": "0",
+			  "LimitTunnelProtocols": ["OSSH", "UNFRONTED-MEEK-HTTPS-OSSH"],
+			  "DisableTunnelProtocols": ["SSH"]}`,
+			nil,
+		},
+		{
+			"unknown tunnel protocols",
+			`{"PropagationChannelId": "0", "SponsorId": "0",
+			  "LimitTunnelProtocols": ["OSSH", "MEEK-HTTPS"],
+			  "DisableTunnelProtocols": ["QUIC"]}`,
+			[]string{
+				"invalid LimitTunnelProtocols: MEEK-HTTPS",
+				"invalid DisableTunnelProtocols: QUIC",
+			},
+		},
+		{
+			"all tunnel protocols disabled",
+			`{"PropagationChannelId": "0", "SponsorId": "0",
+			  "LimitTunnelProtocols": ["OSSH"],
+			  "DisableTunnelProtocols": ["OSSH", "SSH"]}`,
+			[]string{
+				"DisableTunnelProtocols disables all LimitTunnelProtocols",
+			},
+		},
+		{
+			"all local proxies disabled",
+			`{"PropagationChannelId": "0", "SponsorId": "0",
+			  "DisableLocalSocksProxy": true,
+			  "DisableLocalHTTPProxy": true}`,
+			nil,
+		},
+		{
+			"invalid trusted CAs and pins",
+			`{"PropagationChannelId": "0", "SponsorId": "0",
+			  "TrustedCACertificatesPEM": "not a certificate",
+			  "PinnedSPKIHashes": ["47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", "AAAA"]}`,
+			[]string{
+				"invalid TrustedCACertificatesPEM",
+				"invalid PinnedSPKIHashes: AAAA",
+			},
+		},
+		{
+			"TLS profile",
+			`{"PropagationChannelId": "0", "SponsorId": "0",
+			  "TLSProfile": "randomized"}`,
+			nil,
+		},
+		{
+			"invalid TLS profile",
+			`{"PropagationChannelId": "0", "SponsorId": "0",
+			  "TLSProfile": "Android"}`,
+			[]string{
+				"invalid TLSProfile: Android",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+
+		var config Config
+		err := json.Unmarshal([]byte(testCase.configJSON), &config)
+		suite.Nil(err, testCase.description)
+
+		err = config.Validate()
+
+		if testCase.problems == nil {
+			suite.Nil(err, testCase.description)
+			continue
+		}
+
+		suite.NotNil(err, testCase.description)
+		if err == nil {
+			continue
+		}
+
+		const prefix = "invalid configuration: "
+		message := err.Error()
+		message = message[strings.Index(message, prefix)+len(prefix):]
+
+		suite.Equal(testCase.problems, strings.Split(message, "; "), testCase.description)
+	}
+}
+
+// Tests environment variable overrides
+func (suite *ConfigTestSuite) Test_LoadConfig_EnvOverrides() {
+
+	configJSON := []byte(`{
+		"PropagationChannelId": "0",
+		"SponsorId": "file",
+		"ClientPlatform": "file",
+		"TunnelPoolSize": 1}`)
+
+	env := map[string]string{
+		"PSIPHON_SPONSOR_ID":                             "env",
+		"PSIPHON_UPGRADE_DOWNLOAD_URL":                   "https://example.com/upgrade",
+		"PSIPHON_UPGRADE_DOWNLOAD_CLIENT_VERSION_HEADER": "x-version",
+		"PSIPHON_UPGRADE_DOWNLOAD_FILENAME":              "upgrade",
+		"PSIPHON_TUNNEL_POOL_SIZE":                       "2",
+		"PSIPHON_EMIT_BYTES_TRANSFERRED":                 "true",
+		"PSIPHON_NETWORK_LATENCY_MULTIPLIER":             "1.5",
+		"PSIPHON_SESSION_ID":                             "0123456789abcdef0123456789abcdef",
+	}
+
+	lookupEnv := func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+
+	overlayJSON, err := OverlayConfigEnv(configJSON, lookupEnv)
+	suite.Nil(err)
+
+	config, err := LoadConfig(overlayJSON)
+	suite.Nil(err)
+	if err != nil {
+		return
+	}
+
+	suite.Equal("0", config.PropagationChannelId)
+	suite.Equal("env", config.SponsorId)
+	suite.Equal("file", config.ClientPlatform)
+	suite.Equal("upgrade", config.UpgradeDownloadFilename)
+	suite.Equal(2, config.TunnelPoolSize)
+	suite.Equal(true, config.EmitBytesTransferred)
+	suite.Equal(1.5, config.NetworkLatencyMultiplier)
+	suite.Equal("0123456789abcdef0123456789abcdef", config.SessionID)
+	suite.Equal("0", config.ClientVersion)
+
+	env = map[string]string{"PSIPHON_TUNNEL_POOL_SIZE": "two"}
+	_, err = OverlayConfigEnv(configJSON, lookupEnv)
+	suite.NotNil(err, "unparseable environment variable should fail")
+}
+
+// Tests that TLSProfile values are normalized
+func (suite *ConfigTestSuite) Test_LoadConfig_TLSProfile() {
+
+	for tlsProfile, expected := range map[string]string{
+		"chrome":     TLSProfileChrome,
+		"FIREFOX":    TLSProfileFirefox,
+		"Randomized": TLSProfileRandomized,
+	} {
+		config, err := LoadConfig([]byte(fmt.Sprintf(`{
+			"PropagationChannelId": "0",
+			"SponsorId": "0",
+			"TLSProfile": "%s"}`, tlsProfile)))
+		suite.Nil(err)
+		if err != nil {
+			continue
+		}
+		suite.Equal(expected, config.TLSProfile)
+	}
+}
+
+// Tests that the untunneled upgrade download diagnostic is gated
+func (suite *ConfigTestSuite) Test_LoadConfig_UntunneledDiagnostic() {
+	_, err := LoadConfig([]byte(`{
+		"PropagationChannelId": "0",
+		"SponsorId": "0",
+		"UpgradeDownloadUntunneledDiagnostic": true}`))
+	suite.Equal(diagnosticsBuild, err == nil)
+}
+
+// Tests that disabling both local proxies, without another traffic path,
+// emits an alert rather than failing
+func (suite *ConfigTestSuite) Test_LoadConfig_LocalProxiesDisabled() {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	alerts := make(chan string, 16)
+	SetNoticeCallback(func(noticeType string, data map[string]interface{}) {
+		if noticeType == "Alert" {
+			alerts <- data["message"].(string)
+		}
+	})
+	defer SetNoticeCallback(nil)
+
+	for _, useControllerDial := range []bool{false, true} {
+
+		_, err := LoadConfig([]byte(fmt.Sprintf(`{
+			"PropagationChannelId": "0",
+			"SponsorId": "0",
+			"DisableLocalSocksProxy": true,
+			"DisableLocalHTTPProxy": true,
+			"UseControllerDial": %v}`, useControllerDial)))
+		suite.Nil(err)
+
+		alerted := false
+		timeout := time.After(100 * time.Millisecond)
+	loop:
+		for {
+			select {
+			case message := <-alerts:
+				if strings.Contains(message, "DisableLocalSocksProxy and DisableLocalHTTPProxy") {
+					alerted = true
+				}
+			case <-timeout:
+				break loop
+			}
+		}
+		suite.Equal(!useControllerDial, alerted)
+	}
+}
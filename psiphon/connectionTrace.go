@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Inc/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// Connection trace events, which record the lifecycle of each tunnel
+// connection attempt in Config.ConnectionTraceFile.
+const (
+	CONNECTION_TRACE_EVENT_DIAL                 = "dial"
+	CONNECTION_TRACE_EVENT_DIAL_FAILED          = "dial_failed"
+	CONNECTION_TRACE_EVENT_SSH_HANDSHAKE        = "ssh_handshake"
+	CONNECTION_TRACE_EVENT_SSH_HANDSHAKE_FAILED = "ssh_handshake_failed"
+	CONNECTION_TRACE_EVENT_ESTABLISHED          = "established"
+	CONNECTION_TRACE_EVENT_TEARDOWN             = "teardown"
+)
+
+// connectionTraceEvent is a single JSON line in the connection trace file.
+//
+// To keep the trace safe to share for debugging, events never include
+// payload bytes, port forward destinations, or error messages, which may
+// contain addresses. Failures are recorded as CONNECT_FAILURE_REASON values.
+// The server address is included only when
+// Config.ConnectionTraceIncludeServerAddresses is set.
+type connectionTraceEvent struct {
+	Timestamp           string `json:"timestamp"`
+	Event               string `json:"event"`
+	ConnectionID        string `json:"connectionID"`
+	TunnelProtocol      string `json:"tunnelProtocol"`
+	ServerRegion        string `json:"serverRegion"`
+	ServerAddress       string `json:"serverAddress,omitempty"`
+	ElapsedMilliseconds int64  `json:"elapsedMilliseconds"`
+	BytesSent           int64  `json:"bytesSent"`
+	BytesReceived       int64  `json:"bytesReceived"`
+	FailureReason       string `json:"failureReason,omitempty"`
+}
+
+// connectionTrace records the lifecycle events of one tunnel connection.
+// The connection ID correlates the events of a connection, as many
+// connection attempts run concurrently during establishment. A nil
+// connectionTrace, used when Config.ConnectionTraceFile is not set, records
+// nothing.
+type connectionTrace struct {
+	config         *Config
+	connectionID   string
+	tunnelProtocol string
+	serverRegion   string
+	serverAddress  string
+	startTime      monotime.Time
+}
+
+func newConnectionTrace(
+	config *Config,
+	serverEntry *protocol.ServerEntry,
+	tunnelProtocol string) *connectionTrace {
+
+	if config.ConnectionTraceFile == "" {
+		return nil
+	}
+
+	connectionID, err := common.MakeRandomStringHex(8)
+	if err != nil {
+		NoticeAlert("newConnectionTrace failed: %s", common.ContextError(err))
+		return nil
+	}
+
+	trace := &connectionTrace{
+		config:         config,
+		connectionID:   connectionID,
+		tunnelProtocol: tunnelProtocol,
+		serverRegion:   serverEntry.Region,
+		startTime:      monotime.Now(),
+	}
+
+	if config.ConnectionTraceIncludeServerAddresses {
+		trace.serverAddress = serverEntry.IpAddress
+	}
+
+	return trace
+}
+
+// record appends an event to the connection trace file. failureReason is
+// blank for events which aren't failures.
+func (trace *connectionTrace) record(
+	event string, failureReason string, metrics TunnelMetrics) {
+
+	if trace == nil {
+		return
+	}
+
+	line, err := json.Marshal(&connectionTraceEvent{
+		Timestamp:           time.Now().UTC().Format(time.RFC3339Nano),
+		Event:               event,
+		ConnectionID:        trace.connectionID,
+		TunnelProtocol:      trace.tunnelProtocol,
+		ServerRegion:        trace.serverRegion,
+		ServerAddress:       trace.serverAddress,
+		ElapsedMilliseconds: int64(monotime.Since(trace.startTime) / time.Millisecond),
+		BytesSent:           metrics.BytesSent,
+		BytesReceived:       metrics.BytesReceived,
+		FailureReason:       failureReason,
+	})
+	if err == nil {
+		err = appendConnectionTraceLine(trace.config.ConnectionTraceFile, line)
+	}
+	if err != nil {
+		NoticeAlert("record connection trace failed: %s", common.ContextError(err))
+	}
+}
+
+// connectionTraceFileMutex serializes appends so that concurrent events
+// aren't interleaved within a line.
+var connectionTraceFileMutex sync.Mutex
+
+// appendConnectionTraceLine opens the trace file for each event, rather
+// than holding it open, as events are infrequent and this leaves no file
+// handle to close when the controller stops.
+func appendConnectionTraceLine(filename string, line []byte) error {
+
+	connectionTraceFileMutex.Lock()
+	defer connectionTraceFileMutex.Unlock()
+
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	_, err = file.Write(append(line, '\n'))
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
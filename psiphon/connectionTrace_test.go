@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Psiphon-Inc/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestConnectionTrace(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-connection-trace-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	// The datastore is used by operateTunnel, which is started by Activate.
+
+	singleton = dataStore{}
+	err = InitDataStore(&Config{DataStoreDirectory: testDataDirName})
+	if err != nil {
+		t.Fatalf("InitDataStore failed: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	serverEntry := makeTestSSHServerEntry(t, listener, runTestSSHServer(t, listener, nil))
+	serverEntry.Region = "DE"
+
+	// A server which closes connections without responding fails the SSH
+	// handshake, as with a middlebox which resets blocked connections.
+
+	resettingListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer resettingListener.Close()
+	go func() {
+		for {
+			conn, err := resettingListener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	failingServerEntry := makeTestSSHServerEntry(t, resettingListener, "")
+
+	for _, includeServerAddresses := range []bool{false, true} {
+
+		traceFilename := filepath.Join(testDataDirName, "connection_trace")
+		os.Remove(traceFilename)
+
+		config := makeTestConnectTunnelConfig(t, 30)
+		config.DisableApi = true
+		config.ConnectionTraceFile = traceFilename
+		config.ConnectionTraceIncludeServerAddresses = includeServerAddresses
+
+		tunnel, err := ConnectTunnel(
+			context.Background(), config, "0", serverEntry,
+			protocol.TUNNEL_PROTOCOL_SSH, monotime.Now())
+		if err != nil {
+			t.Fatalf("ConnectTunnel failed: %s", err)
+		}
+
+		err = tunnel.Activate(context.Background(), testTunnelOwner{})
+		if err != nil {
+			t.Fatalf("Activate failed: %s", err)
+		}
+
+		tunnel.Close(false)
+
+		_, err = ConnectTunnel(
+			context.Background(), config, "0", failingServerEntry,
+			protocol.TUNNEL_PROTOCOL_SSH, monotime.Now())
+		if err == nil {
+			t.Fatalf("ConnectTunnel unexpectedly succeeded")
+		}
+
+		events := readTestConnectionTrace(t, traceFilename)
+
+		expectedEvents := []string{
+			CONNECTION_TRACE_EVENT_DIAL,
+			CONNECTION_TRACE_EVENT_SSH_HANDSHAKE,
+			CONNECTION_TRACE_EVENT_ESTABLISHED,
+			CONNECTION_TRACE_EVENT_TEARDOWN,
+			CONNECTION_TRACE_EVENT_DIAL,
+			CONNECTION_TRACE_EVENT_SSH_HANDSHAKE_FAILED,
+		}
+
+		if len(events) != len(expectedEvents) {
+			t.Fatalf("unexpected event count: %d", len(events))
+		}
+
+		for i, event := range events {
+
+			if event.Event != expectedEvents[i] ||
+				event.TunnelProtocol != protocol.TUNNEL_PROTOCOL_SSH ||
+				event.Timestamp == "" {
+				t.Fatalf("unexpected event: %+v", event)
+			}
+
+			// The events of the established connection share a connection
+			// ID, distinct from the failed connection.
+
+			isFailedConnection := i >= 4
+			if (event.ConnectionID == events[0].ConnectionID) == isFailedConnection {
+				t.Fatalf("unexpected connection ID: %+v", event)
+			}
+
+			expectedFailureReason := ""
+			if event.Event == CONNECTION_TRACE_EVENT_SSH_HANDSHAKE_FAILED {
+				expectedFailureReason = CONNECT_FAILURE_REASON_SSH_HANDSHAKE
+			}
+			if event.FailureReason != expectedFailureReason {
+				t.Fatalf("unexpected failure reason: %+v", event)
+			}
+
+			if !isFailedConnection && event.ServerRegion != "DE" {
+				t.Fatalf("unexpected server region: %+v", event)
+			}
+
+			expectedServerAddress := ""
+			if includeServerAddresses {
+				expectedServerAddress = "127.0.0.1"
+			}
+			if event.ServerAddress != expectedServerAddress {
+				t.Fatalf("unexpected server address: %+v", event)
+			}
+		}
+	}
+}
+
+func readTestConnectionTrace(t *testing.T, filename string) []*connectionTraceEvent {
+
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	defer file.Close()
+
+	var events []*connectionTraceEvent
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event connectionTraceEvent
+		err := json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			t.Fatalf("Unmarshal failed: %s", err)
+		}
+		events = append(events, &event)
+	}
+	if scanner.Err() != nil {
+		t.Fatalf("Scan failed: %s", scanner.Err())
+	}
+
+	return events
+}
@@ -30,6 +30,7 @@ import (
 	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Psiphon-Inc/goarista/monotime"
@@ -43,8 +44,17 @@ import (
 // Controller is a tunnel lifecycle coordinator. It manages lists of servers to
 // connect to; establishes and monitors tunnels; and runs local proxies which
 // route traffic through the tunnels.
+//
+// Multiple controllers, each with its own Config, may run concurrently in
+// one process. To tell their notices apart, give each Config its own
+// NoticeWriter or NoticeCallback; see Config.NoticeWriter for which notices
+// are delivered there. The datastore remains process-wide: InitDataStore
+// opens one datastore, in the directory given by the first Config, for all
+// controllers. As InitDataStore precedes NewController, its notices go to
+// the process-wide notice sink.
 type Controller struct {
 	config                             *Config
+	notices                            *noticeLogger
 	sessionId                          string
 	runCtx                             context.Context
 	stopRunning                        context.CancelFunc
@@ -53,8 +63,11 @@ type Controller struct {
 	failedTunnels                      chan *Tunnel
 	tunnelMutex                        sync.Mutex
 	establishedOnce                    bool
-	tunnels                            []*Tunnel
-	nextTunnel                         int
+	lastHandshakeTime                  time.Time
+	signalEstablished                  chan struct{}
+	signalGiveUp                       chan struct{}
+	giveUpOnce                         sync.Once
+	tunnelPool                         *TunnelPool
 	startedConnectedReporter           bool
 	isEstablishing                     bool
 	concurrentEstablishTunnelsMutex    sync.Mutex
@@ -62,17 +75,33 @@ type Controller struct {
 	concurrentMeekEstablishTunnels     int
 	peakConcurrentEstablishTunnels     int
 	peakConcurrentMeekEstablishTunnels int
+	establishRoundOutcomes             map[string]*EstablishProtocolOutcome
 	establishCtx                       context.Context
 	stopEstablish                      context.CancelFunc
 	establishWaitGroup                 *sync.WaitGroup
 	candidateServerEntries             chan *candidateServerEntry
 	untunneledDialConfig               *DialConfig
 	splitTunnelClassifier              *SplitTunnelClassifier
+	localProxyAddressesMutex           sync.Mutex
+	localSocksProxyAddress             string
+	localHttpProxyAddress              string
 	signalFetchCommonRemoteServerList  chan struct{}
 	signalFetchObfuscatedServerLists   chan struct{}
 	signalDownloadUpgrade              chan string
 	impairedProtocolClassification     map[string]int
+	establishRoundFailures             int32
+	isPaused                           int32
+	lastDialTime                       int64
+	upgradeDownloadsInProgress         int32
+	idleReestablished                  chan struct{}
+	signalIdleReestablish              chan struct{}
 	signalReportConnected              chan struct{}
+	signalSwitchServer                 chan struct{}
+	sessionByteBudget                  *sessionByteBudget
+	noActiveTunnelsTime                monotime.Time
+	isDirectConnectionFallback         int32
+	signalSessionByteBudgetReset       chan struct{}
+	connectionFilter                   atomic.Value
 	serverAffinityDoneBroadcast        chan struct{}
 	newClientVerificationPayload       chan string
 	packetTunnelClient                 *tun.Client
@@ -83,8 +112,24 @@ type candidateServerEntry struct {
 	serverEntry                *protocol.ServerEntry
 	isServerAffinityCandidate  bool
 	usePriorityProtocol        bool
+	useLastTunnelProtocol      bool
 	impairedProtocols          []string
 	adjustedEstablishStartTime monotime.Time
+	establishPass              *establishPass
+}
+
+// establishPass tracks the candidates of one establishment round, to
+// determine when every candidate in a complete iteration of the known
+// server entries has been tried without success.
+type establishPass struct {
+	mutex              sync.Mutex
+	round              int
+	candidates         int
+	pendingCandidates  int
+	iterationCompleted bool
+	succeeded          bool
+	reported           bool
+	attempts           map[string]int
 }
 
 // NewController initializes a new controller.
@@ -93,9 +138,20 @@ func NewController(config *Config) (controller *Controller, err error) {
 	// Needed by regen, at least
 	rand.Seed(int64(time.Now().Nanosecond()))
 
+	// The controller's notice sink is stored in its config, which is passed
+	// to ConnectTunnel and to the other components that emit notices on
+	// behalf of the controller.
+	if config.NoticeWriter != nil || config.NoticeCallback != nil {
+		config.notices = newNoticeLogger(config.NoticeWriter, config.NoticeCallback)
+	}
+
 	// The session ID for the Psiphon server API is used across all
 	// tunnels established by the controller.
-	NoticeSessionId(config.SessionID)
+	config.notices.SessionId(config.SessionID)
+
+	if config.TunnelSocketFwmark != 0 && !socketFwmarkSupported {
+		config.notices.Alert("TunnelSocketFwmark is not supported on this platform")
+	}
 
 	untunneledDialConfig := &DialConfig{
 		UpstreamProxyURL:              config.UpstreamProxyURL,
@@ -103,6 +159,11 @@ func NewController(config *Config) (controller *Controller, err error) {
 		DeviceBinder:                  config.DeviceBinder,
 		DnsServerGetter:               config.DnsServerGetter,
 		IPv6Synthesizer:               config.IPv6Synthesizer,
+		IPAddressFamilyPreference:     config.IPAddressFamilyPreference,
+		SocketFwmark:                  config.TunnelSocketFwmark,
+		SocketReadBuffer:              config.TunnelSocketReadBuffer,
+		SocketWriteBuffer:             config.TunnelSocketWriteBuffer,
+		BootstrapDohUrl:               config.BootstrapDohUrl,
 		UseIndistinguishableTLS:       config.UseIndistinguishableTLS,
 		TrustedCACertificatesFilename: config.TrustedCACertificatesFilename,
 		DeviceRegion:                  config.DeviceRegion,
@@ -110,13 +171,14 @@ func NewController(config *Config) (controller *Controller, err error) {
 
 	controller = &Controller{
 		config:       config,
+		notices:      config.notices,
 		sessionId:    config.SessionID,
 		runWaitGroup: new(sync.WaitGroup),
 		// connectedTunnels and failedTunnels buffer sizes are large enough to
 		// receive full pools of tunnels without blocking. Senders should not block.
 		connectedTunnels:               make(chan *Tunnel, config.TunnelPoolSize),
 		failedTunnels:                  make(chan *Tunnel, config.TunnelPoolSize),
-		tunnels:                        make([]*Tunnel, 0),
+		tunnelPool:                     NewTunnelPool(config.TunnelPoolSize, config.TunnelPoolSelection),
 		establishedOnce:                false,
 		startedConnectedReporter:       false,
 		isEstablishing:                 false,
@@ -128,10 +190,20 @@ func NewController(config *Config) (controller *Controller, err error) {
 		signalFetchCommonRemoteServerList: make(chan struct{}),
 		signalFetchObfuscatedServerLists:  make(chan struct{}),
 		signalDownloadUpgrade:             make(chan string),
+		signalGiveUp:                      make(chan struct{}),
 		signalReportConnected:             make(chan struct{}),
 		// Buffer allows SetClientVerificationPayloadForActiveTunnels to submit one
 		// new payload without blocking or dropping it.
 		newClientVerificationPayload: make(chan string, 1),
+		// Buffer allows SwitchServer to signal without blocking; concurrent
+		// SwitchServer calls are coalesced into the one pending signal.
+		signalSwitchServer: make(chan struct{}, 1),
+		// Buffer allows Dial to signal reestablishment after an idle
+		// disconnect without blocking; concurrent signals are coalesced.
+		signalIdleReestablish: make(chan struct{}, 1),
+		sessionByteBudget:     newSessionByteBudget(config.SessionByteBudget),
+		// Buffer allows ResetSessionByteBudget to signal without blocking.
+		signalSessionByteBudgetReset: make(chan struct{}, 1),
 	}
 
 	controller.splitTunnelClassifier = NewSplitTunnelClassifier(config, controller)
@@ -147,7 +219,7 @@ func NewController(config *Config) (controller *Controller, err error) {
 		packetTunnelTransport := NewPacketTunnelTransport()
 
 		packetTunnelClient, err := tun.NewClient(&tun.ClientConfig{
-			Logger:            NoticeCommonLogger(),
+			Logger:            controller.notices.CommonLogger(),
 			TunFileDescriptor: config.PacketTunnelTunFileDescriptor,
 			Transport:         packetTunnelTransport,
 		})
@@ -168,12 +240,25 @@ func (controller *Controller) Run(ctx context.Context) {
 
 	ReportAvailableRegions(controller.config)
 
+	controller.notices.ClientInfo(GetClientInstanceID(controller.config))
+
 	runCtx, stopRunning := context.WithCancel(ctx)
 	defer stopRunning()
 
 	controller.runCtx = runCtx
 	controller.stopRunning = stopRunning
 
+	// Import server entries supplied by the host application. As with
+	// embedded server entries, which may become stale, supplied entries will
+	// not overwrite existing stored entries for the same server.
+	if controller.config.ServerEntrySource != nil {
+		err := StoreServerEntrySource(
+			runCtx, controller.config, controller.config.ServerEntrySource, false)
+		if err != nil {
+			controller.notices.Alert("error importing server entry source: %s", err)
+		}
+	}
+
 	// Start components
 
 	// TODO: IPv6 support
@@ -188,7 +273,7 @@ func (controller *Controller) Run(ctx context.Context) {
 			err = fmt.Errorf("no IPv4 address for interface %s", controller.config.ListenInterface)
 		}
 		if err != nil {
-			NoticeError("error getting listener IP: %s", err)
+			controller.notices.Error("error getting listener IP: %s", err)
 			return
 		}
 		listenIP = IPv4Address.String()
@@ -197,19 +282,45 @@ func (controller *Controller) Run(ctx context.Context) {
 	if !controller.config.DisableLocalSocksProxy {
 		socksProxy, err := NewSocksProxy(controller.config, controller, listenIP)
 		if err != nil {
-			NoticeAlert("error initializing local SOCKS proxy: %s", err)
+			controller.notices.Alert("error initializing local SOCKS proxy: %s", err)
 			return
 		}
 		defer socksProxy.Close()
+		controller.setLocalProxyAddress(
+			_SOCKS_PROXY_TYPE, socksProxy.listener.Addr().String())
+	} else {
+		controller.notices.LocalProxyDisabled("SOCKS")
 	}
 
 	if !controller.config.DisableLocalHTTPProxy {
 		httpProxy, err := NewHttpProxy(controller.config, controller, listenIP)
 		if err != nil {
-			NoticeAlert("error initializing local HTTP proxy: %s", err)
+			controller.notices.Alert("error initializing local HTTP proxy: %s", err)
 			return
 		}
 		defer httpProxy.Close()
+		controller.setLocalProxyAddress(
+			_HTTP_PROXY_TYPE, httpProxy.listener.Addr().String())
+	} else {
+		controller.notices.LocalProxyDisabled("HTTP")
+	}
+
+	if controller.config.HealthCheckAddress != "" {
+		healthCheckServer, err := NewHealthCheckServer(controller)
+		if err != nil {
+			controller.notices.Alert("error initializing health check server: %s", err)
+			return
+		}
+		defer healthCheckServer.Close()
+	}
+
+	if controller.config.PACServerAddress != "" {
+		PACServer, err := NewPACServer(controller)
+		if err != nil {
+			controller.notices.Alert("error initializing PAC server: %s", err)
+			return
+		}
+		defer PACServer.Close()
 	}
 
 	if !controller.config.DisableRemoteServerListFetcher {
@@ -229,6 +340,12 @@ func (controller *Controller) Run(ctx context.Context) {
 				FetchObfuscatedServerLists,
 				controller.signalFetchObfuscatedServerLists)
 		}
+
+		if controller.config.PrefetchServerEntries &&
+			controller.config.RemoteServerListURLs != nil {
+			controller.runWaitGroup.Add(1)
+			go controller.serverEntryPrefetcher()
+		}
 	}
 
 	if controller.config.UpgradeDownloadURLs != nil {
@@ -252,7 +369,7 @@ func (controller *Controller) Run(ctx context.Context) {
 	// Wait while running
 
 	<-controller.runCtx.Done()
-	NoticeInfo("controller stopped")
+	controller.notices.Info("controller stopped")
 
 	if controller.packetTunnelClient != nil {
 		controller.packetTunnelClient.Stop()
@@ -267,18 +384,61 @@ func (controller *Controller) Run(ctx context.Context) {
 
 	controller.splitTunnelClassifier.Shutdown()
 
-	NoticeInfo("exiting controller")
+	controller.notices.Info("exiting controller")
 
-	NoticeExiting()
+	controller.notices.Exiting()
 }
 
 // SignalComponentFailure notifies the controller that an associated component has failed.
 // This will terminate the controller.
 func (controller *Controller) SignalComponentFailure() {
-	NoticeAlert("controller shutdown due to component failure")
+	controller.notices.Alert("controller shutdown due to component failure")
 	controller.stopRunning()
 }
 
+// ConnectWithDeadline blocks until a tunnel is established or ctx is done,
+// bounding the entire establishment effort, across all candidates and
+// retries, rather than any single connection attempt. ConnectWithDeadline
+// waits on a controller which is run, concurrently, with Run.
+//
+// When ctx is done first, ConnectWithDeadline gives up: the controller is
+// stopped, canceling all in-flight connection attempts, and ctx.Err() is
+// returned. In either case, a ConnectWithDeadline notice reports the
+// outcome.
+func (controller *Controller) ConnectWithDeadline(ctx context.Context) error {
+
+	startTime := monotime.Now()
+
+	select {
+	case <-controller.getEstablishedSignal():
+		controller.notices.ConnectWithDeadline(true, monotime.Since(startTime))
+		return nil
+	case <-ctx.Done():
+	}
+
+	controller.notices.ConnectWithDeadline(false, monotime.Since(startTime))
+
+	controller.giveUpOnce.Do(func() {
+		close(controller.signalGiveUp)
+	})
+
+	return ctx.Err()
+}
+
+// getEstablishedSignal returns a channel which is closed once a tunnel is
+// first established.
+func (controller *Controller) getEstablishedSignal() <-chan struct{} {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+	if controller.signalEstablished == nil {
+		controller.signalEstablished = make(chan struct{})
+		if controller.establishedOnce {
+			close(controller.signalEstablished)
+		}
+	}
+	return controller.signalEstablished
+}
+
 // SetClientVerificationPayloadForActiveTunnels sets the client verification
 // payload that is to be sent in client verification requests to all established
 // tunnels.
@@ -302,6 +462,47 @@ func (controller *Controller) SetClientVerificationPayloadForActiveTunnels(clien
 	}
 }
 
+// ConnectionFilter inspects the destination, a host:port, of a port forward
+// before it is opened. A non-nil error rejects the port forward.
+type ConnectionFilter func(destination string) error
+
+// ErrConnectionRejected is returned by Controller.Dial when the
+// ConnectionFilter rejects the destination. ErrConnectionRejected is
+// returned without added context.
+var ErrConnectionRejected = errors.New("connection rejected by filter")
+
+// SetConnectionFilter sets a ConnectionFilter which is invoked before each
+// port forward is opened with Dial, including the port forwards of the local
+// SOCKS and HTTP proxies. This allows host applications to implement
+// destination allowlists or blocklists. Rejected connections receive a SOCKS
+// or HTTP error from the local proxies, and a ConnectionRejected notice is
+// emitted. Direct connections made by the local HTTP proxy's URL proxy
+// "/direct/" mode are not filtered.
+//
+// SetConnectionFilter may be called at any time; a nil filter removes any
+// filter. The filter is called concurrently and must not block for long,
+// as it delays the port forward.
+func (controller *Controller) SetConnectionFilter(filter ConnectionFilter) {
+	controller.connectionFilter.Store(filter)
+}
+
+// filterConnection applies any ConnectionFilter to destination.
+func (controller *Controller) filterConnection(destination string) error {
+
+	filter, _ := controller.connectionFilter.Load().(ConnectionFilter)
+	if filter == nil {
+		return nil
+	}
+
+	err := filter(destination)
+	if err != nil {
+		controller.notices.ConnectionRejected(destination, err.Error())
+		return ErrConnectionRejected
+	}
+
+	return nil
+}
+
 // remoteServerListFetcher fetches an out-of-band list of server entries
 // for more tunnel candidates. It fetches when signalled, with retries
 // on failure.
@@ -360,7 +561,7 @@ fetcherLoop:
 				break retryLoop
 			}
 
-			NoticeAlert("failed to fetch %s remote server list: %s", name, err)
+			controller.notices.Alert("failed to fetch %s remote server list: %s", name, err)
 
 			retryPeriod := controller.config.clientParameters.Get().Duration(
 				parameters.FetchRemoteServerListRetryPeriod)
@@ -375,7 +576,66 @@ fetcherLoop:
 		}
 	}
 
-	NoticeInfo("exiting %s remote server list fetcher", name)
+	controller.notices.Info("exiting %s remote server list fetcher", name)
+}
+
+// serverEntryPrefetcher periodically prefetches the common remote server
+// list, through an active tunnel, once the tunnels have been idle for
+// PrefetchServerEntriesIdlePeriod. Prefetches are made at most once per
+// PrefetchServerEntriesPeriod, with retries on failure.
+func (controller *Controller) serverEntryPrefetcher() {
+
+	defer controller.runWaitGroup.Done()
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	var nextPrefetchTime monotime.Time
+
+prefetchLoop:
+	for {
+		select {
+		case <-ticker.C:
+		case <-controller.runCtx.Done():
+			break prefetchLoop
+		}
+
+		if nextPrefetchTime != 0 && monotime.Now().Before(nextPrefetchTime) {
+			continue
+		}
+
+		p := controller.config.clientParameters.Get()
+		idlePeriod := p.Duration(parameters.PrefetchServerEntriesIdlePeriod)
+		period := p.Duration(parameters.PrefetchServerEntriesPeriod)
+		retryPeriod := p.Duration(parameters.FetchRemoteServerListRetryPeriod)
+		bytesPerSecond := int64(p.Int(parameters.PrefetchServerEntriesBytesPerSecond))
+		p = nil
+
+		if !controller.isIdle(idlePeriod) {
+			continue
+		}
+
+		tunnel := controller.getNextActiveTunnel()
+		if tunnel == nil {
+			continue
+		}
+
+		err := prefetchServerEntries(
+			controller.runCtx,
+			controller.config,
+			tunnel,
+			controller.untunneledDialConfig,
+			bytesPerSecond)
+		if err != nil {
+			controller.notices.Alert("failed to prefetch server entries: %s", err)
+			nextPrefetchTime = monotime.Now().Add(retryPeriod)
+			continue
+		}
+
+		nextPrefetchTime = monotime.Now().Add(period)
+	}
+
+	controller.notices.Info("exiting server entry prefetcher")
 }
 
 // establishTunnelWatcher terminates the controller if a tunnel
@@ -389,21 +649,26 @@ func (controller *Controller) establishTunnelWatcher() {
 	timeout := controller.config.clientParameters.Get().Duration(
 		parameters.EstablishTunnelTimeout)
 
+	var timerC <-chan time.Time
 	if timeout > 0 {
 		timer := time.NewTimer(timeout)
 		defer timer.Stop()
+		timerC = timer.C
+	}
 
-		select {
-		case <-timer.C:
-			if !controller.hasEstablishedOnce() {
-				NoticeAlert("failed to establish tunnel before timeout")
-				controller.SignalComponentFailure()
-			}
-		case <-controller.runCtx.Done():
+	select {
+	case <-timerC:
+		if !controller.hasEstablishedOnce() {
+			controller.notices.Alert("failed to establish tunnel before timeout")
+			controller.SignalComponentFailure()
 		}
+	case <-controller.signalGiveUp:
+		controller.notices.Info("controller shutdown due to connect deadline")
+		controller.stopRunning()
+	case <-controller.runCtx.Done():
 	}
 
-	NoticeInfo("exiting establish tunnel watcher")
+	controller.notices.Info("exiting establish tunnel watcher")
 }
 
 // connectedReporter sends periodic "connected" requests to the Psiphon API.
@@ -428,7 +693,7 @@ loop:
 			if err == nil {
 				reported = true
 			} else {
-				NoticeAlert("failed to make connected request: %s", err)
+				controller.notices.Alert("failed to make connected request: %s", err)
 			}
 		}
 
@@ -459,7 +724,7 @@ loop:
 		}
 	}
 
-	NoticeInfo("exiting connected reporter")
+	controller.notices.Info("exiting connected reporter")
 }
 
 func (controller *Controller) startOrSignalConnectedReporter() {
@@ -503,6 +768,7 @@ func (controller *Controller) upgradeDownloader() {
 	defer controller.runWaitGroup.Done()
 
 	var lastDownloadTime monotime.Time
+	var notFoundVersion string
 
 downloadLoop:
 	for {
@@ -514,6 +780,11 @@ downloadLoop:
 			break downloadLoop
 		}
 
+		// Don't retry an advertised version that was found to be withdrawn.
+		if handshakeVersion != "" && handshakeVersion == notFoundVersion {
+			continue
+		}
+
 		stalePeriod := controller.config.clientParameters.Get().Duration(
 			parameters.FetchUpgradeStalePeriod)
 
@@ -525,6 +796,10 @@ downloadLoop:
 			continue
 		}
 
+		// Egress regions from which the upgrade download server was found to
+		// be unreachable.
+		unreachableEgressRegions := make(map[string]bool)
+
 	retryLoop:
 		for attempt := 0; ; attempt++ {
 			// Don't attempt to download while there is no network connectivity,
@@ -536,23 +811,62 @@ downloadLoop:
 			}
 
 			// Pick any active tunnel and make the next download attempt. If there's
-			// no active tunnel, the untunneledDialConfig will be used.
-			tunnel := controller.getNextActiveTunnel()
+			// no active tunnel, the untunneledDialConfig will be used. Prefer a
+			// tunnel with an egress region from which the download server
+			// hasn't been found to be unreachable.
+			var tunnel *Tunnel
+			if len(unreachableEgressRegions) > 0 {
+				tunnel = controller.getActiveTunnelExcludingRegions(unreachableEgressRegions)
+			}
+			if tunnel == nil {
+				tunnel = controller.getNextActiveTunnel()
+			}
 
-			err := DownloadUpgrade(
-				controller.runCtx,
-				controller.config,
-				attempt,
-				handshakeVersion,
-				tunnel,
-				controller.untunneledDialConfig)
+			// While paused, there's no untunneled fallback either.
+			// An upgrade download in progress counts as activity, so that the
+			// tunnel isn't disconnected as idle.
+			err := ErrTunnelPaused
+			if controller.sessionByteBudget.exceeded() {
+				err = ErrSessionByteBudgetExceeded
+			} else if !controller.IsPaused() {
+				atomic.AddInt32(&controller.upgradeDownloadsInProgress, 1)
+				err = DownloadUpgrade(
+					controller.runCtx,
+					controller.config,
+					attempt,
+					handshakeVersion,
+					tunnel,
+					controller.untunneledDialConfig)
+				atomic.AddInt32(&controller.upgradeDownloadsInProgress, -1)
+			}
 
 			if err == nil {
 				lastDownloadTime = monotime.Now()
 				break retryLoop
 			}
 
-			NoticeAlert("failed to download upgrade: %s", err)
+			if err == ErrUpgradeNotFound {
+				notFoundVersion = handshakeVersion
+				break retryLoop
+			}
+
+			// Don't emit a failure notice when the download was interrupted due
+			// to the controller stopping.
+			if controller.runCtx.Err() != nil {
+				break downloadLoop
+			}
+
+			if unreachableErr, ok := err.(*EndpointUnreachableError); ok {
+				// The tunnel is not considered failed. DownloadUpgrade has
+				// already emitted an alert.
+				unreachableEgressRegions[unreachableErr.EgressRegion] = true
+			} else if err == ErrTunnelPaused {
+				controller.notices.Info("upgrade download deferred while paused")
+			} else if err == ErrSessionByteBudgetExceeded {
+				controller.notices.Info("upgrade download deferred: session byte budget exceeded")
+			} else {
+				controller.notices.Alert("failed to download upgrade: %s", err)
+			}
 
 			timeout := controller.config.clientParameters.Get().Duration(
 				parameters.FetchUpgradeRetryPeriod)
@@ -567,7 +881,7 @@ downloadLoop:
 		}
 	}
 
-	NoticeInfo("exiting upgrade downloader")
+	controller.notices.Info("exiting upgrade downloader")
 }
 
 // runTunnels is the controller tunnel management main loop. It starts and stops
@@ -589,18 +903,70 @@ func (controller *Controller) runTunnels() {
 
 	var clientVerificationPayload string
 
+	// switchTunnel is the active tunnel which is to be replaced, when a
+	// SwitchServer is in progress.
+	var switchTunnel *Tunnel
+
+	// Idle disconnection is checked periodically. isIdle is set from when
+	// the tunnels are disconnected as idle until a tunnel is reestablished.
+	idleCheckTicker := time.NewTicker(1 * time.Second)
+	defer idleCheckTicker.Stop()
+	isIdle := false
+
 	// Start running
 
 	controller.startEstablishing()
 loop:
 	for {
 		select {
+		case <-idleCheckTicker.C:
+			controller.updateDirectConnectionFallback()
+
+			idleTimeout := controller.config.clientParameters.Get().Duration(
+				parameters.IdleTunnelTimeout)
+			if isIdle || switchTunnel != nil || !controller.isIdle(idleTimeout) {
+				break
+			}
+			isIdle = true
+			controller.tunnelMutex.Lock()
+			controller.idleReestablished = make(chan struct{})
+			controller.tunnelMutex.Unlock()
+			controller.stopEstablishing()
+			controller.terminateAllTunnels()
+			controller.notices.IdleTunnelDisconnect(idleTimeout)
+
+		case <-controller.signalIdleReestablish:
+			if isIdle {
+				controller.notices.Info("reestablishing after idle disconnect")
+				controller.startEstablishing()
+			}
+
+		case <-controller.sessionByteBudget.signalExceeded:
+			// NoticeSessionByteBudgetExceeded is emitted by the
+			// sessionByteBudget. startEstablishing is a no-op until
+			// ResetSessionByteBudget is called.
+			switchTunnel = nil
+			controller.stopEstablishing()
+			controller.terminateAllTunnels()
+
+		case <-controller.signalSessionByteBudgetReset:
+			controller.notices.Info("reestablishing after session byte budget reset")
+			controller.startEstablishing()
+
 		case failedTunnel := <-controller.failedTunnels:
-			NoticeAlert("tunnel failed: %s", failedTunnel.serverEntry.IpAddress)
+			controller.notices.Alert("tunnel failed: %s", failedTunnel.serverEntry.IpAddress)
 			controller.terminateTunnel(failedTunnel)
 
+			// When the tunnel being switched away from fails, the replacement
+			// tunnel, once established, simply fills the empty pool slot.
+			if failedTunnel == switchTunnel {
+				switchTunnel = nil
+			}
+
 			controller.classifyImpairedProtocol(failedTunnel)
 
+			controller.resetEstablishPauseBackoff(failedTunnel)
+
 			// Clear the reference to this tunnel before calling startEstablishing,
 			// which will invoke a garbage collection.
 			failedTunnel = nil
@@ -621,7 +987,7 @@ loop:
 				// ESTABLISH_TUNNEL_WORK_TIME loop. By not discarding here, a true
 				// impaired protocol may require an extra reconnect.
 
-				NoticeAlert("connected tunnel with impaired protocol: %s", connectedTunnel.protocol)
+				controller.notices.Alert("connected tunnel with impaired protocol: %s", connectedTunnel.protocol)
 			}
 
 			// Tunnel establishment has two phases: connection and activation.
@@ -645,7 +1011,7 @@ loop:
 			//
 			// In the typical case of TunnelPoolSize of 1, only a single handshake is
 			// performed and the homepages notices file, when used, will not be modifed
-			// after the NoticeTunnels(1) [i.e., connected] until NoticeTunnels(0) [i.e.,
+			// after the controller.notices.Tunnels(1) [i.e., connected] until controller.notices.Tunnels(0) [i.e.,
 			// disconnected]. For TunnelPoolSize > 1, serial handshakes only ensures that
 			// each set of emitted NoticeHomepages is contiguous.
 
@@ -653,10 +1019,22 @@ loop:
 
 			// discardTunnel will be true here when already fully established.
 
-			discardTunnel := (outstanding <= 0)
+			// A tunnel which connected as the session byte budget was
+			// exceeded is not used.
+
+			discardTunnel := (outstanding <= 0) || controller.sessionByteBudget.exceeded()
 			isFirstTunnel := (active == 0)
 			isLastTunnel := (outstanding == 1)
 
+			// When a SwitchServer is in progress, the pool is full and the
+			// connected tunnel replaces switchTunnel.
+			isReplacementTunnel := discardTunnel && switchTunnel != nil &&
+				!controller.sessionByteBudget.exceeded()
+			if isReplacementTunnel {
+				discardTunnel = false
+				isLastTunnel = true
+			}
+
 			if !discardTunnel {
 
 				if isLastTunnel {
@@ -673,14 +1051,21 @@ loop:
 					// TODO: distinguish between network and other errors
 					controller.classifyImpairedProtocol(connectedTunnel)
 
-					NoticeAlert("failed to activate %s: %s", connectedTunnel.serverEntry.IpAddress, err)
+					controller.notices.Alert("failed to activate %s: %s", connectedTunnel.serverEntry.IpAddress, err)
 					discardTunnel = true
+				} else if isReplacementTunnel {
+					if controller.replaceTunnel(switchTunnel, connectedTunnel) {
+						switchTunnel = nil
+					} else {
+						controller.notices.Alert("failed to replace with %s", connectedTunnel.serverEntry.IpAddress)
+						discardTunnel = true
+					}
 				} else {
 					// It's unlikely that registerTunnel will fail, since only this goroutine
 					// calls registerTunnel -- and after checking numTunnels; so failure is not
 					// expected.
 					if !controller.registerTunnel(connectedTunnel) {
-						NoticeAlert("failed to register %s: %s", connectedTunnel.serverEntry.IpAddress)
+						controller.notices.Alert("failed to register %s: %s", connectedTunnel.serverEntry.IpAddress)
 						discardTunnel = true
 					}
 				}
@@ -704,7 +1089,17 @@ loop:
 				break
 			}
 
-			NoticeActiveTunnel(
+			controller.updateDirectConnectionFallback()
+
+			if isIdle {
+				isIdle = false
+				controller.tunnelMutex.Lock()
+				close(controller.idleReestablished)
+				controller.idleReestablished = nil
+				controller.tunnelMutex.Unlock()
+			}
+
+			controller.notices.ActiveTunnel(
 				connectedTunnel.serverEntry.IpAddress,
 				connectedTunnel.protocol,
 				connectedTunnel.serverEntry.SupportsSSHAPIRequests())
@@ -767,6 +1162,27 @@ loop:
 		case clientVerificationPayload = <-controller.newClientVerificationPayload:
 			controller.setClientVerificationPayloadForActiveTunnels(clientVerificationPayload)
 
+		case <-controller.signalSwitchServer:
+
+			// Ignore the signal when a switch is already in progress, or when
+			// there's no active tunnel to switch away from, in which case
+			// establishment is already running.
+			if switchTunnel != nil {
+				break
+			}
+			tunnels := controller.tunnelPool.Tunnels()
+			if len(tunnels) == 0 {
+				break
+			}
+
+			// With TunnelPoolSize > 1, the longest-established tunnel is
+			// replaced. The replacement is established while the current
+			// tunnel remains active; the current tunnel is excluded from
+			// establishment candidates as an active tunnel server entry.
+			switchTunnel = tunnels[0]
+			controller.notices.Info("switching server: %s", switchTunnel.serverEntry.IpAddress)
+			controller.startEstablishing()
+
 		case <-controller.runCtx.Done():
 			break loop
 		}
@@ -787,7 +1203,7 @@ loop:
 		controller.discardTunnel(tunnel)
 	}
 
-	NoticeInfo("exiting run tunnels")
+	controller.notices.Info("exiting run tunnels")
 }
 
 // TerminateNextActiveTunnel is a support routine for
@@ -798,10 +1214,78 @@ func (controller *Controller) TerminateNextActiveTunnel() {
 	tunnel := controller.getNextActiveTunnel()
 	if tunnel != nil {
 		controller.SignalTunnelFailure(tunnel)
-		NoticeInfo("terminated tunnel: %s", tunnel.serverEntry.IpAddress)
+		controller.notices.Info("terminated tunnel: %s", tunnel.serverEntry.IpAddress)
 	}
 }
 
+// SwitchServer requests that the controller replace the active tunnel with a
+// tunnel to a different server. The replacement tunnel is established in
+// the background, while the current tunnel continues to carry traffic, and
+// is then swapped in. New port forwards use the replacement tunnel
+// immediately, while port forwards open on the replaced tunnel are allowed
+// up to SwitchServerDrainTimeout to complete before that tunnel is closed.
+// A ConnectedServer notice is emitted for the replacement tunnel.
+//
+// SwitchServer does not block. Calls made while a switch is pending or in
+// progress are coalesced into that switch.
+func (controller *Controller) SwitchServer() {
+	select {
+	case controller.signalSwitchServer <- *new(struct{}):
+	default:
+	}
+}
+
+// ResetSessionByteBudget clears the bytes counted against the
+// SessionByteBudget. When the budget was exceeded, tunnel establishment is
+// restarted.
+func (controller *Controller) ResetSessionByteBudget() {
+	isExceeded := controller.sessionByteBudget.exceeded()
+	controller.sessionByteBudget.reset()
+	if isExceeded {
+		select {
+		case controller.signalSessionByteBudgetReset <- *new(struct{}):
+		default:
+		}
+	}
+}
+
+// Pause stops SSH keep alives and status requests on all active tunnels,
+// for example when a mobile app is backgrounded. Unlike stopping the
+// controller, active tunnels and server selection state are retained, so
+// that Resume can quickly restore service. Tunnels established while paused
+// are also paused. Upgrade downloads fail with ErrTunnelPaused while paused.
+func (controller *Controller) Pause() {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+	if !atomic.CompareAndSwapInt32(&controller.isPaused, 0, 1) {
+		return
+	}
+	for _, tunnel := range controller.tunnelPool.Tunnels() {
+		tunnel.setPaused(true)
+	}
+	controller.notices.Paused(true)
+}
+
+// Resume undoes Pause. Each active tunnel is immediately probed with an SSH
+// keep alive; a tunnel that fails the probe is replaced in the same way as
+// any other failed tunnel.
+func (controller *Controller) Resume() {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+	if !atomic.CompareAndSwapInt32(&controller.isPaused, 1, 0) {
+		return
+	}
+	for _, tunnel := range controller.tunnelPool.Tunnels() {
+		tunnel.setPaused(false)
+	}
+	controller.notices.Paused(false)
+}
+
+// IsPaused indicates whether the controller is paused.
+func (controller *Controller) IsPaused() bool {
+	return atomic.LoadInt32(&controller.isPaused) == 1
+}
+
 // classifyImpairedProtocol tracks "impaired" protocol classifications for failed
 // tunnels. A protocol is classified as impaired if a tunnel using that protocol
 // fails, repeatedly, shortly after the start of the connection. During tunnel
@@ -832,10 +1316,11 @@ func (controller *Controller) classifyImpairedProtocol(failedTunnel *Tunnel) {
 	// there is now no way to proceed with only unimpaired protocols. The network
 	// situation (or attack) resulting in classification may not be protocol-specific.
 
-	if CountNonImpairedProtocols(
+	limitTunnelProtocols, allDisabled := controller.config.clientParameters.Get().LimitTunnelProtocols()
+
+	if allDisabled || CountNonImpairedProtocols(
 		controller.config.EgressRegion,
-		controller.config.clientParameters.Get().TunnelProtocols(
-			parameters.LimitTunnelProtocols),
+		limitTunnelProtocols,
 		controller.getImpairedProtocols()) == 0 {
 
 		controller.impairedProtocolClassification = make(map[string]int)
@@ -848,7 +1333,7 @@ func (controller *Controller) classifyImpairedProtocol(failedTunnel *Tunnel) {
 // Concurrency note: only the runTunnels() goroutine may call getImpairedProtocols
 func (controller *Controller) getImpairedProtocols() []string {
 
-	NoticeImpairedProtocolClassification(controller.impairedProtocolClassification)
+	controller.notices.ImpairedProtocolClassification(controller.impairedProtocolClassification)
 
 	threshold := controller.config.clientParameters.Get().Int(
 		parameters.ImpairedProtocolClassificationThreshold)
@@ -904,7 +1389,7 @@ func (controller *Controller) SignalTunnelFailure(tunnel *Tunnel) {
 
 // discardTunnel disposes of a successful connection that is no longer required.
 func (controller *Controller) discardTunnel(tunnel *Tunnel) {
-	NoticeInfo("discard tunnel: %s", tunnel.serverEntry.IpAddress)
+	controller.notices.Info("discard tunnel: %s", tunnel.serverEntry.IpAddress)
 	// TODO: not calling PromoteServerEntry, since that would rank the
 	// discarded tunnel before fully active tunnels. Can a discarded tunnel
 	// be promoted (since it connects), but with lower rank than all active
@@ -918,29 +1403,67 @@ func (controller *Controller) discardTunnel(tunnel *Tunnel) {
 func (controller *Controller) registerTunnel(tunnel *Tunnel) bool {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
-	if len(controller.tunnels) >= controller.config.TunnelPoolSize {
+	if !controller.tunnelPool.add(tunnel) {
 		return false
 	}
-	// Perform a final check just in case we've established
-	// a duplicate connection.
-	for _, activeTunnel := range controller.tunnels {
-		if activeTunnel.serverEntry.IpAddress == tunnel.serverEntry.IpAddress {
-			NoticeAlert("duplicate tunnel: %s", tunnel.serverEntry.IpAddress)
-			return false
-		}
+	// The tunnel's handshake completes immediately before registration.
+	controller.lastHandshakeTime = time.Now()
+	if !controller.establishedOnce && controller.signalEstablished != nil {
+		close(controller.signalEstablished)
 	}
 	controller.establishedOnce = true
-	controller.tunnels = append(controller.tunnels, tunnel)
-	NoticeTunnels(len(controller.tunnels))
+	if controller.IsPaused() {
+		tunnel.setPaused(true)
+	}
+	controller.notices.Tunnels(controller.tunnelPool.Count())
 
 	// Promote this successful tunnel to first rank so it's one
-	// of the first candidates next time establish runs.
+	// of the first candidates next time establish runs; and record
+	// its protocol as the region's last successful protocol.
 	// Connecting to a TargetServerEntry does not change the
-	// ranking.
+	// ranking or the last successful protocol.
 	if controller.config.TargetServerEntry == "" {
 		PromoteServerEntry(controller.config, tunnel.serverEntry.IpAddress)
+		recordTunnelProtocolSuccess(tunnel.serverEntry, tunnel.protocol)
+	}
+
+	return true
+}
+
+// replaceTunnel substitutes newTunnel for oldTunnel in the pool of active
+// tunnels and then shuts down oldTunnel, in the background, allowing up to
+// SwitchServerDrainTimeout for its port forwards to complete. Returns false
+// if oldTunnel is no longer in the pool (caller should discard newTunnel).
+func (controller *Controller) replaceTunnel(oldTunnel, newTunnel *Tunnel) bool {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+	if !controller.tunnelPool.replace(oldTunnel, newTunnel) {
+		return false
+	}
+	controller.lastHandshakeTime = time.Now()
+
+	if controller.IsPaused() {
+		newTunnel.setPaused(true)
+	}
+
+	if controller.config.TargetServerEntry == "" {
+		PromoteServerEntry(controller.config, newTunnel.serverEntry.IpAddress)
 	}
 
+	drainTimeout := controller.config.clientParameters.Get().Duration(
+		parameters.SwitchServerDrainTimeout)
+
+	// The shutdown is interrupted, and oldTunnel is closed immediately,
+	// when the controller is stopping.
+	controller.runWaitGroup.Add(1)
+	go func() {
+		defer controller.runWaitGroup.Done()
+		ctx, cancelFunc := context.WithTimeout(controller.runCtx, drainTimeout)
+		defer cancelFunc()
+		oldTunnel.Shutdown(ctx)
+		controller.notices.Info("switched server from: %s", oldTunnel.serverEntry.IpAddress)
+	}()
+
 	return true
 }
 
@@ -955,42 +1478,26 @@ func (controller *Controller) hasEstablishedOnce() bool {
 
 // isFullyEstablished indicates if the pool of active tunnels is full.
 func (controller *Controller) isFullyEstablished() bool {
-	controller.tunnelMutex.Lock()
-	defer controller.tunnelMutex.Unlock()
-	return len(controller.tunnels) >= controller.config.TunnelPoolSize
+	return controller.tunnelPool.IsFull()
 }
 
 // numTunnels returns the number of active and outstanding tunnels.
 // Oustanding is the number of tunnels required to fill the pool of
 // active tunnels.
 func (controller *Controller) numTunnels() (int, int) {
-	controller.tunnelMutex.Lock()
-	defer controller.tunnelMutex.Unlock()
-	active := len(controller.tunnels)
-	outstanding := controller.config.TunnelPoolSize - len(controller.tunnels)
+	active := controller.tunnelPool.Count()
+	outstanding := controller.tunnelPool.Size() - active
 	return active, outstanding
 }
 
 // terminateTunnel removes a tunnel from the pool of active tunnels
-// and closes the tunnel. The next-tunnel state used by getNextActiveTunnel
-// is adjusted as required.
+// and closes the tunnel.
 func (controller *Controller) terminateTunnel(tunnel *Tunnel) {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
-	for index, activeTunnel := range controller.tunnels {
-		if tunnel == activeTunnel {
-			controller.tunnels = append(
-				controller.tunnels[:index], controller.tunnels[index+1:]...)
-			if controller.nextTunnel > index {
-				controller.nextTunnel--
-			}
-			if controller.nextTunnel >= len(controller.tunnels) {
-				controller.nextTunnel = 0
-			}
-			activeTunnel.Close(false)
-			NoticeTunnels(len(controller.tunnels))
-			break
-		}
+	if controller.tunnelPool.remove(tunnel) {
+		tunnel.Close(false)
+		controller.notices.Tunnels(controller.tunnelPool.Count())
 	}
 }
 
@@ -1002,9 +1509,10 @@ func (controller *Controller) terminateAllTunnels() {
 	// Closing all tunnels in parallel. In an orderly shutdown, each tunnel
 	// may take a few seconds to send a final status request. We only want
 	// to wait as long as the single slowest tunnel.
+	tunnels := controller.tunnelPool.removeAll()
 	closeWaitGroup := new(sync.WaitGroup)
-	closeWaitGroup.Add(len(controller.tunnels))
-	for _, activeTunnel := range controller.tunnels {
+	closeWaitGroup.Add(len(tunnels))
+	for _, activeTunnel := range tunnels {
 		tunnel := activeTunnel
 		go func() {
 			defer closeWaitGroup.Done()
@@ -1012,38 +1520,41 @@ func (controller *Controller) terminateAllTunnels() {
 		}()
 	}
 	closeWaitGroup.Wait()
-	controller.tunnels = make([]*Tunnel, 0)
-	controller.nextTunnel = 0
-	NoticeTunnels(len(controller.tunnels))
+	controller.notices.Tunnels(controller.tunnelPool.Count())
 }
 
 // getNextActiveTunnel returns the next tunnel from the pool of active
-// tunnels. Currently, tunnel selection order is simple round-robin.
+// tunnels, as selected by TunnelPool.GetTunnel.
 func (controller *Controller) getNextActiveTunnel() (tunnel *Tunnel) {
-	controller.tunnelMutex.Lock()
-	defer controller.tunnelMutex.Unlock()
-	for i := len(controller.tunnels); i > 0; i-- {
-		tunnel = controller.tunnels[controller.nextTunnel]
-		controller.nextTunnel =
-			(controller.nextTunnel + 1) % len(controller.tunnels)
-		return tunnel
+	return controller.tunnelPool.GetTunnel()
+}
+
+// getActiveTunnelExcludingRegions returns an active tunnel with an egress
+// region that's not in excludeRegions, or nil when there is no such tunnel.
+func (controller *Controller) getActiveTunnelExcludingRegions(
+	excludeRegions map[string]bool) *Tunnel {
+
+	for _, tunnel := range controller.tunnelPool.Tunnels() {
+		if !excludeRegions[tunnel.serverEntry.Region] {
+			return tunnel
+		}
 	}
 	return nil
 }
 
+// GetTunnelPool returns the controller's pool of active tunnels, which may be
+// used to enumerate the active tunnels or to make requests load balanced
+// across the tunnels, as with MakeTunnelPoolHTTPClient.
+func (controller *Controller) GetTunnelPool() *TunnelPool {
+	return controller.tunnelPool
+}
+
 // isActiveTunnelServerEntry is used to check if there's already
 // an existing tunnel to a candidate server.
 func (controller *Controller) isActiveTunnelServerEntry(
 	serverEntry *protocol.ServerEntry) bool {
 
-	controller.tunnelMutex.Lock()
-	defer controller.tunnelMutex.Unlock()
-	for _, activeTunnel := range controller.tunnels {
-		if activeTunnel.serverEntry.IpAddress == serverEntry.IpAddress {
-			return true
-		}
-	}
-	return false
+	return controller.tunnelPool.hasServerEntry(serverEntry.IpAddress)
 }
 
 // setClientVerificationPayloadForActiveTunnels triggers the client verification
@@ -1051,10 +1562,7 @@ func (controller *Controller) isActiveTunnelServerEntry(
 func (controller *Controller) setClientVerificationPayloadForActiveTunnels(
 	clientVerificationPayload string) {
 
-	controller.tunnelMutex.Lock()
-	defer controller.tunnelMutex.Unlock()
-
-	for _, activeTunnel := range controller.tunnels {
+	for _, activeTunnel := range controller.tunnelPool.Tunnels() {
 		activeTunnel.SetClientVerificationPayload(clientVerificationPayload)
 	}
 }
@@ -1065,14 +1573,35 @@ func (controller *Controller) setClientVerificationPayloadForActiveTunnels(
 func (controller *Controller) Dial(
 	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (conn net.Conn, err error) {
 
+	if controller.sessionByteBudget.exceeded() {
+		return nil, common.ContextError(ErrSessionByteBudgetExceeded)
+	}
+
+	// The filter is applied before any tunnel or split tunnel dial, so a
+	// rejected destination is never contacted, or resolved.
+	err = controller.filterConnection(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.StoreInt64(&controller.lastDialTime, int64(monotime.Now()))
+
 	tunnel := controller.getNextActiveTunnel()
 	if tunnel == nil {
+		tunnel = controller.awaitIdleReestablish()
+	}
+	if tunnel == nil {
+		if !alwaysTunnel && controller.isDirectConnectionFallbackEngaged() {
+			return controller.DirectDial(remoteAddr)
+		}
 		return nil, common.ContextError(errors.New("no active tunnels"))
 	}
 
 	// Perform split tunnel classification when feature is enabled, and if the remote
 	// address is classified as untunneled, dial directly.
-	if !alwaysTunnel && controller.config.SplitTunnelDNSServer != "" {
+	if !alwaysTunnel &&
+		(controller.config.SplitTunnelDNSServer != "" ||
+			len(controller.config.SplitTunnelDirectCIDRs) > 0) {
 
 		host, _, err := net.SplitHostPort(remoteAddr)
 		if err != nil {
@@ -1098,6 +1627,105 @@ func (controller *Controller) Dial(
 	return tunneledConn, nil
 }
 
+// isIdle indicates whether there are active tunnels which have had no port
+// forward dials or traffic for at least idleTimeout, and no upgrade download
+// is in progress. When idleTimeout is 0, the tunnels are never idle.
+func (controller *Controller) isIdle(idleTimeout time.Duration) bool {
+	if idleTimeout <= 0 || atomic.LoadInt32(&controller.upgradeDownloadsInProgress) > 0 {
+		return false
+	}
+	tunnels := controller.tunnelPool.Tunnels()
+	if len(tunnels) == 0 {
+		return false
+	}
+	lastActivity := monotime.Time(atomic.LoadInt64(&controller.lastDialTime))
+	for _, tunnel := range tunnels {
+		tunnelLastActivity := tunnel.getLastActivityTime()
+		if tunnelLastActivity.After(lastActivity) {
+			lastActivity = tunnelLastActivity
+		}
+	}
+	return !lastActivity.Add(idleTimeout).After(monotime.Now())
+}
+
+// updateDirectConnectionFallback engages the direct connection fallback when
+// tunnel establishment has run, with no active tunnels, for
+// DirectConnectionFallbackTimeoutSeconds; and disengages the fallback once
+// there is an active tunnel or establishment stops, as after an idle
+// disconnect. Only runTunnels may call updateDirectConnectionFallback.
+func (controller *Controller) updateDirectConnectionFallback() {
+
+	timeout := time.Duration(
+		controller.config.DirectConnectionFallbackTimeoutSeconds) * time.Second
+	active, _ := controller.numTunnels()
+
+	if timeout <= 0 || active > 0 || !controller.isEstablishing {
+		controller.noActiveTunnelsTime = 0
+		controller.setDirectConnectionFallback(false)
+		return
+	}
+
+	if controller.noActiveTunnelsTime == 0 {
+		controller.noActiveTunnelsTime = monotime.Now()
+	}
+
+	if monotime.Since(controller.noActiveTunnelsTime) >= timeout {
+		controller.setDirectConnectionFallback(true)
+	}
+}
+
+func (controller *Controller) setDirectConnectionFallback(engaged bool) {
+	value := int32(0)
+	if engaged {
+		value = 1
+	}
+	if atomic.SwapInt32(&controller.isDirectConnectionFallback, value) != value {
+		if engaged {
+			controller.notices.Alert("no tunnel established: dialing directly, traffic is NOT tunneled")
+		}
+		controller.notices.DirectConnectionFallback(engaged)
+	}
+}
+
+// isDirectConnectionFallbackEngaged indicates whether local proxy
+// connections are to be dialed directly.
+func (controller *Controller) isDirectConnectionFallbackEngaged() bool {
+	return atomic.LoadInt32(&controller.isDirectConnectionFallback) == 1
+}
+
+// awaitIdleReestablish signals tunnel reestablishment, when the tunnels were
+// disconnected as idle, and waits for a tunnel to be established. The wait
+// is limited to IdleTunnelReestablishTimeout. Returns nil when not idle or
+// when no tunnel is established in time.
+func (controller *Controller) awaitIdleReestablish() *Tunnel {
+	controller.tunnelMutex.Lock()
+	idleReestablished := controller.idleReestablished
+	controller.tunnelMutex.Unlock()
+
+	if idleReestablished == nil {
+		return nil
+	}
+
+	select {
+	case controller.signalIdleReestablish <- *new(struct{}):
+	default:
+	}
+
+	timer := time.NewTimer(controller.config.clientParameters.Get().Duration(
+		parameters.IdleTunnelReestablishTimeout))
+	defer timer.Stop()
+
+	select {
+	case <-idleReestablished:
+	case <-timer.C:
+		return nil
+	case <-controller.runCtx.Done():
+		return nil
+	}
+
+	return controller.getNextActiveTunnel()
+}
+
 // DirectDial dials an untunneled TCP connection within the controller run context.
 func (controller *Controller) DirectDial(remoteAddr string) (conn net.Conn, err error) {
 	return DialTCP(controller.runCtx, remoteAddr, controller.untunneledDialConfig)
@@ -1110,7 +1738,10 @@ func (controller *Controller) startEstablishing() {
 	if controller.isEstablishing {
 		return
 	}
-	NoticeInfo("start establishing")
+	if controller.sessionByteBudget.exceeded() {
+		return
+	}
+	controller.notices.Info("start establishing")
 
 	controller.concurrentEstablishTunnelsMutex.Lock()
 	controller.concurrentEstablishTunnels = 0
@@ -1227,12 +1858,12 @@ func (controller *Controller) stopEstablishing() {
 	if !controller.isEstablishing {
 		return
 	}
-	NoticeInfo("stop establishing")
+	controller.notices.Info("stop establishing")
 	controller.stopEstablish()
 	// Note: establishCandidateGenerator closes controller.candidateServerEntries
 	// (as it may be sending to that channel).
 	controller.establishWaitGroup.Wait()
-	NoticeInfo("stopped establishing")
+	controller.notices.Info("stopped establishing")
 
 	controller.isEstablishing = false
 	controller.establishCtx = nil
@@ -1249,8 +1880,8 @@ func (controller *Controller) stopEstablishing() {
 	controller.peakConcurrentEstablishTunnels = 0
 	controller.peakConcurrentMeekEstablishTunnels = 0
 	controller.concurrentEstablishTunnelsMutex.Unlock()
-	NoticeInfo("peak concurrent establish tunnels: %d", peakConcurrent)
-	NoticeInfo("peak concurrent meek establish tunnels: %d", peakConcurrentMeek)
+	controller.notices.Info("peak concurrent establish tunnels: %d", peakConcurrent)
+	controller.notices.Info("peak concurrent meek establish tunnels: %d", peakConcurrentMeek)
 
 	emitMemoryMetrics()
 	standardGarbageCollection()
@@ -1264,7 +1895,7 @@ func (controller *Controller) getTactics(done chan struct{}) {
 		GetTacticsStorer(),
 		controller.config.NetworkIDGetter.GetNetworkID())
 	if err != nil {
-		NoticeAlert("get stored tactics failed: %s", err)
+		controller.notices.Alert("get stored tactics failed: %s", err)
 
 		// The error will be due to a local datastore problem.
 		// While we could proceed with the tactics request, this
@@ -1277,7 +1908,7 @@ func (controller *Controller) getTactics(done chan struct{}) {
 		iterator, err := NewTacticsServerEntryIterator(
 			controller.config)
 		if err != nil {
-			NoticeAlert("tactics iterator failed: %s", err)
+			controller.notices.Alert("tactics iterator failed: %s", err)
 			return
 		}
 		defer iterator.Close()
@@ -1292,13 +1923,13 @@ func (controller *Controller) getTactics(done chan struct{}) {
 
 			serverEntry, err := iterator.Next()
 			if err != nil {
-				NoticeAlert("tactics iterator failed: %s", err)
+				controller.notices.Alert("tactics iterator failed: %s", err)
 				return
 			}
 
 			if serverEntry == nil {
 				if iteration == 0 {
-					NoticeAlert("tactics request skipped: no capable servers")
+					controller.notices.Alert("tactics request skipped: no capable servers")
 					return
 				}
 
@@ -1311,7 +1942,7 @@ func (controller *Controller) getTactics(done chan struct{}) {
 				break
 			}
 
-			NoticeAlert("tactics request failed: %s", err)
+			controller.notices.Alert("tactics request failed: %s", err)
 
 			// On error, proceed with a retry, as the error is likely
 			// due to a network failure.
@@ -1344,7 +1975,7 @@ func (controller *Controller) getTactics(done chan struct{}) {
 		err := controller.config.SetClientParameters(
 			tacticsRecord.Tag, true, tacticsRecord.Tactics.Parameters)
 		if err != nil {
-			NoticeAlert("apply tactics failed: %s", err)
+			controller.notices.Alert("apply tactics failed: %s", err)
 
 			// The error will be due to invalid tactics values from
 			// the server. When ApplyClientParameters fails, all
@@ -1386,7 +2017,7 @@ func (controller *Controller) doFetchTactics(
 
 	dialConfig, dialStats := initDialConfig(controller.config, meekConfig)
 
-	NoticeRequestingTactics(
+	controller.notices.RequestingTactics(
 		serverEntry.IpAddress,
 		serverEntry.Region,
 		tacticsProtocol,
@@ -1447,7 +2078,7 @@ func (controller *Controller) doFetchTactics(
 		return nil, common.ContextError(err)
 	}
 
-	NoticeRequestedTactics(
+	controller.notices.RequestedTactics(
 		serverEntry.IpAddress,
 		serverEntry.Region,
 		tacticsProtocol,
@@ -1472,9 +2103,12 @@ func (controller *Controller) establishCandidateGenerator(impairedProtocols []st
 	establishStartTime := monotime.Now()
 	var networkWaitDuration time.Duration
 
+	obfuscationPassphraseTag := common.GetObfuscationPassphraseTag(
+		controller.config.ObfuscationPassphrase)
+
 	applyServerAffinity, iterator, err := NewServerEntryIterator(controller.config)
 	if err != nil {
-		NoticeAlert("failed to iterate over candidates: %s", err)
+		controller.notices.Alert("failed to iterate over candidates: %s", err)
 		controller.SignalComponentFailure()
 		return
 	}
@@ -1493,10 +2127,19 @@ func (controller *Controller) establishCandidateGenerator(impairedProtocols []st
 
 	candidateCount := 0
 
+	// Summarize the final round, which is interrupted when establishment
+	// stops.
+	round := 0
+	defer func() {
+		controller.reportEstablishRound(round)
+	}()
+
 loop:
 	// Repeat until stopped
 	for i := 0; ; i++ {
 
+		round = i + 1
+
 		networkWaitStartTime := monotime.Now()
 
 		if !WaitForNetworkConnectivity(
@@ -1507,17 +2150,23 @@ loop:
 
 		networkWaitDuration += monotime.Since(networkWaitStartTime)
 
+		pass := &establishPass{
+			round:    round,
+			attempts: make(map[string]int),
+		}
+
 		// Send each iterator server entry to the establish workers
 		startTime := monotime.Now()
 		for {
 			serverEntry, err := iterator.Next()
 			if err != nil {
-				NoticeAlert("failed to get next candidate: %s", err)
+				controller.notices.Alert("failed to get next candidate: %s", err)
 				controller.SignalComponentFailure()
 				break loop
 			}
 			if serverEntry == nil {
 				// Completed this iteration
+				controller.completeEstablishPassIteration(pass)
 				break
 			}
 
@@ -1526,6 +2175,15 @@ loop:
 				continue
 			}
 
+			// Servers which require an obfuscation passphrase don't
+			// interoperate with clients that have a different passphrase,
+			// or none, so don't attempt them.
+			if serverEntry.ObfuscationPassphraseTag != obfuscationPassphraseTag {
+				controller.notices.ServerEntryRejected(
+					serverEntry.IpAddress, "obfuscation passphrase mismatch")
+				continue
+			}
+
 			// Use a prioritized tunnel protocol for the first
 			// PrioritizeTunnelProtocolsCandidateCount candidates.
 			// This facility can be used to favor otherwise slower
@@ -1547,6 +2205,14 @@ loop:
 				candidateImpairedProtocols = impairedProtocols
 			}
 
+			// Prefer the last successful protocol for the server's region.
+			// As with impaired protocols, this is only done for the first
+			// iteration, so that a protocol which is now blocked doesn't
+			// prevent other protocols from being tried.
+
+			useLastTunnelProtocol := i == 0 &&
+				!controller.config.DisableStickyTunnelProtocol
+
 			// adjustedEstablishStartTime is establishStartTime shifted
 			// to exclude time spent waiting for network connectivity.
 
@@ -1556,8 +2222,10 @@ loop:
 				serverEntry:                serverEntry,
 				isServerAffinityCandidate:  isServerAffinityCandidate,
 				usePriorityProtocol:        usePriorityProtocol,
+				useLastTunnelProtocol:      useLastTunnelProtocol,
 				impairedProtocols:          candidateImpairedProtocols,
 				adjustedEstablishStartTime: adjustedEstablishStartTime,
+				establishPass:              pass,
 			}
 
 			wasServerAffinityCandidate := isServerAffinityCandidate
@@ -1571,6 +2239,11 @@ loop:
 
 			candidateCount++
 
+			pass.mutex.Lock()
+			pass.candidates += 1
+			pass.pendingCandidates += 1
+			pass.mutex.Unlock()
+
 			select {
 			case controller.candidateServerEntries <- candidate:
 			case <-controller.establishCtx.Done():
@@ -1635,6 +2308,8 @@ loop:
 		// Free up resources now, but don't reset until after the pause.
 		iterator.Close()
 
+		controller.reportEstablishRound(round)
+
 		// Trigger a common remote server list fetch, since we may have failed
 		// to connect with all known servers. Don't block sending signal, since
 		// this signal may have already been sent.
@@ -1669,11 +2344,9 @@ loop:
 		// in typical conditions (it isn't strictly necessary to wait for this, there will
 		// be more rounds if required).
 
-		p := controller.config.clientParameters.Get()
-		timeout := common.JitterDuration(
-			p.Duration(parameters.EstablishTunnelPausePeriod),
-			p.Float(parameters.EstablishTunnelPausePeriodJitter))
-		p = nil
+		timeout := controller.nextEstablishPausePeriod()
+
+		controller.notices.Info("next establishment round in %s", timeout)
 
 		timer := time.NewTimer(timeout)
 		select {
@@ -1689,6 +2362,55 @@ loop:
 	}
 }
 
+// nextEstablishPausePeriod records an establishment round that failed to
+// establish a tunnel and returns the pause before the next round. The pause
+// backs off exponentially, from EstablishTunnelPausePeriod up to
+// EstablishTunnelPausePeriodMax, with the number of consecutive failed
+// rounds. Failed rounds are counted across establishments, so that the
+// backoff applies when tunnels repeatedly fail and are reestablished.
+func (controller *Controller) nextEstablishPausePeriod() time.Duration {
+
+	failures := atomic.AddInt32(&controller.establishRoundFailures, 1)
+
+	p := controller.config.clientParameters.Get()
+	pausePeriod := p.Duration(parameters.EstablishTunnelPausePeriod)
+	maxPausePeriod := p.Duration(parameters.EstablishTunnelPausePeriodMax)
+	jitter := p.Float(parameters.EstablishTunnelPausePeriodJitter)
+	p = nil
+
+	// A maximum less than the initial pause disables the backoff.
+	if maxPausePeriod < pausePeriod {
+		maxPausePeriod = pausePeriod
+	}
+
+	for i := int32(1); i < failures && pausePeriod < maxPausePeriod; i++ {
+		pausePeriod *= 2
+	}
+	if pausePeriod > maxPausePeriod {
+		pausePeriod = maxPausePeriod
+	}
+
+	return common.JitterDuration(pausePeriod, jitter)
+}
+
+// resetEstablishPauseBackoff resets the establishment pause backoff when the
+// failed tunnel was connected for at least
+// EstablishTunnelPauseBackoffResetPeriod. Tunnels which fail sooner, as may
+// happen when the network is unstable, don't reset the backoff.
+func (controller *Controller) resetEstablishPauseBackoff(failedTunnel *Tunnel) {
+
+	resetPeriod := controller.config.clientParameters.Get().Duration(
+		parameters.EstablishTunnelPauseBackoffResetPeriod)
+
+	// If the tunnel failed while activating, its establishedTime will be 0.
+
+	if failedTunnel.establishedTime != 0 &&
+		!failedTunnel.establishedTime.Add(resetPeriod).After(monotime.Now()) {
+
+		atomic.StoreInt32(&controller.establishRoundFailures, 0)
+	}
+}
+
 // establishTunnelWorker pulls candidates from the candidate queue, establishes
 // a connection to the tunnel server, and delivers the connected tunnel to a channel.
 func (controller *Controller) establishTunnelWorker() {
@@ -1703,6 +2425,7 @@ loop:
 
 		// There may already be a tunnel to this candidate. If so, skip it.
 		if controller.isActiveTunnelServerEntry(candidateServerEntry.serverEntry) {
+			controller.completeEstablishPassCandidate(candidateServerEntry, "", false)
 			continue
 		}
 
@@ -1739,7 +2462,8 @@ loop:
 			candidateServerEntry.serverEntry,
 			candidateServerEntry.impairedProtocols,
 			excludeMeek,
-			candidateServerEntry.usePriorityProtocol)
+			candidateServerEntry.usePriorityProtocol,
+			candidateServerEntry.useLastTunnelProtocol)
 
 		if err == errNoProtocolSupported {
 			// selectProtocol returns errNoProtocolSupported when the server
@@ -1754,6 +2478,7 @@ loop:
 				close(controller.serverAffinityDoneBroadcast)
 			}
 
+			controller.completeEstablishPassCandidate(candidateServerEntry, "", false)
 			continue
 		}
 
@@ -1773,6 +2498,7 @@ loop:
 
 					// Skip this candidate.
 					controller.concurrentEstablishTunnelsMutex.Unlock()
+					controller.completeEstablishPassCandidate(candidateServerEntry, "", false)
 					continue
 				}
 				controller.concurrentMeekEstablishTunnels += 1
@@ -1831,10 +2557,36 @@ loop:
 				break loop
 			}
 
-			NoticeInfo("failed to connect to %s: %s", candidateServerEntry.serverEntry.IpAddress, err)
+			controller.notices.Info("failed to connect to %s: %s", candidateServerEntry.serverEntry.IpAddress, err)
+
+			if selectedProtocol != "" {
+				controller.recordEstablishOutcome(
+					selectedProtocol, getConnectFailureReason(err))
+			}
+
+			controller.recordServerEntryPerformance(
+				candidateServerEntry.serverEntry.IpAddress, false, 0)
+
+			controller.completeEstablishPassCandidate(
+				candidateServerEntry, selectedProtocol, false)
+
 			continue
 		}
 
+		controller.recordServerEntryPerformance(
+			candidateServerEntry.serverEntry.IpAddress,
+			true,
+			tunnel.dialStats.DialDuration+tunnel.dialStats.SSHHandshakeDuration)
+
+		controller.recordEstablishOutcome(selectedProtocol, "")
+
+		controller.completeEstablishPassCandidate(
+			candidateServerEntry, selectedProtocol, true)
+
+		// Port forward traffic through the tunnel counts against the
+		// controller's session byte budget.
+		tunnel.sessionByteBudget = controller.sessionByteBudget
+
 		// Deliver connected tunnel.
 		// Don't block. Assumes the receiver has a buffer large enough for
 		// the number of desired tunnels. If there's no room, the tunnel must
@@ -1858,6 +2610,127 @@ loop:
 	}
 }
 
+// recordEstablishOutcome records a connection attempt outcome in the
+// current establishment round summary. failureReason is blank for a
+// successful attempt.
+func (controller *Controller) recordEstablishOutcome(
+	tunnelProtocol, failureReason string) {
+
+	controller.concurrentEstablishTunnelsMutex.Lock()
+	defer controller.concurrentEstablishTunnelsMutex.Unlock()
+
+	if controller.establishRoundOutcomes == nil {
+		controller.establishRoundOutcomes = make(map[string]*EstablishProtocolOutcome)
+	}
+
+	outcome, ok := controller.establishRoundOutcomes[tunnelProtocol]
+	if !ok {
+		outcome = &EstablishProtocolOutcome{Failed: make(map[string]int)}
+		controller.establishRoundOutcomes[tunnelProtocol] = outcome
+	}
+
+	outcome.Attempts += 1
+	if failureReason == "" {
+		outcome.Succeeded += 1
+	} else {
+		outcome.Failed[failureReason] += 1
+	}
+}
+
+// reportEstablishRound emits a summary of the connection attempts made in an
+// establishment round, and resets the summary for the next round. Attempts
+// are summarized per round, rather than reported individually, to limit the
+// volume of notices. No notice is emitted when no attempts were made.
+func (controller *Controller) reportEstablishRound(round int) {
+
+	controller.concurrentEstablishTunnelsMutex.Lock()
+	outcomes := controller.establishRoundOutcomes
+	controller.establishRoundOutcomes = nil
+	controller.concurrentEstablishTunnelsMutex.Unlock()
+
+	if len(outcomes) > 0 {
+		controller.notices.EstablishRound(round, outcomes)
+	}
+}
+
+// completeEstablishPassIteration marks the end of a complete iteration of
+// the known server entries, after which the pass is exhausted once all its
+// candidates have failed.
+func (controller *Controller) completeEstablishPassIteration(pass *establishPass) {
+
+	pass.mutex.Lock()
+	pass.iterationCompleted = true
+	pass.mutex.Unlock()
+
+	controller.reportEstablishPassExhausted(pass)
+}
+
+// completeEstablishPassCandidate records the outcome of an establishment
+// round candidate. selectedProtocol is blank when the candidate was skipped
+// without a connection attempt.
+func (controller *Controller) completeEstablishPassCandidate(
+	candidate *candidateServerEntry, selectedProtocol string, success bool) {
+
+	pass := candidate.establishPass
+
+	pass.mutex.Lock()
+	pass.pendingCandidates -= 1
+	if selectedProtocol != "" {
+		pass.attempts[selectedProtocol] += 1
+	}
+	if success {
+		pass.succeeded = true
+	}
+	pass.mutex.Unlock()
+
+	controller.reportEstablishPassExhausted(pass)
+}
+
+// reportEstablishPassExhausted emits a ServerEntriesExhausted notice when
+// every candidate in a complete iteration of the known server entries has
+// failed. This is distinct from individual connection failures, and
+// indicates that new server entries or a change in network conditions are
+// needed. Passes interrupted by the end of establishment, such as when
+// another pass establishes a tunnel, aren't reported.
+func (controller *Controller) reportEstablishPassExhausted(pass *establishPass) {
+
+	pass.mutex.Lock()
+	exhausted := pass.iterationCompleted &&
+		pass.pendingCandidates == 0 &&
+		!pass.succeeded &&
+		!pass.reported
+	if exhausted {
+		pass.reported = true
+	}
+	candidates := pass.candidates
+	attempts := make(map[string]int)
+	for tunnelProtocol, count := range pass.attempts {
+		attempts[tunnelProtocol] = count
+	}
+	pass.mutex.Unlock()
+
+	if exhausted && !controller.isStopEstablishing() {
+		controller.notices.ServerEntriesExhausted(pass.round, candidates, attempts)
+	}
+}
+
+// recordServerEntryPerformance records a connection attempt outcome, which
+// is used to favor fast, reliable servers in subsequent establishments.
+// Failures are not fatal, and are reported as alerts.
+func (controller *Controller) recordServerEntryPerformance(
+	ipAddress string, success bool, latency time.Duration) {
+
+	// TargetServerEntry candidates may not be in the datastore.
+	if controller.config.TargetServerEntry != "" {
+		return
+	}
+
+	err := RecordServerEntryPerformance(controller.config, ipAddress, success, latency)
+	if err != nil {
+		controller.notices.Alert("failed to record server performance: %s", err)
+	}
+}
+
 func (controller *Controller) isStopEstablishing() bool {
 	select {
 	case <-controller.establishCtx.Done():
@@ -22,6 +22,7 @@ package psiphon
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -32,6 +33,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -1155,3 +1157,959 @@ type testNetworkGetter struct {
 func (testNetworkGetter) GetNetworkID() string {
 	return "NETWORK1"
 }
+
+func TestSwitchServerCoalesced(t *testing.T) {
+
+	controller := &Controller{
+		signalSwitchServer: make(chan struct{}, 1),
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			controller.SwitchServer()
+		}()
+	}
+	wg.Wait()
+
+	if len(controller.signalSwitchServer) != 1 {
+		t.Fatalf("unexpected pending switch server signals: %d",
+			len(controller.signalSwitchServer))
+	}
+}
+
+func TestEstablishPauseBackoff(t *testing.T) {
+
+	config, err := LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "EstablishTunnelPausePeriodSeconds" : 1,
+        "EstablishTunnelPausePeriodMaxSeconds" : 5,
+        "EstablishTunnelPausePeriodJitter" : 0.0
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	controller := &Controller{config: config}
+
+	expectedPausePeriods := []time.Duration{
+		1 * time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+
+	for _, expectedPausePeriod := range expectedPausePeriods {
+		pausePeriod := controller.nextEstablishPausePeriod()
+		if pausePeriod != expectedPausePeriod {
+			t.Fatalf("unexpected pause period: %s", pausePeriod)
+		}
+	}
+
+	// A tunnel which fails soon after connecting doesn't reset the backoff;
+	// a tunnel which remained connected for the reset period does.
+
+	err = config.SetClientParameters("", false, map[string]interface{}{
+		parameters.EstablishTunnelPauseBackoffResetPeriod: "100ms",
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	tunnel := &Tunnel{establishedTime: monotime.Now()}
+
+	controller.resetEstablishPauseBackoff(tunnel)
+
+	if pausePeriod := controller.nextEstablishPausePeriod(); pausePeriod != 5*time.Second {
+		t.Fatalf("unexpected pause period: %s", pausePeriod)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	controller.resetEstablishPauseBackoff(tunnel)
+
+	if pausePeriod := controller.nextEstablishPausePeriod(); pausePeriod != 1*time.Second {
+		t.Fatalf("unexpected pause period: %s", pausePeriod)
+	}
+}
+
+func TestControllerPause(t *testing.T) {
+
+	config, err := LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "TargetServerEntry" : "0",
+        "TunnelPoolSize" : 2
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	pausedNotices := make(chan bool, 2)
+	SetNoticeCallback(func(noticeType string, data map[string]interface{}) {
+		if noticeType == "Paused" {
+			pausedNotices <- data["paused"].(bool)
+		}
+	})
+	defer SetNoticeCallback(nil)
+
+	controller := &Controller{
+		config:     config,
+		tunnelPool: NewTunnelPool(config.TunnelPoolSize, config.TunnelPoolSelection),
+	}
+
+	makeTunnel := func(i int) *Tunnel {
+		return &Tunnel{
+			mutex: new(sync.Mutex),
+			serverEntry: &protocol.ServerEntry{
+				IpAddress: fmt.Sprintf("192.0.2.%d", i),
+			},
+			openPortForwards: make(map[*TunneledConn]bool),
+			signalResume:     make(chan struct{}, 1),
+		}
+	}
+
+	tunnels := []*Tunnel{makeTunnel(0), makeTunnel(1)}
+
+	if !controller.registerTunnel(tunnels[0]) {
+		t.Fatalf("registerTunnel failed")
+	}
+
+	controller.Pause()
+	controller.Pause()
+
+	if !controller.IsPaused() || !tunnels[0].IsPaused() {
+		t.Fatalf("unexpected unpaused state")
+	}
+
+	// A tunnel established while paused starts paused
+
+	if !controller.registerTunnel(tunnels[1]) {
+		t.Fatalf("registerTunnel failed")
+	}
+
+	if !tunnels[1].IsPaused() {
+		t.Fatalf("unexpected unpaused tunnel")
+	}
+
+	// Upgrade downloads fail fast while paused
+
+	err = DownloadUpgrade(context.Background(), config, 0, "", tunnels[0], nil)
+	if err != ErrTunnelPaused {
+		t.Fatalf("unexpected DownloadUpgrade result: %v", err)
+	}
+
+	// Resume signals each tunnel to probe
+
+	controller.Resume()
+	controller.Resume()
+
+	for _, tunnel := range tunnels {
+		if tunnel.IsPaused() {
+			t.Fatalf("unexpected paused tunnel")
+		}
+		select {
+		case <-tunnel.signalResume:
+		default:
+			t.Fatalf("missing resume signal")
+		}
+	}
+
+	for _, expectedPaused := range []bool{true, false} {
+		select {
+		case paused := <-pausedNotices:
+			if paused != expectedPaused {
+				t.Fatalf("unexpected Paused notice: %t", paused)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("missing Paused notice")
+		}
+	}
+
+	select {
+	case <-pausedNotices:
+		t.Fatalf("unexpected Paused notice")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestControllerIdle(t *testing.T) {
+
+	config, err := LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "TargetServerEntry" : "0"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	runCtx, stopRunning := context.WithCancel(context.Background())
+	defer stopRunning()
+
+	controller := &Controller{
+		config:                config,
+		runCtx:                runCtx,
+		tunnelPool:            NewTunnelPool(config.TunnelPoolSize, config.TunnelPoolSelection),
+		signalIdleReestablish: make(chan struct{}, 1),
+	}
+
+	idleTimeout := 100 * time.Millisecond
+
+	if controller.isIdle(idleTimeout) {
+		t.Fatalf("unexpected idle with no tunnels")
+	}
+
+	tunnel := &Tunnel{
+		mutex: new(sync.Mutex),
+		serverEntry: &protocol.ServerEntry{
+			IpAddress: "192.0.2.1",
+		},
+		openPortForwards: make(map[*TunneledConn]bool),
+		establishedTime:  monotime.Now(),
+	}
+
+	if !controller.registerTunnel(tunnel) {
+		t.Fatalf("registerTunnel failed")
+	}
+
+	if controller.isIdle(idleTimeout) {
+		t.Fatalf("unexpected idle after establishment")
+	}
+
+	time.Sleep(idleTimeout)
+
+	if !controller.isIdle(idleTimeout) || controller.isIdle(0) {
+		t.Fatalf("unexpected idle state")
+	}
+
+	// Port forward traffic is activity
+
+	conn, peerConn := net.Pipe()
+	defer conn.Close()
+	defer peerConn.Close()
+	go io.Copy(ioutil.Discard, peerConn)
+
+	tunneledConn := &TunneledConn{Conn: conn, tunnel: tunnel}
+	_, err = tunneledConn.Write([]byte("data"))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	if controller.isIdle(idleTimeout) {
+		t.Fatalf("unexpected idle after port forward traffic")
+	}
+
+	time.Sleep(idleTimeout)
+
+	// An upgrade download in progress is activity
+
+	atomic.StoreInt32(&controller.upgradeDownloadsInProgress, 1)
+
+	if controller.isIdle(idleTimeout) {
+		t.Fatalf("unexpected idle during upgrade download")
+	}
+
+	atomic.StoreInt32(&controller.upgradeDownloadsInProgress, 0)
+
+	if !controller.isIdle(idleTimeout) {
+		t.Fatalf("unexpected non-idle state")
+	}
+
+	// After an idle disconnect, a dial signals reestablishment and waits for
+	// a tunnel
+
+	if controller.awaitIdleReestablish() != nil {
+		t.Fatalf("unexpected tunnel when not idle")
+	}
+
+	controller.tunnelPool.removeAll()
+
+	controller.idleReestablished = make(chan struct{})
+
+	result := make(chan *Tunnel, 1)
+	go func() {
+		result <- controller.awaitIdleReestablish()
+	}()
+
+	select {
+	case <-controller.signalIdleReestablish:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("missing reestablish signal")
+	}
+
+	if !controller.registerTunnel(tunnel) {
+		t.Fatalf("registerTunnel failed")
+	}
+
+	controller.tunnelMutex.Lock()
+	close(controller.idleReestablished)
+	controller.idleReestablished = nil
+	controller.tunnelMutex.Unlock()
+
+	select {
+	case reestablishedTunnel := <-result:
+		if reestablishedTunnel != tunnel {
+			t.Fatalf("unexpected reestablished tunnel")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("awaitIdleReestablish did not return")
+	}
+}
+
+func TestControllerDirectConnectionFallback(t *testing.T) {
+
+	config, err := LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "TargetServerEntry" : "0",
+        "DirectConnectionFallbackTimeoutSeconds" : 1
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	notices := make(chan bool, 16)
+	SetNoticeCallback(func(noticeType string, data map[string]interface{}) {
+		if noticeType == "DirectConnectionFallback" {
+			notices <- data["engaged"].(bool)
+		}
+	})
+	defer SetNoticeCallback(nil)
+
+	runCtx, stopRunning := context.WithCancel(context.Background())
+	defer stopRunning()
+
+	controller := &Controller{
+		config:               config,
+		runCtx:               runCtx,
+		tunnelPool:           NewTunnelPool(config.TunnelPoolSize, config.TunnelPoolSelection),
+		untunneledDialConfig: &DialConfig{},
+		isEstablishing:       true,
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	dial := func(alwaysTunnel bool) error {
+		conn, err := controller.Dial(listener.Addr().String(), alwaysTunnel, nil)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	// The fallback doesn't engage before the failure window has elapsed.
+
+	startTime := monotime.Now()
+
+	for monotime.Since(startTime) < 500*time.Millisecond {
+		controller.updateDirectConnectionFallback()
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if controller.isDirectConnectionFallbackEngaged() {
+		t.Fatalf("unexpected fallback before timeout")
+	}
+
+	if dial(false) == nil {
+		t.Fatalf("unexpected dial success with no tunnel")
+	}
+
+	// After the failure window, the fallback engages and dials are direct.
+
+	time.Sleep(1 * time.Second)
+	controller.updateDirectConnectionFallback()
+
+	if !controller.isDirectConnectionFallbackEngaged() {
+		t.Fatalf("fallback not engaged after timeout")
+	}
+
+	select {
+	case engaged := <-notices:
+		if !engaged {
+			t.Fatalf("unexpected notice")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("missing notice")
+	}
+
+	err = dial(false)
+	if err != nil {
+		t.Fatalf("direct dial failed: %s", err)
+	}
+
+	if dial(true) == nil {
+		t.Fatalf("unexpected direct dial when always tunneling")
+	}
+
+	// Once a tunnel is established, the fallback disengages.
+
+	tunnel := &Tunnel{
+		mutex: new(sync.Mutex),
+		serverEntry: &protocol.ServerEntry{
+			IpAddress: "192.0.2.1",
+		},
+		openPortForwards: make(map[*TunneledConn]bool),
+		establishedTime:  monotime.Now(),
+	}
+
+	if !controller.registerTunnel(tunnel) {
+		t.Fatalf("registerTunnel failed")
+	}
+
+	controller.updateDirectConnectionFallback()
+
+	if controller.isDirectConnectionFallbackEngaged() {
+		t.Fatalf("unexpected fallback with active tunnel")
+	}
+
+	select {
+	case engaged := <-notices:
+		if engaged {
+			t.Fatalf("unexpected notice")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("missing notice")
+	}
+}
+
+func TestControllerEstablishRound(t *testing.T) {
+
+	type establishRoundNotice struct {
+		round    int
+		outcomes map[string]*EstablishProtocolOutcome
+	}
+
+	notices := make(chan establishRoundNotice, 16)
+
+	SetNoticeCallback(func(noticeType string, data map[string]interface{}) {
+		if noticeType == "EstablishRound" {
+			notices <- establishRoundNotice{
+				round:    data["round"].(int),
+				outcomes: data["protocols"].(map[string]*EstablishProtocolOutcome),
+			}
+		}
+	})
+	defer SetNoticeCallback(nil)
+
+	controller := &Controller{}
+
+	// No notice is emitted for a round with no attempts.
+
+	controller.reportEstablishRound(1)
+
+	timeoutCtx, cancelFunc := context.WithTimeout(context.Background(), 0)
+	defer cancelFunc()
+	<-timeoutCtx.Done()
+
+	controller.recordEstablishOutcome(
+		protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+		getConnectFailureReason(newConnectTunnelError(
+			context.Background(), CONNECT_FAILURE_REASON_DIAL, errors.New("failed"))))
+	controller.recordEstablishOutcome(
+		protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+		getConnectFailureReason(newConnectTunnelError(
+			timeoutCtx, CONNECT_FAILURE_REASON_SSH_HANDSHAKE, errors.New("failed"))))
+	controller.recordEstablishOutcome(
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+		getConnectFailureReason(errors.New("failed")))
+	controller.recordEstablishOutcome(
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK, "")
+
+	controller.reportEstablishRound(2)
+
+	var notice establishRoundNotice
+	select {
+	case notice = <-notices:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("missing EstablishRound notice")
+	}
+
+	if notice.round != 2 || len(notice.outcomes) != 2 {
+		t.Fatalf("unexpected EstablishRound notice: %+v", notice)
+	}
+
+	obfuscatedSSH := notice.outcomes[protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH]
+	if obfuscatedSSH == nil ||
+		obfuscatedSSH.Attempts != 2 ||
+		obfuscatedSSH.Succeeded != 0 ||
+		obfuscatedSSH.Failed[CONNECT_FAILURE_REASON_DIAL] != 1 ||
+		obfuscatedSSH.Failed[CONNECT_FAILURE_REASON_TIMEOUT] != 1 {
+
+		t.Fatalf("unexpected OSSH outcome: %+v", obfuscatedSSH)
+	}
+
+	meek := notice.outcomes[protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK]
+	if meek == nil ||
+		meek.Attempts != 2 ||
+		meek.Succeeded != 1 ||
+		meek.Failed[CONNECT_FAILURE_REASON_OTHER] != 1 {
+
+		t.Fatalf("unexpected meek outcome: %+v", meek)
+	}
+
+	// The summary is reset for the next round.
+
+	controller.reportEstablishRound(3)
+
+	select {
+	case notice = <-notices:
+		t.Fatalf("unexpected EstablishRound notice: %+v", notice)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestControllerConnectWithDeadline(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-connect-deadline-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	singleton = dataStore{}
+	err = InitDataStore(&Config{DataStoreDirectory: testDataDirName})
+	if err != nil {
+		t.Fatalf("InitDataStore failed: %s", err)
+	}
+
+	for _, testCase := range []struct {
+		description   string
+		slowCandidate bool
+	}{
+		{"connected", false},
+		{"slow candidate", true},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Listen failed: %s", err)
+			}
+			defer listener.Close()
+
+			// The slow candidate accepts TCP connections but never completes
+			// the SSH handshake, so the connection attempt never succeeds
+			// or times out on its own.
+
+			hostKey := ""
+			if testCase.slowCandidate {
+				go func() {
+					for {
+						conn, err := listener.Accept()
+						if err != nil {
+							return
+						}
+						defer conn.Close()
+					}
+				}()
+			} else {
+				hostKey = runTestSSHServer(t, listener, nil)
+			}
+
+			encodedServerEntry, err := protocol.EncodeServerEntry(
+				makeTestSSHServerEntry(t, listener, hostKey))
+			if err != nil {
+				t.Fatalf("EncodeServerEntry failed: %s", err)
+			}
+
+			config, err := LoadConfig([]byte(fmt.Sprintf(`
+            {
+                "PropagationChannelId" : "0",
+                "SponsorId" : "0",
+                "DataStoreDirectory" : "%s",
+                "TargetServerEntry" : "%s",
+                "DisableApi" : true,
+                "DisableRemoteServerListFetcher" : true,
+                "DisableLocalSocksProxy" : true,
+                "DisableLocalHTTPProxy" : true,
+                "UseControllerDial" : true,
+                "TunnelConnectTimeoutSeconds" : 300,
+                "EstablishTunnelTimeoutSeconds" : 0
+            }`, testDataDirName, encodedServerEntry)))
+			if err != nil {
+				t.Fatalf("LoadConfig failed: %s", err)
+			}
+
+			results := make(chan bool, 1)
+			SetNoticeCallback(func(noticeType string, data map[string]interface{}) {
+				if noticeType == "ConnectWithDeadline" {
+					results <- data["connected"].(bool)
+				}
+			})
+			defer SetNoticeCallback(nil)
+
+			controller, err := NewController(config)
+			if err != nil {
+				t.Fatalf("NewController failed: %s", err)
+			}
+
+			runCtx, stopRunning := context.WithCancel(context.Background())
+			defer stopRunning()
+
+			stopped := make(chan struct{})
+			go func() {
+				controller.Run(runCtx)
+				close(stopped)
+			}()
+
+			ctx, cancelFunc := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancelFunc()
+
+			err = controller.ConnectWithDeadline(ctx)
+
+			if testCase.slowCandidate {
+				if err != context.DeadlineExceeded {
+					t.Fatalf("unexpected ConnectWithDeadline result: %v", err)
+				}
+
+				// The controller gives up, canceling the in-flight connection
+				// attempt, well within the per-candidate timeout.
+
+				select {
+				case <-stopped:
+				case <-time.After(10 * time.Second):
+					t.Fatalf("controller did not stop")
+				}
+
+			} else if err != nil {
+				t.Fatalf("ConnectWithDeadline failed: %s", err)
+			}
+
+			select {
+			case connected := <-results:
+				if connected == testCase.slowCandidate {
+					t.Fatalf("unexpected ConnectWithDeadline notice: %v", connected)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("missing ConnectWithDeadline notice")
+			}
+
+			stopRunning()
+			<-stopped
+		})
+	}
+}
+
+func TestControllerServerEntriesExhausted(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	// The failing server accepts TCP connections and immediately closes
+	// them, so each connection attempt fails the SSH handshake.
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		makeTestSSHServerEntry(t, listener, ""))
+	if err != nil {
+		t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+
+	for _, testCase := range []struct {
+		description        string
+		targetServerEntry  string
+		expectedCandidates int
+		expectedAttempts   map[string]int
+	}{
+		{"empty", "", 0, map[string]int{}},
+		{"failing", encodedServerEntry, 1, map[string]int{protocol.TUNNEL_PROTOCOL_SSH: 1}},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			testDataDirName, err := ioutil.TempDir("", "psiphon-exhausted-test")
+			if err != nil {
+				t.Fatalf("TempDir failed: %s", err)
+			}
+			defer os.RemoveAll(testDataDirName)
+
+			singleton = dataStore{}
+			err = InitDataStore(&Config{DataStoreDirectory: testDataDirName})
+			if err != nil {
+				t.Fatalf("InitDataStore failed: %s", err)
+			}
+
+			config, err := LoadConfig([]byte(fmt.Sprintf(`
+            {
+                "PropagationChannelId" : "0",
+                "SponsorId" : "0",
+                "DataStoreDirectory" : "%s",
+                "TargetServerEntry" : "%s",
+                "DisableApi" : true,
+                "DisableRemoteServerListFetcher" : true,
+                "DisableLocalSocksProxy" : true,
+                "DisableLocalHTTPProxy" : true,
+                "UseControllerDial" : true
+            }`, testDataDirName, testCase.targetServerEntry)))
+			if err != nil {
+				t.Fatalf("LoadConfig failed: %s", err)
+			}
+
+			type exhaustedNotice struct {
+				candidates int
+				attempts   map[string]int
+			}
+
+			notices := make(chan exhaustedNotice, 16)
+			SetNoticeCallback(func(noticeType string, data map[string]interface{}) {
+				if noticeType == "ServerEntriesExhausted" {
+					notices <- exhaustedNotice{
+						candidates: data["candidates"].(int),
+						attempts:   data["protocols"].(map[string]int),
+					}
+				}
+			})
+			defer SetNoticeCallback(nil)
+
+			controller, err := NewController(config)
+			if err != nil {
+				t.Fatalf("NewController failed: %s", err)
+			}
+
+			runCtx, stopRunning := context.WithCancel(context.Background())
+			defer stopRunning()
+
+			stopped := make(chan struct{})
+			go func() {
+				controller.Run(runCtx)
+				close(stopped)
+			}()
+
+			select {
+			case notice := <-notices:
+				if notice.candidates != testCase.expectedCandidates ||
+					!reflect.DeepEqual(notice.attempts, testCase.expectedAttempts) {
+					t.Fatalf("unexpected ServerEntriesExhausted notice: %+v", notice)
+				}
+			case <-time.After(30 * time.Second):
+				t.Fatalf("missing ServerEntriesExhausted notice")
+			}
+
+			stopRunning()
+			<-stopped
+		})
+	}
+}
+
+func TestConcurrentControllers(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	emitDiagnosticNotices := GetEmitDiagnoticNotices()
+	defer SetEmitDiagnosticNotices(emitDiagnosticNotices)
+
+	// Notices emitted by either controller's components must not reach the
+	// process-wide notice sink.
+
+	var processNoticesMutex sync.Mutex
+	var processNotices []string
+	SetNoticeCallback(func(noticeType string, data map[string]interface{}) {
+		if noticeType == "Tunnels" || noticeType == "ActiveTunnel" || noticeType == "ConnectingServer" ||
+			noticeType == "ListeningSocksProxyPort" || noticeType == "ListeningHttpProxyPort" {
+			processNoticesMutex.Lock()
+			processNotices = append(processNotices, noticeType)
+			processNoticesMutex.Unlock()
+		}
+	})
+	defer SetNoticeCallback(nil)
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-concurrent-controllers-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	singleton = dataStore{}
+	err = InitDataStore(&Config{DataStoreDirectory: testDataDirName})
+	if err != nil {
+		t.Fatalf("InitDataStore failed: %s", err)
+	}
+
+	type testController struct {
+		ipAddress      string
+		config         *Config
+		noticesMutex   sync.Mutex
+		notices        []map[string]interface{}
+		noticeTypes    []string
+		tunnelsNotice  chan struct{}
+		tunnelsNoticed sync.Once
+	}
+
+	// Each controller targets its own SSH server, listening on a distinct
+	// loopback address, and has its own notice callback.
+
+	controllers := make([]*testController, 2)
+
+	for i := range controllers {
+
+		listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.%d:0", i+2))
+		if err != nil {
+			t.Fatalf("Listen failed: %s", err)
+		}
+		defer listener.Close()
+
+		serverEntry := makeTestSSHServerEntry(t, listener, runTestSSHServer(t, listener, nil))
+		serverEntry.IpAddress = listener.Addr().(*net.TCPAddr).IP.String()
+
+		encodedServerEntry, err := protocol.EncodeServerEntry(serverEntry)
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+
+		config, err := LoadConfig([]byte(fmt.Sprintf(`
+        {
+            "PropagationChannelId" : "0",
+            "SponsorId" : "0",
+            "DataStoreDirectory" : "%s",
+            "TargetServerEntry" : "%s",
+            "EmitDiagnosticNotices" : true,
+            "DisableApi" : true,
+            "DisableRemoteServerListFetcher" : true
+        }`, testDataDirName, encodedServerEntry)))
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %s", err)
+		}
+
+		controller := &testController{
+			ipAddress:     serverEntry.IpAddress,
+			config:        config,
+			tunnelsNotice: make(chan struct{}),
+		}
+
+		config.NoticeCallback = func(noticeType string, data map[string]interface{}) {
+			controller.noticesMutex.Lock()
+			controller.noticeTypes = append(controller.noticeTypes, noticeType)
+			controller.notices = append(controller.notices, data)
+			controller.noticesMutex.Unlock()
+			if noticeType == "Tunnels" && data["count"].(int) == 1 {
+				controller.tunnelsNoticed.Do(func() { close(controller.tunnelsNotice) })
+			}
+		}
+
+		controllers[i] = controller
+	}
+
+	// Run both controllers concurrently, until each has established a
+	// tunnel.
+
+	runCtx, stopRunning := context.WithCancel(context.Background())
+	defer stopRunning()
+
+	var stoppedWaitGroup sync.WaitGroup
+
+	for _, state := range controllers {
+
+		controller, err := NewController(state.config)
+		if err != nil {
+			t.Fatalf("NewController failed: %s", err)
+		}
+
+		stoppedWaitGroup.Add(1)
+		go func() {
+			defer stoppedWaitGroup.Done()
+			controller.Run(runCtx)
+		}()
+	}
+
+	for i, controller := range controllers {
+		select {
+		case <-controller.tunnelsNotice:
+		case <-time.After(30 * time.Second):
+			t.Fatalf("missing Tunnels notice for controller %d", i)
+		}
+	}
+
+	stopRunning()
+	stoppedWaitGroup.Wait()
+
+	// Each controller's notices must refer only to its own server, and each
+	// controller must report its own local proxy ports.
+
+	proxyPorts := make(map[string]int)
+
+	for i, controller := range controllers {
+
+		controller.noticesMutex.Lock()
+		noticeTypes := controller.noticeTypes
+		notices := controller.notices
+		controller.noticesMutex.Unlock()
+
+		activeTunnel := false
+		for j, data := range notices {
+			ipAddress, ok := data["ipAddress"].(string)
+			if ok && ipAddress != controller.ipAddress {
+				t.Fatalf("unexpected %s notice for controller %d: %s",
+					noticeTypes[j], i, ipAddress)
+			}
+			if noticeTypes[j] == "ActiveTunnel" {
+				activeTunnel = true
+			}
+		}
+
+		if !activeTunnel {
+			t.Fatalf("missing ActiveTunnel notice for controller %d", i)
+		}
+
+		for _, proxyNoticeType := range []string{
+			"ListeningSocksProxyPort", "ListeningHttpProxyPort"} {
+
+			count := 0
+			for j, data := range notices {
+				if noticeTypes[j] != proxyNoticeType {
+					continue
+				}
+				count += 1
+				address := data["address"].(string)
+				if otherIndex, ok := proxyPorts[address]; ok {
+					t.Fatalf("unexpected %s notice for controller %d: %s reported by controller %d",
+						proxyNoticeType, i, address, otherIndex)
+				}
+				proxyPorts[address] = i
+			}
+			if count != 1 {
+				t.Fatalf("unexpected %s notice count for controller %d: %d",
+					proxyNoticeType, i, count)
+			}
+		}
+	}
+
+	processNoticesMutex.Lock()
+	defer processNoticesMutex.Unlock()
+	if len(processNotices) > 0 {
+		t.Fatalf("unexpected process-wide notices: %v", processNotices)
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
@@ -62,6 +63,7 @@ const (
 	slokBucket                  = "SLOKs"
 	tacticsBucket               = "tactics"
 	speedTestSamplesBucket      = "speedTestSamples"
+	serverPerformanceBucket     = "serverEntryPerformance"
 
 	rankedServerEntryCount = 100
 )
@@ -71,6 +73,11 @@ const (
 	LEGACY_DATA_STORE_FILENAME              = "psiphon.db"
 	DATA_STORE_LAST_CONNECTED_KEY           = "lastConnected"
 	DATA_STORE_LAST_SERVER_ENTRY_FILTER_KEY = "lastServerEntryFilter"
+	DATA_STORE_UPGRADE_CHECK_SEED_KEY       = "upgradeCheckSeed"
+	DATA_STORE_CLIENT_INSTANCE_SEED_KEY     = "clientInstanceSeed"
+
+	DATA_STORE_LAST_FRONTING_ADDRESS_KEY_PREFIX = "lastFrontingAddress-"
+	DATA_STORE_LAST_TUNNEL_PROTOCOL_KEY_PREFIX  = "lastTunnelProtocol-"
 	PERSISTENT_STAT_TYPE_REMOTE_SERVER_LIST = remoteServerListStatsBucket
 )
 
@@ -97,14 +104,14 @@ func InitDataStore(config *Config) (err error) {
 		for retry := 0; retry < 3; retry++ {
 
 			if retry > 0 {
-				NoticeAlert("InitDataStore retry: %d", retry)
+				config.notices.Alert("InitDataStore retry: %d", retry)
 			}
 
 			db, err = bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
 
 			// The datastore file may be corrupt, so attempt to delete and try again
 			if err != nil {
-				NoticeAlert("bolt.Open error: %s", err)
+				config.notices.Alert("bolt.Open error: %s", err)
 				os.Remove(filename)
 				continue
 			}
@@ -117,7 +124,7 @@ func InitDataStore(config *Config) (err error) {
 
 			// The datastore file may be corrupt, so attempt to delete and try again
 			if err != nil {
-				NoticeAlert("bolt.SynchronousCheck error: %s", err)
+				config.notices.Alert("bolt.SynchronousCheck error: %s", err)
 				db.Close()
 				os.Remove(filename)
 				continue
@@ -159,15 +166,20 @@ func InitDataStore(config *Config) (err error) {
 			return
 		}
 
-		// Cleanup obsolete tunnel (session) stats bucket, if one still exists
+		// Cleanup obsolete tunnel (session) stats bucket, if one still exists,
+		// and the server entry performance bucket, as performance history is
+		// now stored in the KeyValueStore
 
 		err = db.Update(func(tx *bolt.Tx) error {
-			tunnelStatsBucket := []byte("tunnelStats")
-			if tx.Bucket(tunnelStatsBucket) != nil {
-				err := tx.DeleteBucket(tunnelStatsBucket)
-				if err != nil {
-					NoticeAlert("DeleteBucket %s error: %s", tunnelStatsBucket, err)
-					// Continue, since this is not fatal
+			for _, obsoleteBucket := range []string{
+				tunnelStatsBucket, serverPerformanceBucket} {
+
+				if tx.Bucket([]byte(obsoleteBucket)) != nil {
+					err := tx.DeleteBucket([]byte(obsoleteBucket))
+					if err != nil {
+						config.notices.Alert("DeleteBucket %s error: %s", obsoleteBucket, err)
+						// Continue, since this is not fatal
+					}
 				}
 			}
 			return nil
@@ -358,7 +370,7 @@ func PromoteServerEntry(config *Config, ipAddress string) error {
 		bucket := tx.Bucket([]byte(serverEntriesBucket))
 		data := bucket.Get([]byte(ipAddress))
 		if data == nil {
-			NoticeAlert(
+			config.notices.Alert(
 				"PromoteServerEntry: ignoring unknown server entry: %s",
 				ipAddress)
 			return nil
@@ -499,6 +511,129 @@ func insertRankedServerEntry(tx *bolt.Tx, serverEntryId string, position int) er
 	return nil
 }
 
+// serverEntryPerformanceKey is the KeyValueStore key of the recorded server
+// entry performance history, which is stored as a single JSON map of server
+// entry ID to serverEntryPerformance.
+const serverEntryPerformanceKey = "serverEntryPerformance"
+
+// serverEntryPerformancePruneWindows is the number of decay windows after
+// which a server entry performance record, having decayed to insignificance,
+// is pruned from the history.
+const serverEntryPerformancePruneWindows = 10
+
+// serverEntryPerformanceMutex serializes the read-modify-write of the
+// performance history in RecordServerEntryPerformance and
+// refreshServerEntryPerformance.
+var serverEntryPerformanceMutex sync.Mutex
+
+// RecordServerEntryPerformance records the outcome of a connection attempt
+// to the specified server entry. For a successful connection, latency is the
+// time taken to connect. The recorded performance is used by
+// ServerEntryIterator to favor fast, reliable servers.
+func RecordServerEntryPerformance(
+	config *Config, ipAddress string, success bool, latency time.Duration) error {
+
+	decayWindow := config.clientParameters.Get().Duration(
+		parameters.ServerEntryPerformanceDecayWindow)
+
+	serverEntryPerformanceMutex.Lock()
+	defer serverEntryPerformanceMutex.Unlock()
+
+	performance := getServerEntryPerformance(config)
+
+	p, ok := performance[ipAddress]
+	if !ok {
+		p = &serverEntryPerformance{}
+		performance[ipAddress] = p
+	}
+
+	now := time.Now()
+
+	p.record(now, decayWindow, success, latency)
+
+	pruneServerEntryPerformance(performance, now, decayWindow)
+
+	return setServerEntryPerformance(config, performance)
+}
+
+// refreshServerEntryPerformance prunes, from the recorded server entry
+// performance, records which have decayed to insignificance and records for
+// server entries which are no longer stored, so that the performance
+// history reflects the current server entries.
+func refreshServerEntryPerformance(config *Config) error {
+
+	decayWindow := config.clientParameters.Get().Duration(
+		parameters.ServerEntryPerformanceDecayWindow)
+
+	ipAddresses, err := GetServerEntryIpAddresses()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	serverEntryPerformanceMutex.Lock()
+	defer serverEntryPerformanceMutex.Unlock()
+
+	performance := getServerEntryPerformance(config)
+
+	for ipAddress := range performance {
+		if !common.Contains(ipAddresses, ipAddress) {
+			delete(performance, ipAddress)
+		}
+	}
+
+	pruneServerEntryPerformance(performance, time.Now(), decayWindow)
+
+	return setServerEntryPerformance(config, performance)
+}
+
+func pruneServerEntryPerformance(
+	performance map[string]*serverEntryPerformance,
+	now time.Time,
+	decayWindow time.Duration) {
+
+	if decayWindow <= 0 {
+		return
+	}
+	for serverEntryId, p := range performance {
+		if now.Sub(p.LastUpdate) > serverEntryPerformancePruneWindows*decayWindow {
+			delete(performance, serverEntryId)
+		}
+	}
+}
+
+func setServerEntryPerformance(
+	config *Config, performance map[string]*serverEntryPerformance) error {
+
+	data, err := json.Marshal(performance)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = config.getKeyValueStore().Set(serverEntryPerformanceKey, data)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// getServerEntryPerformance returns all recorded server entry performance.
+func getServerEntryPerformance(config *Config) map[string]*serverEntryPerformance {
+
+	performance := make(map[string]*serverEntryPerformance)
+
+	data, err := config.getKeyValueStore().Get(serverEntryPerformanceKey)
+	if err == nil && data != nil {
+		err = json.Unmarshal(data, &performance)
+	}
+	if err != nil {
+		// In case of data corruption, start over.
+		config.notices.Alert("getServerEntryPerformance: %s", common.ContextError(err))
+		performance = make(map[string]*serverEntryPerformance)
+	}
+
+	return performance
+}
+
 // ServerEntryIterator is used to iterate over
 // stored server entries in rank order.
 type ServerEntryIterator struct {
@@ -597,7 +732,10 @@ func newTargetServerEntryIterator(config *Config, isTactics bool) (bool, *Server
 			return false, nil, common.ContextError(errors.New("TargetServerEntry does not support EgressRegion"))
 		}
 
-		limitTunnelProtocols := config.clientParameters.Get().TunnelProtocols(parameters.LimitTunnelProtocols)
+		limitTunnelProtocols, allDisabled := config.clientParameters.Get().LimitTunnelProtocols()
+		if allDisabled {
+			return false, nil, common.ContextError(errors.New("all tunnel protocols are disabled"))
+		}
 		if len(limitTunnelProtocols) > 0 {
 			// At the ServerEntryIterator level, only limitTunnelProtocols is applied;
 			// impairedTunnelProtocols and excludeMeek are handled higher up.
@@ -614,7 +752,7 @@ func newTargetServerEntryIterator(config *Config, isTactics bool) (bool, *Server
 		targetServerEntry:            serverEntry,
 	}
 
-	NoticeInfo("using TargetServerEntry: %s", serverEntry.IpAddress)
+	config.notices.Info("using TargetServerEntry: %s", serverEntry.IpAddress)
 
 	return false, iterator, nil
 }
@@ -638,16 +776,24 @@ func (iterator *ServerEntryIterator) Reset() error {
 	// TODO: for isTacticsServerEntryIterator, emit tactics candidate count.
 
 	if !iterator.isTacticsServerEntryIterator {
-		limitTunnelProtocols := iterator.config.clientParameters.Get().TunnelProtocols(
-			parameters.LimitTunnelProtocols)
+		limitTunnelProtocols, allDisabled := iterator.config.clientParameters.Get().LimitTunnelProtocols()
 
-		count := CountServerEntries(iterator.config.EgressRegion, limitTunnelProtocols)
-		NoticeCandidateServers(iterator.config.EgressRegion, limitTunnelProtocols, count)
+		count := 0
+		if allDisabled {
+			iterator.config.notices.Alert(
+				"DisableTunnelProtocols disables all tunnel protocols: no server will be attempted")
+		} else {
+			count = CountServerEntries(iterator.config.EgressRegion, limitTunnelProtocols)
+		}
+		iterator.config.notices.CandidateServers(iterator.config.EgressRegion, limitTunnelProtocols, count)
 
 		// LimitTunnelProtocols may have changed since the last ReportAvailableRegions,
 		// and now there may be no servers with the required capabilities in the
 		// selected region. ReportAvailableRegions will signal this to the client.
 		if count == 0 {
+			if iterator.config.EgressRegion != "" {
+				iterator.config.notices.EgressRegionUnavailable(iterator.config.EgressRegion)
+			}
 			ReportAvailableRegions(iterator.config)
 		}
 	}
@@ -655,7 +801,9 @@ func (iterator *ServerEntryIterator) Reset() error {
 	// This query implements the Psiphon server candidate selection
 	// algorithm: the first TunnelPoolSize server candidates are in rank
 	// (priority) order, to favor previously successful servers; then the
-	// remaining long tail is shuffled to raise up less recent candidates.
+	// remaining long tail is shuffled to raise up less recent candidates,
+	// and ordered to favor servers with good recorded performance, while
+	// still exploring other candidates.
 
 	// BoltDB implementation note:
 	// We don't keep a transaction open for the duration of the iterator
@@ -672,6 +820,11 @@ func (iterator *ServerEntryIterator) Reset() error {
 	// list is built.
 
 	var serverEntryIds []string
+	var performance map[string]*serverEntryPerformance
+
+	if !iterator.isTacticsServerEntryIterator {
+		performance = getServerEntryPerformance(iterator.config)
+	}
 
 	err := singleton.db.View(func(tx *bolt.Tx) error {
 		var err error
@@ -705,6 +858,16 @@ func (iterator *ServerEntryIterator) Reset() error {
 		serverEntryIds[i], serverEntryIds[j] = serverEntryIds[j], serverEntryIds[i]
 	}
 
+	if len(performance) > 0 && len(serverEntryIds) > iterator.shuffleHeadLength {
+		p := iterator.config.clientParameters.Get()
+		orderServerEntriesByPerformance(
+			serverEntryIds[iterator.shuffleHeadLength:],
+			performance,
+			time.Now(),
+			p.Duration(parameters.ServerEntryPerformanceDecayWindow),
+			p.Float(parameters.ServerEntryPerformanceExplorationRatio))
+	}
+
 	iterator.serverEntryIds = serverEntryIds
 	iterator.serverEntryIndex = 0
 
@@ -768,7 +931,7 @@ func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
 		if data == nil {
 			// In case of data corruption or a bug causing this condition,
 			// do not stop iterating.
-			NoticeAlert("ServerEntryIterator.Next: unexpected missing server entry: %s", serverEntryId)
+			iterator.config.notices.Alert("ServerEntryIterator.Next: unexpected missing server entry: %s", serverEntryId)
 			continue
 		}
 
@@ -776,7 +939,7 @@ func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
 		if err != nil {
 			// In case of data corruption or a bug causing this condition,
 			// do not stop iterating.
-			NoticeAlert("ServerEntryIterator.Next: %s", common.ContextError(err))
+			iterator.config.notices.Alert("ServerEntryIterator.Next: %s", common.ContextError(err))
 			continue
 		}
 
@@ -903,10 +1066,27 @@ func CountNonImpairedProtocols(
 
 // ReportAvailableRegions prints a notice with the available egress regions.
 func ReportAvailableRegions(config *Config) {
+
+	regions, err := GetAvailableEgressRegions(config)
+	if err != nil {
+		config.notices.Alert("ReportAvailableRegions failed: %s", err)
+		return
+	}
+
+	config.notices.AvailableEgressRegions(regions)
+}
+
+// GetAvailableEgressRegions returns the sorted list of regions, suitable
+// for use as EgressRegion values, of the stored server entries which support
+// at least one of the LimitTunnelProtocols. This list may be used, for
+// example, to populate a region picker in a UI.
+func GetAvailableEgressRegions(config *Config) ([]string, error) {
 	checkInitDataStore()
 
-	limitTunnelProtocols := config.clientParameters.Get().TunnelProtocols(
-		parameters.LimitTunnelProtocols)
+	limitTunnelProtocols, allDisabled := config.clientParameters.Get().LimitTunnelProtocols()
+	if allDisabled {
+		return []string{}, nil
+	}
 
 	regions := make(map[string]bool)
 	err := scanServerEntries(func(serverEntry *protocol.ServerEntry) {
@@ -920,8 +1100,7 @@ func ReportAvailableRegions(config *Config) {
 	})
 
 	if err != nil {
-		NoticeAlert("ReportAvailableRegions failed: %s", err)
-		return
+		return nil, common.ContextError(err)
 	}
 
 	regionList := make([]string, 0, len(regions))
@@ -933,7 +1112,105 @@ func ReportAvailableRegions(config *Config) {
 		}
 	}
 
-	NoticeAvailableEgressRegions(regionList)
+	sort.Strings(regionList)
+
+	return regionList, nil
+}
+
+const (
+	SERVER_ENTRY_STATUS_UNKNOWN   = "unknown"
+	SERVER_ENTRY_STATUS_SUCCEEDED = "succeeded"
+	SERVER_ENTRY_STATUS_FAILED    = "failed"
+)
+
+// ServerEntryInfo describes a stored server entry, for diagnostics.
+//
+// IPAddress is blank unless diagnostic notices are enabled; see
+// SetEmitDiagnosticNotices. Status is the outcome of the most recent
+// connection attempt, one of SERVER_ENTRY_STATUS_UNKNOWN, when there is no
+// recorded attempt, SERVER_ENTRY_STATUS_SUCCEEDED, or
+// SERVER_ENTRY_STATUS_FAILED. SuccessRate is the recent connection success
+// rate, with older attempts decayed as per
+// ServerEntryPerformanceDecayWindow, and is 0 when there are no attempts.
+type ServerEntryInfo struct {
+	IPAddress       string    `json:"ipAddress,omitempty"`
+	Region          string    `json:"region"`
+	Protocols       []string  `json:"protocols"`
+	Status          string    `json:"status"`
+	LastAttemptTime time.Time `json:"lastAttemptTime"`
+	SuccessRate     float64   `json:"successRate"`
+}
+
+// ListServerEntries returns a description of each stored server entry,
+// including its region, supported tunnel protocols, and last known
+// connection status. ListServerEntries is intended to support diagnosing
+// connection failures.
+//
+// The list is read in a single read-only datastore transaction, so it's a
+// consistent snapshot, and doesn't block concurrent server entry selection
+// or updates.
+func ListServerEntries(config *Config) ([]*ServerEntryInfo, error) {
+	checkInitDataStore()
+
+	decayWindow := config.clientParameters.Get().Duration(
+		parameters.ServerEntryPerformanceDecayWindow)
+
+	includeIPAddress := GetEmitDiagnoticNotices()
+
+	now := time.Now()
+
+	var infos []*ServerEntryInfo
+
+	performance := getServerEntryPerformance(config)
+
+	err := singleton.db.View(func(tx *bolt.Tx) error {
+
+		bucket := tx.Bucket([]byte(serverEntriesBucket))
+		cursor := bucket.Cursor()
+
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			serverEntry := new(protocol.ServerEntry)
+			err := json.Unmarshal(value, serverEntry)
+			if err != nil {
+				// In case of data corruption or a bug causing this condition,
+				// do not stop iterating.
+				config.notices.Alert("ListServerEntries: %s", common.ContextError(err))
+				continue
+			}
+
+			info := &ServerEntryInfo{
+				Region:    serverEntry.Region,
+				Protocols: serverEntry.GetSupportedProtocols(nil, nil, false),
+				Status:    SERVER_ENTRY_STATUS_UNKNOWN,
+			}
+
+			if includeIPAddress {
+				info.IPAddress = serverEntry.IpAddress
+			}
+
+			if p, ok := performance[serverEntry.IpAddress]; ok && p.Attempts > 0 {
+				if p.LastSuccess {
+					info.Status = SERVER_ENTRY_STATUS_SUCCEEDED
+				} else {
+					info.Status = SERVER_ENTRY_STATUS_FAILED
+				}
+				info.LastAttemptTime = p.LastUpdate
+				decayed := *p
+				decayed.decay(now, decayWindow)
+				info.SuccessRate = decayed.Successes / decayed.Attempts
+			}
+
+			infos = append(infos, info)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return infos, nil
 }
 
 // GetServerEntryIpAddresses returns an array containing
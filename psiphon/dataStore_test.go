@@ -0,0 +1,253 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestEgressRegion(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-egress-region-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	singleton = dataStore{}
+	os.Remove(filepath.Join(testDataDirName, DATA_STORE_FILENAME))
+
+	err = InitDataStore(&Config{DataStoreDirectory: testDataDirName})
+	if err != nil {
+		t.Fatalf("InitDataStore failed: %s", err)
+	}
+
+	regions := []string{"US", "CA", "CA", "DE", ""}
+	for i, region := range regions {
+		err := StoreServerEntry(
+			&protocol.ServerEntry{
+				IpAddress: fmt.Sprintf("192.0.2.%d", i),
+				Region:    region,
+				Capabilities: []string{
+					protocol.GetCapability(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH)},
+			},
+			true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	makeConfig := func(egressRegion string) *Config {
+		config, err := LoadConfig([]byte(fmt.Sprintf(`
+	    {
+	        "PropagationChannelId" : "0",
+	        "SponsorId" : "0",
+	        "DataStoreDirectory" : "%s",
+	        "EgressRegion" : "%s"
+	    }`, testDataDirName, egressRegion)))
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %s", err)
+		}
+		return config
+	}
+
+	availableRegions, err := GetAvailableEgressRegions(makeConfig(""))
+	if err != nil {
+		t.Fatalf("GetAvailableEgressRegions failed: %s", err)
+	}
+	if !reflect.DeepEqual(availableRegions, []string{"CA", "DE", "US"}) {
+		t.Fatalf("unexpected available regions: %+v", availableRegions)
+	}
+
+	unavailableRegions := make(chan string, 1)
+	SetNoticeCallback(func(noticeType string, data map[string]interface{}) {
+		if noticeType == "EgressRegionUnavailable" {
+			unavailableRegions <- data["region"].(string)
+		}
+	})
+	defer SetNoticeCallback(nil)
+
+	for _, testCase := range []struct {
+		egressRegion  string
+		expectedCount int
+	}{
+		{"", len(regions)},
+		{"CA", 2},
+		{"US", 1},
+		{"GB", 0},
+	} {
+
+		_, iterator, err := NewServerEntryIterator(makeConfig(testCase.egressRegion))
+		if err != nil {
+			t.Fatalf("NewServerEntryIterator failed: %s", err)
+		}
+
+		count := 0
+		for {
+			serverEntry, err := iterator.Next()
+			if err != nil {
+				t.Fatalf("Next failed: %s", err)
+			}
+			if serverEntry == nil {
+				break
+			}
+			if testCase.egressRegion != "" && serverEntry.Region != testCase.egressRegion {
+				t.Fatalf("unexpected region: %s", serverEntry.Region)
+			}
+			count++
+		}
+		iterator.Close()
+
+		if count != testCase.expectedCount {
+			t.Fatalf("unexpected server entry count for %s: %d",
+				testCase.egressRegion, count)
+		}
+	}
+
+	select {
+	case region := <-unavailableRegions:
+		if region != "GB" {
+			t.Fatalf("unexpected unavailable region: %s", region)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("missing EgressRegionUnavailable notice")
+	}
+
+	_, err = LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "EgressRegion" : "ca"
+    }`))
+	if err == nil {
+		t.Fatalf("LoadConfig unexpectedly accepted invalid EgressRegion")
+	}
+}
+
+func TestListServerEntries(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-list-server-entries-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	singleton = dataStore{}
+
+	err = InitDataStore(&Config{DataStoreDirectory: testDataDirName})
+	if err != nil {
+		t.Fatalf("InitDataStore failed: %s", err)
+	}
+
+	config, err := LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "DataStoreDirectory" : "` + testDataDirName + `"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	for i, region := range []string{"CA", "DE", "US"} {
+		err := StoreServerEntry(
+			&protocol.ServerEntry{
+				IpAddress: fmt.Sprintf("192.0.2.%d", i),
+				Region:    region,
+				Capabilities: []string{
+					protocol.GetCapability(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH)},
+			},
+			true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	err = RecordServerEntryPerformance(config, "192.0.2.0", true, time.Second)
+	if err != nil {
+		t.Fatalf("RecordServerEntryPerformance failed: %s", err)
+	}
+
+	err = RecordServerEntryPerformance(config, "192.0.2.1", true, time.Second)
+	if err != nil {
+		t.Fatalf("RecordServerEntryPerformance failed: %s", err)
+	}
+
+	err = RecordServerEntryPerformance(config, "192.0.2.1", false, 0)
+	if err != nil {
+		t.Fatalf("RecordServerEntryPerformance failed: %s", err)
+	}
+
+	for _, emitDiagnosticNotices := range []bool{false, true} {
+
+		SetEmitDiagnosticNotices(emitDiagnosticNotices)
+
+		infos, err := ListServerEntries(config)
+		if err != nil {
+			t.Fatalf("ListServerEntries failed: %s", err)
+		}
+
+		if len(infos) != 3 {
+			t.Fatalf("unexpected server entry count: %d", len(infos))
+		}
+
+		expectedStatuses := map[string]string{
+			"CA": SERVER_ENTRY_STATUS_SUCCEEDED,
+			"DE": SERVER_ENTRY_STATUS_FAILED,
+			"US": SERVER_ENTRY_STATUS_UNKNOWN,
+		}
+
+		for _, info := range infos {
+
+			if (info.IPAddress != "") != emitDiagnosticNotices {
+				t.Fatalf("unexpected IP address: %s", info.IPAddress)
+			}
+
+			if !reflect.DeepEqual(
+				info.Protocols, []string{protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH}) {
+				t.Fatalf("unexpected protocols: %+v", info.Protocols)
+			}
+
+			if info.Status != expectedStatuses[info.Region] {
+				t.Fatalf("unexpected status for %s: %s", info.Region, info.Status)
+			}
+
+			if info.Region == "DE" && (info.SuccessRate <= 0.4 || info.SuccessRate >= 0.6) {
+				t.Fatalf("unexpected success rate: %f", info.SuccessRate)
+			}
+		}
+	}
+
+	SetEmitDiagnosticNotices(false)
+}
@@ -0,0 +1,28 @@
+// +build DIAGNOSTICS
+
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+// diagnosticsBuild indicates that this is a diagnostics build, built with
+// the DIAGNOSTICS tag. Diagnostics builds enable features, such as
+// UpgradeDownloadUntunneledDiagnostic, that are not to be used in
+// production.
+const diagnosticsBuild = true
@@ -0,0 +1,60 @@
+// +build android linux darwin
+
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"syscall"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// getAvailableDiskSpace returns the number of bytes available to an
+// unprivileged user on the filesystem containing path.
+func getAvailableDiskSpace(path string) (int64, error) {
+
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// isSameFilesystem returns whether path1 and path2 are on the same
+// filesystem.
+func isSameFilesystem(path1, path2 string) (bool, error) {
+
+	var stat1, stat2 syscall.Stat_t
+
+	err := syscall.Stat(path1, &stat1)
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+
+	err = syscall.Stat(path2, &stat2)
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+
+	return stat1.Dev == stat2.Dev, nil
+}
@@ -0,0 +1,34 @@
+// +build !android,!linux,!darwin
+
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+// getAvailableDiskSpace is not supported on this platform, and
+// always returns errDiskSpaceUnsupported.
+func getAvailableDiskSpace(_ string) (int64, error) {
+	return 0, errDiskSpaceUnsupported
+}
+
+// isSameFilesystem is not supported on this platform, and always returns
+// errDiskSpaceUnsupported.
+func isSameFilesystem(_, _ string) (bool, error) {
+	return false, errDiskSpaceUnsupported
+}
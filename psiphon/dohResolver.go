@@ -0,0 +1,254 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Inc/dns"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	bootstrapDohTimeout         = 10 * time.Second
+	bootstrapDohMaxCacheTTL     = 1 * time.Minute
+	bootstrapDohMaxResponseSize = 65535
+	dohMediaType                = "application/dns-message"
+)
+
+type bootstrapDohCacheEntry struct {
+	ips    []net.IP
+	expiry time.Time
+}
+
+// bootstrapDohCache caches successful bootstrap DoH lookups for the lesser
+// of the record TTL and bootstrapDohMaxCacheTTL.
+var bootstrapDohCache = struct {
+	mutex   sync.Mutex
+	entries map[string]bootstrapDohCacheEntry
+}{
+	entries: make(map[string]bootstrapDohCacheEntry),
+}
+
+// bootstrapDohLookupIP resolves host using the DNS-over-HTTPS (RFC 8484)
+// resolver at config.BootstrapDohUrl. This is used for untunneled lookups,
+// such as for meek fronts and remote server list hosts, in networks where
+// the system resolver is subject to tampering.
+//
+// The DoH request is made with a direct connection, using the system
+// resolver to resolve the DoH server host, so BootstrapDohUrl should
+// normally specify an IP address host.
+func bootstrapDohLookupIP(
+	ctx context.Context, host string, config *DialConfig) ([]net.IP, error) {
+
+	cacheKey := config.BootstrapDohUrl + " " + host
+
+	bootstrapDohCache.mutex.Lock()
+	entry, ok := bootstrapDohCache.entries[cacheKey]
+	if ok && time.Now().Before(entry.expiry) {
+		bootstrapDohCache.mutex.Unlock()
+		return append([]net.IP(nil), entry.ips...), nil
+	}
+	delete(bootstrapDohCache.entries, cacheKey)
+	bootstrapDohCache.mutex.Unlock()
+
+	ctx, cancelFunc := context.WithTimeout(ctx, bootstrapDohTimeout)
+	defer cancelFunc()
+
+	httpClient, err := makeBootstrapDohHTTPClient(config)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	queryTypes := []uint16{dns.TypeA}
+	if config.IPAddressFamilyPreference != "" {
+		queryTypes = append(queryTypes, dns.TypeAAAA)
+	}
+
+	var ips []net.IP
+	ttl := bootstrapDohMaxCacheTTL
+
+	for _, queryType := range queryTypes {
+		answerIPs, answerTTL, err := dohQuery(
+			ctx, httpClient, config.BootstrapDohUrl, host, queryType)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		ips = append(ips, answerIPs...)
+		if answerTTL < ttl {
+			ttl = answerTTL
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, common.ContextError(errors.New("empty address list"))
+	}
+
+	bootstrapDohCache.mutex.Lock()
+	bootstrapDohCache.entries[cacheKey] = bootstrapDohCacheEntry{
+		ips:    append([]net.IP(nil), ips...),
+		expiry: time.Now().Add(ttl),
+	}
+	bootstrapDohCache.mutex.Unlock()
+
+	return ips, nil
+}
+
+// makeBootstrapDohHTTPClient creates an HTTP client which dials the DoH
+// server directly, with the same device binding as other untunneled dials.
+// When config.TrustedCACertificatesFilename is set, those CAs are used to
+// verify the DoH server certificate.
+func makeBootstrapDohHTTPClient(config *DialConfig) (*http.Client, error) {
+
+	// The DoH server dial must not itself use the DoH resolver.
+	dohDialConfig := *config
+	dohDialConfig.BootstrapDohUrl = ""
+
+	tlsConfig := &tls.Config{}
+	if config.TrustedCACertificatesFilename != "" {
+		certs, err := ioutil.ReadFile(config.TrustedCACertificatesFilename)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(certs) {
+			return nil, common.ContextError(errors.New("no trusted CA certificates"))
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return DialTCP(ctx, addr, &dohDialConfig)
+		},
+		TLSClientConfig:   tlsConfig,
+		DisableKeepAlives: true,
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// dohQuery makes a single RFC 8484 GET request and returns the A or AAAA
+// answers and the minimum answer TTL. The response is validated: it must be
+// a successful DNS response to the query that was sent.
+func dohQuery(
+	ctx context.Context,
+	httpClient *http.Client,
+	dohURL, host string,
+	queryType uint16) ([]net.IP, time.Duration, error) {
+
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(host), queryType)
+	query.RecursionDesired = true
+
+	// RFC 8484 recommends a DNS ID of 0 for cache friendliness.
+	query.Id = 0
+
+	packedQuery, err := query.Pack()
+	if err != nil {
+		return nil, 0, common.ContextError(err)
+	}
+
+	requestURL, err := url.Parse(dohURL)
+	if err != nil {
+		return nil, 0, common.ContextError(err)
+	}
+	values := requestURL.Query()
+	values.Set("dns", base64.RawURLEncoding.EncodeToString(packedQuery))
+	requestURL.RawQuery = values.Encode()
+
+	request, err := http.NewRequest("GET", requestURL.String(), nil)
+	if err != nil {
+		return nil, 0, common.ContextError(err)
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Accept", dohMediaType)
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, 0, common.ContextError(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, 0, common.ContextError(
+			fmt.Errorf("unexpected response status code: %d", response.StatusCode))
+	}
+
+	if !strings.HasPrefix(response.Header.Get("Content-Type"), dohMediaType) {
+		return nil, 0, common.ContextError(
+			fmt.Errorf("unexpected response content type: %s", response.Header.Get("Content-Type")))
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, bootstrapDohMaxResponseSize))
+	if err != nil {
+		return nil, 0, common.ContextError(err)
+	}
+
+	answer := new(dns.Msg)
+	err = answer.Unpack(body)
+	if err != nil {
+		return nil, 0, common.ContextError(err)
+	}
+
+	if !answer.Response ||
+		answer.Id != query.Id ||
+		answer.Rcode != dns.RcodeSuccess ||
+		len(answer.Question) != 1 ||
+		!strings.EqualFold(answer.Question[0].Name, query.Question[0].Name) ||
+		answer.Question[0].Qtype != queryType {
+		return nil, 0, common.ContextError(errors.New("invalid DNS response"))
+	}
+
+	var ips []net.IP
+	ttl := bootstrapDohMaxCacheTTL
+
+	for _, record := range answer.Answer {
+		var ip net.IP
+		switch r := record.(type) {
+		case *dns.A:
+			ip = r.A
+		case *dns.AAAA:
+			ip = r.AAAA
+		default:
+			continue
+		}
+		ips = append(ips, ip)
+		recordTTL := time.Duration(record.Header().Ttl) * time.Second
+		if recordTTL < ttl {
+			ttl = recordTTL
+		}
+	}
+
+	return ips, ttl, nil
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Psiphon-Inc/dns"
+)
+
+func TestBootstrapDohLookupIP(t *testing.T) {
+
+	expectedIP := net.ParseIP("192.0.2.1")
+	var requestCount int32
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			atomic.AddInt32(&requestCount, 1)
+
+			packedQuery, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			query := new(dns.Msg)
+			err = query.Unpack(packedQuery)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			answer := new(dns.Msg)
+			answer.SetReply(query)
+			if query.Question[0].Qtype == dns.TypeA {
+				answer.Answer = append(answer.Answer, &dns.A{
+					Hdr: dns.RR_Header{
+						Name:   query.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    60,
+					},
+					A: expectedIP,
+				})
+			}
+			packedAnswer, err := answer.Pack()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", dohMediaType)
+			w.Write(packedAnswer)
+		}))
+	defer server.Close()
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-doh-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	certFilename := filepath.Join(testDataDirName, "ca.pem")
+	err = ioutil.WriteFile(
+		certFilename,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}),
+		0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	config := &DialConfig{
+		BootstrapDohUrl:               server.URL + "/dns-query",
+		TrustedCACertificatesFilename: certFilename,
+	}
+
+	for i := 0; i < 2; i++ {
+		ips, err := LookupIP(context.Background(), "doh-test.example.com", config)
+		if err != nil {
+			t.Fatalf("LookupIP failed: %s", err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(expectedIP) {
+			t.Fatalf("unexpected IPs: %v", ips)
+		}
+	}
+
+	// The second lookup is expected to be served from the cache.
+	if atomic.LoadInt32(&requestCount) != 1 {
+		t.Fatalf("unexpected DoH request count: %d", requestCount)
+	}
+
+	// When the DoH resolver is unreachable, resolution falls back to the
+	// system resolver.
+	config.BootstrapDohUrl = "https://127.0.0.1:1/dns-query"
+
+	ips, err := LookupIP(context.Background(), "localhost", config)
+	if err != nil {
+		t.Fatalf("LookupIP failed: %s", err)
+	}
+	if len(ips) == 0 || !ips[0].IsLoopback() {
+		t.Fatalf("unexpected IPs: %v", ips)
+	}
+}
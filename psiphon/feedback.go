@@ -40,6 +40,7 @@ import (
 	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 )
 
 const (
@@ -114,6 +115,9 @@ func SendFeedback(configJson, diagnosticsJson, b64EncodedPublicKey, uploadServer
 		CustomHeaders:                 config.CustomHeaders,
 		DeviceBinder:                  nil,
 		IPv6Synthesizer:               nil,
+		IPAddressFamilyPreference:     config.IPAddressFamilyPreference,
+		SocketFwmark:                  config.TunnelSocketFwmark,
+		BootstrapDohUrl:               config.BootstrapDohUrl,
 		DnsServerGetter:               nil,
 		UseIndistinguishableTLS:       config.UseIndistinguishableTLS,
 		TrustedCACertificatesFilename: config.TrustedCACertificatesFilename,
@@ -156,6 +160,81 @@ func SendFeedback(configJson, diagnosticsJson, b64EncodedPublicKey, uploadServer
 	return err
 }
 
+// SendTunneledFeedback encrypts payload to config.FeedbackEncryptionPublicKey
+// and uploads it to config.FeedbackUploadUrl through the specified tunnel.
+// The payload is encrypted in the same format as SendFeedback.
+//
+// As with upgrade downloads, each upload attempt is limited by
+// FetchUpgradeTimeout and failed attempts are retried, up to
+// FEEDBACK_UPLOAD_MAX_RETRIES attempts in total, after waiting
+// FetchUpgradeRetryPeriod. A FeedbackUploaded or FeedbackUploadFailed notice
+// is emitted with the outcome.
+func SendTunneledFeedback(config *Config, tunnel *Tunnel, payload []byte) error {
+
+	client, err := MakeTunneledHTTPClient(config, tunnel, false)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return sendFeedbackWithClient(config, client, payload)
+}
+
+// sendFeedbackWithClient implements SendTunneledFeedback using the specified
+// HTTP client.
+func sendFeedbackWithClient(config *Config, client *http.Client, payload []byte) error {
+
+	client = withCustomHeaders(client, config.FeedbackUploadHeaders)
+
+	err := uploadFeedbackWithRetries(config, client, payload)
+	if err != nil {
+		NoticeFeedbackUploadFailed(err)
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+func uploadFeedbackWithRetries(config *Config, client *http.Client, payload []byte) error {
+
+	if config.FeedbackUploadUrl == "" || config.FeedbackEncryptionPublicKey == "" {
+		return common.ContextError(errors.New("feedback upload not configured"))
+	}
+
+	secureFeedback, err := encryptFeedback(string(payload), config.FeedbackEncryptionPublicKey)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	randBytes, err := common.MakeSecureRandomBytes(8)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	uploadId := hex.EncodeToString(randBytes)
+
+	url := config.FeedbackUploadUrl + uploadId
+
+	for i := 0; ; i++ {
+
+		err = putFeedback(client, secureFeedback, url, MakePsiphonUserAgent(config), nil)
+		if err == nil {
+			break
+		}
+
+		if i+1 >= FEEDBACK_UPLOAD_MAX_RETRIES {
+			return common.ContextError(err)
+		}
+
+		NoticeAlert("failed to upload feedback: %s", err)
+
+		time.Sleep(config.clientParameters.Get().Duration(
+			parameters.FetchUpgradeRetryPeriod))
+	}
+
+	NoticeFeedbackUploaded(uploadId)
+
+	return nil
+}
+
 // Attempt to upload feedback data to server.
 func uploadFeedback(
 	config *Config, dialConfig *DialConfig, feedbackData []byte, url, userAgent string, headerPieces []string) error {
@@ -175,6 +254,16 @@ func uploadFeedback(
 		return err
 	}
 
+	client = withCustomHeaders(client, config.FeedbackUploadHeaders)
+
+	return putFeedback(client, feedbackData, url, userAgent, headerPieces)
+}
+
+// putFeedback makes a single feedback upload request. headerPieces, when not
+// nil, is an additional header name and value.
+func putFeedback(
+	client *http.Client, feedbackData []byte, url, userAgent string, headerPieces []string) error {
+
 	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(feedbackData))
 	if err != nil {
 		return common.ContextError(err)
@@ -182,7 +271,9 @@ func uploadFeedback(
 
 	req.Header.Set("User-Agent", userAgent)
 
-	req.Header.Set(headerPieces[0], headerPieces[1])
+	if headerPieces != nil {
+		req.Header.Set(headerPieces[0], headerPieces[1])
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -20,8 +20,23 @@
 package psiphon
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 )
 
@@ -79,3 +94,143 @@ func TestFeedbackUpload(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestSendTunneledFeedback(t *testing.T) {
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %s", err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey failed: %s", err)
+	}
+
+	payload := []byte(`{"Feedback":{"Message":{"text":"test feedback"}}}`)
+
+	var requestCount, failCount int32
+	uploads := make(chan []byte, FEEDBACK_UPLOAD_MAX_RETRIES)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requestCount, 1)
+			if r.Method != "PUT" || !strings.HasPrefix(r.URL.Path, "/feedback/") {
+				http.Error(w, "unexpected request", http.StatusBadRequest)
+				return
+			}
+			if r.Header.Get("Authorization") != "Bearer token" {
+				http.Error(w, "missing header", http.StatusUnauthorized)
+				return
+			}
+			if atomic.AddInt32(&failCount, -1) >= 0 {
+				http.Error(w, "upload failed", http.StatusInternalServerError)
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			uploads <- body
+		}))
+	defer server.Close()
+
+	configJSON := fmt.Sprintf(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "FetchUpgradeRetryPeriodMilliseconds" : 1,
+        "FeedbackUploadUrl" : "%s/feedback/",
+        "FeedbackEncryptionPublicKey" : "%s",
+        "FeedbackUploadHeaders" : {"Authorization" : ["Bearer token"]}
+    }`, server.URL, base64.StdEncoding.EncodeToString(publicKey))
+
+	config, err := LoadConfig([]byte(configJSON))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	// The first attempt fails and the upload is retried.
+
+	atomic.StoreInt32(&failCount, 1)
+
+	err = sendFeedbackWithClient(config, server.Client(), payload)
+	if err != nil {
+		t.Fatalf("sendFeedbackWithClient failed: %s", err)
+	}
+
+	if atomic.LoadInt32(&requestCount) != 2 {
+		t.Fatalf("unexpected request count: %d", requestCount)
+	}
+
+	plaintext, err := decryptTestFeedback(<-uploads, privateKey)
+	if err != nil {
+		t.Fatalf("decryptTestFeedback failed: %s", err)
+	}
+	if !bytes.Equal(plaintext, payload) {
+		t.Fatalf("unexpected plaintext: %s", plaintext)
+	}
+
+	// All attempts fail.
+
+	atomic.StoreInt32(&requestCount, 0)
+	atomic.StoreInt32(&failCount, FEEDBACK_UPLOAD_MAX_RETRIES)
+
+	err = sendFeedbackWithClient(config, server.Client(), payload)
+	if err == nil {
+		t.Fatalf("unexpected sendFeedbackWithClient success")
+	}
+
+	if atomic.LoadInt32(&requestCount) != FEEDBACK_UPLOAD_MAX_RETRIES {
+		t.Fatalf("unexpected request count: %d", requestCount)
+	}
+}
+
+// decryptTestFeedback reverses encryptFeedback, verifying the MAC.
+func decryptTestFeedback(data []byte, privateKey *rsa.PrivateKey) ([]byte, error) {
+
+	var feedback secureFeedback
+	err := json.Unmarshal(data, &feedback)
+	if err != nil {
+		return nil, err
+	}
+
+	decode := func(s string) []byte {
+		b, _ := base64.StdEncoding.DecodeString(s)
+		return b
+	}
+
+	encryptionKey, err := rsa.DecryptOAEP(
+		sha1.New(), nil, privateKey, decode(feedback.WrappedEncryptionKey), nil)
+	if err != nil {
+		return nil, err
+	}
+	macKey, err := rsa.DecryptOAEP(
+		sha1.New(), nil, privateKey, decode(feedback.WrappedMacKey), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := decode(feedback.IV)
+	ciphertext := decode(feedback.ContentCipherText)
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	if !hmac.Equal(mac.Sum(nil), decode(feedback.ContentMac)) {
+		return nil, fmt.Errorf("invalid MAC")
+	}
+
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("invalid ciphertext length")
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+
+	paddingLen := int(plaintext[len(plaintext)-1])
+	if paddingLen == 0 || paddingLen > aes.BlockSize {
+		return nil, fmt.Errorf("invalid padding")
+	}
+
+	return plaintext[:len(plaintext)-paddingLen], nil
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// HealthCheckStatus is the JSON response body of the health check endpoint.
+type HealthCheckStatus struct {
+	Tunnels           int      `json:"tunnels"`
+	EgressRegion      string   `json:"egressRegion"`
+	ServerRegions     []string `json:"serverRegions"`
+	LastHandshakeTime string   `json:"lastHandshakeTime,omitempty"`
+}
+
+// HealthCheckServer is a local HTTP server which reports tunnel liveness,
+// for use as, e.g., a Kubernetes readiness probe. Any request receives a
+// 200 response when at least one tunnel is established and a 503 response
+// otherwise, each with a HealthCheckStatus body.
+//
+// The health check server is served directly on its local listener and
+// makes no outbound connections, so it never routes through the tunnel.
+type HealthCheckServer struct {
+	controller     *Controller
+	listener       net.Listener
+	serveWaitGroup *sync.WaitGroup
+}
+
+// NewHealthCheckServer starts a health check server listening on
+// config.HealthCheckAddress.
+func NewHealthCheckServer(controller *Controller) (*HealthCheckServer, error) {
+
+	listener, err := net.Listen("tcp", controller.config.HealthCheckAddress)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	server := &HealthCheckServer{
+		controller:     controller,
+		listener:       listener,
+		serveWaitGroup: new(sync.WaitGroup),
+	}
+
+	httpServer := &http.Server{
+		Handler:      server,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	server.serveWaitGroup.Add(1)
+	go func() {
+		defer server.serveWaitGroup.Done()
+		// Serve returns an error when the listener is closed.
+		httpServer.Serve(listener)
+	}()
+
+	controller.notices.ListeningHealthCheck(listener.Addr().String())
+
+	return server, nil
+}
+
+// Close stops the health check server.
+func (server *HealthCheckServer) Close() {
+	server.listener.Close()
+	server.serveWaitGroup.Wait()
+}
+
+func (server *HealthCheckServer) ServeHTTP(
+	responseWriter http.ResponseWriter, _ *http.Request) {
+
+	status := server.controller.getHealthCheckStatus()
+
+	body, err := json.Marshal(status)
+	if err != nil {
+		http.Error(responseWriter, "", http.StatusInternalServerError)
+		return
+	}
+
+	statusCode := http.StatusOK
+	if status.Tunnels == 0 {
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.Header().Set("Cache-Control", "no-store")
+	responseWriter.WriteHeader(statusCode)
+	responseWriter.Write(body)
+}
+
+// getHealthCheckStatus summarizes the currently established tunnels.
+func (controller *Controller) getHealthCheckStatus() *HealthCheckStatus {
+
+	controller.tunnelMutex.Lock()
+	lastHandshakeTime := controller.lastHandshakeTime
+	controller.tunnelMutex.Unlock()
+
+	tunnels := controller.tunnelPool.Tunnels()
+
+	status := &HealthCheckStatus{
+		Tunnels:       len(tunnels),
+		EgressRegion:  controller.config.EgressRegion,
+		ServerRegions: make([]string, 0, len(tunnels)),
+	}
+
+	for _, tunnel := range tunnels {
+		status.ServerRegions = append(status.ServerRegions, tunnel.serverEntry.Region)
+	}
+
+	if !lastHandshakeTime.IsZero() {
+		status.LastHandshakeTime = lastHandshakeTime.UTC().Format(time.RFC3339)
+	}
+
+	return status
+}
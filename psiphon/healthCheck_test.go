@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestHealthCheckServer(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	config, err := LoadConfig([]byte(`
+		{
+			"PropagationChannelId" : "0",
+			"SponsorId" : "0",
+			"EgressRegion" : "CA",
+			"HealthCheckAddress" : "127.0.0.1:0"
+		}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	controller := &Controller{
+		config:     config,
+		tunnelPool: NewTunnelPool(1, TUNNEL_POOL_SELECTION_ROUND_ROBIN),
+	}
+
+	server, err := NewHealthCheckServer(controller)
+	if err != nil {
+		t.Fatalf("NewHealthCheckServer failed: %s", err)
+	}
+	defer server.Close()
+
+	check := func() (int, *HealthCheckStatus) {
+		response, err := http.Get("http://" + server.listener.Addr().String() + "/")
+		if err != nil {
+			t.Fatalf("http.Get failed: %s", err)
+		}
+		defer response.Body.Close()
+		var status HealthCheckStatus
+		err = json.NewDecoder(response.Body).Decode(&status)
+		if err != nil {
+			t.Fatalf("Decode failed: %s", err)
+		}
+		return response.StatusCode, &status
+	}
+
+	// Unhealthy: no tunnels.
+
+	statusCode, status := check()
+
+	if statusCode != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status code: %d", statusCode)
+	}
+
+	expectedStatus := &HealthCheckStatus{
+		Tunnels:       0,
+		EgressRegion:  "CA",
+		ServerRegions: []string{},
+	}
+
+	if !reflect.DeepEqual(status, expectedStatus) {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	// Healthy: one established tunnel.
+
+	handshakeTime := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	controller.tunnelPool.add(&Tunnel{
+		mutex: new(sync.Mutex),
+		serverEntry: &protocol.ServerEntry{
+			IpAddress: "192.0.2.1",
+			Region:    "CA",
+		},
+		openPortForwards: make(map[*TunneledConn]bool),
+	})
+	controller.lastHandshakeTime = handshakeTime
+
+	statusCode, status = check()
+
+	if statusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", statusCode)
+	}
+
+	expectedStatus = &HealthCheckStatus{
+		Tunnels:           1,
+		EgressRegion:      "CA",
+		ServerRegions:     []string{"CA"},
+		LastHandshakeTime: "2018-06-01T12:00:00Z",
+	}
+
+	if !reflect.DeepEqual(status, expectedStatus) {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
@@ -85,9 +85,12 @@ type HttpProxy struct {
 	urlProxyDirectClient   *http.Client
 	responseHeaderTimeout  time.Duration
 	openConns              *common.Conns
+	portForwardLimiter     *portForwardLimiter
+	portForwardIdleTimeout time.Duration
 	stopListeningBroadcast chan struct{}
 	listenIP               string
 	listenPort             int
+	notices                *noticeLogger
 }
 
 var _HTTP_PROXY_TYPE = "HTTP"
@@ -98,20 +101,33 @@ func NewHttpProxy(
 	tunneler Tunneler,
 	listenIP string) (proxy *HttpProxy, err error) {
 
-	listener, err := net.Listen(
-		"tcp", fmt.Sprintf("%s:%d", listenIP, config.LocalHttpProxyPort))
+	// config.LocalHttpProxyAddress, when set, overrides listenIP and
+	// config.LocalHttpProxyPort.
+	listenAddress := config.LocalHttpProxyAddress
+	if listenAddress == "" {
+		listenAddress = net.JoinHostPort(
+			listenIP, strconv.Itoa(config.LocalHttpProxyPort))
+	}
+
+	listener, err := net.Listen("tcp", listenAddress)
 	if err != nil {
 		if IsAddressInUseError(err) {
-			NoticeHttpProxyPortInUse(config.LocalHttpProxyPort)
+			_, portString, _ := net.SplitHostPort(listenAddress)
+			port, _ := strconv.Atoi(portString)
+			config.notices.HttpProxyPortInUse(port)
 		}
 		return nil, common.ContextError(err)
 	}
 
+	portForwardLimiter := newPortForwardLimiter(config, _HTTP_PROXY_TYPE)
+
 	tunneledDialer := func(_, addr string) (conn net.Conn, err error) {
 		// downstreamConn is not set in this case, as there is not a fixed
 		// association between a downstream client connection and a particular
 		// tunnel.
-		return tunneler.Dial(addr, false, nil)
+		return portForwardLimiter.dial(
+			addr,
+			func() (net.Conn, error) { return tunneler.Dial(addr, false, nil) })
 	}
 	directDialer := func(_, addr string) (conn net.Conn, err error) {
 		return tunneler.DirectDial(addr)
@@ -123,6 +139,9 @@ func NewHttpProxy(
 	maxIdleConnsPerHost := config.clientParameters.Get().Int(
 		parameters.HTTPProxyMaxIdleConnectionsPerHost)
 
+	portForwardIdleTimeout := config.clientParameters.Get().Duration(
+		parameters.PortForwardIdleTimeout)
+
 	// TODO: could HTTP proxy share a tunneled transport with URL proxy?
 	// For now, keeping them distinct just to be conservative.
 	httpProxyTunneledRelay := &http.Transport{
@@ -173,9 +192,12 @@ func NewHttpProxy(
 		urlProxyDirectClient:   urlProxyDirectClient,
 		responseHeaderTimeout:  responseHeaderTimeout,
 		openConns:              new(common.Conns),
+		portForwardLimiter:     portForwardLimiter,
+		portForwardIdleTimeout: portForwardIdleTimeout,
 		stopListeningBroadcast: make(chan struct{}),
 		listenIP:               proxyIP,
 		listenPort:             proxyPort,
+		notices:                config.notices,
 	}
 	proxy.serveWaitGroup.Add(1)
 	go proxy.serve()
@@ -191,7 +213,7 @@ func NewHttpProxy(
 	// NoticeListeningHttpProxyPort after that call.
 	// Also, check the listen backlog queue length -- shouldn't it be possible
 	// to enqueue pending connections between net.Listen() and httpServer.Serve()?
-	NoticeListeningHttpProxyPort(proxy.listenPort)
+	proxy.notices.ListeningHttpProxyPort(proxy.listenPort, listener.Addr().String())
 
 	return proxy, nil
 }
@@ -228,7 +250,7 @@ func (proxy *HttpProxy) Close() {
 //
 func (proxy *HttpProxy) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
 	if request.Method == "CONNECT" {
-		conn := hijack(responseWriter)
+		conn := proxy.hijack(responseWriter)
 		if conn == nil {
 			// hijack emits an alert notice
 			http.Error(responseWriter, "", http.StatusInternalServerError)
@@ -237,7 +259,7 @@ func (proxy *HttpProxy) ServeHTTP(responseWriter http.ResponseWriter, request *h
 		go func() {
 			err := proxy.httpConnectHandler(conn, request.URL.Host)
 			if err != nil {
-				NoticeAlert("%s", common.ContextError(err))
+				proxy.notices.Alert("%s", common.ContextError(err))
 			}
 		}()
 	} else if request.URL.IsAbs() {
@@ -254,7 +276,17 @@ func (proxy *HttpProxy) httpConnectHandler(localConn net.Conn, target string) (e
 	// Setting downstreamConn so localConn.Close() will be called when remoteConn.Close() is called.
 	// This ensures that the downstream client (e.g., web browser) doesn't keep waiting on the
 	// open connection for data which will never arrive.
-	remoteConn, err := proxy.tunneler.Dial(target, false, localConn)
+	remoteConn, err := proxy.portForwardLimiter.dial(
+		target,
+		func() (net.Conn, error) { return proxy.tunneler.Dial(target, false, localConn) })
+	if err == errPortForwardLimitExceeded {
+		_, err = localConn.Write([]byte("HTTP/1.1 429 Too Many Requests\r\n\r\n"))
+		return common.ContextError(err)
+	}
+	if err == ErrConnectionRejected {
+		_, err = localConn.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\n"))
+		return common.ContextError(err)
+	}
 	if err != nil {
 		return common.ContextError(err)
 	}
@@ -263,7 +295,7 @@ func (proxy *HttpProxy) httpConnectHandler(localConn net.Conn, target string) (e
 	if err != nil {
 		return common.ContextError(err)
 	}
-	LocalProxyRelay(_HTTP_PROXY_TYPE, localConn, remoteConn)
+	localProxyRelay(proxy.notices, _HTTP_PROXY_TYPE, proxy.portForwardIdleTimeout, localConn, remoteConn)
 	return nil
 }
 
@@ -311,21 +343,21 @@ func (proxy *HttpProxy) urlProxyHandler(responseWriter http.ResponseWriter, requ
 		err = errors.New("missing origin URL")
 	}
 	if err != nil {
-		NoticeAlert("%s", common.ContextError(FilterUrlError(err)))
-		forceClose(responseWriter)
+		proxy.notices.Alert("%s", common.ContextError(FilterUrlError(err)))
+		proxy.forceClose(responseWriter)
 		return
 	}
 
 	// Origin URL must be well-formed, absolute, and have a scheme of "http" or "https"
 	originURL, err := url.ParseRequestURI(originURLString)
 	if err != nil {
-		NoticeAlert("%s", common.ContextError(FilterUrlError(err)))
-		forceClose(responseWriter)
+		proxy.notices.Alert("%s", common.ContextError(FilterUrlError(err)))
+		proxy.forceClose(responseWriter)
 		return
 	}
 	if !originURL.IsAbs() || (originURL.Scheme != "http" && originURL.Scheme != "https") {
-		NoticeAlert("invalid origin URL")
-		forceClose(responseWriter)
+		proxy.notices.Alert("invalid origin URL")
+		proxy.forceClose(responseWriter)
 		return
 	}
 
@@ -498,8 +530,8 @@ func (proxy *HttpProxy) relayHTTPRequest(
 	}
 
 	if err != nil {
-		NoticeAlert("%s", common.ContextError(FilterUrlError(err)))
-		forceClose(responseWriter)
+		proxy.notices.Alert("%s", common.ContextError(FilterUrlError(err)))
+		proxy.forceClose(responseWriter)
 		return
 	}
 
@@ -518,8 +550,8 @@ func (proxy *HttpProxy) relayHTTPRequest(
 			}
 
 			if err != nil {
-				NoticeAlert("URL proxy rewrite failed for %s: %s", key, common.ContextError(err))
-				forceClose(responseWriter)
+				proxy.notices.Alert("URL proxy rewrite failed for %s: %s", key, common.ContextError(err))
+				proxy.forceClose(responseWriter)
 				response.Body.Close()
 				return
 			}
@@ -551,7 +583,7 @@ func (proxy *HttpProxy) relayHTTPRequest(
 		// hijacking here does not disrupt an otherwise persistent
 		// connection.
 
-		conn := hijack(responseWriter)
+		conn := proxy.hijack(responseWriter)
 		if conn == nil {
 			// hijack emits an alert notice
 			return
@@ -563,21 +595,21 @@ func (proxy *HttpProxy) relayHTTPRequest(
 			response.StatusCode,
 			http.StatusText(response.StatusCode))
 		if err != nil {
-			NoticeAlert("write status line failed: %s", common.ContextError(err))
+			proxy.notices.Alert("write status line failed: %s", common.ContextError(err))
 			conn.Close()
 			return
 		}
 
 		err = responseWriter.Header().Write(conn)
 		if err != nil {
-			NoticeAlert("write headers failed: %s", common.ContextError(err))
+			proxy.notices.Alert("write headers failed: %s", common.ContextError(err))
 			conn.Close()
 			return
 		}
 
 		_, err = io.Copy(conn, response.Body)
 		if err != nil {
-			NoticeAlert("write body failed: %s", common.ContextError(err))
+			proxy.notices.Alert("write body failed: %s", common.ContextError(err))
 			conn.Close()
 			return
 		}
@@ -589,8 +621,8 @@ func (proxy *HttpProxy) relayHTTPRequest(
 		responseWriter.WriteHeader(response.StatusCode)
 		_, err = io.Copy(responseWriter, response.Body)
 		if err != nil {
-			NoticeAlert("%s", common.ContextError(err))
-			forceClose(responseWriter)
+			proxy.notices.Alert("%s", common.ContextError(err))
+			proxy.forceClose(responseWriter)
 			return
 		}
 	}
@@ -599,22 +631,22 @@ func (proxy *HttpProxy) relayHTTPRequest(
 // forceClose hijacks and closes persistent connections. This is used
 // to ensure local persistent connections into the HTTP proxy are closed
 // when ServeHTTP encounters an error.
-func forceClose(responseWriter http.ResponseWriter) {
-	conn := hijack(responseWriter)
+func (proxy *HttpProxy) forceClose(responseWriter http.ResponseWriter) {
+	conn := proxy.hijack(responseWriter)
 	if conn != nil {
 		conn.Close()
 	}
 }
 
-func hijack(responseWriter http.ResponseWriter) net.Conn {
+func (proxy *HttpProxy) hijack(responseWriter http.ResponseWriter) net.Conn {
 	hijacker, ok := responseWriter.(http.Hijacker)
 	if !ok {
-		NoticeAlert("%s", common.ContextError(errors.New("responseWriter is not an http.Hijacker")))
+		proxy.notices.Alert("%s", common.ContextError(errors.New("responseWriter is not an http.Hijacker")))
 		return nil
 	}
 	conn, _, err := hijacker.Hijack()
 	if err != nil {
-		NoticeAlert("%s", common.ContextError(fmt.Errorf("responseWriter hijack failed: %s", err)))
+		proxy.notices.Alert("%s", common.ContextError(fmt.Errorf("responseWriter hijack failed: %s", err)))
 		return nil
 	}
 	return conn
@@ -669,10 +701,10 @@ func (proxy *HttpProxy) serve() {
 	default:
 		if err != nil {
 			proxy.tunneler.SignalComponentFailure()
-			NoticeLocalProxyError(_HTTP_PROXY_TYPE, common.ContextError(err))
+			proxy.notices.LocalProxyError(_HTTP_PROXY_TYPE, common.ContextError(err))
 		}
 	}
-	NoticeInfo("HTTP proxy stopped")
+	proxy.notices.Info("HTTP proxy stopped")
 }
 
 //
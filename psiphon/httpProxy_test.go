@@ -20,8 +20,12 @@
 package psiphon
 
 import (
+	"bufio"
 	"bytes"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -154,3 +158,73 @@ func TestRewriteM3U8(t *testing.T) {
 		}
 	}
 }
+
+func TestHttpProxyPortForwardLimits(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+
+	config, err := LoadConfig([]byte(`
+		{
+			"PropagationChannelId" : "0",
+			"SponsorId" : "0",
+			"MaxOpenPortForwards" : 1
+		}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	httpProxy, err := NewHttpProxy(config, &testDirectTunneler{}, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewHttpProxy failed: %s", err)
+	}
+	defer httpProxy.Close()
+
+	connect := func() (net.Conn, int) {
+		conn, err := net.Dial("tcp", httpProxy.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("net.Dial failed: %s", err)
+		}
+		target := listener.Addr().String()
+		_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+		response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("ReadResponse failed: %s", err)
+		}
+		return conn, response.StatusCode
+	}
+
+	conn, statusCode := connect()
+	defer conn.Close()
+	if statusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", statusCode)
+	}
+
+	conn, statusCode = connect()
+	defer conn.Close()
+	if statusCode != http.StatusTooManyRequests {
+		t.Fatalf("unexpected status code: %d", statusCode)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// KEY_VALUE_STORE_DIRECTORY is the directory, within DataStoreDirectory, in
+// which the default FileKeyValueStore stores values.
+const KEY_VALUE_STORE_DIRECTORY = "psiphon.kvstore"
+
+// KeyValueStore is a pluggable storage backend for persistent client state.
+// Embedders may implement KeyValueStore to keep state in an app-specific
+// store, such as encrypted storage backed by the Android Keystore or iOS
+// Keychain, and set Config.KeyValueStore. When Config.KeyValueStore is not
+// set, a FileKeyValueStore in DataStoreDirectory is used.
+//
+// The KeyValueStore stores upgrade download validators and server entry
+// performance history. Server entries remain in the datastore, as candidate
+// selection requires ranked iteration over all server entries.
+//
+// Implementations must be safe for concurrent use.
+type KeyValueStore interface {
+
+	// Get returns the value stored for key, or nil when no value is stored.
+	Get(key string) ([]byte, error)
+
+	// Set stores value for key, replacing any existing value.
+	Set(key string, value []byte) error
+
+	// Delete removes any value stored for key. Deleting a key with no value
+	// is not an error.
+	Delete(key string) error
+}
+
+// FileKeyValueStore is the default KeyValueStore, which stores each value
+// in a file in a directory.
+type FileKeyValueStore struct {
+	directory string
+}
+
+// NewFileKeyValueStore creates a FileKeyValueStore which stores values in
+// directory. The directory is created when the first value is stored.
+func NewFileKeyValueStore(directory string) *FileKeyValueStore {
+	return &FileKeyValueStore{directory: directory}
+}
+
+// Get implements KeyValueStore.
+func (store *FileKeyValueStore) Get(key string) ([]byte, error) {
+	value, err := ioutil.ReadFile(store.filename(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, common.ContextError(err)
+	}
+	return value, nil
+}
+
+// Set implements KeyValueStore. The value is written to a temporary file
+// which is then renamed into place, so that a crash doesn't leave a
+// partially written value.
+func (store *FileKeyValueStore) Set(key string, value []byte) error {
+
+	err := os.MkdirAll(store.directory, 0700)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	file, err := ioutil.TempFile(store.directory, ".tmp")
+	if err != nil {
+		return common.ContextError(err)
+	}
+	tempFilename := file.Name()
+
+	_, err = file.Write(value)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFilename, store.filename(key))
+	}
+	if err != nil {
+		os.Remove(tempFilename)
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// Delete implements KeyValueStore.
+func (store *FileKeyValueStore) Delete(key string) error {
+	err := os.Remove(store.filename(key))
+	if err != nil && !os.IsNotExist(err) {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// filename returns the file in which the value for key is stored. The key
+// is hex encoded, so any key maps to a valid filename.
+func (store *FileKeyValueStore) filename(key string) string {
+	return filepath.Join(store.directory, hex.EncodeToString([]byte(key)))
+}
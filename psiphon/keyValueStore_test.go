@@ -0,0 +1,194 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryKeyValueStore is an in-memory KeyValueStore, standing in for an
+// embedder-supplied store.
+type memoryKeyValueStore struct {
+	mutex  sync.Mutex
+	values map[string][]byte
+}
+
+func newMemoryKeyValueStore() *memoryKeyValueStore {
+	return &memoryKeyValueStore{values: make(map[string][]byte)}
+}
+
+func (store *memoryKeyValueStore) Get(key string) ([]byte, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.values[key], nil
+}
+
+func (store *memoryKeyValueStore) Set(key string, value []byte) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.values[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (store *memoryKeyValueStore) Delete(key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.values, key)
+	return nil
+}
+
+func TestKeyValueStore(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-key-value-store-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	for _, testCase := range []struct {
+		description string
+		store       KeyValueStore
+	}{
+		{"memory", newMemoryKeyValueStore()},
+		{"file", NewFileKeyValueStore(filepath.Join(testDataDirName, KEY_VALUE_STORE_DIRECTORY))},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			store := testCase.store
+
+			value, err := store.Get("key/1")
+			if err != nil || value != nil {
+				t.Fatalf("unexpected Get result: %v, %v", value, err)
+			}
+
+			for _, expectedValue := range [][]byte{[]byte("value-1"), []byte("value-2")} {
+
+				err = store.Set("key/1", expectedValue)
+				if err != nil {
+					t.Fatalf("Set failed: %s", err)
+				}
+
+				value, err = store.Get("key/1")
+				if err != nil || !bytes.Equal(value, expectedValue) {
+					t.Fatalf("unexpected Get result: %v, %v", value, err)
+				}
+			}
+
+			err = store.Delete("key/1")
+			if err != nil {
+				t.Fatalf("Delete failed: %s", err)
+			}
+
+			value, err = store.Get("key/1")
+			if err != nil || value != nil {
+				t.Fatalf("unexpected Get result: %v, %v", value, err)
+			}
+
+			err = store.Delete("key/1")
+			if err != nil {
+				t.Fatalf("Delete failed: %s", err)
+			}
+		})
+	}
+}
+
+func TestConfigKeyValueStore(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-key-value-store-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config, err := LoadConfig([]byte(`
+		{
+			"PropagationChannelId" : "0",
+			"SponsorId" : "0",
+			"DataStoreDirectory" : "` + testDataDirName + `",
+			"UpgradeDownloadConditionalRequest" : true
+		}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	store := newMemoryKeyValueStore()
+	config.KeyValueStore = store
+
+	// Server entry performance history persists through the configured
+	// store.
+
+	err = RecordServerEntryPerformance(config, "192.0.2.0", true, time.Second)
+	if err != nil {
+		t.Fatalf("RecordServerEntryPerformance failed: %s", err)
+	}
+
+	err = RecordServerEntryPerformance(config, "192.0.2.1", false, 0)
+	if err != nil {
+		t.Fatalf("RecordServerEntryPerformance failed: %s", err)
+	}
+
+	performance := getServerEntryPerformance(config)
+
+	if len(performance) != 2 ||
+		performance["192.0.2.0"] == nil || !performance["192.0.2.0"].LastSuccess ||
+		performance["192.0.2.1"] == nil || performance["192.0.2.1"].LastSuccess {
+		t.Fatalf("unexpected performance: %+v", performance)
+	}
+
+	// Upgrade download validators persist through the configured store.
+
+	err = ioutil.WriteFile(
+		filepath.Join(testDataDirName, "upgrade.2"), []byte("upgrade"), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	config.UpgradeDownloadFilename = filepath.Join(testDataDirName, "upgrade")
+
+	file := &upgradeDownloadFile{config: config}
+
+	_, err = file.complete("2", &upgradeDownloadValidator{ETag: `"upgrade"`})
+	if err != nil {
+		t.Fatalf("complete failed: %s", err)
+	}
+
+	validator := file.getValidator()
+	if validator == nil || validator.ETag != `"upgrade"` {
+		t.Fatalf("unexpected validator: %+v", validator)
+	}
+
+	if store.values[makeUpgradeDownloadValidatorKey(config.UpgradeDownloadFilename)] == nil ||
+		store.values[serverEntryPerformanceKey] == nil {
+		t.Fatalf("missing stored values")
+	}
+
+	// Nothing is written to the default store.
+
+	if _, err := os.Stat(
+		filepath.Join(testDataDirName, KEY_VALUE_STORE_DIRECTORY)); !os.IsNotExist(err) {
+		t.Fatalf("unexpected default store")
+	}
+}
@@ -79,8 +79,9 @@ type MeekConfig struct {
 	// TLSProfile specifies the TLS profile to use for all underlying
 	// TLS connections created by this meek connection. Valid values
 	// are the possible values for CustomTLSConfig.TLSProfile.
-	// TLSProfile will be used only when DialConfig.UseIndistinguishableTLS
-	// is set in the DialConfig passed in to DialMeek.
+	// When TLSProfile is "", a profile is selected for each TLS
+	// connection only when DialConfig.UseIndistinguishableTLS is set in
+	// the DialConfig passed in to DialMeek.
 	TLSProfile string
 
 	// UseObfuscatedSessionTickets indicates whether to use obfuscated
@@ -151,6 +152,7 @@ type MeekConn struct {
 	// For relay mode
 	fullReceiveBufferLength int
 	readPayloadChunkLength  int
+	maxRequestPayloadLength int
 	emptyReceiveBuffer      chan *bytes.Buffer
 	partialReceiveBuffer    chan *bytes.Buffer
 	fullReceiveBuffer       chan *bytes.Buffer
@@ -243,7 +245,7 @@ func DialMeek(
 			Dial:                          NewTCPDialer(dialConfig),
 			SNIServerName:                 meekConfig.SNIServerName,
 			SkipVerify:                    true,
-			UseIndistinguishableTLS:       dialConfig.UseIndistinguishableTLS,
+			UseIndistinguishableTLS:       dialConfig.UseIndistinguishableTLS || meekConfig.TLSProfile != "",
 			TLSProfile:                    meekConfig.TLSProfile,
 			TrustedCACertificatesFilename: dialConfig.TrustedCACertificatesFilename,
 		}
@@ -451,6 +453,7 @@ func DialMeek(
 			meek.fullReceiveBufferLength = p.Int(parameters.MeekFullReceiveBufferLength)
 			meek.readPayloadChunkLength = p.Int(parameters.MeekReadPayloadChunkLength)
 		}
+		meek.maxRequestPayloadLength = getMeekMaxRequestPayloadLength(p)
 		p = nil
 
 		meek.emptyReceiveBuffer = make(chan *bytes.Buffer, 1)
@@ -654,7 +657,7 @@ func (meek *MeekConn) Write(buffer []byte) (n int, err error) {
 		case <-meek.runCtx.Done():
 			return 0, common.ContextError(errors.New("meek connection has closed"))
 		}
-		writeLen := MEEK_MAX_REQUEST_PAYLOAD_LENGTH - sendBuffer.Len()
+		writeLen := meek.maxRequestPayloadLength - sendBuffer.Len()
 		if writeLen > 0 {
 			if writeLen > len(buffer) {
 				writeLen = len(buffer)
@@ -707,13 +710,24 @@ func (meek *MeekConn) replaceSendBuffer(sendBuffer *bytes.Buffer) {
 	switch {
 	case sendBuffer.Len() == 0:
 		meek.emptySendBuffer <- sendBuffer
-	case sendBuffer.Len() >= MEEK_MAX_REQUEST_PAYLOAD_LENGTH:
+	case sendBuffer.Len() >= meek.maxRequestPayloadLength:
 		meek.fullSendBuffer <- sendBuffer
 	default:
 		meek.partialSendBuffer <- sendBuffer
 	}
 }
 
+// getMeekMaxRequestPayloadLength returns the MeekMaxRequestPayloadLength
+// parameter, capped at MEEK_MAX_REQUEST_PAYLOAD_LENGTH, the maximum request
+// payload accepted by the meek server.
+func getMeekMaxRequestPayloadLength(p *parameters.ClientParametersSnapshot) int {
+	length := p.Int(parameters.MeekMaxRequestPayloadLength)
+	if length > MEEK_MAX_REQUEST_PAYLOAD_LENGTH {
+		length = MEEK_MAX_REQUEST_PAYLOAD_LENGTH
+	}
+	return length
+}
+
 // relay sends and receives tunneled traffic (payload). An HTTP request is
 // triggered when data is in the write queue or at a polling interval.
 // There's a geometric increase, up to a maximum, in the polling interval when
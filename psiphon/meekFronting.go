@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+const (
+	MEEK_FRONTING_ADDRESS_SELECTION_RANDOM  = "random"
+	MEEK_FRONTING_ADDRESS_SELECTION_ORDERED = "ordered"
+	MEEK_FRONTING_ADDRESS_SELECTION_STICKY  = "sticky-on-success"
+)
+
+// failedFrontingAddresses records, for each server, the fronting addresses
+// which have failed since the last successful connection to that server.
+// Failed fronting addresses are skipped by selectFrontingAddress until all
+// of a server's fronting addresses have failed.
+var failedFrontingAddresses = struct {
+	mutex     sync.Mutex
+	addresses map[string]map[string]bool
+}{
+	addresses: make(map[string]map[string]bool),
+}
+
+// selectFrontingAddress selects one of the server entry's
+// MeekFrontingAddresses for a connection attempt, according to the
+// selection policy. Fronting addresses which have recently failed are
+// skipped, so that repeated connection attempts rotate through the
+// candidate fronting addresses.
+func selectFrontingAddress(
+	selection string, serverEntry *protocol.ServerEntry) (string, error) {
+
+	if len(serverEntry.MeekFrontingAddresses) == 0 {
+		return "", common.ContextError(errors.New("MeekFrontingAddresses is empty"))
+	}
+
+	failedFrontingAddresses.mutex.Lock()
+	failed := failedFrontingAddresses.addresses[serverEntry.IpAddress]
+	candidates := make([]string, 0, len(serverEntry.MeekFrontingAddresses))
+	for _, frontingAddress := range serverEntry.MeekFrontingAddresses {
+		if !failed[frontingAddress] {
+			candidates = append(candidates, frontingAddress)
+		}
+	}
+	if len(candidates) == 0 {
+		// All fronting addresses have failed, so start over.
+		delete(failedFrontingAddresses.addresses, serverEntry.IpAddress)
+		candidates = serverEntry.MeekFrontingAddresses
+	}
+	failedFrontingAddresses.mutex.Unlock()
+
+	switch selection {
+
+	case MEEK_FRONTING_ADDRESS_SELECTION_ORDERED:
+		return candidates[0], nil
+
+	case MEEK_FRONTING_ADDRESS_SELECTION_STICKY:
+		lastFrontingAddress, err := GetKeyValue(
+			DATA_STORE_LAST_FRONTING_ADDRESS_KEY_PREFIX + serverEntry.IpAddress)
+		if err != nil {
+			NoticeAlert("failed to get last fronting address: %s", err)
+		}
+		if lastFrontingAddress != "" && common.Contains(candidates, lastFrontingAddress) {
+			return lastFrontingAddress, nil
+		}
+	}
+
+	index, err := common.MakeSecureRandomInt(len(candidates))
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	return candidates[index], nil
+}
+
+// recordFrontingAddressResult records the outcome of a connection attempt
+// using frontingAddress. A failed fronting address is skipped in subsequent
+// selections; a successful fronting address is persisted for use by the
+// MEEK_FRONTING_ADDRESS_SELECTION_STICKY policy.
+func recordFrontingAddressResult(
+	serverEntry *protocol.ServerEntry, frontingAddress string, success bool) {
+
+	if !common.Contains(serverEntry.MeekFrontingAddresses, frontingAddress) {
+		// The fronting address was generated from MeekFrontingAddressesRegex.
+		return
+	}
+
+	failedFrontingAddresses.mutex.Lock()
+	if success {
+		delete(failedFrontingAddresses.addresses, serverEntry.IpAddress)
+	} else {
+		failed, ok := failedFrontingAddresses.addresses[serverEntry.IpAddress]
+		if !ok {
+			failed = make(map[string]bool)
+			failedFrontingAddresses.addresses[serverEntry.IpAddress] = failed
+		}
+		failed[frontingAddress] = true
+	}
+	failedFrontingAddresses.mutex.Unlock()
+
+	if success {
+		err := SetKeyValue(
+			DATA_STORE_LAST_FRONTING_ADDRESS_KEY_PREFIX+serverEntry.IpAddress,
+			frontingAddress)
+		if err != nil {
+			NoticeAlert("failed to set last fronting address: %s", err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestSelectFrontingAddress(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-fronting-address-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	singleton = dataStore{}
+	os.Remove(filepath.Join(testDataDirName, DATA_STORE_FILENAME))
+
+	err = InitDataStore(&Config{DataStoreDirectory: testDataDirName})
+	if err != nil {
+		t.Fatalf("InitDataStore failed: %s", err)
+	}
+
+	frontingAddresses := []string{"a.example.com", "b.example.com", "c.example.com"}
+
+	makeServerEntry := func(ipAddress string) *protocol.ServerEntry {
+		return &protocol.ServerEntry{
+			IpAddress:             ipAddress,
+			MeekFrontingAddresses: frontingAddresses,
+		}
+	}
+
+	selectAddress := func(selection string, serverEntry *protocol.ServerEntry) string {
+		frontingAddress, err := selectFrontingAddress(selection, serverEntry)
+		if err != nil {
+			t.Fatalf("selectFrontingAddress failed: %s", err)
+		}
+		return frontingAddress
+	}
+
+	// Ordered: when the first front fails, fall back to the next; after a
+	// success, start over with the first front.
+
+	serverEntry := makeServerEntry("192.0.2.1")
+	selection := MEEK_FRONTING_ADDRESS_SELECTION_ORDERED
+
+	for i := 0; i < len(frontingAddresses); i++ {
+		frontingAddress := selectAddress(selection, serverEntry)
+		if frontingAddress != frontingAddresses[i] {
+			t.Fatalf("unexpected fronting address: %s", frontingAddress)
+		}
+		recordFrontingAddressResult(serverEntry, frontingAddress, false)
+	}
+
+	// All fronts have failed, so the selection starts over.
+
+	if selectAddress(selection, serverEntry) != frontingAddresses[0] {
+		t.Fatalf("unexpected fronting address")
+	}
+	recordFrontingAddressResult(serverEntry, frontingAddresses[0], false)
+	recordFrontingAddressResult(serverEntry, frontingAddresses[1], true)
+
+	if selectAddress(selection, serverEntry) != frontingAddresses[0] {
+		t.Fatalf("unexpected fronting address")
+	}
+
+	// Random: a failed front is not selected again.
+
+	serverEntry = makeServerEntry("192.0.2.2")
+	selection = MEEK_FRONTING_ADDRESS_SELECTION_RANDOM
+
+	recordFrontingAddressResult(serverEntry, frontingAddresses[0], false)
+
+	for i := 0; i < 100; i++ {
+		if selectAddress(selection, serverEntry) == frontingAddresses[0] {
+			t.Fatalf("unexpected fronting address")
+		}
+	}
+
+	// Sticky: the last successful front is selected until it fails.
+
+	serverEntry = makeServerEntry("192.0.2.3")
+	selection = MEEK_FRONTING_ADDRESS_SELECTION_STICKY
+
+	recordFrontingAddressResult(serverEntry, frontingAddresses[2], true)
+
+	for i := 0; i < 10; i++ {
+		if selectAddress(selection, serverEntry) != frontingAddresses[2] {
+			t.Fatalf("unexpected fronting address")
+		}
+	}
+
+	recordFrontingAddressResult(serverEntry, frontingAddresses[2], false)
+
+	for i := 0; i < 100; i++ {
+		if selectAddress(selection, serverEntry) == frontingAddresses[2] {
+			t.Fatalf("unexpected fronting address")
+		}
+	}
+}
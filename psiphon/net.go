@@ -20,9 +20,17 @@
 package psiphon
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -30,11 +38,18 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Psiphon-Inc/dns"
+	"github.com/Psiphon-Inc/goarista/monotime"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/juju/ratelimit"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/lex/httplex"
 )
 
 const DNS_PORT = 53
@@ -71,6 +86,27 @@ type DialConfig struct {
 	DnsServerGetter DnsServerGetter
 	IPv6Synthesizer IPv6Synthesizer
 
+	// IPAddressFamilyPreference specifies how TCP dials choose between the
+	// IPv4 and IPv6 addresses of a destination. See the Config field of the
+	// same name.
+	IPAddressFamilyPreference string
+
+	// SocketFwmark, when non-zero, specifies a firewall mark to set on TCP
+	// sockets before connecting. See the Config field TunnelSocketFwmark.
+	SocketFwmark uint32
+
+	// SocketReadBuffer and SocketWriteBuffer, when non-zero, specify the
+	// SO_RCVBUF and SO_SNDBUF sizes to set on TCP sockets before connecting.
+	// See the Config fields TunnelSocketReadBuffer and
+	// TunnelSocketWriteBuffer.
+	SocketReadBuffer  int
+	SocketWriteBuffer int
+
+	// BootstrapDohUrl, when set, specifies a DNS-over-HTTPS resolver to use
+	// for untunneled domain name resolution. See the Config field of the
+	// same name.
+	BootstrapDohUrl string
+
 	// UseIndistinguishableTLS specifies whether to try to use an
 	// alternative stack for TLS. From a circumvention perspective,
 	// Go's TLS has a distinct fingerprint that may be used for blocking.
@@ -107,6 +143,20 @@ type NetworkConnectivityChecker interface {
 // DeviceBinder defines the interface to the external BindToDevice provider
 // which calls into the host application to bind sockets to specific devices.
 // This is used for VPN routing exclusion.
+//
+// BindToDevice is called, before connecting, with the file descriptor of
+// every socket tunnel-core creates for a direct network connection: each
+// TCP socket dialed for a tunnel, meek, upstream proxy, remote server list,
+// upgrade download, or feedback connection; and each UDP socket used for
+// untunneled DNS resolution. Tunneled connections, including the tunneled
+// HTTP client used by DownloadUpgrade, are carried over an existing tunnel
+// and create no new sockets. BindToDevice may be called concurrently.
+//
+// On Android, VpnService apps should implement BindToDevice with
+// VpnService.protect, so that tunnel traffic bypasses the VPN route. On iOS,
+// where the Network Extension excludes its own traffic, DeviceBinder need
+// not be set. DeviceBinder is not supported on Windows, where dials fail when
+// it is set.
 type DeviceBinder interface {
 	BindToDevice(fileDescriptor int) error
 }
@@ -154,7 +204,51 @@ type Dialer func(context.Context, string, string) (net.Conn, error)
 
 // LocalProxyRelay sends to remoteConn bytes received from localConn,
 // and sends to localConn bytes received from remoteConn.
-func LocalProxyRelay(proxyType string, localConn, remoteConn net.Conn) {
+//
+// When idleTimeout is > 0, both connections are closed once no bytes have
+// been relayed, in either direction, for idleTimeout.
+func LocalProxyRelay(
+	proxyType string, idleTimeout time.Duration, localConn, remoteConn net.Conn) {
+
+	localProxyRelay(nil, proxyType, idleTimeout, localConn, remoteConn)
+}
+
+// localProxyRelay is LocalProxyRelay with relay errors reported to notices,
+// or to the process-wide notice sink when notices is nil.
+func localProxyRelay(
+	notices *noticeLogger,
+	proxyType string, idleTimeout time.Duration, localConn, remoteConn net.Conn) {
+
+	if idleTimeout > 0 {
+		lastActivity := int64(monotime.Now())
+		localConn = &relayActivityConn{Conn: localConn, lastActivity: &lastActivity}
+
+		stopMonitoring := make(chan struct{})
+		defer close(stopMonitoring)
+
+		go func() {
+			timer := time.NewTimer(idleTimeout)
+			defer timer.Stop()
+			for {
+				select {
+				case <-timer.C:
+				case <-stopMonitoring:
+					return
+				}
+				idleTime := monotime.Since(
+					monotime.Time(atomic.LoadInt64(&lastActivity)))
+				if idleTime >= idleTimeout {
+					notices.LocalProxyError(
+						proxyType, common.ContextError(errors.New("relay idle timeout")))
+					localConn.Close()
+					remoteConn.Close()
+					return
+				}
+				timer.Reset(idleTimeout - idleTime)
+			}
+		}()
+	}
+
 	copyWaitGroup := new(sync.WaitGroup)
 	copyWaitGroup.Add(1)
 	go func() {
@@ -162,17 +256,40 @@ func LocalProxyRelay(proxyType string, localConn, remoteConn net.Conn) {
 		_, err := io.Copy(localConn, remoteConn)
 		if err != nil {
 			err = fmt.Errorf("Relay failed: %s", common.ContextError(err))
-			NoticeLocalProxyError(proxyType, err)
+			notices.LocalProxyError(proxyType, err)
 		}
 	}()
 	_, err := io.Copy(remoteConn, localConn)
 	if err != nil {
 		err = fmt.Errorf("Relay failed: %s", common.ContextError(err))
-		NoticeLocalProxyError(proxyType, err)
+		notices.LocalProxyError(proxyType, err)
 	}
 	copyWaitGroup.Wait()
 }
 
+// relayActivityConn records the time of the last read or write which
+// relayed any bytes.
+type relayActivityConn struct {
+	net.Conn
+	lastActivity *int64
+}
+
+func (conn *relayActivityConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+	if n > 0 {
+		atomic.StoreInt64(conn.lastActivity, int64(monotime.Now()))
+	}
+	return n, err
+}
+
+func (conn *relayActivityConn) Write(buffer []byte) (int, error) {
+	n, err := conn.Conn.Write(buffer)
+	if n > 0 {
+		atomic.StoreInt64(conn.lastActivity, int64(monotime.Now()))
+	}
+	return n, err
+}
+
 // WaitForNetworkConnectivity uses a NetworkConnectivityChecker to
 // periodically check for network connectivity. It returns true if
 // no NetworkConnectivityChecker is provided (waiting is disabled)
@@ -211,29 +328,49 @@ func WaitForNetworkConnectivity(
 // when we need to ensure that a DNS connection is tunneled.
 // Caller must set timeouts or interruptibility as required for conn.
 func ResolveIP(host string, conn net.Conn) (addrs []net.IP, ttls []time.Duration, err error) {
+	return resolveIP(host, conn, dns.TypeA)
+}
+
+// resolveIP sends a DNS query for each of the specified query types, in
+// order, and returns the A and AAAA answers. When a later query fails, the
+// addresses resolved by earlier queries are returned.
+func resolveIP(
+	host string, conn net.Conn, queryTypes ...uint16) (addrs []net.IP, ttls []time.Duration, err error) {
 
-	// Send the DNS query
 	dnsConn := &dns.Conn{Conn: conn}
 	defer dnsConn.Close()
-	query := new(dns.Msg)
-	query.SetQuestion(dns.Fqdn(host), dns.TypeA)
-	query.RecursionDesired = true
-	dnsConn.WriteMsg(query)
 
-	// Process the response
-	response, err := dnsConn.ReadMsg()
-	if err != nil {
-		return nil, nil, common.ContextError(err)
-	}
 	addrs = make([]net.IP, 0)
 	ttls = make([]time.Duration, 0)
-	for _, answer := range response.Answer {
-		if a, ok := answer.(*dns.A); ok {
-			addrs = append(addrs, a.A)
-			ttl := time.Duration(a.Hdr.Ttl) * time.Second
-			ttls = append(ttls, ttl)
+
+	for _, queryType := range queryTypes {
+
+		// Send the DNS query
+		query := new(dns.Msg)
+		query.SetQuestion(dns.Fqdn(host), queryType)
+		query.RecursionDesired = true
+		dnsConn.WriteMsg(query)
+
+		// Process the response
+		response, err := dnsConn.ReadMsg()
+		if err != nil {
+			if len(addrs) > 0 {
+				break
+			}
+			return nil, nil, common.ContextError(err)
+		}
+		for _, answer := range response.Answer {
+			switch a := answer.(type) {
+			case *dns.A:
+				addrs = append(addrs, a.A)
+				ttls = append(ttls, time.Duration(a.Hdr.Ttl)*time.Second)
+			case *dns.AAAA:
+				addrs = append(addrs, a.AAAA)
+				ttls = append(ttls, time.Duration(a.Hdr.Ttl)*time.Second)
+			}
 		}
 	}
+
 	return addrs, ttls, nil
 }
 
@@ -286,259 +423,2343 @@ func MakeUntunneledHTTPClient(
 	return httpClient, nil
 }
 
+// HTTPClientTimeouts specifies timeouts for an http.Client. Dial limits
+// the time to establish a connection, ResponseHeader limits the time to
+// wait for response headers after sending a request, and Overall limits the
+// entire request, including reading the response body. ReadStall limits the
+// time that any read on a connection may wait without receiving bytes. A
+// zero value for any field specifies no timeout.
+type HTTPClientTimeouts struct {
+	Dial           time.Duration
+	ResponseHeader time.Duration
+	Overall        time.Duration
+	ReadStall      time.Duration
+}
+
 // MakeTunneledHTTPClient returns a net/http.Client which is
 // configured to use custom dialing features including tunneled
 // dialing and, optionally, UseTrustedCACertificatesForStockTLS.
 // This http.Client uses stock TLS for HTTPS.
+//
+// The client uses the default upgrade download timeouts. Use
+// MakeTunneledHTTPClientWithTimeouts to specify other timeouts.
 func MakeTunneledHTTPClient(
 	config *Config,
 	tunnel *Tunnel,
 	skipVerify bool) (*http.Client, error) {
 
+	p := config.clientParameters.Get()
+	timeouts := HTTPClientTimeouts{
+		Dial:      p.Duration(parameters.TunnelPortForwardDialTimeout),
+		Overall:   p.Duration(parameters.FetchUpgradeTimeout),
+		ReadStall: p.Duration(parameters.TunnelReadStallTimeout),
+	}
+	p = nil
+
+	return MakeTunneledHTTPClientWithTimeouts(config, tunnel, skipVerify, timeouts)
+}
+
+// MakeTunneledHTTPClientWithTimeouts is MakeTunneledHTTPClient with the
+// specified timeouts. The timeouts ensure that a stalled tunneled request
+// cannot hang indefinitely.
+func MakeTunneledHTTPClientWithTimeouts(
+	config *Config,
+	tunnel *Tunnel,
+	skipVerify bool,
+	timeouts HTTPClientTimeouts) (*http.Client, error) {
+
+	return makeTunneledHTTPClient(
+		config,
+		func(addr string) (net.Conn, error) {
+			conn, err := tunnel.sshClient.Dial("tcp", addr)
+			if err != nil {
+				return nil, tunnel.classifyPortForwardError(addr, err)
+			}
+			return conn, nil
+		},
+		skipVerify,
+		timeouts)
+}
+
+// MakeTunnelPoolHTTPClient returns a net/http.Client which is configured to
+// use port forwarding through the tunnels in pool. Each new connection is
+// made through the tunnel selected by TunnelPool.GetTunnel, so concurrent
+// requests are load balanced across the pool.
+func MakeTunnelPoolHTTPClient(
+	config *Config,
+	pool *TunnelPool,
+	skipVerify bool) (*http.Client, error) {
+
+	p := config.clientParameters.Get()
+	timeouts := HTTPClientTimeouts{
+		Dial:      p.Duration(parameters.TunnelPortForwardDialTimeout),
+		Overall:   p.Duration(parameters.FetchUpgradeTimeout),
+		ReadStall: p.Duration(parameters.TunnelReadStallTimeout),
+	}
+	p = nil
+
+	return makeTunneledHTTPClient(
+		config,
+		func(addr string) (net.Conn, error) {
+			tunnel := pool.GetTunnel()
+			if tunnel == nil {
+				return nil, common.ContextError(errors.New("no active tunnels"))
+			}
+			return tunnel.Dial(addr, true, nil)
+		},
+		skipVerify,
+		timeouts)
+}
+
+func makeTunneledHTTPClient(
+	config *Config,
+	tunneledDial func(addr string) (net.Conn, error),
+	skipVerify bool,
+	timeouts HTTPClientTimeouts) (*http.Client, error) {
+
 	// Note: there is no dial context since SSH port forward dials cannot
 	// be interrupted directly. Closing the tunnel will interrupt the dials.
-
-	tunneledDialer := func(_, addr string) (conn net.Conn, err error) {
-		return tunnel.sshClient.Dial("tcp", addr)
+	// The dial timeout unblocks the dialer, but the dial goroutine may not
+	// exit until the tunnel is closed.
+
+	clock := config.getClock()
+
+	tunneledDialer := func(_, addr string) (net.Conn, error) {
+		var conn net.Conn
+		var err error
+		if timeouts.Dial == 0 {
+			conn, err = tunneledDial(addr)
+		} else {
+			conn, err = dialWithTimeout(clock, tunneledDial, addr, timeouts.Dial)
+		}
+		if err != nil || timeouts.ReadStall == 0 {
+			return conn, err
+		}
+		return newReadStallConn(conn, clock, timeouts.ReadStall), nil
 	}
 
+	// Note: the response header timeout is enforced by http.Transport, which
+	// always uses the real clock.
+
 	transport := &http.Transport{
-		Dial: tunneledDialer,
+		Dial:                  tunneledDialer,
+		ResponseHeaderTimeout: timeouts.ResponseHeader,
+	}
+
+	if config.TLSProfile != "" {
+
+		// With a configured TLSProfile, TLS connections are dialed with
+		// CustomTLSDial, which sends the profile's ClientHello. The HTTP/2
+		// transport requires stock Go TLS connections, so only HTTP/1.1 is
+		// offered via ALPN and DisableTunneledHTTP2 is implied.
+
+		tlsConfig := &CustomTLSConfig{
+			ClientParameters: config.clientParameters,
+			Dial: func(_ context.Context, network, addr string) (net.Conn, error) {
+				return tunneledDialer(network, addr)
+			},
+			UseDialAddrSNI:          true,
+			SkipVerify:              skipVerify,
+			UseIndistinguishableTLS: true,
+			TLSProfile:              config.TLSProfile,
+			NextProtos:              []string{"http/1.1"},
+		}
+
+		if !skipVerify {
+			stockTLSConfig, err := makeStockTLSConfig(config)
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+			if stockTLSConfig != nil {
+				tlsConfig.RootCAs = stockTLSConfig.RootCAs
+				tlsConfig.VerifyPeerCertificate = stockTLSConfig.VerifyPeerCertificate
+			}
+		}
+
+		// CustomTLSDial adds context to errors, so a pin mismatch is
+		// recorded and ErrCertificatePinMismatch is returned as is, as it
+		// is with stock Go TLS.
+
+		transport.DialTLS = func(network, addr string) (net.Conn, error) {
+			dialTLSConfig := *tlsConfig
+			pinMismatch := false
+			if tlsConfig.VerifyPeerCertificate != nil {
+				dialTLSConfig.VerifyPeerCertificate = func(
+					rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+
+					err := tlsConfig.VerifyPeerCertificate(rawCerts, verifiedChains)
+					pinMismatch = err == ErrCertificatePinMismatch
+					return err
+				}
+			}
+			conn, err := CustomTLSDial(context.Background(), network, addr, &dialTLSConfig)
+			if err != nil && pinMismatch {
+				return nil, ErrCertificatePinMismatch
+			}
+			return conn, err
+		}
+
+	} else {
+
+		if skipVerify {
+
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+
+		} else {
+
+			tlsConfig, err := makeStockTLSConfig(config)
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+			transport.TLSClientConfig = tlsConfig
+		}
+
+		// A custom Dial and TLSClientConfig disable the stock transport's
+		// automatic HTTP/2 support, so HTTP/2 is explicitly configured.
+		// HTTP/2 is negotiated via ALPN, with HTTP/1.1 as the fallback, and
+		// is required for some CDN endpoints.
+
+		if !config.DisableTunneledHTTP2 {
+			err := http2.ConfigureTransport(transport)
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+		}
+	}
+
+	// The overall timeout, which includes reading the response body, is
+	// applied by overallTimeoutTransport rather than http.Client.Timeout so
+	// that it uses the config clock.
+
+	var roundTripper http.RoundTripper = transport
+	if timeouts.Overall > 0 {
+		roundTripper = &overallTimeoutTransport{
+			transport: transport,
+			clock:     clock,
+			timeout:   timeouts.Overall,
+		}
+	}
+
+	if config.HTTPUserAgent != "" || config.RandomizeHTTPUserAgent {
+		roundTripper = &userAgentTransport{
+			transport: roundTripper,
+			config:    config,
+		}
 	}
 
-	if skipVerify {
+	return &http.Client{
+		Transport: roundTripper,
+	}, nil
+}
+
+// ErrCertificatePinMismatch is returned, without added context, by tunneled
+// TLS connections when no certificate in the verified server certificate
+// chain matches PinnedSPKIHashes.
+var ErrCertificatePinMismatch = errors.New("certificate pin mismatch")
 
-		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+// makeStockTLSConfig returns the stock Go TLS config for tunneled TLS
+// connections that expect server certificates signed with public
+// certificate authorities. The result is nil, using the system root CAs with
+// no pinning, when no trusted CAs or pins are configured.
+func makeStockTLSConfig(config *Config) (*tls.Config, error) {
 
-	} else if config.UseTrustedCACertificatesForStockTLS {
+	var rootCAs *x509.CertPool
 
+	if config.UseTrustedCACertificatesForStockTLS {
 		if config.TrustedCACertificatesFilename == "" {
 			return nil, common.ContextError(errors.New(
 				"UseTrustedCACertificatesForStockTLS requires TrustedCACertificatesFilename"))
 		}
-		rootCAs := x509.NewCertPool()
+		rootCAs = x509.NewCertPool()
 		certData, err := ioutil.ReadFile(config.TrustedCACertificatesFilename)
 		if err != nil {
 			return nil, common.ContextError(err)
 		}
 		rootCAs.AppendCertsFromPEM(certData)
-		transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
 	}
 
-	return &http.Client{
-		Transport: transport,
-	}, nil
-}
+	if config.TrustedCACertificatesPEM != "" {
+		if rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM([]byte(config.TrustedCACertificatesPEM)) {
+			return nil, common.ContextError(errors.New("invalid TrustedCACertificatesPEM"))
+		}
+	}
 
-// MakeDownloadHTTPClient is a helper that sets up a http.Client
-// for use either untunneled or through a tunnel.
-func MakeDownloadHTTPClient(
-	ctx context.Context,
-	config *Config,
-	tunnel *Tunnel,
-	untunneledDialConfig *DialConfig,
-	skipVerify bool) (*http.Client, error) {
+	if rootCAs == nil && len(config.PinnedSPKIHashes) == 0 {
+		return nil, nil
+	}
 
-	var httpClient *http.Client
-	var err error
+	tlsConfig := &tls.Config{RootCAs: rootCAs}
 
-	if tunnel != nil {
+	if len(config.PinnedSPKIHashes) > 0 {
 
-		httpClient, err = MakeTunneledHTTPClient(
-			config, tunnel, skipVerify)
-		if err != nil {
-			return nil, common.ContextError(err)
+		var pins [][]byte
+		for _, pin := range config.PinnedSPKIHashes {
+			hash, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+			pins = append(pins, hash)
 		}
 
-	} else {
-
-		httpClient, err = MakeUntunneledHTTPClient(
-			ctx, config, untunneledDialConfig, nil, skipVerify)
-		if err != nil {
-			return nil, common.ContextError(err)
+		// VerifyPeerCertificate is called after normal certificate
+		// verification, so only verified chains are checked against the pins.
+		tlsConfig.VerifyPeerCertificate = func(
+			_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+
+			for _, chain := range verifiedChains {
+				for _, certificate := range chain {
+					hash := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+					for _, pin := range pins {
+						if bytes.Equal(hash[:], pin) {
+							return nil
+						}
+					}
+				}
+			}
+			return ErrCertificatePinMismatch
 		}
 	}
 
-	return httpClient, nil
+	return tlsConfig, nil
 }
 
-// ResumeDownload is a reusable helper that downloads requestUrl via the
-// httpClient, storing the result in downloadFilename when the download is
-// complete. Intermediate, partial downloads state is stored in
-// downloadFilename.part and downloadFilename.part.etag.
-// Any existing downloadFilename file will be overwritten.
-//
-// In the case where the remote object has changed while a partial download
-// is to be resumed, the partial state is reset and resumeDownload fails.
-// The caller must restart the download.
-//
-// When ifNoneMatchETag is specified, no download is made if the remote
-// object has the same ETag. ifNoneMatchETag has an effect only when no
-// partial download is in progress.
-//
-func ResumeDownload(
-	ctx context.Context,
-	httpClient *http.Client,
-	downloadURL string,
-	userAgent string,
-	downloadFilename string,
-	ifNoneMatchETag string) (int64, string, error) {
+// Download restart reasons, reported when a partial download is discarded
+// and the download restarts from byte zero. DOWNLOAD_RESTART_REASON_MISSING_ETAG
+// is reported when the partial download manifest is missing, unreadable, or
+// has no ETag. DOWNLOAD_RESTART_REASON_WEAK_ETAG is reported when the partial
+// download ETag is a weak validator, which doesn't identify the entity bytes
+// and so can't be used to resume.
+const (
+	DOWNLOAD_RESTART_REASON_ETAG_MISMATCH         = "etag-mismatch"
+	DOWNLOAD_RESTART_REASON_MISSING_ETAG          = "missing-etag"
+	DOWNLOAD_RESTART_REASON_WEAK_ETAG             = "weak-etag"
+	DOWNLOAD_RESTART_REASON_INCONSISTENT_MANIFEST = "inconsistent-manifest"
+	DOWNLOAD_RESTART_REASON_NO_RANGE_SUPPORT      = "no-range-support"
+	DOWNLOAD_RESTART_REASON_TRUNCATED             = "truncated"
+)
 
-	partialFilename := fmt.Sprintf("%s.part", downloadFilename)
+type downloadRestartHandlerContextKey struct{}
 
-	partialETagFilename := fmt.Sprintf("%s.part.etag", downloadFilename)
+// withDownloadRestartHandler returns a copy of ctx which specifies a handler
+// that ResumeDownload and ResumeDownloadConcurrently call, with one of the
+// DOWNLOAD_RESTART_REASON values, when a partial download is discarded.
+func withDownloadRestartHandler(
+	ctx context.Context, handler func(reason string)) context.Context {
 
-	file, err := os.OpenFile(partialFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
-	if err != nil {
-		return 0, "", common.ContextError(err)
+	return context.WithValue(ctx, downloadRestartHandlerContextKey{}, handler)
+}
+
+func reportDownloadRestart(ctx context.Context, reason string) {
+	handler, ok := ctx.Value(downloadRestartHandlerContextKey{}).(func(string))
+	if ok {
+		handler(reason)
 	}
-	defer file.Close()
+}
 
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return 0, "", common.ContextError(err)
+type downloadRewindHandlerContextKey struct{}
+
+// withDownloadRewindHandler returns a copy of ctx which specifies a handler
+// that ResumeDownload and ResumeDownloadConcurrently call, with the number of
+// bytes discarded, when the tail of a resumed partial download doesn't match
+// the remote entity and is rewound; see withDownloadResumeVerifyBytes. A
+// rewind isn't a restart: the partial download preceding the first differing
+// byte is retained.
+func withDownloadRewindHandler(
+	ctx context.Context, handler func(rewindBytes int64)) context.Context {
+
+	return context.WithValue(ctx, downloadRewindHandlerContextKey{}, handler)
+}
+
+func reportDownloadRewind(ctx context.Context, rewindBytes int64) {
+	handler, ok := ctx.Value(downloadRewindHandlerContextKey{}).(func(int64))
+	if ok {
+		handler(rewindBytes)
 	}
+}
 
-	// A partial download should have an ETag which is to be sent with the
-	// Range request to ensure that the source object is the same as the
-	// one that is partially downloaded.
-	var partialETag []byte
-	if fileInfo.Size() > 0 {
+type downloadVersionContextKey struct{}
 
-		partialETag, err = ioutil.ReadFile(partialETagFilename)
+// withDownloadVersion returns a copy of ctx which specifies the version of
+// the entity being downloaded. The version is recorded in the partial
+// download manifest, and a partial download of any other version is not
+// resumed.
+func withDownloadVersion(ctx context.Context, version string) context.Context {
+	return context.WithValue(ctx, downloadVersionContextKey{}, version)
+}
 
-		// When the ETag can't be loaded, delete the partial download. To keep the
-		// code simple, there is no immediate, inline retry here, on the assumption
-		// that the controller's upgradeDownloader will shortly call DownloadUpgrade
-		// again.
-		if err != nil {
+func getDownloadVersion(ctx context.Context) string {
+	version, _ := ctx.Value(downloadVersionContextKey{}).(string)
+	return version
+}
 
-			// On Windows, file must be closed before it can be deleted
-			file.Close()
+type downloadResumeVerifyBytesContextKey struct{}
 
-			tempErr := os.Remove(partialFilename)
-			if tempErr != nil && !os.IsNotExist(tempErr) {
-				NoticeAlert("reset partial download failed: %s", tempErr)
-			}
+// withDownloadResumeVerifyBytes returns a copy of ctx which specifies the
+// number of bytes, at the end of a partial download, that ResumeDownload and
+// ResumeDownloadConcurrently verify against the remote entity before
+// resuming.
+func withDownloadResumeVerifyBytes(ctx context.Context, verifyBytes int) context.Context {
+	return context.WithValue(ctx, downloadResumeVerifyBytesContextKey{}, verifyBytes)
+}
 
-			tempErr = os.Remove(partialETagFilename)
-			if tempErr != nil && !os.IsNotExist(tempErr) {
-				NoticeAlert("reset partial download ETag failed: %s", tempErr)
-			}
+func getDownloadResumeVerifyBytes(ctx context.Context) int {
+	verifyBytes, _ := ctx.Value(downloadResumeVerifyBytesContextKey{}).(int)
+	return verifyBytes
+}
 
-			return 0, "", common.ContextError(
-				fmt.Errorf("failed to load partial download ETag: %s", err))
-		}
+type downloadRateLimitContextKey struct{}
+
+// withDownloadRateLimit returns a copy of ctx which specifies a limit, in
+// bytes per second, on the rate at which a remote server list resource is
+// downloaded.
+func withDownloadRateLimit(ctx context.Context, bytesPerSecond int64) context.Context {
+	return context.WithValue(ctx, downloadRateLimitContextKey{}, bytesPerSecond)
+}
+
+func getDownloadRateLimit(ctx context.Context) int64 {
+	bytesPerSecond, _ := ctx.Value(downloadRateLimitContextKey{}).(int64)
+	return bytesPerSecond
+}
+
+// partialDownloadManifest records the state of a partial download. The
+// manifest is stored as JSON in downloadFilename.part.manifest, next to the
+// partial download, so that the download may be validated and resumed after
+// a process restart or crash.
+//
+// Offset is the size of the partial download known to be synced to disk;
+// any bytes past Offset are discarded on resume. ContentLength is the total
+// entity size, or -1 when unknown.
+//
+// URL is informational: the download URL may differ between attempts, as
+// downloaders select from multiple URLs for the same entity, so the ETag,
+// sent as If-Match, identifies the entity.
+type partialDownloadManifest struct {
+	URL           string `json:"url"`
+	ETag          string `json:"etag"`
+	ContentLength int64  `json:"contentLength"`
+	Offset        int64  `json:"offset"`
+	Version       string `json:"version,omitempty"`
+}
+
+func loadPartialDownloadManifest(filename string) (*partialDownloadManifest, error) {
+	value, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	var manifest partialDownloadManifest
+	err = json.Unmarshal(value, &manifest)
+	if err != nil {
+		return nil, common.ContextError(err)
 	}
+	return &manifest, nil
+}
 
-	request, err := http.NewRequest("GET", downloadURL, nil)
+func (manifest *partialDownloadManifest) store(filename string) error {
+	value, err := json.Marshal(manifest)
 	if err != nil {
-		return 0, "", common.ContextError(err)
+		return common.ContextError(err)
+	}
+	err = ioutil.WriteFile(filename, value, 0600)
+	if err != nil {
+		return common.ContextError(err)
 	}
+	return nil
+}
 
-	request = request.WithContext(ctx)
+// partialDownload is the storage of a resumable download: the partial
+// download bytes and the partialDownloadManifest which records their state.
+// The same resume protocol -- manifest validation, If-Match, and restarting
+// on 412 -- applies to all storage. ResumeDownload and
+// ResumeDownloadConcurrently store partial downloads in files; see
+// partialDownloadFile. DownloadUpgradeToWriter stores partial downloads in
+// a caller-provided io.WriterAt; see partialDownloadWriter.
+//
+// WriteAt may be called concurrently for distinct byte ranges.
+type partialDownload interface {
+	io.WriterAt
+	io.ReaderAt
 
-	request.Header.Set("User-Agent", userAgent)
+	// size returns the size of the partial download.
+	size() (int64, error)
 
-	request.Header.Add("Range", fmt.Sprintf("bytes=%d-", fileInfo.Size()))
+	// truncate discards the partial download bytes past size.
+	truncate(size int64) error
 
-	if partialETag != nil {
+	// sync makes the partial download durable.
+	sync() error
 
-		// Note: not using If-Range, since not all host servers support it.
-		// Using If-Match means we need to check for status code 412 and reset
-		// when the ETag has changed since the last partial download.
-		request.Header.Add("If-Match", string(partialETag))
+	// setSyncHook sets a function which is called after each periodic sync
+	// made while writing.
+	setSyncHook(hook func())
 
-	} else if ifNoneMatchETag != "" {
+	// loadManifest returns the stored manifest, or an error when there is
+	// none.
+	loadManifest() (*partialDownloadManifest, error)
 
-		// Can't specify both If-Match and If-None-Match. Behavior is undefined.
-		// https://www.w3.org/Protocols/rfc2616/rfc2616-sec14.html#sec14.26
-		// So for downloaders that store an ETag and wish to use that to prevent
-		// redundant downloads, that ETag is sent as If-None-Match in the case
-		// where a partial download is not in progress. When a partial download
-		// is in progress, the partial ETag is sent as If-Match: either that's
-		// a version that was never fully received, or it's no longer current in
-		// which case the response will be StatusPreconditionFailed, the partial
-		// download will be discarded, and then the next retry will use
-		// If-None-Match.
+	// storeManifest stores manifest, replacing any stored manifest.
+	storeManifest(manifest *partialDownloadManifest) error
 
-		// Note: in this case, fileInfo.Size() == 0
+	// removeManifest removes any stored manifest.
+	removeManifest()
 
-		request.Header.Add("If-None-Match", ifNoneMatchETag)
-	}
+	// complete finalizes the completed, synced download.
+	complete() error
 
-	response, err := httpClient.Do(request)
+	// discard removes the partial download and its manifest.
+	discard()
+}
 
-	// The resumeable download may ask for bytes past the resource range
-	// since it doesn't store the "completed download" state. In this case,
-	// the HTTP server returns 416. Otherwise, we expect 206. We may also
-	// receive 412 on ETag mismatch.
-	if err == nil &&
-		(response.StatusCode != http.StatusPartialContent &&
+// partialDownloadFile is a partialDownload stored in downloadFilename.part,
+// with its manifest in downloadFilename.part.manifest. On completion, the
+// partial download is renamed to downloadFilename.
+type partialDownloadFile struct {
+	downloadFilename string
+	version          string
+	legacyETag       []byte
+	file             *os.File
+	writer           *SyncFileWriter
+}
 
-			// Certain http servers return 200 OK where we expect 206, so accept that.
-			response.StatusCode != http.StatusOK &&
+// openPartialDownloadFile opens or creates the partial download for
+// downloadFilename. Writes are synced at most once per syncBytes and
+// syncPeriod; see NewBatchingSyncFileWriter.
+func openPartialDownloadFile(
+	ctx context.Context,
+	downloadFilename string,
+	syncBytes int,
+	syncPeriod time.Duration) (*partialDownloadFile, error) {
 
-			response.StatusCode != http.StatusRequestedRangeNotSatisfiable &&
-			response.StatusCode != http.StatusPreconditionFailed &&
-			response.StatusCode != http.StatusNotModified) {
-		response.Body.Close()
-		err = fmt.Errorf("unexpected response status code: %d", response.StatusCode)
+	partial := &partialDownloadFile{
+		downloadFilename: downloadFilename,
+		version:          getDownloadVersion(ctx),
 	}
+
+	file, err := os.OpenFile(partial.partialFilename(), os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
-		return 0, "", common.ContextError(err)
+		return nil, common.ContextError(err)
+	}
+	partial.file = file
+	partial.writer = NewBatchingSyncFileWriter(file, syncBytes, syncPeriod)
+
+	// Partial downloads made before manifests were introduced record only
+	// the ETag, in downloadFilename.part.etag. A legacy ETag is migrated to a
+	// manifest, so the partial download is resumed rather than discarded, and
+	// the legacy file is always removed.
+
+	legacyETagFilename := partial.partialFilename() + ".etag"
+	legacyETag, err := ioutil.ReadFile(legacyETagFilename)
+	if err == nil {
+		partial.legacyETag = legacyETag
+		os.Remove(legacyETagFilename)
 	}
-	defer response.Body.Close()
 
-	responseETag := response.Header.Get("ETag")
+	return partial, nil
+}
 
-	if response.StatusCode == http.StatusPreconditionFailed {
-		// When the ETag no longer matches, delete the partial download. As above,
-		// simply failing and relying on the caller's retry schedule.
-		os.Remove(partialFilename)
-		os.Remove(partialETagFilename)
-		return 0, "", common.ContextError(errors.New("partial download ETag mismatch"))
+func (partial *partialDownloadFile) partialFilename() string {
+	return partial.downloadFilename + ".part"
+}
 
-	} else if response.StatusCode == http.StatusNotModified {
-		// This status code is possible in the "If-None-Match" case. Don't leave
-		// any partial download in progress. Caller should check that responseETag
-		// matches ifNoneMatchETag.
-		os.Remove(partialFilename)
-		os.Remove(partialETagFilename)
-		return 0, responseETag, nil
-	}
+func (partial *partialDownloadFile) manifestFilename() string {
+	return partial.downloadFilename + ".part.manifest"
+}
 
-	// Not making failure to write ETag file fatal, in case the entire download
-	// succeeds in this one request.
-	ioutil.WriteFile(partialETagFilename, []byte(responseETag), 0600)
+func (partial *partialDownloadFile) close() {
+	partial.file.Close()
+}
 
-	// A partial download occurs when this copy is interrupted. The io.Copy
-	// will fail, leaving a partial download in place (.part and .part.etag).
-	n, err := io.Copy(NewSyncFileWriter(file), response.Body)
+func (partial *partialDownloadFile) WriteAt(p []byte, offset int64) (int, error) {
+	return partial.writer.WriteAt(p, offset)
+}
 
-	// From this point, n bytes are indicated as downloaded, even if there is
-	// an error; the caller may use this to report partial download progress.
+func (partial *partialDownloadFile) ReadAt(p []byte, offset int64) (int, error) {
+	return partial.file.ReadAt(p, offset)
+}
 
+func (partial *partialDownloadFile) size() (int64, error) {
+	fileInfo, err := partial.file.Stat()
 	if err != nil {
-		return n, "", common.ContextError(err)
+		return 0, common.ContextError(err)
 	}
+	return fileInfo.Size(), nil
+}
 
-	// Ensure the file is flushed to disk. The deferred close
-	// will be a noop when this succeeds.
-	err = file.Close()
+func (partial *partialDownloadFile) truncate(size int64) error {
+	err := partial.file.Truncate(size)
 	if err != nil {
-		return n, "", common.ContextError(err)
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+func (partial *partialDownloadFile) sync() error {
+	err := partial.writer.Sync()
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+func (partial *partialDownloadFile) setSyncHook(hook func()) {
+	partial.writer.SetSyncHook(hook)
+}
+
+func (partial *partialDownloadFile) loadManifest() (*partialDownloadManifest, error) {
+
+	manifest, err := loadPartialDownloadManifest(partial.manifestFilename())
+
+	if err != nil && len(partial.legacyETag) > 0 {
+
+		// The legacy partial download was synced only on completion, so a
+		// torn tail is possible; see withDownloadResumeVerifyBytes. The
+		// legacy download filename includes any version.
+
+		size, sizeErr := partial.size()
+		if sizeErr != nil {
+			return nil, common.ContextError(sizeErr)
+		}
+		manifest = &partialDownloadManifest{
+			ETag:          string(partial.legacyETag),
+			ContentLength: -1,
+			Offset:        size,
+			Version:       partial.version,
+		}
+		err = partial.storeManifest(manifest)
+	}
+
+	return manifest, err
+}
+
+func (partial *partialDownloadFile) storeManifest(manifest *partialDownloadManifest) error {
+	return manifest.store(partial.manifestFilename())
+}
+
+func (partial *partialDownloadFile) removeManifest() {
+	os.Remove(partial.manifestFilename())
+}
+
+func (partial *partialDownloadFile) complete() error {
+
+	// The deferred close will be a noop when this succeeds.
+	err := partial.file.Close()
+	if err != nil {
+		return common.ContextError(err)
 	}
 
 	// Remove if exists, to enable rename
-	os.Remove(downloadFilename)
+	os.Remove(partial.downloadFilename)
 
-	err = os.Rename(partialFilename, downloadFilename)
+	err = os.Rename(partial.partialFilename(), partial.downloadFilename)
 	if err != nil {
-		return n, "", common.ContextError(err)
+		return common.ContextError(err)
 	}
 
-	os.Remove(partialETagFilename)
+	partial.removeManifest()
 
-	return n, responseETag, nil
+	return nil
+}
+
+func (partial *partialDownloadFile) discard() {
+	partial.file.Close()
+	os.Remove(partial.partialFilename())
+	partial.removeManifest()
+}
+
+// partialDownloadWriter is a partialDownload stored in a caller-provided
+// io.WriterAt, with its manifest stored in a KeyValueStore.
+//
+// The caller owns the durability of the data written to dst, so sync does
+// nothing, and the size of the partial download is the caller's count of
+// the bytes already written, rather than the manifest offset. dst can't be
+// truncated; bytes past a truncated size are overwritten as the download
+// continues.
+//
+// On completion, the manifest is retained, so that a repeated download of
+// the same entity is completed by a validated 416 response rather than
+// downloaded again.
+type partialDownloadWriter struct {
+	dst         io.WriterAt
+	store       KeyValueStore
+	manifestKey string
+	mutex       sync.Mutex
+	length      int64
+}
+
+// newPartialDownloadWriter creates a partialDownloadWriter, where length is
+// the number of bytes of the partial download already written to dst.
+func newPartialDownloadWriter(
+	dst io.WriterAt,
+	store KeyValueStore,
+	manifestKey string,
+	length int64) *partialDownloadWriter {
+
+	return &partialDownloadWriter{
+		dst:         dst,
+		store:       store,
+		manifestKey: manifestKey,
+		length:      length,
+	}
+}
+
+func (partial *partialDownloadWriter) WriteAt(p []byte, offset int64) (int, error) {
+	n, err := partial.dst.WriteAt(p, offset)
+	partial.mutex.Lock()
+	if offset+int64(n) > partial.length {
+		partial.length = offset + int64(n)
+	}
+	partial.mutex.Unlock()
+	return n, err
+}
+
+func (partial *partialDownloadWriter) ReadAt(p []byte, offset int64) (int, error) {
+	reader, ok := partial.dst.(io.ReaderAt)
+	if !ok {
+		return 0, common.ContextError(errors.New("partial download is not readable"))
+	}
+	return reader.ReadAt(p, offset)
+}
+
+func (partial *partialDownloadWriter) size() (int64, error) {
+	partial.mutex.Lock()
+	defer partial.mutex.Unlock()
+	return partial.length, nil
+}
+
+func (partial *partialDownloadWriter) truncate(size int64) error {
+	partial.mutex.Lock()
+	defer partial.mutex.Unlock()
+	if size < partial.length {
+		partial.length = size
+	}
+	return nil
+}
+
+func (partial *partialDownloadWriter) sync() error {
+	return nil
+}
+
+func (partial *partialDownloadWriter) setSyncHook(_ func()) {
+}
+
+func (partial *partialDownloadWriter) loadManifest() (*partialDownloadManifest, error) {
+
+	value, err := partial.store.Get(partial.manifestKey)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	if value == nil {
+		return nil, common.ContextError(errors.New("no partial download manifest"))
+	}
+
+	var manifest partialDownloadManifest
+	err = json.Unmarshal(value, &manifest)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	manifest.Offset, _ = partial.size()
+
+	return &manifest, nil
+}
+
+func (partial *partialDownloadWriter) storeManifest(manifest *partialDownloadManifest) error {
+	value, err := json.Marshal(manifest)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	err = partial.store.Set(partial.manifestKey, value)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+func (partial *partialDownloadWriter) removeManifest() {
+	partial.store.Delete(partial.manifestKey)
+}
+
+func (partial *partialDownloadWriter) complete() error {
+	return nil
+}
+
+func (partial *partialDownloadWriter) discard() {
+	partial.truncate(0)
+	partial.removeManifest()
+}
+
+// openPartialDownload validates any existing partial download against its
+// manifest, and returns the manifest and the offset at which to resume.
+// When the manifest is missing or inconsistent with the partial download,
+// the partial download is truncated and the download restarts from byte
+// zero.
+func openPartialDownload(
+	ctx context.Context,
+	partial partialDownload) (*partialDownloadManifest, int64, error) {
+
+	size, err := partial.size()
+	if err != nil {
+		return nil, 0, common.ContextError(err)
+	}
+
+	if size == 0 {
+		return nil, 0, nil
+	}
+
+	manifest, err := partial.loadManifest()
+
+	restartReason := ""
+	if err != nil || manifest.ETag == "" {
+		restartReason = DOWNLOAD_RESTART_REASON_MISSING_ETAG
+	} else if isWeakETag(manifest.ETag) {
+		restartReason = DOWNLOAD_RESTART_REASON_WEAK_ETAG
+	} else if manifest.Version != getDownloadVersion(ctx) ||
+		manifest.Offset < 0 ||
+		manifest.Offset > size ||
+		(manifest.ContentLength >= 0 && manifest.Offset > manifest.ContentLength) {
+		restartReason = DOWNLOAD_RESTART_REASON_INCONSISTENT_MANIFEST
+	}
+
+	if restartReason != "" {
+
+		NoticeInfo("invalid partial download manifest: restarting download")
+
+		err = partial.truncate(0)
+		if err != nil {
+			return nil, 0, common.ContextError(err)
+		}
+		partial.removeManifest()
+
+		reportDownloadRestart(ctx, restartReason)
+
+		return nil, 0, nil
+	}
+
+	// Bytes past the manifest offset may not have been synced before a
+	// crash, so they're downloaded again.
+
+	if size > manifest.Offset {
+		err = partial.truncate(manifest.Offset)
+		if err != nil {
+			return nil, 0, common.ContextError(err)
+		}
+	}
+
+	if manifest.Offset == 0 {
+		partial.removeManifest()
+		return nil, 0, nil
+	}
+
+	return manifest, manifest.Offset, nil
+}
+
+type httpUserAgentContextKey struct{}
+
+// WithHTTPUserAgent returns a copy of ctx which specifies a User-Agent for
+// a single request made with a tunneled HTTP client. The specified
+// User-Agent overrides HTTPUserAgent and RandomizeHTTPUserAgent for any
+// request made with the returned context.
+func WithHTTPUserAgent(ctx context.Context, userAgent string) context.Context {
+	return context.WithValue(ctx, httpUserAgentContextKey{}, userAgent)
+}
+
+// userAgentTransport is an http.RoundTripper which sets the User-Agent
+// configured by HTTPUserAgent and RandomizeHTTPUserAgent, replacing any
+// User-Agent, such as the default Psiphon User-Agent, set on the request. A
+// User-Agent specified with WithHTTPUserAgent takes precedence.
+type userAgentTransport struct {
+	transport http.RoundTripper
+	config    *Config
+}
+
+func (t *userAgentTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+
+	userAgent, ok := request.Context().Value(httpUserAgentContextKey{}).(string)
+	if !ok {
+		userAgent = selectHTTPUserAgent(t.config)
+	}
+
+	if userAgent != "" {
+
+		// An http.RoundTripper must not modify the request, so the User-Agent
+		// is set on a copy. All other headers, such as Range, are retained.
+
+		request = request.WithContext(request.Context())
+		request.Header = cloneHeader(request.Header)
+		request.Header.Set("User-Agent", userAgent)
+	}
+
+	return t.transport.RoundTrip(request)
+}
+
+// selectHTTPUserAgent returns a User-Agent picked by the registered
+// User-Agent picker, when RandomizeHTTPUserAgent is set, or else
+// HTTPUserAgent.
+func selectHTTPUserAgent(config *Config) string {
+	if config.RandomizeHTTPUserAgent {
+		userAgent := pickUserAgent()
+		if userAgent != "" {
+			return userAgent
+		}
+	}
+	return config.HTTPUserAgent
+}
+
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for name, values := range header {
+		clone[name] = append([]string(nil), values...)
+	}
+	return clone
+}
+
+// reservedRequestHeaders are headers which may not be specified in
+// UpgradeDownloadHeaders or FeedbackUploadHeaders, as they control the
+// request framing or the requested range.
+var reservedRequestHeaders = []string{
+	"Connection",
+	"Content-Length",
+	"Host",
+	"If-Range",
+	"Range",
+	"Transfer-Encoding",
+}
+
+// validateCustomRequestHeaders checks that headers, to be added with a
+// customHeadersTransport, are well-formed and not reserved.
+func validateCustomRequestHeaders(headers http.Header) error {
+	for name, values := range headers {
+		if !httplex.ValidHeaderFieldName(name) {
+			return common.ContextError(fmt.Errorf("invalid header name: %q", name))
+		}
+		if common.Contains(reservedRequestHeaders, http.CanonicalHeaderKey(name)) {
+			return common.ContextError(fmt.Errorf("reserved header: %s", name))
+		}
+		for _, value := range values {
+			if !httplex.ValidHeaderFieldValue(value) {
+				return common.ContextError(fmt.Errorf("invalid value for header: %s", name))
+			}
+		}
+	}
+	return nil
+}
+
+// customHeadersTransport is an http.RoundTripper which adds headers, such
+// as an authorization header or a CDN bypass token, to each request. The
+// custom headers are merged after the headers set on the request, and a
+// header already set on the request, such as Range, is never replaced.
+type customHeadersTransport struct {
+	transport http.RoundTripper
+	headers   http.Header
+}
+
+// withCustomHeaders returns a copy of httpClient which adds the specified
+// headers to each request, or httpClient when no headers are specified.
+func withCustomHeaders(httpClient *http.Client, headers http.Header) *http.Client {
+	if len(headers) == 0 {
+		return httpClient
+	}
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	client := *httpClient
+	client.Transport = &customHeadersTransport{
+		transport: transport,
+		headers:   headers,
+	}
+	return &client
+}
+
+func (t *customHeadersTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+
+	// An http.RoundTripper must not modify the request, so the headers are
+	// added to a copy.
+
+	request = request.WithContext(request.Context())
+	request.Header = cloneHeader(request.Header)
+	for name, values := range t.headers {
+		name = http.CanonicalHeaderKey(name)
+		if _, ok := request.Header[name]; ok {
+			continue
+		}
+		request.Header[name] = append([]string(nil), values...)
+	}
+
+	return t.transport.RoundTrip(request)
+}
+
+// overallTimeoutTransport is an http.RoundTripper which cancels a request,
+// including reading its response body, when it doesn't complete within the
+// timeout.
+type overallTimeoutTransport struct {
+	transport http.RoundTripper
+	clock     clock
+	timeout   time.Duration
+}
+
+func (t *overallTimeoutTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+
+	ctx, cancelFunc := context.WithCancel(request.Context())
+
+	timer := t.clock.NewTimer(t.timeout)
+	go func() {
+		select {
+		case <-timer.C():
+			cancelFunc()
+		case <-ctx.Done():
+		}
+	}()
+
+	stop := func() {
+		timer.Stop()
+		cancelFunc()
+	}
+
+	response, err := t.transport.RoundTrip(request.WithContext(ctx))
+	if err != nil {
+		stop()
+		return nil, err
+	}
+
+	response.Body = &overallTimeoutBody{
+		ReadCloser: response.Body,
+		stop:       stop,
+	}
+
+	return response, nil
+}
+
+type overallTimeoutBody struct {
+	io.ReadCloser
+	stop func()
+}
+
+func (body *overallTimeoutBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.stop()
+	return err
+}
+
+// dialWithTimeout invokes dial and returns an error when dial doesn't
+// complete within the timeout. A connection established after the timeout
+// is closed.
+func dialWithTimeout(
+	clock clock,
+	dial func(addr string) (net.Conn, error),
+	addr string,
+	timeout time.Duration) (net.Conn, error) {
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+
+	resultChannel := make(chan dialResult)
+	timedOut := make(chan struct{})
+
+	go func() {
+		conn, err := dial(addr)
+		select {
+		case resultChannel <- dialResult{conn, err}:
+		case <-timedOut:
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}()
+
+	timer := clock.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case result := <-resultChannel:
+		return result.conn, result.err
+	case <-timer.C():
+		close(timedOut)
+		return nil, common.ContextError(errors.New("dial timeout"))
+	}
+}
+
+// errTunnelReadStalled is returned by readStallConn.Read when the read
+// waited longer than the read stall timeout without receiving any bytes.
+var errTunnelReadStalled = errors.New("tunneled connection read stalled")
+
+// readStallConn is a net.Conn watchdog which closes the underlying conn when
+// a Read waits longer than timeout without receiving any bytes. A tunneled
+// port forward may remain open while the tunnel has silently stopped
+// delivering data, and SSH channels don't support read deadlines, so without
+// this check a read may block until the tunnel is eventually closed.
+//
+// Only time spent waiting in Read counts towards the timeout; an idle conn
+// with no pending Read is not closed.
+type readStallConn struct {
+	net.Conn
+	clock            clock
+	timeout          time.Duration
+	mutex            sync.Mutex
+	isReadPending    bool
+	lastActivityTime time.Time
+	isStalled        bool
+	closeOnce        sync.Once
+	stopWatchdog     chan struct{}
+}
+
+func newReadStallConn(conn net.Conn, clock clock, timeout time.Duration) *readStallConn {
+	stallConn := &readStallConn{
+		Conn:             conn,
+		clock:            clock,
+		timeout:          timeout,
+		lastActivityTime: clock.Now(),
+		stopWatchdog:     make(chan struct{}),
+	}
+	go stallConn.watchdog()
+	return stallConn
+}
+
+func (conn *readStallConn) Read(buffer []byte) (int, error) {
+
+	conn.mutex.Lock()
+	conn.isReadPending = true
+	conn.lastActivityTime = conn.clock.Now()
+	conn.mutex.Unlock()
+
+	n, err := conn.Conn.Read(buffer)
+
+	conn.mutex.Lock()
+	conn.isReadPending = false
+	conn.lastActivityTime = conn.clock.Now()
+	isStalled := conn.isStalled
+	conn.mutex.Unlock()
+
+	if isStalled {
+		// Note: no context error to preserve error type
+		return n, errTunnelReadStalled
+	}
+
+	return n, err
+}
+
+func (conn *readStallConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.stopWatchdog)
+	})
+	return conn.Conn.Close()
+}
+
+func (conn *readStallConn) watchdog() {
+	for {
+		conn.mutex.Lock()
+		wait := conn.timeout
+		if conn.isReadPending {
+			elapsed := conn.clock.Now().Sub(conn.lastActivityTime)
+			if elapsed >= conn.timeout {
+				conn.isStalled = true
+				conn.mutex.Unlock()
+				conn.Close()
+				return
+			}
+			wait = conn.timeout - elapsed
+		}
+		conn.mutex.Unlock()
+
+		timer := conn.clock.NewTimer(wait)
+		select {
+		case <-timer.C():
+		case <-conn.stopWatchdog:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// MakeDownloadHTTPClient is a helper that sets up a http.Client
+// for use either untunneled or through a tunnel.
+func MakeDownloadHTTPClient(
+	ctx context.Context,
+	config *Config,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig,
+	skipVerify bool) (*http.Client, error) {
+
+	var httpClient *http.Client
+	var err error
+
+	if tunnel != nil {
+
+		httpClient, err = MakeTunneledHTTPClient(
+			config, tunnel, skipVerify)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+	} else {
+
+		httpClient, err = MakeUntunneledHTTPClient(
+			ctx, config, untunneledDialConfig, nil, skipVerify)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	return httpClient, nil
+}
+
+// ResumeDownload is a reusable helper that downloads requestUrl via the
+// httpClient, storing the result in downloadFilename when the download is
+// complete. Intermediate, partial downloads state is stored in
+// downloadFilename.part and downloadFilename.part.manifest; see
+// partialDownloadManifest. Any existing downloadFilename file will be
+// overwritten.
+//
+// ResumeDownload is shared by the upgrade downloader, DownloadUpgrade, and
+// the remote server list fetchers, via downloadRemoteServerListFile, so that
+// interrupted downloads of either resource are resumed rather than restarted.
+//
+// In the case where the remote object has changed while a partial download
+// is to be resumed, the partial state is reset and the download is restarted,
+// from byte zero, with the new remote object. The download is also restarted
+// when the partial download manifest is missing or is inconsistent with the
+// partial download file.
+//
+// A resumed partial download which is already complete receives 416 Range
+// Not Satisfiable. The partial download is completed only when the 416
+// response reports the entity size, in Content-Range, and that size matches
+// the partial download and its manifest; otherwise, the download restarts
+// from byte zero, with restart reason
+// DOWNLOAD_RESTART_REASON_INCONSISTENT_MANIFEST.
+//
+// When ifNoneMatchETag is specified, no download is made if the remote
+// object has the same ETag. ifNoneMatchETag has an effect only when no
+// partial download is in progress.
+//
+// If-Match requires a strong ETag, so a partial download made from a server
+// that provides only a weak ETag isn't resumed; the download restarts from
+// byte zero, with restart reason DOWNLOAD_RESTART_REASON_WEAK_ETAG.
+//
+// The partial download is synced to disk at most once per syncBytes and
+// syncPeriod; see NewBatchingSyncFileWriter. Data lost from an unsynced
+// partial download is simply downloaded again on resume. The completed
+// download is always synced before it's renamed to downloadFilename.
+//
+// A crash in the middle of a write may leave a torn, corrupt tail in the
+// partial download. When ctx specifies resume verify bytes, set with
+// withDownloadResumeVerifyBytes, the Range request for a resumed download
+// overlaps that many bytes already on disk, and the overlapping bytes are
+// compared with the tail of the partial download. On divergence, the partial
+// download is rewound to the first differing byte, and is rewritten from the
+// server's bytes, rather than completing a corrupt download.
+//
+func ResumeDownload(
+	ctx context.Context,
+	httpClient *http.Client,
+	downloadURL string,
+	userAgent string,
+	downloadFilename string,
+	ifNoneMatchETag string,
+	syncBytes int,
+	syncPeriod time.Duration) (int64, string, error) {
+
+	partial, err := openPartialDownloadFile(ctx, downloadFilename, syncBytes, syncPeriod)
+	if err != nil {
+		return 0, "", common.ContextError(err)
+	}
+	defer partial.close()
+
+	return resumeDownload(ctx, httpClient, downloadURL, userAgent, partial, ifNoneMatchETag)
+}
+
+// resumeDownload is ResumeDownload with the partial download stored in
+// partial.
+func resumeDownload(
+	ctx context.Context,
+	httpClient *http.Client,
+	downloadURL string,
+	userAgent string,
+	partial partialDownload,
+	ifNoneMatchETag string) (int64, string, error) {
+
+	// A partial download should have an ETag which is to be sent with the
+	// Range request to ensure that the source object is the same as the
+	// one that is partially downloaded.
+	manifest, offset, err := openPartialDownload(ctx, partial)
+	if err != nil {
+		return 0, "", common.ContextError(err)
+	}
+
+	var partialETag []byte
+	if manifest != nil {
+		partialETag = []byte(manifest.ETag)
+	}
+
+	verifyBytes := int64(getDownloadResumeVerifyBytes(ctx))
+
+	var response *http.Response
+	var overlap int64
+
+	for {
+
+		overlap = 0
+		if partialETag != nil && verifyBytes > 0 {
+			overlap = verifyBytes
+			if overlap > offset {
+				overlap = offset
+			}
+		}
+
+		request, err := http.NewRequest("GET", downloadURL, nil)
+		if err != nil {
+			return 0, "", common.ContextError(err)
+		}
+
+		request = request.WithContext(ctx)
+
+		request.Header.Set("User-Agent", userAgent)
+
+		request.Header.Add("Range", fmt.Sprintf("bytes=%d-", offset-overlap))
+
+		if partialETag != nil {
+
+			// Note: not using If-Range, since not all host servers support it.
+			// Using If-Match means we need to check for status code 412 and reset
+			// when the ETag has changed since the last partial download.
+			request.Header.Add("If-Match", string(partialETag))
+
+		} else if ifNoneMatchETag != "" {
+
+			// Can't specify both If-Match and If-None-Match. Behavior is undefined.
+			// https://www.w3.org/Protocols/rfc2616/rfc2616-sec14.html#sec14.26
+			// So for downloaders that store an ETag and wish to use that to prevent
+			// redundant downloads, that ETag is sent as If-None-Match in the case
+			// where a partial download is not in progress. When a partial download
+			// is in progress, the partial ETag is sent as If-Match: either that's
+			// a version that was never fully received, or it's no longer current in
+			// which case the response will be StatusPreconditionFailed, the partial
+			// download will be discarded, and the download restarts from byte zero
+			// with If-None-Match; so a restart still receives StatusNotModified
+			// when the current remote object is the one already downloaded.
+
+			// Note: in this case, offset == 0
+
+			request.Header.Add("If-None-Match", ifNoneMatchETag)
+		}
+
+		response, err = httpClient.Do(request)
+
+		// The resumeable download may ask for bytes past the resource range
+		// since it doesn't store the "completed download" state. In this case,
+		// the HTTP server returns 416. Otherwise, we expect 206. We may also
+		// receive 412 on ETag mismatch.
+		if err == nil &&
+			(response.StatusCode != http.StatusPartialContent &&
+
+				// Certain http servers return 200 OK where we expect 206, so accept that.
+				response.StatusCode != http.StatusOK &&
+
+				response.StatusCode != http.StatusRequestedRangeNotSatisfiable &&
+				response.StatusCode != http.StatusPreconditionFailed &&
+				response.StatusCode != http.StatusNotModified) {
+			response.Body.Close()
+			err = fmt.Errorf("unexpected response status code: %d", response.StatusCode)
+		}
+		if err != nil {
+			return 0, "", common.ContextError(err)
+		}
+
+		if response.StatusCode == http.StatusPreconditionFailed && partialETag != nil {
+
+			// The remote object has changed since the partial download began; for
+			// example, server-side automation has replaced the entity. Appending
+			// the new object's bytes to the partial download would produce a
+			// corrupt file, so truncate the partial download and immediately
+			// restart from byte zero.
+
+			response.Body.Close()
+
+			err = partial.truncate(0)
+			if err != nil {
+				return 0, "", common.ContextError(err)
+			}
+
+			partial.removeManifest()
+
+			NoticeInfo("partial download ETag mismatch: restarting download")
+
+			reportDownloadRestart(ctx, DOWNLOAD_RESTART_REASON_ETAG_MISMATCH)
+
+			partialETag = nil
+			offset = 0
+			continue
+		}
+
+		if response.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+
+			response.Body.Close()
+
+			// The Range request starts at or past the end of the remote entity.
+			// If-Match is evaluated before Range, so, when resuming, the entity
+			// is the one partially downloaded, and the partial download is
+			// complete when its size is the entity size reported in the 416
+			// Content-Range, "bytes */<size>", and recorded in the manifest.
+			// Any other partial download doesn't match the entity, and the
+			// download restarts from byte zero.
+
+			responseETag := response.Header.Get("ETag")
+			totalBytes := parseUnsatisfiedContentRange(response)
+
+			if totalBytes == offset &&
+				(offset == 0 ||
+					(partialETag != nil &&
+						(responseETag == "" || responseETag == string(partialETag)) &&
+						(manifest.ContentLength < 0 || manifest.ContentLength == offset))) {
+
+				err = partial.sync()
+				if err != nil {
+					return 0, "", common.ContextError(err)
+				}
+				err = partial.complete()
+				if err != nil {
+					return 0, "", common.ContextError(err)
+				}
+
+				return 0, string(partialETag), nil
+			}
+
+			if offset == 0 {
+				return 0, "", common.ContextError(
+					fmt.Errorf("unexpected response status code: %d", response.StatusCode))
+			}
+
+			err = partial.truncate(0)
+			if err != nil {
+				return 0, "", common.ContextError(err)
+			}
+
+			partial.removeManifest()
+
+			NoticeInfo("partial download doesn't match remote entity size: restarting download")
+
+			reportDownloadRestart(ctx, DOWNLOAD_RESTART_REASON_INCONSISTENT_MANIFEST)
+
+			partialETag = nil
+			offset = 0
+			continue
+		}
+
+		break
+	}
+	defer response.Body.Close()
+
+	responseETag := response.Header.Get("ETag")
+
+	if response.StatusCode == http.StatusPreconditionFailed {
+		// If-Match is only sent when resuming, and that case is handled above, so
+		// this response is not expected. Delete any partial download and rely on
+		// the caller's retry schedule.
+		partial.discard()
+		reportDownloadRestart(ctx, DOWNLOAD_RESTART_REASON_ETAG_MISMATCH)
+		return 0, "", common.ContextError(errors.New("partial download ETag mismatch"))
+
+	} else if response.StatusCode == http.StatusNotModified {
+		// This status code is possible in the "If-None-Match" case. Don't leave
+		// any partial download in progress. Caller should check that responseETag
+		// matches ifNoneMatchETag.
+		partial.discard()
+		return 0, responseETag, nil
+	}
+
+	// A 200 OK response contains the entire entity, so any partial download
+	// must be discarded rather than appended to. This happens when the server
+	// doesn't support Range requests; or, with contentDecodingTransport, when
+	// resuming a compressed download.
+	if response.StatusCode == http.StatusOK && offset > 0 {
+
+		NoticeInfo("download server ignored range request: restarting download")
+
+		reportDownloadRestart(ctx, DOWNLOAD_RESTART_REASON_NO_RANGE_SUPPORT)
+
+		err = partial.truncate(0)
+		if err != nil {
+			return 0, "", common.ContextError(err)
+		}
+
+		offset = 0
+		overlap = 0
+	}
+
+	// The entity size reported by the server, or -1 when unknown.
+
+	expectedSize := int64(-1)
+	if response.StatusCode == http.StatusPartialContent {
+		_, _, totalSize, err := parseContentRange(response)
+		if err == nil {
+			expectedSize = totalSize
+		} else if response.ContentLength >= 0 {
+			expectedSize = offset - overlap + response.ContentLength
+		}
+	} else if response.ContentLength >= 0 {
+		expectedSize = response.ContentLength
+	}
+
+	if overlap > 0 {
+		offset, err = verifyPartialDownloadTail(
+			ctx, partial, offset, overlap, response.Body)
+		if err != nil {
+			return 0, "", common.ContextError(err)
+		}
+	}
+
+	// Not making failure to write the manifest fatal, in case the entire
+	// download succeeds in this one request.
+	manifest = &partialDownloadManifest{
+		URL:           downloadURL,
+		ETag:          responseETag,
+		ContentLength: expectedSize,
+		Offset:        offset,
+		Version:       getDownloadVersion(ctx),
+	}
+	partial.storeManifest(manifest)
+
+	// The manifest offset is advanced as the partial download is synced, so
+	// that the synced bytes may be resumed after a process restart.
+	recordOffset := func() {
+		size, err := partial.size()
+		if err == nil {
+			manifest.Offset = size
+			partial.storeManifest(manifest)
+		}
+	}
+
+	// A partial download occurs when this copy is interrupted. The io.Copy
+	// will fail, leaving a partial download in place (.part and .part.manifest).
+	partial.setSyncHook(recordOffset)
+	n, err := io.Copy(&offsetWriter{writer: partial, offset: offset}, response.Body)
+
+	// From this point, n bytes are indicated as downloaded, even if there is
+	// an error; the caller may use this to report partial download progress.
+
+	if err != nil {
+		if partial.sync() == nil {
+			recordOffset()
+		}
+		return n, "", common.ContextError(err)
+	}
+
+	// io.Copy doesn't fail when the server closes the response body early
+	// and the transport doesn't detect the short body; for example, with
+	// chunked encoding. Check the download against the entity size reported
+	// by the server. A short download is retained as a partial download, to
+	// be resumed by the caller's retry, and isn't renamed into place.
+
+	if expectedSize >= 0 {
+		size, err := partial.size()
+		if err != nil {
+			return n, "", common.ContextError(err)
+		}
+		if size < expectedSize {
+			if partial.sync() == nil {
+				recordOffset()
+			}
+			return n, "", common.ContextError(
+				fmt.Errorf(
+					"incomplete download: %d of %d bytes",
+					size, expectedSize))
+		}
+	}
+
+	// Ensure the partial download is flushed to disk before it's completed.
+	err = partial.sync()
+	if err != nil {
+		return n, "", common.ContextError(err)
+	}
+	err = partial.complete()
+	if err != nil {
+		return n, "", common.ContextError(err)
+	}
+
+	return n, responseETag, nil
+}
+
+// verifyPartialDownloadTail reads the overlap bytes at the start of body, which
+// the server sent for the overlap bytes preceding offset, and compares them
+// with the same bytes of the partial download. When they differ, or body is
+// short, the partial download is truncated to the first differing byte and
+// the remaining overlap bytes from the server are written in place.
+// verifyPartialDownloadTail returns the resulting partial download size.
+func verifyPartialDownloadTail(
+	ctx context.Context,
+	partial partialDownload,
+	offset int64,
+	overlap int64,
+	body io.Reader) (int64, error) {
+
+	start := offset - overlap
+
+	serverBytes := make([]byte, overlap)
+	n, err := io.ReadFull(body, serverBytes)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, common.ContextError(err)
+	}
+	serverBytes = serverBytes[:n]
+
+	partialBytes := make([]byte, overlap)
+	_, err = partial.ReadAt(partialBytes, start)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	i := 0
+	for i < len(serverBytes) && serverBytes[i] == partialBytes[i] {
+		i++
+	}
+
+	if int64(i) == overlap {
+		return offset, nil
+	}
+
+	rewindBytes := offset - (start + int64(i))
+
+	NoticeInfo("partial download tail mismatch: rewinding %d bytes", rewindBytes)
+
+	reportDownloadRewind(ctx, rewindBytes)
+
+	err = partial.truncate(start + int64(i))
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	_, err = partial.WriteAt(serverBytes[i:], start+int64(i))
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	return start + int64(len(serverBytes)), nil
+}
+
+// ResumeDownloadConcurrently is a variant of ResumeDownload which splits the
+// download into chunks of chunkSize bytes and fetches up to maxConcurrency
+// chunks in parallel, using Range requests made with httpClient. Each chunk
+// is written at its offset in the same partial download file used by
+// ResumeDownload, so partial downloads may be resumed by either function.
+//
+// Every chunk request includes If-Match with the ETag of the entity, so a
+// change to the remote entity in the middle of the download is detected. In
+// this case, the partial download is discarded and an error is returned.
+//
+// When interrupted, the partial download is truncated to the longest
+// contiguous range of completed chunks, which is retained for resuming.
+//
+// When the server doesn't support Range requests -- it responds with 200
+// instead of 206 -- or doesn't provide a strong ETag or total entity size,
+// ResumeDownloadConcurrently falls back to a sequential ResumeDownload.
+//
+// As in ResumeDownload, the first chunk request for a resumed download
+// overlaps the tail of the partial download when ctx specifies resume verify
+// bytes, and a torn tail is rewound and rewritten from the server's bytes.
+//
+// syncBytes and syncPeriod are as in ResumeDownload.
+func ResumeDownloadConcurrently(
+	ctx context.Context,
+	httpClient *http.Client,
+	downloadURL string,
+	userAgent string,
+	downloadFilename string,
+	maxConcurrency int,
+	chunkSize int64,
+	syncBytes int,
+	syncPeriod time.Duration) (int64, string, error) {
+
+	partial, err := openPartialDownloadFile(ctx, downloadFilename, syncBytes, syncPeriod)
+	if err != nil {
+		return 0, "", common.ContextError(err)
+	}
+	defer partial.close()
+
+	return resumeDownloadConcurrently(
+		ctx, httpClient, downloadURL, userAgent, partial, maxConcurrency, chunkSize)
+}
+
+// resumeDownloadConcurrently is ResumeDownloadConcurrently with the partial
+// download stored in partial.
+func resumeDownloadConcurrently(
+	ctx context.Context,
+	httpClient *http.Client,
+	downloadURL string,
+	userAgent string,
+	partial partialDownload,
+	maxConcurrency int,
+	chunkSize int64) (int64, string, error) {
+
+	manifest, offset, err := openPartialDownload(ctx, partial)
+	if err != nil {
+		return 0, "", common.ContextError(err)
+	}
+
+	var partialETag string
+	if manifest != nil {
+		partialETag = manifest.ETag
+	}
+
+	fallback := func() (int64, string, error) {
+		return resumeDownload(ctx, httpClient, downloadURL, userAgent, partial, "")
+	}
+
+	// The first chunk is requested alone, to determine the entity ETag and
+	// total size and whether the server supports Range requests. When
+	// resuming, the request also covers the overlap bytes to verify.
+
+	verifyBytes := int64(getDownloadResumeVerifyBytes(ctx))
+
+	overlap := int64(0)
+	if partialETag != "" && verifyBytes > 0 {
+		overlap = verifyBytes
+		if overlap > offset {
+			overlap = offset
+		}
+	}
+
+	response, err := makeRangeRequest(
+		ctx, httpClient, downloadURL, userAgent, offset-overlap, offset+chunkSize-1, partialETag)
+	if err != nil {
+		return 0, "", common.ContextError(err)
+	}
+
+	if response.StatusCode != http.StatusPartialContent {
+
+		// ResumeDownload handles 200, 412, and 416 responses.
+
+		response.Body.Close()
+		return fallback()
+	}
+
+	first, last, totalBytes, err := parseContentRange(response)
+	responseETag := response.Header.Get("ETag")
+	if err != nil || first != offset-overlap || responseETag == "" || isWeakETag(responseETag) {
+		response.Body.Close()
+		return fallback()
+	}
+
+	if overlap > 0 {
+		offset, err = verifyPartialDownloadTail(
+			ctx, partial, offset, overlap, response.Body)
+		if err != nil {
+			response.Body.Close()
+			return 0, "", common.ContextError(err)
+		}
+		first = offset
+	}
+
+	// Chunks may complete out of order, so the manifest offset isn't advanced
+	// until the download is interrupted, at which point the contiguous prefix
+	// of completed chunks is recorded.
+	manifest = &partialDownloadManifest{
+		URL:           downloadURL,
+		ETag:          responseETag,
+		ContentLength: totalBytes,
+		Offset:        offset,
+		Version:       getDownloadVersion(ctx),
+	}
+	partial.storeManifest(manifest)
+
+	runCtx, stopRunning := context.WithCancel(ctx)
+	defer stopRunning()
+
+	var mutex sync.Mutex
+	var firstErr error
+	var entityChanged bool
+	var bytesDownloaded int64
+	completedChunks := make(map[int64]int64)
+
+	downloadChunk := func(response *http.Response, first, last int64) {
+		defer response.Body.Close()
+
+		n, err := io.Copy(
+			&offsetWriter{writer: partial, offset: first}, response.Body)
+		if err == nil && n != last-first+1 {
+			err = io.ErrUnexpectedEOF
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		bytesDownloaded += n
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			stopRunning()
+			return
+		}
+		completedChunks[first] = last + 1
+	}
+
+	downloadChunk(response, first, last)
+
+	chunks := make(chan [2]int64)
+	waitGroup := new(sync.WaitGroup)
+
+	for i := 0; i < maxConcurrency; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for chunk := range chunks {
+				response, err := makeRangeRequest(
+					runCtx, httpClient, downloadURL, userAgent, chunk[0], chunk[1], responseETag)
+				if err == nil {
+					if response.StatusCode == http.StatusPreconditionFailed {
+						response.Body.Close()
+						mutex.Lock()
+						entityChanged = true
+						mutex.Unlock()
+						err = errors.New("partial download ETag mismatch")
+					} else if response.StatusCode != http.StatusPartialContent {
+						response.Body.Close()
+						err = fmt.Errorf("unexpected response status code: %d", response.StatusCode)
+					} else if first, last, _, _ := parseContentRange(response); first != chunk[0] || last != chunk[1] {
+						response.Body.Close()
+						err = errors.New("unexpected response content range")
+					}
+				}
+				if err != nil {
+					mutex.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mutex.Unlock()
+					stopRunning()
+					continue
+				}
+				downloadChunk(response, chunk[0], chunk[1])
+			}
+		}()
+	}
+
+enqueueLoop:
+	for first := last + 1; first < totalBytes; first += chunkSize {
+		last := first + chunkSize - 1
+		if last >= totalBytes {
+			last = totalBytes - 1
+		}
+		select {
+		case chunks <- [2]int64{first, last}:
+		case <-runCtx.Done():
+			break enqueueLoop
+		}
+	}
+	close(chunks)
+
+	waitGroup.Wait()
+
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = ctx.Err()
+	}
+
+	if firstErr != nil {
+
+		if entityChanged {
+
+			// The remote entity changed during the download. Discard the
+			// partial download so that the next attempt starts over.
+
+			partial.discard()
+
+			reportDownloadRestart(ctx, DOWNLOAD_RESTART_REASON_ETAG_MISMATCH)
+
+		} else {
+
+			// Retain only the contiguous prefix of completed chunks, which
+			// is a valid partial download for resuming.
+
+			end := offset
+			for {
+				next, ok := completedChunks[end]
+				if !ok {
+					break
+				}
+				end = next
+			}
+			partial.truncate(end)
+
+			if partial.sync() == nil {
+				manifest.Offset = end
+				partial.storeManifest(manifest)
+			}
+
+			// When no chunks are contiguous with the start of the download,
+			// all downloaded bytes are discarded.
+
+			if end == 0 && bytesDownloaded > 0 {
+				reportDownloadRestart(ctx, DOWNLOAD_RESTART_REASON_TRUNCATED)
+			}
+		}
+
+		return bytesDownloaded, "", common.ContextError(firstErr)
+	}
+
+	// Ensure the partial download is flushed to disk before it's completed.
+	err = partial.sync()
+	if err != nil {
+		return bytesDownloaded, "", common.ContextError(err)
+	}
+	err = partial.complete()
+	if err != nil {
+		return bytesDownloaded, "", common.ContextError(err)
+	}
+
+	return bytesDownloaded, responseETag, nil
+}
+
+// makeRangeRequest makes a GET request for the specified, inclusive byte
+// range. When ifMatchETag is not blank, it's sent in an If-Match header.
+func makeRangeRequest(
+	ctx context.Context,
+	httpClient *http.Client,
+	downloadURL string,
+	userAgent string,
+	first, last int64,
+	ifMatchETag string) (*http.Response, error) {
+
+	request, err := http.NewRequest("GET", downloadURL, nil)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	request = request.WithContext(ctx)
+
+	request.Header.Set("User-Agent", userAgent)
+
+	request.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", first, last))
+
+	if ifMatchETag != "" {
+		request.Header.Add("If-Match", ifMatchETag)
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return response, nil
+}
+
+// offsetWriter is an io.Writer which writes sequentially to an io.WriterAt,
+// starting at offset.
+type offsetWriter struct {
+	writer io.WriterAt
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+// downloadProgressTransport is an http.RoundTripper which wraps successful
+// response bodies in order to report download progress. The report callback
+// is invoked at most once per noticePeriod or once per noticeBytes, whichever
+// comes first, and once when a response body is fully read.
+//
+// Progress includes any partial download prefix indicated by a Content-Range
+// response header, so that reported values are correct when resuming.
+// Progress is aggregated across all responses, which accommodates concurrent
+// chunk downloads; the offset of only the first successful response is used
+// as the starting point.
+//
+// Each report also includes the current, smoothed download rate and the
+// average download rate; see downloadRateEstimator.
+type downloadProgressTransport struct {
+	transport       http.RoundTripper
+	noticePeriod    time.Duration
+	noticeBytes     int64
+	report          func(bytesWritten, totalBytes, bytesPerSecond, averageBytesPerSecond int64)
+	mutex           sync.Mutex
+	started         bool
+	bytesWritten    int64
+	totalBytes      int64
+	lastReportTime  monotime.Time
+	lastReportBytes int64
+	rateEstimator   downloadRateEstimator
+}
+
+func (t *downloadProgressTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+
+	response, err := t.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK &&
+		response.StatusCode != http.StatusPartialContent {
+		return response, nil
+	}
+
+	offset, totalBytes := getResponseContentRange(response)
+
+	t.mutex.Lock()
+	if !t.started {
+		t.started = true
+		t.bytesWritten = offset
+		t.lastReportTime = monotime.Now()
+	}
+	t.totalBytes = totalBytes
+	t.mutex.Unlock()
+
+	response.Body = &downloadProgressReader{
+		ReadCloser: response.Body,
+		transport:  t,
+	}
+
+	return response, nil
+}
+
+func (t *downloadProgressTransport) update(n int64, completed bool) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := monotime.Now()
+
+	t.bytesWritten += n
+	t.rateEstimator.update(n, now)
+
+	if t.bytesWritten != t.lastReportBytes &&
+		(completed ||
+			t.bytesWritten-t.lastReportBytes >= t.noticeBytes ||
+			now.Sub(t.lastReportTime) >= t.noticePeriod) {
+
+		bytesPerSecond, averageBytesPerSecond := t.rateEstimator.sample(now)
+		t.report(t.bytesWritten, t.totalBytes, bytesPerSecond, averageBytesPerSecond)
+		t.lastReportTime = now
+		t.lastReportBytes = t.bytesWritten
+	}
+}
+
+const (
+	downloadRateSmoothingFactor   = 0.3
+	downloadRateIdleResetDuration = 10 * time.Second
+)
+
+// downloadRateEstimator computes download rates from the number of bytes read
+// over time. The current rate is an exponentially weighted moving average of
+// the rates observed between samples, which avoids a jittery displayed value.
+// The average rate is computed over the bytes read since the estimator
+// started, which excludes any previously downloaded partial prefix.
+//
+// When no bytes are read for downloadRateIdleResetDuration, as when a
+// download is resumed after a pause, the estimator restarts, so that the time
+// spent paused doesn't result in misleadingly low rates.
+type downloadRateEstimator struct {
+	started         bool
+	startTime       monotime.Time
+	lastUpdateTime  monotime.Time
+	bytes           int64
+	sampled         bool
+	lastSampleTime  monotime.Time
+	lastSampleBytes int64
+	smoothedRate    float64
+}
+
+// update records that n bytes were read at time now.
+func (e *downloadRateEstimator) update(n int64, now monotime.Time) {
+	if !e.started || now.Sub(e.lastUpdateTime) >= downloadRateIdleResetDuration {
+		*e = downloadRateEstimator{
+			started:        true,
+			startTime:      now,
+			lastSampleTime: now,
+		}
+	}
+	e.bytes += n
+	e.lastUpdateTime = now
+}
+
+// sample returns the smoothed current rate and the average rate, in bytes
+// per second, as of time now.
+func (e *downloadRateEstimator) sample(now monotime.Time) (int64, int64) {
+
+	if !e.started {
+		return 0, 0
+	}
+
+	elapsed := now.Sub(e.lastSampleTime).Seconds()
+	if elapsed > 0 {
+		rate := float64(e.bytes-e.lastSampleBytes) / elapsed
+		if !e.sampled {
+			e.smoothedRate = rate
+			e.sampled = true
+		} else {
+			e.smoothedRate = downloadRateSmoothingFactor*rate +
+				(1-downloadRateSmoothingFactor)*e.smoothedRate
+		}
+		e.lastSampleTime = now
+		e.lastSampleBytes = e.bytes
+	}
+
+	var averageRate float64
+	totalElapsed := now.Sub(e.startTime).Seconds()
+	if totalElapsed > 0 {
+		averageRate = float64(e.bytes) / totalElapsed
+	}
+
+	return int64(e.smoothedRate), int64(averageRate)
+}
+
+// getResponseContentRange returns the byte offset at which the response body
+// starts and the total size of the remote entity. totalBytes is -1 when the
+// total size is unknown.
+func getResponseContentRange(response *http.Response) (int64, int64) {
+
+	if response.StatusCode == http.StatusPartialContent {
+		first, _, total, err := parseContentRange(response)
+		if err == nil {
+			return first, total
+		}
+		return first, -1
+	}
+
+	return 0, response.ContentLength
+}
+
+// isWeakETag indicates whether etag is a weak validator, which servers may
+// use for semantically equivalent but not byte-identical entities. If-Match
+// always fails for weak ETags; see RFC 7232 section 3.1.
+func isWeakETag(etag string) bool {
+	return strings.HasPrefix(etag, "W/")
+}
+
+// parseUnsatisfiedContentRange parses the total entity size from the
+// Content-Range header of a 416 response, "bytes */<size>", or returns -1
+// when the header is missing or malformed.
+func parseUnsatisfiedContentRange(response *http.Response) int64 {
+	var total int64
+	_, err := fmt.Sscanf(
+		response.Header.Get("Content-Range"), "bytes */%d", &total)
+	if err != nil {
+		return -1
+	}
+	return total
+}
+
+// parseContentRange parses the byte range and total entity size from the
+// Content-Range header of a 206 response.
+func parseContentRange(response *http.Response) (int64, int64, int64, error) {
+	var first, last, total int64
+	_, err := fmt.Sscanf(
+		response.Header.Get("Content-Range"), "bytes %d-%d/%d", &first, &last, &total)
+	if err != nil {
+		return first, last, -1, common.ContextError(err)
+	}
+	return first, last, total, nil
+}
+
+type downloadProgressReader struct {
+	io.ReadCloser
+	transport *downloadProgressTransport
+}
+
+func (reader *downloadProgressReader) Read(p []byte) (int, error) {
+
+	n, err := reader.ReadCloser.Read(p)
+
+	reader.transport.update(int64(n), err == io.EOF)
+
+	return n, err
+}
+
+// contentDecodingTransport is an http.RoundTripper which decodes gzip and
+// deflate Content-Encoding response bodies. http.Transport transparently
+// decodes only responses for which it requested compression, which it never
+// does for Range requests.
+//
+// The byte range of a 206 response with a Content-Encoding refers to the
+// encoded bytes, which cannot be appended to a partial download of decoded
+// bytes. In this case, and in the case of a 416 response, where the decoded
+// offset exceeds the encoded size, the request is reissued without any Range
+// header, and the entire entity is downloaded.
+//
+// Only 200 and 206 response bodies are decoded. Decoded responses have an
+// unknown ContentLength.
+type contentDecodingTransport struct {
+	transport http.RoundTripper
+}
+
+func (t *contentDecodingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+
+	response, err := t.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	encoding := response.Header.Get("Content-Encoding")
+	if encoding == "" || encoding == "identity" {
+		return response, nil
+	}
+
+	if response.StatusCode == http.StatusPartialContent ||
+		response.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+
+		response.Body.Close()
+
+		fullRequest := new(http.Request)
+		*fullRequest = *request
+		fullRequest.Header = make(http.Header)
+		for name, values := range request.Header {
+			switch name {
+			case "Range", "If-Range", "If-Match":
+			default:
+				fullRequest.Header[name] = values
+			}
+		}
+
+		response, err = t.transport.RoundTrip(fullRequest)
+		if err != nil {
+			return nil, err
+		}
+
+		encoding = response.Header.Get("Content-Encoding")
+		if encoding == "" || encoding == "identity" {
+			return response, nil
+		}
+	}
+
+	if response.StatusCode != http.StatusOK &&
+		response.StatusCode != http.StatusPartialContent {
+		return response, nil
+	}
+
+	if request.Method != "HEAD" {
+		body, err := newContentDecoder(encoding, response.Body)
+		if err != nil {
+			response.Body.Close()
+			return nil, common.ContextError(err)
+		}
+		response.Body = body
+	}
+
+	response.Header.Del("Content-Encoding")
+	response.Header.Del("Content-Length")
+	response.ContentLength = -1
+	response.Uncompressed = true
+
+	return response, nil
+}
+
+// newContentDecoder returns a reader which decodes the encoded body. For
+// "deflate", both zlib format, as specified, and raw deflate format, as sent
+// by some servers, are supported.
+func newContentDecoder(encoding string, body io.ReadCloser) (io.ReadCloser, error) {
+
+	var reader io.Reader
+
+	switch encoding {
+
+	case "gzip", "x-gzip":
+		gzipReader, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		reader = gzipReader
+
+	case "deflate":
+		bufferedBody := bufio.NewReader(body)
+		header, err := bufferedBody.Peek(2)
+		if err == nil &&
+			header[0]&0x0f == 8 &&
+			(uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+
+			zlibReader, err := zlib.NewReader(bufferedBody)
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+			reader = zlibReader
+		} else {
+			reader = flate.NewReader(bufferedBody)
+		}
+
+	default:
+		return nil, common.ContextError(
+			fmt.Errorf("unsupported Content-Encoding: %s", encoding))
+	}
+
+	return &contentDecoderBody{Reader: reader, body: body}, nil
+}
+
+type contentDecoderBody struct {
+	io.Reader
+	body io.ReadCloser
+}
+
+func (body *contentDecoderBody) Close() error {
+	if closer, ok := body.Reader.(io.Closer); ok {
+		closer.Close()
+	}
+	return body.body.Close()
+}
+
+// rateLimitedTransport is an http.RoundTripper which wraps response bodies
+// with a token bucket rate limiter. The bucket is shared by all responses,
+// so the rate limit applies to the aggregate of concurrent downloads.
+// Throttled reads are interrupted when the request context is done, so that
+// a canceled download doesn't remain blocked on rate limiting.
+type rateLimitedTransport struct {
+	transport http.RoundTripper
+	bucket    *ratelimit.Bucket
+}
+
+func newRateLimitedTransport(
+	transport http.RoundTripper, bytesPerSecond int64) *rateLimitedTransport {
+
+	return &rateLimitedTransport{
+		transport: transport,
+		bucket:    ratelimit.NewBucketWithRate(float64(bytesPerSecond), bytesPerSecond),
+	}
+}
+
+func (t *rateLimitedTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+
+	response, err := t.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	response.Body = &rateLimitedReader{
+		ReadCloser: response.Body,
+		ctx:        request.Context(),
+		bucket:     t.bucket,
+	}
+
+	return response, nil
+}
+
+type rateLimitedReader struct {
+	io.ReadCloser
+	ctx    context.Context
+	bucket *ratelimit.Bucket
+}
+
+func (reader *rateLimitedReader) Read(p []byte) (int, error) {
+
+	// Reads are limited to the bucket capacity so that the wait for any
+	// single read is at most around one second.
+	if int64(len(p)) > reader.bucket.Capacity() {
+		p = p[:reader.bucket.Capacity()]
+	}
+
+	n, err := reader.ReadCloser.Read(p)
+
+	wait := reader.bucket.Take(int64(n))
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-reader.ctx.Done():
+			return n, reader.ctx.Err()
+		}
+	}
+
+	return n, err
 }
@@ -0,0 +1,1411 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Inc/goarista/monotime"
+)
+
+func TestResumeDownloadETagChanged(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-resume-download-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	oldEntity := bytes.Repeat([]byte("a"), 1000)
+	oldETag := `"old"`
+	newEntity := bytes.Repeat([]byte("b"), 1500)
+	newETag := `"new"`
+
+	// Seed a partial download of the old entity.
+
+	downloadFilename := filepath.Join(testDataDirName, "download")
+
+	err = ioutil.WriteFile(downloadFilename+".part", oldEntity[:400], 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	manifest := &partialDownloadManifest{
+		URL:           "http://example.com/download",
+		ETag:          oldETag,
+		ContentLength: int64(len(oldEntity)),
+		Offset:        400,
+	}
+	err = manifest.store(downloadFilename + ".part.manifest")
+	if err != nil {
+		t.Fatalf("store failed: %s", err)
+	}
+
+	// The server now has the new entity. http.ServeContent handles Range and
+	// If-Match, responding with 412 to the resume request.
+
+	var requestCount int32
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requestCount, 1)
+			w.Header().Set("ETag", newETag)
+			http.ServeContent(w, r, "", time.Now(), bytes.NewReader(newEntity))
+		}))
+	defer server.Close()
+
+	var restartReasons []string
+	ctx := withDownloadRestartHandler(
+		context.Background(),
+		func(reason string) { restartReasons = append(restartReasons, reason) })
+
+	n, responseETag, err := ResumeDownload(
+		ctx,
+		server.Client(),
+		server.URL,
+		"test-user-agent",
+		downloadFilename,
+		"",
+		0,
+		0)
+	if err != nil {
+		t.Fatalf("ResumeDownload failed: %s", err)
+	}
+
+	if n != int64(len(newEntity)) {
+		t.Fatalf("unexpected downloaded byte count: %d", n)
+	}
+
+	if responseETag != newETag {
+		t.Fatalf("unexpected ETag: %s", responseETag)
+	}
+
+	if atomic.LoadInt32(&requestCount) != 2 {
+		t.Fatalf("unexpected request count: %d", requestCount)
+	}
+
+	if len(restartReasons) != 1 ||
+		restartReasons[0] != DOWNLOAD_RESTART_REASON_ETAG_MISMATCH {
+		t.Fatalf("unexpected restart reasons: %v", restartReasons)
+	}
+
+	downloaded, err := ioutil.ReadFile(downloadFilename)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+
+	if !bytes.Equal(downloaded, newEntity) {
+		t.Fatalf("downloaded file does not match new entity")
+	}
+
+	for _, filename := range []string{
+		downloadFilename + ".part", downloadFilename + ".part.manifest"} {
+
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			t.Fatalf("unexpected partial download file: %s", filename)
+		}
+	}
+}
+
+func TestResumeDownloadClosedEarly(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-resume-download-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	entity := make([]byte, 1000)
+	for i := range entity {
+		entity[i] = byte(i)
+	}
+	entityETag := "\"entity\""
+
+	var closeEarly int32 = 1
+
+	// The server sends a chunked response body, without Content-Length, so
+	// the client transport can't detect that the body is closed early. The
+	// Content-Range header still reports the entity size.
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			var offset int
+			_, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &offset)
+			if err != nil || offset >= len(entity) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+
+			end := len(entity)
+			if atomic.CompareAndSwapInt32(&closeEarly, 1, 0) {
+				end = offset + (end-offset)/2
+			}
+
+			w.Header().Set("ETag", entityETag)
+			w.Header().Set(
+				"Content-Range",
+				fmt.Sprintf("bytes %d-%d/%d", offset, len(entity)-1, len(entity)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.(http.Flusher).Flush()
+			w.Write(entity[offset:end])
+		}))
+	defer server.Close()
+
+	downloadFilename := filepath.Join(testDataDirName, "download")
+
+	download := func() (int64, error) {
+		n, _, err := ResumeDownload(
+			context.Background(),
+			server.Client(),
+			server.URL,
+			"test-user-agent",
+			downloadFilename,
+			"",
+			0,
+			0)
+		return n, err
+	}
+
+	// The first download is incomplete; the partial download is retained and
+	// the download isn't renamed into place.
+
+	n, err := download()
+	if err == nil {
+		t.Fatalf("ResumeDownload unexpectedly succeeded")
+	}
+
+	if n != int64(len(entity)/2) {
+		t.Fatalf("unexpected downloaded byte count: %d", n)
+	}
+
+	if _, err := os.Stat(downloadFilename); !os.IsNotExist(err) {
+		t.Fatalf("unexpected download file")
+	}
+
+	fileInfo, err := os.Stat(downloadFilename + ".part")
+	if err != nil || fileInfo.Size() != int64(len(entity)/2) {
+		t.Fatalf("unexpected partial download: %v", err)
+	}
+
+	// The retry resumes and completes the download.
+
+	n, err = download()
+	if err != nil {
+		t.Fatalf("ResumeDownload failed: %s", err)
+	}
+
+	if n != int64(len(entity)/2) {
+		t.Fatalf("unexpected downloaded byte count: %d", n)
+	}
+
+	downloaded, err := ioutil.ReadFile(downloadFilename)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+
+	if !bytes.Equal(downloaded, entity) {
+		t.Fatalf("downloaded file does not match entity")
+	}
+}
+
+func TestResumeDownloadManifest(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-resume-download-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	entity := make([]byte, 1000)
+	for i := range entity {
+		entity[i] = byte(i)
+	}
+	entityETag := `"entity"`
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", entityETag)
+			http.ServeContent(w, r, "", time.Now(), bytes.NewReader(entity))
+		}))
+	defer server.Close()
+
+	// Each case simulates a process restart, with a partial download and
+	// manifest left in place by a previous process.
+
+	testCases := []struct {
+		description           string
+		partialSize           int
+		manifest              *partialDownloadManifest
+		version               string
+		expectedDownloadBytes int
+		expectedRestartReason string
+	}{
+		{
+			"valid manifest",
+			400,
+			&partialDownloadManifest{ETag: entityETag, ContentLength: 1000, Offset: 400},
+			"",
+			600,
+			"",
+		},
+		{
+			"unsynced bytes past manifest offset",
+			500,
+			&partialDownloadManifest{ETag: entityETag, ContentLength: 1000, Offset: 400},
+			"",
+			600,
+			"",
+		},
+		{
+			"valid manifest with version",
+			400,
+			&partialDownloadManifest{ETag: entityETag, ContentLength: 1000, Offset: 400, Version: "2"},
+			"2",
+			600,
+			"",
+		},
+		{
+			"missing manifest",
+			400,
+			nil,
+			"",
+			1000,
+			DOWNLOAD_RESTART_REASON_MISSING_ETAG,
+		},
+		{
+			"manifest offset past partial download",
+			400,
+			&partialDownloadManifest{ETag: entityETag, ContentLength: 1000, Offset: 500},
+			"",
+			1000,
+			DOWNLOAD_RESTART_REASON_INCONSISTENT_MANIFEST,
+		},
+		{
+			"manifest offset past content length",
+			400,
+			&partialDownloadManifest{ETag: entityETag, ContentLength: 300, Offset: 400},
+			"",
+			1000,
+			DOWNLOAD_RESTART_REASON_INCONSISTENT_MANIFEST,
+		},
+		{
+			"manifest version mismatch",
+			400,
+			&partialDownloadManifest{ETag: entityETag, ContentLength: 1000, Offset: 400, Version: "1"},
+			"2",
+			1000,
+			DOWNLOAD_RESTART_REASON_INCONSISTENT_MANIFEST,
+		},
+		{
+			"weak ETag",
+			400,
+			&partialDownloadManifest{ETag: "W/" + entityETag, ContentLength: 1000, Offset: 400},
+			"",
+			1000,
+			DOWNLOAD_RESTART_REASON_WEAK_ETAG,
+		},
+		{
+			"completed partial download",
+			1000,
+			&partialDownloadManifest{ETag: entityETag, ContentLength: 1000, Offset: 1000},
+			"",
+			0,
+			"",
+		},
+		{
+			"completed partial download of unknown length",
+			1000,
+			&partialDownloadManifest{ETag: entityETag, ContentLength: -1, Offset: 1000},
+			"",
+			0,
+			"",
+		},
+		{
+			"partial download past entity size",
+			1200,
+			&partialDownloadManifest{ETag: entityETag, ContentLength: -1, Offset: 1200},
+			"",
+			1000,
+			DOWNLOAD_RESTART_REASON_INCONSISTENT_MANIFEST,
+		},
+	}
+
+	for i, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			downloadFilename := filepath.Join(
+				testDataDirName, fmt.Sprintf("download-%d", i))
+
+			// The partial download is corrupted past the manifest offset, as if
+			// those bytes were never synced, to check that they're discarded.
+
+			partial := make([]byte, testCase.partialSize)
+			copy(partial, entity)
+			if testCase.manifest != nil && testCase.partialSize > int(testCase.manifest.Offset) {
+				for j := int(testCase.manifest.Offset); j < len(partial); j++ {
+					partial[j] = 0xff
+				}
+			}
+
+			err := ioutil.WriteFile(downloadFilename+".part", partial, 0600)
+			if err != nil {
+				t.Fatalf("WriteFile failed: %s", err)
+			}
+
+			if testCase.manifest != nil {
+				err = testCase.manifest.store(downloadFilename + ".part.manifest")
+				if err != nil {
+					t.Fatalf("store failed: %s", err)
+				}
+			}
+
+			var restartReasons []string
+			ctx := withDownloadRestartHandler(
+				withDownloadVersion(context.Background(), testCase.version),
+				func(reason string) { restartReasons = append(restartReasons, reason) })
+
+			n, _, err := ResumeDownload(
+				ctx,
+				server.Client(),
+				server.URL,
+				"test-user-agent",
+				downloadFilename,
+				"",
+				0,
+				0)
+			if err != nil {
+				t.Fatalf("ResumeDownload failed: %s", err)
+			}
+
+			if n != int64(testCase.expectedDownloadBytes) {
+				t.Fatalf("unexpected downloaded byte count: %d", n)
+			}
+
+			if testCase.expectedRestartReason == "" {
+				if len(restartReasons) != 0 {
+					t.Fatalf("unexpected restart reasons: %v", restartReasons)
+				}
+			} else if len(restartReasons) != 1 ||
+				restartReasons[0] != testCase.expectedRestartReason {
+				t.Fatalf("unexpected restart reasons: %v", restartReasons)
+			}
+
+			downloaded, err := ioutil.ReadFile(downloadFilename)
+			if err != nil {
+				t.Fatalf("ReadFile failed: %s", err)
+			}
+
+			if !bytes.Equal(downloaded, entity) {
+				t.Fatalf("downloaded file does not match entity")
+			}
+
+			if _, err := os.Stat(downloadFilename + ".part.manifest"); !os.IsNotExist(err) {
+				t.Fatalf("unexpected partial download manifest")
+			}
+		})
+	}
+}
+
+func TestResumeDownloadLegacyETag(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-resume-download-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	entity := make([]byte, 1000)
+	for i := range entity {
+		entity[i] = byte(i)
+	}
+	entityETag := `"entity"`
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", entityETag)
+			http.ServeContent(w, r, "", time.Now(), bytes.NewReader(entity))
+		}))
+	defer server.Close()
+
+	// Seed a partial download with a legacy .part.etag sidecar, as left by a
+	// previous version, in place of a manifest.
+
+	downloadFilename := filepath.Join(testDataDirName, "download")
+
+	err = ioutil.WriteFile(downloadFilename+".part", entity[:400], 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	err = ioutil.WriteFile(downloadFilename+".part.etag", []byte(entityETag), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	var restartReasons []string
+	ctx := withDownloadRestartHandler(
+		withDownloadVersion(context.Background(), "2"),
+		func(reason string) { restartReasons = append(restartReasons, reason) })
+
+	n, _, err := ResumeDownload(
+		ctx,
+		server.Client(),
+		server.URL,
+		"test-user-agent",
+		downloadFilename,
+		"",
+		0,
+		0)
+	if err != nil {
+		t.Fatalf("ResumeDownload failed: %s", err)
+	}
+
+	// The partial download is resumed, not restarted.
+
+	if n != 600 || len(restartReasons) != 0 {
+		t.Fatalf("unexpected resume: %d bytes, restarts %v", n, restartReasons)
+	}
+
+	downloaded, err := ioutil.ReadFile(downloadFilename)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+
+	if !bytes.Equal(downloaded, entity) {
+		t.Fatalf("downloaded file does not match entity")
+	}
+
+	for _, filename := range []string{
+		downloadFilename + ".part",
+		downloadFilename + ".part.manifest",
+		downloadFilename + ".part.etag"} {
+
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			t.Fatalf("unexpected partial download file: %s", filename)
+		}
+	}
+}
+
+func TestResumeDownloadInterruptedManifest(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-resume-download-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	entity := bytes.Repeat([]byte("a"), 1000)
+	entityETag := `"entity"`
+
+	// The server sends half of the entity and then aborts the response.
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", entityETag)
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(entity)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(entity[:len(entity)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}))
+	defer server.Close()
+
+	downloadFilename := filepath.Join(testDataDirName, "download")
+
+	_, _, err = ResumeDownload(
+		withDownloadVersion(context.Background(), "2"),
+		server.Client(),
+		server.URL,
+		"test-user-agent",
+		downloadFilename,
+		"",
+		0,
+		0)
+	if err == nil {
+		t.Fatalf("ResumeDownload unexpectedly succeeded")
+	}
+
+	// The manifest records the interrupted partial download, for resuming
+	// after a restart.
+
+	manifest, err := loadPartialDownloadManifest(downloadFilename + ".part.manifest")
+	if err != nil {
+		t.Fatalf("loadPartialDownloadManifest failed: %s", err)
+	}
+
+	expectedManifest := partialDownloadManifest{
+		URL:           server.URL,
+		ETag:          entityETag,
+		ContentLength: int64(len(entity)),
+		Offset:        int64(len(entity) / 2),
+		Version:       "2",
+	}
+
+	if *manifest != expectedManifest {
+		t.Fatalf("unexpected manifest: %+v", *manifest)
+	}
+}
+
+func TestResumeDownloadConcurrently(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	entity := make([]byte, 10000)
+	for i := range entity {
+		entity[i] = byte(i)
+	}
+	entityETag := `"entity"`
+	chunkSize := int64(1000)
+
+	// failOffset, when not -1, specifies a Range request offset for which
+	// the server fails. changeAfter, when > 0, specifies a number of requests
+	// after which the server replaces the entity. ignoreRange specifies that
+	// the server responds with the full entity. weakETag specifies that the
+	// server sends a weak ETag.
+
+	var requestCount, failOffset, changeAfter, ignoreRange, weakETag int32
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			count := atomic.AddInt32(&requestCount, 1)
+			if fail := atomic.LoadInt32(&failOffset); fail != -1 &&
+				r.Header.Get("Range") == fmt.Sprintf("bytes=%d-%d", fail, int64(fail)+chunkSize-1) {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			ETag, content := entityETag, entity
+			if after := atomic.LoadInt32(&changeAfter); after > 0 && count > after {
+				ETag, content = `"changed"`, bytes.Repeat([]byte("c"), len(entity))
+			}
+			if atomic.LoadInt32(&weakETag) == 1 {
+				ETag = "W/" + ETag
+			}
+			w.Header().Set("ETag", ETag)
+			if atomic.LoadInt32(&ignoreRange) == 1 {
+				w.Write(content)
+				return
+			}
+			http.ServeContent(w, r, "", time.Now(), bytes.NewReader(content))
+		}))
+	defer server.Close()
+
+	for _, testCase := range []struct {
+		description    string
+		maxConcurrency int
+		failOffset     int32
+		changeAfter    int32
+		ignoreRange    int32
+		weakETag       int32
+		expectSuccess  bool
+		expectPartial  int64
+	}{
+		{"concurrent", 4, -1, 0, 0, 0, true, 0},
+		{"sequential chunks", 1, -1, 0, 0, 0, true, 0},
+		{"range not supported", 4, -1, 0, 1, 0, true, 0},
+		{"weak ETag", 4, -1, 0, 0, 1, true, 0},
+		{"entity changed", 4, -1, 3, 0, 0, false, -1},
+		{"interrupted", 1, 5000, 0, 0, 0, false, 5000},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			testDataDirName, err := ioutil.TempDir("", "psiphon-resume-download-test")
+			if err != nil {
+				t.Fatalf("TempDir failed: %s", err)
+			}
+			defer os.RemoveAll(testDataDirName)
+
+			downloadFilename := filepath.Join(testDataDirName, "download")
+
+			atomic.StoreInt32(&requestCount, 0)
+			atomic.StoreInt32(&failOffset, testCase.failOffset)
+			atomic.StoreInt32(&changeAfter, testCase.changeAfter)
+			atomic.StoreInt32(&ignoreRange, testCase.ignoreRange)
+			atomic.StoreInt32(&weakETag, testCase.weakETag)
+
+			download := func() (int64, string, error) {
+				return ResumeDownloadConcurrently(
+					context.Background(),
+					server.Client(),
+					server.URL,
+					"test-user-agent",
+					downloadFilename,
+					testCase.maxConcurrency,
+					chunkSize,
+					0,
+					0)
+			}
+
+			n, responseETag, err := download()
+
+			if !testCase.expectSuccess {
+				if err == nil {
+					t.Fatalf("ResumeDownloadConcurrently unexpectedly succeeded")
+				}
+
+				fileInfo, statErr := os.Stat(downloadFilename + ".part")
+				if testCase.expectPartial == -1 {
+					if !os.IsNotExist(statErr) {
+						t.Fatalf("unexpected partial download")
+					}
+					return
+				}
+				if statErr != nil || fileInfo.Size() != testCase.expectPartial {
+					t.Fatalf("unexpected partial download: %v", statErr)
+				}
+
+				// Resume the partial download.
+
+				atomic.StoreInt32(&failOffset, -1)
+
+				n, responseETag, err = download()
+				if n != int64(len(entity))-testCase.expectPartial {
+					t.Fatalf("unexpected resumed byte count: %d", n)
+				}
+			}
+
+			if err != nil {
+				t.Fatalf("ResumeDownloadConcurrently failed: %s", err)
+			}
+
+			expectedETag := entityETag
+			if testCase.weakETag == 1 {
+				expectedETag = "W/" + entityETag
+			}
+			if responseETag != expectedETag {
+				t.Fatalf("unexpected ETag: %s", responseETag)
+			}
+
+			downloaded, err := ioutil.ReadFile(downloadFilename)
+			if err != nil {
+				t.Fatalf("ReadFile failed: %s", err)
+			}
+
+			if !bytes.Equal(downloaded, entity) {
+				t.Fatalf("downloaded file does not match entity")
+			}
+
+			if testCase.expectSuccess && n != int64(len(entity)) {
+				t.Fatalf("unexpected downloaded byte count: %d", n)
+			}
+		})
+	}
+}
+
+func TestTunneledHTTPClientTimeouts(t *testing.T) {
+
+	// The server stalls, for the specified path, until the test completes.
+
+	stopStalling := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/stall-header":
+				<-stopStalling
+			case "/stall-body":
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+				<-stopStalling
+			}
+		}))
+	defer server.Close()
+	defer close(stopStalling)
+
+	dial := func(addr string) (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}
+
+	stallingDial := func(addr string) (net.Conn, error) {
+		<-stopStalling
+		return nil, errors.New("dial stopped")
+	}
+
+	timeout := 100 * time.Millisecond
+
+	for _, testCase := range []struct {
+		description string
+		dial        func(addr string) (net.Conn, error)
+		path        string
+		timeouts    HTTPClientTimeouts
+	}{
+		{"dial", stallingDial, "/", HTTPClientTimeouts{Dial: timeout}},
+		{"response header", dial, "/stall-header", HTTPClientTimeouts{ResponseHeader: timeout}},
+		{"overall", dial, "/stall-body", HTTPClientTimeouts{Overall: timeout}},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			httpClient, err := makeTunneledHTTPClient(
+				&Config{}, testCase.dial, false, testCase.timeouts)
+			if err != nil {
+				t.Fatalf("makeTunneledHTTPClient failed: %s", err)
+			}
+
+			startTime := time.Now()
+
+			response, err := httpClient.Get(server.URL + testCase.path)
+			if err == nil {
+				_, err = ioutil.ReadAll(response.Body)
+				response.Body.Close()
+			}
+			if err == nil {
+				t.Fatalf("request unexpectedly succeeded")
+			}
+
+			if time.Since(startTime) > 10*timeout {
+				t.Fatalf("timeout not applied")
+			}
+		})
+	}
+}
+
+func TestTunneledHTTPClientUserAgent(t *testing.T) {
+
+	var requestHeaders atomic.Value
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requestHeaders.Store(r.Header)
+		}))
+	defer server.Close()
+
+	dial := func(addr string) (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}
+
+	initMockUserAgentPicker()
+
+	configuredUserAgent := "Mozilla/5.0 (Windows NT 10.0; Win64; x64)"
+	requestUserAgent := MakePsiphonUserAgent(&Config{ClientVersion: "1"})
+
+	for _, testCase := range []struct {
+		description        string
+		config             *Config
+		ctx                context.Context
+		expectedUserAgents []string
+	}{
+		{
+			"default",
+			&Config{},
+			context.Background(),
+			[]string{requestUserAgent},
+		},
+		{
+			"configured",
+			&Config{HTTPUserAgent: configuredUserAgent},
+			context.Background(),
+			[]string{configuredUserAgent},
+		},
+		{
+			"randomized",
+			&Config{HTTPUserAgent: configuredUserAgent, RandomizeHTTPUserAgent: true},
+			context.Background(),
+			mockUserAgents,
+		},
+		{
+			"per-request override",
+			&Config{HTTPUserAgent: configuredUserAgent},
+			WithHTTPUserAgent(context.Background(), "override"),
+			[]string{"override"},
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			httpClient, err := makeTunneledHTTPClient(
+				testCase.config, dial, false, HTTPClientTimeouts{})
+			if err != nil {
+				t.Fatalf("makeTunneledHTTPClient failed: %s", err)
+			}
+
+			request, err := http.NewRequest("GET", server.URL, nil)
+			if err != nil {
+				t.Fatalf("NewRequest failed: %s", err)
+			}
+			request = request.WithContext(testCase.ctx)
+			request.Header.Set("User-Agent", requestUserAgent)
+			request.Header.Set("Range", "bytes=1-")
+
+			response, err := httpClient.Do(request)
+			if err != nil {
+				t.Fatalf("Do failed: %s", err)
+			}
+			response.Body.Close()
+
+			headers := requestHeaders.Load().(http.Header)
+
+			userAgent := headers.Get("User-Agent")
+			found := false
+			for _, expectedUserAgent := range testCase.expectedUserAgents {
+				if userAgent == expectedUserAgent {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatalf("unexpected User-Agent: %s", userAgent)
+			}
+
+			if headers.Get("Range") != "bytes=1-" {
+				t.Fatalf("unexpected Range: %s", headers.Get("Range"))
+			}
+
+			// The caller's request is not modified.
+
+			if request.Header.Get("User-Agent") != requestUserAgent {
+				t.Fatalf("request modified")
+			}
+		})
+	}
+}
+
+func TestTunneledHTTPClientCertificatePinning(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	dial := func(addr string) (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}
+
+	certificate := server.Certificate()
+
+	certificatePEM := string(pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}))
+
+	hash := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(hash[:])
+
+	wrongHash := sha256.Sum256([]byte("wrong"))
+	wrongPin := base64.StdEncoding.EncodeToString(wrongHash[:])
+
+	for _, testCase := range []struct {
+		description string
+		config      *Config
+		expectError bool
+		expectPin   bool
+	}{
+		{
+			"untrusted self-signed",
+			&Config{},
+			true,
+			false,
+		},
+		{
+			"trusted CA",
+			&Config{TrustedCACertificatesPEM: certificatePEM},
+			false,
+			false,
+		},
+		{
+			"trusted CA with pin",
+			&Config{
+				TrustedCACertificatesPEM: certificatePEM,
+				PinnedSPKIHashes:         []string{wrongPin, pin},
+			},
+			false,
+			false,
+		},
+		{
+			"trusted CA with wrong pin",
+			&Config{
+				TrustedCACertificatesPEM: certificatePEM,
+				PinnedSPKIHashes:         []string{wrongPin},
+			},
+			true,
+			true,
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			client, err := makeTunneledHTTPClient(
+				testCase.config, dial, false, HTTPClientTimeouts{Overall: 5 * time.Second})
+			if err != nil {
+				t.Fatalf("makeTunneledHTTPClient failed: %s", err)
+			}
+
+			response, err := client.Get(server.URL)
+			if err == nil {
+				response.Body.Close()
+			}
+
+			if (err != nil) != testCase.expectError {
+				t.Fatalf("unexpected result: %v", err)
+			}
+
+			if errors.Is(err, ErrCertificatePinMismatch) != testCase.expectPin {
+				t.Fatalf("unexpected pin mismatch result: %v", err)
+			}
+		})
+	}
+}
+
+func TestTunneledHTTPClientTLSProfile(t *testing.T) {
+
+	var mutex sync.Mutex
+	var clientHellos []*tls.ClientHelloInfo
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	server.EnableHTTP2 = true
+	server.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			mutex.Lock()
+			clientHellos = append(clientHellos, hello)
+			mutex.Unlock()
+			return nil, nil
+		},
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	dial := func(addr string) (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}
+
+	certificate := server.Certificate()
+
+	certificatePEM := string(pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}))
+
+	wrongHash := sha256.Sum256([]byte("wrong"))
+	wrongPin := base64.StdEncoding.EncodeToString(wrongHash[:])
+
+	isGREASE := func(value uint16) bool {
+		return value&0x0f0f == 0x0a0a
+	}
+
+	for _, testCase := range []struct {
+		description      string
+		config           *Config
+		expectError      bool
+		expectPin        bool
+		checkClientHello func(cipherSuites []uint16) bool
+	}{
+		{
+			"Chrome",
+			&Config{TrustedCACertificatesPEM: certificatePEM, TLSProfile: TLSProfileChrome},
+			false,
+			false,
+			func(cipherSuites []uint16) bool {
+				return len(cipherSuites) > 1 &&
+					isGREASE(cipherSuites[0]) &&
+					cipherSuites[1] == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+			},
+		},
+		{
+			"Firefox",
+			&Config{TrustedCACertificatesPEM: certificatePEM, TLSProfile: TLSProfileFirefox},
+			false,
+			false,
+			func(cipherSuites []uint16) bool {
+				return len(cipherSuites) > 10 &&
+					cipherSuites[0] == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 &&
+					cipherSuites[10] == 0x0033 // TLS_DHE_RSA_WITH_AES_128_CBC_SHA
+			},
+		},
+		{
+			"Randomized",
+			&Config{TrustedCACertificatesPEM: certificatePEM, TLSProfile: TLSProfileRandomized},
+			false,
+			false,
+			nil,
+		},
+		{
+			"untrusted self-signed",
+			&Config{TLSProfile: TLSProfileChrome},
+			true,
+			false,
+			nil,
+		},
+		{
+			"trusted CA with wrong pin",
+			&Config{
+				TrustedCACertificatesPEM: certificatePEM,
+				PinnedSPKIHashes:         []string{wrongPin},
+				TLSProfile:               TLSProfileChrome,
+			},
+			true,
+			true,
+			nil,
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			mutex.Lock()
+			clientHellos = nil
+			mutex.Unlock()
+
+			// Each client dials a new TLS connection.
+
+			for i := 0; i < 3; i++ {
+
+				client, err := makeTunneledHTTPClient(
+					testCase.config, dial, false, HTTPClientTimeouts{Overall: 5 * time.Second})
+				if err != nil {
+					t.Fatalf("makeTunneledHTTPClient failed: %s", err)
+				}
+
+				response, err := client.Get(server.URL)
+				if err == nil {
+					response.Body.Close()
+				}
+
+				if (err != nil) != testCase.expectError {
+					t.Fatalf("unexpected result: %v", err)
+				}
+
+				if errors.Is(err, ErrCertificatePinMismatch) != testCase.expectPin {
+					t.Fatalf("unexpected pin mismatch result: %v", err)
+				}
+
+				if err == nil && response.ProtoMajor != 1 {
+					t.Fatalf("unexpected protocol: %s", response.Proto)
+				}
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			distinctCipherSuites := make(map[string]bool)
+			for _, hello := range clientHellos {
+
+				if len(hello.SupportedProtos) != 1 || hello.SupportedProtos[0] != "http/1.1" {
+					t.Fatalf("unexpected ALPN protocols: %v", hello.SupportedProtos)
+				}
+
+				if testCase.checkClientHello != nil &&
+					!testCase.checkClientHello(hello.CipherSuites) {
+					t.Fatalf("unexpected cipher suites: %x", hello.CipherSuites)
+				}
+
+				distinctCipherSuites[fmt.Sprintf("%x", hello.CipherSuites)] = true
+			}
+
+			if len(clientHellos) != 3 {
+				t.Fatalf("unexpected ClientHello count: %d", len(clientHellos))
+			}
+
+			if testCase.config.TLSProfile == TLSProfileRandomized &&
+				len(distinctCipherSuites) < 2 {
+				t.Fatalf("ClientHello not randomized")
+			}
+		})
+	}
+}
+
+func TestTunneledHTTPClientHTTP2(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-http2-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	entity := make([]byte, 100000)
+	for i := range entity {
+		entity[i] = byte(i)
+	}
+	entityETag := "\"entity\""
+
+	dial := func(addr string) (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}
+
+	for i, testCase := range []struct {
+		description          string
+		serverHTTP2          bool
+		disableTunneledHTTP2 bool
+		expectProtoMajor     int
+	}{
+		{"HTTP/2 server", true, false, 2},
+		{"HTTP/2 server with HTTP/2 disabled", true, true, 1},
+		{"HTTP/1.1 server", false, false, 1},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			server := httptest.NewUnstartedServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("ETag", entityETag)
+					http.ServeContent(w, r, "", time.Now(), bytes.NewReader(entity))
+				}))
+			server.EnableHTTP2 = testCase.serverHTTP2
+			server.StartTLS()
+			defer server.Close()
+
+			config := &Config{
+				TrustedCACertificatesPEM: string(pem.EncodeToMemory(
+					&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})),
+				DisableTunneledHTTP2: testCase.disableTunneledHTTP2,
+			}
+
+			client, err := makeTunneledHTTPClient(
+				config, dial, false, HTTPClientTimeouts{Overall: 10 * time.Second})
+			if err != nil {
+				t.Fatalf("makeTunneledHTTPClient failed: %s", err)
+			}
+
+			response, err := makeRangeRequest(
+				context.Background(), client, server.URL, "test-user-agent", 100, 199, entityETag)
+			if err != nil {
+				t.Fatalf("makeRangeRequest failed: %s", err)
+			}
+			body, err := ioutil.ReadAll(response.Body)
+			response.Body.Close()
+			if err != nil {
+				t.Fatalf("ReadAll failed: %s", err)
+			}
+
+			if response.ProtoMajor != testCase.expectProtoMajor {
+				t.Fatalf("unexpected protocol: %s", response.Proto)
+			}
+
+			if response.StatusCode != http.StatusPartialContent ||
+				!bytes.Equal(body, entity[100:200]) {
+
+				t.Fatalf("unexpected range response: %d", response.StatusCode)
+			}
+
+			// Concurrent Range requests share the HTTP/2 connection.
+
+			downloadFilename := filepath.Join(
+				testDataDirName, fmt.Sprintf("download-%d", i))
+
+			_, _, err = ResumeDownloadConcurrently(
+				context.Background(),
+				client,
+				server.URL,
+				"test-user-agent",
+				downloadFilename,
+				4,
+				10000,
+				0,
+				0)
+			if err != nil {
+				t.Fatalf("ResumeDownloadConcurrently failed: %s", err)
+			}
+
+			downloaded, err := ioutil.ReadFile(downloadFilename)
+			if err != nil {
+				t.Fatalf("ReadFile failed: %s", err)
+			}
+
+			if !bytes.Equal(downloaded, entity) {
+				t.Fatalf("downloaded file does not match entity")
+			}
+		})
+	}
+}
+
+func TestReadStallConn(t *testing.T) {
+
+	clock := newFakeClock(false)
+	timeout := 10 * time.Second
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+
+	conn := newReadStallConn(clientConn, clock, timeout)
+	defer conn.Close()
+
+	buffer := make([]byte, 1024)
+
+	// While bytes flow, the conn isn't closed, even though the total time
+	// exceeds the timeout.
+
+	for i := 0; i < 5; i++ {
+		go serverConn.Write([]byte("data"))
+		_, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+		clock.Advance(timeout / 2)
+	}
+
+	// No bytes are sent, so the pending Read stalls.
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(buffer)
+		result <- err
+	}()
+
+	for i := 0; ; i++ {
+		select {
+		case err := <-result:
+			if err != errTunnelReadStalled {
+				t.Fatalf("unexpected Read error: %v", err)
+			}
+			_, err = serverConn.Write([]byte("data"))
+			if err == nil {
+				t.Fatalf("conn not closed")
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+			if i > 100 {
+				t.Fatalf("Read did not stall")
+			}
+			clock.Advance(timeout / 2)
+		}
+	}
+}
+
+func TestTunneledHTTPClientFakeClockTimeouts(t *testing.T) {
+
+	stopStalling := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-stopStalling
+		}))
+	defer server.Close()
+	defer close(stopStalling)
+
+	dial := func(addr string) (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}
+
+	stallingDial := func(addr string) (net.Conn, error) {
+		<-stopStalling
+		return nil, errors.New("dial stopped")
+	}
+
+	// With the fake clock, the long timeouts expire only when the clock is
+	// advanced, without any real waiting.
+
+	timeout := time.Hour
+
+	for _, testCase := range []struct {
+		description string
+		dial        func(addr string) (net.Conn, error)
+		timeouts    HTTPClientTimeouts
+	}{
+		{"dial", stallingDial, HTTPClientTimeouts{Dial: timeout}},
+		{"overall", dial, HTTPClientTimeouts{Overall: timeout}},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			clock := newFakeClock(false)
+
+			httpClient, err := makeTunneledHTTPClient(
+				&Config{clock: clock}, testCase.dial, false, testCase.timeouts)
+			if err != nil {
+				t.Fatalf("makeTunneledHTTPClient failed: %s", err)
+			}
+
+			result := make(chan error, 1)
+
+			go func() {
+				response, err := httpClient.Get(server.URL)
+				if err == nil {
+					_, err = ioutil.ReadAll(response.Body)
+					response.Body.Close()
+				}
+				result <- err
+			}()
+
+			clock.WaitForTimers(1)
+
+			select {
+			case <-result:
+				t.Fatalf("request completed before timeout")
+			default:
+			}
+
+			clock.Advance(timeout)
+
+			err = <-result
+			if err == nil {
+				t.Fatalf("request unexpectedly succeeded")
+			}
+		})
+	}
+}
+
+func TestDownloadRateEstimator(t *testing.T) {
+
+	var estimator downloadRateEstimator
+
+	now := monotime.Now()
+
+	// A steady 1000 bytes/second.
+
+	for i := 0; i < 10; i++ {
+		estimator.update(1000, now)
+		now = now.Add(time.Second)
+	}
+
+	rate, averageRate := estimator.sample(now)
+	if rate != 1000 || averageRate != 1000 {
+		t.Fatalf("unexpected rates: %d, %d", rate, averageRate)
+	}
+
+	// A brief burst is smoothed.
+
+	estimator.update(10000, now)
+	now = now.Add(time.Second)
+
+	rate, _ = estimator.sample(now)
+	if rate <= 1000 || rate >= 10000 {
+		t.Fatalf("unexpected smoothed rate: %d", rate)
+	}
+
+	// After a long pause, the rates reflect only the resumed download.
+
+	now = now.Add(time.Hour)
+
+	for i := 0; i < 10; i++ {
+		estimator.update(500, now)
+		now = now.Add(time.Second)
+	}
+
+	rate, averageRate = estimator.sample(now)
+	if rate != 500 || averageRate != 500 {
+		t.Fatalf("unexpected rates after pause: %d, %d", rate, averageRate)
+	}
+}
@@ -24,6 +24,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"sort"
 	"strings"
@@ -36,23 +38,72 @@ import (
 
 type noticeLogger struct {
 	logDiagnostics             int32
+	minSeverity                int32
+	timestampFormat            atomic.Value
 	mutex                      sync.Mutex
 	writer                     io.Writer
 	homepageFilename           string
 	homepageFile               *os.File
 	rotatingFilename           string
-	rotatingOlderFilename      string
 	rotatingFile               *os.File
 	rotatingFileSize           int64
 	rotatingCurrentFileSize    int64
 	rotatingSyncFrequency      int
 	rotatingCurrentNoticeCount int
+	rotatingMaxBackups         int
+	rotatingOmitsDiagnostics   bool
+	callbackQueue              chan noticeCallbackItem
+	callbackDroppedCount       int64
+	recentNotices              [][]byte
+	recentNoticesNext          int
+	repetitiveNoticeMutex      sync.Mutex
+	repetitiveNoticeStates     map[string]*repetitiveNoticeState
 }
 
+type noticeCallbackItem struct {
+	noticeType string
+	data       map[string]interface{}
+}
+
+// NOTICE_CALLBACK_QUEUE_SIZE is the maximum number of notices buffered for
+// delivery to the notice callback.
+const NOTICE_CALLBACK_QUEUE_SIZE = 1000
+
+// NOTICE_RECENT_BUFFER_SIZE is the maximum number of the most recent notices
+// retained in memory for GetRecentNotices.
+const NOTICE_RECENT_BUFFER_SIZE = 500
+
 var singletonNoticeLogger = noticeLogger{
 	writer: os.Stderr,
 }
 
+// newNoticeLogger creates a noticeLogger, separate from the process-wide
+// singletonNoticeLogger, which writes notices to writer, when not nil, and
+// delivers notices to callback, when not nil. The new noticeLogger takes
+// the current process-wide diagnostic, severity, and timestamp settings.
+func newNoticeLogger(
+	writer io.Writer,
+	callback func(noticeType string, data map[string]interface{})) *noticeLogger {
+
+	if writer == nil {
+		writer = ioutil.Discard
+	}
+
+	nl := &noticeLogger{
+		logDiagnostics: atomic.LoadInt32(&singletonNoticeLogger.logDiagnostics),
+		minSeverity:    atomic.LoadInt32(&singletonNoticeLogger.minSeverity),
+		writer:         writer,
+	}
+
+	if format, ok := singletonNoticeLogger.timestampFormat.Load().(string); ok {
+		nl.timestampFormat.Store(format)
+	}
+
+	nl.setNoticeCallback(callback, NOTICE_CALLBACK_QUEUE_SIZE)
+
+	return nl
+}
+
 // SetEmitDiagnosticNotices toggles whether diagnostic notices
 // are emitted. Diagnostic notices contain potentially sensitive
 // circumvention network information; only enable this in environments
@@ -66,10 +117,114 @@ func SetEmitDiagnosticNotices(enable bool) {
 	}
 }
 
+const (
+	NOTICE_TIMESTAMP_FORMAT_DEFAULT      = ""
+	NOTICE_TIMESTAMP_FORMAT_RFC3339_NANO = "rfc3339nano"
+	NOTICE_TIMESTAMP_FORMAT_NONE         = "none"
+)
+
+// SetNoticeTimestampFormat sets the format of the notice "timestamp" field.
+// With NOTICE_TIMESTAMP_FORMAT_DEFAULT, the timestamp is in UTC and
+// RFC3339Milli format. With NOTICE_TIMESTAMP_FORMAT_RFC3339_NANO, the
+// timestamp is in UTC and RFC3339Nano format. With
+// NOTICE_TIMESTAMP_FORMAT_NONE, the "timestamp" field is omitted, for
+// consumers which add their own timestamps.
+func SetNoticeTimestampFormat(format string) error {
+	if !isValidNoticeTimestampFormat(format) {
+		return common.ContextError(
+			fmt.Errorf("invalid notice timestamp format: %s", format))
+	}
+	singletonNoticeLogger.timestampFormat.Store(format)
+	return nil
+}
+
+func isValidNoticeTimestampFormat(format string) bool {
+	return format == NOTICE_TIMESTAMP_FORMAT_DEFAULT ||
+		format == NOTICE_TIMESTAMP_FORMAT_RFC3339_NANO ||
+		format == NOTICE_TIMESTAMP_FORMAT_NONE
+}
+
+// makeTimestamp returns the notice timestamp for the current time, in the
+// configured format, or "" when timestamps are omitted.
+func (nl *noticeLogger) makeTimestamp() string {
+	format, _ := nl.timestampFormat.Load().(string)
+	switch format {
+	case NOTICE_TIMESTAMP_FORMAT_RFC3339_NANO:
+		return time.Now().UTC().Format(time.RFC3339Nano)
+	case NOTICE_TIMESTAMP_FORMAT_NONE:
+		return ""
+	}
+	return time.Now().UTC().Format(common.RFC3339Milli)
+}
+
+const (
+	NOTICE_SEVERITY_INFO    = "info"
+	NOTICE_SEVERITY_WARNING = "warning"
+	NOTICE_SEVERITY_ALERT   = "alert"
+)
+
+// noticeSeverityLevels orders the notice severities, from least to most
+// severe.
+var noticeSeverityLevels = map[string]int32{
+	NOTICE_SEVERITY_INFO:    0,
+	NOTICE_SEVERITY_WARNING: 1,
+	NOTICE_SEVERITY_ALERT:   2,
+}
+
+// noticeTypeSeverities specifies the severity of notice types which aren't
+// NOTICE_SEVERITY_INFO. Warnings are problems which an embedder may want to
+// surface or record, such as a misconfigured local proxy or upstream proxy,
+// but from which the tunnel may recover. Alerts are error conditions.
+var noticeTypeSeverities = map[string]string{
+	"Alert":                  NOTICE_SEVERITY_ALERT,
+	"Error":                  NOTICE_SEVERITY_ALERT,
+	"SocksProxyPortInUse":    NOTICE_SEVERITY_WARNING,
+	"HttpProxyPortInUse":     NOTICE_SEVERITY_WARNING,
+	"UpstreamProxyError":     NOTICE_SEVERITY_WARNING,
+	"LocalProxyError":        NOTICE_SEVERITY_WARNING,
+	"ServerEntriesExhausted": NOTICE_SEVERITY_WARNING,
+	"FeedbackUploadFailed":   NOTICE_SEVERITY_WARNING,
+}
+
+// getNoticeSeverity returns the severity of the specified notice type.
+func getNoticeSeverity(noticeType string) string {
+	severity, ok := noticeTypeSeverities[noticeType]
+	if !ok {
+		return NOTICE_SEVERITY_INFO
+	}
+	return severity
+}
+
+// SetMinNoticeSeverity sets the minimum severity of notices which are
+// emitted. With NOTICE_SEVERITY_INFO, the default, all notices are emitted.
+// With NOTICE_SEVERITY_WARNING, only warning notices, such as
+// UpstreamProxyError, and alert notices, Alert and Error, are emitted; and
+// with NOTICE_SEVERITY_ALERT, only alert notices are emitted.
+//
+// Notices below the minimum severity are omitted from all notice outputs,
+// including the notice callback. Embedders which track tunnel state using,
+// for example, the Tunnels notice, should not set a minimum severity.
+func SetMinNoticeSeverity(severity string) error {
+	level, ok := noticeSeverityLevels[severity]
+	if !ok {
+		return common.ContextError(
+			fmt.Errorf("invalid notice severity: %s", severity))
+	}
+	atomic.StoreInt32(&singletonNoticeLogger.minSeverity, level)
+	return nil
+}
+
 // GetEmitDiagnoticNotices returns the current state
 // of emitting diagnostic notices.
 func GetEmitDiagnoticNotices() bool {
-	return atomic.LoadInt32(&singletonNoticeLogger.logDiagnostics) == 1
+	return singletonNoticeLogger.getEmitDiagnosticNotices()
+}
+
+func (nl *noticeLogger) getEmitDiagnosticNotices() bool {
+	if nl == nil {
+		nl = &singletonNoticeLogger
+	}
+	return atomic.LoadInt32(&nl.logDiagnostics) == 1
 }
 
 // SetNoticeWriter sets a target writer to receive notices. By default,
@@ -88,10 +243,14 @@ func GetEmitDiagnoticNotices() bool {
 // - "showUser": whether the information should be displayed to the user. For example, this flag is set for "SocksProxyPortInUse"
 // as the user should be informed that their configured choice of listening port could not be used. Core clients should
 // anticipate that the core will add additional "showUser"=true notices in the future and emit at least the raw notice.
-// - "timestamp": UTC timezone, RFC3339Milli format timestamp for notice event
+// - "timestamp": UTC timezone, RFC3339Milli format timestamp for notice event. See
+// SetNoticeTimestampFormat for alternative formats, including omitting this field.
 //
 // See the Notice* functions for details on each notice meaning and payload.
 //
+// To emit notices in a human-readable format instead, wrap the writer using
+// NewNoticeConsoleRewriter.
+//
 func SetNoticeWriter(writer io.Writer) {
 
 	singletonNoticeLogger.mutex.Lock()
@@ -100,6 +259,55 @@ func SetNoticeWriter(writer io.Writer) {
 	singletonNoticeLogger.writer = writer
 }
 
+// SetNoticeCallback sets a callback to receive notices, in addition to the
+// notice writer. The callback receives the notice type and the notice data
+// payload. Set callback to nil to stop receiving notices.
+//
+// The callback is invoked on a dedicated goroutine, one notice at a time and
+// in the order in which notices are emitted. So that a blocking callback
+// cannot block the tunnel, notices are buffered in a bounded queue and, when
+// the queue is full, notices are dropped. Dropped notices are counted; see
+// GetNoticeCallbackDroppedCount. The callback may call Notice functions.
+func SetNoticeCallback(callback func(noticeType string, data map[string]interface{})) {
+	singletonNoticeLogger.setNoticeCallback(callback, NOTICE_CALLBACK_QUEUE_SIZE)
+}
+
+// GetNoticeCallbackDroppedCount returns the number of notices dropped, due
+// to a full queue, since the notice callback was set.
+func GetNoticeCallbackDroppedCount() int64 {
+	return atomic.LoadInt64(&singletonNoticeLogger.callbackDroppedCount)
+}
+
+func (nl *noticeLogger) setNoticeCallback(
+	callback func(noticeType string, data map[string]interface{}),
+	queueSize int) {
+
+	nl.mutex.Lock()
+	defer nl.mutex.Unlock()
+
+	// Closing the queue stops any previous callback goroutine once it has
+	// delivered its remaining, queued notices.
+	if nl.callbackQueue != nil {
+		close(nl.callbackQueue)
+		nl.callbackQueue = nil
+	}
+
+	atomic.StoreInt64(&nl.callbackDroppedCount, 0)
+
+	if callback == nil {
+		return
+	}
+
+	queue := make(chan noticeCallbackItem, queueSize)
+	nl.callbackQueue = queue
+
+	go func() {
+		for item := range queue {
+			callback(item.noticeType, item.data)
+		}
+	}()
+}
+
 // SetNoticeFiles configures files for notice writing.
 //
 // - When homepageFilename is not "", homepages are written to the specified file
@@ -143,40 +351,108 @@ func SetNoticeFiles(
 	}
 
 	if rotatingFilename != "" {
-		var err error
-		if singletonNoticeLogger.rotatingFile != nil {
-			singletonNoticeLogger.rotatingFile.Close()
-		}
-		singletonNoticeLogger.rotatingFile, err = os.OpenFile(
-			rotatingFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		err := singletonNoticeLogger.setRotatingFile(
+			rotatingFilename,
+			int64(rotatingFileSize),
+			rotatingSyncFrequency,
+			1,
+			true)
 		if err != nil {
 			return common.ContextError(err)
 		}
+	}
 
-		fileInfo, err := singletonNoticeLogger.rotatingFile.Stat()
-		if err != nil {
-			return common.ContextError(err)
-		}
+	return nil
+}
 
-		if rotatingFileSize <= 0 {
-			rotatingFileSize = 1 << 20
-		}
+// SetNoticeFile configures a rotating file to which all notices are
+// written. Unlike with SetNoticeFiles, notices continue to be written to the
+// writer, including diagnostic notices, so that a persistent log may be kept
+// while also, for example, writing to stderr.
+//
+// The file is rotated when its size exceeds maxBytes. Up to maxBackups
+// rotated older files, <filename>.1 through <filename>.<maxBackups>, with
+// <filename>.1 being the most recent, are retained. When maxBackups is 0, no
+// older files are retained. When maxBytes is <= 0, a default value is used.
+// The file is synced on rotation.
+//
+// When filename is "", any rotating file is closed and notices are no longer
+// written to a file. SetNoticeFile replaces any rotating file configured by
+// SetNoticeFiles.
+func SetNoticeFile(filename string, maxBytes int64, maxBackups int) error {
+
+	if maxBackups < 0 {
+		return common.ContextError(
+			fmt.Errorf("invalid maxBackups: %d", maxBackups))
+	}
+
+	singletonNoticeLogger.mutex.Lock()
+	defer singletonNoticeLogger.mutex.Unlock()
 
-		if rotatingSyncFrequency <= 0 {
-			rotatingSyncFrequency = 100
+	if filename == "" {
+		if singletonNoticeLogger.rotatingFile != nil {
+			singletonNoticeLogger.rotatingFile.Sync()
+			singletonNoticeLogger.rotatingFile.Close()
+			singletonNoticeLogger.rotatingFile = nil
 		}
+		return nil
+	}
 
-		singletonNoticeLogger.rotatingFilename = rotatingFilename
-		singletonNoticeLogger.rotatingOlderFilename = rotatingFilename + ".1"
-		singletonNoticeLogger.rotatingFileSize = int64(rotatingFileSize)
-		singletonNoticeLogger.rotatingCurrentFileSize = fileInfo.Size()
-		singletonNoticeLogger.rotatingSyncFrequency = rotatingSyncFrequency
-		singletonNoticeLogger.rotatingCurrentNoticeCount = 0
+	err := singletonNoticeLogger.setRotatingFile(
+		filename, maxBytes, 0, maxBackups, false)
+	if err != nil {
+		return common.ContextError(err)
 	}
 
 	return nil
 }
 
+// setRotatingFile opens the rotating notice file, closing any previous
+// rotating file. nl.mutex must be held.
+func (nl *noticeLogger) setRotatingFile(
+	filename string,
+	fileSize int64,
+	syncFrequency int,
+	maxBackups int,
+	omitDiagnostics bool) error {
+
+	if nl.rotatingFile != nil {
+		nl.rotatingFile.Close()
+		nl.rotatingFile = nil
+	}
+
+	file, err := os.OpenFile(
+		filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return common.ContextError(err)
+	}
+
+	if fileSize <= 0 {
+		fileSize = 1 << 20
+	}
+
+	if syncFrequency <= 0 {
+		syncFrequency = 100
+	}
+
+	nl.rotatingFilename = filename
+	nl.rotatingFile = file
+	nl.rotatingFileSize = fileSize
+	nl.rotatingCurrentFileSize = fileInfo.Size()
+	nl.rotatingSyncFrequency = syncFrequency
+	nl.rotatingCurrentNoticeCount = 0
+	nl.rotatingMaxBackups = maxBackups
+	nl.rotatingOmitsDiagnostics = omitDiagnostics
+
+	return nil
+}
+
 const (
 	noticeShowUser       = 1
 	noticeIsDiagnostic   = 2
@@ -186,18 +462,34 @@ const (
 )
 
 // outputNotice encodes a notice in JSON and writes it to the output writer.
+// A nil noticeLogger, the default for a Controller or Tunnel whose Config
+// specifies no notice sink, writes to the process-wide singletonNoticeLogger.
 func (nl *noticeLogger) outputNotice(noticeType string, noticeFlags uint32, args ...interface{}) {
 
+	if nl == nil {
+		nl = &singletonNoticeLogger
+	}
+
 	if (noticeFlags&noticeIsDiagnostic != 0) && atomic.LoadInt32(&nl.logDiagnostics) != 1 {
 		return
 	}
 
+	// Filter by severity before encoding, so that suppressed notices, which
+	// may be frequent, incur no serialization cost.
+	minSeverity := atomic.LoadInt32(&nl.minSeverity)
+	if minSeverity > 0 &&
+		noticeSeverityLevels[getNoticeSeverity(noticeType)] < minSeverity {
+		return
+	}
+
 	obj := make(map[string]interface{})
 	noticeData := make(map[string]interface{})
 	obj["noticeType"] = noticeType
 	obj["showUser"] = (noticeFlags&noticeShowUser != 0)
 	obj["data"] = noticeData
-	obj["timestamp"] = time.Now().UTC().Format(common.RFC3339Milli)
+	if timestamp := nl.makeTimestamp(); timestamp != "" {
+		obj["timestamp"] = timestamp
+	}
 	for i := 0; i < len(args)-1; i += 2 {
 		name, ok := args[i].(string)
 		value := args[i+1]
@@ -239,7 +531,7 @@ func (nl *noticeLogger) outputNotice(noticeType string, noticeFlags uint32, args
 
 	if nl.rotatingFile != nil {
 
-		if !skipWriter {
+		if !skipWriter && nl.rotatingOmitsDiagnostics {
 			skipWriter = (noticeFlags&noticeIsDiagnostic != 0)
 		}
 
@@ -255,14 +547,76 @@ func (nl *noticeLogger) outputNotice(noticeType string, noticeFlags uint32, args
 	if !skipWriter {
 		_, _ = nl.writer.Write(output)
 	}
+
+	nl.addRecentNotice(output)
+
+	if nl.callbackQueue != nil {
+		select {
+		case nl.callbackQueue <- noticeCallbackItem{noticeType, noticeData}:
+		default:
+			atomic.AddInt64(&nl.callbackDroppedCount, 1)
+		}
+	}
+}
+
+// addRecentNotice adds a notice to the recent notices ring buffer, replacing
+// the oldest notice when the buffer is full. The caller must hold nl.mutex.
+func (nl *noticeLogger) addRecentNotice(output []byte) {
+	if len(nl.recentNotices) < NOTICE_RECENT_BUFFER_SIZE {
+		nl.recentNotices = append(nl.recentNotices, output)
+		return
+	}
+	nl.recentNotices[nl.recentNoticesNext] = output
+	nl.recentNoticesNext = (nl.recentNoticesNext + 1) % NOTICE_RECENT_BUFFER_SIZE
+}
+
+// GetRecentNotices returns up to max of the most recently emitted notices,
+// oldest first; when max <= 0, all buffered notices are returned. Each
+// notice is the decoded notice JSON object, with "noticeType", "data", etc.
+// fields. Up to NOTICE_RECENT_BUFFER_SIZE notices are retained in memory,
+// regardless of the notice writer and without persistent logging, so that
+// they may, for example, be included in the diagnostics submitted with
+// SendFeedback. As with other notice outputs, diagnostic notices are only
+// retained when SetEmitDiagnosticNotices is enabled.
+func GetRecentNotices(max int) []map[string]interface{} {
+
+	nl := &singletonNoticeLogger
+
+	nl.mutex.Lock()
+	count := len(nl.recentNotices)
+	if max > 0 && max < count {
+		count = max
+	}
+	outputs := make([][]byte, count)
+	for i := 0; i < count; i++ {
+		index := (nl.recentNoticesNext + len(nl.recentNotices) - count + i) %
+			len(nl.recentNotices)
+		outputs[i] = nl.recentNotices[index]
+	}
+	nl.mutex.Unlock()
+
+	notices := make([]map[string]interface{}, 0, count)
+	for _, output := range outputs {
+		var notice map[string]interface{}
+		if json.Unmarshal(output, &notice) == nil {
+			notices = append(notices, notice)
+		}
+	}
+
+	return notices
 }
 
 // NoticeInteralError is an error formatting or writing notices.
 // A NoticeInteralError handler must not call a Notice function.
 func makeNoticeInternalError(errorMessage string) []byte {
 	// Format an Alert Notice (_without_ using json.Marshal, since that can fail)
+	timestamp := singletonNoticeLogger.makeTimestamp()
+	if timestamp == "" {
+		alertNoticeFormat := "{\"noticeType\":\"InternalError\",\"showUser\":false,\"data\":{\"message\":\"%s\"}}\n"
+		return []byte(fmt.Sprintf(alertNoticeFormat, errorMessage))
+	}
 	alertNoticeFormat := "{\"noticeType\":\"InternalError\",\"showUser\":false,\"timestamp\":\"%s\",\"data\":{\"message\":\"%s\"}}\n"
-	return []byte(fmt.Sprintf(alertNoticeFormat, time.Now().UTC().Format(common.RFC3339Milli), errorMessage))
+	return []byte(fmt.Sprintf(alertNoticeFormat, timestamp, errorMessage))
 
 }
 
@@ -313,9 +667,23 @@ func (nl *noticeLogger) outputNoticeToRotatingFile(output []byte) error {
 			return common.ContextError(err)
 		}
 
-		err = os.Rename(nl.rotatingFilename, nl.rotatingOlderFilename)
-		if err != nil {
-			return common.ContextError(err)
+		// Shift the older files, discarding the oldest, so that
+		// <rotatingFilename>.1 is always the most recent older file.
+
+		if nl.rotatingMaxBackups > 0 {
+
+			for i := nl.rotatingMaxBackups - 1; i > 0; i-- {
+				err = os.Rename(
+					nl.rotatingBackupFilename(i), nl.rotatingBackupFilename(i+1))
+				if err != nil && !os.IsNotExist(err) {
+					return common.ContextError(err)
+				}
+			}
+
+			err = os.Rename(nl.rotatingFilename, nl.rotatingBackupFilename(1))
+			if err != nil {
+				return common.ContextError(err)
+			}
 		}
 
 		nl.rotatingFile, err = os.OpenFile(
@@ -344,23 +712,39 @@ func (nl *noticeLogger) outputNoticeToRotatingFile(output []byte) error {
 	return nil
 }
 
+func (nl *noticeLogger) rotatingBackupFilename(index int) string {
+	return fmt.Sprintf("%s.%d", nl.rotatingFilename, index)
+}
+
 // NoticeInfo is an informational message
 func NoticeInfo(format string, args ...interface{}) {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.Info(format, args...)
+}
+
+func (nl *noticeLogger) Info(format string, args ...interface{}) {
+	nl.outputNotice(
 		"Info", noticeIsDiagnostic,
 		"message", fmt.Sprintf(format, args...))
 }
 
 // NoticeAlert is an alert message; typically a recoverable error condition
 func NoticeAlert(format string, args ...interface{}) {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.Alert(format, args...)
+}
+
+func (nl *noticeLogger) Alert(format string, args ...interface{}) {
+	nl.outputNotice(
 		"Alert", noticeIsDiagnostic,
 		"message", fmt.Sprintf(format, args...))
 }
 
 // NoticeError is an error message; typically an unrecoverable error condition
 func NoticeError(format string, args ...interface{}) {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.Error(format, args...)
+}
+
+func (nl *noticeLogger) Error(format string, args ...interface{}) {
+	nl.outputNotice(
 		"Error", noticeIsDiagnostic,
 		"message", fmt.Sprintf(format, args...))
 }
@@ -374,25 +758,101 @@ func NoticeUserLog(message string) {
 
 // NoticeCandidateServers is how many possible servers are available for the selected region and protocols
 func NoticeCandidateServers(region string, protocols []string, count int) {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.CandidateServers(region, protocols, count)
+}
+
+func (nl *noticeLogger) CandidateServers(region string, protocols []string, count int) {
+	nl.outputNotice(
 		"CandidateServers", noticeIsDiagnostic,
 		"region", region,
 		"protocols", protocols,
 		"count", count)
 }
 
+// EstablishProtocolOutcome summarizes the connection attempts made with one
+// tunnel protocol in an establishment round. Failed counts failures by
+// reason; see CONNECT_FAILURE_REASON_DIAL, etc.
+type EstablishProtocolOutcome struct {
+	Attempts  int            `json:"attempts"`
+	Succeeded int            `json:"succeeded"`
+	Failed    map[string]int `json:"failed"`
+}
+
+// NoticeEstablishRound summarizes, by tunnel protocol, the connection
+// attempts made in an establishment round, indicating which protocols are
+// failing and why.
+func NoticeEstablishRound(round int, outcomes map[string]*EstablishProtocolOutcome) {
+	singletonNoticeLogger.EstablishRound(round, outcomes)
+}
+
+func (nl *noticeLogger) EstablishRound(round int, outcomes map[string]*EstablishProtocolOutcome) {
+	nl.outputNotice(
+		"EstablishRound", 0,
+		"round", round,
+		"protocols", outcomes)
+}
+
+// NoticeServerEntriesExhausted indicates that every candidate server in a
+// complete establishment round was tried without establishing a tunnel.
+// attempts counts the connection attempts by tunnel protocol; candidates
+// skipped without an attempt are included in candidates only.
+func NoticeServerEntriesExhausted(round, candidates int, attempts map[string]int) {
+	singletonNoticeLogger.ServerEntriesExhausted(round, candidates, attempts)
+}
+
+func (nl *noticeLogger) ServerEntriesExhausted(round, candidates int, attempts map[string]int) {
+	nl.outputNotice(
+		"ServerEntriesExhausted", 0,
+		"round", round,
+		"candidates", candidates,
+		"protocols", attempts)
+}
+
+// NoticeConnectWithDeadline reports the outcome of
+// Controller.ConnectWithDeadline: whether a tunnel was established before
+// the deadline, and the time spent waiting.
+func NoticeConnectWithDeadline(connected bool, elapsed time.Duration) {
+	singletonNoticeLogger.ConnectWithDeadline(connected, elapsed)
+}
+
+func (nl *noticeLogger) ConnectWithDeadline(connected bool, elapsed time.Duration) {
+	nl.outputNotice(
+		"ConnectWithDeadline", 0,
+		"connected", connected,
+		"elapsedMilliseconds", int64(elapsed/time.Millisecond))
+}
+
 // NoticeAvailableEgressRegions is what regions are available for egress from.
 // Consecutive reports of the same list of regions are suppressed.
 func NoticeAvailableEgressRegions(regions []string) {
+	singletonNoticeLogger.AvailableEgressRegions(regions)
+}
+
+func (nl *noticeLogger) AvailableEgressRegions(regions []string) {
 	sortedRegions := append([]string(nil), regions...)
 	sort.Strings(sortedRegions)
 	repetitionMessage := strings.Join(sortedRegions, "")
-	outputRepetitiveNotice(
+	nl.outputRepetitiveNotice(
 		"AvailableEgressRegions", repetitionMessage, 0,
 		"AvailableEgressRegions", 0, "regions", sortedRegions)
 }
 
-func noticeWithDialStats(noticeType, ipAddress, region, protocol string, dialStats *DialStats) {
+// NoticeEgressRegionUnavailable indicates that there are no known servers in
+// the selected egress region that support the required tunnel protocols, and
+// so no tunnel can be established. The client may select another region from
+// those reported in AvailableEgressRegions. Consecutive reports for the same
+// region are suppressed.
+func NoticeEgressRegionUnavailable(region string) {
+	singletonNoticeLogger.EgressRegionUnavailable(region)
+}
+
+func (nl *noticeLogger) EgressRegionUnavailable(region string) {
+	nl.outputRepetitiveNotice(
+		"EgressRegionUnavailable", region, 0,
+		"EgressRegionUnavailable", noticeShowUser, "region", region)
+}
+
+func (nl *noticeLogger) noticeWithDialStats(noticeType, ipAddress, region, protocol string, dialStats *DialStats) {
 
 	args := []interface{}{
 		"ipAddress", ipAddress,
@@ -442,38 +902,112 @@ func noticeWithDialStats(noticeType, ipAddress, region, protocol string, dialSta
 		args = append(args, "TLSProfile", dialStats.TLSProfile)
 	}
 
-	singletonNoticeLogger.outputNotice(
+	args = append(args, dialStatsDurationArgs(dialStats)...)
+
+	nl.outputNotice(
 		noticeType, noticeIsDiagnostic,
 		args...)
 }
 
+// dialStatsDurationArgs returns notice args for the recorded establishment
+// phase durations, in milliseconds. Phases not yet reached are omitted.
+func dialStatsDurationArgs(dialStats *DialStats) []interface{} {
+
+	var args []interface{}
+
+	if dialStats.DialDuration > 0 {
+		args = append(args, "dialDuration", int64(dialStats.DialDuration/time.Millisecond))
+	}
+
+	if dialStats.SSHHandshakeDuration > 0 {
+		args = append(args, "SSHHandshakeDuration", int64(dialStats.SSHHandshakeDuration/time.Millisecond))
+	}
+
+	if dialStats.APIHandshakeDuration > 0 {
+		args = append(args, "APIHandshakeDuration", int64(dialStats.APIHandshakeDuration/time.Millisecond))
+	}
+
+	return args
+}
+
 // NoticeConnectingServer reports parameters and details for a single connection attempt
+// NoticeServerEntryRejected indicates that a server entry was not attempted
+// as a tunnel candidate, for the specified reason.
+func NoticeServerEntryRejected(ipAddress, reason string) {
+	singletonNoticeLogger.ServerEntryRejected(ipAddress, reason)
+}
+
+func (nl *noticeLogger) ServerEntryRejected(ipAddress, reason string) {
+	nl.outputNotice(
+		"ServerEntryRejected", noticeIsDiagnostic,
+		"ipAddress", ipAddress,
+		"reason", reason)
+}
+
 func NoticeConnectingServer(ipAddress, region, protocol string, dialStats *DialStats) {
-	noticeWithDialStats(
+	singletonNoticeLogger.ConnectingServer(ipAddress, region, protocol, dialStats)
+}
+
+func (nl *noticeLogger) ConnectingServer(ipAddress, region, protocol string, dialStats *DialStats) {
+	nl.noticeWithDialStats(
 		"ConnectingServer", ipAddress, region, protocol, dialStats)
 }
 
-// NoticeConnectedServer reports parameters and details for a single successful connection
+// NoticeConnectedServer reports parameters and details for a single successful
+// connection, including the time spent in each establishment phase. When
+// diagnostic notices are not enabled, only the region, protocol, and phase
+// timings are reported.
 func NoticeConnectedServer(ipAddress, region, protocol string, dialStats *DialStats) {
-	noticeWithDialStats(
-		"ConnectedServer", ipAddress, region, protocol, dialStats)
+	singletonNoticeLogger.ConnectedServer(ipAddress, region, protocol, dialStats)
+}
+
+func (nl *noticeLogger) ConnectedServer(ipAddress, region, protocol string, dialStats *DialStats) {
+
+	if nl.getEmitDiagnosticNotices() {
+		nl.noticeWithDialStats(
+			"ConnectedServer", ipAddress, region, protocol, dialStats)
+		return
+	}
+
+	args := []interface{}{
+		"region", region,
+		"protocol", protocol,
+	}
+
+	args = append(args, dialStatsDurationArgs(dialStats)...)
+
+	nl.outputNotice(
+		"ConnectedServer", 0,
+		args...)
 }
 
 // NoticeRequestingTactics reports parameters and details for a tactics request attempt
 func NoticeRequestingTactics(ipAddress, region, protocol string, dialStats *DialStats) {
-	noticeWithDialStats(
+	singletonNoticeLogger.RequestingTactics(ipAddress, region, protocol, dialStats)
+}
+
+func (nl *noticeLogger) RequestingTactics(ipAddress, region, protocol string, dialStats *DialStats) {
+	nl.noticeWithDialStats(
 		"RequestingTactics", ipAddress, region, protocol, dialStats)
 }
 
 // NoticeRequestedTactics reports parameters and details for a successful tactics request
 func NoticeRequestedTactics(ipAddress, region, protocol string, dialStats *DialStats) {
-	noticeWithDialStats(
+	singletonNoticeLogger.RequestedTactics(ipAddress, region, protocol, dialStats)
+}
+
+func (nl *noticeLogger) RequestedTactics(ipAddress, region, protocol string, dialStats *DialStats) {
+	nl.noticeWithDialStats(
 		"RequestedTactics", ipAddress, region, protocol, dialStats)
 }
 
 // NoticeActiveTunnel is a successful connection that is used as an active tunnel for port forwarding
 func NoticeActiveTunnel(ipAddress, protocol string, isTCS bool) {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.ActiveTunnel(ipAddress, protocol, isTCS)
+}
+
+func (nl *noticeLogger) ActiveTunnel(ipAddress, protocol string, isTCS bool) {
+	nl.outputNotice(
 		"ActiveTunnel", noticeIsDiagnostic,
 		"ipAddress", ipAddress,
 		"protocol", protocol,
@@ -482,36 +1016,130 @@ func NoticeActiveTunnel(ipAddress, protocol string, isTCS bool) {
 
 // NoticeSocksProxyPortInUse is a failure to use the configured LocalSocksProxyPort
 func NoticeSocksProxyPortInUse(port int) {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.SocksProxyPortInUse(port)
+}
+
+func (nl *noticeLogger) SocksProxyPortInUse(port int) {
+	nl.outputNotice(
 		"SocksProxyPortInUse",
 		noticeShowUser, "port", port)
 }
 
-// NoticeListeningSocksProxyPort is the selected port for the listening local SOCKS proxy
-func NoticeListeningSocksProxyPort(port int) {
-	singletonNoticeLogger.outputNotice(
+// NoticeListeningSocksProxyPort is the selected port, and full listening
+// address, for the listening local SOCKS proxy
+func NoticeListeningSocksProxyPort(port int, address string) {
+	singletonNoticeLogger.ListeningSocksProxyPort(port, address)
+}
+
+func (nl *noticeLogger) ListeningSocksProxyPort(port int, address string) {
+	nl.outputNotice(
 		"ListeningSocksProxyPort", 0,
-		"port", port)
+		"port", port,
+		"address", address)
 }
 
 // NoticeHttpProxyPortInUse is a failure to use the configured LocalHttpProxyPort
 func NoticeHttpProxyPortInUse(port int) {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.HttpProxyPortInUse(port)
+}
+
+func (nl *noticeLogger) HttpProxyPortInUse(port int) {
+	nl.outputNotice(
 		"HttpProxyPortInUse", noticeShowUser,
 		"port", port)
 }
 
-// NoticeListeningHttpProxyPort is the selected port for the listening local HTTP proxy
-func NoticeListeningHttpProxyPort(port int) {
-	singletonNoticeLogger.outputNotice(
+// NoticeListeningHttpProxyPort is the selected port, and full listening
+// address, for the listening local HTTP proxy
+func NoticeListeningHttpProxyPort(port int, address string) {
+	singletonNoticeLogger.ListeningHttpProxyPort(port, address)
+}
+
+func (nl *noticeLogger) ListeningHttpProxyPort(port int, address string) {
+	nl.outputNotice(
 		"ListeningHttpProxyPort", 0,
-		"port", port)
+		"port", port,
+		"address", address)
+}
+
+// NoticeListeningHealthCheck is the listening address of the health check
+// endpoint.
+func NoticeListeningHealthCheck(address string) {
+	singletonNoticeLogger.ListeningHealthCheck(address)
+}
+
+func (nl *noticeLogger) ListeningHealthCheck(address string) {
+	nl.outputNotice(
+		"ListeningHealthCheck", 0,
+		"address", address)
+}
+
+// NoticeListeningPACServer is the URL of the local PAC file endpoint.
+func NoticeListeningPACServer(URL string) {
+	singletonNoticeLogger.ListeningPACServer(URL)
+}
+
+func (nl *noticeLogger) ListeningPACServer(URL string) {
+	nl.outputNotice(
+		"ListeningPACServer", 0,
+		"url", URL)
+}
+
+// NoticeLocalProxyThrottled reports that the local proxy of the specified
+// type, "SOCKS" or "HTTP", rejected a connection as it would exceed the
+// specified port forward limit, PORT_FORWARD_LIMIT_TOTAL or
+// PORT_FORWARD_LIMIT_PER_HOST. Consecutive reports of the same limit are
+// suppressed.
+func NoticeLocalProxyThrottled(proxyType, limit string) {
+	singletonNoticeLogger.LocalProxyThrottled(proxyType, limit)
+}
+
+func (nl *noticeLogger) LocalProxyThrottled(proxyType, limit string) {
+	nl.outputRepetitiveNotice(
+		"LocalProxyThrottled"+proxyType, limit, 0,
+		"LocalProxyThrottled", 0,
+		"proxyType", proxyType,
+		"limit", limit)
+}
+
+// NoticeConnectionRejected reports that a ConnectionFilter rejected a port
+// forward to destination, with the filter's reason.
+//
+// Note: "destination" should remain private; this notice should only be used
+// for alerting users, not for diagnostics logs.
+func NoticeConnectionRejected(destination, reason string) {
+	singletonNoticeLogger.ConnectionRejected(destination, reason)
+}
+
+func (nl *noticeLogger) ConnectionRejected(destination, reason string) {
+	nl.outputNotice(
+		"ConnectionRejected", noticeShowUser,
+		"destination", destination,
+		"reason", reason)
+}
+
+// NoticeLocalProxyDisabled reports that the local proxy of the specified
+// type, "SOCKS" or "HTTP", is disabled and not listening. Enabled local
+// proxies report their listening ports with NoticeListeningSocksProxyPort
+// and NoticeListeningHttpProxyPort.
+func NoticeLocalProxyDisabled(proxyType string) {
+	singletonNoticeLogger.LocalProxyDisabled(proxyType)
+}
+
+func (nl *noticeLogger) LocalProxyDisabled(proxyType string) {
+	nl.outputNotice(
+		"LocalProxyDisabled", 0,
+		"type", proxyType)
 }
 
 // NoticeClientUpgradeAvailable is an available client upgrade, as per the handshake. The
 // client should download and install an upgrade.
 func NoticeClientUpgradeAvailable(version string) {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.ClientUpgradeAvailable(version)
+}
+
+func (nl *noticeLogger) ClientUpgradeAvailable(version string) {
+	nl.outputNotice(
 		"ClientUpgradeAvailable", 0,
 		"version", version)
 }
@@ -520,14 +1148,105 @@ func NoticeClientUpgradeAvailable(version string) {
 // is already the latest version. availableVersion is the version available for download,
 // if known.
 func NoticeClientIsLatestVersion(availableVersion string) {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.ClientIsLatestVersion(availableVersion)
+}
+
+func (nl *noticeLogger) ClientIsLatestVersion(availableVersion string) {
+	nl.outputNotice(
 		"ClientIsLatestVersion", 0,
 		"availableVersion", availableVersion)
 }
 
+// NoticeClientUpgradeNotFound reports that the upgrade download server
+// responded with statusCode, 404 or 410, indicating that the upgrade is no
+// longer available. availableVersion is the version that was to be
+// downloaded, if known.
+func NoticeClientUpgradeNotFound(availableVersion string, statusCode int) {
+	singletonNoticeLogger.ClientUpgradeNotFound(availableVersion, statusCode)
+}
+
+func (nl *noticeLogger) ClientUpgradeNotFound(availableVersion string, statusCode int) {
+	nl.outputNotice(
+		"ClientUpgradeNotFound", 0,
+		"availableVersion", availableVersion,
+		"statusCode", statusCode)
+}
+
+// NoticeClientUpgradeDownloadRestart reports that the partial upgrade
+// download of availableVersion was discarded, and the download restarted
+// from the beginning, for the specified reason; see
+// DOWNLOAD_RESTART_REASON_ETAG_MISMATCH, etc.
+func NoticeClientUpgradeDownloadRestart(availableVersion, reason string) {
+	singletonNoticeLogger.ClientUpgradeDownloadRestart(availableVersion, reason)
+}
+
+func (nl *noticeLogger) ClientUpgradeDownloadRestart(availableVersion, reason string) {
+	nl.outputNotice(
+		"ClientUpgradeDownloadRestart", 0,
+		"availableVersion", availableVersion,
+		"reason", reason)
+}
+
+// NoticeClientUpgradeDownloadRewind reports that the tail of the resumed
+// partial upgrade download of availableVersion didn't match the download
+// server's bytes, and that rewindBytes bytes were discarded and downloaded
+// again. The rest of the partial download was retained.
+func NoticeClientUpgradeDownloadRewind(availableVersion string, rewindBytes int64) {
+	singletonNoticeLogger.ClientUpgradeDownloadRewind(availableVersion, rewindBytes)
+}
+
+func (nl *noticeLogger) ClientUpgradeDownloadRewind(availableVersion string, rewindBytes int64) {
+	nl.outputNotice(
+		"ClientUpgradeDownloadRewind", 0,
+		"availableVersion", availableVersion,
+		"rewindBytes", rewindBytes)
+}
+
+// NoticeClientUpgradeDownloadRetryAfter reports that the upgrade download
+// server is throttling requests, with a 503 Retry-After response, and that
+// the next download attempt is delayed accordingly.
+func NoticeClientUpgradeDownloadRetryAfter(availableVersion string, delay time.Duration) {
+	singletonNoticeLogger.ClientUpgradeDownloadRetryAfter(availableVersion, delay)
+}
+
+func (nl *noticeLogger) ClientUpgradeDownloadRetryAfter(availableVersion string, delay time.Duration) {
+	nl.outputNotice(
+		"ClientUpgradeDownloadRetryAfter", 0,
+		"availableVersion", availableVersion,
+		"delayMilliseconds", int64(delay/time.Millisecond))
+}
+
+// NoticeUpgradeCheckScheduled reports the delay, computed by
+// GetUpgradeCheckDelay, before the next periodic upgrade check.
+func NoticeUpgradeCheckScheduled(delay time.Duration) {
+	singletonNoticeLogger.UpgradeCheckScheduled(delay)
+}
+
+func (nl *noticeLogger) UpgradeCheckScheduled(delay time.Duration) {
+	nl.outputNotice(
+		"UpgradeCheckScheduled", 0,
+		"delayMilliseconds", int64(delay/time.Millisecond))
+}
+
 // NoticeHomepages emits a series of NoticeHomepage, the sponsor homepages. The client
 // should display the sponsor's homepages.
+//
+// A single Homepages notice, listing all of the homepage URLs, is also emitted
+// for clients, such as mobile apps, that present the homepages in-app. URLs
+// are deduplicated and any URL that is not an absolute http or https URL is
+// dropped.
 func NoticeHomepages(urls []string) {
+	singletonNoticeLogger.Homepages(urls)
+}
+
+func (nl *noticeLogger) Homepages(urls []string) {
+
+	urls = filterHomepageURLs(urls)
+
+	nl.outputNotice(
+		"Homepages", 0,
+		"urls", urls)
+
 	for i, url := range urls {
 		noticeFlags := uint32(noticeIsHomepage)
 		if i == 0 {
@@ -536,19 +1255,44 @@ func NoticeHomepages(urls []string) {
 		if i == len(urls)-1 {
 			noticeFlags |= noticeSyncHomepages
 		}
-		singletonNoticeLogger.outputNotice(
+		nl.outputNotice(
 			"Homepage", noticeFlags,
 			"url", url)
 	}
 }
 
+// filterHomepageURLs returns the unique, valid http and https URLs in urls,
+// preserving their order.
+func filterHomepageURLs(urls []string) []string {
+	filtered := make([]string, 0, len(urls))
+	seen := make(map[string]bool)
+	for _, homepageURL := range urls {
+		parsedURL, err := url.Parse(homepageURL)
+		if err != nil ||
+			(parsedURL.Scheme != "http" && parsedURL.Scheme != "https") ||
+			parsedURL.Host == "" {
+			continue
+		}
+		if seen[homepageURL] {
+			continue
+		}
+		seen[homepageURL] = true
+		filtered = append(filtered, homepageURL)
+	}
+	return filtered
+}
+
 // NoticeClientVerificationRequired indicates that client verification is required, as
 // indicated by the handshake. The client should submit a client verification payload.
 // Empty nonce is allowed, if ttlSeconds is 0 the client should not send verification
 // payload to the server. If resetCache is set the client must always perform a new
 // verification and update its cache
 func NoticeClientVerificationRequired(nonce string, ttlSeconds int, resetCache bool) {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.ClientVerificationRequired(nonce, ttlSeconds, resetCache)
+}
+
+func (nl *noticeLogger) ClientVerificationRequired(nonce string, ttlSeconds int, resetCache bool) {
+	nl.outputNotice(
 		"ClientVerificationRequired", 0,
 		"nonce", nonce,
 		"ttlSeconds", ttlSeconds,
@@ -558,7 +1302,11 @@ func NoticeClientVerificationRequired(nonce string, ttlSeconds int, resetCache b
 // NoticeClientRegion is the client's region, as determined by the server and
 // reported to the client in the handshake.
 func NoticeClientRegion(region string) {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.ClientRegion(region)
+}
+
+func (nl *noticeLogger) ClientRegion(region string) {
+	nl.outputNotice(
 		"ClientRegion", 0,
 		"region", region)
 }
@@ -567,26 +1315,120 @@ func NoticeClientRegion(region string) {
 // determine connecting/unexpected disconnect state transitions. When count is 0, the core is
 // disconnected; when count > 1, the core is connected.
 func NoticeTunnels(count int) {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.Tunnels(count)
+}
+
+func (nl *noticeLogger) Tunnels(count int) {
+	nl.outputNotice(
 		"Tunnels", 0,
 		"count", count)
 }
 
+// NoticePaused indicates that the controller has paused or resumed
+// periodic tunnel traffic.
+func NoticePaused(isPaused bool) {
+	singletonNoticeLogger.Paused(isPaused)
+}
+
+func (nl *noticeLogger) Paused(isPaused bool) {
+	nl.outputNotice(
+		"Paused", 0,
+		"paused", isPaused)
+}
+
+// NoticeIdleTunnelDisconnect reports that the tunnels were disconnected
+// after idleTimeout with no port forward traffic. Tunnels are reestablished
+// on the next port forward.
+func NoticeIdleTunnelDisconnect(idleTimeout time.Duration) {
+	singletonNoticeLogger.IdleTunnelDisconnect(idleTimeout)
+}
+
+func (nl *noticeLogger) IdleTunnelDisconnect(idleTimeout time.Duration) {
+	nl.outputNotice(
+		"IdleTunnelDisconnect", noticeShowUser,
+		"idleTimeoutMilliseconds", int64(idleTimeout/time.Millisecond))
+}
+
+// NoticeDirectConnectionFallback reports that the direct connection fallback
+// has engaged or disengaged. While engaged, local proxy connections are
+// dialed directly and are NOT tunneled. The notice is always shown to the
+// user, so that they understand they are no longer protected.
+func NoticeDirectConnectionFallback(engaged bool) {
+	singletonNoticeLogger.DirectConnectionFallback(engaged)
+}
+
+func (nl *noticeLogger) DirectConnectionFallback(engaged bool) {
+	nl.outputNotice(
+		"DirectConnectionFallback", noticeShowUser,
+		"engaged", engaged)
+}
+
+// NoticeSessionByteBudgetExceeded reports that the port forward bytes
+// transferred in the session have exceeded the SessionByteBudget and that
+// the tunnels are being disconnected.
+func NoticeSessionByteBudgetExceeded(budget, bytesTransferred int64) {
+	singletonNoticeLogger.outputNotice(
+		"SessionByteBudgetExceeded", noticeShowUser,
+		"budget", budget,
+		"bytesTransferred", bytesTransferred)
+}
+
+// NoticeTunnelPoolMembership reports a tunnel being added to or removed from
+// the tunnel pool, along with the resulting number of tunnels in the pool.
+func NoticeTunnelPoolMembership(added bool, tunnel *Tunnel, count int) {
+	singletonNoticeLogger.TunnelPoolMembership(added, tunnel, count)
+}
+
+func (nl *noticeLogger) TunnelPoolMembership(added bool, tunnel *Tunnel, count int) {
+	action := "removed"
+	if added {
+		action = "added"
+	}
+	nl.outputNotice(
+		"TunnelPoolMembership", noticeIsDiagnostic,
+		"action", action,
+		"ipAddress", tunnel.serverEntry.IpAddress,
+		"region", tunnel.serverEntry.Region,
+		"protocol", tunnel.protocol,
+		"count", count)
+}
+
 // NoticeSessionId is the session ID used across all tunnels established by the controller.
 func NoticeSessionId(sessionId string) {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.SessionId(sessionId)
+}
+
+func (nl *noticeLogger) SessionId(sessionId string) {
+	nl.outputNotice(
 		"SessionId", noticeIsDiagnostic,
 		"sessionId", sessionId)
 }
 
+// NoticeClientInfo reports the client instance ID, which the user may
+// provide to support. See GetClientInstanceID.
+func NoticeClientInfo(clientInstanceID string) {
+	singletonNoticeLogger.ClientInfo(clientInstanceID)
+}
+
+func (nl *noticeLogger) ClientInfo(clientInstanceID string) {
+	nl.outputNotice(
+		"ClientInfo", 0,
+		"clientInstanceID", clientInstanceID)
+}
+
 func NoticeImpairedProtocolClassification(impairedProtocolClassification map[string]int) {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.ImpairedProtocolClassification(impairedProtocolClassification)
+}
+
+func (nl *noticeLogger) ImpairedProtocolClassification(impairedProtocolClassification map[string]int) {
+	nl.outputNotice(
 		"ImpairedProtocolClassification", noticeIsDiagnostic,
 		"classification", impairedProtocolClassification)
 }
 
 // NoticeUntunneled indicates than an address has been classified as untunneled and is being
-// accessed directly.
+// accessed directly. It is emitted only the first time each address is classified as
+// untunneled.
 //
 // Note: "address" should remain private; this notice should only be used for alerting
 // users, not for diagnostics logs.
@@ -612,19 +1454,83 @@ func NoticeUpstreamProxyError(err error) {
 		"message", err.Error())
 }
 
+// NoticeFeedbackUploaded indicates that feedback was successfully uploaded
+// by SendTunneledFeedback. uploadID identifies the uploaded feedback.
+func NoticeFeedbackUploaded(uploadID string) {
+	singletonNoticeLogger.outputNotice(
+		"FeedbackUploaded", 0,
+		"uploadID", uploadID)
+}
+
+// NoticeFeedbackUploadFailed indicates that SendTunneledFeedback failed to
+// upload feedback after all retries.
+func NoticeFeedbackUploadFailed(err error) {
+	singletonNoticeLogger.outputNotice(
+		"FeedbackUploadFailed", 0,
+		"message", err.Error())
+}
+
 // NoticeClientUpgradeDownloadedBytes reports client upgrade download progress.
 func NoticeClientUpgradeDownloadedBytes(bytes int64) {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.ClientUpgradeDownloadedBytes(bytes)
+}
+
+func (nl *noticeLogger) ClientUpgradeDownloadedBytes(bytes int64) {
+	nl.outputNotice(
 		"ClientUpgradeDownloadedBytes", noticeIsDiagnostic,
 		"bytes", bytes)
 }
 
-// NoticeClientUpgradeDownloaded indicates that a client upgrade download
-// is complete and available at the destination specified.
-func NoticeClientUpgradeDownloaded(filename string) {
+// NoticeClientUpgradeDownloadProgress reports client upgrade download progress
+// for display in a progress bar. bytesWritten includes any previously downloaded
+// partial prefix. totalBytes is -1, and no percentage is reported, when the
+// total size of the upgrade is unknown. bytesPerSecond is the smoothed,
+// current download rate and averageBytesPerSecond is the average download
+// rate since the download started or resumed.
+func NoticeClientUpgradeDownloadProgress(
+	bytesWritten, totalBytes, bytesPerSecond, averageBytesPerSecond int64) {
+
+	args := []interface{}{
+		"bytesWritten", bytesWritten,
+		"totalBytes", totalBytes,
+		"bytesPerSecond", bytesPerSecond,
+		"averageBytesPerSecond", averageBytesPerSecond,
+	}
+	if totalBytes > 0 {
+		args = append(args, "percentage", int(100*bytesWritten/totalBytes))
+	}
 	singletonNoticeLogger.outputNotice(
+		"ClientUpgradeDownloadProgress", 0,
+		args...)
+}
+
+// NoticeClientUpgradeDownloadMirror reports the mirror, the index of the URL
+// within the UpgradeDownloadURLs candidates, from which an upgrade download
+// completed.
+func NoticeClientUpgradeDownloadMirror(mirrorIndex int, url string) {
+	singletonNoticeLogger.ClientUpgradeDownloadMirror(mirrorIndex, url)
+}
+
+func (nl *noticeLogger) ClientUpgradeDownloadMirror(mirrorIndex int, url string) {
+	nl.outputNotice(
+		"ClientUpgradeDownloadMirror", 0,
+		"mirror", mirrorIndex,
+		"url", url)
+}
+
+// NoticeClientUpgradeDownloaded indicates that a client upgrade download
+// is complete and available at the destination specified. alreadyDownloaded
+// indicates that the upgrade was downloaded previously and no download was
+// made; this distinguishes an existing, pending upgrade from a fresh download.
+func NoticeClientUpgradeDownloaded(filename string, alreadyDownloaded bool) {
+	singletonNoticeLogger.ClientUpgradeDownloaded(filename, alreadyDownloaded)
+}
+
+func (nl *noticeLogger) ClientUpgradeDownloaded(filename string, alreadyDownloaded bool) {
+	nl.outputNotice(
 		"ClientUpgradeDownloaded", 0,
-		"filename", filename)
+		"filename", filename,
+		"alreadyDownloaded", alreadyDownloaded)
 }
 
 // NoticeBytesTransferred reports how many tunneled bytes have been
@@ -634,7 +1540,11 @@ func NoticeClientUpgradeDownloaded(filename string) {
 // functionality such as traffic display; and this frequent notice
 // is not intended to be included with feedback.
 func NoticeBytesTransferred(ipAddress string, sent, received int64) {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.BytesTransferred(ipAddress, sent, received)
+}
+
+func (nl *noticeLogger) BytesTransferred(ipAddress string, sent, received int64) {
+	nl.outputNotice(
 		"BytesTransferred", 0,
 		"sent", sent,
 		"received", received)
@@ -644,7 +1554,11 @@ func NoticeBytesTransferred(ipAddress string, sent, received int64) {
 // transferred in total up to this point, for the tunnel to the server
 // at ipAddress. This is a diagnostic notice.
 func NoticeTotalBytesTransferred(ipAddress string, sent, received int64) {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.TotalBytesTransferred(ipAddress, sent, received)
+}
+
+func (nl *noticeLogger) TotalBytesTransferred(ipAddress string, sent, received int64) {
+	nl.outputNotice(
 		"TotalBytesTransferred", noticeIsDiagnostic,
 		"ipAddress", ipAddress,
 		"sent", sent,
@@ -654,6 +1568,10 @@ func NoticeTotalBytesTransferred(ipAddress string, sent, received int64) {
 // NoticeLocalProxyError reports a local proxy error message. Repetitive
 // errors for a given proxy type are suppressed.
 func NoticeLocalProxyError(proxyType string, err error) {
+	singletonNoticeLogger.LocalProxyError(proxyType, err)
+}
+
+func (nl *noticeLogger) LocalProxyError(proxyType string, err error) {
 
 	// For repeats, only consider the base error message, which is
 	// the root error that repeats (the full error often contains
@@ -666,7 +1584,7 @@ func NoticeLocalProxyError(proxyType string, err error) {
 		repetitionMessage = repetitionMessage[index+2:]
 	}
 
-	outputRepetitiveNotice(
+	nl.outputRepetitiveNotice(
 		"LocalProxyError"+proxyType, repetitionMessage, 1,
 		"LocalProxyError", noticeIsDiagnostic,
 		"message", err.Error())
@@ -681,13 +1599,21 @@ func NoticeBuildInfo() {
 
 // NoticeExiting indicates that tunnel-core is exiting imminently.
 func NoticeExiting() {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.Exiting()
+}
+
+func (nl *noticeLogger) Exiting() {
+	nl.outputNotice(
 		"Exiting", 0)
 }
 
 // NoticeRemoteServerListResourceDownloadedBytes reports remote server list download progress.
 func NoticeRemoteServerListResourceDownloadedBytes(url string, bytes int64) {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.RemoteServerListResourceDownloadedBytes(url, bytes)
+}
+
+func (nl *noticeLogger) RemoteServerListResourceDownloadedBytes(url string, bytes int64) {
+	nl.outputNotice(
 		"RemoteServerListResourceDownloadedBytes", noticeIsDiagnostic,
 		"url", url,
 		"bytes", bytes)
@@ -696,14 +1622,34 @@ func NoticeRemoteServerListResourceDownloadedBytes(url string, bytes int64) {
 // NoticeRemoteServerListResourceDownloaded indicates that a remote server list download
 // completed successfully.
 func NoticeRemoteServerListResourceDownloaded(url string) {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.RemoteServerListResourceDownloaded(url)
+}
+
+func (nl *noticeLogger) RemoteServerListResourceDownloaded(url string) {
+	nl.outputNotice(
 		"RemoteServerListResourceDownloaded", noticeIsDiagnostic,
 		"url", url)
 }
 
+// NoticeServerEntriesPrefetched indicates that an idle time prefetch of the
+// remote server list stored serverEntryCount new or updated server entries.
+func NoticeServerEntriesPrefetched(serverEntryCount int) {
+	singletonNoticeLogger.ServerEntriesPrefetched(serverEntryCount)
+}
+
+func (nl *noticeLogger) ServerEntriesPrefetched(serverEntryCount int) {
+	nl.outputNotice(
+		"ServerEntriesPrefetched", 0,
+		"count", serverEntryCount)
+}
+
 func NoticeClientVerificationRequestCompleted(ipAddress string) {
+	singletonNoticeLogger.ClientVerificationRequestCompleted(ipAddress)
+}
+
+func (nl *noticeLogger) ClientVerificationRequestCompleted(ipAddress string) {
 	// TODO: remove "Notice" prefix
-	singletonNoticeLogger.outputNotice(
+	nl.outputNotice(
 		"NoticeClientVerificationRequestCompleted", noticeIsDiagnostic,
 		"ipAddress", ipAddress)
 }
@@ -711,7 +1657,11 @@ func NoticeClientVerificationRequestCompleted(ipAddress string) {
 // NoticeSLOKSeeded indicates that the SLOK with the specified ID was received from
 // the Psiphon server. The "duplicate" flags indicates whether the SLOK was previously known.
 func NoticeSLOKSeeded(slokID string, duplicate bool) {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.SLOKSeeded(slokID, duplicate)
+}
+
+func (nl *noticeLogger) SLOKSeeded(slokID string, duplicate bool) {
+	nl.outputNotice(
 		"SLOKSeeded", noticeIsDiagnostic,
 		"slokID", slokID,
 		"duplicate", duplicate)
@@ -719,7 +1669,11 @@ func NoticeSLOKSeeded(slokID string, duplicate bool) {
 
 // NoticeServerTimestamp reports server side timestamp as seen in the handshake.
 func NoticeServerTimestamp(timestamp string) {
-	singletonNoticeLogger.outputNotice(
+	singletonNoticeLogger.ServerTimestamp(timestamp)
+}
+
+func (nl *noticeLogger) ServerTimestamp(timestamp string) {
+	nl.outputNotice(
 		"ServerTimestamp", 0,
 		"timestamp", timestamp)
 }
@@ -727,13 +1681,17 @@ func NoticeServerTimestamp(timestamp string) {
 // NoticeActiveAuthorizationIDs reports the authorizations the server has accepted.
 // Each ID is a base64-encoded accesscontrol.Authorization.ID value.
 func NoticeActiveAuthorizationIDs(activeAuthorizationIDs []string) {
+	singletonNoticeLogger.ActiveAuthorizationIDs(activeAuthorizationIDs)
+}
+
+func (nl *noticeLogger) ActiveAuthorizationIDs(activeAuthorizationIDs []string) {
 
 	// Never emit 'null' instead of empty list
 	if activeAuthorizationIDs == nil {
 		activeAuthorizationIDs = make([]string, 0)
 	}
 
-	singletonNoticeLogger.outputNotice(
+	nl.outputNotice(
 		"ActiveAuthorizationIDs", 0,
 		"IDs", activeAuthorizationIDs)
 }
@@ -743,24 +1701,30 @@ type repetitiveNoticeState struct {
 	repeats int
 }
 
-var repetitiveNoticeMutex sync.Mutex
-var repetitiveNoticeStates = make(map[string]*repetitiveNoticeState)
-
 // outputRepetitiveNotice conditionally outputs a notice. Used for noticies which
 // often repeat in noisy bursts. For a repeat limit of N, the notice is emitted
 // with a "repeats" count on consecutive repeats up to the limit and then suppressed
-// until the repetitionMessage differs.
-func outputRepetitiveNotice(
+// until the repetitionMessage differs. Repeats are tracked per noticeLogger, so
+// one Controller's notices don't suppress another's.
+func (nl *noticeLogger) outputRepetitiveNotice(
 	repetitionKey, repetitionMessage string, repeatLimit int,
 	noticeType string, noticeFlags uint32, args ...interface{}) {
 
-	repetitiveNoticeMutex.Lock()
-	defer repetitiveNoticeMutex.Unlock()
+	if nl == nil {
+		nl = &singletonNoticeLogger
+	}
+
+	nl.repetitiveNoticeMutex.Lock()
+	defer nl.repetitiveNoticeMutex.Unlock()
+
+	if nl.repetitiveNoticeStates == nil {
+		nl.repetitiveNoticeStates = make(map[string]*repetitiveNoticeState)
+	}
 
-	state, ok := repetitiveNoticeStates[repetitionKey]
+	state, ok := nl.repetitiveNoticeStates[repetitionKey]
 	if !ok {
 		state = new(repetitiveNoticeState)
-		repetitiveNoticeStates[repetitionKey] = state
+		nl.repetitiveNoticeStates[repetitionKey] = state
 	}
 
 	emit := true
@@ -778,7 +1742,7 @@ func outputRepetitiveNotice(
 		if state.repeats > 0 {
 			args = append(args, "repeats", state.repeats)
 		}
-		singletonNoticeLogger.outputNotice(
+		nl.outputNotice(
 			noticeType, noticeFlags,
 			args...)
 	}
@@ -853,6 +1817,14 @@ func NewNoticeConsoleRewriter(writer io.Writer) *NoticeReceiver {
 	return NewNoticeReceiver(func(notice []byte) {
 		var object noticeObject
 		_ = json.Unmarshal(notice, &object)
+		if object.Timestamp == "" {
+			fmt.Fprintf(
+				writer,
+				"%s %s\n",
+				object.NoticeType,
+				string(object.Data))
+			return
+		}
 		fmt.Fprintf(
 			writer,
 			"%s %s %s\n",
@@ -886,27 +1858,34 @@ func (writer *NoticeWriter) Write(p []byte) (n int, err error) {
 // This is used to make the notice facility available to other packages that
 // don't import the "psiphon" package.
 func NoticeCommonLogger() common.Logger {
-	return &commonLogger{}
+	return singletonNoticeLogger.CommonLogger()
+}
+
+func (nl *noticeLogger) CommonLogger() common.Logger {
+	return &commonLogger{nl: nl}
 }
 
 type commonLogger struct {
+	nl *noticeLogger
 }
 
 func (logger *commonLogger) WithContext() common.LogContext {
 	return &commonLogContext{
+		nl:      logger.nl,
 		context: common.GetParentContext(),
 	}
 }
 
 func (logger *commonLogger) WithContextFields(fields common.LogFields) common.LogContext {
 	return &commonLogContext{
+		nl:      logger.nl,
 		context: common.GetParentContext(),
 		fields:  fields,
 	}
 }
 
 func (logger *commonLogger) LogMetric(metric string, fields common.LogFields) {
-	singletonNoticeLogger.outputNotice(
+	logger.nl.outputNotice(
 		metric, noticeIsDiagnostic,
 		listCommonFields(fields)...)
 }
@@ -926,6 +1905,7 @@ func listCommonFields(fields common.LogFields) []interface{} {
 }
 
 type commonLogContext struct {
+	nl      *noticeLogger
 	context string
 	fields  common.LogFields
 }
@@ -933,7 +1913,7 @@ type commonLogContext struct {
 func (context *commonLogContext) outputNotice(
 	noticeType string, args ...interface{}) {
 
-	singletonNoticeLogger.outputNotice(
+	context.nl.outputNotice(
 		noticeType, noticeIsDiagnostic,
 		append(
 			[]interface{}{
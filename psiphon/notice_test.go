@@ -0,0 +1,490 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+func TestNoticeCallback(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	var mutex sync.Mutex
+	var received []int
+
+	SetNoticeCallback(func(noticeType string, data map[string]interface{}) {
+		if noticeType != "Test" {
+			return
+		}
+		mutex.Lock()
+		received = append(received, data["index"].(int))
+		mutex.Unlock()
+	})
+	defer SetNoticeCallback(nil)
+
+	noticeCount := 100
+
+	for i := 0; i < noticeCount; i++ {
+		singletonNoticeLogger.outputNotice("Test", 0, "index", i)
+	}
+
+	waitForNoticeCallback(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(received) == noticeCount
+	})
+
+	// Notices are delivered in order.
+
+	for i, index := range received {
+		if i != index {
+			t.Fatalf("unexpected notice order: %d at %d", index, i)
+		}
+	}
+
+	if GetNoticeCallbackDroppedCount() != 0 {
+		t.Fatalf("unexpected dropped notices")
+	}
+}
+
+func TestNoticeCallbackOverflow(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	// The callback blocks until unblocked, so the queue fills and
+	// subsequent notices are dropped.
+
+	unblock := make(chan struct{})
+	var mutex sync.Mutex
+	receivedCount := 0
+
+	queueSize := 10
+
+	singletonNoticeLogger.setNoticeCallback(
+		func(noticeType string, data map[string]interface{}) {
+			<-unblock
+			mutex.Lock()
+			receivedCount++
+			mutex.Unlock()
+		},
+		queueSize)
+	defer SetNoticeCallback(nil)
+
+	noticeCount := 100
+
+	start := time.Now()
+
+	for i := 0; i < noticeCount; i++ {
+		singletonNoticeLogger.outputNotice("Test", 0, "index", i)
+	}
+
+	// Emitting notices must not block on the callback.
+
+	if time.Since(start) > 1*time.Second {
+		t.Fatalf("emitting notices blocked")
+	}
+
+	droppedCount := int(GetNoticeCallbackDroppedCount())
+
+	// At most one notice is dequeued by the blocked callback.
+
+	if droppedCount < noticeCount-queueSize-1 {
+		t.Fatalf("unexpected dropped count: %d", droppedCount)
+	}
+
+	close(unblock)
+
+	waitForNoticeCallback(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return receivedCount == noticeCount-droppedCount
+	})
+}
+
+func waitForNoticeCallback(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for notice callback")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNoticeConnectedServer(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	notices := make(chan map[string]interface{}, 1)
+
+	SetNoticeCallback(func(noticeType string, data map[string]interface{}) {
+		if noticeType == "ConnectedServer" {
+			notices <- data
+		}
+	})
+	defer SetNoticeCallback(nil)
+
+	dialStats := &DialStats{
+		DialDuration:         100 * time.Millisecond,
+		SSHHandshakeDuration: 200 * time.Millisecond,
+		APIHandshakeDuration: 300 * time.Millisecond,
+	}
+	dialStats.MeekResolvedIPAddress.Store("")
+
+	for _, emitDiagnostics := range []bool{false, true} {
+
+		SetEmitDiagnosticNotices(emitDiagnostics)
+
+		NoticeConnectedServer("192.0.2.1", "CA", "OSSH", dialStats)
+
+		var data map[string]interface{}
+		select {
+		case data = <-notices:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for notice")
+		}
+
+		if data["region"] != "CA" ||
+			data["protocol"] != "OSSH" ||
+			data["dialDuration"] != int64(100) ||
+			data["SSHHandshakeDuration"] != int64(200) ||
+			data["APIHandshakeDuration"] != int64(300) {
+			t.Fatalf("unexpected notice data: %+v", data)
+		}
+
+		// The server IP address is reported only in diagnostic notices.
+
+		_, ok := data["ipAddress"]
+		if ok != emitDiagnostics {
+			t.Fatalf("unexpected notice data: %+v", data)
+		}
+	}
+
+	SetEmitDiagnosticNotices(false)
+}
+
+func TestNoticeHomepages(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	notices := make(chan map[string]interface{}, 1)
+
+	SetNoticeCallback(func(noticeType string, data map[string]interface{}) {
+		if noticeType == "Homepages" {
+			notices <- data
+		}
+	})
+	defer SetNoticeCallback(nil)
+
+	NoticeHomepages([]string{
+		"https://example.com/a",
+		"javascript:alert(1)",
+		"http://example.com/b",
+		"https://example.com/a",
+		"ftp://example.com/c",
+		"/relative",
+		"https://example.org/",
+	})
+
+	var data map[string]interface{}
+	select {
+	case data = <-notices:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for notice")
+	}
+
+	urls, ok := data["urls"].([]string)
+	expected := []string{
+		"https://example.com/a",
+		"http://example.com/b",
+		"https://example.org/",
+	}
+	if !ok || len(urls) != len(expected) {
+		t.Fatalf("unexpected notice data: %+v", data)
+	}
+	for i := range expected {
+		if urls[i] != expected[i] {
+			t.Fatalf("unexpected notice data: %+v", data)
+		}
+	}
+}
+
+func TestNoticeTimestampFormat(t *testing.T) {
+
+	var buffer bytes.Buffer
+	SetNoticeWriter(&buffer)
+	defer SetNoticeWriter(os.Stderr)
+	defer SetNoticeTimestampFormat(NOTICE_TIMESTAMP_FORMAT_DEFAULT)
+
+	// NoticeInfo and NoticeAlert are diagnostic notices.
+	emitDiagnosticNotices := GetEmitDiagnoticNotices()
+	SetEmitDiagnosticNotices(true)
+	defer SetEmitDiagnosticNotices(emitDiagnosticNotices)
+
+	testCases := []struct {
+		format          string
+		layout          string
+		expectTimestamp bool
+	}{
+		{NOTICE_TIMESTAMP_FORMAT_DEFAULT, common.RFC3339Milli, true},
+		{NOTICE_TIMESTAMP_FORMAT_RFC3339_NANO, time.RFC3339Nano, true},
+		{NOTICE_TIMESTAMP_FORMAT_NONE, "", false},
+	}
+
+	for _, testCase := range testCases {
+
+		err := SetNoticeTimestampFormat(testCase.format)
+		if err != nil {
+			t.Fatalf("SetNoticeTimestampFormat failed: %s", err)
+		}
+
+		buffer.Reset()
+		NoticeInfo("test")
+		NoticeAlert("test")
+		NoticeClientUpgradeDownloaded("", false)
+		buffer.Write(makeNoticeInternalError("test"))
+
+		lines := bytes.Split(bytes.TrimSpace(buffer.Bytes()), []byte("\n"))
+		if len(lines) != 4 {
+			t.Fatalf("unexpected notice count: %d", len(lines))
+		}
+
+		for _, line := range lines {
+			var object map[string]interface{}
+			err := json.Unmarshal(line, &object)
+			if err != nil {
+				t.Fatalf("Unmarshal failed: %s", err)
+			}
+			timestamp, ok := object["timestamp"].(string)
+			if ok != testCase.expectTimestamp {
+				t.Fatalf("unexpected timestamp presence: %s", line)
+			}
+			if !ok {
+				continue
+			}
+			parsed, err := time.Parse(testCase.layout, timestamp)
+			if err != nil || parsed.Format(testCase.layout) != timestamp {
+				t.Fatalf("unexpected timestamp format: %s", timestamp)
+			}
+			if parsed.Location() != time.UTC {
+				t.Fatalf("unexpected timestamp timezone: %s", timestamp)
+			}
+		}
+	}
+
+	if SetNoticeTimestampFormat("invalid") == nil {
+		t.Fatalf("unexpected SetNoticeTimestampFormat success")
+	}
+}
+
+func TestNoticeFile(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-notice-file-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetEmitDiagnosticNotices(true)
+	defer SetEmitDiagnosticNotices(false)
+
+	var buffer bytes.Buffer
+	SetNoticeWriter(&buffer)
+	defer SetNoticeWriter(os.Stderr)
+
+	filename := filepath.Join(testDataDirName, "notices")
+	maxBytes := int64(1000)
+	maxBackups := 2
+
+	err = SetNoticeFile(filename, maxBytes, maxBackups)
+	if err != nil {
+		t.Fatalf("SetNoticeFile failed: %s", err)
+	}
+
+	goroutines := 10
+	noticesPerGoroutine := 50
+
+	var waitGroup sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		waitGroup.Add(1)
+		go func(i int) {
+			defer waitGroup.Done()
+			for j := 0; j < noticesPerGoroutine; j++ {
+				NoticeInfo("notice %d %d", i, j)
+			}
+		}(i)
+	}
+	waitGroup.Wait()
+
+	err = SetNoticeFile("", 0, 0)
+	if err != nil {
+		t.Fatalf("SetNoticeFile failed: %s", err)
+	}
+
+	// All notices are also written to the writer.
+
+	lines := bytes.Split(bytes.TrimSpace(buffer.Bytes()), []byte("\n"))
+	if len(lines) != goroutines*noticesPerGoroutine {
+		t.Fatalf("unexpected writer notice count: %d", len(lines))
+	}
+
+	// The file has been rotated, only maxBackups older files are retained,
+	// and each file is within the size limit and contains whole notices.
+
+	for i := 0; i <= maxBackups+1; i++ {
+
+		name := filename
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", filename, i)
+		}
+
+		content, err := ioutil.ReadFile(name)
+		if i > maxBackups {
+			if !os.IsNotExist(err) {
+				t.Fatalf("unexpected older file: %s", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("ReadFile failed: %s", err)
+		}
+
+		if int64(len(content)) > maxBytes {
+			t.Fatalf("unexpected file size: %s: %d", name, len(content))
+		}
+
+		for _, line := range bytes.Split(bytes.TrimSpace(content), []byte("\n")) {
+			var notice map[string]interface{}
+			err := json.Unmarshal(line, &notice)
+			if err != nil || notice["noticeType"] != "Info" {
+				t.Fatalf("unexpected notice in %s: %s", name, line)
+			}
+		}
+	}
+}
+
+func TestGetRecentNotices(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	// Overfill the buffer, so that the oldest notices are dropped.
+
+	noticeCount := NOTICE_RECENT_BUFFER_SIZE + 10
+
+	for i := 0; i < noticeCount; i++ {
+		NoticeUpgradeCheckScheduled(time.Duration(i) * time.Millisecond)
+	}
+
+	checkNotices := func(notices []map[string]interface{}, expectedCount int) {
+		if len(notices) != expectedCount {
+			t.Fatalf("unexpected notice count: %d", len(notices))
+		}
+		for i, notice := range notices {
+			if notice["noticeType"] != "UpgradeCheckScheduled" {
+				t.Fatalf("unexpected notice type: %v", notice["noticeType"])
+			}
+			data, ok := notice["data"].(map[string]interface{})
+			if !ok {
+				t.Fatalf("unexpected notice data: %v", notice["data"])
+			}
+			expectedDelay := float64(noticeCount - expectedCount + i)
+			if data["delayMilliseconds"] != expectedDelay {
+				t.Fatalf("unexpected notice %d: %v", i, data)
+			}
+		}
+	}
+
+	checkNotices(GetRecentNotices(0), NOTICE_RECENT_BUFFER_SIZE)
+	checkNotices(GetRecentNotices(NOTICE_RECENT_BUFFER_SIZE+1), NOTICE_RECENT_BUFFER_SIZE)
+	checkNotices(GetRecentNotices(3), 3)
+}
+
+func TestMinNoticeSeverity(t *testing.T) {
+
+	var buffer bytes.Buffer
+	SetNoticeWriter(&buffer)
+	defer SetNoticeWriter(os.Stderr)
+	defer SetMinNoticeSeverity(NOTICE_SEVERITY_INFO)
+
+	// NoticeInfo and NoticeAlert are diagnostic notices.
+	emitDiagnosticNotices := GetEmitDiagnoticNotices()
+	SetEmitDiagnosticNotices(true)
+	defer SetEmitDiagnosticNotices(emitDiagnosticNotices)
+
+	testCases := []struct {
+		severity            string
+		expectedNoticeTypes []string
+	}{
+		{NOTICE_SEVERITY_INFO, []string{"Info", "ClientUpgradeDownloadedBytes", "UpstreamProxyError", "Alert"}},
+		{NOTICE_SEVERITY_WARNING, []string{"UpstreamProxyError", "Alert"}},
+		{NOTICE_SEVERITY_ALERT, []string{"Alert"}},
+	}
+
+	for _, testCase := range testCases {
+
+		err := SetMinNoticeSeverity(testCase.severity)
+		if err != nil {
+			t.Fatalf("SetMinNoticeSeverity failed: %s", err)
+		}
+
+		buffer.Reset()
+		NoticeInfo("test")
+		NoticeClientUpgradeDownloadedBytes(1)
+		NoticeUpstreamProxyError(fmt.Errorf("test"))
+		NoticeAlert("test")
+
+		var noticeTypes []string
+		for _, line := range bytes.Split(bytes.TrimSpace(buffer.Bytes()), []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			var object map[string]interface{}
+			err := json.Unmarshal(line, &object)
+			if err != nil {
+				t.Fatalf("Unmarshal failed: %s", err)
+			}
+			noticeTypes = append(noticeTypes, object["noticeType"].(string))
+		}
+
+		if fmt.Sprintf("%v", noticeTypes) != fmt.Sprintf("%v", testCase.expectedNoticeTypes) {
+			t.Fatalf("unexpected notices at %s: %v", testCase.severity, noticeTypes)
+		}
+	}
+
+	if SetMinNoticeSeverity("invalid") == nil {
+		t.Fatalf("unexpected SetMinNoticeSeverity success")
+	}
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// pacDirectNetworks are always accessed directly, as the local proxies
+// can't reach these networks through the tunnel.
+var pacDirectNetworks = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+}
+
+// PACServer is a local HTTP server which serves a proxy auto-config (PAC)
+// file, so that a system or browser may be pointed at a PAC URL which
+// routes through the local proxies. Any request receives the PAC file.
+//
+// The PAC file is generated for each request from the current local proxy
+// listening addresses and split tunnel rules, so it always reflects any
+// change to those ports or rules.
+//
+// Plain hostnames, localhost, and the local networks in pacDirectNetworks
+// are accessed directly, as are IPv4 destinations in SplitTunnelDirectCIDRs.
+// As PAC network matching would require the browser to resolve hostnames
+// outside of the tunnel, these networks are matched only against IP
+// address destinations; the local proxies still classify all destinations
+// using the full split tunnel rules, including routes data.
+type PACServer struct {
+	controller     *Controller
+	listener       net.Listener
+	serveWaitGroup *sync.WaitGroup
+}
+
+// NewPACServer starts a PAC server listening on config.PACServerAddress.
+func NewPACServer(controller *Controller) (*PACServer, error) {
+
+	listener, err := net.Listen("tcp", controller.config.PACServerAddress)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	server := &PACServer{
+		controller:     controller,
+		listener:       listener,
+		serveWaitGroup: new(sync.WaitGroup),
+	}
+
+	httpServer := &http.Server{
+		Handler:      server,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	server.serveWaitGroup.Add(1)
+	go func() {
+		defer server.serveWaitGroup.Done()
+		// Serve returns an error when the listener is closed.
+		httpServer.Serve(listener)
+	}()
+
+	controller.notices.ListeningPACServer(
+		fmt.Sprintf("http://%s/proxy.pac", listener.Addr().String()))
+
+	return server, nil
+}
+
+// Close stops the PAC server.
+func (server *PACServer) Close() {
+	server.listener.Close()
+	server.serveWaitGroup.Wait()
+}
+
+func (server *PACServer) ServeHTTP(
+	responseWriter http.ResponseWriter, request *http.Request) {
+
+	// When a local proxy listens on all interfaces, the PAC file references
+	// the host the PAC file was requested from, which the requester can
+	// reach.
+	requestHost, _, err := net.SplitHostPort(request.Host)
+	if err != nil {
+		requestHost = request.Host
+	}
+
+	pac := server.controller.makePAC(requestHost)
+
+	responseWriter.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	responseWriter.Header().Set("Cache-Control", "no-store")
+	responseWriter.Write(pac)
+}
+
+// makePAC generates a PAC file for the current local proxy listening
+// addresses and split tunnel rules. Unspecified listening IP addresses are
+// replaced with requestHost.
+func (controller *Controller) makePAC(requestHost string) []byte {
+
+	controller.localProxyAddressesMutex.Lock()
+	socksProxyAddress := controller.localSocksProxyAddress
+	httpProxyAddress := controller.localHttpProxyAddress
+	controller.localProxyAddressesMutex.Unlock()
+
+	var proxies []string
+	if httpProxyAddress != "" {
+		proxies = append(proxies,
+			"PROXY "+pacProxyAddress(httpProxyAddress, requestHost))
+	}
+	if socksProxyAddress != "" {
+		address := pacProxyAddress(socksProxyAddress, requestHost)
+		proxies = append(proxies, "SOCKS5 "+address, "SOCKS "+address)
+	}
+
+	directNetworks := make([]*net.IPNet, 0)
+	for _, CIDR := range pacDirectNetworks {
+		_, network, _ := net.ParseCIDR(CIDR)
+		directNetworks = append(directNetworks, network)
+	}
+	directNetworks = append(
+		directNetworks, controller.splitTunnelClassifier.directNetworks...)
+
+	var pac bytes.Buffer
+
+	pac.WriteString("function FindProxyForURL(url, host) {\n")
+	pac.WriteString("  if (isPlainHostName(host) || host == \"localhost\") {\n")
+	pac.WriteString("    return \"DIRECT\";\n")
+	pac.WriteString("  }\n")
+	pac.WriteString("  if (/^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host)) {\n")
+	for _, network := range directNetworks {
+		// isInNet supports only IPv4.
+		if network.IP.To4() == nil {
+			continue
+		}
+		fmt.Fprintf(&pac,
+			"    if (isInNet(host, \"%s\", \"%s\")) return \"DIRECT\";\n",
+			network.IP.String(), net.IP(network.Mask).String())
+	}
+	pac.WriteString("  }\n")
+
+	// There's no DIRECT fallback, so traffic isn't sent untunneled when the
+	// local proxies are unavailable. Config.Validate ensures that at least
+	// one local proxy is enabled.
+	fmt.Fprintf(&pac, "  return \"%s\";\n", strings.Join(proxies, "; "))
+	pac.WriteString("}\n")
+
+	return pac.Bytes()
+}
+
+func pacProxyAddress(listenAddress, requestHost string) string {
+	host, port, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return listenAddress
+	}
+	IP := net.ParseIP(host)
+	if IP != nil && IP.IsUnspecified() && requestHost != "" {
+		host = requestHost
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// setLocalProxyAddress records the listening address of the local proxy of
+// the specified type, _SOCKS_PROXY_TYPE or _HTTP_PROXY_TYPE, for inclusion
+// in generated PAC files.
+func (controller *Controller) setLocalProxyAddress(proxyType, address string) {
+
+	controller.localProxyAddressesMutex.Lock()
+	defer controller.localProxyAddressesMutex.Unlock()
+
+	if proxyType == _SOCKS_PROXY_TYPE {
+		controller.localSocksProxyAddress = address
+	} else {
+		controller.localHttpProxyAddress = address
+	}
+}
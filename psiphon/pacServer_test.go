@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPACServer(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	config, err := LoadConfig([]byte(`
+		{
+			"PropagationChannelId" : "0",
+			"SponsorId" : "0",
+			"PACServerAddress" : "127.0.0.1:0",
+			"SplitTunnelDirectCIDRs" : ["192.0.2.0/24", "2001:db8::/32"]
+		}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	controller := &Controller{
+		config:                config,
+		splitTunnelClassifier: NewSplitTunnelClassifier(config, nil),
+	}
+
+	// The local proxies listen on ephemeral ports, so the PAC file must
+	// reference the actual bound addresses.
+
+	socksProxy, err := NewSocksProxy(config, controller, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewSocksProxy failed: %s", err)
+	}
+	defer socksProxy.Close()
+	controller.setLocalProxyAddress(
+		_SOCKS_PROXY_TYPE, socksProxy.listener.Addr().String())
+
+	httpProxy, err := NewHttpProxy(config, controller, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewHttpProxy failed: %s", err)
+	}
+	defer httpProxy.Close()
+	controller.setLocalProxyAddress(
+		_HTTP_PROXY_TYPE, httpProxy.listener.Addr().String())
+
+	server, err := NewPACServer(controller)
+	if err != nil {
+		t.Fatalf("NewPACServer failed: %s", err)
+	}
+	defer server.Close()
+
+	getPAC := func() string {
+		response, err := http.Get("http://" + server.listener.Addr().String() + "/proxy.pac")
+		if err != nil {
+			t.Fatalf("http.Get failed: %s", err)
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK ||
+			response.Header.Get("Content-Type") != "application/x-ns-proxy-autoconfig" {
+			t.Fatalf("unexpected response: %+v", response)
+		}
+		body, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			t.Fatalf("ReadAll failed: %s", err)
+		}
+		return string(body)
+	}
+
+	pac := getPAC()
+
+	expectedProxies := "PROXY " + httpProxy.listener.Addr().String() +
+		"; SOCKS5 " + socksProxy.listener.Addr().String() +
+		"; SOCKS " + socksProxy.listener.Addr().String()
+
+	for _, expected := range []string{
+		"function FindProxyForURL(url, host) {",
+		`return "` + expectedProxies + `";`,
+		`isInNet(host, "192.168.0.0", "255.255.0.0")`,
+		`isInNet(host, "192.0.2.0", "255.255.255.0")`,
+	} {
+		if !strings.Contains(pac, expected) {
+			t.Fatalf("missing %s in PAC: %s", expected, pac)
+		}
+	}
+
+	if strings.Contains(pac, "2001:db8::") {
+		t.Fatalf("unexpected IPv6 network in PAC: %s", pac)
+	}
+
+	// A proxy listening on all interfaces is referenced by the host the PAC
+	// file was requested from, and a changed port is reflected in the next
+	// PAC file.
+
+	controller.setLocalProxyAddress(_HTTP_PROXY_TYPE, "0.0.0.0:8080")
+
+	pac = getPAC()
+
+	if !strings.Contains(pac, `return "PROXY 127.0.0.1:8080; SOCKS5 `) {
+		t.Fatalf("unexpected PAC: %s", pac)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+const (
+	PORT_FORWARD_LIMIT_TOTAL    = "total"
+	PORT_FORWARD_LIMIT_PER_HOST = "per-host"
+)
+
+// errPortForwardLimitExceeded is returned by portForwardLimiter.dial when
+// opening another port forward would exceed a configured limit.
+var errPortForwardLimitExceeded = errors.New("port forward limit exceeded")
+
+// portForwardLimiter enforces MaxOpenPortForwards and
+// MaxOpenPortForwardsPerHost for a local proxy, so that a single
+// misbehaving client app can't exhaust tunnel resources by opening an
+// unbounded number of port forwards.
+type portForwardLimiter struct {
+	proxyType  string
+	maxOpen    int
+	maxPerHost int
+	notices    *noticeLogger
+
+	mutex       sync.Mutex
+	open        int
+	openPerHost map[string]int
+}
+
+func newPortForwardLimiter(config *Config, proxyType string) *portForwardLimiter {
+	return &portForwardLimiter{
+		proxyType:   proxyType,
+		maxOpen:     config.MaxOpenPortForwards,
+		maxPerHost:  config.MaxOpenPortForwardsPerHost,
+		notices:     config.notices,
+		openPerHost: make(map[string]int),
+	}
+}
+
+// dial calls dialer to open a port forward to target, a host:port, when the
+// limits permit. The returned conn releases its slot when closed. When a
+// limit is exceeded, dial emits a notice and returns
+// errPortForwardLimitExceeded without calling dialer.
+func (limiter *portForwardLimiter) dial(
+	target string, dialer func() (net.Conn, error)) (net.Conn, error) {
+
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+
+	limit := limiter.acquire(host)
+	if limit != "" {
+		limiter.notices.LocalProxyThrottled(limiter.proxyType, limit)
+		return nil, errPortForwardLimitExceeded
+	}
+
+	conn, err := dialer()
+	if err != nil {
+		limiter.release(host)
+		return nil, err
+	}
+
+	return &limitedConn{
+		Conn:    conn,
+		release: func() { limiter.release(host) },
+	}, nil
+}
+
+// acquire reserves a slot for a port forward to host, returning "" on
+// success or the name of the exceeded limit.
+func (limiter *portForwardLimiter) acquire(host string) string {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if limiter.maxOpen > 0 && limiter.open >= limiter.maxOpen {
+		return PORT_FORWARD_LIMIT_TOTAL
+	}
+	if limiter.maxPerHost > 0 && limiter.openPerHost[host] >= limiter.maxPerHost {
+		return PORT_FORWARD_LIMIT_PER_HOST
+	}
+
+	limiter.open += 1
+	limiter.openPerHost[host] += 1
+	return ""
+}
+
+func (limiter *portForwardLimiter) release(host string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.open -= 1
+	limiter.openPerHost[host] -= 1
+	if limiter.openPerHost[host] <= 0 {
+		delete(limiter.openPerHost, host)
+	}
+}
+
+// limitedConn is a port forward conn which releases its portForwardLimiter
+// slot, once, when closed.
+type limitedConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (conn *limitedConn) Close() error {
+	err := conn.Conn.Close()
+	conn.releaseOnce.Do(conn.release)
+	return err
+}
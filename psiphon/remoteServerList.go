@@ -50,69 +50,185 @@ func FetchCommonRemoteServerList(
 	tunnel *Tunnel,
 	untunneledDialConfig *DialConfig) error {
 
-	NoticeInfo("fetching common remote server list")
+	config.notices.Info("fetching common remote server list")
 
-	p := config.clientParameters.Get()
+	_, err := fetchCommonRemoteServerList(
+		ctx,
+		config,
+		attempt,
+		tunnel,
+		untunneledDialConfig,
+		config.RemoteServerListDownloadFilename)
+	return err
+}
+
+// prefetchServerEntries downloads the common remote server list, with the
+// download rate limited to bytesPerSecond, and refreshes the recorded
+// server entry performance. The prefetch is made while tunnels are idle, in
+// advance of the regular fetch, so that fresh server entries are available
+// for the next establishment. A distinct download filename is used so that
+// a prefetch doesn't disturb a concurrent, resumable regular fetch.
+func prefetchServerEntries(
+	ctx context.Context,
+	config *Config,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig,
+	bytesPerSecond int64) error {
+
+	config.notices.Info("prefetching common remote server list")
+
+	serverEntryCount, err := fetchCommonRemoteServerList(
+		withDownloadRateLimit(ctx, bytesPerSecond),
+		config,
+		0,
+		tunnel,
+		untunneledDialConfig,
+		config.RemoteServerListDownloadFilename+".prefetch")
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = refreshServerEntryPerformance(config)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if serverEntryCount > 0 {
+		config.notices.ServerEntriesPrefetched(serverEntryCount)
+	}
+
+	return nil
+}
+
+// fetchCommonRemoteServerList downloads the common remote server list to
+// downloadFilename and stores its server entries. The number of server
+// entries stored is returned, which is 0 when the remote server list is
+// unchanged.
+func fetchCommonRemoteServerList(
+	ctx context.Context,
+	config *Config,
+	attempt int,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig,
+	downloadFilename string) (int, error) {
+
+	source := &commonRemoteServerListSource{
+		config:               config,
+		attempt:              attempt,
+		tunnel:               tunnel,
+		untunneledDialConfig: untunneledDialConfig,
+		downloadFilename:     downloadFilename,
+	}
+
+	err := StoreServerEntrySource(ctx, config, source, true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to store common remote server list: %s", common.ContextError(err))
+	}
+
+	// When the resource is unchanged, skip.
+	if source.newETag == "" {
+		return 0, nil
+	}
+
+	// Now that the server entries are successfully imported, store the response
+	// ETag so we won't re-download this same data again.
+	err = SetUrlETag(source.canonicalURL, source.newETag)
+	if err != nil {
+		config.notices.Alert("failed to set ETag for common remote server list: %s", common.ContextError(err))
+		// This fetch is still reported as a success, even if we can't store the etag
+	}
+
+	return source.serverEntryCount, nil
+}
+
+// commonRemoteServerListSource is a ServerEntrySource which downloads and
+// authenticates the common remote server list. When the remote server list
+// is unchanged, no server entries are supplied. The download ETag is
+// recorded in newETag and is not stored; the caller is responsible for
+// storing the ETag once the server entries are successfully imported. The
+// number of server entries supplied is recorded in serverEntryCount.
+type commonRemoteServerListSource struct {
+	config               *Config
+	attempt              int
+	tunnel               *Tunnel
+	untunneledDialConfig *DialConfig
+	downloadFilename     string
+	canonicalURL         string
+	newETag              string
+	serverEntryCount     int
+}
+
+func (source *commonRemoteServerListSource) ServerEntries(
+	ctx context.Context) (ServerEntrySourceIterator, error) {
+
+	p := source.config.clientParameters.Get()
 	publicKey := p.String(parameters.RemoteServerListSignaturePublicKey)
 	urls := p.DownloadURLs(parameters.RemoteServerListURLs)
 	downloadTimeout := p.Duration(parameters.FetchRemoteServerListTimeout)
 	p = nil
 
-	downloadURL, canonicalURL, skipVerify := urls.Select(attempt)
+	downloadURL, canonicalURL, skipVerify := urls.Select(source.attempt)
 
 	newETag, err := downloadRemoteServerListFile(
 		ctx,
-		config,
-		tunnel,
-		untunneledDialConfig,
+		source.config,
+		source.tunnel,
+		source.untunneledDialConfig,
 		downloadTimeout,
 		downloadURL,
 		canonicalURL,
 		skipVerify,
 		"",
-		config.RemoteServerListDownloadFilename)
+		source.downloadFilename)
 	if err != nil {
-		return fmt.Errorf("failed to download common remote server list: %s", common.ContextError(err))
+		return nil, fmt.Errorf("failed to download common remote server list: %s", common.ContextError(err))
 	}
 
+	source.canonicalURL = canonicalURL
+	source.newETag = newETag
+
 	// When the resource is unchanged, skip.
 	if newETag == "" {
-		return nil
+		return &emptyServerEntrySourceIterator{}, nil
 	}
 
-	file, err := os.Open(config.RemoteServerListDownloadFilename)
+	file, err := os.Open(source.downloadFilename)
 	if err != nil {
-		return fmt.Errorf("failed to open common remote server list: %s", common.ContextError(err))
-
+		return nil, fmt.Errorf("failed to open common remote server list: %s", common.ContextError(err))
 	}
-	defer file.Close()
 
 	serverListPayloadReader, err := common.NewAuthenticatedDataPackageReader(
 		file, publicKey)
 	if err != nil {
-		return fmt.Errorf("failed to read remote server list: %s", common.ContextError(err))
+		file.Close()
+		return nil, fmt.Errorf("failed to read remote server list: %s", common.ContextError(err))
 	}
 
-	err = StreamingStoreServerEntries(
-		config,
-		protocol.NewStreamingServerEntryDecoder(
-			serverListPayloadReader,
-			common.GetCurrentTimestamp(),
-			protocol.SERVER_ENTRY_SOURCE_REMOTE),
-		true)
-	if err != nil {
-		return fmt.Errorf("failed to store common remote server list: %s", common.ContextError(err))
-	}
+	return &countingServerEntrySourceIterator{
+		ServerEntrySourceIterator: &decoderServerEntrySourceIterator{
+			decoder: protocol.NewStreamingServerEntryDecoder(
+				serverListPayloadReader,
+				common.GetCurrentTimestamp(),
+				protocol.SERVER_ENTRY_SOURCE_REMOTE),
+			closer: file,
+		},
+		count: &source.serverEntryCount,
+	}, nil
+}
 
-	// Now that the server entries are successfully imported, store the response
-	// ETag so we won't re-download this same data again.
-	err = SetUrlETag(canonicalURL, newETag)
-	if err != nil {
-		NoticeAlert("failed to set ETag for common remote server list: %s", common.ContextError(err))
-		// This fetch is still reported as a success, even if we can't store the etag
-	}
+// countingServerEntrySourceIterator is a ServerEntrySourceIterator which
+// counts the server entries supplied by the wrapped iterator.
+type countingServerEntrySourceIterator struct {
+	ServerEntrySourceIterator
+	count *int
+}
 
-	return nil
+func (iterator *countingServerEntrySourceIterator) Next() (*protocol.ServerEntry, error) {
+	serverEntry, err := iterator.ServerEntrySourceIterator.Next()
+	if serverEntry != nil {
+		*iterator.count++
+	}
+	return serverEntry, err
 }
 
 // FetchObfuscatedServerLists downloads the obfuscated remote server lists
@@ -133,7 +249,7 @@ func FetchObfuscatedServerLists(
 	tunnel *Tunnel,
 	untunneledDialConfig *DialConfig) error {
 
-	NoticeInfo("fetching obfuscated remote server lists")
+	config.notices.Info("fetching obfuscated remote server lists")
 
 	p := config.clientParameters.Get()
 	publicKey := p.String(parameters.RemoteServerListSignaturePublicKey)
@@ -181,7 +297,7 @@ func FetchObfuscatedServerLists(
 		downloadFilename)
 	if err != nil {
 		failed = true
-		NoticeAlert("failed to download obfuscated server list registry: %s", common.ContextError(err))
+		config.notices.Alert("failed to download obfuscated server list registry: %s", common.ContextError(err))
 		// Proceed with any existing cached OSL registry.
 	} else if newETag != "" {
 		updateCache = true
@@ -192,7 +308,7 @@ func FetchObfuscatedServerLists(
 		// Lookup SLOKs in local datastore
 		key, err := GetSLOK(slokID)
 		if err != nil {
-			NoticeAlert("GetSLOK failed: %s", err)
+			config.notices.Alert("GetSLOK failed: %s", err)
 		}
 		return key
 	}
@@ -225,7 +341,7 @@ func FetchObfuscatedServerLists(
 		oslFileSpec, err := registryStreamer.Next()
 		if err != nil {
 			failed = true
-			NoticeAlert("failed to stream obfuscated server list registry: %s", common.ContextError(err))
+			config.notices.Alert("failed to stream obfuscated server list registry: %s", common.ContextError(err))
 			break
 		}
 
@@ -258,7 +374,7 @@ func FetchObfuscatedServerLists(
 			downloadFilename)
 		if err != nil {
 			failed = true
-			NoticeAlert("failed to download obfuscated server list file (%s): %s", hexID, common.ContextError(err))
+			config.notices.Alert("failed to download obfuscated server list file (%s): %s", hexID, common.ContextError(err))
 			continue
 		}
 
@@ -270,7 +386,7 @@ func FetchObfuscatedServerLists(
 		file, err := os.Open(downloadFilename)
 		if err != nil {
 			failed = true
-			NoticeAlert("failed to open obfuscated server list file (%s): %s", hexID, common.ContextError(err))
+			config.notices.Alert("failed to open obfuscated server list file (%s): %s", hexID, common.ContextError(err))
 			continue
 		}
 		// Note: don't defer file.Close() since we're in a loop
@@ -283,7 +399,7 @@ func FetchObfuscatedServerLists(
 		if err != nil {
 			file.Close()
 			failed = true
-			NoticeAlert("failed to read obfuscated server list file (%s): %s", hexID, common.ContextError(err))
+			config.notices.Alert("failed to read obfuscated server list file (%s): %s", hexID, common.ContextError(err))
 			continue
 		}
 
@@ -297,7 +413,7 @@ func FetchObfuscatedServerLists(
 		if err != nil {
 			file.Close()
 			failed = true
-			NoticeAlert("failed to store obfuscated server list file (%s): %s", hexID, common.ContextError(err))
+			config.notices.Alert("failed to store obfuscated server list file (%s): %s", hexID, common.ContextError(err))
 			continue
 		}
 
@@ -306,7 +422,7 @@ func FetchObfuscatedServerLists(
 		err = SetUrlETag(canonicalURL, newETag)
 		if err != nil {
 			file.Close()
-			NoticeAlert("failed to set ETag for obfuscated server list file (%s): %s", hexID, common.ContextError(err))
+			config.notices.Alert("failed to set ETag for obfuscated server list file (%s): %s", hexID, common.ContextError(err))
 			continue
 			// This fetch is still reported as a success, even if we can't store the ETag
 		}
@@ -329,13 +445,13 @@ func FetchObfuscatedServerLists(
 
 		err := os.Rename(downloadFilename, cachedFilename)
 		if err != nil {
-			NoticeAlert("failed to set cached obfuscated server list registry: %s", common.ContextError(err))
+			config.notices.Alert("failed to set cached obfuscated server list registry: %s", common.ContextError(err))
 			// This fetch is still reported as a success, even if we can't update the cache
 		}
 
 		err = SetUrlETag(canonicalURL, newETag)
 		if err != nil {
-			NoticeAlert("failed to set ETag for obfuscated server list registry: %s", common.ContextError(err))
+			config.notices.Alert("failed to set ETag for obfuscated server list registry: %s", common.ContextError(err))
 			// This fetch is still reported as a success, even if we can't store the ETag
 		}
 	}
@@ -398,15 +514,27 @@ func downloadRemoteServerListFile(
 		return "", common.ContextError(err)
 	}
 
+	bytesPerSecond := getDownloadRateLimit(ctx)
+	if bytesPerSecond > 0 {
+		httpClient.Transport = newRateLimitedTransport(httpClient.Transport, bytesPerSecond)
+	}
+
+	p := config.clientParameters.Get()
+	syncBytes := p.Int(parameters.DownloadSyncBytes)
+	syncPeriod := p.Duration(parameters.DownloadSyncPeriod)
+	p = nil
+
 	n, responseETag, err := ResumeDownload(
 		ctx,
 		httpClient,
 		sourceURL,
 		MakePsiphonUserAgent(config),
 		destinationFilename,
-		lastETag)
+		lastETag,
+		syncBytes,
+		syncPeriod)
 
-	NoticeRemoteServerListResourceDownloadedBytes(sourceURL, n)
+	config.notices.RemoteServerListResourceDownloadedBytes(sourceURL, n)
 
 	if err != nil {
 		return "", common.ContextError(err)
@@ -416,7 +544,7 @@ func downloadRemoteServerListFile(
 		return "", nil
 	}
 
-	NoticeRemoteServerListResourceDownloaded(sourceURL)
+	config.notices.RemoteServerListResourceDownloaded(sourceURL)
 
 	RecordRemoteServerListStat(sourceURL, responseETag)
 
@@ -30,10 +30,12 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
@@ -42,6 +44,7 @@ import (
 	socks "github.com/Psiphon-Inc/goptlib"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/osl"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/server"
 )
 
@@ -371,6 +374,7 @@ func testObfuscatedRemoteServerLists(t *testing.T, omitMD5Sums bool) {
         "ClientVersion" : "0",
         "SponsorId" : "0",
         "PropagationChannelId" : "0",
+        "DataStoreDirectory" : "%s",
         "ConnectionPoolSize" : 1,
         "EstablishTunnelPausePeriodSeconds" : 1,
         "FetchRemoteServerListRetryPeriodMilliseconds" : 250,
@@ -384,6 +388,7 @@ func testObfuscatedRemoteServerLists(t *testing.T, omitMD5Sums bool) {
 
 	clientConfigJSON := fmt.Sprintf(
 		clientConfigJSONTemplate,
+		testDataDirName,
 		signingPublicKey,
 		remoteServerListURL,
 		remoteServerListDownloadFilename,
@@ -455,3 +460,152 @@ func testObfuscatedRemoteServerLists(t *testing.T, omitMD5Sums bool) {
 		}
 	}
 }
+
+func TestPrefetchServerEntries(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-prefetch-server-entries-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	singleton = dataStore{}
+	os.Remove(filepath.Join(testDataDirName, DATA_STORE_FILENAME))
+
+	err = InitDataStore(&Config{DataStoreDirectory: testDataDirName})
+	if err != nil {
+		t.Fatalf("InitDataStore failed: %s", err)
+	}
+
+	// Random server entry field values ensure that the compressed remote
+	// server list is large enough to exercise the rate limit.
+
+	serverEntryCount := 100
+	var encodedServerEntries []string
+	for i := 0; i < serverEntryCount; i++ {
+		webServerSecret, _ := common.MakeRandomStringHex(64)
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:       fmt.Sprintf("192.0.2.%d", i),
+				WebServerSecret: webServerSecret,
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+	}
+
+	signingPublicKey, signingPrivateKey, err := common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	remoteServerList, err := common.WriteAuthenticatedDataPackage(
+		strings.Join(encodedServerEntries, "\n"), signingPublicKey, signingPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"server-list"`)
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(remoteServerList))
+		}))
+	defer server.Close()
+
+	config, err := LoadConfig([]byte(fmt.Sprintf(`
+		{
+			"PropagationChannelId" : "0",
+			"SponsorId" : "0",
+			"DataStoreDirectory" : "%s",
+			"RemoteServerListUrl" : "%s",
+			"RemoteServerListSignaturePublicKey" : "%s",
+			"RemoteServerListDownloadFilename" : "%s",
+			"PrefetchServerEntries" : true
+		}`,
+		testDataDirName,
+		server.URL,
+		signingPublicKey,
+		filepath.Join(testDataDirName, "server_list_compressed"))))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	// Performance history for a server entry which is not in the remote
+	// server list is pruned by the prefetch.
+
+	err = RecordServerEntryPerformance(config, "192.0.2.0", true, time.Second)
+	if err != nil {
+		t.Fatalf("RecordServerEntryPerformance failed: %s", err)
+	}
+	err = RecordServerEntryPerformance(config, "198.51.100.0", true, time.Second)
+	if err != nil {
+		t.Fatalf("RecordServerEntryPerformance failed: %s", err)
+	}
+
+	prefetchedCount := make(chan int, 1)
+
+	SetNoticeWriter(NewNoticeReceiver(
+		func(notice []byte) {
+			noticeType, payload, err := GetNotice(notice)
+			if err == nil && noticeType == "ServerEntriesPrefetched" {
+				prefetchedCount <- int(payload["count"].(float64))
+			}
+		}))
+	defer SetNoticeWriter(os.Stderr)
+
+	// The rate limit bucket starts full, so the download must take at least
+	// as long as it takes to transfer the remainder of the remote server
+	// list at the limited rate.
+
+	bytesPerSecond := int64(len(remoteServerList)) / 3
+	minDuration := time.Duration(
+		float64(int64(len(remoteServerList))-bytesPerSecond) /
+			float64(bytesPerSecond) * float64(time.Second))
+
+	startTime := time.Now()
+
+	err = prefetchServerEntries(
+		context.Background(), config, nil, &DialConfig{}, bytesPerSecond)
+	if err != nil {
+		t.Fatalf("prefetchServerEntries failed: %s", err)
+	}
+
+	duration := time.Since(startTime)
+	if duration < minDuration*9/10 {
+		t.Fatalf("prefetch exceeded rate limit: %s < %s", duration, minDuration)
+	}
+
+	select {
+	case count := <-prefetchedCount:
+		if count != serverEntryCount {
+			t.Fatalf("unexpected prefetched count: %d", count)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("missing ServerEntriesPrefetched notice")
+	}
+
+	if CountServerEntries("", nil) != serverEntryCount {
+		t.Fatalf("unexpected server entry count")
+	}
+
+	performance := getServerEntryPerformance(config)
+	if len(performance) != 1 || performance["192.0.2.0"] == nil {
+		t.Fatalf("unexpected performance: %+v", performance)
+	}
+
+	// When the remote server list is unchanged, no server entries are
+	// stored and there is no notice.
+
+	err = prefetchServerEntries(
+		context.Background(), config, nil, &DialConfig{}, bytesPerSecond)
+	if err != nil {
+		t.Fatalf("prefetchServerEntries failed: %s", err)
+	}
+
+	select {
+	case count := <-prefetchedCount:
+		t.Fatalf("unexpected prefetched count: %d", count)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -177,7 +177,11 @@ func dispatchAPIRequestHandler(
 }
 
 var handshakeRequestParams = append(
-	append([]requestParamSpec(nil), tacticsParams...),
+	append(
+		[]requestParamSpec{
+			{"client_instance_id", isHexDigits, requestParamOptional},
+		},
+		tacticsParams...),
 	baseRequestParams...)
 
 // handshakeAPIRequestHandler implements the "handshake" API request.
@@ -125,7 +125,8 @@ type Config struct {
 	// and which ports to listen on for each protocol. Valid tunnel
 	// protocols include: "SSH", "OSSH", "UNFRONTED-MEEK-OSSH",
 	// "UNFRONTED-MEEK-HTTPS-OSSH", "UNFRONTED-MEEK-SESSION-TICKET-OSSH",
-	// "FRONTED-MEEK-OSSH", "FRONTED-MEEK-HTTP-OSSH".
+	// "FRONTED-MEEK-OSSH", "FRONTED-MEEK-HTTP-OSSH", "QUIC-OSSH".
+	// The "QUIC-OSSH" port is a UDP port.
 	TunnelProtocolPorts map[string]int
 
 	// SSHPrivateKey is the SSH host key. The same key is used for
@@ -152,6 +153,13 @@ type Config struct {
 	// run by this server instance, which use Obfuscated SSH.
 	ObfuscatedSSHKey string
 
+	// ObfuscationPassphrase is an optional passphrase which is mixed into
+	// the Obfuscated SSH key derivation. When set, only clients configured
+	// with the same passphrase can connect with protocols which use
+	// Obfuscated SSH. Server entries for this server must carry the
+	// corresponding ObfuscationPassphraseTag.
+	ObfuscationPassphrase string
+
 	// MeekCookieEncryptionPrivateKey is the NaCl private key used
 	// to decrypt meek cookie payload sent from clients. The same
 	// key is used for all meek protocols run by this server instance.
@@ -438,6 +446,7 @@ type GenerateConfigParams struct {
 	TrafficRulesFilename        string
 	TacticsRequestPublicKey     string
 	TacticsRequestObfuscatedKey string
+	ObfuscationPassphrase       string
 }
 
 // GenerateConfig creates a new Psiphon server config. It returns JSON encoded
@@ -605,6 +614,7 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, error
 		SSHUserName:                    sshUserName,
 		SSHPassword:                    sshPassword,
 		ObfuscatedSSHKey:               obfuscatedSSHKey,
+		ObfuscationPassphrase:          params.ObfuscationPassphrase,
 		TunnelProtocolPorts:            params.TunnelProtocolPorts,
 		DNSResolverIPAddress:           "8.8.8.8",
 		UDPInterceptUdpgwServerAddress: "127.0.0.1:7300",
@@ -669,6 +679,7 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, error
 
 	sshPort := params.TunnelProtocolPorts["SSH"]
 	obfuscatedSSHPort := params.TunnelProtocolPorts["OSSH"]
+	obfuscatedSSHQUICPort := params.TunnelProtocolPorts["QUIC-OSSH"]
 
 	// Meek port limitations
 	// - fronted meek protocols are hard-wired in the client to be port 443 or 80.
@@ -706,6 +717,7 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, error
 		SshPassword:                   sshPassword,
 		SshHostKey:                    base64.RawStdEncoding.EncodeToString(sshPublicKey.Marshal()),
 		SshObfuscatedPort:             obfuscatedSSHPort,
+		SshObfuscatedQUICPort:         obfuscatedSSHQUICPort,
 		SshObfuscatedKey:              obfuscatedSSHKey,
 		Capabilities:                  capabilities,
 		Region:                        "US",
@@ -717,6 +729,7 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, error
 		MeekFrontingDisableSNI:        false,
 		TacticsRequestPublicKey:       params.TacticsRequestPublicKey,
 		TacticsRequestObfuscatedKey:   params.TacticsRequestObfuscatedKey,
+		ObfuscationPassphraseTag:      common.GetObfuscationPassphraseTag(params.ObfuscationPassphrase),
 		ConfigurationVersion:          1,
 	}
 
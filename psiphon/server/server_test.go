@@ -21,6 +21,9 @@ package server
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -32,6 +35,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
@@ -50,6 +54,9 @@ var serverIPAddress, testDataDirName string
 var mockWebServerURL, mockWebServerExpectedResponse string
 var mockWebServerPort = 8080
 
+const mockUpgradeClientVersion = "1"
+const mockUpgradeClientVersionHeader = "x-amz-meta-psiphon-client-version"
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 
@@ -97,6 +104,12 @@ func runMockWebServer() (string, string) {
 	serveMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(responseBody))
 	})
+	// The upgrade download is the same entity as the web request response,
+	// served with Range support.
+	serveMux.HandleFunc("/upgrade", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(mockUpgradeClientVersionHeader, mockUpgradeClientVersion)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(responseBody))
+	})
 	webServerAddress := fmt.Sprintf("%s:%d", serverIPAddress, mockWebServerPort)
 	server := &http.Server{
 		Addr:    webServerAddress,
@@ -328,6 +341,23 @@ func TestTCPOnlySLOK(t *testing.T) {
 		})
 }
 
+func TestQUICOSSH(t *testing.T) {
+	runServer(t,
+		&runServerConfig{
+			tunnelProtocol:       "QUIC-OSSH",
+			enableSSHAPIRequests: true,
+			doHotReload:          false,
+			doDefaultSponsorID:   false,
+			denyTrafficRules:     false,
+			requireAuthorization: true,
+			omitAuthorization:    false,
+			doClientVerification: false,
+			doTunneledWebRequest: true,
+			doTunneledNTPRequest: false,
+			doUpgradeDownload:    true,
+		})
+}
+
 func TestUDPOnlySLOK(t *testing.T) {
 	runServer(t,
 		&runServerConfig{
@@ -355,6 +385,7 @@ type runServerConfig struct {
 	doClientVerification bool
 	doTunneledWebRequest bool
 	doTunneledNTPRequest bool
+	doUpgradeDownload    bool
 }
 
 func runServer(t *testing.T, runConfig *runServerConfig) {
@@ -420,8 +451,14 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 
 	// Pave psinet with random values to test handshake homepages.
 	psinetFilename := filepath.Join(testDataDirName, "psinet.json")
+	// When testing upgrade downloads, the handshake advertises a newer client
+	// version, which triggers a tunneled upgrade download.
+	upgradeClientVersion := ""
+	if runConfig.doUpgradeDownload {
+		upgradeClientVersion = mockUpgradeClientVersion
+	}
 	sponsorID, expectedHomepageURL := pavePsinetDatabaseFile(
-		t, runConfig.doDefaultSponsorID, psinetFilename)
+		t, runConfig.doDefaultSponsorID, upgradeClientVersion, psinetFilename)
 
 	// Pave OSL config for SLOK testing
 	oslConfigFilename := filepath.Join(testDataDirName, "osl_config.json")
@@ -511,7 +548,7 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 
 		// Pave new config files with different random values.
 		sponsorID, expectedHomepageURL = pavePsinetDatabaseFile(
-			t, runConfig.doDefaultSponsorID, psinetFilename)
+			t, runConfig.doDefaultSponsorID, upgradeClientVersion, psinetFilename)
 
 		propagationChannelID = paveOSLConfigFile(t, oslConfigFilename)
 
@@ -552,8 +589,31 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
         "UseIndistinguishableTLS" : true,
         "EstablishTunnelPausePeriodSeconds" : 1,
         "ConnectionWorkerPoolSize" : %d,
-        "TunnelProtocols" : ["%s"]
+        "TunnelProtocols" : ["%s"],
+        "MeekMaxRequestPayloadBytes" : 32768
     }`, numTunnels, runConfig.tunnelProtocol)
+
+	upgradeDownloadFilename := filepath.Join(testDataDirName, "upgrade")
+
+	if runConfig.doUpgradeDownload {
+
+		// Upgrade download config values must be set before calling LoadConfig.
+
+		os.Remove(upgradeDownloadFilename)
+
+		upgradeDigest := sha256.Sum256([]byte(mockWebServerExpectedResponse))
+
+		var modifyConfig map[string]interface{}
+		json.Unmarshal([]byte(clientConfigJSON), &modifyConfig)
+		modifyConfig["UpgradeDownloadURLs"] = parameters.DownloadURLs{
+			{URL: base64.StdEncoding.EncodeToString([]byte(mockWebServerURL + "upgrade"))}}
+		modifyConfig["UpgradeDownloadClientVersionHeader"] = mockUpgradeClientVersionHeader
+		modifyConfig["UpgradeDownloadFilename"] = upgradeDownloadFilename
+		modifyConfig["UpgradeDownloadSHA256"] = hex.EncodeToString(upgradeDigest[:])
+		modifiedConfigJSON, _ := json.Marshal(modifyConfig)
+		clientConfigJSON = string(modifiedConfigJSON)
+	}
+
 	clientConfig, _ := psiphon.LoadConfig([]byte(clientConfigJSON))
 
 	clientConfig.DataStoreDirectory = testDataDirName
@@ -609,6 +669,8 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 	slokSeeded := make(chan struct{}, 1)
 	verificationRequired := make(chan struct{}, 1)
 	verificationCompleted := make(chan struct{}, 1)
+	meekParametersReported := make(chan struct{}, 1)
+	upgradeDownloaded := make(chan struct{}, 1)
 
 	psiphon.SetNoticeWriter(psiphon.NewNoticeReceiver(
 		func(notice []byte) {
@@ -643,6 +705,14 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 				controller.SetClientVerificationPayloadForActiveTunnels(dummyClientVerificationPayload)
 			case "NoticeClientVerificationRequestCompleted":
 				sendNotificationReceived(verificationCompleted)
+			case "ClientUpgradeDownloaded":
+				sendNotificationReceived(upgradeDownloaded)
+			case "Info":
+				message := payload["message"].(string)
+				if strings.HasPrefix(message, "meek parameters") &&
+					strings.HasSuffix(message, "max request payload 32768 bytes") {
+					sendNotificationReceived(meekParametersReported)
+				}
 			}
 		}))
 
@@ -687,6 +757,10 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 	waitOnNotification(t, tunnelsEstablished, timeoutSignal, "tunnel establish timeout exceeded")
 	waitOnNotification(t, homepageReceived, timeoutSignal, "homepage received timeout exceeded")
 
+	if protocol.TunnelProtocolUsesMeek(runConfig.tunnelProtocol) {
+		waitOnNotification(t, meekParametersReported, timeoutSignal, "meek parameters timeout exceeded")
+	}
+
 	if runConfig.doClientVerification {
 		waitOnNotification(t, verificationRequired, timeoutSignal, "verification required timeout exceeded")
 		waitOnNotification(t, verificationCompleted, timeoutSignal, "verification completed timeout exceeded")
@@ -712,6 +786,21 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 		}
 	}
 
+	if runConfig.doUpgradeDownload {
+
+		// Test: tunneled upgrade download
+
+		waitOnNotification(t, upgradeDownloaded, timeoutSignal, "upgrade downloaded timeout exceeded")
+
+		upgrade, err := ioutil.ReadFile(upgradeDownloadFilename)
+		if err != nil {
+			t.Fatalf("error reading upgrade download: %s", err)
+		}
+		if string(upgrade) != mockWebServerExpectedResponse {
+			t.Fatalf("unexpected upgrade download")
+		}
+	}
+
 	if runConfig.doTunneledNTPRequest {
 
 		// Test: tunneled UDP packets
@@ -984,7 +1073,10 @@ func makeTunneledNTPRequestAttempt(
 }
 
 func pavePsinetDatabaseFile(
-	t *testing.T, useDefaultSponsorID bool, psinetFilename string) (string, string) {
+	t *testing.T,
+	useDefaultSponsorID bool,
+	upgradeClientVersion string,
+	psinetFilename string) (string, string) {
 
 	sponsorID, _ := common.MakeRandomStringHex(8)
 
@@ -1006,6 +1098,9 @@ func pavePsinetDatabaseFile(
                     ]
                 }
             }
+        },
+        "client_versions": {
+            "Windows": [%s]
         }
     }
 	`
@@ -1015,8 +1110,13 @@ func pavePsinetDatabaseFile(
 		defaultSponsorID = sponsorID
 	}
 
+	clientVersions := ""
+	if upgradeClientVersion != "" {
+		clientVersions = fmt.Sprintf(`{"version": "%s"}`, upgradeClientVersion)
+	}
+
 	psinetJSON := fmt.Sprintf(
-		psinetJSONFormat, defaultSponsorID, sponsorID, expectedHomepageURL)
+		psinetJSONFormat, defaultSponsorID, sponsorID, expectedHomepageURL, clientVersions)
 
 	err := ioutil.WriteFile(psinetFilename, []byte(psinetJSON), 0600)
 	if err != nil {
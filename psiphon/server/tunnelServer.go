@@ -40,6 +40,7 @@ import (
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/osl"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/quic"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tun"
 	"github.com/marusama/semaphore"
@@ -135,7 +136,14 @@ func (server *TunnelServer) Run() error {
 		localAddress := fmt.Sprintf(
 			"%s:%d", support.Config.ServerIPAddress, listenPort)
 
-		listener, err := net.Listen("tcp", localAddress)
+		var listener net.Listener
+		var err error
+
+		if protocol.TunnelProtocolUsesQUIC(tunnelProtocol) {
+			listener, err = quic.Listen(localAddress)
+		} else {
+			listener, err = net.Listen("tcp", localAddress)
+		}
 		if err != nil {
 			for _, existingListener := range listeners {
 				existingListener.Listener.Close()
@@ -1033,7 +1041,8 @@ func (sshClient *sshClient) run(
 			conn, result.err = common.NewObfuscatedSshConn(
 				common.OBFUSCATION_CONN_MODE_SERVER,
 				conn,
-				sshClient.sshServer.support.Config.ObfuscatedSSHKey)
+				sshClient.sshServer.support.Config.ObfuscatedSSHKey,
+				sshClient.sshServer.support.Config.ObfuscationPassphrase)
 			if result.err != nil {
 				result.err = common.ContextError(result.err)
 			}
@@ -59,6 +59,78 @@ type ServerContext struct {
 	clientRegion             string
 	clientUpgradeVersion     string
 	serverHandshakeTimestamp string
+	homepages                []string
+	handshakeResponse        *HandshakeResponse
+}
+
+// HandshakeResponse is the information returned by the Psiphon server in
+// response to the handshake request, as exposed by
+// Tunnel.GetHandshakeResponse.
+//
+// Fields are populated only when supported by the server, and any field may
+// be empty when connected to an older server.
+type HandshakeResponse struct {
+
+	// ClientRegion is the client's region, as determined by the server.
+	ClientRegion string
+
+	// Homepages are the sponsor homepage URLs, as received from the server
+	// and before any filtering. Empty when the sponsor has no homepages.
+	Homepages []string
+
+	// UpgradeClientVersion is the latest available client version. Empty
+	// when the client is already the latest version. When not empty, the
+	// caller may invoke DownloadUpgrade.
+	UpgradeClientVersion string
+
+	// PageViewRegexes and HttpsRequestRegexes are the stats regexes. Empty
+	// for sponsors that don't collect page view stats.
+	PageViewRegexes     []map[string]string
+	HttpsRequestRegexes []map[string]string
+
+	// ServerTimestamp is the server's time at the handshake, in RFC 3339
+	// format. Empty for servers which don't report a timestamp.
+	ServerTimestamp string
+
+	// ActiveAuthorizationIDs are the IDs of the client's authorizations
+	// which the server accepted. Empty when no authorizations were
+	// submitted, or for servers which don't support authorizations.
+	ActiveAuthorizationIDs []string
+}
+
+// copy returns a deep copy of the HandshakeResponse.
+func (response *HandshakeResponse) copy() *HandshakeResponse {
+
+	copyStrings := func(values []string) []string {
+		if values == nil {
+			return nil
+		}
+		return append([]string(nil), values...)
+	}
+
+	copyRegexes := func(regexes []map[string]string) []map[string]string {
+		if regexes == nil {
+			return nil
+		}
+		copied := make([]map[string]string, len(regexes))
+		for i, regex := range regexes {
+			copied[i] = make(map[string]string, len(regex))
+			for key, value := range regex {
+				copied[i][key] = value
+			}
+		}
+		return copied
+	}
+
+	return &HandshakeResponse{
+		ClientRegion:           response.ClientRegion,
+		Homepages:              copyStrings(response.Homepages),
+		UpgradeClientVersion:   response.UpgradeClientVersion,
+		PageViewRegexes:        copyRegexes(response.PageViewRegexes),
+		HttpsRequestRegexes:    copyRegexes(response.HttpsRequestRegexes),
+		ServerTimestamp:        response.ServerTimestamp,
+		ActiveAuthorizationIDs: copyStrings(response.ActiveAuthorizationIDs),
+	}
 }
 
 // nextTunnelNumber is a monotonically increasing number assigned to each
@@ -125,6 +197,11 @@ func (serverContext *ServerContext) doHandshakeRequest(
 
 	params := serverContext.getBaseAPIParameters()
 
+	clientInstanceID := GetClientInstanceID(serverContext.tunnel.config)
+	if clientInstanceID != "" {
+		params["client_instance_id"] = clientInstanceID
+	}
+
 	doTactics := serverContext.tunnel.config.NetworkIDGetter != nil
 	networkID := ""
 	if doTactics {
@@ -154,6 +231,14 @@ func (serverContext *ServerContext) doHandshakeRequest(
 
 		params[protocol.PSIPHON_API_HANDSHAKE_AUTHORIZATIONS] = serverContext.tunnel.config.Authorizations
 
+		// Padding is only added to SSH API requests, where the server ignores
+		// unknown params; the legacy web API request, with params in the
+		// request URL, is unchanged.
+		padding := makeHandshakePadding(serverContext.tunnel.config)
+		if padding != "" {
+			params["padding"] = padding
+		}
+
 		request, err := makeSSHAPIRequestPayload(params)
 		if err != nil {
 			return common.ContextError(err)
@@ -197,8 +282,18 @@ func (serverContext *ServerContext) doHandshakeRequest(
 		return common.ContextError(err)
 	}
 
+	serverContext.handshakeResponse = &HandshakeResponse{
+		ClientRegion:           handshakeResponse.ClientRegion,
+		Homepages:              handshakeResponse.Homepages,
+		UpgradeClientVersion:   handshakeResponse.UpgradeClientVersion,
+		PageViewRegexes:        handshakeResponse.PageViewRegexes,
+		HttpsRequestRegexes:    handshakeResponse.HttpsRequestRegexes,
+		ServerTimestamp:        handshakeResponse.ServerTimestamp,
+		ActiveAuthorizationIDs: handshakeResponse.ActiveAuthorizationIDs,
+	}
+
 	serverContext.clientRegion = handshakeResponse.ClientRegion
-	NoticeClientRegion(serverContext.clientRegion)
+	serverContext.tunnel.notices.ClientRegion(serverContext.clientRegion)
 
 	var decodedServerEntries []*protocol.ServerEntry
 
@@ -218,7 +313,7 @@ func (serverContext *ServerContext) doHandshakeRequest(
 		err = protocol.ValidateServerEntry(serverEntry)
 		if err != nil {
 			// Skip this entry and continue with the next one
-			NoticeAlert("invalid handshake server entry: %s", err)
+			serverContext.tunnel.notices.Alert("invalid handshake server entry: %s", err)
 			continue
 		}
 
@@ -236,13 +331,15 @@ func (serverContext *ServerContext) doHandshakeRequest(
 		return common.ContextError(err)
 	}
 
-	NoticeHomepages(handshakeResponse.Homepages)
+	// Homepages are emitted by Tunnel.Activate, once the handshake has
+	// fully succeeded.
+	serverContext.homepages = handshakeResponse.Homepages
 
 	serverContext.clientUpgradeVersion = handshakeResponse.UpgradeClientVersion
 	if handshakeResponse.UpgradeClientVersion != "" {
-		NoticeClientUpgradeAvailable(handshakeResponse.UpgradeClientVersion)
+		serverContext.tunnel.notices.ClientUpgradeAvailable(handshakeResponse.UpgradeClientVersion)
 	} else {
-		NoticeClientIsLatestVersion("")
+		serverContext.tunnel.notices.ClientIsLatestVersion("")
 	}
 
 	if !ignoreStatsRegexps {
@@ -253,14 +350,14 @@ func (serverContext *ServerContext) doHandshakeRequest(
 			handshakeResponse.HttpsRequestRegexes)
 
 		for _, notice := range regexpsNotices {
-			NoticeAlert(notice)
+			serverContext.tunnel.notices.Alert(notice)
 		}
 	}
 
 	serverContext.serverHandshakeTimestamp = handshakeResponse.ServerTimestamp
-	NoticeServerTimestamp(serverContext.serverHandshakeTimestamp)
+	serverContext.tunnel.notices.ServerTimestamp(serverContext.serverHandshakeTimestamp)
 
-	NoticeActiveAuthorizationIDs(handshakeResponse.ActiveAuthorizationIDs)
+	serverContext.tunnel.notices.ActiveAuthorizationIDs(handshakeResponse.ActiveAuthorizationIDs)
 
 	if doTactics && handshakeResponse.TacticsPayload != nil &&
 		networkID == serverContext.tunnel.config.NetworkIDGetter.GetNetworkID() {
@@ -290,7 +387,7 @@ func (serverContext *ServerContext) doHandshakeRequest(
 				err := serverContext.tunnel.config.SetClientParameters(
 					tacticsRecord.Tag, true, tacticsRecord.Tactics.Parameters)
 				if err != nil {
-					NoticeInfo("apply handshake tactics failed: %s", err)
+					serverContext.tunnel.notices.Info("apply handshake tactics failed: %s", err)
 				}
 				// The error will be due to invalid tactics values from
 				// the server. When ApplyClientParameters fails, all
@@ -429,6 +526,32 @@ func (serverContext *ServerContext) DoStatusRequest(tunnel *Tunnel) error {
 	return nil
 }
 
+// makeHandshakePadding returns base64-encoded random padding for a handshake
+// request, with a random length in the configured range, inclusive; or ""
+// when handshake padding is disabled. Padding failures are ignored, and no
+// notice is emitted, so that padding isn't revealed in logs.
+func makeHandshakePadding(config *Config) string {
+
+	p := config.clientParameters.Get()
+	minBytes := p.Int(parameters.PsiphonAPIHandshakeRequestPaddingMinBytes)
+	maxBytes := p.Int(parameters.PsiphonAPIHandshakeRequestPaddingMaxBytes)
+	p = nil
+
+	if maxBytes <= 0 {
+		return ""
+	}
+	if minBytes > maxBytes {
+		minBytes = maxBytes
+	}
+
+	padding, err := common.MakeSecureRandomPadding(minBytes, maxBytes+1)
+	if err != nil {
+		return ""
+	}
+
+	return base64.StdEncoding.EncodeToString(padding)
+}
+
 func (serverContext *ServerContext) getStatusParams(
 	isTunneled bool) common.APIParameters {
 
@@ -445,7 +568,7 @@ func (serverContext *ServerContext) getStatusParams(
 		p.Int(parameters.PsiphonAPIStatusRequestPaddingMaxBytes))
 	p = nil
 	if err != nil {
-		NoticeAlert("MakeSecureRandomPadding failed: %s", common.ContextError(err))
+		serverContext.tunnel.notices.Alert("MakeSecureRandomPadding failed: %s", common.ContextError(err))
 		// Proceed without random padding
 		randomPadding = make([]byte, 0)
 	}
@@ -668,12 +791,12 @@ func (serverContext *ServerContext) DoClientVerificationRequest(
 	_ = json.Unmarshal(response, &clientVerificationResponse)
 
 	if clientVerificationResponse.ClientVerificationTTLSeconds > 0 {
-		NoticeClientVerificationRequired(
+		serverContext.tunnel.notices.ClientVerificationRequired(
 			clientVerificationResponse.ClientVerificationServerNonce,
 			clientVerificationResponse.ClientVerificationTTLSeconds,
 			clientVerificationResponse.ClientVerificationResetCache)
 	} else {
-		NoticeClientVerificationRequestCompleted(serverIP)
+		serverContext.tunnel.notices.ClientVerificationRequestCompleted(serverIP)
 	}
 
 	return nil
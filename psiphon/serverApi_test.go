@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMakeHandshakePadding(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	testCases := []struct {
+		description string
+		configJSON  string
+		expectMin   int
+		expectMax   int
+	}{
+		{"default", "", 0, 0},
+		{"disabled", `, "HandshakePaddingMinBytes" : 0, "HandshakePaddingMaxBytes" : 0`, 0, 0},
+		{"fixed", `, "HandshakePaddingMinBytes" : 10, "HandshakePaddingMaxBytes" : 10`, 10, 10},
+		{"range", `, "HandshakePaddingMinBytes" : 5, "HandshakePaddingMaxBytes" : 8`, 5, 8},
+		{"max only", `, "HandshakePaddingMaxBytes" : 3`, 0, 3},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			config, err := LoadConfig([]byte(fmt.Sprintf(`
+				{
+					"PropagationChannelId" : "0",
+					"SponsorId" : "0"
+					%s
+				}`, testCase.configJSON)))
+			if err != nil {
+				t.Fatalf("LoadConfig failed: %s", err)
+			}
+
+			lengths := make(map[int]bool)
+
+			for i := 0; i < 1000; i++ {
+				padding, err := base64.StdEncoding.DecodeString(
+					makeHandshakePadding(config))
+				if err != nil {
+					t.Fatalf("DecodeString failed: %s", err)
+				}
+				if len(padding) < testCase.expectMin || len(padding) > testCase.expectMax {
+					t.Fatalf("unexpected padding length: %d", len(padding))
+				}
+				lengths[len(padding)] = true
+			}
+
+			// Both bounds of the range are produced.
+
+			if !lengths[testCase.expectMin] || !lengths[testCase.expectMax] {
+				t.Fatalf("unexpected padding lengths: %v", lengths)
+			}
+		})
+	}
+
+	_, err := LoadConfig([]byte(`
+		{
+			"PropagationChannelId" : "0",
+			"SponsorId" : "0",
+			"HandshakePaddingMinBytes" : 10,
+			"HandshakePaddingMaxBytes" : 5
+		}`))
+	if err == nil {
+		t.Fatalf("LoadConfig unexpectedly succeeded")
+	}
+}
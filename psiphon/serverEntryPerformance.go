@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// serverEntryPerformanceDefaultLatency is the connection latency assumed
+// for servers with no successful connections on record.
+const serverEntryPerformanceDefaultLatency = 1 * time.Second
+
+// serverEntryPerformance is the recorded connection history for a single
+// server entry. Attempt, success, and latency totals are exponentially
+// decayed, with time constant decayWindow, so that recent connections
+// carry more weight than older ones.
+type serverEntryPerformance struct {
+	Attempts      float64   `json:"attempts"`
+	Successes     float64   `json:"successes"`
+	LatencyWeight float64   `json:"latencyWeight"`
+	LatencySum    float64   `json:"latencySum"`
+	LastUpdate    time.Time `json:"lastUpdate"`
+	LastSuccess   bool      `json:"lastSuccess"`
+}
+
+// decay applies the decay for the time elapsed since the last update.
+func (p *serverEntryPerformance) decay(now time.Time, decayWindow time.Duration) {
+
+	elapsed := now.Sub(p.LastUpdate)
+	if elapsed > 0 && decayWindow > 0 {
+		weight := math.Exp(-float64(elapsed) / float64(decayWindow))
+		p.Attempts *= weight
+		p.Successes *= weight
+		p.LatencyWeight *= weight
+		p.LatencySum *= weight
+	}
+
+	p.LastUpdate = now
+}
+
+// record adds a connection attempt outcome. latency is recorded only for
+// successful connections.
+func (p *serverEntryPerformance) record(
+	now time.Time, decayWindow time.Duration, success bool, latency time.Duration) {
+
+	p.decay(now, decayWindow)
+
+	p.Attempts += 1
+	p.LastSuccess = success
+	if success {
+		p.Successes += 1
+		p.LatencyWeight += 1
+		p.LatencySum += latency.Seconds()
+	}
+}
+
+// score returns a ranking score for the server; higher is better. The score
+// is the estimated success rate, with a uniform prior, discounted by the
+// average connection latency in seconds. A server with no history scores
+// the same as a server with an even success rate and default latency.
+func (p *serverEntryPerformance) score(now time.Time, decayWindow time.Duration) float64 {
+
+	decayed := *p
+	decayed.decay(now, decayWindow)
+
+	successRate := (decayed.Successes + 1) / (decayed.Attempts + 2)
+
+	latency := serverEntryPerformanceDefaultLatency.Seconds()
+	if decayed.LatencyWeight > 0 {
+		latency = decayed.LatencySum / decayed.LatencyWeight
+	}
+
+	return successRate / (1 + latency)
+}
+
+// orderServerEntriesByPerformance reorders serverEntryIds, in place, to
+// favor servers with higher performance scores. Servers without history
+// are scored as per serverEntryPerformance.score.
+//
+// To continue exploring servers without history and servers whose
+// performance may have improved, each position is, with probability
+// explorationRatio, filled by a random remaining candidate instead of the
+// best scoring candidate. serverEntryIds is expected to already be in
+// random order, so that ties remain randomized.
+func orderServerEntriesByPerformance(
+	serverEntryIds []string,
+	performance map[string]*serverEntryPerformance,
+	now time.Time,
+	decayWindow time.Duration,
+	explorationRatio float64) {
+
+	if len(performance) == 0 {
+		return
+	}
+
+	defaultScore := (&serverEntryPerformance{LastUpdate: now}).score(now, decayWindow)
+
+	scores := make(map[string]float64)
+	for _, serverEntryId := range serverEntryIds {
+		score := defaultScore
+		if p, ok := performance[serverEntryId]; ok {
+			score = p.score(now, decayWindow)
+		}
+		scores[serverEntryId] = score
+	}
+
+	remaining := make([]string, len(serverEntryIds))
+	copy(remaining, serverEntryIds)
+
+	sort.SliceStable(remaining, func(i, j int) bool {
+		return scores[remaining[i]] > scores[remaining[j]]
+	})
+
+	for i := range serverEntryIds {
+		index := 0
+		if explorationRatio > 0 && rand.Float64() < explorationRatio {
+			index = rand.Intn(len(remaining))
+		}
+		serverEntryIds[i] = remaining[index]
+		remaining = append(remaining[:index], remaining[index+1:]...)
+	}
+}
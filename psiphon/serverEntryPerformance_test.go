@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestOrderServerEntriesByPerformance(t *testing.T) {
+
+	decayWindow := 24 * time.Hour
+	start := time.Now()
+
+	// Seed synthetic connection history.
+
+	history := []struct {
+		serverEntryId string
+		successes     int
+		failures      int
+		latency       time.Duration
+	}{
+		{"fast", 10, 0, 200 * time.Millisecond},
+		{"slow", 10, 0, 1500 * time.Millisecond},
+		{"unreliable", 1, 9, 200 * time.Millisecond},
+	}
+
+	performance := make(map[string]*serverEntryPerformance)
+
+	for _, h := range history {
+		p := &serverEntryPerformance{}
+		for i := 0; i < h.successes; i++ {
+			p.record(start, decayWindow, true, h.latency)
+		}
+		for i := 0; i < h.failures; i++ {
+			p.record(start, decayWindow, false, 0)
+		}
+		performance[h.serverEntryId] = p
+	}
+
+	expectedOrder := []string{"fast", "slow", "unknown", "unreliable"}
+
+	// Without exploration, candidates are strictly ordered by performance;
+	// servers without history fall between good and bad performers.
+
+	serverEntryIds := []string{"unreliable", "unknown", "slow", "fast"}
+
+	orderServerEntriesByPerformance(
+		serverEntryIds, performance, start, decayWindow, 0.0)
+
+	if !reflect.DeepEqual(serverEntryIds, expectedOrder) {
+		t.Fatalf("unexpected order: %v", serverEntryIds)
+	}
+
+	// Once history has decayed, the unreliable server is no longer
+	// penalized relative to servers without history.
+
+	serverEntryIds = []string{"unreliable", "unknown"}
+
+	orderServerEntriesByPerformance(
+		serverEntryIds, performance, start.Add(100*decayWindow), decayWindow, 0.0)
+
+	if serverEntryIds[0] != "unreliable" {
+		t.Fatalf("unexpected order: %v", serverEntryIds)
+	}
+
+	// With exploration, all candidates are still returned exactly once.
+
+	serverEntryIds = []string{"unreliable", "unknown", "slow", "fast"}
+
+	orderServerEntriesByPerformance(
+		serverEntryIds, performance, start, decayWindow, 1.0)
+
+	sortedServerEntryIds := append([]string(nil), serverEntryIds...)
+	sort.Strings(sortedServerEntryIds)
+	if !reflect.DeepEqual(sortedServerEntryIds, []string{"fast", "slow", "unknown", "unreliable"}) {
+		t.Fatalf("unexpected candidates: %v", serverEntryIds)
+	}
+}
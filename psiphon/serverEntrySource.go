@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// ServerEntrySource is a supplier of server entries. The built-in remote
+// server list fetch and embedded server entry lists are server entry
+// sources; embedders may implement ServerEntrySource to supply server
+// entries from their own channel, and set Config.ServerEntrySource.
+type ServerEntrySource interface {
+
+	// ServerEntries returns an iterator over the server entries currently
+	// available from the source. The caller must Close the iterator.
+	ServerEntries(ctx context.Context) (ServerEntrySourceIterator, error)
+}
+
+// ServerEntrySourceIterator iterates over the server entries supplied by a
+// ServerEntrySource.
+type ServerEntrySourceIterator interface {
+
+	// Next returns the next server entry, or nil when there are no more
+	// server entries.
+	Next() (*protocol.ServerEntry, error)
+
+	// Close releases any resources held by the iterator.
+	Close() error
+}
+
+// StoreServerEntrySource stores all server entries supplied by source. As
+// with StreamingStoreServerEntries, there is an independent transaction for
+// each entry insert/update.
+func StoreServerEntrySource(
+	ctx context.Context,
+	config *Config,
+	source ServerEntrySource,
+	replaceIfExists bool) error {
+
+	checkInitDataStore()
+
+	serverEntries, err := source.ServerEntries(ctx)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	defer serverEntries.Close()
+
+	for {
+		if ctx.Err() != nil {
+			return common.ContextError(ctx.Err())
+		}
+
+		serverEntry, err := serverEntries.Next()
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		if serverEntry == nil {
+			// No more server entries
+			break
+		}
+
+		err = StoreServerEntry(serverEntry, replaceIfExists)
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+
+	// Since there has possibly been a significant change in the server entries,
+	// take this opportunity to update the available egress regions.
+	ReportAvailableRegions(config)
+
+	return nil
+}
+
+// NewEmbeddedServerEntrySource returns a ServerEntrySource which supplies
+// the server entries in encodedServerEntryList, an encoded server entry
+// list as embedded in client builds.
+func NewEmbeddedServerEntrySource(encodedServerEntryList string) ServerEntrySource {
+	return &embeddedServerEntrySource{
+		encodedServerEntryList: encodedServerEntryList,
+	}
+}
+
+// NewEmbeddedServerEntryFileSource returns a ServerEntrySource which
+// supplies the server entries in the encoded server entry list file
+// filename. The file is streamed, and not read entirely into memory.
+func NewEmbeddedServerEntryFileSource(filename string) ServerEntrySource {
+	return &embeddedServerEntrySource{
+		filename: filename,
+	}
+}
+
+type embeddedServerEntrySource struct {
+	filename               string
+	encodedServerEntryList string
+}
+
+func (source *embeddedServerEntrySource) ServerEntries(
+	_ context.Context) (ServerEntrySourceIterator, error) {
+
+	if source.filename == "" {
+		return &decoderServerEntrySourceIterator{
+			decoder: protocol.NewStreamingServerEntryDecoder(
+				strings.NewReader(source.encodedServerEntryList),
+				common.GetCurrentTimestamp(),
+				protocol.SERVER_ENTRY_SOURCE_EMBEDDED),
+		}, nil
+	}
+
+	file, err := os.Open(source.filename)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return &decoderServerEntrySourceIterator{
+		decoder: protocol.NewStreamingServerEntryDecoder(
+			file,
+			common.GetCurrentTimestamp(),
+			protocol.SERVER_ENTRY_SOURCE_EMBEDDED),
+		closer: file,
+	}, nil
+}
+
+// decoderServerEntrySourceIterator is a ServerEntrySourceIterator which
+// reads from a StreamingServerEntryDecoder and, when set, closes the
+// decoder's underlying input on Close.
+type decoderServerEntrySourceIterator struct {
+	decoder *protocol.StreamingServerEntryDecoder
+	closer  io.Closer
+}
+
+func (iterator *decoderServerEntrySourceIterator) Next() (*protocol.ServerEntry, error) {
+	return iterator.decoder.Next()
+}
+
+func (iterator *decoderServerEntrySourceIterator) Close() error {
+	if iterator.closer == nil {
+		return nil
+	}
+	return iterator.closer.Close()
+}
+
+// emptyServerEntrySourceIterator is a ServerEntrySourceIterator with no
+// server entries.
+type emptyServerEntrySourceIterator struct {
+}
+
+func (iterator *emptyServerEntrySourceIterator) Next() (*protocol.ServerEntry, error) {
+	return nil, nil
+}
+
+func (iterator *emptyServerEntrySourceIterator) Close() error {
+	return nil
+}
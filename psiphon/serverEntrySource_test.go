@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestEmbeddedServerEntrySource(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-server-entry-source-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	var encodedServerEntries []string
+	for _, ipAddress := range []string{"192.0.2.1", "invalid", "192.0.2.2"} {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{IpAddress: ipAddress})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		encodedServerEntries = append(encodedServerEntries, encodedServerEntry)
+	}
+	encodedServerEntryList := strings.Join(encodedServerEntries, "\n")
+
+	filename := filepath.Join(testDataDirName, "server_list")
+	err = ioutil.WriteFile(filename, []byte(encodedServerEntryList), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	for _, source := range []ServerEntrySource{
+		NewEmbeddedServerEntrySource(encodedServerEntryList),
+		NewEmbeddedServerEntryFileSource(filename),
+	} {
+
+		// Invalid server entries are skipped. Sources may be iterated more
+		// than once.
+
+		for i := 0; i < 2; i++ {
+
+			ipAddresses, err := collectServerEntrySource(source)
+			if err != nil {
+				t.Fatalf("collectServerEntrySource failed: %s", err)
+			}
+
+			if len(ipAddresses) != 2 ||
+				ipAddresses[0] != "192.0.2.1" ||
+				ipAddresses[1] != "192.0.2.2" {
+				t.Fatalf("unexpected server entries: %v", ipAddresses)
+			}
+		}
+	}
+
+	_, err = NewEmbeddedServerEntryFileSource(
+		filepath.Join(testDataDirName, "missing")).ServerEntries(context.Background())
+	if err == nil {
+		t.Fatalf("ServerEntries unexpectedly succeeded")
+	}
+}
+
+func collectServerEntrySource(source ServerEntrySource) ([]string, error) {
+
+	serverEntries, err := source.ServerEntries(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer serverEntries.Close()
+
+	var ipAddresses []string
+	for {
+		serverEntry, err := serverEntries.Next()
+		if err != nil {
+			return nil, err
+		}
+		if serverEntry == nil {
+			break
+		}
+		if serverEntry.LocalSource != protocol.SERVER_ENTRY_SOURCE_EMBEDDED {
+			return nil, errors.New("unexpected server entry source")
+		}
+		ipAddresses = append(ipAddresses, serverEntry.IpAddress)
+	}
+
+	return ipAddresses, nil
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrSessionByteBudgetExceeded is returned by tunneled connections and
+// DownloadUpgrade when the SessionByteBudget is exceeded, or when the
+// remaining budget is insufficient for an upgrade download.
+// ErrSessionByteBudgetExceeded is returned without added context.
+var ErrSessionByteBudgetExceeded = errors.New("session byte budget exceeded")
+
+// sessionByteBudget totals the port forward bytes transferred by all of a
+// controller's tunnels and tracks when the total exceeds the
+// SessionByteBudget. All methods may be called on a nil sessionByteBudget,
+// which is no budget.
+type sessionByteBudget struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	bytesTransferred int64
+	budget           int64
+	isExceeded       int32
+	signalExceeded   chan struct{}
+}
+
+func newSessionByteBudget(budget int64) *sessionByteBudget {
+	return &sessionByteBudget{
+		budget:         budget,
+		signalExceeded: make(chan struct{}, 1),
+	}
+}
+
+// add adds n bytes to the total. When the total first exceeds the budget,
+// NoticeSessionByteBudgetExceeded is emitted and signalExceeded is
+// signaled.
+func (b *sessionByteBudget) add(n int64) {
+	if b == nil || b.budget <= 0 || n <= 0 {
+		return
+	}
+	bytesTransferred := atomic.AddInt64(&b.bytesTransferred, n)
+	if bytesTransferred > b.budget &&
+		atomic.CompareAndSwapInt32(&b.isExceeded, 0, 1) {
+
+		NoticeSessionByteBudgetExceeded(b.budget, bytesTransferred)
+		select {
+		case b.signalExceeded <- *new(struct{}):
+		default:
+		}
+	}
+}
+
+// exceeded indicates whether the total has exceeded the budget since the
+// last reset.
+func (b *sessionByteBudget) exceeded() bool {
+	return b != nil && atomic.LoadInt32(&b.isExceeded) == 1
+}
+
+// remaining returns the number of bytes remaining in the budget, or -1 when
+// there is no budget.
+func (b *sessionByteBudget) remaining() int64 {
+	if b == nil || b.budget <= 0 {
+		return -1
+	}
+	remaining := b.budget - atomic.LoadInt64(&b.bytesTransferred)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining
+}
+
+// reset clears the total and the exceeded state.
+func (b *sessionByteBudget) reset() {
+	if b == nil {
+		return
+	}
+	atomic.StoreInt64(&b.bytesTransferred, 0)
+	atomic.StoreInt32(&b.isExceeded, 0)
+	select {
+	case <-b.signalExceeded:
+	default:
+	}
+}
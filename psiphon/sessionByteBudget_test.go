@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSessionByteBudget(t *testing.T) {
+
+	var noBudget *sessionByteBudget
+	noBudget.add(1000)
+	if noBudget.exceeded() || noBudget.remaining() != -1 {
+		t.Fatalf("unexpected nil budget state")
+	}
+
+	budget := newSessionByteBudget(1600)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go io.Copy(server, server)
+
+	conn := &tunnelMetricsConn{
+		Conn:   client,
+		tunnel: &Tunnel{sessionByteBudget: budget},
+	}
+
+	buffer := make([]byte, 400)
+
+	// Within the budget, traffic flows.
+
+	for i := 0; i < 2; i++ {
+		_, err := conn.Write(buffer)
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+		_, err = io.ReadFull(conn, buffer)
+		if err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+	}
+
+	if budget.exceeded() || budget.remaining() != 0 {
+		t.Fatalf("unexpected budget state: %d", budget.remaining())
+	}
+
+	select {
+	case <-budget.signalExceeded:
+		t.Fatalf("unexpected exceeded signal")
+	default:
+	}
+
+	// Exceeding the budget signals the controller and halts new traffic.
+
+	_, err := conn.Write(buffer[:1])
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	if !budget.exceeded() {
+		t.Fatalf("budget not exceeded")
+	}
+
+	select {
+	case <-budget.signalExceeded:
+	default:
+		t.Fatalf("missing exceeded signal")
+	}
+
+	_, err = conn.Write(buffer)
+	if err == nil {
+		t.Fatalf("unexpected Write success")
+	}
+
+	_, err = conn.Read(buffer)
+	if err == nil {
+		t.Fatalf("unexpected Read success")
+	}
+
+	// After a reset, traffic flows again.
+
+	budget.reset()
+
+	if budget.exceeded() || budget.remaining() != 1600 {
+		t.Fatalf("unexpected budget state after reset")
+	}
+
+	_, err = conn.Read(buffer[:1])
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+
+	_, err = conn.Write(buffer)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+}
@@ -20,12 +20,14 @@
 package psiphon
 
 import (
-	"fmt"
 	"net"
+	"strconv"
 	"sync"
+	"time"
 
 	socks "github.com/Psiphon-Inc/goptlib"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 )
 
 // SocksProxy is a SOCKS server that accepts local host connections
@@ -37,7 +39,10 @@ type SocksProxy struct {
 	listener               *socks.SocksListener
 	serveWaitGroup         *sync.WaitGroup
 	openConns              *common.Conns
+	portForwardLimiter     *portForwardLimiter
+	portForwardIdleTimeout time.Duration
 	stopListeningBroadcast chan struct{}
+	notices                *noticeLogger
 }
 
 var _SOCKS_PROXY_TYPE = "SOCKS"
@@ -45,16 +50,30 @@ var _SOCKS_PROXY_TYPE = "SOCKS"
 // NewSocksProxy initializes a new SOCKS server. It begins listening for
 // connections, starts a goroutine that runs an accept loop, and returns
 // leaving the accept loop running.
+//
+// The SOCKS server listens on config.LocalSocksProxyAddress, when set, and
+// otherwise on listenIP and config.LocalSocksProxyPort.
 func NewSocksProxy(
 	config *Config,
 	tunneler Tunneler,
 	listenIP string) (proxy *SocksProxy, err error) {
 
-	listener, err := socks.ListenSocks(
-		"tcp", fmt.Sprintf("%s:%d", listenIP, config.LocalSocksProxyPort))
+	listenAddress := config.LocalSocksProxyAddress
+	if listenAddress == "" {
+		listenAddress = net.JoinHostPort(
+			listenIP, strconv.Itoa(config.LocalSocksProxyPort))
+	}
+
+	listener, err := socks.ListenSocksWithAuth(
+		"tcp",
+		listenAddress,
+		config.LocalSocksProxyUsername,
+		config.LocalSocksProxyPassword)
 	if err != nil {
 		if IsAddressInUseError(err) {
-			NoticeSocksProxyPortInUse(config.LocalSocksProxyPort)
+			_, portString, _ := net.SplitHostPort(listenAddress)
+			port, _ := strconv.Atoi(portString)
+			config.notices.SocksProxyPortInUse(port)
 		}
 		return nil, common.ContextError(err)
 	}
@@ -63,11 +82,16 @@ func NewSocksProxy(
 		listener:               listener,
 		serveWaitGroup:         new(sync.WaitGroup),
 		openConns:              new(common.Conns),
+		portForwardLimiter:     newPortForwardLimiter(config, _SOCKS_PROXY_TYPE),
+		portForwardIdleTimeout: config.clientParameters.Get().Duration(parameters.PortForwardIdleTimeout),
 		stopListeningBroadcast: make(chan struct{}),
+		notices:                config.notices,
 	}
 	proxy.serveWaitGroup.Add(1)
 	go proxy.serve()
-	NoticeListeningSocksProxyPort(proxy.listener.Addr().(*net.TCPAddr).Port)
+	proxy.notices.ListeningSocksProxyPort(
+		proxy.listener.Addr().(*net.TCPAddr).Port,
+		proxy.listener.Addr().String())
 	return proxy, nil
 }
 
@@ -87,7 +111,15 @@ func (proxy *SocksProxy) socksConnectionHandler(localConn *socks.SocksConn) (err
 	// Using downstreamConn so localConn.Close() will be called when remoteConn.Close() is called.
 	// This ensures that the downstream client (e.g., web browser) doesn't keep waiting on the
 	// open connection for data which will never arrive.
-	remoteConn, err := proxy.tunneler.Dial(localConn.Req.Target, false, localConn)
+	remoteConn, err := proxy.portForwardLimiter.dial(
+		localConn.Req.Target,
+		func() (net.Conn, error) {
+			return proxy.tunneler.Dial(localConn.Req.Target, false, localConn)
+		})
+	if err == errPortForwardLimitExceeded || err == ErrConnectionRejected {
+		localConn.RejectReason(socks.SocksRepConnectionNotAllowed)
+		return nil
+	}
 	if err != nil {
 		return common.ContextError(err)
 	}
@@ -96,7 +128,7 @@ func (proxy *SocksProxy) socksConnectionHandler(localConn *socks.SocksConn) (err
 	if err != nil {
 		return common.ContextError(err)
 	}
-	LocalProxyRelay(_SOCKS_PROXY_TYPE, localConn, remoteConn)
+	localProxyRelay(proxy.notices, _SOCKS_PROXY_TYPE, proxy.portForwardIdleTimeout, localConn, remoteConn)
 	return nil
 }
 
@@ -116,7 +148,7 @@ loop:
 		default:
 		}
 		if err != nil {
-			NoticeAlert("SOCKS proxy accept error: %s", err)
+			proxy.notices.Alert("SOCKS proxy accept error: %s", err)
 			if e, ok := err.(net.Error); ok && e.Temporary() {
 				// Temporary error, keep running
 				continue
@@ -128,9 +160,9 @@ loop:
 		go func() {
 			err := proxy.socksConnectionHandler(socksConnection)
 			if err != nil {
-				NoticeLocalProxyError(_SOCKS_PROXY_TYPE, common.ContextError(err))
+				proxy.notices.LocalProxyError(_SOCKS_PROXY_TYPE, common.ContextError(err))
 			}
 		}()
 	}
-	NoticeInfo("SOCKS proxy stopped")
+	proxy.notices.Info("SOCKS proxy stopped")
 }
@@ -0,0 +1,509 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// testDirectTunneler is a Tunneler which dials directly, without tunneling.
+type testDirectTunneler struct {
+}
+
+func (tunneler *testDirectTunneler) Dial(
+	remoteAddr string, _ bool, _ net.Conn) (net.Conn, error) {
+	return net.Dial("tcp", remoteAddr)
+}
+
+func (tunneler *testDirectTunneler) DirectDial(remoteAddr string) (net.Conn, error) {
+	return net.Dial("tcp", remoteAddr)
+}
+
+func (tunneler *testDirectTunneler) SignalComponentFailure() {
+}
+
+func loadTestProxyConfig(t *testing.T) *Config {
+	config, err := LoadConfig([]byte(`
+		{
+			"PropagationChannelId" : "0",
+			"SponsorId" : "0"
+		}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	return config
+}
+
+func TestSocksProxyAuthentication(t *testing.T) {
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	defer echoListener.Close()
+
+	go func() {
+		for {
+			conn, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	testCases := []struct {
+		description     string
+		proxyUsername   string
+		proxyPassword   string
+		clientAuth      *proxy.Auth
+		expectConnected bool
+	}{
+		{"no auth required, no auth", "", "", nil, true},
+		{"no auth required, with auth", "", "", &proxy.Auth{User: "user", Password: "password"}, true},
+		{"auth required, valid auth", "user", "password", &proxy.Auth{User: "user", Password: "password"}, true},
+		{"auth required, invalid password", "user", "password", &proxy.Auth{User: "user", Password: "wrong"}, false},
+		{"auth required, invalid username", "user", "password", &proxy.Auth{User: "wrong", Password: "password"}, false},
+		{"auth required, no auth", "user", "password", nil, false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			config := loadTestProxyConfig(t)
+			config.LocalSocksProxyUsername = testCase.proxyUsername
+			config.LocalSocksProxyPassword = testCase.proxyPassword
+
+			socksProxy, err := NewSocksProxy(config, &testDirectTunneler{}, "127.0.0.1")
+			if err != nil {
+				t.Fatalf("NewSocksProxy failed: %s", err)
+			}
+			defer socksProxy.Close()
+
+			dialer, err := proxy.SOCKS5(
+				"tcp",
+				socksProxy.listener.Addr().String(),
+				testCase.clientAuth,
+				proxy.Direct)
+			if err != nil {
+				t.Fatalf("proxy.SOCKS5 failed: %s", err)
+			}
+
+			conn, err := dialer.Dial("tcp", echoListener.Addr().String())
+
+			if !testCase.expectConnected {
+				if err == nil {
+					conn.Close()
+					t.Fatalf("unexpected dial success")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("dial failed: %s", err)
+			}
+			defer conn.Close()
+
+			message := []byte("hello")
+			_, err = conn.Write(message)
+			if err != nil {
+				t.Fatalf("Write failed: %s", err)
+			}
+			response := make([]byte, len(message))
+			_, err = io.ReadFull(conn, response)
+			if err != nil {
+				t.Fatalf("ReadFull failed: %s", err)
+			}
+			if !bytes.Equal(message, response) {
+				t.Fatalf("unexpected response: %s", response)
+			}
+		})
+	}
+}
+
+func TestSocksProxyListenAddress(t *testing.T) {
+
+	listeningAddresses := make(chan string, 1)
+
+	SetNoticeWriter(NewNoticeReceiver(
+		func(notice []byte) {
+			noticeType, payload, err := GetNotice(notice)
+			if err != nil {
+				return
+			}
+			if noticeType == "ListeningSocksProxyPort" {
+				listeningAddresses <- payload["address"].(string)
+			}
+		}))
+	defer SetNoticeWriter(os.Stderr)
+
+	config := loadTestProxyConfig(t)
+	config.LocalSocksProxyAddress = "127.0.0.1:0"
+
+	// listenIP is ignored when LocalSocksProxyAddress is set.
+	socksProxy, err := NewSocksProxy(config, &testDirectTunneler{}, "0.0.0.0")
+	if err != nil {
+		t.Fatalf("NewSocksProxy failed: %s", err)
+	}
+	defer socksProxy.Close()
+
+	address := <-listeningAddresses
+
+	if address != socksProxy.listener.Addr().String() {
+		t.Fatalf("unexpected listening address: %s", address)
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		t.Fatalf("SplitHostPort failed: %s", err)
+	}
+	if host != "127.0.0.1" || port == "0" {
+		t.Fatalf("unexpected listening address: %s", address)
+	}
+}
+
+func TestSocksProxyPortForwardLimits(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	// The destination server closes each connection after receiving one
+	// byte. testDirectTunneler doesn't close port forwards when the local
+	// conn closes, so the test closes a port forward by sending a byte.
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var b [1]byte
+				conn.Read(b[:])
+			}()
+		}
+	}()
+
+	config := loadTestProxyConfig(t)
+	config.MaxOpenPortForwards = 3
+	config.MaxOpenPortForwardsPerHost = 2
+
+	socksProxy, err := NewSocksProxy(config, &testDirectTunneler{}, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewSocksProxy failed: %s", err)
+	}
+	defer socksProxy.Close()
+
+	dialer, err := proxy.SOCKS5(
+		"tcp", socksProxy.listener.Addr().String(), nil, proxy.Direct)
+	if err != nil {
+		t.Fatalf("proxy.SOCKS5 failed: %s", err)
+	}
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	ipTarget := net.JoinHostPort("127.0.0.1", port)
+	nameTarget := net.JoinHostPort("localhost", port)
+
+	var conns []net.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for _, testCase := range []struct {
+		target        string
+		expectSuccess bool
+	}{
+		{ipTarget, true},
+		{ipTarget, true},
+		{ipTarget, false},   // exceeds MaxOpenPortForwardsPerHost
+		{nameTarget, true},  // distinct destination host
+		{nameTarget, false}, // exceeds MaxOpenPortForwards
+	} {
+		conn, err := dialer.Dial("tcp", testCase.target)
+		if testCase.expectSuccess != (err == nil) {
+			t.Fatalf("unexpected dial result for %s: %v", testCase.target, err)
+		}
+		if err == nil {
+			conns = append(conns, conn)
+		}
+	}
+
+	// Closing a port forward frees its slot. The relay closes the port
+	// forward asynchronously, so allow some time for the release.
+
+	conns[0].Write([]byte{0})
+	conns[0].Close()
+	conns = conns[1:]
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := dialer.Dial("tcp", ipTarget)
+		if err == nil {
+			conns = append(conns, conn)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dial failed after close: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSocksProxyPortForwardIdle(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	// The destination server echoes and never closes a connection on its own.
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	config, err := LoadConfig([]byte(`
+		{
+			"PropagationChannelId" : "0",
+			"SponsorId" : "0",
+			"PortForwardIdleSeconds" : 1
+		}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	socksProxy, err := NewSocksProxy(config, &testDirectTunneler{}, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewSocksProxy failed: %s", err)
+	}
+	defer socksProxy.Close()
+
+	dialer, err := proxy.SOCKS5(
+		"tcp", socksProxy.listener.Addr().String(), nil, proxy.Direct)
+	if err != nil {
+		t.Fatalf("proxy.SOCKS5 failed: %s", err)
+	}
+
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	// While there's traffic, the port forward remains open past the idle
+	// timeout.
+
+	startTime := time.Now()
+	lastActivityTime := startTime
+	b := make([]byte, 1)
+	for time.Since(startTime) < 2*time.Second {
+		_, err = conn.Write(b)
+		if err == nil {
+			_, err = io.ReadFull(conn, b)
+		}
+		if err != nil {
+			t.Fatalf("relay failed with traffic: %s", err)
+		}
+		lastActivityTime = time.Now()
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Once the port forward goes idle past the timeout, the local
+	// connection is closed.
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Read(b)
+	if err == nil {
+		t.Fatalf("unexpected read success")
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		t.Fatalf("idle port forward not closed")
+	}
+	if time.Since(lastActivityTime) < 900*time.Millisecond {
+		t.Fatalf("idle port forward closed early")
+	}
+}
+
+func TestSocksProxyConnectionFilter(t *testing.T) {
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	defer echoListener.Close()
+
+	go func() {
+		for {
+			conn, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	rejections := make(chan string, 16)
+	SetNoticeCallback(func(noticeType string, data map[string]interface{}) {
+		if noticeType == "ConnectionRejected" {
+			rejections <- data["destination"].(string)
+		}
+	})
+	defer SetNoticeCallback(nil)
+
+	config := loadTestProxyConfig(t)
+
+	// With the direct connection fallback engaged, the controller dials
+	// directly, so port forwards succeed without a tunnel.
+
+	runCtx, stopRunning := context.WithCancel(context.Background())
+	defer stopRunning()
+
+	controller := &Controller{
+		config:                     config,
+		runCtx:                     runCtx,
+		tunnelPool:                 NewTunnelPool(1, TUNNEL_POOL_SELECTION_ROUND_ROBIN),
+		untunneledDialConfig:       &DialConfig{},
+		isDirectConnectionFallback: 1,
+	}
+
+	socksProxy, err := NewSocksProxy(config, controller, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewSocksProxy failed: %s", err)
+	}
+	defer socksProxy.Close()
+
+	dialer, err := proxy.SOCKS5(
+		"tcp", socksProxy.listener.Addr().String(), nil, proxy.Direct)
+	if err != nil {
+		t.Fatalf("proxy.SOCKS5 failed: %s", err)
+	}
+
+	destination := echoListener.Addr().String()
+
+	filtered := make(chan string, 16)
+
+	for _, testCase := range []struct {
+		description     string
+		filter          ConnectionFilter
+		expectConnected bool
+	}{
+		{"no filter", nil, true},
+		{"accepting filter", func(destination string) error {
+			filtered <- destination
+			return nil
+		}, true},
+		{"vetoing filter", func(destination string) error {
+			filtered <- destination
+			return errors.New("blocked")
+		}, false},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			controller.SetConnectionFilter(testCase.filter)
+
+			conn, err := dialer.Dial("tcp", destination)
+
+			if testCase.filter != nil {
+				select {
+				case filteredDestination := <-filtered:
+					if filteredDestination != destination {
+						t.Fatalf("unexpected filtered destination: %s", filteredDestination)
+					}
+				default:
+					t.Fatalf("filter not invoked")
+				}
+			}
+
+			if !testCase.expectConnected {
+				if err == nil {
+					conn.Close()
+					t.Fatalf("unexpected dial success")
+				}
+				select {
+				case rejectedDestination := <-rejections:
+					if rejectedDestination != destination {
+						t.Fatalf("unexpected rejected destination: %s", rejectedDestination)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("missing ConnectionRejected notice")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("dial failed: %s", err)
+			}
+			defer conn.Close()
+
+			message := []byte("hello")
+			_, err = conn.Write(message)
+			if err != nil {
+				t.Fatalf("Write failed: %s", err)
+			}
+			response := make([]byte, len(message))
+			_, err = io.ReadFull(conn, response)
+			if err != nil {
+				t.Fatalf("ReadFull failed: %s", err)
+			}
+			if !bytes.Equal(message, response) {
+				t.Fatalf("unexpected response: %s", response)
+			}
+		})
+	}
+}
@@ -60,6 +60,15 @@ import (
 // the tunnel registers without performing a handshake) then no routes
 // data is set and all IP addresses are classified as requiring tunneling.
 //
+// In addition to the user's region, the routes data for the regions listed
+// in SplitTunnelDirectRegions is fetched and installed, and IP addresses in
+// any of these regions may be accessed untunneled.
+//
+// SplitTunnelDirectCIDRs specifies networks which are always accessed
+// untunneled, independent of routes data. IP address destinations are
+// matched directly; hostname destinations are resolved, as above, which
+// requires SplitTunnelDNSServer.
+//
 // Split tunnel is made on a best effort basis. After the classifier is
 // started, but before routes data is available for the given region,
 // all IP addresses will be classified as requiring tunneling.
@@ -76,6 +85,9 @@ type SplitTunnelClassifier struct {
 	isRoutesSet          bool
 	cache                map[string]*classification
 	routes               common.SubnetLookup
+	directNetworks       []*net.IPNet
+	directRegions        []string
+	bypassedTargets      map[string]bool
 }
 
 type classification struct {
@@ -84,6 +96,16 @@ type classification struct {
 }
 
 func NewSplitTunnelClassifier(config *Config, tunneler Tunneler) *SplitTunnelClassifier {
+
+	// SplitTunnelDirectCIDRs is checked in Config.Validate.
+	var directNetworks []*net.IPNet
+	for _, CIDR := range config.SplitTunnelDirectCIDRs {
+		_, network, err := net.ParseCIDR(CIDR)
+		if err == nil {
+			directNetworks = append(directNetworks, network)
+		}
+	}
+
 	return &SplitTunnelClassifier{
 		clientParameters:     config.clientParameters,
 		userAgent:            MakePsiphonUserAgent(config),
@@ -91,6 +113,9 @@ func NewSplitTunnelClassifier(config *Config, tunneler Tunneler) *SplitTunnelCla
 		fetchRoutesWaitGroup: new(sync.WaitGroup),
 		isRoutesSet:          false,
 		cache:                make(map[string]*classification),
+		directNetworks:       directNetworks,
+		directRegions:        config.SplitTunnelDirectRegions,
+		bypassedTargets:      make(map[string]bool),
 	}
 }
 
@@ -118,18 +143,24 @@ func (classifier *SplitTunnelClassifier) Start(fetchRoutesTunnel *Tunnel) {
 		return
 	}
 
-	if fetchRoutesTunnel.serverContext == nil {
-		// Tunnel has no serverContext
-		return
+	regions := append([]string(nil), classifier.directRegions...)
+
+	// When the tunnel has no serverContext, or the region is unknown, only
+	// the SplitTunnelDirectRegions routes are fetched.
+	if fetchRoutesTunnel.serverContext != nil &&
+		fetchRoutesTunnel.serverContext.clientRegion != "" &&
+		!common.Contains(regions, fetchRoutesTunnel.serverContext.clientRegion) {
+
+		regions = append(regions, fetchRoutesTunnel.serverContext.clientRegion)
 	}
 
-	if fetchRoutesTunnel.serverContext.clientRegion == "" {
+	if len(regions) == 0 {
 		// Split tunnel region is unknown
 		return
 	}
 
 	classifier.fetchRoutesWaitGroup.Add(1)
-	go classifier.setRoutes(fetchRoutesTunnel)
+	go classifier.setRoutes(fetchRoutesTunnel, regions)
 }
 
 // Shutdown waits until the background setRoutes() goroutine is finished.
@@ -156,15 +187,22 @@ func (classifier *SplitTunnelClassifier) Shutdown() {
 // held during network access.
 func (classifier *SplitTunnelClassifier) IsUntunneled(targetAddress string) bool {
 
-	if !classifier.hasRoutes() {
+	hasRoutes := classifier.hasRoutes()
+
+	if !hasRoutes && len(classifier.directNetworks) == 0 {
 		return false
 	}
 
 	dnsServerAddress := classifier.clientParameters.Get().String(
 		parameters.SplitTunnelDNSServer)
 	if dnsServerAddress == "" {
-		// Split tunnel has been disabled.
-		return false
+		// Split tunnel routes classification has been disabled. Without a
+		// DNS server, only IP address destinations may be matched against
+		// SplitTunnelDirectCIDRs.
+		hasRoutes = false
+		if len(classifier.directNetworks) == 0 || net.ParseIP(targetAddress) == nil {
+			return false
+		}
 	}
 
 	classifier.mutex.RLock()
@@ -182,50 +220,74 @@ func (classifier *SplitTunnelClassifier) IsUntunneled(targetAddress string) bool
 	}
 	expiry := monotime.Now().Add(ttl)
 
-	isUntunneled := classifier.ipAddressInRoutes(ipAddr)
+	isUntunneled := classifier.ipAddressInDirectNetworks(ipAddr) ||
+		(hasRoutes && classifier.ipAddressInRoutes(ipAddr))
 
 	// TODO: garbage collect expired items from cache?
 
 	classifier.mutex.Lock()
 	classifier.cache[targetAddress] = &classification{isUntunneled, expiry}
+	firstBypass := isUntunneled && !classifier.bypassedTargets[targetAddress]
+	if firstBypass {
+		classifier.bypassedTargets[targetAddress] = true
+	}
 	classifier.mutex.Unlock()
 
-	if isUntunneled {
+	// The notice is emitted only the first time each destination is bypassed,
+	// not each time a classification expires and is repeated.
+	if firstBypass {
 		NoticeUntunneled(targetAddress)
 	}
 
 	return isUntunneled
 }
 
-// setRoutes is a background routine that fetches routes data and installs it,
-// which sets the isRoutesSet flag, indicating that IP addresses may now be classified.
-func (classifier *SplitTunnelClassifier) setRoutes(tunnel *Tunnel) {
+// setRoutes is a background routine that fetches routes data for each region
+// and installs it, which sets the isRoutesSet flag, indicating that IP
+// addresses may now be classified. Regions for which routes cannot be
+// fetched are skipped.
+func (classifier *SplitTunnelClassifier) setRoutes(tunnel *Tunnel, regions []string) {
 	defer classifier.fetchRoutesWaitGroup.Done()
 
 	// Note: a possible optimization is to install cached routes
 	// before making the request. That would ensure some split
 	// tunneling for the duration of the request.
 
-	routesData, err := classifier.getRoutes(tunnel)
-	if err != nil {
-		NoticeAlert("failed to get split tunnel routes: %s", err)
+	var routesData []byte
+	var installedRegions []string
+
+	for _, region := range regions {
+		regionRoutesData, err := classifier.getRoutes(tunnel, region)
+		if err != nil {
+			NoticeAlert("failed to get split tunnel routes for %s: %s", region, err)
+			continue
+		}
+		routesData = append(routesData, regionRoutesData...)
+		routesData = append(routesData, '\n')
+		installedRegions = append(installedRegions, region)
+	}
+
+	if len(installedRegions) == 0 {
 		return
 	}
 
-	err = classifier.installRoutes(routesData)
+	err := classifier.installRoutes(routesData)
 	if err != nil {
 		NoticeAlert("failed to install split tunnel routes: %s", err)
 		return
 	}
 
-	NoticeSplitTunnelRegion(tunnel.serverContext.clientRegion)
+	for _, region := range installedRegions {
+		NoticeSplitTunnelRegion(region)
+	}
 }
 
-// getRoutes makes a web request to download fresh routes data for the
-// given region, as indicated by the tunnel. It uses web caching, If-None-Match/ETag,
+// getRoutes makes a web request, through the tunnel, to download fresh
+// routes data for the given region. It uses web caching, If-None-Match/ETag,
 // to save downloading known routes data repeatedly. If the web request
 // fails and cached routes data is present, that cached data is returned.
-func (classifier *SplitTunnelClassifier) getRoutes(tunnel *Tunnel) (routesData []byte, err error) {
+func (classifier *SplitTunnelClassifier) getRoutes(
+	tunnel *Tunnel, region string) (routesData []byte, err error) {
 
 	p := classifier.clientParameters.Get()
 	routesSignaturePublicKey := p.String(parameters.SplitTunnelRoutesSignaturePublicKey)
@@ -233,7 +295,7 @@ func (classifier *SplitTunnelClassifier) getRoutes(tunnel *Tunnel) (routesData [
 	fetchTimeout := p.Duration(parameters.FetchSplitTunnelRoutesTimeout)
 	p = nil
 
-	url := fmt.Sprintf(fetchRoutesUrlFormat, tunnel.serverContext.clientRegion)
+	url := fmt.Sprintf(fetchRoutesUrlFormat, region)
 	request, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, common.ContextError(err)
@@ -241,7 +303,7 @@ func (classifier *SplitTunnelClassifier) getRoutes(tunnel *Tunnel) (routesData [
 
 	request.Header.Set("User-Agent", classifier.userAgent)
 
-	etag, err := GetSplitTunnelRoutesETag(tunnel.serverContext.clientRegion)
+	etag, err := GetSplitTunnelRoutesETag(region)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
@@ -328,7 +390,7 @@ func (classifier *SplitTunnelClassifier) getRoutes(tunnel *Tunnel) (routesData [
 	if !useCachedRoutes {
 		etag := response.Header.Get("ETag")
 		if etag != "" {
-			err := SetSplitTunnelRoutes(tunnel.serverContext.clientRegion, etag, routesData)
+			err := SetSplitTunnelRoutes(region, etag, routesData)
 			if err != nil {
 				NoticeAlert("failed to cache split tunnel routes: %s", common.ContextError(err))
 				// Proceed with fetched data, even when we can't cache it
@@ -337,7 +399,7 @@ func (classifier *SplitTunnelClassifier) getRoutes(tunnel *Tunnel) (routesData [
 	}
 
 	if useCachedRoutes {
-		routesData, err = GetSplitTunnelRoutesData(tunnel.serverContext.clientRegion)
+		routesData, err = GetSplitTunnelRoutesData(region)
 		if err != nil {
 			return nil, common.ContextError(err)
 		}
@@ -381,6 +443,17 @@ func (classifier *SplitTunnelClassifier) ipAddressInRoutes(ipAddr net.IP) bool {
 	return classifier.routes.ContainsIPAddress(ipAddr)
 }
 
+// ipAddressInDirectNetworks checks if a split tunnel candidate IP address is
+// in one of the SplitTunnelDirectCIDRs networks.
+func (classifier *SplitTunnelClassifier) ipAddressInDirectNetworks(ipAddr net.IP) bool {
+	for _, network := range classifier.directNetworks {
+		if network.Contains(ipAddr) {
+			return true
+		}
+	}
+	return false
+}
+
 // tunneledLookupIP resolves a split tunnel candidate hostname with a tunneled
 // DNS request.
 func tunneledLookupIP(
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+func TestSplitTunnelDirectCIDRs(t *testing.T) {
+
+	config, err := LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "SplitTunnelDirectCIDRs" : ["192.0.2.0/24", "2001:db8::/32"]
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	var noticeMutex sync.Mutex
+	untunneledNotices := make(map[string]int)
+
+	SetNoticeWriter(NewNoticeReceiver(
+		func(notice []byte) {
+			noticeType, payload, err := GetNotice(notice)
+			if err != nil || noticeType != "Untunneled" {
+				return
+			}
+			noticeMutex.Lock()
+			untunneledNotices[payload["address"].(string)] += 1
+			noticeMutex.Unlock()
+		}))
+	defer SetNoticeWriter(ioutil.Discard)
+
+	// No DNS tunneler is required to classify IP address destinations.
+	classifier := NewSplitTunnelClassifier(config, nil)
+
+	testCases := []struct {
+		address      string
+		isUntunneled bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.1", true},
+		{"2001:db8::1", true},
+		{"198.51.100.1", false},
+		{"2001:db9::1", false},
+		{"example.com", false},
+	}
+
+	for _, testCase := range testCases {
+		if classifier.IsUntunneled(testCase.address) != testCase.isUntunneled {
+			t.Errorf("unexpected classification for %s", testCase.address)
+		}
+	}
+
+	noticeMutex.Lock()
+	defer noticeMutex.Unlock()
+
+	if len(untunneledNotices) != 2 ||
+		untunneledNotices["192.0.2.1"] != 1 ||
+		untunneledNotices["2001:db8::1"] != 1 {
+		t.Errorf("unexpected Untunneled notices: %+v", untunneledNotices)
+	}
+
+	_, err = LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "SplitTunnelDirectCIDRs" : ["192.0.2.0"]
+    }`))
+	if err == nil {
+		t.Errorf("unexpected LoadConfig success with invalid CIDR")
+	}
+}
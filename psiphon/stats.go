@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Stats names. These names are stable and may be used as, or mapped to,
+// metric names by exporters.
+const (
+	STATS_TUNNELS_ESTABLISHED          = "tunnels_established"
+	STATS_TUNNELS_ACTIVE               = "tunnels_active"
+	STATS_TUNNEL_BYTES_SENT            = "tunnel_bytes_sent"
+	STATS_TUNNEL_BYTES_RECEIVED        = "tunnel_bytes_received"
+	STATS_UPGRADE_DOWNLOADS_COMPLETED  = "upgrade_downloads_completed"
+	STATS_UPGRADE_DOWNLOADS_FAILED     = "upgrade_downloads_failed"
+	STATS_UPGRADE_DOWNLOAD_BYTES       = "upgrade_download_bytes"
+	STATS_HANDSHAKE_FAILURES_SSH       = "handshake_failures_ssh"
+	STATS_HANDSHAKE_FAILURES_API       = "handshake_failures_api"
+	STATS_HANDSHAKE_FAILURES_TIMED_OUT = "handshake_failures_timed_out"
+)
+
+// statsValue is a counter or gauge. All operations on statsValue are atomic.
+type statsValue struct {
+	// value must be the first field to ensure 64-bit alignment for atomic
+	// operations on 32-bit platforms.
+	value   int64
+	name    string
+	isGauge bool
+}
+
+func (s *statsValue) add(delta int64) {
+	atomic.AddInt64(&s.value, delta)
+}
+
+var (
+	statsTunnelsEstablished        = &statsValue{name: STATS_TUNNELS_ESTABLISHED}
+	statsTunnelsActive             = &statsValue{name: STATS_TUNNELS_ACTIVE, isGauge: true}
+	statsTunnelBytesSent           = &statsValue{name: STATS_TUNNEL_BYTES_SENT}
+	statsTunnelBytesReceived       = &statsValue{name: STATS_TUNNEL_BYTES_RECEIVED}
+	statsUpgradeDownloadsCompleted = &statsValue{name: STATS_UPGRADE_DOWNLOADS_COMPLETED}
+	statsUpgradeDownloadsFailed    = &statsValue{name: STATS_UPGRADE_DOWNLOADS_FAILED}
+	statsUpgradeDownloadBytes      = &statsValue{name: STATS_UPGRADE_DOWNLOAD_BYTES}
+	statsHandshakeFailuresSSH      = &statsValue{name: STATS_HANDSHAKE_FAILURES_SSH}
+	statsHandshakeFailuresAPI      = &statsValue{name: STATS_HANDSHAKE_FAILURES_API}
+	statsHandshakeFailuresTimedOut = &statsValue{name: STATS_HANDSHAKE_FAILURES_TIMED_OUT}
+)
+
+var allStats = []*statsValue{
+	statsTunnelsEstablished,
+	statsTunnelsActive,
+	statsTunnelBytesSent,
+	statsTunnelBytesReceived,
+	statsUpgradeDownloadsCompleted,
+	statsUpgradeDownloadsFailed,
+	statsUpgradeDownloadBytes,
+	statsHandshakeFailuresSSH,
+	statsHandshakeFailuresAPI,
+	statsHandshakeFailuresTimedOut,
+}
+
+// GetStats returns a snapshot of the client counters and gauges, keyed by
+// the stable STATS_* names. Every name is always present in the returned
+// map. The stats are process-wide and are aggregated across all tunnels and
+// controllers.
+//
+// When reset is set, each counter is reset to 0 as it is read, so that the
+// returned values are the increments since the previous resetting call.
+// Gauges, such as STATS_TUNNELS_ACTIVE, are never reset.
+//
+// GetStats is safe to call concurrently and is intended to be polled by
+// a metrics exporter, such as a Prometheus scrape handler.
+func GetStats(reset bool) map[string]int64 {
+	stats := make(map[string]int64)
+	for _, s := range allStats {
+		if reset && !s.isGauge {
+			stats[s.name] = atomic.SwapInt64(&s.value, 0)
+		} else {
+			stats[s.name] = atomic.LoadInt64(&s.value)
+		}
+	}
+	return stats
+}
+
+// countHandshakeFailure records a failed SSH or API handshake. Handshakes
+// which fail due to ctx timing out are counted as timed out, regardless of
+// which handshake failed; handshakes interrupted by ctx cancellation, as
+// happens when establishment completes or is stopped, are not counted.
+func countHandshakeFailure(ctx context.Context, s *statsValue) {
+	switch ctx.Err() {
+	case nil:
+		s.add(1)
+	case context.DeadlineExceeded:
+		statsHandshakeFailuresTimedOut.add(1)
+	}
+}
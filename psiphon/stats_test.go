@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestGetStats(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	entity := bytes.Repeat([]byte("upgrade"), 1000)
+
+	server := makeUpgradeTestServer(entity)
+	defer server.Close()
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-stats-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config := makeUpgradeDownloadTestConfig(t, testDataDirName, server.URL, nil)
+
+	initialStats := GetStats(false)
+	for _, s := range allStats {
+		if _, ok := initialStats[s.name]; !ok {
+			t.Fatalf("missing stat: %s", s.name)
+		}
+	}
+
+	err = DownloadUpgrade(context.Background(), config, 0, "2", nil, &DialConfig{})
+	if err != nil {
+		t.Fatalf("DownloadUpgrade failed: %s", err)
+	}
+
+	stats := GetStats(true)
+
+	for name, expectedIncrement := range map[string]int64{
+		STATS_UPGRADE_DOWNLOADS_COMPLETED: 1,
+		STATS_UPGRADE_DOWNLOADS_FAILED:    0,
+		STATS_UPGRADE_DOWNLOAD_BYTES:      int64(len(entity)),
+	} {
+		if stats[name]-initialStats[name] != expectedIncrement {
+			t.Fatalf("unexpected %s: %d -> %d", name, initialStats[name], stats[name])
+		}
+	}
+
+	// The previous GetStats call reset all counters.
+
+	stats = GetStats(false)
+	for _, s := range allStats {
+		if !s.isGauge && stats[s.name] != 0 {
+			t.Fatalf("unexpected %s after reset: %d", s.name, stats[s.name])
+		}
+	}
+}
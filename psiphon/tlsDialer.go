@@ -76,7 +76,9 @@ import (
 	"crypto/x509"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
@@ -85,10 +87,28 @@ import (
 )
 
 const (
-	TLSProfileAndroid = "Android"
-	TLSProfileChrome  = "Chrome"
+	TLSProfileAndroid    = "Android"
+	TLSProfileChrome     = "Chrome"
+	TLSProfileFirefox    = "Firefox"
+	TLSProfileRandomized = "Randomized"
 )
 
+// normalizeConfigTLSProfile returns the TLS profile constant matching
+// the case-insensitive Config.TLSProfile value. Only the profiles
+// implemented by Go TLS may be configured; TLSProfileAndroid is subject
+// to OpenSSL compatibility constraints and is only selected by
+// SelectTLSProfile.
+func normalizeConfigTLSProfile(tlsProfile string) (string, bool) {
+	for _, profile := range []string{
+		TLSProfileChrome, TLSProfileFirefox, TLSProfileRandomized} {
+
+		if strings.EqualFold(tlsProfile, profile) {
+			return profile, true
+		}
+	}
+	return "", false
+}
+
 // CustomTLSConfig contains parameters to determine the behavior
 // of CustomTLSDial.
 type CustomTLSConfig struct {
@@ -137,9 +157,11 @@ type CustomTLSConfig struct {
 	// is selected at random. Setting TLSProfile allows the caller to pin
 	// the selection so all TLS connections in a certain context (e.g. a
 	// single meek connection) use a consistent value.
-	// Valid values include "Android" and "Chrome". The value should be
-	// selected by calling SelectTLSProfile, which will pick a value at
-	// random, but subject to compatibility constraints.
+	// Valid values include "Android", "Chrome", "Firefox", and
+	// "Randomized". The value should be either selected by calling
+	// SelectTLSProfile, which will pick a value at random, but subject to
+	// compatibility constraints; or be a validated Config.TLSProfile.
+	// With "Randomized", each TLS dial sends a different ClientHello.
 	TLSProfile string
 
 	// TrustedCACertificatesFilename specifies a file containing trusted
@@ -151,6 +173,20 @@ type CustomTLSConfig struct {
 	// ObfuscatedSessionTicketKey enables obfuscated session tickets
 	// using the specified key.
 	ObfuscatedSessionTicketKey string
+
+	// RootCAs specifies the CAs used to verify the server certificate.
+	// When nil, the host's root CAs are used. RootCAs is ignored when
+	// SkipVerify is set and doesn't apply to OpenSSL connections.
+	RootCAs *x509.CertPool
+
+	// VerifyPeerCertificate, when set, is called after normal server
+	// certificate verification, as in crypto/tls. It doesn't apply to
+	// OpenSSL connections.
+	VerifyPeerCertificate func([][]byte, [][]*x509.Certificate) error
+
+	// NextProtos specifies the ALPN protocols to offer. When nil, the
+	// selected TLS profile determines the ALPN protocols.
+	NextProtos []string
 }
 
 func SelectTLSProfile(
@@ -245,6 +281,7 @@ func CustomTLSDial(
 				config.ObfuscatedSessionTicketKey != "" ||
 				// TODO: (... || config.VerifyLegacyCertificate != nil)
 				!(config.SkipVerify || config.TrustedCACertificatesFilename != "") {
+				rawConn.Close()
 				return nil, common.ContextError(errors.New("TLSProfileAndroid not supported"))
 			}
 
@@ -254,9 +291,28 @@ func CustomTLSDial(
 
 			tlsConfig.EmulateChrome = true
 			tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+
+		case TLSProfileFirefox:
+
+			tlsConfig.EmulateFirefox = true
+			tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+
+		case TLSProfileRandomized:
+
+			tlsConfig.RandomizeClientHello = true
+			tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+
+		default:
+			rawConn.Close()
+			return nil, common.ContextError(
+				fmt.Errorf("unknown TLS profile: %s", selectedTLSProfile))
 		}
 	}
 
+	tlsConfig.RootCAs = config.RootCAs
+	tlsConfig.VerifyPeerCertificate = config.VerifyPeerCertificate
+	tlsConfig.NextProtos = config.NextProtos
+
 	if config.SkipVerify {
 		tlsConfig.InsecureSkipVerify = true
 	}
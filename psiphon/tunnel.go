@@ -29,6 +29,7 @@ import (
 	"io"
 	"net"
 	"net/url"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -78,11 +79,23 @@ type TunnelOwner interface {
 // tunnel includes a network connection to the specified server
 // and an SSH session built on top of that transport.
 type Tunnel struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	bytesSent                    int64
+	bytesReceived                int64
+	lastPortForwardActivity      int64
 	mutex                        *sync.Mutex
 	config                       *Config
+	notices                      *noticeLogger
 	isActivated                  bool
 	isDiscarded                  bool
 	isClosed                     bool
+	isShuttingDown               bool
+	isPaused                     int32
+	signalResume                 chan struct{}
+	openPortForwards             map[*TunneledConn]bool
+	signalPortForwardClosed      chan struct{}
 	sessionId                    string
 	serverEntry                  *protocol.ServerEntry
 	serverContext                *ServerContext
@@ -100,6 +113,8 @@ type Tunnel struct {
 	establishedTime              monotime.Time
 	dialStats                    *DialStats
 	newClientVerificationPayload chan string
+	sessionByteBudget            *sessionByteBudget
+	connectionTrace              *connectionTrace
 }
 
 // DialStats records additional dial config that is sent to the server for
@@ -114,6 +129,10 @@ type Tunnel struct {
 // dial process has begun. The atomic.Value will contain a string, initialized
 // to "", and set to the resolved IP address once that part of the dial
 // process has completed.
+//
+// DialDuration, SSHHandshakeDuration, and APIHandshakeDuration record the
+// time spent in each establishment phase. These are reported in the
+// ConnectedServer notice and are not sent to the server.
 type DialStats struct {
 	SelectedSSHClientVersion       bool
 	SSHClientVersion               string
@@ -128,6 +147,48 @@ type DialStats struct {
 	UserAgent                      string
 	SelectedTLSProfile             bool
 	TLSProfile                     string
+	DialDuration                   time.Duration
+	SSHHandshakeDuration           time.Duration
+	APIHandshakeDuration           time.Duration
+}
+
+// Connection failure reasons, which classify ConnectTunnel errors in
+// establishment round summaries.
+const (
+	CONNECT_FAILURE_REASON_DIAL          = "dial"
+	CONNECT_FAILURE_REASON_SSH_HANDSHAKE = "ssh_handshake"
+	CONNECT_FAILURE_REASON_TIMEOUT       = "timeout"
+	CONNECT_FAILURE_REASON_OTHER         = "other"
+)
+
+// connectTunnelError is an error returned by ConnectTunnel along with a
+// connection failure reason.
+type connectTunnelError struct {
+	reason string
+	err    error
+}
+
+func (err *connectTunnelError) Error() string {
+	return err.err.Error()
+}
+
+// newConnectTunnelError makes a connectTunnelError with the specified
+// reason, or with CONNECT_FAILURE_REASON_TIMEOUT when the connection
+// attempt has timed out.
+func newConnectTunnelError(ctx context.Context, reason string, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		reason = CONNECT_FAILURE_REASON_TIMEOUT
+	}
+	return &connectTunnelError{reason: reason, err: err}
+}
+
+// getConnectFailureReason returns the connection failure reason for a
+// ConnectTunnel error.
+func getConnectFailureReason(err error) string {
+	if err, ok := err.(*connectTunnelError); ok {
+		return err.reason
+	}
+	return CONNECT_FAILURE_REASON_OTHER
 }
 
 // ConnectTunnel first makes a network transport connection to the
@@ -167,13 +228,17 @@ func ConnectTunnel(
 	dialResult, err := dialSsh(
 		ctx, config, serverEntry, selectedProtocol, sessionId)
 	if err != nil {
-		return nil, common.ContextError(err)
+		return nil, &connectTunnelError{
+			reason: getConnectFailureReason(err),
+			err:    common.ContextError(err),
+		}
 	}
 
 	// The tunnel is now connected
 	return &Tunnel{
 		mutex:             new(sync.Mutex),
 		config:            config,
+		notices:           config.notices,
 		sessionId:         sessionId,
 		serverEntry:       serverEntry,
 		protocol:          selectedProtocol,
@@ -183,11 +248,16 @@ func ConnectTunnel(
 		// A buffer allows at least one signal to be sent even when the receiver is
 		// not listening. Senders should not block.
 		signalPortForwardFailure:   make(chan struct{}, 1),
+		openPortForwards:           make(map[*TunneledConn]bool),
+		signalPortForwardClosed:    make(chan struct{}, 1),
 		adjustedEstablishStartTime: adjustedEstablishStartTime,
 		dialStats:                  dialResult.dialStats,
+		connectionTrace:            dialResult.connectionTrace,
 		// Buffer allows SetClientVerificationPayload to submit one new payload
 		// without blocking or dropping it.
 		newClientVerificationPayload: make(chan string, 1),
+		// Buffer allows setPaused to signal a resume without blocking.
+		signalResume: make(chan struct{}, 1),
 	}, nil
 }
 
@@ -203,7 +273,7 @@ func (tunnel *Tunnel) Activate(
 	// fails.
 	var serverContext *ServerContext
 	if !tunnel.config.DisableApi {
-		NoticeInfo("starting server context for %s", tunnel.serverEntry.IpAddress)
+		tunnel.notices.Info("starting server context for %s", tunnel.serverEntry.IpAddress)
 
 		// Call NewServerContext in a goroutine, as it blocks on a network operation,
 		// the handshake request, and would block shutdown. If the shutdown signal is
@@ -231,6 +301,8 @@ func (tunnel *Tunnel) Activate(
 
 		resultChannel := make(chan newServerContextResult)
 
+		apiHandshakeStartTime := monotime.Now()
+
 		go func() {
 			serverContext, err := NewServerContext(tunnel)
 			resultChannel <- newServerContextResult{
@@ -251,12 +323,39 @@ func (tunnel *Tunnel) Activate(
 		}
 
 		if result.err != nil {
+			countHandshakeFailure(ctx, statsHandshakeFailuresAPI)
 			return common.ContextError(
 				fmt.Errorf("error starting server context for %s: %s",
 					tunnel.serverEntry.IpAddress, result.err))
 		}
 
 		serverContext = result.serverContext
+
+		tunnel.dialStats.APIHandshakeDuration = monotime.Since(apiHandshakeStartTime)
+
+		tunnel.notices.Homepages(serverContext.homepages)
+	}
+
+	// NoticeConnectedServer is emitted once all establishment phases have
+	// completed, so that the reported timing covers the entire connection,
+	// including any time spent in internal retries within each phase.
+	tunnel.notices.ConnectedServer(
+		tunnel.serverEntry.IpAddress,
+		tunnel.ServerRegion(),
+		tunnel.Protocol(),
+		tunnel.dialStats)
+
+	// Meek throughput is limited by the polling interval and request payload
+	// size, and some CDNs impose small payload sizes. Report these parameters
+	// so that slow meek tunnels can be correlated with them.
+	if protocol.TunnelProtocolUsesMeek(tunnel.protocol) {
+		p := tunnel.config.clientParameters.Get()
+		tunnel.notices.Info(
+			"meek parameters for %s: min poll interval %s, max poll interval %s, max request payload %d bytes",
+			tunnel.serverEntry.IpAddress,
+			p.Duration(parameters.MeekMinPollInterval),
+			p.Duration(parameters.MeekMaxPollInterval),
+			getMeekMaxRequestPayloadLength(p))
 	}
 
 	tunnel.mutex.Lock()
@@ -271,6 +370,9 @@ func (tunnel *Tunnel) Activate(
 	tunnel.isActivated = true
 	tunnel.serverContext = serverContext
 
+	statsTunnelsEstablished.add(1)
+	statsTunnelsActive.add(1)
+
 	// establishDuration is the elapsed time between the controller starting tunnel
 	// establishment and this tunnel being established. The reported value represents
 	// how long the user waited between starting the client and having a usable tunnel;
@@ -282,6 +384,8 @@ func (tunnel *Tunnel) Activate(
 	tunnel.establishDuration = monotime.Since(tunnel.adjustedEstablishStartTime)
 	tunnel.establishedTime = monotime.Now()
 
+	tunnel.connectionTrace.record(CONNECTION_TRACE_EVENT_ESTABLISHED, "", TunnelMetrics{})
+
 	// Use the Background context instead of the controller run context, as tunnels
 	// are terminated when the controller calls tunnel.Close.
 	tunnel.operateCtx, tunnel.stopOperate = context.WithCancel(context.Background())
@@ -312,6 +416,10 @@ func (tunnel *Tunnel) Close(isDiscarded bool) {
 
 	if !isClosed {
 
+		if isActivated {
+			statsTunnelsActive.add(-1)
+		}
+
 		// Signal operateTunnel to stop before closing the tunnel -- this
 		// allows a final status request to be made in the case of an orderly
 		// shutdown.
@@ -335,8 +443,100 @@ func (tunnel *Tunnel) Close(isDiscarded bool) {
 
 		err := tunnel.sshClient.Wait()
 		if err != nil {
-			NoticeAlert("close tunnel ssh error: %s", err)
+			tunnel.notices.Alert("close tunnel ssh error: %s", err)
 		}
+
+		tunnel.connectionTrace.record(
+			CONNECTION_TRACE_EVENT_TEARDOWN, "", tunnel.GetMetrics())
+	}
+}
+
+// Shutdown stops accepting new port forwards, waits for in-flight port
+// forwards to close, and then closes the tunnel. When ctx is done before all
+// port forwards have closed, the remaining port forwards are forcibly
+// closed. Shutdown allows, for example, a nearly complete upgrade download to
+// finish before the tunnel is torn down.
+func (tunnel *Tunnel) Shutdown(ctx context.Context) {
+
+	tunnel.mutex.Lock()
+	tunnel.isShuttingDown = true
+	tunnel.mutex.Unlock()
+
+	forceClosedCount := tunnel.drainPortForwards(ctx)
+	if forceClosedCount > 0 {
+		tunnel.notices.Info("tunnel shutdown: force closed %d port forwards", forceClosedCount)
+	}
+
+	tunnel.Close(false)
+}
+
+// drainPortForwards waits until there are no open port forwards or until ctx
+// is done. Any port forwards still open when ctx is done are closed. Returns
+// the number of port forwards closed by drainPortForwards.
+func (tunnel *Tunnel) drainPortForwards(ctx context.Context) int {
+
+loop:
+	for {
+		tunnel.mutex.Lock()
+		openCount := len(tunnel.openPortForwards)
+		tunnel.mutex.Unlock()
+
+		if openCount == 0 {
+			return 0
+		}
+
+		select {
+		case <-tunnel.signalPortForwardClosed:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+
+	// TunneledConn.Close acquires the tunnel mutex, so the port forwards are
+	// closed after releasing it.
+
+	tunnel.mutex.Lock()
+	conns := make([]*TunneledConn, 0, len(tunnel.openPortForwards))
+	for conn := range tunnel.openPortForwards {
+		conns = append(conns, conn)
+	}
+	tunnel.mutex.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	return len(conns)
+}
+
+// addPortForward records an open port forward. addPortForward fails when the
+// tunnel is shutting down or closed.
+func (tunnel *Tunnel) addPortForward(conn *TunneledConn) bool {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	if tunnel.isShuttingDown || tunnel.isClosed {
+		return false
+	}
+	tunnel.openPortForwards[conn] = true
+	return true
+}
+
+// numPortForwards returns the number of open port forwards.
+func (tunnel *Tunnel) numPortForwards() int {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	return len(tunnel.openPortForwards)
+}
+
+// removePortForward removes a closed port forward and signals any pending
+// drainPortForwards.
+func (tunnel *Tunnel) removePortForward(conn *TunneledConn) {
+	tunnel.mutex.Lock()
+	delete(tunnel.openPortForwards, conn)
+	tunnel.mutex.Unlock()
+	select {
+	case tunnel.signalPortForwardClosed <- *new(struct{}):
+	default:
 	}
 }
 
@@ -347,6 +547,21 @@ func (tunnel *Tunnel) IsActivated() bool {
 	return tunnel.isActivated
 }
 
+// GetHandshakeResponse returns a copy of the Psiphon server's handshake
+// response. Returns nil when the tunnel is not activated or when the
+// handshake was not performed, as when DisableApi is set.
+func (tunnel *Tunnel) GetHandshakeResponse() *HandshakeResponse {
+	tunnel.mutex.Lock()
+	serverContext := tunnel.serverContext
+	tunnel.mutex.Unlock()
+
+	if serverContext == nil || serverContext.handshakeResponse == nil {
+		return nil
+	}
+
+	return serverContext.handshakeResponse.copy()
+}
+
 // IsDiscarded returns the tunnel's discarded flag.
 func (tunnel *Tunnel) IsDiscarded() bool {
 	tunnel.mutex.Lock()
@@ -354,6 +569,20 @@ func (tunnel *Tunnel) IsDiscarded() bool {
 	return tunnel.isDiscarded
 }
 
+// Protocol returns the tunnel protocol selected when the tunnel was
+// established. The value is fixed for the life of the tunnel, so Protocol
+// may be called from any goroutine.
+func (tunnel *Tunnel) Protocol() string {
+	return tunnel.protocol
+}
+
+// ServerRegion returns the region of the tunnel's server, as specified in
+// its server entry. As with Protocol, the value is fixed for the life of the
+// tunnel.
+func (tunnel *Tunnel) ServerRegion() string {
+	return tunnel.serverEntry.Region
+}
+
 // SendAPIRequest sends an API request as an SSH request through the tunnel.
 // This function blocks awaiting a response. Only one request may be in-flight
 // at once; a concurrent SendAPIRequest will block until an active request
@@ -384,6 +613,17 @@ func (tunnel *Tunnel) Dial(
 		return nil, common.ContextError(errors.New("tunnel is not activated"))
 	}
 
+	tunnel.mutex.Lock()
+	isShuttingDown := tunnel.isShuttingDown
+	tunnel.mutex.Unlock()
+	if isShuttingDown {
+		return nil, common.ContextError(errors.New("tunnel is shutting down"))
+	}
+
+	if tunnel.sessionByteBudget.exceeded() {
+		return nil, common.ContextError(ErrSessionByteBudgetExceeded)
+	}
+
 	type tunnelDialResult struct {
 		sshPortForwardConn net.Conn
 		err                error
@@ -424,12 +664,50 @@ func (tunnel *Tunnel) Dial(
 		return nil, common.ContextError(result.err)
 	}
 
-	conn = &TunneledConn{
+	tunneledConn := &TunneledConn{
 		Conn:           result.sshPortForwardConn,
 		tunnel:         tunnel,
 		downstreamConn: downstreamConn}
 
-	return tunnel.wrapWithTransferStats(conn), nil
+	// Shutdown may have started while the port forward was being dialed.
+	if !tunnel.addPortForward(tunneledConn) {
+		result.sshPortForwardConn.Close()
+		return nil, common.ContextError(errors.New("tunnel is shutting down"))
+	}
+
+	return tunnel.wrapWithTransferStats(tunneledConn), nil
+}
+
+// EndpointUnreachableError indicates that a tunnel is working but that a
+// destination is unreachable from the tunnel's egress: the server rejected
+// the port forward because it could not resolve or connect to the
+// destination, as when the destination refuses connections or the server's
+// dial times out. Other egress regions may still reach the destination.
+type EndpointUnreachableError struct {
+	RemoteAddr   string
+	EgressRegion string
+	Err          error
+}
+
+func (e *EndpointUnreachableError) Error() string {
+	return fmt.Sprintf(
+		"endpoint %s unreachable via egress region %s: %s",
+		e.RemoteAddr, e.EgressRegion, e.Err)
+}
+
+// classifyPortForwardError returns an EndpointUnreachableError when err, from
+// an SSH port forward dial, indicates that the destination is unreachable
+// from the tunnel's egress. Otherwise, err is returned unchanged.
+func (tunnel *Tunnel) classifyPortForwardError(remoteAddr string, err error) error {
+	if openChannelErr, ok := err.(*ssh.OpenChannelError); ok &&
+		openChannelErr.Reason == ssh.ConnectionFailed {
+		return &EndpointUnreachableError{
+			RemoteAddr:   remoteAddr,
+			EgressRegion: tunnel.serverEntry.Region,
+			Err:          err,
+		}
+	}
+	return err
 }
 
 func (tunnel *Tunnel) DialPacketTunnelChannel() (net.Conn, error) {
@@ -474,13 +752,62 @@ func (tunnel *Tunnel) wrapWithTransferStats(conn net.Conn) net.Conn {
 		regexps = tunnel.serverContext.StatsRegexps()
 	}
 
-	return transferstats.NewConn(conn, tunnel.serverEntry.IpAddress, regexps)
+	conn = transferstats.NewConn(conn, tunnel.serverEntry.IpAddress, regexps)
+
+	return &tunnelMetricsConn{Conn: conn, tunnel: tunnel}
+}
+
+// TunnelMetrics is a snapshot of tunnel traffic metrics.
+type TunnelMetrics struct {
+	BytesSent     int64
+	BytesReceived int64
+}
+
+// GetMetrics returns a snapshot of the total number of bytes sent and
+// received through all port forwards and packet tunnel channels of the
+// tunnel. GetMetrics may be called concurrently with tunnel traffic.
+func (tunnel *Tunnel) GetMetrics() TunnelMetrics {
+	return TunnelMetrics{
+		BytesSent:     atomic.LoadInt64(&tunnel.bytesSent),
+		BytesReceived: atomic.LoadInt64(&tunnel.bytesReceived),
+	}
+}
+
+// tunnelMetricsConn wraps a tunneled net.Conn and counts bytes sent and
+// received in the tunnel metrics and the session byte budget. Once the
+// session byte budget is exceeded, reads and writes fail, halting traffic
+// before the controller disconnects the tunnel.
+type tunnelMetricsConn struct {
+	net.Conn
+	tunnel *Tunnel
+}
+
+func (conn *tunnelMetricsConn) Read(buffer []byte) (int, error) {
+	if conn.tunnel.sessionByteBudget.exceeded() {
+		return 0, common.ContextError(ErrSessionByteBudgetExceeded)
+	}
+	n, err := conn.Conn.Read(buffer)
+	atomic.AddInt64(&conn.tunnel.bytesReceived, int64(n))
+	statsTunnelBytesReceived.add(int64(n))
+	conn.tunnel.sessionByteBudget.add(int64(n))
+	return n, err
+}
+
+func (conn *tunnelMetricsConn) Write(buffer []byte) (int, error) {
+	if conn.tunnel.sessionByteBudget.exceeded() {
+		return 0, common.ContextError(ErrSessionByteBudgetExceeded)
+	}
+	n, err := conn.Conn.Write(buffer)
+	atomic.AddInt64(&conn.tunnel.bytesSent, int64(n))
+	statsTunnelBytesSent.add(int64(n))
+	conn.tunnel.sessionByteBudget.add(int64(n))
+	return n, err
 }
 
 // SignalComponentFailure notifies the tunnel that an associated component has failed.
 // This will terminate the tunnel.
 func (tunnel *Tunnel) SignalComponentFailure() {
-	NoticeAlert("tunnel received component failure signal")
+	tunnel.notices.Alert("tunnel received component failure signal")
 	tunnel.Close(false)
 }
 
@@ -508,6 +835,9 @@ type TunneledConn struct {
 
 func (conn *TunneledConn) Read(buffer []byte) (n int, err error) {
 	n, err = conn.Conn.Read(buffer)
+	if n > 0 {
+		conn.tunnel.markPortForwardActivity()
+	}
 	if err != nil && err != io.EOF {
 		// Report new failure. Won't block; assumes the receiver
 		// has a sufficient buffer for the threshold number of reports.
@@ -522,6 +852,9 @@ func (conn *TunneledConn) Read(buffer []byte) (n int, err error) {
 
 func (conn *TunneledConn) Write(buffer []byte) (n int, err error) {
 	n, err = conn.Conn.Write(buffer)
+	if n > 0 {
+		conn.tunnel.markPortForwardActivity()
+	}
 	if err != nil && err != io.EOF {
 		// Same as TunneledConn.Read()
 		select {
@@ -536,7 +869,9 @@ func (conn *TunneledConn) Close() error {
 	if conn.downstreamConn != nil {
 		conn.downstreamConn.Close()
 	}
-	return conn.Conn.Close()
+	err := conn.Conn.Close()
+	conn.tunnel.removePortForward(conn)
+	return err
 }
 
 var errNoProtocolSupported = errors.New("server does not support any required protocol(s)")
@@ -547,16 +882,50 @@ func selectProtocol(
 	serverEntry *protocol.ServerEntry,
 	impairedProtocols []string,
 	excludeMeek bool,
-	usePriorityProtocol bool) (selectedProtocol string, err error) {
+	usePriorityProtocol bool,
+	useLastTunnelProtocol bool) (selectedProtocol string, err error) {
+
+	limitTunnelProtocols, allDisabled := config.clientParameters.Get().LimitTunnelProtocols()
+	if allDisabled {
+		return "", errNoProtocolSupported
+	}
 
 	candidateProtocols := serverEntry.GetSupportedProtocols(
-		config.clientParameters.Get().TunnelProtocols(parameters.LimitTunnelProtocols),
+		limitTunnelProtocols,
 		impairedProtocols,
 		excludeMeek)
+
+	// QUIC runs over UDP, which can't be relayed through an upstream proxy.
+
+	if config.UpstreamProxyURL != "" {
+		protocols := make([]string, 0)
+		for _, candidateProtocol := range candidateProtocols {
+			if !protocol.TunnelProtocolUsesQUIC(candidateProtocol) {
+				protocols = append(protocols, candidateProtocol)
+			}
+		}
+		candidateProtocols = protocols
+	}
+
 	if len(candidateProtocols) == 0 {
 		return "", errNoProtocolSupported
 	}
 
+	// Select the protocol that last succeeded in the server's region, when
+	// indicated and available, to avoid re-probing protocols that may be
+	// blocked on the current network.
+
+	if useLastTunnelProtocol {
+		lastTunnelProtocol, err := GetKeyValue(
+			DATA_STORE_LAST_TUNNEL_PROTOCOL_KEY_PREFIX + serverEntry.Region)
+		if err != nil {
+			config.notices.Alert("failed to get last tunnel protocol: %s", err)
+		}
+		if lastTunnelProtocol != "" && common.Contains(candidateProtocols, lastTunnelProtocol) {
+			return lastTunnelProtocol, nil
+		}
+	}
+
 	// Select a prioritized protocols when indicated. If no prioritized
 	// protocol is available, proceed with selecting any other protocol.
 
@@ -591,9 +960,22 @@ func selectProtocol(
 	return selectedProtocol, nil
 }
 
+// recordTunnelProtocolSuccess persists the protocol of an established tunnel
+// as the last successful protocol for the server's region, for selection by
+// selectProtocol when useLastTunnelProtocol is set.
+func recordTunnelProtocolSuccess(serverEntry *protocol.ServerEntry, tunnelProtocol string) {
+	err := SetKeyValue(
+		DATA_STORE_LAST_TUNNEL_PROTOCOL_KEY_PREFIX+serverEntry.Region,
+		tunnelProtocol)
+	if err != nil {
+		NoticeAlert("failed to set last tunnel protocol: %s", err)
+	}
+}
+
 // selectFrontingParameters is a helper which selects/generates meek fronting
 // parameters where the server entry provides multiple options or patterns.
 func selectFrontingParameters(
+	config *Config,
 	serverEntry *protocol.ServerEntry) (frontingAddress, frontingHost string, err error) {
 
 	if len(serverEntry.MeekFrontingAddressesRegex) > 0 {
@@ -606,17 +988,14 @@ func selectFrontingParameters(
 		}
 	} else {
 
-		// Randomly select, for this connection attempt, one front address for
-		// fronting-capable servers.
+		// Select, for this connection attempt, one front address for
+		// fronting-capable servers, as per MeekFrontingAddressSelection.
 
-		if len(serverEntry.MeekFrontingAddresses) == 0 {
-			return "", "", common.ContextError(errors.New("MeekFrontingAddresses is empty"))
-		}
-		index, err := common.MakeSecureRandomInt(len(serverEntry.MeekFrontingAddresses))
+		frontingAddress, err = selectFrontingAddress(
+			config.MeekFrontingAddressSelection, serverEntry)
 		if err != nil {
 			return "", "", common.ContextError(err)
 		}
-		frontingAddress = serverEntry.MeekFrontingAddresses[index]
 	}
 
 	if len(serverEntry.MeekFrontingHosts) > 0 {
@@ -633,6 +1012,19 @@ func selectFrontingParameters(
 	return
 }
 
+// makeMeekHostHeader returns an HTTP Host header value for the specified
+// host and port. The port is omitted when it's the default port for the
+// scheme, and IPv6 literals are bracketed as required by RFC 7230.
+func makeMeekHostHeader(host string, port, defaultPort int) string {
+	if port == defaultPort {
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			return "[" + host + "]"
+		}
+		return host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
 // initMeekConfig is a helper that creates a MeekConfig suitable for the
 // selected meek tunnel protocol.
 func initMeekConfig(
@@ -655,7 +1047,7 @@ func initMeekConfig(
 	switch selectedProtocol {
 	case protocol.TUNNEL_PROTOCOL_FRONTED_MEEK:
 
-		frontingAddress, frontingHost, err := selectFrontingParameters(serverEntry)
+		frontingAddress, frontingHost, err := selectFrontingParameters(config, serverEntry)
 		if err != nil {
 			return nil, common.ContextError(err)
 		}
@@ -672,7 +1064,7 @@ func initMeekConfig(
 
 	case protocol.TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP:
 
-		frontingAddress, frontingHost, err := selectFrontingParameters(serverEntry)
+		frontingAddress, frontingHost, err := selectFrontingParameters(config, serverEntry)
 		if err != nil {
 			return nil, common.ContextError(err)
 		}
@@ -681,22 +1073,18 @@ func initMeekConfig(
 
 	case protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK:
 
-		dialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
+		dialAddress = net.JoinHostPort(serverEntry.IpAddress, strconv.Itoa(serverEntry.MeekServerPort))
 		hostname := serverEntry.IpAddress
 		if doMeekTransformHostName() {
 			hostname = common.GenerateHostName()
 			transformedHostName = true
 		}
-		if serverEntry.MeekServerPort == 80 {
-			hostHeader = hostname
-		} else {
-			hostHeader = fmt.Sprintf("%s:%d", hostname, serverEntry.MeekServerPort)
-		}
+		hostHeader = makeMeekHostHeader(hostname, serverEntry.MeekServerPort, 80)
 
 	case protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS,
 		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET:
 
-		dialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
+		dialAddress = net.JoinHostPort(serverEntry.IpAddress, strconv.Itoa(serverEntry.MeekServerPort))
 		useHTTPS = true
 		if selectedProtocol == protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET {
 			useObfuscatedSessionTickets = true
@@ -706,11 +1094,7 @@ func initMeekConfig(
 			SNIServerName = common.GenerateHostName()
 			transformedHostName = true
 		}
-		if serverEntry.MeekServerPort == 443 {
-			hostHeader = serverEntry.IpAddress
-		} else {
-			hostHeader = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
-		}
+		hostHeader = makeMeekHostHeader(serverEntry.IpAddress, serverEntry.MeekServerPort, 443)
 
 	default:
 		return nil, common.ContextError(errors.New("unexpected selectedProtocol"))
@@ -729,13 +1113,17 @@ func initMeekConfig(
 		SNIServerName = ""
 	}
 
-	// Pin the TLS profile for the entire meek connection.
-	selectedTLSProfile := SelectTLSProfile(
-		config.clientParameters,
-		config.UseIndistinguishableTLS,
-		useObfuscatedSessionTickets,
-		true,
-		config.TrustedCACertificatesFilename != "")
+	// Pin the TLS profile for the entire meek connection. A configured
+	// TLSProfile takes precedence over random selection.
+	selectedTLSProfile := config.TLSProfile
+	if selectedTLSProfile == "" {
+		selectedTLSProfile = SelectTLSProfile(
+			config.clientParameters,
+			config.UseIndistinguishableTLS,
+			useObfuscatedSessionTickets,
+			true,
+			config.TrustedCACertificatesFilename != "")
+	}
 
 	return &MeekConfig{
 		ClientParameters:              config.clientParameters,
@@ -797,6 +1185,11 @@ func initDialConfig(
 		DeviceBinder:                  config.DeviceBinder,
 		DnsServerGetter:               config.DnsServerGetter,
 		IPv6Synthesizer:               config.IPv6Synthesizer,
+		IPAddressFamilyPreference:     config.IPAddressFamilyPreference,
+		SocketFwmark:                  config.TunnelSocketFwmark,
+		SocketReadBuffer:              config.TunnelSocketReadBuffer,
+		SocketWriteBuffer:             config.TunnelSocketWriteBuffer,
+		BootstrapDohUrl:               config.BootstrapDohUrl,
 		UseIndistinguishableTLS:       config.UseIndistinguishableTLS,
 		TrustedCACertificatesFilename: config.TrustedCACertificatesFilename,
 		DeviceRegion:                  config.DeviceRegion,
@@ -850,11 +1243,12 @@ func initDialConfig(
 }
 
 type dialResult struct {
-	dialConn      net.Conn
-	monitoredConn *common.ActivityMonitoredConn
-	sshClient     *ssh.Client
-	sshRequests   <-chan *ssh.Request
-	dialStats     *DialStats
+	dialConn        net.Conn
+	monitoredConn   *common.ActivityMonitoredConn
+	sshClient       *ssh.Client
+	sshRequests     <-chan *ssh.Request
+	dialStats       *DialStats
+	connectionTrace *connectionTrace
 }
 
 // dialSsh is a helper that builds the transport layers and establishes the SSH connection.
@@ -873,6 +1267,8 @@ func dialSsh(
 
 	timeout := config.clientParameters.Get().Duration(parameters.TunnelConnectTimeout)
 
+	parentCtx := ctx
+
 	var cancelFunc context.CancelFunc
 	ctx, cancelFunc = context.WithTimeout(ctx, timeout)
 	defer cancelFunc()
@@ -886,18 +1282,23 @@ func dialSsh(
 	SSHClientVersion := ""
 	useObfuscatedSsh := false
 	var directTCPDialAddress string
+	var quicDialAddress string
 	var meekConfig *MeekConfig
 	var err error
 
 	switch selectedProtocol {
 	case protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH:
 		useObfuscatedSsh = true
-		directTCPDialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.SshObfuscatedPort)
+		directTCPDialAddress = net.JoinHostPort(serverEntry.IpAddress, strconv.Itoa(serverEntry.SshObfuscatedPort))
+
+	case protocol.TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH:
+		useObfuscatedSsh = true
+		quicDialAddress = net.JoinHostPort(serverEntry.IpAddress, strconv.Itoa(serverEntry.SshObfuscatedQUICPort))
 
 	case protocol.TUNNEL_PROTOCOL_SSH:
 		selectedSSHClientVersion = true
 		SSHClientVersion = pickSSHClientVersion()
-		directTCPDialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.SshPort)
+		directTCPDialAddress = net.JoinHostPort(serverEntry.IpAddress, strconv.Itoa(serverEntry.SshPort))
 
 	default:
 		useObfuscatedSsh = true
@@ -907,6 +1308,30 @@ func dialSsh(
 		}
 	}
 
+	if useObfuscatedSsh {
+		err := common.ValidateObfuscatorKeyword(serverEntry.SshObfuscatedKey)
+		if err != nil {
+			config.notices.Alert("invalid obfuscated SSH key for %s: %s", serverEntry.IpAddress, err)
+			return nil, common.ContextError(err)
+		}
+	}
+
+	// Record the outcome for the selected fronting address, so that
+	// subsequent attempts rotate away from a failed front. An attempt that
+	// is canceled, as when another candidate is established first, is not
+	// counted as a failure.
+	dialSucceeded := false
+	if selectedProtocol == protocol.TUNNEL_PROTOCOL_FRONTED_MEEK ||
+		selectedProtocol == protocol.TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP {
+
+		frontingAddress, _, _ := net.SplitHostPort(meekConfig.DialAddress)
+		defer func() {
+			if dialSucceeded || parentCtx.Err() == nil {
+				recordFrontingAddressResult(serverEntry, frontingAddress, dialSucceeded)
+			}
+		}()
+	}
+
 	dialConfig, dialStats := initDialConfig(config, meekConfig)
 
 	// Add dial stats specific to SSH dialing
@@ -919,31 +1344,42 @@ func dialSsh(
 	// Note: dialStats.MeekResolvedIPAddress isn't set until the dial begins,
 	// so it will always be blank in NoticeConnectingServer.
 
-	NoticeConnectingServer(
+	config.notices.ConnectingServer(
 		serverEntry.IpAddress,
 		serverEntry.Region,
 		selectedProtocol,
 		dialStats)
 
-	// Create the base transport: meek or direct connection
+	// Create the base transport: meek, QUIC, or direct connection
+
+	connectionTrace := newConnectionTrace(config, serverEntry, selectedProtocol)
+
+	dialStartTime := monotime.Now()
 
 	var dialConn net.Conn
 	if meekConfig != nil {
 		dialConn, err = DialMeek(ctx, meekConfig, dialConfig)
-		if err != nil {
-			return nil, common.ContextError(err)
-		}
+	} else if quicDialAddress != "" {
+		dialConn, err = DialQUIC(ctx, quicDialAddress, dialConfig)
 	} else {
 		dialConn, err = DialTCP(ctx, directTCPDialAddress, dialConfig)
-		if err != nil {
-			return nil, common.ContextError(err)
-		}
 	}
+	if err != nil {
+		err = newConnectTunnelError(
+			ctx, CONNECT_FAILURE_REASON_DIAL, common.ContextError(err))
+		connectionTrace.record(
+			CONNECTION_TRACE_EVENT_DIAL_FAILED, getConnectFailureReason(err), TunnelMetrics{})
+		return nil, err
+	}
+
+	dialStats.DialDuration = monotime.Since(dialStartTime)
+
+	connectionTrace.record(CONNECTION_TRACE_EVENT_DIAL, "", TunnelMetrics{})
 
 	// If dialConn is not a Closer, tunnel failure detection may be slower
 	_, ok := dialConn.(common.Closer)
 	if !ok {
-		NoticeAlert("tunnel.dialSsh: dialConn is not a Closer")
+		config.notices.Alert("tunnel.dialSsh: dialConn is not a Closer")
 	}
 
 	cleanupConn := dialConn
@@ -969,7 +1405,10 @@ func dialSsh(
 	var sshConn net.Conn = throttledConn
 	if useObfuscatedSsh {
 		sshConn, err = common.NewObfuscatedSshConn(
-			common.OBFUSCATION_CONN_MODE_CLIENT, throttledConn, serverEntry.SshObfuscatedKey)
+			common.OBFUSCATION_CONN_MODE_CLIENT,
+			throttledConn,
+			serverEntry.SshObfuscatedKey,
+			config.ObfuscationPassphrase)
 		if err != nil {
 			return nil, common.ContextError(err)
 		}
@@ -1027,6 +1466,8 @@ func dialSsh(
 
 	resultChannel := make(chan sshNewClientResult)
 
+	sshHandshakeStartTime := monotime.Now()
+
 	// Call NewClientConn in a goroutine, as it blocks on SSH handshake network
 	// operations, and would block canceling or shutdown. If the parent context
 	// is canceled, close the net.Conn underlying SSH, which will interrupt the
@@ -1067,27 +1508,32 @@ func dialSsh(
 	}
 
 	if result.err != nil {
-		return nil, common.ContextError(result.err)
+		countHandshakeFailure(ctx, statsHandshakeFailuresSSH)
+		err = newConnectTunnelError(
+			ctx, CONNECT_FAILURE_REASON_SSH_HANDSHAKE, common.ContextError(result.err))
+		connectionTrace.record(
+			CONNECTION_TRACE_EVENT_SSH_HANDSHAKE_FAILED, getConnectFailureReason(err), TunnelMetrics{})
+		return nil, err
 	}
 
-	NoticeConnectedServer(
-		serverEntry.IpAddress,
-		serverEntry.Region,
-		selectedProtocol,
-		dialStats)
+	dialStats.SSHHandshakeDuration = monotime.Since(sshHandshakeStartTime)
+
+	connectionTrace.record(CONNECTION_TRACE_EVENT_SSH_HANDSHAKE, "", TunnelMetrics{})
 
 	cleanupConn = nil
+	dialSucceeded = true
 
 	// Note: dialConn may be used to close the underlying network connection
 	// but should not be used to perform I/O as that would interfere with SSH
 	// (and also bypasses throttling).
 
 	return &dialResult{
-			dialConn:      dialConn,
-			monitoredConn: monitoredConn,
-			sshClient:     result.sshClient,
-			sshRequests:   result.sshRequests,
-			dialStats:     dialStats},
+			dialConn:        dialConn,
+			monitoredConn:   monitoredConn,
+			sshClient:       result.sshClient,
+			sshRequests:     result.sshRequests,
+			dialStats:       dialStats,
+			connectionTrace: connectionTrace},
 		nil
 }
 
@@ -1101,6 +1547,47 @@ func makeRandomPeriod(min, max time.Duration) time.Duration {
 	return period
 }
 
+// markPortForwardActivity records that port forward data was transferred.
+func (tunnel *Tunnel) markPortForwardActivity() {
+	atomic.StoreInt64(&tunnel.lastPortForwardActivity, int64(monotime.Now()))
+}
+
+// getLastActivityTime returns the time of the most recent port forward data
+// transfer or, when there has been no transfer, the time the tunnel was
+// established.
+func (tunnel *Tunnel) getLastActivityTime() monotime.Time {
+	lastActivity := monotime.Time(atomic.LoadInt64(&tunnel.lastPortForwardActivity))
+	tunnel.mutex.Lock()
+	establishedTime := tunnel.establishedTime
+	tunnel.mutex.Unlock()
+	if lastActivity.Before(establishedTime) {
+		return establishedTime
+	}
+	return lastActivity
+}
+
+// IsPaused indicates whether periodic tunnel traffic is paused.
+func (tunnel *Tunnel) IsPaused() bool {
+	return atomic.LoadInt32(&tunnel.isPaused) == 1
+}
+
+// setPaused pauses or resumes periodic tunnel traffic. While paused,
+// operateTunnel sends no SSH keep alives or status requests; the tunnel
+// remains open and may still be used for port forwards. Resuming triggers an
+// immediate SSH keep alive probe.
+func (tunnel *Tunnel) setPaused(paused bool) {
+	if paused {
+		atomic.StoreInt32(&tunnel.isPaused, 1)
+		return
+	}
+	if atomic.CompareAndSwapInt32(&tunnel.isPaused, 1, 0) {
+		select {
+		case tunnel.signalResume <- *new(struct{}):
+		default:
+		}
+	}
+}
+
 // operateTunnel monitors the health of the tunnel and performs
 // periodic work.
 //
@@ -1158,6 +1645,10 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 	totalSent := int64(0)
 	totalReceived := int64(0)
 
+	bytesTransferredTicks := 0
+	recentSent := int64(0)
+	recentReceived := int64(0)
+
 	noticeBytesTransferredTicker := time.NewTicker(1 * time.Second)
 	defer noticeBytesTransferredTicker.Stop()
 
@@ -1178,7 +1669,7 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 	// persistent stats.
 	unreported := CountUnreportedPersistentStats()
 	if unreported > 0 {
-		NoticeInfo("Unreported persistent stats: %d", unreported)
+		tunnel.notices.Info("Unreported persistent stats: %d", unreported)
 		p := clientParameters.Get()
 		statsTimer.Reset(
 			makeRandomPeriod(
@@ -1215,21 +1706,11 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 	}()
 
 	requestsWaitGroup.Add(1)
-	signalSshKeepAlive := make(chan time.Duration)
+	signalSshKeepAlive := make(chan sshKeepAliveSignal)
 	sshKeepAliveError := make(chan error, 1)
 	go func() {
 		defer requestsWaitGroup.Done()
-		isFirstKeepAlive := true
-		for timeout := range signalSshKeepAlive {
-			err := tunnel.sendSshKeepAlive(isFirstKeepAlive, timeout)
-			if err != nil {
-				select {
-				case sshKeepAliveError <- err:
-				default:
-				}
-			}
-			isFirstKeepAlive = false
-		}
+		tunnel.sshKeepAliveWorker(signalSshKeepAlive, sshKeepAliveError)
 	}()
 
 	requestsWaitGroup.Add(1)
@@ -1302,28 +1783,50 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 			noticePeriod := clientParameters.Get().Duration(parameters.TotalBytesTransferredNoticePeriod)
 
 			if lastTotalBytesTransferedTime.Add(noticePeriod).Before(monotime.Now()) {
-				NoticeTotalBytesTransferred(tunnel.serverEntry.IpAddress, totalSent, totalReceived)
+				tunnel.notices.TotalBytesTransferred(tunnel.serverEntry.IpAddress, totalSent, totalReceived)
 				lastTotalBytesTransferedTime = monotime.Now()
 			}
 
-			// Only emit the frequent BytesTransferred notice when tunnel is not idle.
-			if tunnel.config.EmitBytesTransferred && (sent > 0 || received > 0) {
-				NoticeBytesTransferred(tunnel.serverEntry.IpAddress, sent, received)
+			recentSent += sent
+			recentReceived += received
+
+			bytesTransferredTicks += 1
+
+			noticePeriod = clientParameters.Get().Duration(parameters.BytesTransferredNoticePeriod)
+
+			if bytesTransferredTicks >= int(noticePeriod/time.Second) {
+
+				// Only emit the frequent BytesTransferred notice when tunnel is not idle.
+				if tunnel.config.EmitBytesTransferred && (recentSent > 0 || recentReceived > 0) {
+					tunnel.notices.BytesTransferred(tunnel.serverEntry.IpAddress, recentSent, recentReceived)
+				}
+
+				bytesTransferredTicks = 0
+				recentSent = 0
+				recentReceived = 0
 			}
 
 		case <-statsTimer.C:
-			select {
-			case signalStatusRequest <- *new(struct{}):
-			default:
+			if !tunnel.IsPaused() {
+				select {
+				case signalStatusRequest <- *new(struct{}):
+				default:
+				}
 			}
 			statsTimer.Reset(nextStatusRequestPeriod())
 
 		case <-sshKeepAliveTimer.C:
 			inactivePeriod := clientParameters.Get().Duration(parameters.SSHKeepAlivePeriodicInactivePeriod)
-			if lastBytesReceivedTime.Add(inactivePeriod).Before(monotime.Now()) {
-				timeout := clientParameters.Get().Duration(parameters.SSHKeepAlivePeriodicTimeout)
+			if !tunnel.IsPaused() &&
+				lastBytesReceivedTime.Add(inactivePeriod).Before(monotime.Now()) {
+				p := clientParameters.Get()
+				signal := sshKeepAliveSignal{
+					timeout:          p.Duration(parameters.SSHKeepAlivePeriodicTimeout),
+					maxMissedReplies: p.Int(parameters.SSHKeepAliveMaxMissedReplies),
+				}
+				p = nil
 				select {
-				case signalSshKeepAlive <- timeout:
+				case signalSshKeepAlive <- signal:
 				default:
 				}
 			}
@@ -1332,7 +1835,7 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 		case <-tunnel.signalPortForwardFailure:
 			// Note: no mutex on portForwardFailureTotal; only referenced here
 			tunnel.totalPortForwardFailures++
-			NoticeInfo("port forward failures for %s: %d",
+			tunnel.notices.Info("port forward failures for %s: %d",
 				tunnel.serverEntry.IpAddress, tunnel.totalPortForwardFailures)
 
 			// If the underlying Conn has closed (meek and other plugin protocols may close
@@ -1344,9 +1847,12 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 			} else {
 				inactivePeriod := clientParameters.Get().Duration(parameters.SSHKeepAliveProbeInactivePeriod)
 				if lastBytesReceivedTime.Add(inactivePeriod).Before(monotime.Now()) {
-					timeout := clientParameters.Get().Duration(parameters.SSHKeepAliveProbeTimeout)
+					signal := sshKeepAliveSignal{
+						timeout:          clientParameters.Get().Duration(parameters.SSHKeepAliveProbeTimeout),
+						maxMissedReplies: 1,
+					}
 					select {
-					case signalSshKeepAlive <- timeout:
+					case signalSshKeepAlive <- signal:
 					default:
 					}
 				}
@@ -1356,6 +1862,22 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 
 			}
 
+		case <-tunnel.signalResume:
+			// Probe the tunnel immediately on resume, as it may have been
+			// disconnected while paused. When the probe fails, the tunnel fails
+			// and the controller establishes a replacement.
+			signal := sshKeepAliveSignal{
+				timeout:          clientParameters.Get().Duration(parameters.SSHKeepAliveProbeTimeout),
+				maxMissedReplies: 1,
+			}
+			select {
+			case signalSshKeepAlive <- signal:
+			default:
+			}
+			if !tunnel.config.DisablePeriodicSshKeepAlive {
+				sshKeepAliveTimer.Reset(nextSshKeepAlivePeriod())
+			}
+
 		case err = <-sshKeepAliveError:
 
 		case serverRequest := <-tunnel.sshServerRequests:
@@ -1364,7 +1886,7 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 				if err == nil {
 					serverRequest.Reply(true, nil)
 				} else {
-					NoticeAlert("HandleServerRequest for %s failed: %s", serverRequest.Type, err)
+					tunnel.notices.Alert("HandleServerRequest for %s failed: %s", serverRequest.Type, err)
 					serverRequest.Reply(false, nil)
 
 				}
@@ -1386,10 +1908,10 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 	totalReceived += received
 
 	// Always emit a final NoticeTotalBytesTransferred
-	NoticeTotalBytesTransferred(tunnel.serverEntry.IpAddress, totalSent, totalReceived)
+	tunnel.notices.TotalBytesTransferred(tunnel.serverEntry.IpAddress, totalSent, totalReceived)
 
 	if err == nil {
-		NoticeInfo("shutdown operate tunnel")
+		tunnel.notices.Info("shutdown operate tunnel")
 
 		// Send a final status request in order to report any outstanding
 		// domain bytes transferred stats as well as to report session stats
@@ -1399,15 +1921,67 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 		sendStats(tunnel)
 
 	} else {
-		NoticeAlert("operate tunnel error for %s: %s", tunnel.serverEntry.IpAddress, err)
+		tunnel.notices.Alert("operate tunnel error for %s: %s", tunnel.serverEntry.IpAddress, err)
 		tunnelOwner.SignalTunnelFailure(tunnel)
 	}
 }
 
+// sshKeepAliveSignal requests an SSH keepalive. When the keepalive times
+// out, the tunnel fails only once maxMissedReplies consecutive keepalives
+// have timed out.
+type sshKeepAliveSignal struct {
+	timeout          time.Duration
+	maxMissedReplies int
+}
+
+// errSSHKeepAliveTimedOut is returned by sendSshKeepAlive when no reply is
+// received within the timeout.
+var errSSHKeepAliveTimedOut = errors.New("timed out")
+
+// sshKeepAliveWorker sends SSH keepalives as signaled, and reports a tunnel
+// failure to keepAliveError. On failure, the tunnel connection is closed,
+// which interrupts any in-flight port forwards and requests, including
+// those made by tunneled downloads, with an error.
+func (tunnel *Tunnel) sshKeepAliveWorker(
+	signalKeepAlive <-chan sshKeepAliveSignal, keepAliveError chan<- error) {
+
+	isFirstKeepAlive := true
+	missedReplies := 0
+
+	for signal := range signalKeepAlive {
+
+		err := tunnel.sendSshKeepAlive(isFirstKeepAlive, signal.timeout)
+		isFirstKeepAlive = false
+
+		if err == nil {
+			missedReplies = 0
+			continue
+		}
+
+		if err == errSSHKeepAliveTimedOut {
+			missedReplies++
+			if missedReplies < signal.maxMissedReplies {
+				tunnel.notices.Info("missed SSH keep alive reply for %s: %d",
+					tunnel.serverEntry.IpAddress, missedReplies)
+				continue
+			}
+		}
+
+		tunnel.sshClient.Close()
+		tunnel.conn.Close()
+
+		select {
+		case keepAliveError <- common.ContextError(err):
+		default:
+		}
+	}
+}
+
 // sendSshKeepAlive is a helper which sends a keepalive@openssh.com request
-// on the specified SSH connections and returns true of the request succeeds
-// within a specified timeout. If the request fails, the associated conn is
-// closed, which will terminate the associated tunnel.
+// on the specified SSH connections and returns nil if the request succeeds
+// within a specified timeout, or errSSHKeepAliveTimedOut when no reply is
+// received in time. The caller is responsible for closing the tunnel when
+// the keepalive fails.
 func (tunnel *Tunnel) sendSshKeepAlive(isFirstKeepAlive bool, timeout time.Duration) error {
 
 	// Note: there is no request context since SSH requests cannot be
@@ -1420,7 +1994,7 @@ func (tunnel *Tunnel) sendSshKeepAlive(isFirstKeepAlive bool, timeout time.Durat
 	errChannel := make(chan error, 1)
 
 	afterFunc := time.AfterFunc(timeout, func() {
-		errChannel <- errors.New("timed out")
+		errChannel <- errSSHKeepAliveTimedOut
 	})
 	defer afterFunc.Stop()
 
@@ -1432,7 +2006,7 @@ func (tunnel *Tunnel) sendSshKeepAlive(isFirstKeepAlive bool, timeout time.Durat
 			p.Int(parameters.SSHKeepAlivePaddingMaxBytes))
 		p = nil
 		if err != nil {
-			NoticeAlert("MakeSecureRandomPadding failed: %s", common.ContextError(err))
+			tunnel.notices.Alert("MakeSecureRandomPadding failed: %s", common.ContextError(err))
 			// Proceed without random padding.
 			request = make([]byte, 0)
 		}
@@ -1470,18 +2044,17 @@ func (tunnel *Tunnel) sendSshKeepAlive(isFirstKeepAlive bool, timeout time.Durat
 				request,
 				response)
 			if err != nil {
-				NoticeAlert("AddSpeedTestSample failed: %s", common.ContextError(err))
+				tunnel.notices.Alert("AddSpeedTestSample failed: %s", common.ContextError(err))
 			}
 		}
 	}()
 
 	err := <-errChannel
-	if err != nil {
-		tunnel.sshClient.Close()
-		tunnel.conn.Close()
+	if err != nil && err != errSSHKeepAliveTimedOut {
+		return common.ContextError(err)
 	}
 
-	return common.ContextError(err)
+	return err
 }
 
 // sendStats is a helper for sending session stats to the server.
@@ -1499,7 +2072,7 @@ func sendStats(tunnel *Tunnel) bool {
 
 	err := tunnel.serverContext.DoStatusRequest(tunnel)
 	if err != nil {
-		NoticeAlert("DoStatusRequest failed for %s: %s", tunnel.serverEntry.IpAddress, err)
+		tunnel.notices.Alert("DoStatusRequest failed for %s: %s", tunnel.serverEntry.IpAddress, err)
 	}
 
 	return err == nil
@@ -1521,7 +2094,7 @@ func sendClientVerification(tunnel *Tunnel, clientVerificationPayload string) bo
 
 	err := tunnel.serverContext.DoClientVerificationRequest(clientVerificationPayload, tunnel.serverEntry.IpAddress)
 	if err != nil {
-		NoticeAlert("DoClientVerificationRequest failed for %s: %s", tunnel.serverEntry.IpAddress, err)
+		tunnel.notices.Alert("DoClientVerificationRequest failed for %s: %s", tunnel.serverEntry.IpAddress, err)
 	}
 
 	return err == nil
@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"sync"
+)
+
+const (
+	TUNNEL_POOL_SELECTION_ROUND_ROBIN  = "round-robin"
+	TUNNEL_POOL_SELECTION_LEAST_LOADED = "least-loaded"
+)
+
+// TunnelPool is a pool of established tunnels. Port forwards are load
+// balanced across the tunnels in the pool, as selected by GetTunnel.
+type TunnelPool struct {
+	mutex      sync.Mutex
+	size       int
+	selection  string
+	tunnels    []*Tunnel
+	nextTunnel int
+}
+
+// NewTunnelPool creates a new, empty TunnelPool with capacity for size
+// tunnels. selection specifies how GetTunnel selects a tunnel, and may be
+// TUNNEL_POOL_SELECTION_ROUND_ROBIN or TUNNEL_POOL_SELECTION_LEAST_LOADED.
+// The default, "", is TUNNEL_POOL_SELECTION_ROUND_ROBIN.
+func NewTunnelPool(size int, selection string) *TunnelPool {
+	return &TunnelPool{
+		size:      size,
+		selection: selection,
+		tunnels:   make([]*Tunnel, 0),
+	}
+}
+
+// Size returns the capacity of the pool.
+func (pool *TunnelPool) Size() int {
+	return pool.size
+}
+
+// Count returns the number of tunnels in the pool.
+func (pool *TunnelPool) Count() int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return len(pool.tunnels)
+}
+
+// IsFull indicates if the pool is at capacity.
+func (pool *TunnelPool) IsFull() bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return len(pool.tunnels) >= pool.size
+}
+
+// Tunnels returns a snapshot of the tunnels in the pool.
+func (pool *TunnelPool) Tunnels() []*Tunnel {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	tunnels := make([]*Tunnel, len(pool.tunnels))
+	copy(tunnels, pool.tunnels)
+	return tunnels
+}
+
+// GetTunnel selects a tunnel from the pool, or returns nil when the pool is
+// empty. With TUNNEL_POOL_SELECTION_LEAST_LOADED, the tunnel with the fewest
+// open port forwards is selected, with ties broken in round-robin order.
+func (pool *TunnelPool) GetTunnel() *Tunnel {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if len(pool.tunnels) == 0 {
+		return nil
+	}
+
+	index := pool.nextTunnel
+
+	if pool.selection == TUNNEL_POOL_SELECTION_LEAST_LOADED {
+		minLoad := -1
+		for i := 0; i < len(pool.tunnels); i++ {
+			candidate := (pool.nextTunnel + i) % len(pool.tunnels)
+			load := pool.tunnels[candidate].numPortForwards()
+			if minLoad == -1 || load < minLoad {
+				index = candidate
+				minLoad = load
+			}
+		}
+	}
+
+	pool.nextTunnel = (index + 1) % len(pool.tunnels)
+
+	return pool.tunnels[index]
+}
+
+// hasServerEntry indicates if the pool contains a tunnel to the server with
+// the specified IP address.
+func (pool *TunnelPool) hasServerEntry(ipAddress string) bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for _, tunnel := range pool.tunnels {
+		if tunnel.serverEntry.IpAddress == ipAddress {
+			return true
+		}
+	}
+	return false
+}
+
+// add adds tunnel to the pool. Returns false, and does not add the tunnel,
+// if the pool is full or already contains a tunnel to the same server.
+func (pool *TunnelPool) add(tunnel *Tunnel) bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if len(pool.tunnels) >= pool.size {
+		return false
+	}
+
+	for _, activeTunnel := range pool.tunnels {
+		if activeTunnel.serverEntry.IpAddress == tunnel.serverEntry.IpAddress {
+			tunnel.notices.Alert("duplicate tunnel: %s", tunnel.serverEntry.IpAddress)
+			return false
+		}
+	}
+
+	pool.tunnels = append(pool.tunnels, tunnel)
+
+	tunnel.notices.TunnelPoolMembership(true, tunnel, len(pool.tunnels))
+
+	return true
+}
+
+// remove removes tunnel from the pool. The next-tunnel state used by
+// GetTunnel is adjusted as required. Returns false if the tunnel is not in
+// the pool.
+func (pool *TunnelPool) remove(tunnel *Tunnel) bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for index, activeTunnel := range pool.tunnels {
+		if tunnel == activeTunnel {
+			pool.tunnels = append(pool.tunnels[:index], pool.tunnels[index+1:]...)
+			if pool.nextTunnel > index {
+				pool.nextTunnel--
+			}
+			if pool.nextTunnel >= len(pool.tunnels) {
+				pool.nextTunnel = 0
+			}
+			tunnel.notices.TunnelPoolMembership(false, tunnel, len(pool.tunnels))
+			return true
+		}
+	}
+
+	return false
+}
+
+// replace substitutes newTunnel for oldTunnel, in the same pool position.
+// Returns false if oldTunnel is not in the pool or if the pool already
+// contains a tunnel to the newTunnel server.
+func (pool *TunnelPool) replace(oldTunnel, newTunnel *Tunnel) bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	index := -1
+	for i, activeTunnel := range pool.tunnels {
+		if activeTunnel == oldTunnel {
+			index = i
+		} else if activeTunnel.serverEntry.IpAddress == newTunnel.serverEntry.IpAddress {
+			newTunnel.notices.Alert("duplicate tunnel: %s", newTunnel.serverEntry.IpAddress)
+			return false
+		}
+	}
+	if index == -1 {
+		return false
+	}
+
+	pool.tunnels[index] = newTunnel
+
+	oldTunnel.notices.TunnelPoolMembership(false, oldTunnel, len(pool.tunnels)-1)
+	newTunnel.notices.TunnelPoolMembership(true, newTunnel, len(pool.tunnels))
+
+	return true
+}
+
+// removeAll empties the pool and returns the removed tunnels.
+func (pool *TunnelPool) removeAll() []*Tunnel {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	tunnels := pool.tunnels
+	pool.tunnels = make([]*Tunnel, 0)
+	pool.nextTunnel = 0
+
+	for i, tunnel := range tunnels {
+		tunnel.notices.TunnelPoolMembership(false, tunnel, len(tunnels)-i-1)
+	}
+
+	return tunnels
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestTunnelPool(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	makeTunnel := func(i int) *Tunnel {
+		return &Tunnel{
+			mutex: new(sync.Mutex),
+			serverEntry: &protocol.ServerEntry{
+				IpAddress: fmt.Sprintf("192.0.2.%d", i),
+			},
+			openPortForwards: make(map[*TunneledConn]bool),
+		}
+	}
+
+	poolSize := 3
+
+	tunnels := make([]*Tunnel, poolSize+1)
+	for i := range tunnels {
+		tunnels[i] = makeTunnel(i)
+	}
+
+	// Membership
+
+	pool := NewTunnelPool(poolSize, TUNNEL_POOL_SELECTION_ROUND_ROBIN)
+
+	if pool.GetTunnel() != nil {
+		t.Fatalf("unexpected tunnel from empty pool")
+	}
+
+	for i := 0; i < poolSize; i++ {
+		if !pool.add(tunnels[i]) {
+			t.Fatalf("add failed")
+		}
+	}
+
+	if pool.add(tunnels[poolSize]) {
+		t.Fatalf("unexpected add to full pool")
+	}
+
+	if !pool.remove(tunnels[0]) || pool.remove(tunnels[0]) {
+		t.Fatalf("unexpected remove result")
+	}
+
+	if pool.add(makeTunnel(1)) {
+		t.Fatalf("unexpected add of duplicate server")
+	}
+
+	if !pool.add(tunnels[poolSize]) || !pool.IsFull() || pool.Count() != poolSize {
+		t.Fatalf("unexpected pool state")
+	}
+
+	// Replacement
+
+	replacementTunnel := makeTunnel(poolSize + 1)
+
+	if pool.replace(tunnels[2], makeTunnel(poolSize)) {
+		t.Fatalf("unexpected replace with duplicate server")
+	}
+
+	if !pool.replace(tunnels[2], replacementTunnel) ||
+		pool.replace(tunnels[2], replacementTunnel) {
+		t.Fatalf("unexpected replace result")
+	}
+
+	if pool.Count() != poolSize || pool.Tunnels()[1] != replacementTunnel {
+		t.Fatalf("unexpected pool state")
+	}
+
+	// Round-robin selection
+
+	selected := make(map[*Tunnel]int)
+	for i := 0; i < 3*poolSize; i++ {
+		selected[pool.GetTunnel()]++
+	}
+	for _, tunnel := range pool.Tunnels() {
+		if selected[tunnel] != 3 {
+			t.Fatalf("unexpected round-robin selection: %+v", selected)
+		}
+	}
+
+	// Least-loaded selection
+
+	pool = NewTunnelPool(poolSize, TUNNEL_POOL_SELECTION_LEAST_LOADED)
+	for i := 0; i < poolSize; i++ {
+		pool.add(tunnels[i])
+	}
+
+	for i := 0; i < 2*poolSize; i++ {
+		tunnel := pool.GetTunnel()
+		tunnel.openPortForwards[&TunneledConn{}] = true
+	}
+	for i := 0; i < poolSize; i++ {
+		if tunnels[i].numPortForwards() != 2 {
+			t.Fatalf("unexpected least-loaded selection")
+		}
+	}
+
+	for conn := range tunnels[1].openPortForwards {
+		delete(tunnels[1].openPortForwards, conn)
+		break
+	}
+	for i := 0; i < poolSize; i++ {
+		if pool.GetTunnel() != tunnels[1] {
+			t.Fatalf("unexpected least-loaded selection")
+		}
+	}
+
+	if len(pool.removeAll()) != poolSize || pool.Count() != 0 {
+		t.Fatalf("unexpected pool state")
+	}
+}
@@ -0,0 +1,880 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Inc/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestTunnelMetrics(t *testing.T) {
+
+	tunnel := &Tunnel{}
+
+	portForwardCount := 100
+	dataSize := 1000
+
+	// Each simulated port forward writes dataSize bytes and reads back
+	// the echoed data.
+
+	waitGroup := new(sync.WaitGroup)
+
+	for i := 0; i < portForwardCount; i++ {
+
+		clientConn, serverConn := net.Pipe()
+
+		waitGroup.Add(2)
+
+		go func() {
+			defer waitGroup.Done()
+			io.Copy(serverConn, serverConn)
+		}()
+
+		go func() {
+			defer waitGroup.Done()
+			conn := &tunnelMetricsConn{Conn: clientConn, tunnel: tunnel}
+			writeDone := make(chan struct{})
+			go func() {
+				conn.Write(make([]byte, dataSize))
+				close(writeDone)
+			}()
+			io.CopyN(ioutil.Discard, conn, int64(dataSize))
+			<-writeDone
+			clientConn.Close()
+			serverConn.Close()
+		}()
+	}
+
+	waitGroup.Wait()
+
+	metrics := tunnel.GetMetrics()
+
+	expectedBytes := int64(portForwardCount * dataSize)
+
+	if metrics.BytesSent != expectedBytes ||
+		metrics.BytesReceived != expectedBytes {
+
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+}
+
+func TestTunnelDrainPortForwards(t *testing.T) {
+
+	tunnel := &Tunnel{
+		mutex:                   new(sync.Mutex),
+		openPortForwards:        make(map[*TunneledConn]bool),
+		signalPortForwardClosed: make(chan struct{}, 1),
+	}
+
+	portForwardCount := 10
+	conns := make([]*TunneledConn, portForwardCount)
+
+	for i := 0; i < portForwardCount; i++ {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+		conns[i] = &TunneledConn{Conn: clientConn, tunnel: tunnel}
+		if !tunnel.addPortForward(conns[i]) {
+			t.Fatalf("addPortForward failed")
+		}
+	}
+
+	// Port forwards that close before the deadline are not force closed.
+
+	go func() {
+		for i := 0; i < portForwardCount/2; i++ {
+			conns[i].Close()
+		}
+	}()
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+
+	forceClosedCount := tunnel.drainPortForwards(ctx)
+
+	if forceClosedCount != portForwardCount/2 {
+		t.Fatalf("unexpected force closed count: %d", forceClosedCount)
+	}
+
+	if len(tunnel.openPortForwards) != 0 {
+		t.Fatalf("unexpected open port forwards: %d", len(tunnel.openPortForwards))
+	}
+
+	// All port forwards are closed.
+
+	for _, conn := range conns {
+		_, err := conn.Write([]byte{0})
+		if err == nil {
+			t.Fatalf("unexpected open port forward")
+		}
+	}
+
+	// No new port forwards are accepted once shutting down.
+
+	tunnel.isShuttingDown = true
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	if tunnel.addPortForward(&TunneledConn{Conn: clientConn, tunnel: tunnel}) {
+		t.Fatalf("unexpected addPortForward success")
+	}
+
+	// When all port forwards close before the deadline, none are force closed.
+
+	tunnel.isShuttingDown = false
+
+	clientConn, serverConn = net.Pipe()
+	defer serverConn.Close()
+	conn := &TunneledConn{Conn: clientConn, tunnel: tunnel}
+	tunnel.addPortForward(conn)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		conn.Close()
+	}()
+
+	forceClosedCount = tunnel.drainPortForwards(context.Background())
+
+	if forceClosedCount != 0 {
+		t.Fatalf("unexpected force closed count: %d", forceClosedCount)
+	}
+}
+
+func TestConnectTunnelTimeout(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	// Each server listens on a distinct loopback address, as the datastore
+	// stores server entries by IP address.
+
+	nextAddress := int32(1)
+	listen := func() net.Listener {
+		address := fmt.Sprintf("127.0.0.%d:0", atomic.AddInt32(&nextAddress, 1))
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			t.Fatalf("Listen failed: %s", err)
+		}
+		return listener
+	}
+
+	// Slow candidates accept TCP connections but never respond to the SSH
+	// handshake, as with a server behind a blackholing middlebox. Closed
+	// connections, as when an attempt is abandoned or canceled, are counted.
+
+	var slowAccepted, slowClosed int32
+
+	var slowListeners []net.Listener
+	defer func() {
+		for _, listener := range slowListeners {
+			listener.Close()
+		}
+	}()
+
+	makeSlowCandidate := func() *protocol.ServerEntry {
+		listener := listen()
+		slowListeners = append(slowListeners, listener)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				atomic.AddInt32(&slowAccepted, 1)
+				go func() {
+					io.Copy(ioutil.Discard, conn)
+					conn.Close()
+					atomic.AddInt32(&slowClosed, 1)
+				}()
+			}
+		}()
+		serverEntry := makeTestSSHServerEntry(t, listener, "")
+		serverEntry.IpAddress = listener.Addr().(*net.TCPAddr).IP.String()
+		return serverEntry
+	}
+
+	slowCandidates := make([]*protocol.ServerEntry, 3)
+	for i := range slowCandidates {
+		slowCandidates[i] = makeSlowCandidate()
+	}
+
+	// The fast candidate delays its SSH handshake, past the server affinity
+	// grace period, so that the slow attempts are in progress when it
+	// establishes a tunnel.
+
+	fastListener := listen()
+	defer fastListener.Close()
+	fastCandidate := makeTestSSHServerEntry(
+		t, fastListener, runTestSSHServer(
+			t, &delayedAcceptListener{Listener: fastListener, delay: 1500 * time.Millisecond}, nil))
+	fastCandidate.IpAddress = fastListener.Addr().(*net.TCPAddr).IP.String()
+
+	// runController runs a controller, with the candidates in its datastore
+	// and one connection worker per candidate, until awaitNotice returns
+	// true, and returns the elapsed time. checkRunning, when not nil, is
+	// called after awaitNotice returns true and before the controller is
+	// stopped.
+
+	runController := func(
+		candidates []*protocol.ServerEntry,
+		timeoutSeconds int,
+		awaitNotice func(noticeType string, data map[string]interface{}) bool,
+		checkRunning func()) time.Duration {
+
+		testDataDirName, err := ioutil.TempDir("", "psiphon-connect-timeout-test")
+		if err != nil {
+			t.Fatalf("TempDir failed: %s", err)
+		}
+		defer os.RemoveAll(testDataDirName)
+
+		singleton = dataStore{}
+		err = InitDataStore(&Config{DataStoreDirectory: testDataDirName})
+		if err != nil {
+			t.Fatalf("InitDataStore failed: %s", err)
+		}
+
+		for _, candidate := range candidates {
+			err := StoreServerEntry(candidate, true)
+			if err != nil {
+				t.Fatalf("StoreServerEntry failed: %s", err)
+			}
+		}
+
+		config, err := LoadConfig([]byte(fmt.Sprintf(`
+        {
+            "PropagationChannelId" : "0",
+            "SponsorId" : "0",
+            "DataStoreDirectory" : "%s",
+            "DisableApi" : true,
+            "DisableRemoteServerListFetcher" : true,
+            "DisableLocalSocksProxy" : true,
+            "DisableLocalHTTPProxy" : true,
+            "UseControllerDial" : true,
+            "ConnectionWorkerPoolSize" : %d,
+            "TunnelConnectTimeoutSeconds" : %d
+        }`, testDataDirName, len(candidates), timeoutSeconds)))
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %s", err)
+		}
+
+		noticeReceived := make(chan struct{})
+		var once sync.Once
+		SetNoticeCallback(func(noticeType string, data map[string]interface{}) {
+			if awaitNotice(noticeType, data) {
+				once.Do(func() { close(noticeReceived) })
+			}
+		})
+		defer SetNoticeCallback(nil)
+
+		controller, err := NewController(config)
+		if err != nil {
+			t.Fatalf("NewController failed: %s", err)
+		}
+
+		runCtx, stopRunning := context.WithCancel(context.Background())
+		stopped := make(chan struct{})
+		defer func() {
+			stopRunning()
+			<-stopped
+		}()
+
+		startTime := time.Now()
+
+		go func() {
+			controller.Run(runCtx)
+			close(stopped)
+		}()
+
+		select {
+		case <-noticeReceived:
+		case <-time.After(30 * time.Second):
+			t.Fatalf("missing notice")
+		}
+
+		elapsed := time.Since(startTime)
+
+		if checkRunning != nil {
+			checkRunning()
+		}
+
+		return elapsed
+	}
+
+	// All candidates slow: each attempt in the establishment pass is
+	// abandoned after the per-candidate timeout, rather than consuming the
+	// whole establishment period, and the pass is exhausted.
+
+	elapsed := runController(
+		slowCandidates,
+		1,
+		func(noticeType string, data map[string]interface{}) bool {
+			if noticeType != "ServerEntriesExhausted" {
+				return false
+			}
+			attempts := data["protocols"].(map[string]int)
+			if attempts[protocol.TUNNEL_PROTOCOL_SSH] != len(slowCandidates) {
+				t.Errorf("unexpected attempts: %v", attempts)
+			}
+			return true
+		},
+		nil)
+
+	if elapsed < 1*time.Second || elapsed > 5*time.Second {
+		t.Fatalf("unexpected establishment pass duration: %s", elapsed)
+	}
+
+	// One fast candidate: the fast candidate establishes a tunnel well
+	// within the per-candidate timeout, and stopping establishment cancels
+	// the in-progress slow attempts while the controller continues to run.
+
+	atomic.StoreInt32(&slowAccepted, 0)
+	atomic.StoreInt32(&slowClosed, 0)
+
+	elapsed = runController(
+		append([]*protocol.ServerEntry{fastCandidate}, slowCandidates...),
+		30,
+		func(noticeType string, data map[string]interface{}) bool {
+			return noticeType == "Tunnels" && data["count"].(int) == 1
+		},
+		func() {
+			if atomic.LoadInt32(&slowAccepted) != int32(len(slowCandidates)) {
+				t.Fatalf("unexpected slow attempts: %d", atomic.LoadInt32(&slowAccepted))
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for atomic.LoadInt32(&slowClosed) != int32(len(slowCandidates)) {
+				if time.Now().After(deadline) {
+					t.Fatalf("slow attempts not canceled: %d closed",
+						atomic.LoadInt32(&slowClosed))
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+
+	if elapsed > 5*time.Second {
+		t.Fatalf("unexpected establishment duration: %s", elapsed)
+	}
+}
+
+// delayedAcceptListener delays each accepted connection, to simulate a
+// server which is slow to respond.
+type delayedAcceptListener struct {
+	net.Listener
+	delay time.Duration
+}
+
+func (listener *delayedAcceptListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err == nil {
+		time.Sleep(listener.delay)
+	}
+	return conn, err
+}
+
+func TestSelectProtocolDisableTunnelProtocols(t *testing.T) {
+
+	serverEntry := &protocol.ServerEntry{IpAddress: "192.0.2.1"}
+	for _, tunnelProtocol := range protocol.SupportedTunnelProtocols {
+		serverEntry.Capabilities = append(
+			serverEntry.Capabilities, protocol.GetCapability(tunnelProtocol))
+	}
+
+	testCases := []struct {
+		description       string
+		configJSON        string
+		expectedProtocols []string
+	}{
+		{
+			"disabled",
+			`{"PropagationChannelId": "0", "SponsorId": "0",
+			  "DisableTunnelProtocols": ["SSH", "OSSH"]}`,
+			[]string{
+				protocol.TUNNEL_PROTOCOL_FRONTED_MEEK,
+				protocol.TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP,
+				protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+				protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS,
+				protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET,
+				protocol.TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH,
+			},
+		},
+		{
+			"limited and disabled",
+			`{"PropagationChannelId": "0", "SponsorId": "0",
+			  "LimitTunnelProtocols": ["SSH", "OSSH"],
+			  "DisableTunnelProtocols": ["SSH"]}`,
+			[]string{protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH},
+		},
+		{
+			"legacy limited and disabled",
+			`{"PropagationChannelId": "0", "SponsorId": "0",
+			  "TunnelProtocols": ["SSH", "UNFRONTED-MEEK-OSSH"],
+			  "DisableTunnelProtocols": ["SSH"]}`,
+			[]string{protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK},
+		},
+		{
+			"upstream proxy excludes QUIC",
+			`{"PropagationChannelId": "0", "SponsorId": "0",
+			  "LimitTunnelProtocols": ["OSSH", "QUIC-OSSH"],
+			  "UpstreamProxyURL": "http://127.0.0.1:8080"}`,
+			[]string{protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH},
+		},
+	}
+
+	for _, testCase := range testCases {
+
+		config, err := LoadConfig([]byte(testCase.configJSON))
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %s", err)
+		}
+
+		for i := 0; i < 100; i++ {
+			selectedProtocol, err := selectProtocol(config, serverEntry, nil, false, false, false)
+			if err != nil {
+				t.Fatalf("selectProtocol failed: %s", err)
+			}
+			if !common.Contains(testCase.expectedProtocols, selectedProtocol) {
+				t.Fatalf("%s: unexpected protocol selected: %s",
+					testCase.description, selectedProtocol)
+			}
+		}
+	}
+}
+
+func makeTestConnectTunnelConfig(t *testing.T, timeoutSeconds int) *Config {
+
+	configJSON := fmt.Sprintf(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "TunnelConnectTimeoutSeconds" : %d
+    }`, timeoutSeconds)
+
+	config, err := LoadConfig([]byte(configJSON))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	return config
+}
+
+func makeTestSSHServerEntry(
+	t *testing.T, listener net.Listener, hostKey string) *protocol.ServerEntry {
+
+	if hostKey == "" {
+		hostKey = base64.StdEncoding.EncodeToString(makeTestSSHSigner(t).PublicKey().Marshal())
+	}
+
+	return &protocol.ServerEntry{
+		IpAddress:    "127.0.0.1",
+		SshPort:      listener.Addr().(*net.TCPAddr).Port,
+		SshUsername:  "username",
+		SshPassword:  "password",
+		SshHostKey:   hostKey,
+		Capabilities: []string{protocol.GetCapability(protocol.TUNNEL_PROTOCOL_SSH)},
+	}
+}
+
+func makeTestSSHSigner(t *testing.T) ssh.Signer {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey failed: %s", err)
+	}
+	return signer
+}
+
+// runTestSSHServer runs a minimal SSH server, which accepts any password,
+// on listener and returns its encoded host public key. While stallRequests
+// is set, the server stops replying to global requests, such as keepalives.
+// The server rejects all port forwards as prohibited.
+func runTestSSHServer(t *testing.T, listener net.Listener, stallRequests *int32) string {
+	return runTestSSHServerWithRejection(t, listener, stallRequests, ssh.Prohibited)
+}
+
+// runTestSSHServerWithRejection is runTestSSHServer with the specified port
+// forward rejection reason. ssh.ConnectionFailed simulates an egress from
+// which port forward destinations are unreachable.
+func runTestSSHServerWithRejection(
+	t *testing.T,
+	listener net.Listener,
+	stallRequests *int32,
+	rejectionReason ssh.RejectionReason) string {
+
+	signer := makeTestSSHSigner(t)
+
+	serverConfig := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	serverConfig.AddHostKey(signer)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				sshConn, channels, requests, err := ssh.NewServerConn(conn, serverConfig)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				go func() {
+					for request := range requests {
+						if stallRequests != nil && atomic.LoadInt32(stallRequests) == 1 {
+							continue
+						}
+						if request.WantReply {
+							request.Reply(false, nil)
+						}
+					}
+				}()
+				for newChannel := range channels {
+					newChannel.Reject(rejectionReason, "")
+				}
+				sshConn.Close()
+			}()
+		}
+	}()
+
+	return base64.StdEncoding.EncodeToString(signer.PublicKey().Marshal())
+}
+
+func TestSSHKeepAliveMissedReplies(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	var stallRequests int32
+	serverEntry := makeTestSSHServerEntry(
+		t, listener, runTestSSHServer(t, listener, &stallRequests))
+
+	config := makeTestConnectTunnelConfig(t, 10)
+
+	tunnel, err := ConnectTunnel(
+		context.Background(), config, "0", serverEntry,
+		protocol.TUNNEL_PROTOCOL_SSH, monotime.Now())
+	if err != nil {
+		t.Fatalf("ConnectTunnel failed: %s", err)
+	}
+	defer tunnel.Close(true)
+
+	signalKeepAlive := make(chan sshKeepAliveSignal)
+	keepAliveError := make(chan error, 1)
+	workerDone := make(chan struct{})
+	go func() {
+		tunnel.sshKeepAliveWorker(signalKeepAlive, keepAliveError)
+		close(workerDone)
+	}()
+	defer func() {
+		close(signalKeepAlive)
+		<-workerDone
+	}()
+
+	timeout := 200 * time.Millisecond
+	maxMissedReplies := 3
+
+	sendKeepAlive := func() {
+		signalKeepAlive <- sshKeepAliveSignal{
+			timeout:          timeout,
+			maxMissedReplies: maxMissedReplies,
+		}
+	}
+
+	expectNoError := func() {
+		select {
+		case err := <-keepAliveError:
+			t.Fatalf("unexpected keep alive error: %s", err)
+		case <-time.After(2 * timeout):
+		}
+		if tunnel.conn.IsClosed() {
+			t.Fatalf("unexpected tunnel conn closed")
+		}
+	}
+
+	// A responsive server.
+
+	sendKeepAlive()
+	expectNoError()
+
+	// A stalled server: the tunnel survives missed replies up to the
+	// threshold.
+
+	atomic.StoreInt32(&stallRequests, 1)
+
+	for i := 0; i < maxMissedReplies-1; i++ {
+		sendKeepAlive()
+		expectNoError()
+	}
+
+	sendKeepAlive()
+
+	select {
+	case <-keepAliveError:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for keep alive error")
+	}
+
+	if !tunnel.conn.IsClosed() {
+		t.Fatalf("tunnel conn not closed")
+	}
+
+	// Once failed, tunneled requests get an error rather than hanging.
+
+	dialErr := make(chan error, 1)
+	go func() {
+		_, err := tunnel.sshClient.Dial("tcp", "127.0.0.1:80")
+		dialErr <- err
+	}()
+
+	select {
+	case err := <-dialErr:
+		if err == nil {
+			t.Fatalf("unexpected dial success")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for dial error")
+	}
+}
+
+type testTunnelOwner struct{}
+
+func (testTunnelOwner) SignalSeededNewSLOK() {}
+
+func (testTunnelOwner) SignalTunnelFailure(_ *Tunnel) {}
+
+func TestTunnelProtocolAndServerRegion(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-tunnel-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	// The datastore is used by operateTunnel, which is started by Activate.
+
+	singleton = dataStore{}
+	err = InitDataStore(&Config{DataStoreDirectory: testDataDirName})
+	if err != nil {
+		t.Fatalf("InitDataStore failed: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	serverEntry := makeTestSSHServerEntry(t, listener, runTestSSHServer(t, listener, nil))
+	serverEntry.Region = "DE"
+
+	config := makeTestConnectTunnelConfig(t, 30)
+	config.DisableApi = true
+
+	type connectedServer struct {
+		region   string
+		protocol string
+	}
+	connectedServers := make(chan connectedServer, 1)
+	SetNoticeCallback(func(noticeType string, data map[string]interface{}) {
+		if noticeType == "ConnectedServer" {
+			connectedServers <- connectedServer{
+				region:   data["region"].(string),
+				protocol: data["protocol"].(string),
+			}
+		}
+	})
+	defer SetNoticeCallback(nil)
+
+	tunnel, err := ConnectTunnel(
+		context.Background(), config, "0", serverEntry,
+		protocol.TUNNEL_PROTOCOL_SSH, monotime.Now())
+	if err != nil {
+		t.Fatalf("ConnectTunnel failed: %s", err)
+	}
+	defer tunnel.Close(true)
+
+	// The values are available once connected, before activation.
+
+	if tunnel.Protocol() != protocol.TUNNEL_PROTOCOL_SSH || tunnel.ServerRegion() != "DE" {
+		t.Fatalf("unexpected tunnel values: %s, %s", tunnel.Protocol(), tunnel.ServerRegion())
+	}
+
+	err = tunnel.Activate(context.Background(), testTunnelOwner{})
+	if err != nil {
+		t.Fatalf("Activate failed: %s", err)
+	}
+
+	select {
+	case server := <-connectedServers:
+		if server.protocol != tunnel.Protocol() || server.region != tunnel.ServerRegion() {
+			t.Fatalf("unexpected ConnectedServer notice: %+v", server)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("missing ConnectedServer notice")
+	}
+}
+
+func TestGetHandshakeResponse(t *testing.T) {
+
+	tunnel := &Tunnel{mutex: new(sync.Mutex)}
+
+	if tunnel.GetHandshakeResponse() != nil {
+		t.Fatalf("unexpected handshake response")
+	}
+
+	tunnel.serverContext = &ServerContext{
+		handshakeResponse: &HandshakeResponse{
+			ClientRegion:         "CA",
+			Homepages:            []string{"https://example.com/"},
+			UpgradeClientVersion: "2",
+			PageViewRegexes:      []map[string]string{{"regex": "a", "replace": "b"}},
+		},
+	}
+
+	response := tunnel.GetHandshakeResponse()
+	if response.ClientRegion != "CA" ||
+		response.UpgradeClientVersion != "2" ||
+		len(response.Homepages) != 1 ||
+		response.PageViewRegexes[0]["regex"] != "a" ||
+		response.ServerTimestamp != "" {
+		t.Fatalf("unexpected handshake response: %+v", response)
+	}
+
+	// Mutating the returned copy doesn't modify the tunnel's state.
+
+	response.Homepages[0] = "https://example.org/"
+	response.PageViewRegexes[0]["regex"] = "c"
+
+	response = tunnel.GetHandshakeResponse()
+	if response.Homepages[0] != "https://example.com/" ||
+		response.PageViewRegexes[0]["regex"] != "a" {
+		t.Fatalf("handshake response state modified: %+v", response)
+	}
+}
+
+func TestSelectProtocolLastTunnelProtocol(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-select-protocol-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	config, err := LoadConfig([]byte(fmt.Sprintf(`
+		{
+			"PropagationChannelId" : "0",
+			"SponsorId" : "0",
+			"DataStoreDirectory" : "%s"
+		}`, testDataDirName)))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	singleton = dataStore{}
+	err = InitDataStore(config)
+	if err != nil {
+		t.Fatalf("InitDataStore failed: %s", err)
+	}
+
+	serverEntry := &protocol.ServerEntry{IpAddress: "192.0.2.1", Region: "CA"}
+	for _, tunnelProtocol := range protocol.SupportedTunnelProtocols {
+		serverEntry.Capabilities = append(
+			serverEntry.Capabilities, protocol.GetCapability(tunnelProtocol))
+	}
+
+	otherRegionServerEntry := *serverEntry
+	otherRegionServerEntry.Region = "US"
+
+	lastProtocol := protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS
+
+	recordTunnelProtocolSuccess(serverEntry, lastProtocol)
+
+	selectProtocols := func(
+		serverEntry *protocol.ServerEntry,
+		excludeMeek bool,
+		useLastTunnelProtocol bool) map[string]bool {
+
+		selected := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			selectedProtocol, err := selectProtocol(
+				config, serverEntry, nil, excludeMeek, false, useLastTunnelProtocol)
+			if err != nil {
+				t.Fatalf("selectProtocol failed: %s", err)
+			}
+			selected[selectedProtocol] = true
+		}
+		return selected
+	}
+
+	// The last successful protocol is always selected first.
+
+	selected := selectProtocols(serverEntry, false, true)
+	if len(selected) != 1 || !selected[lastProtocol] {
+		t.Fatalf("unexpected selected protocols: %v", selected)
+	}
+
+	// Stickiness is per region, may be disabled, and doesn't apply when the
+	// last successful protocol isn't a candidate.
+
+	for _, selected := range []map[string]bool{
+		selectProtocols(&otherRegionServerEntry, false, true),
+		selectProtocols(serverEntry, false, false),
+		selectProtocols(serverEntry, true, true),
+	} {
+		if len(selected) < 2 {
+			t.Fatalf("unexpected selected protocols: %v", selected)
+		}
+	}
+}
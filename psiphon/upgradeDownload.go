@@ -21,15 +21,48 @@ package psiphon
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 )
 
+// ErrInsufficientDiskSpace is returned by DownloadUpgrade when there is not
+// enough free disk space for the upgrade download. Unlike other errors,
+// ErrInsufficientDiskSpace is returned without added context, so that callers
+// may compare against it.
+var ErrInsufficientDiskSpace = errors.New("insufficient disk space")
+
+// ErrUpgradeNotFound is returned by DownloadUpgrade when the upgrade
+// download server responds with 404 Not Found or 410 Gone, as when an
+// advertised upgrade version is withdrawn. Retrying the same version is not
+// expected to succeed. ErrUpgradeNotFound is returned without added context.
+var ErrUpgradeNotFound = errors.New("upgrade not found")
+
+// ErrTunnelPaused is returned by DownloadUpgrade when the tunnel is paused.
+// No download progress is lost, and the download may be resumed once the
+// tunnel is resumed. ErrTunnelPaused is returned without added context.
+var ErrTunnelPaused = errors.New("tunnel is paused")
+
+var errDiskSpaceUnsupported = errors.New("disk space query not supported")
+
 // DownloadUpgrade performs a resumable download of client upgrade files.
 //
 // While downloading/resuming, a temporary file is used. Once the download is complete,
@@ -43,6 +76,20 @@ import (
 // remote entity's UpgradeDownloadClientVersionHeader. A HEAD request is made to check the
 // version before proceeding with a full download.
 //
+// Before downloading, DownloadUpgrade checks that the free disk space is
+// sufficient for the remaining download size plus a margin, and returns
+// ErrInsufficientDiskSpace when it isn't. The check is skipped on platforms
+// where free disk space cannot be determined.
+//
+// When config.UpgradeDownloadConditionalRequest is set and validators from a
+// previously completed download are stored, a conditional HEAD request is
+// made first; a 304 Not Modified response skips the download.
+//
+// When the tunnel is working but the download server is unreachable from the
+// tunnel's egress, DownloadUpgrade returns an *EndpointUnreachableError,
+// without added context, rather than retrying, so that the caller may try a
+// tunnel with a different egress region.
+//
 // NOTE: This code does not check that any existing file at config.UpgradeDownloadFilename
 // is actually the version specified in handshakeVersion.
 //
@@ -63,117 +110,1800 @@ func DownloadUpgrade(
 	tunnel *Tunnel,
 	untunneledDialConfig *DialConfig) error {
 
-	// Note: this downloader doesn't use ETags since many client binaries, with
-	// different embedded values, exist for a single version.
+	// Note: the ETag of a partial download is sent, with If-Match, when
+	// resuming, so that a partial download is never completed with the bytes
+	// of a different entity. ETags aren't otherwise used to skip downloads,
+	// since many client binaries, with different embedded values, exist for
+	// a single version; see config.UpgradeDownloadConditionalRequest.
 
 	// Check if complete file already downloaded
 
 	if _, err := os.Stat(config.UpgradeDownloadFilename); err == nil {
-		NoticeClientUpgradeDownloaded(config.UpgradeDownloadFilename)
+		config.notices.ClientUpgradeDownloaded(config.UpgradeDownloadFilename, true)
 		return nil
 	}
 
-	p := config.clientParameters.Get()
-	urls := p.DownloadURLs(parameters.UpgradeDownloadURLs)
-	clientVersionHeader := p.String(parameters.UpgradeDownloadClientVersionHeader)
-	downloadTimeout := p.Duration(parameters.FetchUpgradeTimeout)
-	p = nil
+	file := &upgradeDownloadFile{config: config}
+
+	// Downloads to the same destination are serialized, and
+	// CancelUpgradeDownload waits for any in-progress download to stop before
+	// removing its files. The lock is for the destination, not the
+	// intermediate files, so that it's shared by configs with different
+	// UpgradeDownloadTempDir values.
 
-	var cancelFunc context.CancelFunc
-	ctx, cancelFunc = context.WithTimeout(ctx, downloadTimeout)
+	lock := getUpgradeDownloadLock(config.UpgradeDownloadFilename)
+
+	ctx, cancelFunc := lock.makeDownloadContext(ctx)
 	defer cancelFunc()
 
-	// Select tunneled or untunneled configuration
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
 
-	downloadURL, _, skipVerify := urls.Select(attempt)
+	// A download canceled while waiting for the lock must not create new
+	// partial download files.
 
-	httpClient, err := MakeDownloadHTTPClient(
+	if ctx.Err() != nil {
+		return common.ContextError(ctx.Err())
+	}
+
+	return downloadUpgrade(
 		ctx,
 		config,
+		attempt,
+		handshakeVersion,
 		tunnel,
 		untunneledDialConfig,
-		skipVerify)
+		file)
+}
 
-	// If no handshake version is supplied, make an initial HEAD request
-	// to get the current version from the version header.
+// CancelUpgradeDownload stops any in-progress DownloadUpgrade for
+// config.UpgradeDownloadFilename and removes the intermediate files for the
+// specified upgrade version: the partial download, its manifest, which
+// records the ETag, any legacy ETag sidecar, and any completed but not yet
+// verified download. When config.UpgradeDownloadTempDir is set, these files
+// are also removed from the config.UpgradeDownloadFilename directory, where
+// they may have been left before UpgradeDownloadTempDir was set. This
+// frees the disk space used by a download which the caller has decided not
+// to install. The completed upgrade at config.UpgradeDownloadFilename, if
+// any, is not removed.
+//
+// CancelUpgradeDownload waits for an in-progress download to stop before
+// removing files, so that no file is recreated after it's removed. A
+// download started after CancelUpgradeDownload returns isn't affected.
+// When there are no files to remove, CancelUpgradeDownload does nothing and
+// returns no error.
+func CancelUpgradeDownload(config *Config, version string) error {
 
-	availableClientVersion := handshakeVersion
-	if availableClientVersion == "" {
+	file := &upgradeDownloadFile{config: config}
 
-		request, err := http.NewRequest("HEAD", downloadURL, nil)
-		if err != nil {
-			return common.ContextError(err)
+	lock := getUpgradeDownloadLock(config.UpgradeDownloadFilename)
+
+	lock.cancelDownloads()
+
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
+
+	err := file.removeDownloadFiles(version)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// upgradeDownloadLock coordinates DownloadUpgrade and CancelUpgradeDownload
+// for one upgrade download destination. mutex is held for the
+// duration of a download. All downloads waiting for or holding mutex are
+// canceled by cancelDownloads.
+type upgradeDownloadLock struct {
+	mutex         sync.Mutex
+	cancelMutex   sync.Mutex
+	cancelContext context.Context
+	cancelFunc    context.CancelFunc
+}
+
+var upgradeDownloadLocksMutex sync.Mutex
+var upgradeDownloadLocks = make(map[string]*upgradeDownloadLock)
+
+// getUpgradeDownloadLock returns the lock for the specified upgrade
+// download destination filename.
+func getUpgradeDownloadLock(upgradeDownloadFilename string) *upgradeDownloadLock {
+
+	upgradeDownloadLocksMutex.Lock()
+	defer upgradeDownloadLocksMutex.Unlock()
+
+	lock, ok := upgradeDownloadLocks[upgradeDownloadFilename]
+	if !ok {
+		lock = &upgradeDownloadLock{}
+		lock.cancelContext, lock.cancelFunc = context.WithCancel(context.Background())
+		upgradeDownloadLocks[upgradeDownloadFilename] = lock
+	}
+	return lock
+}
+
+// makeDownloadContext returns a context, derived from ctx, which is also
+// canceled by the next cancelDownloads. The returned cancel func must be
+// called once the download is done.
+func (lock *upgradeDownloadLock) makeDownloadContext(
+	ctx context.Context) (context.Context, context.CancelFunc) {
+
+	lock.cancelMutex.Lock()
+	cancelContext := lock.cancelContext
+	lock.cancelMutex.Unlock()
+
+	ctx, cancelFunc := context.WithCancel(ctx)
+
+	go func() {
+		select {
+		case <-cancelContext.Done():
+			cancelFunc()
+		case <-ctx.Done():
 		}
+	}()
 
-		request = request.WithContext(ctx)
+	return ctx, cancelFunc
+}
+
+// cancelDownloads cancels all downloads with contexts from
+// makeDownloadContext. Downloads which subsequently call
+// makeDownloadContext aren't canceled.
+func (lock *upgradeDownloadLock) cancelDownloads() {
+
+	lock.cancelMutex.Lock()
+	defer lock.cancelMutex.Unlock()
+
+	lock.cancelFunc()
+	lock.cancelContext, lock.cancelFunc = context.WithCancel(context.Background())
+}
 
-		response, err := httpClient.Do(request)
+// DownloadUpgradeToWriter is DownloadUpgrade with a custom destination. The
+// upgrade is written to dst rather than to config.UpgradeDownloadFilename,
+// which is not used.
+//
+// To resume a partial download, downloadedOffset must return the number of
+// bytes of the specified upgrade version already written to dst; or 0 to
+// start from the beginning. Partial downloads are resumed exactly as in
+// DownloadUpgrade: the ETag of the partial download is recorded in a
+// manifest, stored in the KeyValueStore, and is sent with If-Match when
+// resuming. When there's no manifest for the partial download, or the
+// upgrade entity has changed, or the server doesn't support resuming, the
+// download restarts from offset 0 and previously written bytes are
+// overwritten. Only one DownloadUpgradeToWriter download may be in progress
+// for a given KeyValueStore.
+//
+// The caller owns durability of the written data, including any fsync;
+// DownloadUpgradeToWriter does not sync dst, and downloadedOffset must
+// report only bytes which the caller has made durable. When
+// config.UpgradeDownloadSHA256 is set, dst must also implement io.ReaderAt
+// so that the download may be verified. When dst implements io.ReaderAt,
+// the tail of a resumed partial download is also verified; see
+// parameters.UpgradeDownloadResumeVerifyBytes. When
+// config.UpgradeDownloadMaxConcurrency > 1, WriteAt is called concurrently,
+// for distinct byte ranges.
+//
+// A ClientUpgradeDownloaded notice, with a blank filename, is emitted once
+// the download is complete.
+func DownloadUpgradeToWriter(
+	ctx context.Context,
+	config *Config,
+	attempt int,
+	handshakeVersion string,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig,
+	dst io.WriterAt,
+	downloadedOffset func(version string) (int64, error)) error {
 
-		if err == nil && response.StatusCode != http.StatusOK {
-			response.Body.Close()
-			err = fmt.Errorf("unexpected response status code: %d", response.StatusCode)
+	if config.UpgradeDownloadSHA256 != "" {
+		if _, ok := dst.(io.ReaderAt); !ok {
+			return common.ContextError(
+				errors.New("UpgradeDownloadSHA256 requires dst to implement io.ReaderAt"))
 		}
-		if err != nil {
-			return common.ContextError(err)
+	}
+
+	return downloadUpgrade(
+		ctx,
+		config,
+		attempt,
+		handshakeVersion,
+		tunnel,
+		untunneledDialConfig,
+		&upgradeDownloadWriter{
+			config:           config,
+			dst:              dst,
+			downloadedOffset: downloadedOffset,
+		})
+}
+
+// GetUpgradeCheckDelay returns the delay before the next periodic upgrade
+// check, for callers that schedule their own DownloadUpgrade invocations.
+// The delay is within UpgradeCheckPeriod +/- UpgradeCheckPeriodJitter.
+//
+// To avoid many clients checking at the same time, the position of the
+// delay within that window is derived from a random, per-client seed. The
+// seed is persisted in the datastore, so the delay is stable across
+// restarts. The datastore must be initialized before calling
+// GetUpgradeCheckDelay.
+//
+// An UpgradeCheckScheduled notice reports the computed delay.
+func GetUpgradeCheckDelay(config *Config) time.Duration {
+
+	p := config.clientParameters.Get()
+	period := p.Duration(parameters.UpgradeCheckPeriod)
+	jitter := p.Float(parameters.UpgradeCheckPeriodJitter)
+	p = nil
+
+	delay := upgradeCheckDelay(period, jitter, getUpgradeCheckSeed(config.notices))
+
+	config.notices.UpgradeCheckScheduled(delay)
+
+	return delay
+}
+
+// getUpgradeCheckSeed returns the persisted upgrade check seed, creating
+// and storing a new seed when there is none. When the seed can't be
+// stored, a new seed is used for this run only.
+func getUpgradeCheckSeed(notices *noticeLogger) []byte {
+
+	seed, err := GetKeyValue(DATA_STORE_UPGRADE_CHECK_SEED_KEY)
+	if err == nil && seed != "" {
+		return []byte(seed)
+	}
+
+	seed, err = common.MakeRandomStringHex(16)
+	if err != nil {
+		notices.Alert("failed to make upgrade check seed: %s", common.ContextError(err))
+		return nil
+	}
+
+	err = SetKeyValue(DATA_STORE_UPGRADE_CHECK_SEED_KEY, seed)
+	if err != nil {
+		notices.Alert("failed to store upgrade check seed: %s", common.ContextError(err))
+	}
+
+	return []byte(seed)
+}
+
+// upgradeCheckDelay returns a delay in the range period +/- (period *
+// jitter), deterministically selected by seed.
+func upgradeCheckDelay(period time.Duration, jitter float64, seed []byte) time.Duration {
+
+	digest := sha256.Sum256(seed)
+	fraction := float64(binary.BigEndian.Uint64(digest[0:8])) / math.MaxUint64
+
+	delay := period + time.Duration(float64(period)*jitter*(2*fraction-1))
+	if delay < 0 {
+		delay = 0
+	}
+
+	return delay
+}
+
+// upgradeDownloadDestination is where downloadUpgrade stores the upgrade.
+type upgradeDownloadDestination interface {
+
+	// download performs one resumable download attempt of the specified
+	// version, returning the number of bytes downloaded.
+	download(
+		ctx context.Context,
+		httpClient *http.Client,
+		downloadURL string,
+		userAgent string,
+		version string,
+		maxConcurrency int,
+		chunkSize int64) (int64, error)
+
+	// verify checks the SHA-256 digest of the downloaded version. On failure,
+	// the download is discarded.
+	verify(version string, expectedDigest string) error
+
+	// getValidator returns the stored validator for the previously completed
+	// download, or nil when there is none.
+	getValidator() *upgradeDownloadValidator
+
+	// checkDiskSpace checks that there is sufficient storage for the
+	// remainder of the specified version download, plus margin bytes.
+	// getContentLength returns the total download size, or -1 when unknown.
+	checkDiskSpace(version string, getContentLength func() int64, margin int64) error
+
+	// complete finalizes the download of the specified version and returns
+	// the filename, if any, of the upgrade. validator, which may be nil, is
+	// the validator of the downloaded entity.
+	complete(version string, validator *upgradeDownloadValidator) (string, error)
+
+	// discard deletes any partial download of the specified version.
+	discard(version string)
+}
+
+// upgradeDownloadValidator is the HTTP cache validator of a completed
+// upgrade download, used to make conditional requests.
+type upgradeDownloadValidator struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+func downloadUpgrade(
+	ctx context.Context,
+	config *Config,
+	attempt int,
+	handshakeVersion string,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig,
+	destination upgradeDownloadDestination) (retErr error) {
+
+	if tunnel != nil && tunnel.IsPaused() {
+		return ErrTunnelPaused
+	}
+
+	if tunnel != nil && tunnel.sessionByteBudget.exceeded() {
+		return ErrSessionByteBudgetExceeded
+	}
+
+	defer func() {
+		if retErr != nil {
+			statsUpgradeDownloadsFailed.add(1)
 		}
-		defer response.Body.Close()
+	}()
 
-		currentClientVersion, err := strconv.Atoi(config.ClientVersion)
-		if err != nil {
-			return common.ContextError(err)
+	ctx, cancelFunc := context.WithTimeout(
+		ctx, config.clientParameters.Get().Duration(parameters.FetchUpgradeTimeout))
+	defer cancelFunc()
+
+	// Try each mirror in turn, in the random order returned by Candidates,
+	// failing over to the next mirror when the download server can't be
+	// reached or fails with a 5xx response. A partial download is resumed
+	// from the next mirror; as the partial download ETag is sent as
+	// If-Match, the download restarts when the mirror's ETag differs.
+
+	mirrors := config.clientParameters.Get().DownloadURLs(
+		parameters.UpgradeDownloadURLs).Candidates(attempt)
+
+	var err error
+	for mirrorIndex, mirror := range mirrors {
+
+		err = downloadUpgradeFromMirror(
+			ctx,
+			config,
+			handshakeVersion,
+			tunnel,
+			untunneledDialConfig,
+			destination,
+			mirrorIndex,
+			mirror)
+
+		mirrorErr, ok := err.(*upgradeMirrorError)
+		if !ok {
+			return err
 		}
+		err = mirrorErr.err
 
-		// Note: if the header is missing, Header.Get returns "" and then
-		// strconv.Atoi returns a parse error.
-		availableClientVersion = response.Header.Get(clientVersionHeader)
-		checkAvailableClientVersion, err := strconv.Atoi(availableClientVersion)
-		if err != nil {
-			// If the header is missing or malformed, we can't determine the available
-			// version number. This is unexpected; but if it happens, it's likely due
-			// to a server-side configuration issue. In this one case, we don't
-			// return an error so that we don't go into a rapid retry loop making
-			// ineffective HEAD requests (the client may still signal an upgrade
-			// download later in the session).
-			NoticeAlert(
-				"failed to download upgrade: invalid %s header value %s: %s",
-				clientVersionHeader, availableClientVersion, err)
-			return nil
+		if ctx.Err() != nil {
+			break
 		}
 
-		if currentClientVersion >= checkAvailableClientVersion {
-			NoticeClientIsLatestVersion(availableClientVersion)
+		if mirrorIndex < len(mirrors)-1 {
+			config.notices.Alert("upgrade download mirror %d failed: %s", mirrorIndex, err)
+		}
+	}
+
+	return err
+}
+
+// upgradeMirrorError is returned by downloadUpgradeFromMirror when the
+// download failed in a way which another mirror may not, such as a failure
+// to connect or a 5xx response.
+type upgradeMirrorError struct {
+	err error
+}
+
+func (e *upgradeMirrorError) Error() string {
+	return e.err.Error()
+}
+
+// isUpgradeMirrorFailure indicates whether a request which received the
+// specified status code, 0 when no response was received, should be retried
+// with another mirror.
+func isUpgradeMirrorFailure(statusCode int32) bool {
+	return statusCode == 0 || statusCode >= 500
+}
+
+// downloadUpgradeFromMirror performs the upgrade download from mirror, the
+// mirrorIndex'th candidate URL.
+func downloadUpgradeFromMirror(
+	ctx context.Context,
+	config *Config,
+	handshakeVersion string,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig,
+	destination upgradeDownloadDestination,
+	mirrorIndex int,
+	mirror *parameters.DownloadURL) error {
+
+	p := config.clientParameters.Get()
+	progressNoticePeriod := p.Duration(parameters.UpgradeDownloadProgressNoticePeriod)
+	progressNoticeBytes := int64(p.Int(parameters.UpgradeDownloadProgressNoticeBytes))
+	chunkSize := int64(p.Int(parameters.UpgradeDownloadChunkSize))
+	retries := p.Int(parameters.UpgradeDownloadRetries)
+	retryBase := p.Duration(parameters.UpgradeDownloadRetryBase)
+	retryMaximum := p.Duration(parameters.UpgradeDownloadRetryMaximum)
+	retryAfterMaximum := p.Duration(parameters.UpgradeDownloadRetryAfterMaximum)
+	diskSpaceMargin := int64(p.Int(parameters.UpgradeDownloadDiskSpaceMargin))
+	resumeVerifyBytes := p.Int(parameters.UpgradeDownloadResumeVerifyBytes)
+	p = nil
+
+	downloadURL := mirror.URL
+
+	// Select tunneled or untunneled configuration
+
+	httpClient, err := makeUpgradeDownloadHTTPClient(
+		ctx, config, mirror, tunnel, untunneledDialConfig)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	// Record when the tunnel is working but the download server is
+	// unreachable from the tunnel's egress, so that the failure isn't
+	// mistaken for a tunnel failure and a different egress may be tried.
+
+	var endpointUnreachable atomic.Value
+	httpClient.Transport = &endpointUnreachableRecordingTransport{
+		transport:   httpClient.Transport,
+		unreachable: &endpointUnreachable,
+	}
+
+	endpointUnreachableError := func(err error) error {
+		unreachableErr, ok := endpointUnreachable.Load().(*EndpointUnreachableError)
+		if !ok {
 			return nil
 		}
+		config.notices.Alert("upgrade endpoint unreachable via this egress: %s", err)
+		return unreachableErr
+	}
+
+	// When a validator from a previously completed download is stored, the
+	// HEAD request is conditional, and a 304 Not Modified response indicates
+	// that the upgrade is unchanged and need not be downloaded again.
+
+	var validator *upgradeDownloadValidator
+	if config.UpgradeDownloadConditionalRequest {
+		validator = destination.getValidator()
+	}
+
+	var headStatusCode int32
+	headHTTPClient := *httpClient
+	headHTTPClient.Transport = &statusRecordingTransport{
+		transport:  httpClient.Transport,
+		statusCode: &headStatusCode,
+	}
+
+	availability, err := checkUpgradeAvailable(
+		ctx, config, &headHTTPClient, downloadURL, handshakeVersion, validator, false)
+	if err == ErrUpgradeNotFound {
+		return err
+	}
+	if err != nil {
+		if unreachableErr := endpointUnreachableError(err); unreachableErr != nil {
+			err = unreachableErr
+		} else {
+			err = common.ContextError(err)
+		}
+		if isUpgradeMirrorFailure(atomic.LoadInt32(&headStatusCode)) {
+			return &upgradeMirrorError{err: err}
+		}
+		return err
 	}
 
+	if !availability.Available {
+		return nil
+	}
+
+	availableClientVersion := availability.Version
+	contentLength := availability.SizeBytes
+
 	// Proceed with download
 
-	// An intermediate filename is used since the presence of
-	// config.UpgradeDownloadFilename indicates a completed download.
+	// Decode compressed responses, so that the stored upgrade is the
+	// original entity.
 
-	downloadFilename := fmt.Sprintf(
-		"%s.%s", config.UpgradeDownloadFilename, availableClientVersion)
+	httpClient.Transport = &contentDecodingTransport{
+		transport: httpClient.Transport,
+	}
 
-	n, _, err := ResumeDownload(
-		ctx,
-		httpClient,
-		downloadURL,
-		MakePsiphonUserAgent(config),
-		downloadFilename,
-		"")
+	// Check for sufficient disk space before starting, rather than failing
+	// when the disk fills part way through the download. When no HEAD
+	// request was made to check the version, one is made here to get the
+	// download size.
 
-	NoticeClientUpgradeDownloadedBytes(n)
+	getContentLength := func() int64 {
+		if contentLength == -1 {
+			contentLength = getDownloadContentLength(ctx, httpClient, downloadURL)
+		}
+		return contentLength
+	}
 
+	err = destination.checkDiskSpace(availableClientVersion, getContentLength, diskSpaceMargin)
+	if err == ErrInsufficientDiskSpace {
+		return err
+	}
 	if err != nil {
 		return common.ContextError(err)
 	}
 
-	err = os.Rename(downloadFilename, config.UpgradeDownloadFilename)
+	// Similarly, don't start a tunneled download which the remaining session
+	// byte budget can't accommodate.
+
+	if tunnel != nil {
+		remaining := tunnel.sessionByteBudget.remaining()
+		if remaining != -1 && getContentLength() > remaining {
+			return ErrSessionByteBudgetExceeded
+		}
+	}
+
+	// Emit periodic progress notices while downloading.
+
+	httpClient.Transport = &downloadProgressTransport{
+		transport:    httpClient.Transport,
+		noticePeriod: progressNoticePeriod,
+		noticeBytes:  progressNoticeBytes,
+		report:       NoticeClientUpgradeDownloadProgress,
+	}
+
+	if config.UpgradeDownloadBytesPerSecond > 0 {
+		httpClient.Transport = newRateLimitedTransport(
+			httpClient.Transport, config.UpgradeDownloadBytesPerSecond)
+	}
+
+	// Guard against a hostile or misconfigured server streaming unbounded
+	// data. An oversized download is not retried.
+
+	var maxBytesExceeded int32
+	if config.UpgradeDownloadMaxBytes > 0 {
+
+		if contentLength > config.UpgradeDownloadMaxBytes {
+			atomic.StoreInt32(&maxBytesExceeded, 1)
+		}
+
+		httpClient.Transport = &maxBytesTransport{
+			transport: httpClient.Transport,
+			maxBytes:  config.UpgradeDownloadMaxBytes,
+			exceeded:  &maxBytesExceeded,
+		}
+	}
+
+	// Record the response status code so that failures due to, for
+	// example, a missing entity, are not retried; and record any Retry-After
+	// so that a throttling server isn't retried too soon.
+
+	var lastStatusCode int32
+	var lastRetryAfter atomic.Value
+	httpClient.Transport = &statusRecordingTransport{
+		transport:  httpClient.Transport,
+		statusCode: &lastStatusCode,
+		retryAfter: &lastRetryAfter,
+	}
+
+	// Record the validator of the downloaded entity, to be stored with the
+	// completed download.
+
+	validatorTransport := &validatorRecordingTransport{
+		transport: httpClient.Transport,
+	}
+	httpClient.Transport = validatorTransport
+
+	// Report when a partial download is discarded, which accounts for
+	// additional download bandwidth.
+
+	ctx = withDownloadRestartHandler(ctx, func(reason string) {
+		config.notices.ClientUpgradeDownloadRestart(availableClientVersion, reason)
+	})
+
+	// Report when the torn tail of a resumed partial download is rewound,
+	// which accounts for a smaller amount of additional download bandwidth.
+
+	ctx = withDownloadRewindHandler(ctx, func(rewindBytes int64) {
+		config.notices.ClientUpgradeDownloadRewind(availableClientVersion, rewindBytes)
+	})
+
+	// Record the version in the partial download manifest.
+
+	ctx = withDownloadVersion(ctx, availableClientVersion)
+
+	// Verify the tail of a resumed partial download, which may be corrupt
+	// after a crash mid-write.
+
+	ctx = withDownloadResumeVerifyBytes(ctx, resumeVerifyBytes)
+
+	download := func() (int64, error) {
+		atomic.StoreInt32(&lastStatusCode, 0)
+		lastRetryAfter.Store("")
+		return destination.download(
+			ctx,
+			httpClient,
+			downloadURL,
+			MakePsiphonUserAgent(config),
+			availableClientVersion,
+			config.UpgradeDownloadMaxConcurrency,
+			chunkSize)
+	}
+
+	// Retry transient failures, with exponential backoff. Each retry resumes
+	// the partial download.
+
+	for retry := 0; atomic.LoadInt32(&maxBytesExceeded) == 0; retry++ {
+
+		var n int64
+		n, err = download()
+
+		config.notices.ClientUpgradeDownloadedBytes(n)
+		statsUpgradeDownloadBytes.add(n)
+
+		if err == nil ||
+			ctx.Err() != nil ||
+			retry >= retries ||
+			atomic.LoadInt32(&maxBytesExceeded) == 1 {
+			break
+		}
+
+		statusCode := atomic.LoadInt32(&lastStatusCode)
+		if statusCode >= 400 && statusCode < 500 {
+			break
+		}
+
+		// Retrying through the same egress isn't expected to succeed.
+
+		if endpointUnreachable.Load() != nil {
+			break
+		}
+
+		config.notices.Info(
+			"retrying upgrade download: attempt %d: %s", retry+2, err)
+
+		retryDelay := upgradeDownloadRetryDelay(retryBase, retryMaximum, retry)
+
+		// When the server is throttling, wait at least as long as it
+		// requests, up to retryAfterMaximum.
+
+		if statusCode == http.StatusServiceUnavailable && retryAfterMaximum > 0 {
+			retryAfter, ok := parseRetryAfter(
+				lastRetryAfter.Load().(string), config.getClock().Now())
+			if ok {
+				if retryAfter > retryAfterMaximum {
+					retryAfter = retryAfterMaximum
+				}
+				if retryAfter > retryDelay {
+					retryDelay = retryAfter
+				}
+				config.notices.ClientUpgradeDownloadRetryAfter(availableClientVersion, retryDelay)
+			}
+		}
+
+		timer := config.getClock().NewTimer(retryDelay)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+		}
+		timer.Stop()
+	}
+
+	if atomic.LoadInt32(&maxBytesExceeded) == 1 {
+		destination.discard(availableClientVersion)
+		config.notices.Alert(
+			"upgrade download exceeded maximum size of %d bytes",
+			config.UpgradeDownloadMaxBytes)
+		return common.ContextError(errUpgradeDownloadTooLarge)
+	}
+
+	if err != nil {
+
+		// When the download is interrupted by cancellation, report the
+		// cancellation rather than the resulting, incidental read error. The
+		// partial download is retained for resuming.
+
+		if ctx.Err() != nil {
+			return common.ContextError(ctx.Err())
+		}
+
+		// A withdrawn upgrade is not retried. 410 Gone indicates that the
+		// withdrawal is permanent, so the partial download is discarded; after
+		// 404 Not Found, the same version may yet be restored, so the partial
+		// download is retained for resuming.
+
+		statusCode := int(atomic.LoadInt32(&lastStatusCode))
+		if isUpgradeNotFoundStatusCode(statusCode) {
+			if statusCode == http.StatusGone {
+				destination.discard(availableClientVersion)
+			}
+			config.notices.ClientUpgradeNotFound(availableClientVersion, statusCode)
+			return ErrUpgradeNotFound
+		}
+
+		if unreachableErr := endpointUnreachableError(err); unreachableErr != nil {
+			err = unreachableErr
+		} else {
+			err = common.ContextError(err)
+		}
+
+		// Failures other than 4xx responses, including a failure
+		// mid-download after a successful response, are retried with the
+		// next mirror, resuming the partial download.
+
+		if statusCode < 400 || statusCode >= 500 {
+			return &upgradeMirrorError{err: err}
+		}
+		return err
+	}
+
+	if config.UpgradeDownloadSHA256 != "" {
+		err = destination.verify(availableClientVersion, config.UpgradeDownloadSHA256)
+		if err != nil {
+			config.notices.Alert("failed to verify upgrade download: %s", err)
+			return common.ContextError(err)
+		}
+	}
+
+	filename, err := destination.complete(
+		availableClientVersion, validatorTransport.getValidator())
 	if err != nil {
 		return common.ContextError(err)
 	}
 
-	NoticeClientUpgradeDownloaded(config.UpgradeDownloadFilename)
+	config.notices.ClientUpgradeDownloadMirror(mirrorIndex, downloadURL)
+	config.notices.ClientUpgradeDownloaded(filename, false)
+	statsUpgradeDownloadsCompleted.add(1)
 
 	return nil
 }
+
+// UpgradeAvailability describes the upgrade available for download, as
+// reported by DownloadUpgradeAvailable.
+type UpgradeAvailability struct {
+
+	// Available indicates whether an upgrade newer than config.ClientVersion
+	// is available for download.
+	Available bool
+
+	// Version is the available upgrade client version.
+	Version string
+
+	// SizeBytes is the size of the upgrade download, or -1 when unknown.
+	SizeBytes int64
+
+	// ETag is the ETag of the upgrade download, or "" when unknown.
+	ETag string
+}
+
+// DownloadUpgradeAvailable checks whether an upgrade is available for
+// download, and its size, without downloading it. This allows the outer
+// client to, for example, prompt the user before downloading on a metered
+// connection. The parameters are as for DownloadUpgrade, and the same
+// tunneled or untunneled HTTP client and timeout are used.
+//
+// A HEAD request is always made, to get the download size. When
+// config.UpgradeDownloadConditionalRequest is set and the upgrade is
+// unchanged since the previously completed download, the upgrade is
+// reported as not available. ErrUpgradeNotFound is returned when the
+// upgrade has been withdrawn. Nothing is written to disk.
+func DownloadUpgradeAvailable(
+	ctx context.Context,
+	config *Config,
+	attempt int,
+	handshakeVersion string,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig) (*UpgradeAvailability, error) {
+
+	ctx, cancelFunc := context.WithTimeout(
+		ctx, config.clientParameters.Get().Duration(parameters.FetchUpgradeTimeout))
+	defer cancelFunc()
+
+	var validator *upgradeDownloadValidator
+	if config.UpgradeDownloadConditionalRequest {
+		validator = (&upgradeDownloadFile{config: config}).getValidator()
+	}
+
+	// As in DownloadUpgrade, fail over to the next mirror when the download
+	// server can't be reached or fails with a 5xx response.
+
+	mirrors := config.clientParameters.Get().DownloadURLs(
+		parameters.UpgradeDownloadURLs).Candidates(attempt)
+
+	var err error
+	for mirrorIndex, mirror := range mirrors {
+
+		var httpClient *http.Client
+		httpClient, err = makeUpgradeDownloadHTTPClient(
+			ctx, config, mirror, tunnel, untunneledDialConfig)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		var statusCode int32
+		httpClient.Transport = &statusRecordingTransport{
+			transport:  httpClient.Transport,
+			statusCode: &statusCode,
+		}
+
+		var availability *UpgradeAvailability
+		availability, err = checkUpgradeAvailable(
+			ctx, config, httpClient, mirror.URL, handshakeVersion, validator, true)
+		if err == ErrUpgradeNotFound {
+			return nil, err
+		}
+		if err == nil {
+			return availability, nil
+		}
+
+		if ctx.Err() != nil || !isUpgradeMirrorFailure(atomic.LoadInt32(&statusCode)) {
+			break
+		}
+
+		if mirrorIndex < len(mirrors)-1 {
+			config.notices.Alert("upgrade download mirror %d failed: %s", mirrorIndex, err)
+		}
+	}
+
+	return nil, common.ContextError(err)
+}
+
+// makeUpgradeDownloadHTTPClient returns a tunneled or untunneled HTTP client
+// for downloading the upgrade from mirror.
+func makeUpgradeDownloadHTTPClient(
+	ctx context.Context,
+	config *Config,
+	mirror *parameters.DownloadURL,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig) (*http.Client, error) {
+
+	if config.UpgradeDownloadUntunneledDiagnostic && diagnosticsBuild {
+		config.notices.Alert("diagnostic: downloading upgrade untunneled")
+		tunnel = nil
+	}
+
+	httpClient, err := MakeDownloadHTTPClient(
+		ctx,
+		config,
+		tunnel,
+		untunneledDialConfig,
+		mirror.SkipVerify)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	httpClient = withCustomHeaders(httpClient, config.UpgradeDownloadHeaders)
+
+	return httpClient, nil
+}
+
+// checkUpgradeAvailable determines whether an upgrade newer than
+// config.ClientVersion is available.
+//
+// When handshakeVersion is supplied, the handshake has already indicated
+// that handshakeVersion is available, and a HEAD request is made only when
+// validator is not nil or requireHead is set. Otherwise, a HEAD request is
+// made to get the available version from the version header. When
+// validator is not nil, the HEAD request is conditional and a 304 Not
+// Modified response indicates that no new upgrade is available.
+func checkUpgradeAvailable(
+	ctx context.Context,
+	config *Config,
+	httpClient *http.Client,
+	downloadURL string,
+	handshakeVersion string,
+	validator *upgradeDownloadValidator,
+	requireHead bool) (*UpgradeAvailability, error) {
+
+	clientVersionHeader := config.clientParameters.Get().String(
+		parameters.UpgradeDownloadClientVersionHeader)
+
+	availability := &UpgradeAvailability{
+		Version:   handshakeVersion,
+		SizeBytes: -1,
+	}
+
+	if handshakeVersion != "" && validator == nil && !requireHead {
+		availability.Available = true
+		return availability, nil
+	}
+
+	request, err := http.NewRequest("HEAD", downloadURL, nil)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	request = request.WithContext(ctx)
+
+	if validator != nil {
+		if validator.ETag != "" {
+			request.Header.Set("If-None-Match", validator.ETag)
+		}
+		if validator.LastModified != "" {
+			request.Header.Set("If-Modified-Since", validator.LastModified)
+		}
+	}
+
+	response, err := httpClient.Do(request)
+
+	if err == nil && validator != nil && response.StatusCode == http.StatusNotModified {
+		response.Body.Close()
+		config.notices.Info("upgrade download not modified")
+		return availability, nil
+	}
+
+	if err == nil && isUpgradeNotFoundStatusCode(response.StatusCode) {
+		response.Body.Close()
+		config.notices.ClientUpgradeNotFound(handshakeVersion, response.StatusCode)
+		return nil, ErrUpgradeNotFound
+	}
+
+	if err == nil && response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		err = fmt.Errorf("unexpected response status code: %d", response.StatusCode)
+	}
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	response.Body.Close()
+
+	availability.SizeBytes = response.ContentLength
+	availability.ETag = response.Header.Get("ETag")
+
+	if handshakeVersion == "" {
+
+		currentClientVersion, err := strconv.Atoi(config.ClientVersion)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		// Note: if the header is missing, Header.Get returns "" and then
+		// strconv.Atoi returns a parse error.
+		availability.Version = response.Header.Get(clientVersionHeader)
+		checkAvailableClientVersion, err := strconv.Atoi(availability.Version)
+		if err != nil {
+			// If the header is missing or malformed, we can't determine the available
+			// version number. This is unexpected; but if it happens, it's likely due
+			// to a server-side configuration issue. In this one case, we don't
+			// return an error so that we don't go into a rapid retry loop making
+			// ineffective HEAD requests (the client may still signal an upgrade
+			// download later in the session).
+			config.notices.Alert(
+				"failed to download upgrade: invalid %s header value %s: %s",
+				clientVersionHeader, availability.Version, err)
+			return availability, nil
+		}
+
+		if currentClientVersion >= checkAvailableClientVersion {
+			config.notices.ClientIsLatestVersion(availability.Version)
+			return availability, nil
+		}
+	}
+
+	availability.Available = true
+
+	return availability, nil
+}
+
+// upgradeDownloadRetryDelay returns the delay before the specified retry,
+// which is retryBase doubled for each previous retry, up to retryMaximum.
+// The doubling stops at retryMaximum, so any number of retries can't
+// overflow the delay.
+func upgradeDownloadRetryDelay(
+	retryBase, retryMaximum time.Duration, retry int) time.Duration {
+
+	// A maximum less than the base disables the backoff.
+	if retryMaximum < retryBase {
+		retryMaximum = retryBase
+	}
+
+	retryDelay := retryBase
+	for i := 0; i < retry && retryDelay < retryMaximum; i++ {
+		retryDelay *= 2
+	}
+	if retryDelay > retryMaximum {
+		retryDelay = retryMaximum
+	}
+
+	return retryDelay
+}
+
+func isUpgradeNotFoundStatusCode(statusCode int) bool {
+	return statusCode == http.StatusNotFound || statusCode == http.StatusGone
+}
+
+// upgradeDownloadFile is an upgradeDownloadDestination which downloads to
+// config.UpgradeDownloadFilename.
+type upgradeDownloadFile struct {
+	config *Config
+}
+
+// downloadFilename returns the intermediate filename for the specified
+// version. An intermediate filename is used since the presence of
+// config.UpgradeDownloadFilename indicates a completed download.
+func (file *upgradeDownloadFile) downloadFilename(version string) string {
+	return fmt.Sprintf("%s.%s", file.downloadFilenamePrefix(), version)
+}
+
+// downloadFilenamePrefix returns the intermediate filename without the
+// version, which is in config.UpgradeDownloadTempDir, when specified, and
+// otherwise alongside config.UpgradeDownloadFilename.
+func (file *upgradeDownloadFile) downloadFilenamePrefix() string {
+	if file.config.UpgradeDownloadTempDir == "" {
+		return file.config.UpgradeDownloadFilename
+	}
+	return filepath.Join(
+		file.config.UpgradeDownloadTempDir,
+		filepath.Base(file.config.UpgradeDownloadFilename))
+}
+
+func (file *upgradeDownloadFile) download(
+	ctx context.Context,
+	httpClient *http.Client,
+	downloadURL string,
+	userAgent string,
+	version string,
+	maxConcurrency int,
+	chunkSize int64) (int64, error) {
+
+	err := file.makeTempDir()
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	// Partial downloads of other versions will never be resumed.
+
+	removeStaleUpgradeDownloadFiles(file.config.notices, file.downloadFilenamePrefix(), version)
+
+	p := file.config.clientParameters.Get()
+	syncBytes := p.Int(parameters.DownloadSyncBytes)
+	syncPeriod := p.Duration(parameters.DownloadSyncPeriod)
+	p = nil
+
+	partial, err := openPartialDownloadFile(
+		ctx, file.downloadFilename(version), syncBytes, syncPeriod)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+	defer partial.close()
+
+	return resumeUpgradeDownload(
+		ctx, httpClient, downloadURL, userAgent, partial, maxConcurrency, chunkSize)
+}
+
+func (file *upgradeDownloadFile) verify(version string, expectedDigest string) error {
+
+	downloadFile, err := os.Open(file.downloadFilename(version))
+	if err != nil {
+		return common.ContextError(err)
+	}
+	defer downloadFile.Close()
+
+	err = verifyUpgradeDownloadSHA256(downloadFile, expectedDigest)
+	if err != nil {
+
+		// Discard the download so that the next attempt starts clean.
+
+		downloadFile.Close()
+		os.Remove(file.downloadFilename(version))
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+func (file *upgradeDownloadFile) checkDiskSpace(
+	version string, getContentLength func() int64, margin int64) error {
+
+	err := file.makeTempDir()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	// The download is stored in the intermediate file directory.
+
+	directory := filepath.Dir(file.downloadFilename(version))
+
+	availableBytes, err := availableDiskSpace(directory)
+	if err != nil {
+		if err != errDiskSpaceUnsupported {
+			file.config.notices.Alert("failed to get available disk space: %s", err)
+		}
+		return nil
+	}
+
+	contentLength := getContentLength()
+	if contentLength < 0 {
+		return nil
+	}
+
+	// Any partially downloaded bytes are already stored.
+
+	var partialBytes int64
+	fileInfo, err := os.Stat(file.downloadFilename(version) + ".part")
+	if err == nil {
+		partialBytes = fileInfo.Size()
+	}
+
+	requiredBytes := contentLength - partialBytes + margin
+
+	if availableBytes < requiredBytes {
+		file.config.notices.Alert(
+			"insufficient disk space for upgrade download in %s: %d bytes short",
+			directory, requiredBytes-availableBytes)
+		return ErrInsufficientDiskSpace
+	}
+
+	// When the intermediate files are on a different filesystem than the
+	// destination, the completed download is copied to the destination; see
+	// renameUpgradeDownload. The destination filesystem must then also have
+	// space for the entire download.
+
+	destinationDirectory := filepath.Dir(file.config.UpgradeDownloadFilename)
+
+	if destinationDirectory == directory {
+		return nil
+	}
+
+	isSameFilesystem, err := sameFilesystem(directory, destinationDirectory)
+	if err != nil {
+		if err != errDiskSpaceUnsupported {
+			file.config.notices.Alert("failed to compare upgrade download filesystems: %s", err)
+		}
+		return nil
+	}
+	if isSameFilesystem {
+		return nil
+	}
+
+	availableBytes, err = availableDiskSpace(destinationDirectory)
+	if err != nil {
+		file.config.notices.Alert("failed to get available disk space: %s", err)
+		return nil
+	}
+
+	requiredBytes = contentLength + margin
+
+	if availableBytes < requiredBytes {
+		file.config.notices.Alert(
+			"insufficient disk space for upgrade download in %s: %d bytes short",
+			destinationDirectory, requiredBytes-availableBytes)
+		return ErrInsufficientDiskSpace
+	}
+
+	return nil
+}
+
+// availableDiskSpace and sameFilesystem are getAvailableDiskSpace and
+// isSameFilesystem, and are replaced in tests to simulate filesystems.
+var availableDiskSpace = getAvailableDiskSpace
+var sameFilesystem = isSameFilesystem
+
+// makeTempDir creates config.UpgradeDownloadTempDir, when specified.
+func (file *upgradeDownloadFile) makeTempDir() error {
+	if file.config.UpgradeDownloadTempDir == "" {
+		return nil
+	}
+	err := os.MkdirAll(file.config.UpgradeDownloadTempDir, 0700)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// ClearUpgradeDownloadValidator deletes the validators stored for the
+// completed upgrade download at config.UpgradeDownloadFilename, when
+// config.UpgradeDownloadConditionalRequest is set. The next DownloadUpgrade
+// then downloads the upgrade even when it's unchanged. The outer client
+// should call ClearUpgradeDownloadValidator to force a re-download; for
+// example, when the previously downloaded upgrade failed to install.
+func ClearUpgradeDownloadValidator(config *Config) error {
+
+	removeLegacyUpgradeDownloadValidatorFile(config)
+
+	err := config.getKeyValueStore().Delete(
+		makeUpgradeDownloadValidatorKey(config.UpgradeDownloadFilename))
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// makeUpgradeDownloadValidatorKey returns the KeyValueStore key of the
+// stored validator for the completed download at upgradeDownloadFilename.
+// Configs with different upgrade download filenames have distinct
+// validators.
+func makeUpgradeDownloadValidatorKey(upgradeDownloadFilename string) string {
+	return "upgradeDownloadValidator:" + upgradeDownloadFilename
+}
+
+// removeLegacyUpgradeDownloadValidatorFile removes any validator file,
+// <UpgradeDownloadFilename>.validator, stored by previous versions, which
+// stored validators in a file rather than in the KeyValueStore.
+func removeLegacyUpgradeDownloadValidatorFile(config *Config) {
+	err := os.Remove(config.UpgradeDownloadFilename + ".validator")
+	if err != nil && !os.IsNotExist(err) {
+		config.notices.Alert("failed to remove legacy upgrade download validator: %s",
+			common.ContextError(err))
+	}
+}
+
+func (file *upgradeDownloadFile) getValidator() *upgradeDownloadValidator {
+
+	// The legacy validator file is not migrated: a download it would have
+	// skipped is made once, and the new validator is stored.
+
+	removeLegacyUpgradeDownloadValidatorFile(file.config)
+
+	value, err := file.config.getKeyValueStore().Get(
+		makeUpgradeDownloadValidatorKey(file.config.UpgradeDownloadFilename))
+	if err != nil {
+		file.config.notices.Alert("failed to load upgrade download validator: %s", common.ContextError(err))
+		return nil
+	}
+	if value == nil {
+		return nil
+	}
+
+	var validator upgradeDownloadValidator
+	err = json.Unmarshal(value, &validator)
+	if err != nil {
+		file.config.notices.Alert("failed to load upgrade download validator: %s", common.ContextError(err))
+		return nil
+	}
+
+	if validator.ETag == "" && validator.LastModified == "" {
+		return nil
+	}
+
+	return &validator
+}
+
+func (file *upgradeDownloadFile) complete(
+	version string, validator *upgradeDownloadValidator) (string, error) {
+
+	err := renameUpgradeDownload(
+		file.config.notices, file.downloadFilename(version), file.config.UpgradeDownloadFilename)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	// Failure to store the validator is not fatal; the next download simply
+	// won't be conditional. Any stale validator is removed, so that it can't
+	// be used for a different entity.
+
+	store := file.config.getKeyValueStore()
+	validatorKey := makeUpgradeDownloadValidatorKey(file.config.UpgradeDownloadFilename)
+
+	store.Delete(validatorKey)
+
+	if file.config.UpgradeDownloadConditionalRequest && validator != nil {
+		value, err := json.Marshal(validator)
+		if err == nil {
+			err = store.Set(validatorKey, value)
+		}
+		if err != nil {
+			file.config.notices.Alert("failed to store upgrade download validator: %s", common.ContextError(err))
+		}
+	}
+
+	return file.config.UpgradeDownloadFilename, nil
+}
+
+func (file *upgradeDownloadFile) discard(version string) {
+	file.removeDownloadFiles(version)
+}
+
+// removeDownloadFiles removes all intermediate files for the specified
+// version, including any legacy .part.etag file and, when
+// config.UpgradeDownloadTempDir is set, any intermediate files left in the
+// config.UpgradeDownloadFilename directory. Files which don't exist are
+// ignored. All removals are attempted, and the first error, if any, is
+// returned.
+func (file *upgradeDownloadFile) removeDownloadFiles(version string) error {
+
+	prefixes := []string{file.downloadFilenamePrefix()}
+	if prefixes[0] != file.config.UpgradeDownloadFilename {
+		prefixes = append(prefixes, file.config.UpgradeDownloadFilename)
+	}
+
+	var firstErr error
+	for _, prefix := range prefixes {
+		downloadFilename := fmt.Sprintf("%s.%s", prefix, version)
+		for _, suffix := range []string{".part", ".part.manifest", ".part.etag", ""} {
+			err := os.Remove(downloadFilename + suffix)
+			if err != nil && !os.IsNotExist(err) && firstErr == nil {
+				firstErr = common.ContextError(err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// resumeUpgradeDownload resumes the upgrade download stored in partial. When
+// maxConcurrency > 1, chunks are downloaded concurrently. DownloadUpgrade and
+// DownloadUpgradeToWriter share this resume protocol, and differ only in
+// where the partial download is stored.
+func resumeUpgradeDownload(
+	ctx context.Context,
+	httpClient *http.Client,
+	downloadURL string,
+	userAgent string,
+	partial partialDownload,
+	maxConcurrency int,
+	chunkSize int64) (int64, error) {
+
+	if maxConcurrency > 1 {
+		n, _, err := resumeDownloadConcurrently(
+			ctx,
+			httpClient,
+			downloadURL,
+			userAgent,
+			partial,
+			maxConcurrency,
+			chunkSize)
+		return n, err
+	}
+	n, _, err := resumeDownload(
+		ctx,
+		httpClient,
+		downloadURL,
+		userAgent,
+		partial,
+		"")
+	return n, err
+}
+
+// upgradeDownloadWriterManifestKey is the KeyValueStore key of the partial
+// download manifest of DownloadUpgradeToWriter downloads.
+const upgradeDownloadWriterManifestKey = "upgradeDownloadWriterManifest"
+
+// upgradeDownloadWriter is an upgradeDownloadDestination which downloads to
+// a caller-provided io.WriterAt. See DownloadUpgradeToWriter.
+type upgradeDownloadWriter struct {
+	config           *Config
+	dst              io.WriterAt
+	downloadedOffset func(version string) (int64, error)
+	size             int64
+}
+
+func (writer *upgradeDownloadWriter) download(
+	ctx context.Context,
+	httpClient *http.Client,
+	downloadURL string,
+	userAgent string,
+	version string,
+	maxConcurrency int,
+	chunkSize int64) (int64, error) {
+
+	offset, err := writer.downloadedOffset(version)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	partial := newPartialDownloadWriter(
+		writer.dst,
+		writer.config.getKeyValueStore(),
+		upgradeDownloadWriterManifestKey,
+		offset)
+
+	// The tail of a resumed partial download can be verified only when dst
+	// is readable.
+
+	if _, ok := writer.dst.(io.ReaderAt); !ok {
+		ctx = withDownloadResumeVerifyBytes(ctx, 0)
+	}
+
+	n, err := resumeUpgradeDownload(
+		ctx, httpClient, downloadURL, userAgent, partial, maxConcurrency, chunkSize)
+
+	writer.size, _ = partial.size()
+
+	return n, err
+}
+
+func (writer *upgradeDownloadWriter) verify(_ string, expectedDigest string) error {
+
+	// DownloadUpgradeToWriter checks that dst implements io.ReaderAt.
+
+	reader := io.NewSectionReader(writer.dst.(io.ReaderAt), 0, writer.size)
+
+	err := verifyUpgradeDownloadSHA256(reader, expectedDigest)
+	if err != nil {
+
+		// Discard the manifest so that the next attempt starts clean.
+
+		writer.removeManifest()
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+func (writer *upgradeDownloadWriter) getValidator() *upgradeDownloadValidator {
+
+	// Validators are not stored for custom destinations.
+	return nil
+}
+
+func (writer *upgradeDownloadWriter) checkDiskSpace(
+	_ string, _ func() int64, _ int64) error {
+
+	// The caller owns the storage for dst.
+	return nil
+}
+
+func (writer *upgradeDownloadWriter) complete(
+	_ string, _ *upgradeDownloadValidator) (string, error) {
+	return "", nil
+}
+
+func (writer *upgradeDownloadWriter) discard(_ string) {
+
+	// The caller owns the data written to dst. Without a manifest, the next
+	// download restarts from byte zero.
+
+	writer.removeManifest()
+}
+
+func (writer *upgradeDownloadWriter) removeManifest() {
+	err := writer.config.getKeyValueStore().Delete(upgradeDownloadWriterManifestKey)
+	if err != nil {
+		writer.config.notices.Alert(
+			"failed to remove upgrade download manifest: %s", common.ContextError(err))
+	}
+}
+
+// getDownloadContentLength makes a HEAD request for downloadURL and returns
+// the response Content-Length, or -1 when the length is unknown or the
+// request fails.
+func getDownloadContentLength(
+	ctx context.Context, httpClient *http.Client, downloadURL string) int64 {
+
+	request, err := http.NewRequest("HEAD", downloadURL, nil)
+	if err != nil {
+		return -1
+	}
+
+	request = request.WithContext(ctx)
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return -1
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return -1
+	}
+
+	return response.ContentLength
+}
+
+// verifyUpgradeDownloadSHA256 checks that the SHA-256 digest of the download
+// matches the expected, hex-encoded digest. The digest is computed over the
+// stored download, after the download is complete, so that a resumed download
+// is verified in its entirety, including the partial prefix downloaded
+// in previous attempts.
+func verifyUpgradeDownloadSHA256(reader io.Reader, expectedDigest string) error {
+
+	hash := sha256.New()
+	_, err := io.Copy(hash, reader)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	digest := hex.EncodeToString(hash.Sum(nil))
+
+	if digest != strings.ToLower(expectedDigest) {
+		return common.ContextError(
+			fmt.Errorf("unexpected SHA-256 digest: %s", digest))
+	}
+
+	return nil
+}
+
+// removeStaleUpgradeDownloadFiles deletes partial download files,
+// <upgradeDownloadFilename>.<version>.part, .part.manifest, and any legacy
+// .part.etag, for any version other than currentVersion. This reclaims disk
+// space when the available upgrade version changes before a download
+// completes.
+func removeStaleUpgradeDownloadFiles(
+	notices *noticeLogger, upgradeDownloadFilename, currentVersion string) {
+
+	directory, prefix := filepath.Split(upgradeDownloadFilename)
+	if directory == "" {
+		directory = "."
+	}
+	prefix += "."
+
+	fileInfos, err := ioutil.ReadDir(directory)
+	if err != nil {
+		notices.Alert("failed to read upgrade download directory: %s", common.ContextError(err))
+		return
+	}
+
+	for _, fileInfo := range fileInfos {
+
+		name := fileInfo.Name()
+		if fileInfo.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		var version string
+		for _, suffix := range []string{".part", ".part.manifest", ".part.etag"} {
+			if strings.HasSuffix(name, suffix) {
+				version = strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix)
+				break
+			}
+		}
+
+		if version == "" || version == currentVersion {
+			continue
+		}
+
+		err := os.Remove(filepath.Join(directory, name))
+		if err != nil {
+			notices.Alert("failed to remove stale upgrade download: %s", common.ContextError(err))
+		}
+	}
+}
+
+// statusRecordingTransport is an http.RoundTripper which records the status
+// code and Retry-After header of the most recent response.
+type statusRecordingTransport struct {
+	transport  http.RoundTripper
+	statusCode *int32
+	retryAfter *atomic.Value
+}
+
+func (t *statusRecordingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := t.transport.RoundTrip(request)
+	if err == nil {
+		atomic.StoreInt32(t.statusCode, int32(response.StatusCode))
+		if t.retryAfter != nil {
+			t.retryAfter.Store(response.Header.Get("Retry-After"))
+		}
+	}
+	return response, err
+}
+
+// endpointUnreachableRecordingTransport is an http.RoundTripper which
+// records the EndpointUnreachableError when a request fails because the
+// destination is unreachable from the tunnel's egress.
+type endpointUnreachableRecordingTransport struct {
+	transport   http.RoundTripper
+	unreachable *atomic.Value
+}
+
+func (t *endpointUnreachableRecordingTransport) RoundTrip(
+	request *http.Request) (*http.Response, error) {
+
+	response, err := t.transport.RoundTrip(request)
+	if unreachableErr, ok := err.(*EndpointUnreachableError); ok {
+		t.unreachable.Store(unreachableErr)
+	}
+	return response, err
+}
+
+// parseRetryAfter parses a Retry-After header value, in either the
+// delta-seconds or HTTP-date form, returning the delay from now. A date in
+// the past yields a zero delay.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		// Avoid overflow for very large values; the caller caps the delay.
+		if seconds > int64(math.MaxInt64/time.Second) {
+			seconds = int64(math.MaxInt64 / time.Second)
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+
+	delay := date.Sub(now)
+	if delay < 0 {
+		delay = 0
+	}
+	return delay, true
+}
+
+// renameFile is os.Rename, and is replaced in tests to simulate failures.
+var renameFile = os.Rename
+
+// renameUpgradeDownload moves the completed download to its final filename.
+// When the rename fails with EXDEV, as the files are on different
+// filesystems, the download is copied to a temporary file in the
+// destination directory, which is synced and then renamed to the final
+// filename; only then is the source removed. The final filename is never
+// observed with partial contents.
+func renameUpgradeDownload(
+	notices *noticeLogger, sourceFilename, destinationFilename string) error {
+
+	err := renameFile(sourceFilename, destinationFilename)
+	if err == nil {
+		return nil
+	}
+
+	linkErr, ok := err.(*os.LinkError)
+	if !ok || linkErr.Err != syscall.EXDEV {
+		return common.ContextError(err)
+	}
+
+	err = copyFileToDirectory(sourceFilename, destinationFilename)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	// Failure to remove the source is not fatal, as the completed download
+	// is in place.
+
+	err = os.Remove(sourceFilename)
+	if err != nil {
+		notices.Alert("failed to remove upgrade download source: %s", common.ContextError(err))
+	}
+
+	return nil
+}
+
+// copyFileToDirectory copies sourceFilename to a temporary file in the
+// destinationFilename directory, syncs it, and renames it to
+// destinationFilename. The temporary file is removed on failure.
+func copyFileToDirectory(sourceFilename, destinationFilename string) (err error) {
+
+	source, err := os.Open(sourceFilename)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	defer source.Close()
+
+	temp, err := ioutil.TempFile(
+		filepath.Dir(destinationFilename), filepath.Base(destinationFilename)+".tmp")
+	if err != nil {
+		return common.ContextError(err)
+	}
+	defer func() {
+		if err != nil {
+			temp.Close()
+			os.Remove(temp.Name())
+		}
+	}()
+
+	_, err = io.Copy(temp, source)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = temp.Sync()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = temp.Close()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	// The rename is within the destination directory, and so on the same
+	// filesystem.
+
+	err = renameFile(temp.Name(), destinationFilename)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+var errUpgradeDownloadTooLarge = errors.New("upgrade download exceeds maximum size")
+
+// maxBytesTransport is an http.RoundTripper which limits GET response bodies
+// so that no byte beyond maxBytes, in the downloaded entity, is read. The
+// entity offset of a 206 Partial Content body is taken from its
+// Content-Range, so the limit applies to resumed and chunked downloads. When
+// the limit is exceeded, the body read fails and exceeded is set.
+type maxBytesTransport struct {
+	transport http.RoundTripper
+	maxBytes  int64
+	exceeded  *int32
+}
+
+func (t *maxBytesTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := t.transport.RoundTrip(request)
+	if err != nil || request.Method != "GET" {
+		return response, err
+	}
+
+	var offset int64
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusPartialContent:
+		first, _, _, err := parseContentRange(response)
+		if err == nil {
+			offset = first
+		}
+	default:
+		return response, nil
+	}
+
+	response.Body = &maxBytesReader{
+		ReadCloser: response.Body,
+		remaining:  t.maxBytes - offset,
+		exceeded:   t.exceeded,
+	}
+
+	return response, nil
+}
+
+type maxBytesReader struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  *int32
+}
+
+func (reader *maxBytesReader) Read(p []byte) (int, error) {
+
+	// Read up to one byte more than remaining, to detect when the body
+	// exceeds the limit.
+
+	if reader.remaining < 0 {
+		atomic.StoreInt32(reader.exceeded, 1)
+		return 0, errUpgradeDownloadTooLarge
+	}
+	if int64(len(p)) > reader.remaining+1 {
+		p = p[:reader.remaining+1]
+	}
+
+	n, err := reader.ReadCloser.Read(p)
+	if int64(n) > reader.remaining {
+		n = int(reader.remaining)
+		reader.remaining = -1
+		atomic.StoreInt32(reader.exceeded, 1)
+		return n, errUpgradeDownloadTooLarge
+	}
+	reader.remaining -= int64(n)
+
+	return n, err
+}
+
+// validatorRecordingTransport is an http.RoundTripper which records the
+// validator of the most recent successful GET response.
+type validatorRecordingTransport struct {
+	transport http.RoundTripper
+	mutex     sync.Mutex
+	validator *upgradeDownloadValidator
+}
+
+func (t *validatorRecordingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := t.transport.RoundTrip(request)
+	if err == nil &&
+		request.Method == "GET" &&
+		(response.StatusCode == http.StatusOK ||
+			response.StatusCode == http.StatusPartialContent) {
+
+		validator := &upgradeDownloadValidator{
+			ETag:         response.Header.Get("ETag"),
+			LastModified: response.Header.Get("Last-Modified"),
+		}
+		if validator.ETag != "" || validator.LastModified != "" {
+			t.mutex.Lock()
+			t.validator = validator
+			t.mutex.Unlock()
+		}
+	}
+	return response, err
+}
+
+func (t *validatorRecordingTransport) getValidator() *upgradeDownloadValidator {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.validator
+}
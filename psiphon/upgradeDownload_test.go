@@ -0,0 +1,2287 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Inc/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+const testUpgradeClientVersionHeader = "x-amz-meta-psiphon-client-version"
+
+// makeUpgradeDownloadTestConfig returns a config which downloads upgrades
+// from serverURL into testDataDirName. modifyConfig values override the
+// default test config values.
+func makeUpgradeDownloadTestConfig(
+	t *testing.T,
+	testDataDirName string,
+	serverURL string,
+	modifyConfig map[string]interface{}) *Config {
+
+	configMap := map[string]interface{}{
+		"PropagationChannelId":               "0",
+		"SponsorId":                          "0",
+		"ClientVersion":                      "1",
+		"DataStoreDirectory":                 testDataDirName,
+		"UpgradeDownloadUrl":                 serverURL,
+		"UpgradeDownloadClientVersionHeader": testUpgradeClientVersionHeader,
+		"UpgradeDownloadFilename":            filepath.Join(testDataDirName, "upgrade"),
+	}
+	for key, value := range modifyConfig {
+		configMap[key] = value
+	}
+
+	configJSON, err := json.Marshal(configMap)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+
+	config, err := LoadConfig(configJSON)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	return config
+}
+
+// makeUpgradeTestServer returns a server which serves entity, with support
+// for Range and If-Match, and advertises the upgrade client version "2".
+func makeUpgradeTestServer(entity []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(testUpgradeClientVersionHeader, "2")
+			w.Header().Set("ETag", `"upgrade"`)
+			http.ServeContent(w, r, "", time.Now(), bytes.NewReader(entity))
+		}))
+}
+
+func TestUpgradeDownloadSHA256(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	entity := bytes.Repeat([]byte("upgrade"), 1000)
+	digest := sha256.Sum256(entity)
+
+	server := makeUpgradeTestServer(entity)
+	defer server.Close()
+
+	for _, testCase := range []struct {
+		description    string
+		expectedSHA256 string
+		expectSuccess  bool
+	}{
+		{"match", hex.EncodeToString(digest[:]), true},
+		{"mismatch", hex.EncodeToString(make([]byte, sha256.Size)), false},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+			if err != nil {
+				t.Fatalf("TempDir failed: %s", err)
+			}
+			defer os.RemoveAll(testDataDirName)
+
+			config := makeUpgradeDownloadTestConfig(
+				t, testDataDirName, server.URL,
+				map[string]interface{}{"UpgradeDownloadSHA256": testCase.expectedSHA256})
+
+			err = DownloadUpgrade(
+				context.Background(), config, 0, "2", nil, &DialConfig{})
+
+			_, statErr := os.Stat(config.UpgradeDownloadFilename)
+
+			if testCase.expectSuccess {
+				if err != nil {
+					t.Fatalf("DownloadUpgrade failed: %s", err)
+				}
+				if statErr != nil {
+					t.Fatalf("missing upgrade file: %s", statErr)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("DownloadUpgrade unexpectedly succeeded")
+				}
+				if !os.IsNotExist(statErr) {
+					t.Fatalf("unexpected upgrade file")
+				}
+
+				// The failed download must be discarded.
+				files, _ := filepath.Glob(config.UpgradeDownloadFilename + ".*")
+				if len(files) > 0 {
+					t.Fatalf("unexpected download files: %v", files)
+				}
+			}
+		})
+	}
+}
+
+func TestUpgradeDownloadRateLimitCanceled(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	entity := bytes.Repeat([]byte("upgrade"), 100000)
+
+	server := makeUpgradeTestServer(entity)
+	defer server.Close()
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config := makeUpgradeDownloadTestConfig(
+		t, testDataDirName, server.URL,
+		map[string]interface{}{"UpgradeDownloadBytesPerSecond": 1000})
+
+	// At the specified rate, the download would take several minutes. The
+	// throttled download must be interrupted promptly on cancel.
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+
+	startTime := time.Now()
+
+	err = DownloadUpgrade(ctx, config, 0, "2", nil, &DialConfig{})
+	if err == nil {
+		t.Fatalf("DownloadUpgrade unexpectedly succeeded")
+	}
+
+	if time.Since(startTime) > 2*time.Second {
+		t.Fatalf("DownloadUpgrade not interrupted promptly")
+	}
+
+	if _, err := os.Stat(config.UpgradeDownloadFilename); !os.IsNotExist(err) {
+		t.Fatalf("unexpected upgrade file")
+	}
+}
+
+func TestUpgradeDownloadCanceled(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	entity := bytes.Repeat([]byte("upgrade"), 1000)
+	trickleBytes := 100
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	// The server trickles the first bytes of the entity and then stalls
+	// until the client cancels, which it does once the trickled bytes are
+	// written to the partial download file.
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"upgrade"`)
+			w.Header().Set("Content-Length", strconv.Itoa(len(entity)))
+			w.WriteHeader(http.StatusOK)
+			if r.Method == "HEAD" {
+				return
+			}
+			w.Write(entity[:trickleBytes])
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}))
+	defer server.Close()
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config := makeUpgradeDownloadTestConfig(t, testDataDirName, server.URL, nil)
+
+	partialFilename := config.UpgradeDownloadFilename + ".2.part"
+
+	go func() {
+		for ctx.Err() == nil {
+			fileInfo, err := os.Stat(partialFilename)
+			if err == nil && fileInfo.Size() == int64(trickleBytes) {
+				cancelFunc()
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	err = DownloadUpgrade(ctx, config, 0, "2", nil, &DialConfig{})
+	if err == nil || !strings.HasSuffix(err.Error(), context.Canceled.Error()) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The partial download must be retained for resuming.
+
+	fileInfo, err := os.Stat(partialFilename)
+	if err != nil {
+		t.Fatalf("missing partial download: %s", err)
+	}
+
+	if fileInfo.Size() != int64(trickleBytes) {
+		t.Fatalf("unexpected partial download size: %d", fileInfo.Size())
+	}
+
+	manifest, err := loadPartialDownloadManifest(partialFilename + ".manifest")
+	if err != nil {
+		t.Fatalf("missing partial download manifest: %s", err)
+	}
+
+	if manifest.Offset != int64(trickleBytes) || manifest.Version != "2" {
+		t.Fatalf("unexpected partial download manifest: %+v", *manifest)
+	}
+}
+
+func TestUpgradeAlreadyDownloaded(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	downloadedNotices := make(chan map[string]interface{}, 2)
+
+	SetNoticeCallback(func(noticeType string, data map[string]interface{}) {
+		if noticeType == "ClientUpgradeDownloaded" {
+			downloadedNotices <- data
+		}
+	})
+	defer SetNoticeCallback(nil)
+
+	entity := bytes.Repeat([]byte("upgrade"), 1000)
+
+	server := makeUpgradeTestServer(entity)
+	defer server.Close()
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config := makeUpgradeDownloadTestConfig(t, testDataDirName, server.URL, nil)
+
+	// The first download fetches the upgrade and the second finds the
+	// existing upgrade file.
+
+	for _, expectAlreadyDownloaded := range []bool{false, true} {
+
+		err = DownloadUpgrade(context.Background(), config, 0, "2", nil, &DialConfig{})
+		if err != nil {
+			t.Fatalf("DownloadUpgrade failed: %s", err)
+		}
+
+		select {
+		case data := <-downloadedNotices:
+			if data["filename"] != config.UpgradeDownloadFilename {
+				t.Fatalf("unexpected filename: %v", data["filename"])
+			}
+			if data["alreadyDownloaded"] != expectAlreadyDownloaded {
+				t.Fatalf("unexpected alreadyDownloaded: %v", data["alreadyDownloaded"])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("missing ClientUpgradeDownloaded notice")
+		}
+	}
+}
+
+func TestRemoveStaleUpgradeDownloadFiles(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	upgradeDownloadFilename := filepath.Join(testDataDirName, "upgrade")
+
+	staleFilenames := []string{
+		upgradeDownloadFilename + ".1.part",
+		upgradeDownloadFilename + ".1.part.manifest",
+		upgradeDownloadFilename + ".1.part.etag",
+		upgradeDownloadFilename + ".3.part",
+	}
+
+	retainedFilenames := []string{
+		upgradeDownloadFilename + ".2.part",
+		upgradeDownloadFilename + ".2.part.manifest",
+		filepath.Join(testDataDirName, "other.1.part"),
+	}
+
+	for _, filename := range append(staleFilenames, retainedFilenames...) {
+		err := ioutil.WriteFile(filename, []byte("partial"), 0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+	}
+
+	removeStaleUpgradeDownloadFiles(nil, upgradeDownloadFilename, "2")
+
+	for _, filename := range staleFilenames {
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			t.Fatalf("stale file not removed: %s", filename)
+		}
+	}
+
+	for _, filename := range retainedFilenames {
+		if _, err := os.Stat(filename); err != nil {
+			t.Fatalf("file unexpectedly removed: %s", filename)
+		}
+	}
+}
+
+func TestUpgradeDownloadRetry(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	entity := bytes.Repeat([]byte("upgrade"), 1000)
+
+	for _, testCase := range []struct {
+		description   string
+		failStatus    int
+		failCount     int32
+		expectSuccess bool
+		expectCount   int32
+		expectBackoff []time.Duration
+	}{
+		{"transient failures", http.StatusServiceUnavailable, 2, true, 3,
+			[]time.Duration{time.Hour, 2 * time.Hour}},
+		{"too many failures", http.StatusServiceUnavailable, 10, false, 4,
+			[]time.Duration{time.Hour, 2 * time.Hour, 3 * time.Hour}},
+		{"not found", http.StatusNotFound, 10, false, 1,
+			nil},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			var requestCount int32
+
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					// Only download requests are counted, not the HEAD
+					// request made for the disk space check.
+					if r.Method != "HEAD" &&
+						atomic.AddInt32(&requestCount, 1) <= testCase.failCount {
+						w.WriteHeader(testCase.failStatus)
+						return
+					}
+					w.Header().Set("ETag", `"upgrade"`)
+					http.ServeContent(w, r, "", time.Now(), bytes.NewReader(entity))
+				}))
+			defer server.Close()
+
+			testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+			if err != nil {
+				t.Fatalf("TempDir failed: %s", err)
+			}
+			defer os.RemoveAll(testDataDirName)
+
+			config := makeUpgradeDownloadTestConfig(
+				t, testDataDirName, server.URL,
+				map[string]interface{}{
+					"UpgradeDownloadRetries":               3,
+					"UpgradeDownloadRetryBaseMilliseconds": 3600000,
+					"UpgradeDownloadRetryMaxMilliseconds":  3 * 3600000,
+				})
+
+			// The fake clock fires backoff timers immediately.
+			clock := newFakeClock(true)
+			config.clock = clock
+
+			err = DownloadUpgrade(
+				context.Background(), config, 0, "2", nil, &DialConfig{})
+
+			if testCase.expectSuccess && err != nil {
+				t.Fatalf("DownloadUpgrade failed: %s", err)
+			}
+			if !testCase.expectSuccess && err == nil {
+				t.Fatalf("DownloadUpgrade unexpectedly succeeded")
+			}
+
+			if atomic.LoadInt32(&requestCount) != testCase.expectCount {
+				t.Fatalf("unexpected request count: %d", requestCount)
+			}
+
+			if !reflect.DeepEqual(clock.Durations(), testCase.expectBackoff) {
+				t.Fatalf("unexpected backoff: %v", clock.Durations())
+			}
+		})
+	}
+}
+
+func TestUpgradeDownloadRetryAfter(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	entity := bytes.Repeat([]byte("upgrade"), 1000)
+
+	// The fake clock starts at the Unix epoch.
+	retryAfterDate := time.Unix(0, 0).Add(3 * time.Hour).UTC().Format(http.TimeFormat)
+
+	for _, testCase := range []struct {
+		description   string
+		failStatus    int
+		retryAfter    string
+		expectBackoff []time.Duration
+	}{
+		{"delta-seconds", http.StatusServiceUnavailable, "7200",
+			[]time.Duration{2 * time.Hour}},
+		{"HTTP-date", http.StatusServiceUnavailable, retryAfterDate,
+			[]time.Duration{3 * time.Hour}},
+		{"capped", http.StatusServiceUnavailable, "86400",
+			[]time.Duration{4 * time.Hour}},
+		{"shorter than backoff", http.StatusServiceUnavailable, "1",
+			[]time.Duration{time.Minute}},
+		{"invalid", http.StatusServiceUnavailable, "soon",
+			[]time.Duration{time.Minute}},
+		{"not throttled", http.StatusBadGateway, "7200",
+			[]time.Duration{time.Minute}},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			var requestCount int32
+
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					if r.Method != "HEAD" &&
+						atomic.AddInt32(&requestCount, 1) == 1 {
+						w.Header().Set("Retry-After", testCase.retryAfter)
+						w.WriteHeader(testCase.failStatus)
+						return
+					}
+					w.Header().Set("ETag", `"upgrade"`)
+					http.ServeContent(w, r, "", time.Now(), bytes.NewReader(entity))
+				}))
+			defer server.Close()
+
+			testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+			if err != nil {
+				t.Fatalf("TempDir failed: %s", err)
+			}
+			defer os.RemoveAll(testDataDirName)
+
+			config := makeUpgradeDownloadTestConfig(
+				t, testDataDirName, server.URL,
+				map[string]interface{}{
+					"UpgradeDownloadRetries":                   3,
+					"UpgradeDownloadRetryBaseMilliseconds":     60000,
+					"UpgradeDownloadRetryAfterMaxMilliseconds": 14400000,
+				})
+
+			clock := newFakeClock(true)
+			config.clock = clock
+
+			err = DownloadUpgrade(
+				context.Background(), config, 0, "2", nil, &DialConfig{})
+			if err != nil {
+				t.Fatalf("DownloadUpgrade failed: %s", err)
+			}
+
+			if !reflect.DeepEqual(clock.Durations(), testCase.expectBackoff) {
+				t.Fatalf("unexpected backoff: %v", clock.Durations())
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, testCase := range []struct {
+		value       string
+		expectOK    bool
+		expectDelay time.Duration
+	}{
+		{"120", true, 2 * time.Minute},
+		{" 0 ", true, 0},
+		{"Fri, 01 Jun 2018 12:05:00 GMT", true, 5 * time.Minute},
+		{"Friday, 01-Jun-18 12:05:00 GMT", true, 5 * time.Minute},
+		{"Fri Jun  1 12:05:00 2018", true, 5 * time.Minute},
+		{"Fri, 01 Jun 2018 11:00:00 GMT", true, 0},
+		{"", false, 0},
+		{"-1", false, 0},
+		{"1.5", false, 0},
+		{"tomorrow", false, 0},
+	} {
+		delay, ok := parseRetryAfter(testCase.value, now)
+		if ok != testCase.expectOK || delay != testCase.expectDelay {
+			t.Errorf("unexpected result for %q: %s, %v", testCase.value, delay, ok)
+		}
+	}
+}
+
+func TestUpgradeDownloadNotFound(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	for _, testCase := range []struct {
+		description      string
+		statusCode       int
+		handshakeVersion string
+		expectPartial    bool
+	}{
+		{"404 download", http.StatusNotFound, "2", true},
+		{"410 download", http.StatusGone, "2", false},
+		{"404 version check", http.StatusNotFound, "", true},
+		{"410 version check", http.StatusGone, "", true},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(testCase.statusCode)
+				}))
+			defer server.Close()
+
+			testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+			if err != nil {
+				t.Fatalf("TempDir failed: %s", err)
+			}
+			defer os.RemoveAll(testDataDirName)
+
+			config := makeUpgradeDownloadTestConfig(
+				t, testDataDirName, server.URL, nil)
+
+			// A partial download from a previous attempt.
+
+			partialFilename := config.UpgradeDownloadFilename + ".2.part"
+			err = ioutil.WriteFile(partialFilename, []byte("upgrade"), 0600)
+			if err != nil {
+				t.Fatalf("WriteFile failed: %s", err)
+			}
+
+			notFoundNotices := make(chan map[string]interface{}, 1)
+			SetNoticeCallback(func(noticeType string, data map[string]interface{}) {
+				if noticeType == "ClientUpgradeNotFound" {
+					notFoundNotices <- data
+				}
+			})
+			defer SetNoticeCallback(nil)
+
+			err = DownloadUpgrade(
+				context.Background(), config, 0, testCase.handshakeVersion, nil, &DialConfig{})
+			if err != ErrUpgradeNotFound {
+				t.Fatalf("unexpected DownloadUpgrade result: %v", err)
+			}
+
+			select {
+			case data := <-notFoundNotices:
+				if data["statusCode"].(int) != testCase.statusCode ||
+					data["availableVersion"].(string) != testCase.handshakeVersion {
+					t.Fatalf("unexpected ClientUpgradeNotFound notice: %+v", data)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("missing ClientUpgradeNotFound notice")
+			}
+
+			_, err = os.Stat(partialFilename)
+			if (err == nil) != testCase.expectPartial {
+				t.Fatalf("unexpected partial download state: %v", err)
+			}
+		})
+	}
+}
+
+// testUpgradeBuffer is an in-memory io.WriterAt and io.ReaderAt.
+type testUpgradeBuffer struct {
+	mutex sync.Mutex
+	data  []byte
+}
+
+func (buffer *testUpgradeBuffer) WriteAt(p []byte, off int64) (int, error) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	if end := int(off) + len(p); end > len(buffer.data) {
+		buffer.data = append(buffer.data, make([]byte, end-len(buffer.data))...)
+	}
+	copy(buffer.data[off:], p)
+	return len(p), nil
+}
+
+func (buffer *testUpgradeBuffer) ReadAt(p []byte, off int64) (int, error) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	if off >= int64(len(buffer.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, buffer.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestDownloadUpgradeToWriter(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	restartReasons := make(chan string, 10)
+
+	SetNoticeCallback(func(noticeType string, data map[string]interface{}) {
+		if noticeType == "ClientUpgradeDownloadRestart" {
+			restartReasons <- data["reason"].(string)
+		}
+	})
+	defer SetNoticeCallback(nil)
+
+	entity := bytes.Repeat([]byte("upgrade"), 1000)
+	digest := sha256.Sum256(entity)
+
+	var requestsMutex sync.Mutex
+	var requests []string
+
+	entityServer := makeUpgradeTestServer(entity)
+	defer entityServer.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" {
+				requestsMutex.Lock()
+				requests = append(requests,
+					fmt.Sprintf("%s %s", r.Header.Get("Range"), r.Header.Get("If-Match")))
+				requestsMutex.Unlock()
+			}
+			entityServer.Config.Handler.ServeHTTP(w, r)
+		}))
+	defer server.Close()
+
+	half := len(entity) / 2
+	chunkSize := 1024
+
+	for _, testCase := range []struct {
+		description           string
+		prefix                []byte
+		manifestETag          string
+		maxConcurrency        int
+		expectedRequests      []string
+		expectedRestartReason string
+		expectSuccess         bool
+	}{
+		{
+			"new download",
+			nil, "", 0,
+			[]string{"bytes=0- "},
+			"", true,
+		},
+		{
+			"resumed download",
+			entity[:half], `"upgrade"`, 0,
+			[]string{fmt.Sprintf("bytes=%d- \"upgrade\"", half)},
+			"", true,
+		},
+		{
+			"concurrent resumed download",
+			entity[:half], `"upgrade"`, 4,
+			[]string{fmt.Sprintf("bytes=%d-%d \"upgrade\"", half, half+chunkSize-1)},
+			"", true,
+		},
+		{
+			"partial download without manifest",
+			entity[:half], "", 0,
+			[]string{"bytes=0- "},
+			DOWNLOAD_RESTART_REASON_MISSING_ETAG, true,
+		},
+		{
+			"changed upgrade entity",
+			entity[:half], `"previous"`, 0,
+			[]string{fmt.Sprintf("bytes=%d- \"previous\"", half), "bytes=0- "},
+			DOWNLOAD_RESTART_REASON_ETAG_MISMATCH, true,
+		},
+		{
+			"completed download",
+			entity, `"upgrade"`, 0,
+			[]string{fmt.Sprintf("bytes=%d- \"upgrade\"", len(entity))},
+			"", true,
+		},
+		{
+			"partial download exceeds upgrade size",
+			append(append([]byte(nil), entity...), "extra"...), `"upgrade"`, 0,
+			[]string{fmt.Sprintf("bytes=%d- \"upgrade\"", len(entity)+5), "bytes=0- "},
+			DOWNLOAD_RESTART_REASON_INCONSISTENT_MANIFEST, true,
+		},
+		{
+			"corrupt partial download",
+			make([]byte, half), `"upgrade"`, 0,
+			[]string{fmt.Sprintf("bytes=%d- \"upgrade\"", half)},
+			"", false,
+		},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+			if err != nil {
+				t.Fatalf("TempDir failed: %s", err)
+			}
+			defer os.RemoveAll(testDataDirName)
+
+			// The tail of a resumed partial download isn't verified, so that
+			// each resumed request starts at the partial download offset.
+
+			config := makeUpgradeDownloadTestConfig(
+				t, testDataDirName, server.URL,
+				map[string]interface{}{
+					"UpgradeDownloadSHA256":            hex.EncodeToString(digest[:]),
+					"UpgradeDownloadResumeVerifyBytes": 0,
+				})
+
+			config.UpgradeDownloadMaxConcurrency = testCase.maxConcurrency
+			err = config.SetClientParameters("", false, map[string]interface{}{
+				"UpgradeDownloadChunkSize": chunkSize,
+			})
+			if err != nil {
+				t.Fatalf("SetClientParameters failed: %s", err)
+			}
+
+			buffer := &testUpgradeBuffer{}
+			buffer.WriteAt(testCase.prefix, 0)
+
+			store := config.getKeyValueStore()
+
+			if testCase.manifestETag != "" {
+				value, _ := json.Marshal(&partialDownloadManifest{
+					ETag:          testCase.manifestETag,
+					ContentLength: -1,
+					Offset:        int64(len(testCase.prefix)),
+					Version:       "2",
+				})
+				err = store.Set(upgradeDownloadWriterManifestKey, value)
+				if err != nil {
+					t.Fatalf("Set failed: %s", err)
+				}
+			}
+
+			downloadedOffset := func(version string) (int64, error) {
+				if version != "2" {
+					return 0, fmt.Errorf("unexpected version: %s", version)
+				}
+				return int64(len(testCase.prefix)), nil
+			}
+
+			requestsMutex.Lock()
+			requests = nil
+			requestsMutex.Unlock()
+
+			err = DownloadUpgradeToWriter(
+				context.Background(), config, 0, "2", nil, &DialConfig{},
+				buffer, downloadedOffset)
+
+			// With concurrency, the first request, for the first chunk, is
+			// made alone.
+
+			requestsMutex.Lock()
+			madeRequests := requests
+			requestsMutex.Unlock()
+			if len(madeRequests) < len(testCase.expectedRequests) ||
+				!reflect.DeepEqual(
+					madeRequests[:len(testCase.expectedRequests)], testCase.expectedRequests) ||
+				(testCase.maxConcurrency == 0 &&
+					len(madeRequests) != len(testCase.expectedRequests)) {
+				t.Fatalf("unexpected requests: %v", madeRequests)
+			}
+
+			if testCase.expectedRestartReason != "" {
+				select {
+				case reason := <-restartReasons:
+					if reason != testCase.expectedRestartReason {
+						t.Fatalf("unexpected restart reason: %s", reason)
+					}
+				case <-time.After(1 * time.Second):
+					t.Fatalf("missing restart notice")
+				}
+			}
+
+			value, _ := store.Get(upgradeDownloadWriterManifestKey)
+
+			if !testCase.expectSuccess {
+				if err == nil {
+					t.Fatalf("DownloadUpgradeToWriter unexpectedly succeeded")
+				}
+
+				// The next download starts over.
+
+				if value != nil {
+					t.Fatalf("unexpected partial download manifest")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("DownloadUpgradeToWriter failed: %s", err)
+			}
+
+			// Bytes past the upgrade size, written by a previous download,
+			// aren't truncated.
+
+			if len(buffer.data) < len(entity) || !bytes.Equal(buffer.data[:len(entity)], entity) {
+				t.Fatalf("unexpected upgrade data")
+			}
+
+			// The manifest is retained, so that a repeated download of the
+			// completed upgrade is validated rather than downloaded again.
+
+			var manifest partialDownloadManifest
+			if value == nil ||
+				json.Unmarshal(value, &manifest) != nil ||
+				manifest.ETag != `"upgrade"` ||
+				manifest.Version != "2" {
+				t.Fatalf("unexpected partial download manifest: %s", value)
+			}
+
+			// The file destination is not used.
+
+			files, _ := filepath.Glob(config.UpgradeDownloadFilename + "*")
+			if len(files) > 0 {
+				t.Fatalf("unexpected download files: %v", files)
+			}
+
+			select {
+			case reason := <-restartReasons:
+				t.Fatalf("unexpected restart: %s", reason)
+			default:
+			}
+		})
+	}
+}
+
+func TestUpgradeDownloadInsufficientDiskSpace(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	if _, err := getAvailableDiskSpace("."); err == errDiskSpaceUnsupported {
+		t.Skipf("disk space query not supported")
+	}
+
+	entity := bytes.Repeat([]byte("upgrade"), 1000)
+
+	server := makeUpgradeTestServer(entity)
+	defer server.Close()
+
+	for _, testCase := range []struct {
+		description   string
+		margin        int
+		expectSuccess bool
+	}{
+		{"sufficient", 0, true},
+		{"insufficient", 1 << 62, false},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+			if err != nil {
+				t.Fatalf("TempDir failed: %s", err)
+			}
+			defer os.RemoveAll(testDataDirName)
+
+			config := makeUpgradeDownloadTestConfig(
+				t, testDataDirName, server.URL,
+				map[string]interface{}{"UpgradeDownloadDiskSpaceMarginBytes": testCase.margin})
+
+			err = DownloadUpgrade(
+				context.Background(), config, 0, "2", nil, &DialConfig{})
+
+			if testCase.expectSuccess {
+				if err != nil {
+					t.Fatalf("DownloadUpgrade failed: %s", err)
+				}
+				return
+			}
+
+			if err != ErrInsufficientDiskSpace {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// No partial download is started.
+			files, _ := filepath.Glob(config.UpgradeDownloadFilename + "*")
+			if len(files) > 0 {
+				t.Fatalf("unexpected download files: %v", files)
+			}
+		})
+	}
+}
+
+func TestUpgradeDownloadCompressed(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	entity := bytes.Repeat([]byte("upgrade"), 1000)
+	digest := sha256.Sum256(entity)
+
+	var gzipEntity bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipEntity)
+	gzipWriter.Write(entity)
+	gzipWriter.Close()
+
+	var deflateEntity bytes.Buffer
+	zlibWriter := zlib.NewWriter(&deflateEntity)
+	zlibWriter.Write(entity)
+	zlibWriter.Close()
+
+	for _, testCase := range []struct {
+		description string
+		encoding    string
+		encoded     []byte
+		resume      bool
+	}{
+		{"gzip", "gzip", gzipEntity.Bytes(), false},
+		{"deflate", "deflate", deflateEntity.Bytes(), false},
+		{"resumed gzip", "gzip", gzipEntity.Bytes(), true},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			// The server applies Range requests to the encoded entity.
+
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set(testUpgradeClientVersionHeader, "2")
+					w.Header().Set("ETag", `"upgrade"`)
+					w.Header().Set("Content-Encoding", testCase.encoding)
+					http.ServeContent(
+						w, r, "", time.Now(), bytes.NewReader(testCase.encoded))
+				}))
+			defer server.Close()
+
+			testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+			if err != nil {
+				t.Fatalf("TempDir failed: %s", err)
+			}
+			defer os.RemoveAll(testDataDirName)
+
+			config := makeUpgradeDownloadTestConfig(
+				t, testDataDirName, server.URL,
+				map[string]interface{}{"UpgradeDownloadSHA256": hex.EncodeToString(digest[:])})
+
+			if testCase.resume {
+
+				// A partial download of decoded bytes, which must not be
+				// resumed with a range of encoded bytes.
+
+				partialFilename := config.UpgradeDownloadFilename + ".2.part"
+				err = ioutil.WriteFile(partialFilename, entity[:len(entity)/2], 0600)
+				if err == nil {
+					manifest := &partialDownloadManifest{
+						ETag:          `"upgrade"`,
+						ContentLength: -1,
+						Offset:        int64(len(entity) / 2),
+						Version:       "2",
+					}
+					err = manifest.store(partialFilename + ".manifest")
+				}
+				if err != nil {
+					t.Fatalf("WriteFile failed: %s", err)
+				}
+			}
+
+			err = DownloadUpgrade(
+				context.Background(), config, 0, "2", nil, &DialConfig{})
+			if err != nil {
+				t.Fatalf("DownloadUpgrade failed: %s", err)
+			}
+
+			data, err := ioutil.ReadFile(config.UpgradeDownloadFilename)
+			if err != nil {
+				t.Fatalf("ReadFile failed: %s", err)
+			}
+
+			if !bytes.Equal(data, entity) {
+				t.Fatalf("unexpected upgrade data")
+			}
+		})
+	}
+}
+
+func TestUpgradeDownloadConditionalRequest(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	entity := bytes.Repeat([]byte("upgrade"), 1000)
+
+	var etag atomic.Value
+	etag.Store(`"upgrade-1"`)
+	var getCount int32
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" {
+				atomic.AddInt32(&getCount, 1)
+			}
+			w.Header().Set(testUpgradeClientVersionHeader, "2")
+			w.Header().Set("ETag", etag.Load().(string))
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(entity))
+		}))
+	defer server.Close()
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config := makeUpgradeDownloadTestConfig(
+		t, testDataDirName, server.URL,
+		map[string]interface{}{"UpgradeDownloadConditionalRequest": true})
+
+	// A config with a different upgrade download filename has a distinct
+	// validator.
+
+	otherConfig := makeUpgradeDownloadTestConfig(
+		t, testDataDirName, server.URL,
+		map[string]interface{}{
+			"UpgradeDownloadConditionalRequest": true,
+			"UpgradeDownloadFilename":           filepath.Join(testDataDirName, "other-upgrade"),
+		})
+
+	legacyValidatorFilename := config.UpgradeDownloadFilename + ".validator"
+
+	for _, testCase := range []struct {
+		description      string
+		config           *Config
+		etag             string
+		clearValidator   bool
+		legacyValidator  bool
+		expectedGetCount int32
+	}{
+		{"initial download", config, `"upgrade-1"`, false, false, 1},
+		{"not modified", config, `"upgrade-1"`, false, false, 1},
+		{"not modified with legacy validator", config, `"upgrade-1"`, false, true, 1},
+		{"modified", config, `"upgrade-2"`, false, false, 2},
+		{"other filename", otherConfig, `"upgrade-2"`, false, false, 3},
+		{"cleared", config, `"upgrade-2"`, true, false, 4},
+	} {
+
+		etag.Store(testCase.etag)
+
+		// The outer client consumes the completed upgrade file.
+
+		os.Remove(testCase.config.UpgradeDownloadFilename)
+
+		if testCase.legacyValidator {
+			err := ioutil.WriteFile(legacyValidatorFilename, []byte("{}"), 0600)
+			if err != nil {
+				t.Fatalf("WriteFile failed: %s", err)
+			}
+		}
+
+		if testCase.clearValidator {
+			err := ClearUpgradeDownloadValidator(testCase.config)
+			if err != nil {
+				t.Fatalf("ClearUpgradeDownloadValidator failed: %s", err)
+			}
+		}
+
+		err = DownloadUpgrade(context.Background(), testCase.config, 0, "2", nil, &DialConfig{})
+		if err != nil {
+			t.Fatalf("%s: DownloadUpgrade failed: %s", testCase.description, err)
+		}
+
+		if _, err := os.Stat(legacyValidatorFilename); !os.IsNotExist(err) {
+			t.Fatalf("%s: legacy validator not removed", testCase.description)
+		}
+
+		if atomic.LoadInt32(&getCount) != testCase.expectedGetCount {
+			t.Fatalf("%s: unexpected GET count: %d",
+				testCase.description, atomic.LoadInt32(&getCount))
+		}
+
+		value, err := testCase.config.getKeyValueStore().Get(
+			makeUpgradeDownloadValidatorKey(testCase.config.UpgradeDownloadFilename))
+		if err != nil || value == nil {
+			t.Fatalf("%s: Get failed: %v", testCase.description, err)
+		}
+		var validator upgradeDownloadValidator
+		err = json.Unmarshal(value, &validator)
+		if err != nil {
+			t.Fatalf("%s: Unmarshal failed: %s", testCase.description, err)
+		}
+		if validator.ETag != testCase.etag {
+			t.Fatalf("%s: unexpected validator: %s", testCase.description, value)
+		}
+	}
+}
+
+func TestUpgradeCheckDelay(t *testing.T) {
+
+	period := 6 * time.Hour
+	jitter := 0.1
+	minDelay := period - time.Duration(float64(period)*jitter)
+	maxDelay := period + time.Duration(float64(period)*jitter)
+
+	delays := make(map[time.Duration]bool)
+
+	for i := 0; i < 100; i++ {
+
+		seed := []byte(strconv.Itoa(i))
+
+		delay := upgradeCheckDelay(period, jitter, seed)
+
+		if delay < minDelay || delay > maxDelay {
+			t.Fatalf("delay out of range: %s", delay)
+		}
+
+		// The delay is stable for a given seed.
+
+		if upgradeCheckDelay(period, jitter, seed) != delay {
+			t.Fatalf("unstable delay for seed %d", i)
+		}
+
+		delays[delay] = true
+	}
+
+	// Different seeds are spread across the window.
+
+	if len(delays) < 90 {
+		t.Fatalf("insufficient delay spread: %d", len(delays))
+	}
+
+	if upgradeCheckDelay(period, 0, []byte("seed")) != period {
+		t.Fatalf("unexpected delay with no jitter")
+	}
+}
+
+func TestUpgradeDownloadRangeNotSupported(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	restartNotices := make(chan struct{}, 10)
+
+	SetNoticeCallback(func(noticeType string, data map[string]interface{}) {
+		if noticeType == "Info" &&
+			strings.Contains(data["message"].(string), "ignored range request") {
+			restartNotices <- *new(struct{})
+		}
+	})
+	defer SetNoticeCallback(nil)
+
+	entity := bytes.Repeat([]byte("upgrade"), 1000)
+
+	// The server ignores Range headers and always responds with 200 and the
+	// entire entity.
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(testUpgradeClientVersionHeader, "2")
+			w.Header().Set("ETag", `"upgrade"`)
+			w.Header().Set("Content-Length", strconv.Itoa(len(entity)))
+			w.WriteHeader(http.StatusOK)
+			if r.Method == "HEAD" {
+				return
+			}
+			w.Write(entity)
+		}))
+	defer server.Close()
+
+	for _, maxConcurrency := range []int{1, 4} {
+
+		t.Run(fmt.Sprintf("concurrency %d", maxConcurrency), func(t *testing.T) {
+
+			testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+			if err != nil {
+				t.Fatalf("TempDir failed: %s", err)
+			}
+			defer os.RemoveAll(testDataDirName)
+
+			config := makeUpgradeDownloadTestConfig(
+				t, testDataDirName, server.URL,
+				map[string]interface{}{"UpgradeDownloadMaxConcurrency": maxConcurrency})
+
+			// Simulate a partial download from a previous attempt, which
+			// must be discarded rather than appended to.
+
+			partialFilename := config.UpgradeDownloadFilename + ".2.part"
+
+			err = ioutil.WriteFile(partialFilename, []byte("partial"), 0600)
+			if err != nil {
+				t.Fatalf("WriteFile failed: %s", err)
+			}
+			manifest := &partialDownloadManifest{
+				ETag:          `"upgrade"`,
+				ContentLength: int64(len(entity)),
+				Offset:        int64(len("partial")),
+				Version:       "2",
+			}
+			err = manifest.store(partialFilename + ".manifest")
+			if err != nil {
+				t.Fatalf("store failed: %s", err)
+			}
+
+			err = DownloadUpgrade(context.Background(), config, 0, "2", nil, &DialConfig{})
+			if err != nil {
+				t.Fatalf("DownloadUpgrade failed: %s", err)
+			}
+
+			downloaded, err := ioutil.ReadFile(config.UpgradeDownloadFilename)
+			if err != nil {
+				t.Fatalf("ReadFile failed: %s", err)
+			}
+			if !bytes.Equal(downloaded, entity) {
+				t.Fatalf("unexpected upgrade download content")
+			}
+
+			select {
+			case <-restartNotices:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("missing restart notice")
+			}
+		})
+	}
+}
+
+func TestUpgradeDownloadResumeVerify(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	restartReasons := make(chan string, 10)
+	rewinds := make(chan int64, 10)
+
+	SetNoticeCallback(func(noticeType string, data map[string]interface{}) {
+		if noticeType == "ClientUpgradeDownloadRestart" {
+			restartReasons <- data["reason"].(string)
+		}
+		if noticeType == "ClientUpgradeDownloadRewind" {
+			rewinds <- data["rewindBytes"].(int64)
+		}
+	})
+	defer SetNoticeCallback(nil)
+
+	entity := make([]byte, 65536)
+	for i := range entity {
+		entity[i] = byte(i * 7)
+	}
+
+	partialSize := 30000
+	verifyBytes := 4096
+	chunkSize := 8192
+
+	var rangesMutex sync.Mutex
+	var ranges []string
+
+	entityServer := makeUpgradeTestServer(entity)
+	defer entityServer.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" {
+				rangesMutex.Lock()
+				ranges = append(ranges, r.Header.Get("Range"))
+				rangesMutex.Unlock()
+			}
+			entityServer.Config.Handler.ServeHTTP(w, r)
+		}))
+	defer server.Close()
+
+	for _, testCase := range []struct {
+		description       string
+		corruptBytes      int
+		verifyBytes       int
+		maxConcurrency    int
+		expectedRange     string
+		expectMismatch    bool
+		expectCorruptFile bool
+	}{
+		{"intact tail", 0, verifyBytes, 0, fmt.Sprintf("bytes=%d-", partialSize-verifyBytes), false, false},
+		{"corrupt tail", 100, verifyBytes, 0, fmt.Sprintf("bytes=%d-", partialSize-verifyBytes), true, false},
+		{"corrupt tail without verify", 100, 0, 0, fmt.Sprintf("bytes=%d-", partialSize), false, true},
+		{"concurrent intact tail", 0, verifyBytes, 4, fmt.Sprintf("bytes=%d-%d", partialSize-verifyBytes, partialSize+chunkSize-1), false, false},
+		{"concurrent corrupt tail", 100, verifyBytes, 4, fmt.Sprintf("bytes=%d-%d", partialSize-verifyBytes, partialSize+chunkSize-1), true, false},
+		{"concurrent corrupt tail without verify", 100, 0, 4, fmt.Sprintf("bytes=%d-%d", partialSize, partialSize+chunkSize-1), false, true},
+	} {
+
+		t.Run(testCase.description, func(t *testing.T) {
+
+			testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+			if err != nil {
+				t.Fatalf("TempDir failed: %s", err)
+			}
+			defer os.RemoveAll(testDataDirName)
+
+			config := makeUpgradeDownloadTestConfig(
+				t, testDataDirName, server.URL,
+				map[string]interface{}{"UpgradeDownloadResumeVerifyBytes": testCase.verifyBytes})
+
+			config.UpgradeDownloadMaxConcurrency = testCase.maxConcurrency
+			err = config.SetClientParameters("", false, map[string]interface{}{
+				"UpgradeDownloadChunkSize": chunkSize,
+			})
+			if err != nil {
+				t.Fatalf("SetClientParameters failed: %s", err)
+			}
+
+			// Simulate a partial download with a tail torn by a crash
+			// mid-write.
+
+			partial := append([]byte(nil), entity[:partialSize]...)
+			for i := partialSize - testCase.corruptBytes; i < partialSize; i++ {
+				partial[i] ^= 0xff
+			}
+
+			partialFilename := config.UpgradeDownloadFilename + ".2.part"
+
+			err = ioutil.WriteFile(partialFilename, partial, 0600)
+			if err != nil {
+				t.Fatalf("WriteFile failed: %s", err)
+			}
+			manifest := &partialDownloadManifest{
+				ETag:          `"upgrade"`,
+				ContentLength: int64(len(entity)),
+				Offset:        int64(partialSize),
+				Version:       "2",
+			}
+			err = manifest.store(partialFilename + ".manifest")
+			if err != nil {
+				t.Fatalf("store failed: %s", err)
+			}
+
+			rangesMutex.Lock()
+			ranges = nil
+			rangesMutex.Unlock()
+
+			err = DownloadUpgrade(context.Background(), config, 0, "2", nil, &DialConfig{})
+			if err != nil {
+				t.Fatalf("DownloadUpgrade failed: %s", err)
+			}
+
+			// With concurrency, the first request, for the first chunk, is
+			// made alone.
+
+			rangesMutex.Lock()
+			requestedRanges := ranges
+			rangesMutex.Unlock()
+			if len(requestedRanges) < 1 || requestedRanges[0] != testCase.expectedRange ||
+				(testCase.maxConcurrency == 0 && len(requestedRanges) != 1) {
+				t.Fatalf("unexpected ranges: %v", requestedRanges)
+			}
+
+			downloaded, err := ioutil.ReadFile(config.UpgradeDownloadFilename)
+			if err != nil {
+				t.Fatalf("ReadFile failed: %s", err)
+			}
+			if bytes.Equal(downloaded, entity) == testCase.expectCorruptFile {
+				t.Fatalf("unexpected upgrade download content")
+			}
+
+			// A rewind isn't a restart.
+
+			select {
+			case rewindBytes := <-rewinds:
+				if !testCase.expectMismatch || rewindBytes != int64(testCase.corruptBytes) {
+					t.Fatalf("unexpected rewind: %d", rewindBytes)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if testCase.expectMismatch {
+					t.Fatalf("missing rewind notice")
+				}
+			}
+
+			select {
+			case reason := <-restartReasons:
+				t.Fatalf("unexpected restart: %s", reason)
+			default:
+			}
+		})
+	}
+}
+
+func TestUpgradeDownloadHeaders(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	entity := bytes.Repeat([]byte("upgrade"), 1000)
+
+	requestHeaders := make(chan http.Header, 10)
+
+	upgradeServer := makeUpgradeTestServer(entity)
+	defer upgradeServer.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" {
+				requestHeaders <- r.Header
+			}
+			upgradeServer.Config.Handler.ServeHTTP(w, r)
+		}))
+	defer server.Close()
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config := makeUpgradeDownloadTestConfig(
+		t, testDataDirName, server.URL,
+		map[string]interface{}{
+			"UpgradeDownloadHeaders": map[string][]string{
+				"Authorization":  {"Bearer token"},
+				"X-Bypass-Token": {"bypass"},
+			},
+		})
+
+	// Resume a partial download, so that the request includes a Range
+	// header.
+
+	partialFilename := config.UpgradeDownloadFilename + ".2.part"
+
+	err = ioutil.WriteFile(partialFilename, entity[:100], 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	manifest := &partialDownloadManifest{
+		ETag:          `"upgrade"`,
+		ContentLength: int64(len(entity)),
+		Offset:        100,
+		Version:       "2",
+	}
+	err = manifest.store(partialFilename + ".manifest")
+	if err != nil {
+		t.Fatalf("store failed: %s", err)
+	}
+
+	err = DownloadUpgrade(context.Background(), config, 0, "2", nil, &DialConfig{})
+	if err != nil {
+		t.Fatalf("DownloadUpgrade failed: %s", err)
+	}
+
+	downloaded, err := ioutil.ReadFile(config.UpgradeDownloadFilename)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+	if !bytes.Equal(downloaded, entity) {
+		t.Fatalf("unexpected upgrade download content")
+	}
+
+	// The default resume verification overlap covers the entire partial
+	// download.
+
+	header := <-requestHeaders
+	if header.Get("Authorization") != "Bearer token" ||
+		header.Get("X-Bypass-Token") != "bypass" ||
+		header.Get("Range") != "bytes=0-" {
+		t.Fatalf("unexpected request headers: %+v", header)
+	}
+
+	// Headers which would clobber the Range header are rejected.
+
+	for _, headers := range []map[string][]string{
+		{"Range": {"bytes=0-"}},
+		{"range": {"bytes=0-"}},
+		{"Invalid Name": {"value"}},
+		{"X-Header": {"invalid\nvalue"}},
+	} {
+		configJSON, _ := json.Marshal(map[string]interface{}{
+			"PropagationChannelId":   "0",
+			"SponsorId":              "0",
+			"UpgradeDownloadHeaders": headers,
+		})
+		_, err := LoadConfig(configJSON)
+		if err == nil {
+			t.Fatalf("unexpected LoadConfig success: %+v", headers)
+		}
+	}
+}
+
+func TestUpgradeDownloadEndpointUnreachable(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	alerts := make(chan string, 10)
+	SetNoticeCallback(func(noticeType string, data map[string]interface{}) {
+		if noticeType == "Alert" {
+			alerts <- data["message"].(string)
+		}
+	})
+	defer SetNoticeCallback(nil)
+
+	// The tunnel works, but its egress refuses connections to the upgrade
+	// download server.
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	serverEntry := makeTestSSHServerEntry(
+		t, listener, runTestSSHServerWithRejection(t, listener, nil, ssh.ConnectionFailed))
+	serverEntry.Region = "DE"
+
+	tunnel, err := ConnectTunnel(
+		context.Background(), makeTestConnectTunnelConfig(t, 30), "0", serverEntry,
+		protocol.TUNNEL_PROTOCOL_SSH, monotime.Now())
+	if err != nil {
+		t.Fatalf("ConnectTunnel failed: %s", err)
+	}
+	defer tunnel.Close(true)
+
+	var requestCount int32
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requestCount, 1)
+		}))
+	defer server.Close()
+
+	config := makeUpgradeDownloadTestConfig(
+		t, testDataDirName, server.URL,
+		map[string]interface{}{"UpgradeDownloadRetryBaseMilliseconds": 1})
+
+	err = DownloadUpgrade(context.Background(), config, 0, "2", tunnel, &DialConfig{})
+
+	unreachableErr, ok := err.(*EndpointUnreachableError)
+	if !ok {
+		t.Fatalf("unexpected DownloadUpgrade result: %v", err)
+	}
+	if unreachableErr.EgressRegion != "DE" {
+		t.Fatalf("unexpected egress region: %s", unreachableErr.EgressRegion)
+	}
+
+	select {
+	case message := <-alerts:
+		if !strings.Contains(message, "upgrade endpoint unreachable via this egress") {
+			t.Fatalf("unexpected alert: %s", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("missing alert")
+	}
+
+	if atomic.LoadInt32(&requestCount) != 0 {
+		t.Fatalf("unexpected request")
+	}
+}
+
+func TestDownloadUpgradeAvailable(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	entity := bytes.Repeat([]byte("upgrade"), 1000)
+
+	server := makeUpgradeTestServer(entity)
+	defer server.Close()
+
+	for _, testCase := range []struct {
+		description      string
+		clientVersion    string
+		handshakeVersion string
+		expectAvailable  bool
+	}{
+		{"newer version", "1", "", true},
+		{"latest version", "2", "", false},
+		{"handshake version", "1", "2", true},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+			if err != nil {
+				t.Fatalf("TempDir failed: %s", err)
+			}
+			defer os.RemoveAll(testDataDirName)
+
+			config := makeUpgradeDownloadTestConfig(
+				t, testDataDirName, server.URL,
+				map[string]interface{}{"ClientVersion": testCase.clientVersion})
+
+			availability, err := DownloadUpgradeAvailable(
+				context.Background(), config, 0, testCase.handshakeVersion, nil, &DialConfig{})
+			if err != nil {
+				t.Fatalf("DownloadUpgradeAvailable failed: %s", err)
+			}
+
+			if availability.Available != testCase.expectAvailable ||
+				availability.Version != "2" ||
+				availability.SizeBytes != int64(len(entity)) ||
+				availability.ETag != `"upgrade"` {
+				t.Fatalf("unexpected availability: %+v", availability)
+			}
+
+			// Nothing is downloaded.
+
+			fileInfos, err := ioutil.ReadDir(testDataDirName)
+			if err != nil {
+				t.Fatalf("ReadDir failed: %s", err)
+			}
+			if len(fileInfos) != 0 {
+				t.Fatalf("unexpected files: %d", len(fileInfos))
+			}
+		})
+	}
+}
+
+func TestUpgradeDownloadMaxBytes(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	entity := bytes.Repeat([]byte("upgrade"), 1000)
+
+	// The server doesn't advertise the download size and streams data
+	// without end.
+
+	var getCount int32
+
+	streamingServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(testUpgradeClientVersionHeader, "2")
+			w.WriteHeader(http.StatusOK)
+			if r.Method == "HEAD" {
+				return
+			}
+			atomic.AddInt32(&getCount, 1)
+			for i := 0; i < 1000; i++ {
+				_, err := w.Write(entity)
+				if err != nil {
+					return
+				}
+			}
+		}))
+	defer streamingServer.Close()
+
+	server := makeUpgradeTestServer(entity)
+	defer server.Close()
+
+	for _, testCase := range []struct {
+		description   string
+		serverURL     string
+		expectSuccess bool
+	}{
+		{"within limit", server.URL, true},
+		{"streams past limit", streamingServer.URL, false},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+			if err != nil {
+				t.Fatalf("TempDir failed: %s", err)
+			}
+			defer os.RemoveAll(testDataDirName)
+
+			config := makeUpgradeDownloadTestConfig(
+				t, testDataDirName, testCase.serverURL,
+				map[string]interface{}{
+					"UpgradeDownloadMaxBytes":              2 * len(entity),
+					"UpgradeDownloadRetryBaseMilliseconds": 1,
+				})
+
+			err = DownloadUpgrade(context.Background(), config, 0, "2", nil, &DialConfig{})
+
+			if testCase.expectSuccess {
+				if err != nil {
+					t.Fatalf("DownloadUpgrade failed: %s", err)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("DownloadUpgrade unexpectedly succeeded")
+			}
+
+			// The oversized download is not retried and the partial
+			// download is deleted.
+
+			if atomic.LoadInt32(&getCount) != 1 {
+				t.Fatalf("unexpected GET count: %d", getCount)
+			}
+
+			files, _ := filepath.Glob(config.UpgradeDownloadFilename + "*")
+			if len(files) > 0 {
+				t.Fatalf("unexpected download files: %v", files)
+			}
+		})
+	}
+}
+
+func TestUpgradeDownloadCrossDeviceRename(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	entity := bytes.Repeat([]byte("upgrade"), 1000)
+
+	server := makeUpgradeTestServer(entity)
+	defer server.Close()
+
+	for _, testCase := range []struct {
+		description   string
+		failTempFile  bool
+		expectSuccess bool
+	}{
+		{"copy fallback", false, true},
+		{"copy fallback fails", true, false},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+			if err != nil {
+				t.Fatalf("TempDir failed: %s", err)
+			}
+			defer os.RemoveAll(testDataDirName)
+
+			config := makeUpgradeDownloadTestConfig(
+				t, testDataDirName, server.URL, nil)
+
+			downloadFilename := config.UpgradeDownloadFilename + ".2"
+
+			// Simulate the download and destination being on different
+			// filesystems: the direct rename fails with EXDEV.
+
+			renameFile = func(oldpath, newpath string) error {
+				if oldpath == downloadFilename ||
+					(testCase.failTempFile && strings.Contains(oldpath, ".tmp")) {
+					return &os.LinkError{
+						Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+				}
+				return os.Rename(oldpath, newpath)
+			}
+			defer func() { renameFile = os.Rename }()
+
+			err = DownloadUpgrade(context.Background(), config, 0, "2", nil, &DialConfig{})
+
+			if !testCase.expectSuccess {
+				if err == nil {
+					t.Fatalf("DownloadUpgrade unexpectedly succeeded")
+				}
+
+				// The temporary copy is cleaned up and the completed
+				// download is retained.
+
+				files, _ := filepath.Glob(config.UpgradeDownloadFilename + "*")
+				if len(files) != 1 || files[0] != downloadFilename {
+					t.Fatalf("unexpected download files: %v", files)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("DownloadUpgrade failed: %s", err)
+			}
+
+			downloaded, err := ioutil.ReadFile(config.UpgradeDownloadFilename)
+			if err != nil {
+				t.Fatalf("ReadFile failed: %s", err)
+			}
+			if !bytes.Equal(downloaded, entity) {
+				t.Fatalf("unexpected upgrade download content")
+			}
+
+			files, _ := filepath.Glob(config.UpgradeDownloadFilename + "*")
+			if len(files) != 1 {
+				t.Fatalf("unexpected download files: %v", files)
+			}
+		})
+	}
+}
+
+func TestUpgradeDownloadMirrorFailover(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	mirrors := make(chan string, 16)
+	SetNoticeCallback(func(noticeType string, data map[string]interface{}) {
+		if noticeType == "ClientUpgradeDownloadMirror" {
+			mirrors <- fmt.Sprintf("%d %s", data["mirror"].(int), data["url"].(string))
+		}
+	})
+	defer SetNoticeCallback(nil)
+
+	entity := bytes.Repeat([]byte("upgrade"), 1000)
+
+	server := makeUpgradeTestServer(entity)
+	defer server.Close()
+
+	// A dead mirror refuses connections.
+
+	deadListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	deadURL := "http://" + deadListener.Addr().String()
+	deadListener.Close()
+
+	makeStatusServer := func(statusCode int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(statusCode)
+			}))
+	}
+
+	unavailableServer := makeStatusServer(http.StatusServiceUnavailable)
+	defer unavailableServer.Close()
+
+	forbiddenServer := makeStatusServer(http.StatusForbidden)
+	defer forbiddenServer.Close()
+
+	// The interrupted mirror serves a different entity, with a different
+	// ETag, and fails mid-download. The partial download must not be
+	// resumed from the next mirror.
+
+	interruptedServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(testUpgradeClientVersionHeader, "2")
+			w.Header().Set("ETag", `"other"`)
+			w.Header().Set("Content-Length", strconv.Itoa(len(entity)))
+			w.WriteHeader(http.StatusOK)
+			if r.Method == "GET" {
+				w.Write(bytes.Repeat([]byte("x"), len(entity)/2))
+				panic(http.ErrAbortHandler)
+			}
+		}))
+	defer interruptedServer.Close()
+
+	for _, testCase := range []struct {
+		description    string
+		firstMirrorURL string
+		expectFailover bool
+	}{
+		{"dead mirror", deadURL, true},
+		{"unavailable mirror", unavailableServer.URL, true},
+		{"forbidden mirror", forbiddenServer.URL, false},
+		{"interrupted mirror", interruptedServer.URL, true},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			// The mirror candidates are tried in random order. Repeat the
+			// download until the test mirror is tried first.
+
+			for i := 0; ; i++ {
+
+				if i == 32 {
+					t.Fatalf("test mirror not tried first")
+				}
+
+				testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+				if err != nil {
+					t.Fatalf("TempDir failed: %s", err)
+				}
+				defer os.RemoveAll(testDataDirName)
+
+				config := makeUpgradeDownloadTestConfig(
+					t, testDataDirName, "",
+					map[string]interface{}{
+						"UpgradeDownloadURLs": []map[string]interface{}{
+							{"URL": base64.StdEncoding.EncodeToString([]byte(testCase.firstMirrorURL))},
+							{"URL": base64.StdEncoding.EncodeToString([]byte(server.URL))},
+						},
+						"UpgradeDownloadRetries": 0,
+					})
+
+				err = DownloadUpgrade(
+					context.Background(), config, 0, "", nil, &DialConfig{})
+
+				if err != nil {
+					if testCase.expectFailover {
+						t.Fatalf("DownloadUpgrade failed: %s", err)
+					}
+					return
+				}
+
+				upgrade, err := ioutil.ReadFile(config.UpgradeDownloadFilename)
+				if err != nil {
+					t.Fatalf("ReadFile failed: %s", err)
+				}
+				if !bytes.Equal(upgrade, entity) {
+					t.Fatalf("unexpected upgrade")
+				}
+
+				var mirror string
+				select {
+				case mirror = <-mirrors:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("missing ClientUpgradeDownloadMirror notice")
+				}
+
+				if mirror == "0 "+server.URL {
+					continue
+				}
+				if mirror != "1 "+server.URL || !testCase.expectFailover {
+					t.Fatalf("unexpected mirror: %s", mirror)
+				}
+				return
+			}
+		})
+	}
+}
+
+func TestUpgradeDownloadTempDir(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	entity := bytes.Repeat([]byte("upgrade"), 1000)
+
+	// The first download is interrupted, leaving a partial download.
+
+	var interrupted int32
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(testUpgradeClientVersionHeader, "2")
+			w.Header().Set("ETag", `"upgrade"`)
+			if r.Method == "GET" && atomic.CompareAndSwapInt32(&interrupted, 0, 1) {
+				w.Header().Set("Content-Length", strconv.Itoa(len(entity)))
+				w.WriteHeader(http.StatusOK)
+				w.Write(entity[:len(entity)/2])
+				panic(http.ErrAbortHandler)
+			}
+			http.ServeContent(w, r, "", time.Now(), bytes.NewReader(entity))
+		}))
+	defer server.Close()
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	tempDirName := filepath.Join(testDataDirName, "partial", "upgrade")
+
+	config := makeUpgradeDownloadTestConfig(
+		t, testDataDirName, server.URL,
+		map[string]interface{}{
+			"UpgradeDownloadTempDir": tempDirName,
+			"UpgradeDownloadRetries": 0,
+		})
+
+	err = DownloadUpgrade(context.Background(), config, 0, "2", nil, &DialConfig{})
+	if err == nil {
+		t.Fatalf("DownloadUpgrade unexpectedly succeeded")
+	}
+
+	// The partial download is in the temporary directory, not alongside
+	// the destination.
+
+	_, err = os.Stat(filepath.Join(tempDirName, "upgrade.2.part"))
+	if err != nil {
+		t.Fatalf("missing partial download: %s", err)
+	}
+	files, _ := filepath.Glob(config.UpgradeDownloadFilename + "*")
+	if len(files) != 0 {
+		t.Fatalf("unexpected download files: %v", files)
+	}
+
+	// Simulate the temporary directory being on a different filesystem than
+	// the destination: the direct rename fails with EXDEV.
+
+	renameFile = func(oldpath, newpath string) error {
+		if filepath.Dir(oldpath) == tempDirName {
+			return &os.LinkError{
+				Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+		}
+		return os.Rename(oldpath, newpath)
+	}
+	defer func() { renameFile = os.Rename }()
+
+	err = DownloadUpgrade(context.Background(), config, 0, "2", nil, &DialConfig{})
+	if err != nil {
+		t.Fatalf("DownloadUpgrade failed: %s", err)
+	}
+
+	downloaded, err := ioutil.ReadFile(config.UpgradeDownloadFilename)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+	if !bytes.Equal(downloaded, entity) {
+		t.Fatalf("unexpected upgrade download content")
+	}
+
+	files, _ = filepath.Glob(filepath.Join(tempDirName, "*"))
+	if len(files) != 0 {
+		t.Fatalf("unexpected temporary files: %v", files)
+	}
+}
+
+func TestCancelUpgradeDownload(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	entity := bytes.Repeat([]byte("upgrade"), 1000)
+
+	// The server sends part of the upgrade and then stalls, so the download
+	// remains in progress until canceled.
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(testUpgradeClientVersionHeader, "2")
+			w.Header().Set("ETag", `"upgrade"`)
+			w.Header().Set("Content-Length", strconv.Itoa(len(entity)))
+			w.WriteHeader(http.StatusOK)
+			if r.Method == "GET" {
+				w.Write(entity[:len(entity)/2])
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+			}
+		}))
+	defer server.Close()
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config := makeUpgradeDownloadTestConfig(
+		t, testDataDirName, server.URL, nil)
+
+	// Cancel is a no-op when there's no download.
+
+	err = CancelUpgradeDownload(config, "2")
+	if err != nil {
+		t.Fatalf("CancelUpgradeDownload failed: %s", err)
+	}
+
+	downloadErr := make(chan error, 1)
+	go func() {
+		downloadErr <- DownloadUpgrade(
+			context.Background(), config, 0, "2", nil, &DialConfig{})
+	}()
+
+	partialFilename := config.UpgradeDownloadFilename + ".2.part"
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		fileInfo, err := os.Stat(partialFilename)
+		if err == nil && fileInfo.Size() > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("download didn't start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A legacy ETag sidecar, as left by a previous version, is also removed.
+
+	err = ioutil.WriteFile(
+		config.UpgradeDownloadFilename+".2.part.etag", []byte(`"upgrade"`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	err = CancelUpgradeDownload(config, "2")
+	if err != nil {
+		t.Fatalf("CancelUpgradeDownload failed: %s", err)
+	}
+
+	// The download has stopped by the time CancelUpgradeDownload returns.
+
+	select {
+	case err := <-downloadErr:
+		if err == nil {
+			t.Fatalf("DownloadUpgrade unexpectedly succeeded")
+		}
+	default:
+		t.Fatalf("DownloadUpgrade still running")
+	}
+
+	files, _ := filepath.Glob(config.UpgradeDownloadFilename + "*")
+	if len(files) != 0 {
+		t.Fatalf("unexpected download files: %v", files)
+	}
+
+	// With UpgradeDownloadTempDir set, intermediate files left alongside the
+	// destination, from before UpgradeDownloadTempDir was set, are removed
+	// along with those in the temporary directory.
+
+	tempDirName := filepath.Join(testDataDirName, "partial")
+
+	config = makeUpgradeDownloadTestConfig(
+		t, testDataDirName, server.URL,
+		map[string]interface{}{"UpgradeDownloadTempDir": tempDirName})
+
+	err = os.MkdirAll(tempDirName, 0700)
+	if err != nil {
+		t.Fatalf("MkdirAll failed: %s", err)
+	}
+
+	for _, filename := range []string{
+		config.UpgradeDownloadFilename + ".2.part",
+		config.UpgradeDownloadFilename + ".2.part.manifest",
+		config.UpgradeDownloadFilename + ".2.part.etag",
+		filepath.Join(tempDirName, "upgrade.2.part"),
+		filepath.Join(tempDirName, "upgrade.2.part.manifest"),
+	} {
+		err := ioutil.WriteFile(filename, []byte("partial"), 0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+	}
+
+	err = CancelUpgradeDownload(config, "2")
+	if err != nil {
+		t.Fatalf("CancelUpgradeDownload failed: %s", err)
+	}
+
+	files, _ = filepath.Glob(config.UpgradeDownloadFilename + "*")
+	tempFiles, _ := filepath.Glob(filepath.Join(tempDirName, "*"))
+	if len(files) != 0 || len(tempFiles) != 0 {
+		t.Fatalf("unexpected download files: %v %v", files, tempFiles)
+	}
+}
+
+func TestUpgradeDownloadRetryDelay(t *testing.T) {
+
+	for _, testCase := range []struct {
+		base     time.Duration
+		maximum  time.Duration
+		retry    int
+		expected time.Duration
+	}{
+		{time.Second, time.Minute, 0, time.Second},
+		{time.Second, time.Minute, 3, 8 * time.Second},
+		{time.Second, time.Minute, 6, time.Minute},
+		{time.Second, time.Minute, 100, time.Minute},
+		{time.Second, time.Millisecond, 3, time.Second},
+	} {
+		delay := upgradeDownloadRetryDelay(
+			testCase.base, testCase.maximum, testCase.retry)
+		if delay != testCase.expected {
+			t.Fatalf("unexpected delay for retry %d: %s", testCase.retry, delay)
+		}
+	}
+}
+
+func TestUpgradeDownloadTempDirDiskSpace(t *testing.T) {
+
+	SetNoticeWriter(ioutil.Discard)
+	defer SetNoticeWriter(os.Stderr)
+
+	entity := bytes.Repeat([]byte("upgrade"), 1000)
+
+	server := makeUpgradeTestServer(entity)
+	defer server.Close()
+
+	for _, testCase := range []struct {
+		description            string
+		sameFilesystem         bool
+		destinationBytes       int64
+		expectSuccess          bool
+		expectDestinationCheck bool
+	}{
+		{"same filesystem", true, 0, true, false},
+		{"sufficient destination space", false, int64(len(entity)), true, true},
+		{"insufficient destination space", false, int64(len(entity)) - 1, false, true},
+	} {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			testDataDirName, err := ioutil.TempDir("", "psiphon-upgrade-download-test")
+			if err != nil {
+				t.Fatalf("TempDir failed: %s", err)
+			}
+			defer os.RemoveAll(testDataDirName)
+
+			tempDirName := filepath.Join(testDataDirName, "partial")
+
+			config := makeUpgradeDownloadTestConfig(
+				t, testDataDirName, server.URL,
+				map[string]interface{}{
+					"UpgradeDownloadTempDir":              tempDirName,
+					"UpgradeDownloadDiskSpaceMarginBytes": 0,
+				})
+
+			// Simulate the temporary directory being on a separate
+			// filesystem with ample space, and the destination directory
+			// having only destinationBytes available.
+
+			destinationChecked := false
+
+			availableDiskSpace = func(path string) (int64, error) {
+				if path == tempDirName {
+					return 1 << 40, nil
+				}
+				destinationChecked = true
+				return testCase.destinationBytes, nil
+			}
+			sameFilesystem = func(_, _ string) (bool, error) {
+				return testCase.sameFilesystem, nil
+			}
+			defer func() {
+				availableDiskSpace = getAvailableDiskSpace
+				sameFilesystem = isSameFilesystem
+			}()
+
+			err = DownloadUpgrade(
+				context.Background(), config, 0, "2", nil, &DialConfig{})
+
+			if destinationChecked != testCase.expectDestinationCheck {
+				t.Fatalf("unexpected destination check: %v", destinationChecked)
+			}
+
+			if testCase.expectSuccess {
+				if err != nil {
+					t.Fatalf("DownloadUpgrade failed: %s", err)
+				}
+				return
+			}
+
+			if err != ErrInsufficientDiskSpace {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// The download fails before it starts, not after it completes.
+
+			files, _ := filepath.Glob(filepath.Join(tempDirName, "*"))
+			if len(files) > 0 {
+				t.Fatalf("unexpected download files: %v", files)
+			}
+		})
+	}
+}
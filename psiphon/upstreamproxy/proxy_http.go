@@ -47,6 +47,7 @@ package upstreamproxy
 
 import (
 	"bufio"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
@@ -57,13 +58,15 @@ import (
 	"golang.org/x/net/proxy"
 )
 
-// httpProxy is a HTTP connect proxy.
+// httpProxy is a HTTP connect proxy. When tlsConfig is set, the connection
+// to the proxy is made using TLS; this is an HTTPS proxy.
 type httpProxy struct {
 	hostPort      string
 	username      string
 	password      string
 	forward       proxy.Dialer
 	customHeaders http.Header
+	tlsConfig     *tls.Config
 }
 
 func newHTTP(uri *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
@@ -82,6 +85,19 @@ func newHTTP(uri *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
 	return hp, nil
 }
 
+func newHTTPS(uri *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	dialer, err := newHTTP(uri, forward)
+	if err != nil {
+		return nil, err
+	}
+	hp := dialer.(*httpProxy)
+	if uri.Port() == "" {
+		hp.hostPort = net.JoinHostPort(uri.Hostname(), "443")
+	}
+	hp.tlsConfig = &tls.Config{ServerName: uri.Hostname()}
+	return hp, nil
+}
+
 func (hp *httpProxy) Dial(network, addr string) (net.Conn, error) {
 	// Dial and create the http client connection.
 	pc := &proxyConn{
@@ -89,6 +105,7 @@ func (hp *httpProxy) Dial(network, addr string) (net.Conn, error) {
 		dialFn:        hp.forward.Dial,
 		proxyAddr:     hp.hostPort,
 		customHeaders: hp.customHeaders,
+		tlsConfig:     hp.tlsConfig,
 	}
 	err := pc.makeNewClientConn()
 	if err != nil {
@@ -124,6 +141,7 @@ type proxyConn struct {
 	dialFn         DialFunc
 	proxyAddr      string
 	customHeaders  http.Header
+	tlsConfig      *tls.Config
 	httpClientConn *httputil.ClientConn
 	hijackedConn   net.Conn
 	staleReader    *bufio.Reader
@@ -233,6 +251,15 @@ func (pc *proxyConn) makeNewClientConn() error {
 	if err != nil {
 		return proxyError(fmt.Errorf("makeNewClientConn: %v", err))
 	}
+	if pc.tlsConfig != nil {
+		tlsConn := tls.Client(c, pc.tlsConfig)
+		err = tlsConn.Handshake()
+		if err != nil {
+			c.Close()
+			return proxyError(fmt.Errorf("makeNewClientConn: TLS handshake: %v", err))
+		}
+		c = tlsConn
+	}
 	pc.httpClientConn = httputil.NewClientConn(c, nil)
 	return nil
 }
@@ -277,4 +304,5 @@ func (pc *proxyConn) SetWriteDeadline(t time.Time) error {
 
 func init() {
 	proxy.RegisterDialerType("http", newHTTP)
+	proxy.RegisterDialerType("https", newHTTPS)
 }
@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package upstreamproxy
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// connectProxyHandler is a minimal HTTP CONNECT proxy which requires basic
+// authentication.
+func connectProxyHandler(username, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		expectedAuth := "Basic " + base64.StdEncoding.EncodeToString(
+			[]byte(username+":"+password))
+
+		if r.Method != "CONNECT" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if r.Header.Get("Proxy-Authorization") != expectedAuth {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+
+		targetConn, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer targetConn.Close()
+
+		w.WriteHeader(http.StatusOK)
+
+		conn, buffer, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		go io.Copy(targetConn, buffer)
+		io.Copy(conn, targetConn)
+	})
+}
+
+// runEchoServer runs a TCP echo server and returns its address.
+func runEchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestHTTPConnectProxy(t *testing.T) {
+
+	echoServer := runEchoServer(t)
+	defer echoServer.Close()
+
+	username := "user"
+	password := "password"
+
+	for _, useTLS := range []bool{false, true} {
+
+		var proxyServer *httptest.Server
+		if useTLS {
+			proxyServer = httptest.NewTLSServer(connectProxyHandler(username, password))
+		} else {
+			proxyServer = httptest.NewServer(connectProxyHandler(username, password))
+		}
+
+		proxyURL, _ := url.Parse(proxyServer.URL)
+		proxyURL.User = url.UserPassword(username, password)
+
+		config := &UpstreamProxyConfig{
+			ForwardDialFunc: net.Dial,
+			ProxyURIString:  proxyURL.String(),
+		}
+
+		var dial DialFunc
+
+		if useTLS {
+
+			// Trust the test server certificate.
+
+			dialer, err := newHTTPS(proxyURL, config)
+			if err != nil {
+				t.Fatalf("newHTTPS failed: %s", err)
+			}
+			rootCAs := x509.NewCertPool()
+			rootCAs.AddCert(proxyServer.Certificate())
+			dialer.(*httpProxy).tlsConfig.RootCAs = rootCAs
+			dial = dialer.Dial
+
+		} else {
+
+			dial = NewProxyDialFunc(config)
+		}
+
+		conn, err := dial("tcp", echoServer.Addr().String())
+		if err != nil {
+			t.Fatalf("dial failed (TLS: %v): %s", useTLS, err)
+		}
+
+		message := []byte("upstream proxy test")
+		_, err = conn.Write(message)
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+
+		response := make([]byte, len(message))
+		_, err = io.ReadFull(conn, response)
+		if err != nil {
+			t.Fatalf("ReadFull failed: %s", err)
+		}
+
+		if !bytes.Equal(message, response) {
+			t.Fatalf("unexpected response")
+		}
+
+		conn.Close()
+		proxyServer.Close()
+	}
+}
+
+func TestHTTPSProxyUntrusted(t *testing.T) {
+
+	proxyServer := httptest.NewTLSServer(connectProxyHandler("", ""))
+	defer proxyServer.Close()
+
+	// The test server certificate isn't trusted, so the TLS handshake with
+	// the proxy must fail.
+
+	dial := NewProxyDialFunc(&UpstreamProxyConfig{
+		ForwardDialFunc: net.Dial,
+		ProxyURIString:  proxyServer.URL,
+	})
+
+	_, err := dial("tcp", "127.0.0.1:1")
+	if err == nil {
+		t.Fatalf("dial unexpectedly succeeded")
+	}
+}
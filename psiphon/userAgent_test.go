@@ -200,6 +200,7 @@ func attemptConnectionsWithUserAgent(
         "PropagationChannelId" : "0",
         "ConnectionPoolSize" : 1,
         "EstablishTunnelPausePeriodSeconds" : 1,
+        "EstablishTunnelPausePeriodMaxSeconds" : 1,
         "DisableRemoteServerListFetcher" : true,
         "TransformHostNames" : "never",
         "UpstreamProxyUrl" : "http://127.0.0.1:2163"
@@ -29,9 +29,11 @@ import (
 	"os"
 	"runtime"
 	"runtime/debug"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/Psiphon-Inc/goarista/monotime"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
 )
@@ -113,18 +115,43 @@ func IsAddressInUseError(err error) bool {
 
 // SyncFileWriter wraps a file and exposes an io.Writer. At predefined
 // steps, the file is synced (flushed to disk) while writing.
+// SyncFileWriter also exposes an io.WriterAt, which may be called
+// concurrently.
+//
+// Periodic syncing may leave the tail of the file unsynced; call Sync
+// after the final write.
 type SyncFileWriter struct {
-	file  *os.File
-	step  int
-	count int
+	file     *os.File
+	step     int
+	period   time.Duration
+	mutex    sync.Mutex
+	count    int
+	lastSync monotime.Time
+	syncHook func()
 }
 
 // NewSyncFileWriter creates a SyncFileWriter.
 func NewSyncFileWriter(file *os.File) *SyncFileWriter {
+	return NewBatchingSyncFileWriter(file, 0, 0)
+}
+
+// NewBatchingSyncFileWriter creates a SyncFileWriter which batches syncs,
+// for higher throughput on storage where syncing is slow. The file is
+// synced at most once per stepBytes written and, when period is not 0, at
+// most once per period; a sync is made once both have passed. When
+// stepBytes is 0, the NewSyncFileWriter default is used.
+func NewBatchingSyncFileWriter(
+	file *os.File, stepBytes int, period time.Duration) *SyncFileWriter {
+
+	if stepBytes <= 0 {
+		stepBytes = 2 << 16
+	}
 	return &SyncFileWriter{
-		file:  file,
-		step:  2 << 16,
-		count: 0}
+		file:     file,
+		step:     stepBytes,
+		period:   period,
+		count:    0,
+		lastSync: monotime.Now()}
 }
 
 // Write implements io.Writer with periodic file syncing.
@@ -133,12 +160,54 @@ func (writer *SyncFileWriter) Write(p []byte) (n int, err error) {
 	if err != nil {
 		return
 	}
+	err = writer.sync(n)
+	return
+}
+
+// WriteAt implements io.WriterAt with periodic file syncing.
+func (writer *SyncFileWriter) WriteAt(p []byte, offset int64) (n int, err error) {
+	n, err = writer.file.WriteAt(p, offset)
+	if err != nil {
+		return
+	}
+	err = writer.sync(n)
+	return
+}
+
+// SetSyncHook sets a function which is called after each successful
+// periodic sync. The hook is called with the writer's lock held and must
+// not call back into the writer.
+func (writer *SyncFileWriter) SetSyncHook(hook func()) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	writer.syncHook = hook
+}
+
+// Sync syncs the file, including any writes not yet synced by periodic
+// syncing.
+func (writer *SyncFileWriter) Sync() error {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	writer.count = 0
+	writer.lastSync = monotime.Now()
+	return writer.file.Sync()
+}
+
+func (writer *SyncFileWriter) sync(n int) error {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
 	writer.count += n
-	if writer.count >= writer.step {
-		err = writer.file.Sync()
+	if writer.count >= writer.step &&
+		(writer.period == 0 || monotime.Since(writer.lastSync) >= writer.period) {
 		writer.count = 0
+		writer.lastSync = monotime.Now()
+		err := writer.file.Sync()
+		if err == nil && writer.syncHook != nil {
+			writer.syncHook()
+		}
+		return err
 	}
-	return
+	return nil
 }
 
 // emptyAddr implements the net.Addr interface. emptyAddr is intended to be
@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSyncFileWriter(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-sync-file-writer-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	testCases := []struct {
+		description   string
+		stepBytes     int
+		period        time.Duration
+		expectPending bool
+	}{
+		{"default", 0, 0, false},
+		{"batching by bytes", 1 << 20, 0, true},
+		{"batching by period", 1, 1 * time.Hour, true},
+	}
+
+	data := bytes.Repeat([]byte{0xAA}, 4096)
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			file, err := os.Create(
+				filepath.Join(testDataDirName, testCase.description))
+			if err != nil {
+				t.Fatalf("Create failed: %s", err)
+			}
+			defer file.Close()
+
+			writer := NewBatchingSyncFileWriter(file, testCase.stepBytes, testCase.period)
+
+			for i := 0; i < 64; i++ {
+				_, err := writer.Write(data)
+				if err != nil {
+					t.Fatalf("Write failed: %s", err)
+				}
+			}
+
+			// With the default step, 256K written is a multiple of the step,
+			// so all writes have been synced.
+
+			if (writer.count > 0) != testCase.expectPending {
+				t.Fatalf("unexpected unsynced byte count: %d", writer.count)
+			}
+
+			// The final sync must always sync any pending writes.
+
+			err = writer.Sync()
+			if err != nil {
+				t.Fatalf("Sync failed: %s", err)
+			}
+
+			if writer.count != 0 {
+				t.Fatalf("unexpected unsynced byte count after Sync: %d", writer.count)
+			}
+		})
+	}
+}
+
+func BenchmarkSyncFileWriter(b *testing.B) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-sync-file-writer-benchmark")
+	if err != nil {
+		b.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	data := make([]byte, 32768)
+
+	run := func(b *testing.B, stepBytes int, period time.Duration) {
+
+		file, err := os.Create(filepath.Join(testDataDirName, "benchmark"))
+		if err != nil {
+			b.Fatalf("Create failed: %s", err)
+		}
+		defer file.Close()
+
+		writer := NewBatchingSyncFileWriter(file, stepBytes, period)
+
+		b.SetBytes(int64(len(data)))
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			_, err := writer.Write(data)
+			if err != nil {
+				b.Fatalf("Write failed: %s", err)
+			}
+		}
+
+		err = writer.Sync()
+		if err != nil {
+			b.Fatalf("Sync failed: %s", err)
+		}
+	}
+
+	b.Run("default", func(b *testing.B) { run(b, 0, 0) })
+	b.Run("batching", func(b *testing.B) { run(b, 1048576, 1*time.Second) })
+}